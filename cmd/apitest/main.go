@@ -63,8 +63,9 @@ func main() {
 	fmt.Println("🚀 GitHub Copilot API Tester")
 	fmt.Println("----------------------------")
 	fmt.Printf("Prompt: %s\n", *prompt)
-	fmt.Printf("Editor Version: %s\n", getOrDefault(service.GetConfig().EditorVersion, "vscode/1.99.2"))
-	fmt.Printf("Plugin Version: %s\n", getOrDefault(service.GetConfig().EditorPluginVersion, "copilot-chat/0.26.3"))
+	editor, plugin := utils.EditorVersions()
+	fmt.Printf("Editor Version: %s\n", editor)
+	fmt.Printf("Plugin Version: %s\n", plugin)
 
 	// Debug token information if requested
 	if *debugToken {
@@ -99,11 +100,3 @@ func main() {
 	fmt.Println(response)
 	fmt.Println("----------------------------")
 }
-
-// getOrDefault returns the value if non-empty, otherwise returns the default value
-func getOrDefault(value, defaultValue string) string {
-	if value == "" {
-		return defaultValue
-	}
-	return value
-}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"copilot-proxy/internal/app"
+	"copilot-proxy/internal/auth"
+	"copilot-proxy/internal/llm"
+	"copilot-proxy/pkg/models"
+	"copilot-proxy/pkg/utils"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// cliToken authorizes the requests made from the command line, which use
+// the proxy's own Copilot credentials and are not subject to key scopes
+var cliToken = &models.LLMToken{
+	UserID:                 1,
+	GithubUserLogin:        "cli",
+	IsStaff:                true,
+	HasLLMSubscription:     true,
+	MaxMonthlySpendInCents: 10000,
+}
+
+var loginCommand = command{
+	name:    "login",
+	usage:   "login [flags]",
+	summary: "Sign in to GitHub with the device flow and save the OAuth token",
+	run:     login,
+}
+
+// login obtains a GitHub OAuth token with the device flow and saves it where
+// later runs find it.
+func login(args []string) error {
+	fs := newFlagSet(command{name: "login", usage: "login [flags]", summary: "Signs in to GitHub with the device flow: open the printed URL and enter the code.\nThe OAuth token is saved for later runs."})
+	upstreamFlags(fs)
+	if rest := parseArgs(fs, args); len(rest) > 0 {
+		return fmt.Errorf("login takes no arguments, got %q", rest)
+	}
+	if err := applyEnvFlags(fs); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	flow := auth.NewDeviceFlow()
+	code, err := flow.RequestCode(ctx)
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	fmt.Printf("Open %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+	fmt.Println("Waiting for authorization...")
+	token, err := flow.PollToken(ctx, code)
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	path, err := utils.SaveCopilotOAuthToken(token)
+	if err != nil {
+		return fmt.Errorf("login failed: failed to save OAuth token: %w", err)
+	}
+	fmt.Printf("Logged in; the OAuth token was saved to %s\n", path)
+
+	// Make sure the account can actually use Copilot
+	if _, err := app.NewApp().GetAPIKey(token); err != nil {
+		fmt.Printf("Warning: the token could not be exchanged for a Copilot API key: %v\n", err)
+	} else {
+		fmt.Println("Copilot access verified")
+	}
+	return nil
+}
+
+var modelsCommand = command{
+	name:    "models",
+	usage:   "models [flags]",
+	summary: "List the available models",
+	run:     listModels,
+}
+
+// listModels prints the models of the Copilot account and the configured
+// providers
+func listModels(args []string) error {
+	fs := newFlagSet(command{name: "models", usage: "models [flags]", summary: "Lists the models of the Copilot account and the configured providers."})
+	asJSON := fs.Bool("json", false, "Print the models as JSON")
+	upstreamFlags(fs)
+	if rest := parseArgs(fs, args); len(rest) > 0 {
+		return fmt.Errorf("models takes no arguments, got %q", rest)
+	}
+	if err := applyEnvFlags(fs); err != nil {
+		return err
+	}
+
+	list, err := copilotService().Models(cliToken, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list models: %w", err)
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPROVIDER\tCONTEXT WINDOW")
+	for _, model := range list {
+		window := "-"
+		if model.ContextWindow > 0 {
+			window = fmt.Sprint(model.ContextWindow)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", model.ID, model.Provider, window)
+	}
+	return w.Flush()
+}
+
+var testCommand = command{
+	name:    "test",
+	usage:   "test <auth|call|copilot> [flags] [arguments]",
+	summary: "Test API keys and the Copilot API",
+}
+
+func init() {
+	testCommand.run = func(args []string) error {
+		return dispatch(testCommand, []command{
+			{name: "test auth", usage: "test auth [KEY]", summary: "Test an API key or Copilot token", run: testAuth},
+			{name: "test call", usage: "test call PAYLOAD", summary: "Make a test call to verify the API is working", run: testCall},
+			{name: "test copilot", usage: "test copilot [PROMPT]", summary: "Stream a sample prompt from the Copilot API", run: testCopilot},
+		}, args)
+	}
+}
+
+// testAuth checks whether a key is a valid application API key or Copilot
+// API token; without one, the Copilot API key is retrieved and checked
+func testAuth(args []string) error {
+	fs := newFlagSet(command{name: "test auth", usage: "test auth [flags] [KEY]", summary: "Tests whether KEY is a valid application API key or GitHub Copilot token.\nWithout KEY the Copilot API key is retrieved and tested."})
+	upstreamFlags(fs)
+	rest := parseArgs(fs, args)
+	if len(rest) > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected at most one key, got %d arguments", len(rest))
+	}
+	if err := applyEnvFlags(fs); err != nil {
+		return err
+	}
+	if keyStore, err := openKeyStore(); err == nil {
+		defer keyStore.Close()
+	}
+
+	var apiKey string
+	if len(rest) == 1 {
+		apiKey = rest[0]
+	} else {
+		// If no API key was provided in the argument, try to get it from our API key retrieval process
+		log.Println("No API key provided as argument, trying to retrieve automatically...")
+		var err error
+		if apiKey, err = app.NewApp().GetCopilotAPIKey(); err != nil {
+			return fmt.Errorf("failed to automatically retrieve API key: %w", err)
+		}
+		log.Printf("Using API key retrieved automatically")
+	}
+
+	if auth.VerifyAppAPIKey(apiKey) {
+		fmt.Println("✅ Valid application API key")
+	} else if auth.VerifyCopilotAPIKey(apiKey) {
+		fmt.Println("✅ Valid GitHub Copilot API token")
+	} else {
+		return fmt.Errorf("❌ Invalid API key or token")
+	}
+	return nil
+}
+
+// testCall makes a test call to verify the API is working
+func testCall(args []string) error {
+	fs := newFlagSet(command{name: "test call", usage: "test call [flags] PAYLOAD", summary: "Makes a test call with PAYLOAD to verify the API is working."})
+	upstreamFlags(fs)
+	rest := parseArgs(fs, args)
+	if len(rest) == 0 {
+		fs.Usage()
+		return fmt.Errorf("a payload is required")
+	}
+	if err := applyEnvFlags(fs); err != nil {
+		return err
+	}
+
+	response, err := app.NewApp().TestAPI(strings.Join(rest, " "))
+	if err != nil {
+		return fmt.Errorf("test call failed: %w", err)
+	}
+	fmt.Printf("Test call response: %s\n", response)
+	return nil
+}
+
+// defaultTestPrompt is streamed by test copilot without a prompt
+const defaultTestPrompt = "Write a Go function to reverse a string"
+
+// testCopilot exchanges the OAuth token for an API key and streams a test
+// prompt from the Copilot API
+func testCopilot(args []string) error {
+	fs := newFlagSet(command{name: "test copilot", usage: "test copilot [flags] [PROMPT]", summary: "Exchanges the OAuth token for a Copilot API key and streams the answer to PROMPT."})
+	upstreamFlags(fs)
+	rest := parseArgs(fs, args)
+	if err := applyEnvFlags(fs); err != nil {
+		return err
+	}
+	prompt := defaultTestPrompt
+	if len(rest) > 0 {
+		prompt = strings.Join(rest, " ")
+	}
+
+	log.Println("Starting Copilot API test...")
+
+	// Step 1: Read OAuth token from .env
+	log.Println("Reading OAuth token from environment variables...")
+	oauthToken, err := utils.GetCopilotOAuthToken()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve OAuth token: %w", err)
+	}
+	log.Printf("Successfully retrieved OAuth token: %s", utils.MaskToken(oauthToken))
+
+	// Step 2: Exchange OAuth token for API key
+	log.Println("Exchanging OAuth token for API key...")
+	apiKey, err := app.NewApp().GetAPIKey(oauthToken)
+	if err != nil {
+		return fmt.Errorf("failed to exchange OAuth token for API key: %w", err)
+	}
+	log.Printf("Successfully retrieved API key: %s", utils.MaskToken(apiKey))
+
+	// Step 3: Submit a test request to the Copilot API with streaming
+	log.Println("Submitting test request to Copilot API (streaming mode)...")
+
+	// Set the API key in the config environment variable so NewService() picks it up
+	os.Setenv("COPILOT_API_KEY", apiKey)
+	if err := llm.NewService().SubmitStreamingTestPrompt(prompt); err != nil {
+		return fmt.Errorf("failed to submit streaming test request: %w", err)
+	}
+	return nil
+}
+
+var chatCommand = command{
+	name:    "chat",
+	usage:   "chat [flags] [PROMPT]",
+	summary: "Chat with a model from the terminal",
+	run:     chat,
+}
+
+// chat sends a prompt to a model and streams the answer. Without a prompt
+// it reads one message per line from standard input and keeps the
+// conversation until the input ends.
+func chat(args []string) error {
+	fs := newFlagSet(command{name: "chat", usage: "chat [flags] [PROMPT]", summary: "Sends PROMPT to a model and streams the answer. Without PROMPT one message per\nline is read from standard input and the conversation continues until the\ninput ends."})
+	model := fs.String("model", "gpt-4o", "Model to chat with")
+	system := fs.String("system", "", "System message that starts the conversation")
+	upstreamFlags(fs)
+	rest := parseArgs(fs, args)
+	if err := applyEnvFlags(fs); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	service := copilotService()
+	var messages []map[string]string
+	if *system != "" {
+		messages = append(messages, map[string]string{"role": "system", "content": *system})
+	}
+	send := func(prompt string) error {
+		messages = append(messages, map[string]string{"role": "user", "content": prompt})
+		request, err := json.Marshal(map[string]interface{}{"model": *model, "messages": messages})
+		if err != nil {
+			return err
+		}
+		result, err := service.StreamChat(llm.CompletionRequest{
+			Context:         ctx,
+			Model:           *model,
+			ProviderRequest: string(request),
+			Token:           cliToken,
+		}, func(delta llm.ChatDelta) {
+			fmt.Print(delta.Content)
+		})
+		fmt.Println()
+		if err != nil {
+			return fmt.Errorf("chat failed: %w", err)
+		}
+		messages = append(messages, map[string]string{"role": "assistant", "content": result.Content})
+		return nil
+	}
+
+	if len(rest) > 0 {
+		return send(strings.Join(rest, " "))
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+		prompt := strings.TrimSpace(scanner.Text())
+		if prompt == "" {
+			continue
+		}
+		if err := send(prompt); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+var usageCommand = command{
+	name:    "usage",
+	usage:   "usage export [flags] [csv|jsonl]",
+	summary: "Export recorded usage",
+}
+
+func init() {
+	usageCommand.run = func(args []string) error {
+		return dispatch(usageCommand, []command{
+			{name: "usage export", usage: "usage export [flags] [csv|jsonl]", summary: "Write recorded usage to stdout", run: exportUsage},
+		}, args)
+	}
+}
+
+// exportUsage writes the usage recorded in the configured usage store to
+// stdout in the given format.
+func exportUsage(args []string) error {
+	fs := newFlagSet(command{name: "usage export", usage: "usage export [flags] [csv|jsonl]", summary: "Writes recorded usage to stdout as csv (the default) or jsonl."})
+	sinceValue := fs.String("since", "", "Only export usage from this time on (RFC 3339 or YYYY-MM-DD)")
+	untilValue := fs.String("until", "", "Only export usage before this time (RFC 3339 or YYYY-MM-DD, default: now)")
+	key := fs.String("key", "", "Only export usage of this API key")
+	rest := parseArgs(fs, args)
+	if len(rest) > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected at most one format, got %d arguments", len(rest))
+	}
+	format := "csv"
+	if len(rest) == 1 {
+		format = rest[0]
+	}
+
+	since, err := llm.ParseUsageTime(*sinceValue)
+	if err != nil {
+		return fmt.Errorf("usage export failed: %w", err)
+	}
+	until := time.Now()
+	if *untilValue != "" {
+		if until, err = llm.ParseUsageTime(*untilValue); err != nil {
+			return fmt.Errorf("usage export failed: %w", err)
+		}
+	}
+	store, err := llm.OpenUsageStore(llm.GetConfig())
+	if err != nil {
+		return fmt.Errorf("usage export failed: %w", err)
+	}
+	defer store.Close()
+	if err := llm.ExportUsage(os.Stdout, store, format, since, until, *key); err != nil {
+		return fmt.Errorf("usage export failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"copilot-proxy/pkg/utils"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// daemonChildEnv marks the background process started by --daemon, which
+// must not daemonize again
+const daemonChildEnv = "COPROXY_DAEMON_CHILD"
+
+// daemonStartupWait is how long --daemon waits for the background process
+// to fail, e.g. because another instance holds the PID file
+const daemonStartupWait = 2 * time.Second
+
+// daemonize starts the server again as a background process detached from
+// the terminal and returns its PID. Its standard output and error are
+// discarded: it opens logPath, if any, itself, so the log is written once
+// and follows rotation. A background process that exits during startup is
+// reported as an error.
+func daemonize(logPath string) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to locate the executable: %w", err)
+	}
+	output, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", os.DevNull, err)
+	}
+	defer output.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonChildEnv+"=1")
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start the background process: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err == nil {
+			err = errors.New("exited")
+		}
+		where := "no log file was given"
+		if logPath != "" {
+			where = "see " + logPath
+		}
+		return 0, fmt.Errorf("the background process failed to start (%v); %s", err, where)
+	case <-time.After(daemonStartupWait):
+		return cmd.Process.Pid, nil
+	}
+}
+
+// checkNotRunning returns an error if the PID file at path names another
+// process that is still running. A missing or stale file is ignored.
+func checkNotRunning(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read PID file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || pid == os.Getpid() || !processRunning(pid) {
+		return nil
+	}
+	return fmt.Errorf("coproxy is already running with PID %d (%s)", pid, path)
+}
+
+// acquirePIDFile writes the PID of this process to path. It refuses to
+// start when the file names another running process, and replaces a stale
+// file left behind by a crash. The returned function removes the file.
+func acquirePIDFile(path string) (func(), error) {
+	// O_EXCL makes a concurrent start lose the race for the file
+	const flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	file, err := os.OpenFile(path, flags, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		if err := checkNotRunning(path); err != nil {
+			return nil, err
+		}
+		// Replace the stale file, once
+		os.Remove(path)
+		file, err = os.OpenFile(path, flags, 0o644)
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("coproxy is already starting (%s)", path)
+		}
+		return nil, fmt.Errorf("failed to create PID file: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write PID file: %w", err)
+	}
+	return func() {
+		// Only remove the file while it is still ours
+		if data, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(os.Getpid()) {
+			os.Remove(path)
+		}
+	}, nil
+}
+
+// openLogFile opens path for appending with the rotation configured by the
+// LOG_* variables and sends the log to it
+func openLogFile(path string) (*utils.LogFile, error) {
+	rotation, err := utils.LogRotationFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	l, err := utils.OpenLogFile(path, rotation)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(utils.NewRedactingWriter(l))
+	return l, nil
+}
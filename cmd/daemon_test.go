@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// exitedPID returns the PID of a process that has already exited
+func exitedPID(t *testing.T) int {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestAcquirePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coproxy.pid")
+	ownPID := strconv.Itoa(os.Getpid())
+
+	// A stale file left behind by a crash is replaced
+	os.WriteFile(path, []byte(strconv.Itoa(exitedPID(t))+"\n"), 0o644)
+	if err := checkNotRunning(path); err != nil {
+		t.Errorf("checkNotRunning(stale PID) error = %v", err)
+	}
+	release, err := acquirePIDFile(path)
+	if err != nil {
+		t.Fatalf("acquirePIDFile(stale PID) error = %v", err)
+	}
+	if data, _ := os.ReadFile(path); strings.TrimSpace(string(data)) != ownPID {
+		t.Errorf("PID file = %q, want %s", data, ownPID)
+	}
+
+	// The file is removed on exit
+	release()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("PID file after release: %v", err)
+	}
+
+	// A file naming a running process is left alone
+	running := strconv.Itoa(os.Getppid())
+	os.WriteFile(path, []byte(running+"\n"), 0o644)
+	if err := checkNotRunning(path); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("checkNotRunning(live PID) error = %v", err)
+	}
+	if _, err := acquirePIDFile(path); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("acquirePIDFile(live PID) error = %v", err)
+	}
+	if data, _ := os.ReadFile(path); strings.TrimSpace(string(data)) != running {
+		t.Errorf("PID file = %q, want %s", data, running)
+	}
+}
+
+func TestReleasePIDFileKeepsOtherProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coproxy.pid")
+	release, err := acquirePIDFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another instance took over the file
+	os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())+"\n"), 0o644)
+	release()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("PID file of another process was removed: %v", err)
+	}
+}
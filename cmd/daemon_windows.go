@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// detachedProcAttr starts the background process without a console window
+func detachedProcAttr() *syscall.SysProcAttr {
+	const createNewProcessGroup, detachedProcess = 0x00000200, 0x00000008
+	return &syscall.SysProcAttr{CreationFlags: createNewProcessGroup | detachedProcess}
+}
+
+// processRunning reports whether a process with the given PID exists
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"copilot-proxy/internal/app"
+	"copilot-proxy/internal/auth"
+	"copilot-proxy/pkg/utils"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var keyCommand = command{
+	name:    "key",
+	usage:   "key <create|list|revoke|rotate|copilot> [flags] [arguments]",
+	summary: "Issue, list, revoke or rotate named API keys, or print a Copilot API key",
+}
+
+func init() {
+	keyCommand.run = func(args []string) error {
+		return dispatch(keyCommand, []command{
+			{name: "key create", usage: "key create [flags] NAME", summary: "Issue a named API key and print it", run: createKey},
+			{name: "key list", usage: "key list", summary: "List issued API keys with their status", run: listKeys},
+			{name: "key revoke", usage: "key revoke ID", summary: "Revoke an API key without affecting the others", run: revokeKey},
+			{name: "key rotate", usage: "key rotate [flags] ID", summary: "Issue a replacement for an API key with the same name and scopes", run: rotateKey},
+			{name: "key copilot", usage: "key copilot [OAUTH_TOKEN]", summary: "Exchange a GitHub OAuth token for a Copilot API key and print it", run: copilotKey},
+		}, args)
+	}
+}
+
+// keyStoreOrFail opens the key store for the key commands
+func keyStoreOrFail() (auth.KeyStore, error) {
+	store, err := openKeyStore()
+	if err != nil {
+		return nil, fmt.Errorf("no key store available: %w", err)
+	}
+	return store, nil
+}
+
+// keyExpiry returns when a key issued now with the given lifetime expires,
+// or nil for a key that never expires
+func keyExpiry(expires time.Duration) *time.Time {
+	if expires <= 0 {
+		return nil
+	}
+	t := time.Now().Add(expires).UTC()
+	return &t
+}
+
+// keyID parses the ID argument of a key command
+func keyID(args []string) (uint64, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("expected one key ID, got %d arguments", len(args))
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("invalid key ID %q", args[0])
+	}
+	return id, nil
+}
+
+// createKey issues a named API key
+func createKey(args []string) error {
+	fs := newFlagSet(command{name: "key create", usage: "key create [flags] NAME", summary: "Issues a named API key and prints it. The key is shown only once."})
+	expires := fs.Duration("expires", 0, "Lifetime of the key, e.g. 720h (default: never expires)")
+	models := fs.String("models", "", "Comma-separated models the key may use; a trailing * matches a prefix")
+	endpoints := fs.String("endpoints", "", "Comma-separated request paths the key may call, e.g. /v1/chat/completions")
+	noStreaming := fs.Bool("no-streaming", false, "Reject streaming requests made with the key")
+	rest := parseArgs(fs, args)
+	if len(rest) != 1 || rest[0] == "" {
+		fs.Usage()
+		return fmt.Errorf("expected one key name, got %d arguments", len(rest))
+	}
+
+	store, err := keyStoreOrFail()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	key, err := store.Create(rest[0], keyExpiry(*expires), keyScopes(*models, *endpoints, *noStreaming))
+	if err != nil {
+		return fmt.Errorf("key management failed: %w", err)
+	}
+	fmt.Printf("Created API key %d (%s): %s\n", key.ID, key.Name, key.Key)
+	return nil
+}
+
+// listKeys lists the issued API keys with their status
+func listKeys(args []string) error {
+	fs := newFlagSet(command{name: "key list", usage: "key list", summary: "Lists issued API keys with their status."})
+	if rest := parseArgs(fs, args); len(rest) > 0 {
+		return fmt.Errorf("key list takes no arguments, got %q", rest)
+	}
+
+	store, err := keyStoreOrFail()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	keys, err := store.List()
+	if err != nil {
+		return fmt.Errorf("key management failed: %w", err)
+	}
+	now := time.Now()
+	for _, key := range keys {
+		status := "active"
+		if err := key.Check(now); err != nil {
+			status = err.Error()
+		} else if key.ReplacedBy != 0 {
+			status = fmt.Sprintf("deprecated, replaced by %d", key.ReplacedBy)
+		}
+		expires := "never"
+		if key.ExpiresAt != nil {
+			expires = key.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%d\t%s\tcreated %s\texpires %s\t%s\n", key.ID, key.Name, key.CreatedAt.Format(time.RFC3339), expires, status)
+	}
+	return nil
+}
+
+// revokeKey revokes an API key
+func revokeKey(args []string) error {
+	fs := newFlagSet(command{name: "key revoke", usage: "key revoke ID", summary: "Revokes an API key without affecting the others."})
+	id, err := keyID(parseArgs(fs, args))
+	if err != nil {
+		fs.Usage()
+		return err
+	}
+
+	store, err := keyStoreOrFail()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Revoke(id); err != nil {
+		return fmt.Errorf("key management failed: %w", err)
+	}
+	fmt.Printf("Revoked API key %d\n", id)
+	return nil
+}
+
+// rotateKey issues a replacement for an API key
+func rotateKey(args []string) error {
+	fs := newFlagSet(command{name: "key rotate", usage: "key rotate [flags] ID", summary: "Issues a replacement for an API key with the same name and scopes and prints it.\nThe old key keeps working for the grace period and each use is logged."})
+	grace := fs.Duration("grace", auth.DefaultRotationGrace, "How long the old key keeps working")
+	expires := fs.Duration("expires", 0, "Lifetime of the new key, e.g. 720h (default: never expires)")
+	id, err := keyID(parseArgs(fs, args))
+	if err != nil {
+		fs.Usage()
+		return err
+	}
+
+	store, err := keyStoreOrFail()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	key, err := store.Rotate(id, *grace, keyExpiry(*expires))
+	if err != nil {
+		return fmt.Errorf("key management failed: %w", err)
+	}
+	fmt.Printf("Rotated API key %d to %d (%s): %s\nThe old key keeps working for %s\n", id, key.ID, key.Name, key.Key, *grace)
+	return nil
+}
+
+// copilotKey exchanges a GitHub OAuth token, by default the configured
+// one, for a Copilot API key
+func copilotKey(args []string) error {
+	fs := newFlagSet(command{name: "key copilot", usage: "key copilot [flags] [OAUTH_TOKEN]", summary: "Exchanges a GitHub OAuth token for a Copilot API key and prints it. Without a\ntoken the one from the environment or coproxy login is used."})
+	upstreamFlags(fs)
+	rest := parseArgs(fs, args)
+	if len(rest) > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected at most one OAuth token, got %d arguments", len(rest))
+	}
+	if err := applyEnvFlags(fs); err != nil {
+		return err
+	}
+
+	var oauthToken string
+	if len(rest) == 1 {
+		oauthToken = rest[0]
+	} else {
+		log.Println("No OAuth token provided as argument, trying to retrieve from environment...")
+		var err error
+		if oauthToken, err = utils.GetCopilotOAuthToken(); err != nil {
+			return fmt.Errorf("failed to automatically retrieve OAuth token: %w", err)
+		}
+		log.Printf("Using OAuth token from environment: %s", utils.MaskToken(oauthToken))
+	}
+	apiKey, err := app.NewApp().GetAPIKey(oauthToken)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve API key: %w", err)
+	}
+	fmt.Printf("Retrieved API key: %s\n", apiKey)
+	return nil
+}
+
+// keyScopes builds the scopes of a key issued with key create from
+// comma-separated lists; it returns nil for an unrestricted key.
+func keyScopes(models, endpoints string, noStreaming bool) *auth.KeyScopes {
+	split := func(list string) []string {
+		var values []string
+		for _, v := range strings.Split(list, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+	scopes := &auth.KeyScopes{Models: split(models), Endpoints: split(endpoints), NoStreaming: noStreaming}
+	if len(scopes.Models) == 0 && len(scopes.Endpoints) == 0 && !noStreaming {
+		return nil
+	}
+	return scopes
+}
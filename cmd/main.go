@@ -6,75 +6,173 @@
 //
 // CLI Usage:
 //
-//	The application supports the following command-line flags:
+//	coproxy <command> [flags] [arguments]
 //
-//	--get-api-key="oauth-token"
-//	  Retrieves a GitHub Copilot API key using the provided OAuth token.
-//	  Example: ./coproxy --get-api-key="ghu_your_github_oauth_token"
+// Every command has its own flags; run "coproxy help <command>" or
+// "coproxy <command> --help" to list them. Without a command the server runs.
 //
-//	--test-auth="api-key"
-//	  Tests if an API key or GitHub Copilot token is valid.
-//	  Example: ./coproxy --test-auth="your-api-key"
+//	coproxy serve [flags]
+//	  Runs the proxy server on :8080. --disable-auth accepts all requests
+//	  without an API key.
+//	  Example: ./coproxy serve --disable-auth
 //
-//	--test-call="payload"
-//	  Makes a test call to verify the API is working.
-//	  Example: ./coproxy --test-call="test-message"
+//	--upstream-proxy="http://proxy:3128"
+//	  Sends the token exchange, model and completion requests through a proxy;
+//	  without it HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored. The
+//	  upstream flags are accepted by every command that calls GitHub.
+//	  Example: ./coproxy serve --upstream-proxy=http://proxy.corp.example:3128
 //
-//	--disable-auth
-//	  Disables API key authorization, allowing all API requests without validation.
-//	  Example: ./coproxy --disable-auth
+//	--tls-cert=cert.pem --tls-key=key.pem, --tls-self-signed
+//	  Serve HTTPS instead of HTTP. The certificate is reloaded when its files
+//	  change; --tls-self-signed generates one if the files do not exist.
+//	  Example: ./coproxy serve --tls-self-signed
 //
-//	--test-copilot
-//	  Tests the Copilot API with a sample prompt.
-//	  Example: ./coproxy --test-copilot
+//	--tls-client-ca=ca.pem, --tls-client-auth=optional
+//	  Require client certificates issued by these CAs (mutual TLS). Clients
+//	  are identified by the certificate's common name or first subject
+//	  alternative name for rate limits, usage and the access log;
+//	  --tls-client-auth=optional also admits clients using API keys.
+//	  Example: ./coproxy serve --tls-cert=cert.pem --tls-key=key.pem --tls-client-ca=ca.pem
+//
+//	--grpc-addr=":9090"
+//	  Also serves the gRPC API (internal/rpc/copilotpb/copilot.proto) with the
+//	  Chat, StreamChat and ListModels calls on this address.
+//	  Example: ./coproxy serve --grpc-addr=:9090
+//
+//	--daemon --pid-file=coproxy.pid --log-file=coproxy.log
+//	  Runs the server in the background. The PID file refuses a second start
+//	  while the process it names is running. The log file is rotated by
+//	  LOG_MAX_SIZE and LOG_ROTATE_INTERVAL, keeping LOG_MAX_BACKUPS files
+//	  for LOG_MAX_AGE (gzipped with LOG_COMPRESS), and reopened on SIGHUP.
+//	  Example: ./coproxy serve --daemon --pid-file=/run/coproxy.pid --log-file=/var/log/coproxy.log
+//
+//	--strict
+//	  Rejects chat completion requests that do not match the OpenAI schema
+//	  with an invalid_request_error naming the offending param.
+//	  Example: ./coproxy serve --strict
+//
+//	coproxy login
+//	  Signs in to GitHub with the device flow: open the printed URL, enter the
+//	  code and the OAuth token is saved for later runs.
+//
+//	coproxy models [--json]
+//	  Lists the models available to the Copilot account and the configured
+//	  providers.
+//
+//	coproxy key create|list|revoke|rotate|copilot
+//	  Issue, list or revoke named API keys in the key store (KEY_STORE).
+//	  "key rotate ID" issues a replacement; the old key keeps working for
+//	  --grace (default 24h) and its uses are logged. --models, --endpoints
+//	  and --no-streaming restrict new keys. "key copilot [OAUTH_TOKEN]"
+//	  prints a Copilot API key exchanged for an OAuth token.
+//	  Example: ./coproxy key create my-editor
+//	  Example: ./coproxy key create --models=gpt-4o-mini --endpoints=/v1/chat/completions script
+//
+//	coproxy test auth [KEY] | test call PAYLOAD | test copilot [PROMPT]
+//	  Tests an API key or Copilot token, makes a test call, or streams a
+//	  sample prompt from the Copilot API.
+//
+//	coproxy chat [--model=gpt-4o] [PROMPT]
+//	  Chats with a model from the terminal; without a prompt the messages
+//	  are read from standard input, one per line.
+//
+//	coproxy usage export [--since] [--until] [--key] [csv|jsonl]
+//	  Writes recorded usage to stdout.
+//	  Example: ./coproxy usage export --since=2024-05-01 csv > usage.csv
+//
+//	coproxy version, coproxy --version
+//	  Prints the version, commit and build date, which are set at link time
+//	  (see internal/buildinfo).
+//
+// The flags of earlier versions still work: --get-api-key, --test-auth,
+// --test-call, --test-copilot, --create-key, --list-keys, --revoke-key,
+// --rotate-key and --export-usage run the matching command, and the other
+// flags are passed to serve.
+//
+// On SIGINT or SIGTERM the server stops accepting connections and waits up to
+// --shutdown-timeout (SHUTDOWN_TIMEOUT, default 30s) for active streams;
+// streams still running then receive a final SSE error event.
+//
+// Send SIGHUP or POST /admin/reload to re-read the .env file, the key store,
+// rate limits, budgets and model aliases without dropping open connections.
 //
 // Environment Variables:
-//   - VALID_API_KEYS: Comma-separated list of valid API keys for accessing this application
+//   - KEY_STORE, KEY_STORE_PATH: Store of named API keys ("file" or "sqlite")
+//   - VALID_API_KEYS: Legacy comma-separated list of valid API keys for accessing this application
+//   - BASIC_AUTH_USERS: Comma-separated user:password pairs accepted as HTTP Basic credentials
 //   - DISABLE_AUTH: Set to "true" or "1" to disable API key verification
+//   - MAX_REQUEST_BODY_BYTES: Largest accepted request body (default: 32 MiB)
+//   - IP_ALLOWLIST, IP_DENYLIST: CIDR ranges allowed or denied access
 //   - COPILOT_API_KEY: GitHub Copilot API token
 //   - GITHUB_ACCESS_TOKEN: GitHub API token for additional functionality
-//   - OAUTH_TOKEN: OAuth token for authenticating with GitHub
+//   - OAUTH_TOKEN: OAuth token for authenticating with GitHub (default: the token saved by login)
+//   - GITHUB_CLIENT_ID: OAuth app used by login (default: the Copilot editor plugin app)
 //   - LLM_API_SECRET: Secret key for LLM API access
-//   - STRIPE_API_KEY: Stripe API key for billing functionality
+//   - LLM_SIGNING_KEY_FILE: RSA or Ed25519 private key (PEM) signing LLM tokens
+//     instead of LLM_API_SECRET
+//   - LLM_VERIFY_KEY_FILES: Retired signing keys (PEM, comma-separated) whose tokens are still accepted
+//   - STRIPE_API_KEY: Stripe secret key; reports usage of the keys in
+//     STRIPE_CUSTOMERS_FILE to Stripe (see internal/billing)
 package main
 
 import (
-	"context"
 	"copilot-proxy/internal/app"
 	"copilot-proxy/internal/auth"
+	"copilot-proxy/internal/buildinfo"
 	"copilot-proxy/internal/llm"
 	"copilot-proxy/pkg/utils"
-	"crypto/rand"
-	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"os/signal"
 	"path/filepath"
-	"syscall"
-	"time"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
 
+// secretEnvVars are the environment variables holding credentials without
+// a recognizable format, which log output must never show
+var secretEnvVars = []string{
+	"COPILOT_API_KEY", "OAUTH_TOKEN", "GITHUB_ACCESS_TOKEN", "GITHUB_TOKEN", "COPILOT_OAUTH_TOKENS",
+	"LLM_API_SECRET", "ADMIN_TOKEN", "VALID_API_KEYS", "OPENAI_API_KEY", "ANTHROPIC_API_KEY",
+	"MODERATION_API_KEY", "STRIPE_API_KEY", "BASIC_AUTH_USERS",
+}
+
+// registerSecrets registers the configured credentials for redaction. Lists
+// such as VALID_API_KEYS and COPILOT_OAUTH_TOKENS register every entry.
+func registerSecrets() {
+	for _, name := range secretEnvVars {
+		for _, entry := range strings.Split(os.Getenv(name), ",") {
+			// Pooled tokens may be named "name=token"
+			if _, token, ok := strings.Cut(entry, "="); ok && name == "COPILOT_OAUTH_TOKENS" {
+				entry = token
+			}
+			// Basic auth users are "user:password"
+			if _, password, ok := strings.Cut(entry, ":"); ok && name == "BASIC_AUTH_USERS" {
+				entry = password
+			}
+			utils.RegisterSecret(entry)
+		}
+	}
+}
+
 // loadEnvFile loads environment variables from a .env file if present.
 // It attempts to load from the current directory and parent directories
-// up to the root directory.
-func loadEnvFile() {
+// up to the root directory, and returns the path of the loaded file.
+func loadEnvFile() string {
 	// Try current directory first
 	err := godotenv.Load()
 	if err == nil {
 		log.Println("Loaded environment variables from .env file in current directory")
-		return
+		return ".env"
 	}
 
 	// Get the current working directory
 	workDir, err := os.Getwd()
 	if err != nil {
 		log.Printf("Warning: Could not determine current directory: %v", err)
-		return
+		return ""
 	}
 
 	// Try parent directories recursively
@@ -84,229 +182,337 @@ func loadEnvFile() {
 			err = godotenv.Load(envPath)
 			if err == nil {
 				log.Printf("Loaded environment variables from %s", envPath)
-				return
+				return envPath
 			}
 		}
 	}
 
 	log.Println("No .env file found. Using existing environment variables.")
+	return ""
 }
 
-func testCopilotAPI() {
-	log.Println("Starting Copilot API test...")
+// environKeys returns the names of the variables set in the process
+// environment, which take precedence over the .env file
+func environKeys() map[string]bool {
+	keys := make(map[string]bool)
+	for _, kv := range os.Environ() {
+		if name, _, ok := strings.Cut(kv, "="); ok {
+			keys[name] = true
+		}
+	}
+	return keys
+}
 
-	// Step 1: Read OAuth token from .env
-	log.Println("Reading OAuth token from environment variables...")
-	oauthToken, err := utils.GetCopilotOAuthToken()
-	if err != nil {
-		log.Fatalf("Failed to retrieve OAuth token: %v", err)
+// command is a subcommand of the CLI
+type command struct {
+	name string
+	// usage is the synopsis after "coproxy"
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+// newFlagSet creates the flag set of a command, whose help output shows the
+// command's synopsis and summary before its flags
+func newFlagSet(cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet("coproxy "+cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: coproxy %s\n\n%s\n", cmd.usage, cmd.summary)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(fs.Output(), "\nFlags:")
+			fs.PrintDefaults()
+		}
 	}
-	log.Printf("Successfully retrieved OAuth token: %s", utils.MaskToken(oauthToken))
+	return fs
+}
 
-	// Step 2: Exchange OAuth token for API key
-	log.Println("Exchanging OAuth token for API key...")
-	application := app.NewApp()
-	apiKey, err := application.GetAPIKey(oauthToken)
-	if err != nil {
-		log.Fatalf("Failed to exchange OAuth token for API key: %v", err)
+// parseArgs parses the flags of a command, which may appear before or after
+// its arguments, and returns the arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		// Everything after "--" is an argument
+		if len(args) > len(rest) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
 	}
-	log.Printf("Successfully retrieved API key: %s", utils.MaskToken(apiKey))
+}
 
-	// Step 3: Submit a test request to the Copilot API with streaming
-	log.Println("Submitting test request to Copilot API (streaming mode)...")
+// dispatch runs the subcommand of a command group such as "key" named by
+// the first argument
+func dispatch(group command, subcommands []command, args []string) error {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: coproxy %s\n\n%s\n\nCommands:\n", group.usage, group.summary)
+		for _, sub := range subcommands {
+			fmt.Fprintf(os.Stderr, "  %-28s %s\n", sub.usage, sub.summary)
+		}
+	}
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		usage()
+		return nil
+	}
+	for _, sub := range subcommands {
+		if sub.name == group.name+" "+args[0] {
+			return sub.run(args[1:])
+		}
+	}
+	usage()
+	os.Exit(2)
+	return nil
+}
 
-	// Set the API key in the config environment variable so NewService() picks it up
-	os.Setenv("COPILOT_API_KEY", apiKey)
+// envFlags are the flags that set an environment variable; the variable
+// takes precedence over the flag
+var envFlags = map[string]string{
+	"upstream-timeout":                 "UPSTREAM_TIMEOUT",
+	"upstream-response-header-timeout": "UPSTREAM_RESPONSE_HEADER_TIMEOUT",
+	"upstream-tls-handshake-timeout":   "UPSTREAM_TLS_HANDSHAKE_TIMEOUT",
+	"upstream-idle-conn-timeout":       "UPSTREAM_IDLE_CONN_TIMEOUT",
+	"upstream-max-idle-conns":          "UPSTREAM_MAX_IDLE_CONNS",
+	"upstream-max-idle-conns-per-host": "UPSTREAM_MAX_IDLE_CONNS_PER_HOST",
+	"upstream-max-conns-per-host":      "UPSTREAM_MAX_CONNS_PER_HOST",
+	"upstream-proxy":                   "UPSTREAM_PROXY",
+	"shutdown-timeout":                 "SHUTDOWN_TIMEOUT",
+	"tls-cert":                         "TLS_CERT_FILE",
+	"tls-key":                          "TLS_KEY_FILE",
+	"tls-self-signed":                  "TLS_SELF_SIGNED",
+	"tls-client-ca":                    "TLS_CLIENT_CA_FILE",
+	"tls-client-auth":                  "TLS_CLIENT_AUTH",
+	"grpc-addr":                        "GRPC_ADDR",
+	"pid-file":                         "PID_FILE",
+	"log-file":                         "LOG_FILE",
+	"monitor-vscode":                   "MONITOR_VSCODE",
+	"strict":                           "STRICT_VALIDATION",
+}
+
+// upstreamFlags registers the upstream HTTP client flags, which every
+// command that calls GitHub or Copilot accepts
+func upstreamFlags(fs *flag.FlagSet) {
+	fs.String("upstream-timeout", "", "Total timeout for upstream requests including streamed bodies, e.g. 10m (default: none)")
+	fs.String("upstream-response-header-timeout", "", "Timeout waiting for upstream response headers (default: 30s)")
+	fs.String("upstream-tls-handshake-timeout", "", "Timeout for the upstream TLS handshake (default: 10s)")
+	fs.String("upstream-idle-conn-timeout", "", "How long idle upstream connections are kept (default: 90s)")
+	fs.String("upstream-max-idle-conns", "", "Maximum idle upstream connections (default: 100)")
+	fs.String("upstream-max-idle-conns-per-host", "", "Maximum idle upstream connections per host (default: 10)")
+	fs.String("upstream-max-conns-per-host", "", "Maximum upstream connections per host (default: unlimited)")
+	fs.String("upstream-proxy", "", "Proxy for all upstream requests, e.g. http://proxy:3128; hosts in NO_PROXY are reached directly (default: HTTP_PROXY/HTTPS_PROXY)")
+}
 
-	// Create a new LLM service that will use the API key from environment
-	llmService := llm.NewService()
+// applyEnvFlags sets the environment variables of the flags given on the
+// command line, unless they are already set, and checks the upstream proxy
+func applyEnvFlags(fs *flag.FlagSet) error {
+	fs.Visit(func(f *flag.Flag) {
+		if env, ok := envFlags[f.Name]; ok && os.Getenv(env) == "" {
+			os.Setenv(env, f.Value.String())
+		}
+	})
+	_, err := utils.UpstreamProxyURL()
+	return err
+}
 
-	// Use the streaming version instead of the non-streaming one
-	err = llmService.SubmitStreamingTestPrompt("Write a Go function to reverse a string")
+// openKeyStore opens the store of named application API keys and makes it
+// the one API keys are verified against
+func openKeyStore() (auth.KeyStore, error) {
+	keyStore, err := auth.OpenKeyStoreFromEnv()
 	if err != nil {
-		log.Fatalf("Failed to submit streaming test request: %v", err)
+		return nil, err
 	}
+	auth.SetKeyStore(keyStore)
+	return keyStore, nil
 }
 
-func main() {
-	// Load environment variables from .env file
-	loadEnvFile()
-
-	// Define CLI flags
-	getAPIKey := flag.String("get-api-key", "", "Retrieve an API key using the provided OAuth token")
-	testAuth := flag.String("test-auth", "", "Test the Authorization/API key")
-	testCall := flag.String("test-call", "", "Make a test call to verify the API is working")
-	disableAuth := flag.Bool("disable-auth", false, "Disable API key authorization and accept all requests")
-	testCopilot := flag.Bool("test-copilot", false, "Test the Copilot API with a sample prompt")
-
-	flag.Parse()
-
-	// Set environment variable if disable-auth flag is set
-	if *disableAuth {
-		os.Setenv("DISABLE_AUTH", "true")
-		log.Println("API authorization is disabled - all requests will be accepted")
+// copilotService creates an LLM service for the commands that call the
+// Copilot API from the command line, exchanging an OAuth token for a
+// Copilot API key if none is set
+func copilotService() *llm.Service {
+	if apiKey, err := app.NewApp().GetCopilotAPIKey(); err != nil {
+		log.Printf("Warning: %v", err)
+	} else {
+		os.Setenv("COPILOT_API_KEY", apiKey)
 	}
+	return llm.NewService()
+}
 
-	// Initialize the app
-	a := app.NewApp()
+// legacyModes maps the mode flags of earlier versions to the commands that
+// replace them. The value of a flag with value set becomes the argument of
+// the command.
+var legacyModes = map[string]struct {
+	command []string
+	value   bool
+}{
+	"get-api-key":  {[]string{"key", "copilot"}, true},
+	"test-auth":    {[]string{"test", "auth"}, true},
+	"test-call":    {[]string{"test", "call"}, true},
+	"test-copilot": {[]string{"test", "copilot"}, false},
+	"create-key":   {[]string{"key", "create"}, true},
+	"list-keys":    {[]string{"key", "list"}, false},
+	"revoke-key":   {[]string{"key", "revoke"}, true},
+	"rotate-key":   {[]string{"key", "rotate"}, true},
+	"export-usage": {[]string{"usage", "export"}, true},
+}
 
-	// Set default behaviors that can be overridden by flags
-	serverMode := true
+// legacyFlags maps the flags of earlier versions that were renamed when they
+// moved to a command
+var legacyFlags = map[string]string{
+	"key-expires":      "expires",
+	"key-models":       "models",
+	"key-endpoints":    "endpoints",
+	"key-no-streaming": "no-streaming",
+	"rotation-grace":   "grace",
+	"export-since":     "since",
+	"export-until":     "until",
+	"export-key":       "key",
+}
 
-	// Process CLI flags
-	if flag.Lookup("get-api-key").Value.String() != "" || flag.CommandLine.Lookup("get-api-key").DefValue != flag.Lookup("get-api-key").Value.String() {
-		serverMode = false
+// serveOnlyFlags are the flags only serve takes, which other commands drop
+// when they are given in the old style; the value reports whether the flag
+// is a boolean
+var serveOnlyFlags = map[string]bool{
+	"disable-auth":     true,
+	"shutdown-timeout": false,
+	"tls-cert":         false,
+	"tls-key":          false,
+	"tls-self-signed":  true,
+	"tls-client-ca":    false,
+	"tls-client-auth":  false,
+	"grpc-addr":        false,
+	"daemon":           true,
+	"pid-file":         false,
+	"log-file":         false,
+	"monitor-vscode":   true,
+	"strict":           true,
+}
 
-		if *getAPIKey == "" {
-			log.Println("No OAuth token provided as argument, trying to retrieve from environment...")
-			var err error
-			*getAPIKey, err = utils.GetCopilotOAuthToken()
-			if err != nil {
-				log.Fatalf("Failed to automatically retrieve OAuth token: %v", err)
-			}
-			log.Printf("Using OAuth token from environment: %s", utils.MaskToken(*getAPIKey))
+// legacyArgs translates a command line of earlier versions, which selected
+// the mode with a flag such as --create-key=NAME, into a command line of the
+// matching command. Command lines without a mode flag run serve. Everything
+// after "--" is passed on unchanged.
+func legacyArgs(args []string) []string {
+	var command, rest []string
+	var value string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
 		}
-
-		// Get API key using OAuth token
-		apiKey, err := a.GetAPIKey(*getAPIKey)
-		if err != nil {
-			log.Fatalf("Failed to retrieve API key: %v", err)
+		if !strings.HasPrefix(arg, "-") {
+			rest = append(rest, arg)
+			continue
 		}
-		fmt.Printf("Retrieved API key: %s\n", apiKey)
-		os.Exit(0)
-	}
-
-	if flag.Lookup("test-auth").Value.String() != "" || flag.CommandLine.Lookup("test-auth").DefValue != flag.Lookup("test-auth").Value.String() {
-		serverMode = false
-		apiKeyArg := *testAuth
-
-		// If no API key was provided in the argument, try to get it from our API key retrieval process
-		if apiKeyArg == "" {
-			log.Println("No API key provided as argument, trying to retrieve automatically...")
-			var err error
-			apiKeyArg, err = a.GetCopilotAPIKey()
-			if err != nil {
-				log.Fatalf("Failed to automatically retrieve API key: %v", err)
+		name, flagValue, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if mode, ok := legacyModes[name]; ok && command == nil {
+			command = mode.command
+			if mode.value && !hasValue && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				flagValue, hasValue = args[i], true
+			}
+			if mode.value && hasValue {
+				value = flagValue
 			}
-			log.Printf("Using API key retrieved automatically")
+			log.Printf("Warning: --%s is deprecated; use coproxy %s", name, strings.Join(command, " "))
+			continue
 		}
-
-		// Test the Authorization/API key
-		if auth.VerifyAppAPIKey(apiKeyArg) {
-			fmt.Println("✅ Valid application API key")
-		} else if auth.VerifyCopilotAPIKey(apiKeyArg) {
-			fmt.Println("✅ Valid GitHub Copilot API token")
-		} else {
-			log.Fatalf("❌ Invalid API key or token")
+		if renamed, ok := legacyFlags[name]; ok {
+			arg = "--" + renamed
+			if hasValue {
+				arg += "=" + flagValue
+			}
 		}
-		os.Exit(0)
+		rest = append(rest, arg)
 	}
-
-	if *testCall != "" {
-		serverMode = false
-		// Make a test call to verify the API is working
-		response, err := a.TestAPI(*testCall)
-		if err != nil {
-			log.Fatalf("Test call failed: %v", err)
-		}
-		fmt.Printf("Test call response: %s\n", response)
-		os.Exit(0)
+	if command == nil {
+		return append([]string{"serve"}, args...)
 	}
 
-	if *testCopilot {
-		testCopilotAPI()
-		os.Exit(0)
+	out := append([]string{}, command...)
+	for i := 0; i < len(rest); i++ {
+		if rest[i] == "--" {
+			out = append(out, rest[i:]...)
+			break
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(rest[i], "-"), "=")
+		if isBool, ok := serveOnlyFlags[name]; ok && strings.HasPrefix(rest[i], "-") {
+			if !isBool && !hasValue {
+				i++
+			}
+			continue
+		}
+		out = append(out, rest[i])
 	}
-
-	// If no command-line flags were used, run in server mode
-	if !serverMode {
-		return
+	if value != "" {
+		out = append(out, value)
 	}
+	return out
+}
 
-	// Print help message if no flags were used
-	if flag.NFlag() == 0 {
-		fmt.Println("Running in server mode. Use --help for CLI options.")
+// printUsage lists the commands
+func printUsage(commands []command) {
+	fmt.Fprintln(os.Stderr, "Usage: coproxy <command> [flags] [arguments]\n\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.summary)
 	}
+	fmt.Fprintf(os.Stderr, "  %-8s %s\n", "version", "Print the version, commit and build date")
+	fmt.Fprintln(os.Stderr, "\nRun \"coproxy help <command>\" for the flags of a command. Without a command the server runs.")
+}
 
-	// Create a context that will be canceled on program termination
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// Set up signal handling for graceful shutdown
-	go func() {
-		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-		<-sigCh
-		log.Println("Shutting down...")
-		cancel()
-	}()
-
-	// Initialize Copilot API key using our prioritized approach
-	log.Println("Initializing GitHub Copilot API key...")
-	copilotKey, err := a.GetCopilotAPIKey()
-	if err != nil {
-		log.Printf("Warning: %v", err)
-		log.Println("Continuing without Copilot API key. Will attempt to retrieve one when needed.")
-	} else {
-		log.Printf("Successfully initialized GitHub Copilot API key")
-		// Store the key in environment variable for future use
-		os.Setenv("COPILOT_API_KEY", copilotKey)
-	}
+func main() {
+	// Mask tokens and keys in every log line
+	log.SetOutput(utils.NewRedactingWriter(os.Stderr))
 
-	// Initialize LLM server
-	llmSecret := os.Getenv("LLM_API_SECRET")
-	if llmSecret == "" {
-		// Generate a random secret for this server instance
-		// This is needed to register the handlers but won't be used for validation
-		// when --disable-auth is set
-		bytes := make([]byte, 32)
-		if _, err := rand.Read(bytes); err != nil {
-			log.Printf("Warning: Failed to generate random secret: %v", err)
-			llmSecret = "temporary-secret-" + time.Now().String()
-		} else {
-			llmSecret = base64.StdEncoding.EncodeToString(bytes)
-		}
-		log.Println("No LLM_API_SECRET set, using generated secret for this session")
+	// Load environment variables from .env file
+	processEnv := environKeys()
+	envFile := loadEnvFile()
+	registerSecrets()
+
+	commands := []command{
+		{name: "serve", usage: "serve [flags]", summary: "Run the proxy server (the default without a command)",
+			run: func(args []string) error { return serve(args, envFile, processEnv) }},
+		loginCommand,
+		modelsCommand,
+		keyCommand,
+		testCommand,
+		chatCommand,
+		usageCommand,
 	}
-	llmState := llm.NewLLMServerState(llmSecret)
-	// Register LLM handlers unconditionally to ensure OpenAI-compatible endpoints are available
-	llmState.RegisterHandlers(a.Router)
 
-	// Authenticate and retrieve API key using OAuth token
-	oauthToken := os.Getenv("OAUTH_TOKEN")
-	if oauthToken != "" {
-		apiKey, err := a.GetAPIKey(oauthToken)
-		if err != nil {
-			log.Fatalf("Failed to retrieve API key: %v", err)
+	args := os.Args[1:]
+	switch {
+	case len(args) > 0 && (args[0] == "-h" || args[0] == "--help" || args[0] == "-help"):
+		printUsage(commands)
+		return
+	case len(args) > 0 && (args[0] == "version" || args[0] == "--version" || args[0] == "-version"):
+		fmt.Println(buildinfo.Get())
+		return
+	case len(args) > 0 && args[0] == "help":
+		if len(args) == 1 {
+			printUsage(commands)
+			return
 		}
-		log.Printf("Retrieved API key: %s", apiKey)
-	}
-
-	// Start HTTP server with graceful shutdown
-	server := &http.Server{
-		Addr:    ":8080",
-		Handler: a.Router,
+		args = []string{args[1], "--help"}
+	case len(args) == 0 || strings.HasPrefix(args[0], "-"):
+		// No command or the flags of earlier versions
+		args = legacyArgs(args)
 	}
 
-	// Start the server in a goroutine
-	go func() {
-		log.Println("Starting server on :8080...")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Could not start server: %v", err)
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			if err := cmd.run(args[1:]); err != nil {
+				log.Fatalf("%v", err)
+			}
+			return
 		}
-	}()
-
-	// Wait for shutdown signal
-	<-ctx.Done()
-
-	// Create a deadline for server shutdown
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer shutdownCancel()
-
-	// Attempt graceful shutdown
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Printf("Error during server shutdown: %v", err)
-	} else {
-		log.Println("Server gracefully stopped")
 	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	printUsage(commands)
+	os.Exit(2)
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLegacyArgs(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		// Without a mode flag the server runs
+		{nil, []string{"serve"}},
+		{[]string{"--port=9000", "--daemon"}, []string{"serve", "--port=9000", "--daemon"}},
+
+		// Mode flags, with their value given inline, as the next argument or not at all
+		{[]string{"--get-api-key=gho_token"}, []string{"key", "copilot", "gho_token"}},
+		{[]string{"--test-auth", "secret"}, []string{"test", "auth", "secret"}},
+		{[]string{"--test-call=hello"}, []string{"test", "call", "hello"}},
+		{[]string{"--test-copilot"}, []string{"test", "copilot"}},
+		{[]string{"--create-key", "ci"}, []string{"key", "create", "ci"}},
+		{[]string{"-list-keys"}, []string{"key", "list"}},
+		{[]string{"--revoke-key=3"}, []string{"key", "revoke", "3"}},
+		{[]string{"--rotate-key", "3"}, []string{"key", "rotate", "3"}},
+		{[]string{"--export-usage", "usage.csv"}, []string{"usage", "export", "usage.csv"}},
+		{[]string{"--get-api-key"}, []string{"key", "copilot"}},
+
+		// Renamed flags
+		{[]string{"--create-key", "ci", "--key-expires", "720h"}, []string{"key", "create", "--expires", "720h", "ci"}},
+		{[]string{"--create-key=ci", "--key-expires=720h", "--key-models=gpt-4o", "--key-endpoints=/v1/embeddings", "--key-no-streaming"},
+			[]string{"key", "create", "--expires=720h", "--models=gpt-4o", "--endpoints=/v1/embeddings", "--no-streaming", "ci"}},
+		{[]string{"--rotate-key=3", "--rotation-grace=1h"}, []string{"key", "rotate", "--grace=1h", "3"}},
+		{[]string{"--export-usage=-", "--export-since=2024-01-01", "--export-until", "2024-02-01", "--export-key=3"},
+			[]string{"usage", "export", "--since=2024-01-01", "--until", "2024-02-01", "--key=3", "-"}},
+
+		// The flags only serve takes are dropped, with their values
+		{[]string{"--disable-auth", "--tls-cert", "cert.pem", "--tls-key=key.pem", "--list-keys", "--daemon", "--log-file", "coproxy.log", "--strict"},
+			[]string{"key", "list"}},
+		{[]string{"--pid-file=coproxy.pid", "--grpc-addr", ":9090", "--revoke-key", "3", "--monitor-vscode"},
+			[]string{"key", "revoke", "3"}},
+
+		// Everything after "--" is passed on unchanged
+		{[]string{"--revoke-key", "--", "3"}, []string{"key", "revoke", "--", "3"}},
+		{[]string{"--create-key", "--", "--key-expires", "--daemon"}, []string{"key", "create", "--", "--key-expires", "--daemon"}},
+
+		// Unknown flags are left for the command to reject
+		{[]string{"--list-keys", "--bogus"}, []string{"key", "list", "--bogus"}},
+		{[]string{"--bogus=1"}, []string{"serve", "--bogus=1"}},
+	}
+	for _, tt := range tests {
+		if got := legacyArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("legacyArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		wantArgs []string
+		wantFlag string
+	}{
+		{[]string{"ci"}, []string{"ci"}, ""},
+		{[]string{"--expires=720h", "ci"}, []string{"ci"}, "720h"},
+		// Flags may follow the arguments
+		{[]string{"ci", "--expires", "720h", "nightly"}, []string{"ci", "nightly"}, "720h"},
+		// Everything after "--" is an argument
+		{[]string{"--expires=1h", "--", "--expires=2h", "ci"}, []string{"--expires=2h", "ci"}, "1h"},
+		{[]string{"ci", "--", "-x"}, []string{"ci", "-x"}, ""},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("create", flag.ContinueOnError)
+		expires := fs.String("expires", "", "")
+		got := parseArgs(fs, tt.args)
+		if !reflect.DeepEqual(got, tt.wantArgs) || *expires != tt.wantFlag {
+			t.Errorf("parseArgs(%q) = %q, expires = %q, want %q, %q", tt.args, got, *expires, tt.wantArgs, tt.wantFlag)
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	var ran string
+	var gotArgs []string
+	sub := func(name string) command {
+		return command{name: "key " + name, run: func(args []string) error {
+			ran, gotArgs = name, args
+			return nil
+		}}
+	}
+	group := command{name: "key", usage: "key <command>"}
+	subcommands := []command{sub("create"), sub("list")}
+
+	if err := dispatch(group, subcommands, []string{"create", "--expires=1h", "ci"}); err != nil || ran != "create" ||
+		strings.Join(gotArgs, " ") != "--expires=1h ci" {
+		t.Errorf("dispatch(create) ran %q with %q, error = %v", ran, gotArgs, err)
+	}
+
+	// Help is printed without running a subcommand
+	ran = ""
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stderr := os.Stderr
+	os.Stderr = devNull
+	defer func() { os.Stderr = stderr }()
+	for _, args := range [][]string{nil, {"help"}, {"--help"}} {
+		if err := dispatch(group, subcommands, args); err != nil || ran != "" {
+			t.Errorf("dispatch(%q) ran %q, error = %v", args, ran, err)
+		}
+	}
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"context"
+	"copilot-proxy/internal/accesslog"
+	"copilot-proxy/internal/admin"
+	"copilot-proxy/internal/app"
+	"copilot-proxy/internal/auth"
+	"copilot-proxy/internal/billing"
+	"copilot-proxy/internal/buildinfo"
+	"copilot-proxy/internal/ipfilter"
+	"copilot-proxy/internal/llm"
+	"copilot-proxy/internal/openapi"
+	"copilot-proxy/internal/rpc"
+	"copilot-proxy/internal/systemd"
+	"copilot-proxy/internal/tlsserver"
+	"copilot-proxy/internal/tracing"
+	"copilot-proxy/pkg/utils"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+	"google.golang.org/grpc"
+)
+
+// defaultShutdownTimeout is how long shutdown waits for active streams
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdownTimeout reads SHUTDOWN_TIMEOUT, a Go duration
+func shutdownTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT"))
+	if err != nil || timeout < 0 {
+		return defaultShutdownTimeout
+	}
+	return timeout
+}
+
+// reloadConfig re-reads the .env file, the API key store, the rate limits,
+// budgets and model aliases without restarting the listeners, so requests and
+// streams in flight are not interrupted. Variables set in the process
+// environment keep precedence over the .env file.
+func reloadConfig(envFile string, processEnv map[string]bool, service *llm.Service) error {
+	var errs []string
+	if envFile != "" {
+		values, err := godotenv.Read(envFile)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to read %s: %v", envFile, err))
+		}
+		for name, value := range values {
+			if !processEnv[name] {
+				os.Setenv(name, value)
+			}
+		}
+	}
+	if err := auth.ReloadKeyStore(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := service.ReloadConfig(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	log.Println("Configuration reloaded")
+	return nil
+}
+
+// registerAdmin registers the admin endpoints, protected by the admin token.
+func registerAdmin(mux *http.ServeMux, token string, llmState *llm.ServerState, keyStore auth.KeyStore, reload func() error) {
+	admin.RegisterPprof(mux, token)
+	admin.RegisterReload(mux, token, reload)
+	if keyStore != nil {
+		admin.RegisterKeys(mux, token, keyStore)
+	}
+	mux.Handle("/admin/limits", admin.RequireToken(token, http.HandlerFunc(llmState.HandleLimits)))
+	mux.Handle("/admin/limits/", admin.RequireToken(token, http.HandlerFunc(llmState.HandleLimits)))
+	mux.Handle("/admin/usage/export", admin.RequireToken(token, http.HandlerFunc(llmState.HandleUsageExport)))
+	mux.Handle("/admin/budgets", admin.RequireToken(token, http.HandlerFunc(llmState.HandleBudgets)))
+	mux.Handle("/admin/budgets/", admin.RequireToken(token, http.HandlerFunc(llmState.HandleBudgets)))
+	mux.Handle("/admin/accounts", admin.RequireToken(token, http.HandlerFunc(llmState.HandleCopilotAccounts)))
+	mux.Handle("/admin/tenants", admin.RequireToken(token, http.HandlerFunc(llmState.HandleTenants)))
+	mux.Handle("/admin/tenants/", admin.RequireToken(token, http.HandlerFunc(llmState.HandleTenants)))
+	mux.Handle("/admin/events", admin.RequireToken(token, http.HandlerFunc(llmState.HandleEvents)))
+	mux.Handle("/admin/metrics", admin.RequireToken(token, http.HandlerFunc(llmState.HandleMetrics)))
+	admin.RegisterDashboard(mux, token, http.HandlerFunc(llmState.HandleDashboardStats))
+}
+
+// openAccessLog sets up the access log of ACCESS_LOG. It returns nil when
+// the access log is off, and the file it writes to if ACCESS_LOG_FILE is set.
+func openAccessLog() (*accesslog.Logger, *utils.LogFile, error) {
+	config, err := accesslog.ConfigFromEnv()
+	if err != nil || !config.Enabled() {
+		return nil, nil, err
+	}
+	var out io.Writer = os.Stdout
+	var file *utils.LogFile
+	if config.File != "" {
+		rotation, err := utils.LogRotationFromEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+		if file, err = utils.OpenLogFile(config.File, rotation); err != nil {
+			return nil, nil, fmt.Errorf("failed to open the access log: %w", err)
+		}
+		out = file
+	}
+	return accesslog.New(config.Format, out), file, nil
+}
+
+// copilotAccountTokens parses COPILOT_OAUTH_TOKENS, a comma-separated list of
+// GitHub OAuth tokens that may be named as name=token, into account names
+// and tokens. Unnamed accounts are numbered.
+func copilotAccountTokens() (names, tokens []string) {
+	for _, entry := range strings.Split(os.Getenv("COPILOT_OAUTH_TOKENS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name := fmt.Sprintf("account-%d", len(tokens)+1)
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			name, entry = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		}
+		names = append(names, name)
+		tokens = append(tokens, entry)
+	}
+	return names, tokens
+}
+
+// copilotPluginPollInterval is how often --monitor-vscode checks the config
+// files of the GitHub Copilot editor plugins
+const copilotPluginPollInterval = 5 * time.Second
+
+// monitorCopilotPlugins follows the sign-ins and token refreshes of the GitHub
+// Copilot editor plugins: a new OAuth token is exchanged for an API key and
+// kept fresh by tokenManager, which is created if there is none yet, and a
+// new API key is used directly. An OAuth token set in the environment keeps
+// precedence over the plugins' one.
+func monitorCopilotPlugins(ctx context.Context, a *app.App, service *llm.Service, tokenManager *app.TokenManager) error {
+	envToken := os.Getenv("COPILOT_OAUTH_TOKEN") != "" || os.Getenv("OAUTH_TOKEN") != ""
+	return utils.WatchCopilotConfig(ctx, copilotPluginPollInterval, func(c utils.CopilotCredentials) {
+		if c.OAuthToken != "" && !envToken {
+			if tokenManager == nil {
+				tokenManager = a.NewTokenManager(c.OAuthToken, service.GetConfig())
+				tokenManager.Start(ctx)
+				service.SetKeyRefresher(tokenManager.Refresh)
+			} else {
+				tokenManager.SetOAuthToken(c.OAuthToken)
+			}
+			err := tokenManager.Refresh()
+			if err == nil {
+				log.Printf("Exchanged the new OAuth token from %s for a Copilot API key", c.OAuthTokenPath)
+				return
+			}
+			log.Printf("Warning: Copilot API key exchange for the OAuth token from %s failed: %v", c.OAuthTokenPath, err)
+		}
+		if c.APIKey != "" && c.APIKey != service.GetConfig().APIKey() {
+			service.GetConfig().SetAPIKey(c.APIKey)
+			os.Setenv("COPILOT_API_KEY", c.APIKey)
+			log.Printf("Using the new Copilot API key from %s", c.APIKeyPath)
+		}
+	})
+}
+
+// serve runs the proxy server until SIGINT or SIGTERM. envFile and
+// processEnv are re-read and respected when the configuration is reloaded.
+func serve(args []string, envFile string, processEnv map[string]bool) error {
+	fs := newFlagSet(command{name: "serve", usage: "serve [flags]", summary: "Runs the proxy server on :8080 until SIGINT or SIGTERM."})
+	disableAuth := fs.Bool("disable-auth", false, "Disable API key authorization and accept all requests")
+	// Upstream HTTP client tuning and TLS serving; environment variables take
+	// precedence over these flags
+	upstreamFlags(fs)
+	fs.String("shutdown-timeout", "", "How long shutdown waits for active streams before aborting them (default: 30s)")
+	fs.String("tls-cert", "", "Serve HTTPS with this PEM certificate file; reloaded when it changes")
+	fs.String("tls-key", "", "PEM private key file of --tls-cert")
+	fs.Bool("tls-self-signed", false, "Serve HTTPS with a self-signed certificate, generated if the certificate files do not exist")
+	fs.String("tls-client-ca", "", "Require client certificates issued by the CAs in this PEM file (mutual TLS)")
+	fs.String("tls-client-auth", "", "Client certificates with --tls-client-ca: require or optional (default: require)")
+	fs.String("grpc-addr", "", "Also serve the gRPC API on this address, e.g. :9090 (default: disabled)")
+	daemon := fs.Bool("daemon", false, "Run in the background, detached from the terminal; use with --log-file and --pid-file")
+	fs.String("pid-file", "", "Write the process ID to this file and refuse to start while the process it names is running")
+	fs.String("log-file", "", "Append the log to this file instead of standard error; rotated by LOG_MAX_SIZE and LOG_ROTATE_INTERVAL and reopened on SIGHUP")
+	fs.Bool("monitor-vscode", false, "Watch the GitHub Copilot config files of VS Code and the other editor plugins and use refreshed tokens without a restart")
+	fs.Bool("strict", false, "Reject chat completion requests that do not match the OpenAI schema with an invalid_request_error naming the parameter")
+	if rest := parseArgs(fs, args); len(rest) > 0 {
+		return fmt.Errorf("serve takes no arguments, got %q", rest)
+	}
+	if err := applyEnvFlags(fs); err != nil {
+		return err
+	}
+
+	// Start again in the background; the background process skips this
+	logPath, pidPath := os.Getenv("LOG_FILE"), os.Getenv("PID_FILE")
+	if *daemon && os.Getenv(daemonChildEnv) == "" {
+		if pidPath != "" {
+			if err := checkNotRunning(pidPath); err != nil {
+				return err
+			}
+		}
+		pid, err := daemonize(logPath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Started coproxy in the background with PID %d\n", pid)
+		return nil
+	}
+	var logs *utils.LogFile
+	if logPath != "" {
+		var err error
+		if logs, err = openLogFile(logPath); err != nil {
+			return err
+		}
+		defer logs.Close()
+	}
+	accessLog, accessLogFile, err := openAccessLog()
+	if err != nil {
+		return err
+	}
+	if accessLogFile != nil {
+		defer accessLogFile.Close()
+	}
+	if pidPath != "" {
+		release, err := acquirePIDFile(pidPath)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	// Set environment variable if disable-auth flag is set
+	if *disableAuth {
+		os.Setenv("DISABLE_AUTH", "true")
+		log.Println("API authorization is disabled - all requests will be accepted")
+	}
+
+	// Open the store of named application API keys
+	keyStore, err := openKeyStore()
+	if err != nil {
+		log.Printf("Warning: %v; only VALID_API_KEYS will be accepted", err)
+	} else {
+		defer keyStore.Close()
+	}
+
+	log.Printf("Starting %s", buildinfo.Get())
+
+	// Initialize the app
+	a := app.NewApp()
+
+	// Print help message if no flags were used
+	if fs.NFlag() == 0 {
+		fmt.Println("Running in server mode. Run coproxy help for the other commands.")
+	}
+
+	// Create a context that will be canceled on program termination
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Set up signal handling for graceful shutdown
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		log.Println("Shutting down...")
+		cancel()
+	}()
+
+	// Export OpenTelemetry spans when an OTLP endpoint is configured
+	shutdownTracing := tracing.Init(tracing.ConfigFromEnv())
+
+	// Initialize Copilot API key using our prioritized approach
+	log.Println("Initializing GitHub Copilot API key...")
+	copilotKey, err := a.GetCopilotAPIKey()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		log.Println("Continuing without Copilot API key. Will attempt to retrieve one when needed.")
+	} else {
+		log.Printf("Successfully initialized GitHub Copilot API key")
+		// Store the key in environment variable for future use
+		os.Setenv("COPILOT_API_KEY", copilotKey)
+	}
+
+	// Initialize LLM server
+	llmSecret := os.Getenv("LLM_API_SECRET")
+	if llmSecret == "" {
+		// Generate a random secret for this server instance
+		// This is needed to register the handlers but won't be used for validation
+		// when --disable-auth is set
+		bytes := make([]byte, 32)
+		if _, err := rand.Read(bytes); err != nil {
+			log.Printf("Warning: Failed to generate random secret: %v", err)
+			llmSecret = "temporary-secret-" + time.Now().String()
+		} else {
+			llmSecret = base64.StdEncoding.EncodeToString(bytes)
+		}
+		log.Println("No LLM_API_SECRET set, using generated secret for this session")
+	}
+	llmState := llm.NewLLMServerState(llmSecret)
+	// Sign LLM tokens with a private key that sidecars can verify
+	if path := os.Getenv("LLM_SIGNING_KEY_FILE"); path != "" {
+		pemData, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read LLM_SIGNING_KEY_FILE: %v", err)
+		}
+		signingKey, err := auth.ParseSigningKey(pemData)
+		if err == nil {
+			err = llmState.SetSigningKey(signingKey)
+		}
+		if err != nil {
+			log.Fatalf("Invalid LLM_SIGNING_KEY_FILE: %v", err)
+		}
+		log.Printf("Signing LLM tokens with the private key in %s; the public key is served at %s", path, llm.JWKSPath)
+		// Keep accepting tokens signed before a key rotation
+		for _, path := range strings.Split(os.Getenv("LLM_VERIFY_KEY_FILES"), ",") {
+			if path = strings.TrimSpace(path); path == "" {
+				continue
+			}
+			pemData, err := os.ReadFile(path)
+			if err != nil {
+				log.Fatalf("Failed to read LLM_VERIFY_KEY_FILES: %v", err)
+			}
+			publicKey, err := auth.ParseVerificationKey(pemData)
+			if err == nil {
+				err = llmState.AddVerificationKey(publicKey)
+			}
+			if err != nil {
+				log.Fatalf("Invalid key %s in LLM_VERIFY_KEY_FILES: %v", path, err)
+			}
+		}
+	}
+	// Persist usage and spending across restarts
+	if usageStore, err := llm.OpenUsageStore(llmState.Service.GetConfig()); err != nil {
+		log.Printf("Warning: %v; usage will only be kept in memory", err)
+	} else {
+		llmState.Service.SetUsageStore(usageStore)
+		defer usageStore.Close()
+	}
+	// Report usage to Stripe and block keys with inactive subscriptions
+	var stripeBilling *billing.Stripe
+	billingCfg, err := billing.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to set up Stripe billing: %v", err)
+	}
+	if billingCfg.Enabled() {
+		if stripeBilling, err = billing.New(billingCfg); err != nil {
+			log.Fatalf("Failed to set up Stripe billing: %v", err)
+		}
+		llmState.Service.SetUsageReporter(stripeBilling.RecordUsage)
+		llmState.Service.SetSubscriptionCheck(stripeBilling.CheckSubscription)
+		stripeBilling.Start(ctx)
+		log.Printf("Reporting usage to Stripe every %s", billingCfg.ReportInterval)
+	}
+	if sessionStore, err := llm.OpenSessionStore(llmState.Service.GetConfig()); err != nil {
+		log.Printf("Warning: %v; sessions will only be kept in memory", err)
+	} else {
+		llmState.Service.SetSessionStore(sessionStore)
+		defer sessionStore.Close()
+	}
+	// Keep the model catalog warm in the background
+	llmState.Service.StartModelRefresher(ctx)
+	// Roll the per-minute, daily and monthly usage windows over
+	llmState.Service.StartUsageWindowScheduler(ctx)
+	// Balance requests over the accounts of COPILOT_OAUTH_TOKENS
+	accountNames, accountTokens := copilotAccountTokens()
+	for i, name := range accountNames {
+		token := accountTokens[i]
+		llmState.Service.AddCopilotAccount(name, func() (string, error) { return a.GetAPIKey(token) })
+	}
+	if len(accountNames) > 0 {
+		log.Printf("Balancing Copilot requests over %d accounts", len(accountNames))
+	}
+	// Tenants with their own GitHub OAuth token exchange it like the proxy does
+	llmState.Service.SetTokenExchanger(a.GetAPIKey)
+	// Refresh the Copilot API key before it expires when an OAuth token is
+	// available; the key is still used to list models with an account pool
+	managedToken, tokenErr := utils.GetCopilotOAuthToken()
+	if tokenErr != nil && len(accountTokens) > 0 {
+		managedToken, tokenErr = accountTokens[0], nil
+	}
+	var tokenManager *app.TokenManager
+	if tokenErr == nil {
+		tokenManager = a.NewTokenManager(managedToken, llmState.Service.GetConfig())
+		if llmState.Service.GetConfig().APIKey() == "" {
+			if err := tokenManager.Refresh(); err != nil {
+				log.Printf("Warning: Copilot API key exchange failed: %v", err)
+			}
+		}
+		tokenManager.Start(ctx)
+		// Re-exchange immediately when the Copilot API rejects the current key
+		llmState.Service.SetKeyRefresher(tokenManager.Refresh)
+	} else {
+		log.Println("No OAuth token available; the Copilot API key will not be refreshed automatically")
+	}
+	// Pick up tokens the editor plugins write while the proxy is running
+	if monitor, _ := strconv.ParseBool(os.Getenv("MONITOR_VSCODE")); monitor {
+		if err := monitorCopilotPlugins(ctx, a, llmState.Service, tokenManager); err != nil {
+			log.Printf("Warning: cannot monitor the GitHub Copilot plugins: %v", err)
+		} else {
+			log.Println("Monitoring the GitHub Copilot plugin config files for new tokens")
+		}
+	}
+	// Register LLM handlers unconditionally to ensure OpenAI-compatible endpoints are available
+	llmState.RegisterHandlers(a.Router)
+	a.Router.Handle(rpc.JSONRPCPath, rpc.NewJSONRPCHandler(llmState))
+	a.Router.Handle(openapi.Path, openapi.Handler())
+
+	// Reload the configuration on SIGHUP or POST /admin/reload
+	reload := func() error {
+		systemd.Notify(systemd.Reloading)
+		defer systemd.Notify(systemd.Ready)
+		// Continue in new log files after they were rotated
+		for _, file := range []*utils.LogFile{logs, accessLogFile} {
+			if file == nil {
+				continue
+			}
+			if err := file.Reopen(); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+		err := reloadConfig(envFile, processEnv, llmState.Service)
+		if stripeBilling != nil {
+			if billingErr := stripeBilling.Reload(); billingErr != nil {
+				if err == nil {
+					return billingErr
+				}
+				return fmt.Errorf("%w; %v", err, billingErr)
+			}
+		}
+		return err
+	}
+	go func() {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		defer signal.Stop(hupCh)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupCh:
+				if err := reload(); err != nil {
+					log.Printf("Warning: configuration reload failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	// Authenticate and retrieve API key using OAuth token
+	oauthToken := os.Getenv("OAUTH_TOKEN")
+	if oauthToken != "" {
+		apiKey, err := a.GetAPIKey(oauthToken)
+		if err != nil {
+			log.Fatalf("Failed to retrieve API key: %v", err)
+		}
+		log.Printf("Retrieved API key: %s", utils.MaskToken(apiKey))
+	}
+
+	// Terminate HTTPS on the listeners when a certificate is configured
+	var serverTLS *tls.Config
+	tlsCfg, err := tlsserver.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+	if tlsCfg.Enabled() {
+		if serverTLS, err = tlsserver.NewTLSConfig(tlsCfg); err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		if tlsCfg.ClientCAFile != "" {
+			log.Printf("Authenticating clients by certificates issued by the CAs in %s", tlsCfg.ClientCAFile)
+		}
+	}
+
+	// Cap request bodies so a single huge request cannot exhaust memory
+	maxBodyBytes := utils.MaxRequestBodyBytes()
+	// Restrict the client addresses allowed on every listener
+	var ipFilter *ipfilter.Filter
+	if ipCfg := ipfilter.ConfigFromEnv(); ipCfg.Enabled() {
+		if ipFilter, err = ipfilter.New(ipCfg); err != nil {
+			log.Fatalf("Failed to set up the IP filter: %v", err)
+		}
+	}
+	guard := func(h http.Handler) http.Handler {
+		h = utils.LimitRequestBody(maxBodyBytes, h)
+		if ipFilter != nil {
+			h = ipFilter.Wrap(h)
+		}
+		if accessLog != nil {
+			h = accessLog.Wrap(h)
+		}
+		return h
+	}
+
+	// Take over the sockets of systemd socket activation: the ones named
+	// "admin" and "grpc" serve those APIs and any other the main API
+	activated, err := systemd.Listeners()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	inherited := make(map[string]net.Listener)
+	for _, l := range activated {
+		name := l.Name
+		if name != "admin" && name != "grpc" {
+			name = "http"
+		}
+		if _, ok := inherited[name]; ok {
+			log.Fatalf("socket activation: more than one %s socket was passed", name)
+		}
+		inherited[name] = l.Listener
+		log.Printf("Using the %s socket %s from systemd", name, l.Addr())
+	}
+	// listen returns the inherited socket of name or listens on addr
+	listen := func(name, addr string) (net.Listener, error) {
+		if l, ok := inherited[name]; ok {
+			return l, nil
+		}
+		return net.Listen("tcp", addr)
+	}
+
+	// Expose admin endpoints on a dedicated admin listener, or on the main
+	// listener when only an admin token is configured
+	adminCfg := admin.ConfigFromEnv()
+	var adminServer *http.Server
+	if _, ok := inherited["admin"]; ok || adminCfg.Addr != "" {
+		if adminCfg.Token == "" {
+			log.Printf("Warning: ADMIN_TOKEN is not set; admin endpoints on %s are unauthenticated", adminCfg.Addr)
+		}
+		adminMux := http.NewServeMux()
+		registerAdmin(adminMux, adminCfg.Token, llmState, keyStore, reload)
+		adminServer = &http.Server{Addr: adminCfg.Addr, Handler: guard(adminMux), TLSConfig: serverTLS}
+		listener, err := listen("admin", adminCfg.Addr)
+		if err != nil {
+			log.Fatalf("Could not start admin server: %v", err)
+		}
+		go func() {
+			log.Printf("Starting admin server on %s...", listener.Addr())
+			var err error
+			if serverTLS != nil {
+				err = adminServer.ServeTLS(listener, "", "")
+			} else {
+				err = adminServer.Serve(listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Printf("Admin server failed: %v", err)
+			}
+		}()
+	} else if adminCfg.Token != "" {
+		registerAdmin(a.Router, adminCfg.Token, llmState, keyStore, reload)
+	}
+
+	// Start HTTP server with graceful shutdown
+	server := &http.Server{
+		Addr:      ":8080",
+		Handler:   guard(a.Router),
+		TLSConfig: serverTLS,
+	}
+
+	listener, err := listen("http", server.Addr)
+	if err != nil {
+		log.Fatalf("Could not start server: %v", err)
+	}
+
+	// Start the server in a goroutine
+	go func() {
+		var err error
+		if serverTLS != nil {
+			log.Printf("Starting HTTPS server on %s...", listener.Addr())
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			log.Printf("Starting server on %s...", listener.Addr())
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Could not start server: %v", err)
+		}
+	}()
+
+	// Serve the gRPC API next to HTTP, sharing the LLM service
+	var grpcServer *grpc.Server
+	if _, ok := inherited["grpc"]; ok || rpc.ConfigFromEnv().Addr != "" {
+		listener, err := listen("grpc", rpc.ConfigFromEnv().Addr)
+		if err != nil {
+			log.Fatalf("Could not start gRPC server: %v", err)
+		}
+		if ipFilter != nil {
+			listener = ipFilter.Listener(listener)
+		}
+		grpcServer = rpc.NewGRPCServer(llmState, serverTLS)
+		go func() {
+			log.Printf("Starting gRPC server on %s...", listener.Addr())
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Printf("gRPC server failed: %v", err)
+			}
+		}()
+	}
+
+	// The listeners are up: let systemd start the units that wait for the
+	// proxy and keep its watchdog fed
+	if err := systemd.Notify(systemd.Ready); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if systemd.StartWatchdog(ctx) {
+		log.Printf("Notifying the systemd watchdog every %s", systemd.WatchdogInterval()/2)
+	}
+
+	// Wait for shutdown signal
+	<-ctx.Done()
+	systemd.Notify(systemd.Stopping)
+
+	// Stop accepting connections and give active streams until the shutdown
+	// timeout to finish; streams still running then get a final error event
+	drainTimeout := shutdownTimeout()
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer drainCancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), drainTimeout+5*time.Second)
+	defer shutdownCancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- server.Shutdown(shutdownCtx) }()
+	// gRPC calls get the same timeout before they are canceled
+	grpcStopped := make(chan struct{})
+	if grpcServer != nil {
+		go func() {
+			grpcServer.GracefulStop()
+			close(grpcStopped)
+		}()
+	}
+	if active := llmState.ActiveStreams(); active > 0 {
+		log.Printf("Waiting up to %s for %d active streams to finish...", drainTimeout, active)
+	}
+	if aborted := llmState.Shutdown(drainCtx); aborted > 0 {
+		log.Printf("Aborted %d streams still active after %s", aborted, drainTimeout)
+	}
+
+	// Attempt graceful shutdown
+	if err := <-shutdownErr; err != nil {
+		log.Printf("Error during server shutdown: %v", err)
+	} else {
+		log.Println("Server gracefully stopped")
+	}
+	if adminServer != nil {
+		adminServer.Shutdown(shutdownCtx)
+	}
+	if grpcServer != nil {
+		select {
+		case <-grpcStopped:
+		case <-drainCtx.Done():
+			grpcServer.Stop()
+		}
+	}
+	if stripeBilling != nil {
+		if err := stripeBilling.Flush(shutdownCtx); err != nil {
+			log.Printf("Error reporting usage to Stripe: %v", err)
+		}
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("Error flushing traces: %v", err)
+	}
+	return nil
+}
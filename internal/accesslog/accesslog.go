@@ -0,0 +1,237 @@
+// Package accesslog writes a line for every request the proxy serves, in
+// the Apache/nginx combined format or as JSON, for standard log pipelines.
+//
+// Each line records the client address, method, path (without the query,
+// which may carry credentials), status, response bytes, duration, the
+// request ID, the model and a hash of the API key ID, so requests of one key
+// can be followed without the log revealing which key it is. Handlers report
+// the key and model with SetKey and SetModel. Clients authenticated with a
+// TLS client certificate are also logged by the certificate's identity.
+//
+// The access log is configured with:
+//   - ACCESS_LOG: off (default), combined or json
+//   - ACCESS_LOG_FILE: file the access log is appended to (default: standard
+//     output); it is rotated like LOG_FILE
+package accesslog
+
+import (
+	"context"
+	"copilot-proxy/internal/tlsserver"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	FormatCombined = "combined"
+	FormatJSON     = "json"
+)
+
+// combinedTimeFormat is the timestamp of the combined format
+const combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// Config selects the format and destination of the access log
+type Config struct {
+	Format string
+	File   string
+}
+
+// ConfigFromEnv reads ACCESS_LOG and ACCESS_LOG_FILE
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		Format: strings.ToLower(strings.TrimSpace(os.Getenv("ACCESS_LOG"))),
+		File:   strings.TrimSpace(os.Getenv("ACCESS_LOG_FILE")),
+	}
+	switch config.Format {
+	case "", "off", "false", "none":
+		config.Format = ""
+	case FormatCombined, FormatJSON:
+	default:
+		return config, fmt.Errorf("invalid ACCESS_LOG %q: use combined or json", config.Format)
+	}
+	return config, nil
+}
+
+// Enabled reports whether an access log format is selected
+func (c Config) Enabled() bool {
+	return c.Format != ""
+}
+
+// Entry is one line of the access log
+type Entry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	ClientCert string    `json:"client_cert,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Protocol   string    `json:"protocol"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs int64     `json:"duration_ms"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	Model      string    `json:"model,omitempty"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// details are what handlers report about a request while serving it
+type details struct {
+	mu    sync.Mutex
+	key   string
+	model string
+}
+
+type detailsKey struct{}
+
+// SetKey records the ID of the API key a request was made with
+func SetKey(ctx context.Context, keyID uint64) {
+	if d, ok := ctx.Value(detailsKey{}).(*details); ok {
+		d.mu.Lock()
+		d.key = HashKey(keyID)
+		d.mu.Unlock()
+	}
+}
+
+// SetModel records the model a request asked for
+func SetModel(ctx context.Context, model string) {
+	if d, ok := ctx.Value(detailsKey{}).(*details); ok {
+		d.mu.Lock()
+		d.model = model
+		d.mu.Unlock()
+	}
+}
+
+// HashKey returns the identifier of an API key ID in the access log: the
+// start of its SHA-256 hash
+func HashKey(keyID uint64) string {
+	sum := sha256.Sum256([]byte("copilot-proxy-key:" + strconv.FormatUint(keyID, 10)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Logger writes the access log
+type Logger struct {
+	format string
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// New creates a logger writing lines of format to out
+func New(format string, out io.Writer) *Logger {
+	return &Logger{format: format, out: out}
+}
+
+// Wrap logs every request served by next
+func (l *Logger) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		d := &details{}
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), detailsKey{}, d)))
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		d.mu.Lock()
+		entry := Entry{
+			Time:       start,
+			RemoteAddr: host,
+			ClientCert: tlsserver.ClientIdentity(r.TLS),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Protocol:   r.Proto,
+			Status:     rw.status,
+			Bytes:      rw.bytes,
+			DurationMs: time.Since(start).Milliseconds(),
+			RequestID:  w.Header().Get("X-Request-ID"),
+			Key:        d.key,
+			Model:      d.model,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+		}
+		d.mu.Unlock()
+		l.Log(entry)
+	})
+}
+
+// Log writes an entry
+func (l *Logger) Log(e Entry) {
+	var line []byte
+	if l.format == FormatJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(combinedLine(e))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+// combinedLine formats an entry in the combined log format, with the client
+// certificate identity (spaces replaced by underscores) as the identity and
+// the hashed key as the user, followed by the duration in seconds, the model
+// and the request ID
+func combinedLine(e Entry) string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%s %s %s [%s] %s %d %s %s %s %.3f %s %s\n",
+		e.RemoteAddr, orDash(strings.ReplaceAll(e.ClientCert, " ", "_")), orDash(e.Key), e.Time.Format(combinedTimeFormat),
+		strconv.Quote(e.Method+" "+e.Path+" "+e.Protocol), e.Status, bytes,
+		strconv.Quote(orDash(e.Referer)), strconv.Quote(orDash(e.UserAgent)),
+		float64(e.DurationMs)/1000, strconv.Quote(orDash(e.Model)), orDash(e.RequestID))
+}
+
+// orDash returns s, or "-" for an empty value
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// responseWriter records the status and size of a response
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes flushes of streamed responses through
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
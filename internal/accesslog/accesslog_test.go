@@ -0,0 +1,85 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("ACCESS_LOG", "JSON")
+	t.Setenv("ACCESS_LOG_FILE", "/var/log/access.log")
+	config, err := ConfigFromEnv()
+	if err != nil || !config.Enabled() || config.Format != FormatJSON || config.File != "/var/log/access.log" {
+		t.Errorf("ConfigFromEnv() = %+v, %v", config, err)
+	}
+
+	t.Setenv("ACCESS_LOG", "off")
+	if config, err := ConfigFromEnv(); err != nil || config.Enabled() {
+		t.Errorf("ConfigFromEnv() with off = %+v, %v", config, err)
+	}
+
+	t.Setenv("ACCESS_LOG", "common")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("ConfigFromEnv() with an unknown format should fail")
+	}
+}
+
+// serve sends a request through a logger of format and returns its line
+func serve(t *testing.T, format string) string {
+	t.Helper()
+	var out bytes.Buffer
+	handler := New(format, &out).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetKey(r.Context(), 42)
+		SetModel(r.Context(), "gpt-4o")
+		w.Header().Set("X-Request-ID", "req-1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?key=secret", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "curl/8.0")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	return out.String()
+}
+
+func TestJSONFormat(t *testing.T) {
+	line := serve(t, FormatJSON)
+	var entry Entry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("invalid JSON line %q: %v", line, err)
+	}
+	if entry.Method != http.MethodPost || entry.Path != "/v1/chat/completions" || entry.Status != http.StatusCreated ||
+		entry.Bytes != 5 || entry.RemoteAddr != "192.0.2.1" || entry.Key != HashKey(42) || entry.Model != "gpt-4o" ||
+		entry.RequestID != "req-1" || entry.UserAgent != "curl/8.0" {
+		t.Errorf("entry = %+v", entry)
+	}
+	if strings.Contains(line, "secret") || strings.Contains(line, `"42"`) {
+		t.Errorf("line %q reveals the query or the key ID", line)
+	}
+}
+
+func TestCombinedFormat(t *testing.T) {
+	line := serve(t, FormatCombined)
+	pattern := `^192\.0\.2\.1 - ` + HashKey(42) + ` \[[^\]]+\] "POST /v1/chat/completions HTTP/1\.1" 201 5 "-" "curl/8\.0" \d+\.\d{3} "gpt-4o" req-1\n$`
+	if !regexp.MustCompile(pattern).MatchString(line) {
+		t.Errorf("line = %q, want a match of %s", line, pattern)
+	}
+}
+
+func TestCombinedFormatClientCert(t *testing.T) {
+	line := combinedLine(Entry{RemoteAddr: "192.0.2.1", ClientCert: "build bot", Method: "GET", Path: "/v1/models", Protocol: "HTTP/2.0", Status: 200})
+	if !strings.HasPrefix(line, "192.0.2.1 build_bot - [") {
+		t.Errorf("line = %q, want the certificate identity", line)
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	if HashKey(1) == HashKey(2) || len(HashKey(1)) != 12 || HashKey(1) != HashKey(1) {
+		t.Errorf("HashKey() = %q, %q", HashKey(1), HashKey(2))
+	}
+}
@@ -0,0 +1,95 @@
+// Package admin provides operator-only HTTP endpoints such as profiling and
+// API key management.
+//
+// Admin endpoints are protected by a shared token (ADMIN_TOKEN) passed as
+// "Authorization: Bearer <token>" or in the X-Admin-Token header. They can be
+// served on the main listener or on a separate admin listener (ADMIN_ADDR),
+// which is typically bound to localhost.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+// Config controls how admin endpoints are exposed
+type Config struct {
+	// Token is the shared secret required for admin requests
+	Token string
+	// Addr is an optional dedicated listen address for admin endpoints
+	Addr string
+}
+
+// ConfigFromEnv reads ADMIN_TOKEN and ADMIN_ADDR
+func ConfigFromEnv() Config {
+	return Config{
+		Token: os.Getenv("ADMIN_TOKEN"),
+		Addr:  os.Getenv("ADMIN_ADDR"),
+	}
+}
+
+// RequireToken wraps a handler so that it only serves requests carrying the
+// admin token. An empty token allows every request, which is only used for
+// a dedicated admin listener the operator has chosen to leave open.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !validToken(token, r) {
+			writeError(w, http.StatusUnauthorized, "invalid or missing admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeError writes an OpenAI-style error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    "invalid_request_error",
+			"code":    nil,
+		},
+	})
+}
+
+// validToken compares the request's admin token in constant time
+func validToken(token string, r *http.Request) bool {
+	given := r.Header.Get("X-Admin-Token")
+	if auth := r.Header.Get("Authorization"); given == "" && strings.HasPrefix(auth, "Bearer ") {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// RegisterPprof registers the net/http/pprof handlers under /debug/pprof/,
+// protected by the admin token.
+func RegisterPprof(mux *http.ServeMux, token string) {
+	mux.Handle("/debug/pprof/", RequireToken(token, http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", RequireToken(token, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", RequireToken(token, http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", RequireToken(token, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", RequireToken(token, http.HandlerFunc(pprof.Trace)))
+}
+
+// RegisterReload registers POST /admin/reload, which calls reload to re-read
+// the configuration, protected by the admin token.
+func RegisterReload(mux *http.ServeMux, token string, reload func() error) {
+	mux.Handle("/admin/reload", RequireToken(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if err := reload(); err != nil {
+			writeError(w, http.StatusInternalServerError, "reload failed: "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "reloaded"})
+	})))
+}
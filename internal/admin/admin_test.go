@@ -0,0 +1,86 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegisterPprofRequiresToken(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterPprof(mux, "admin-secret")
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"missing token", nil, http.StatusUnauthorized},
+		{"wrong token", map[string]string{"Authorization": "Bearer nope"}, http.StatusUnauthorized},
+		{"bearer token", map[string]string{"Authorization": "Bearer admin-secret"}, http.StatusOK},
+		{"admin header", map[string]string{"X-Admin-Token": "admin-secret"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/debug/pprof/", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequireTokenOpenWithoutToken(t *testing.T) {
+	handler := RequireToken("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/cmdline", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestRegisterReload(t *testing.T) {
+	var reloads int
+	var reloadErr error
+	mux := http.NewServeMux()
+	RegisterReload(mux, "admin-secret", func() error {
+		reloads++
+		return reloadErr
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		token      string
+		err        error
+		wantStatus int
+		wantCalls  int
+	}{
+		{"missing token", "POST", "", nil, http.StatusUnauthorized, 0},
+		{"wrong method", "GET", "admin-secret", nil, http.StatusMethodNotAllowed, 0},
+		{"reloaded", "POST", "admin-secret", nil, http.StatusOK, 1},
+		{"failed", "POST", "admin-secret", errors.New("bad rate limits file"), http.StatusInternalServerError, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloads, reloadErr = 0, tt.err
+			req := httptest.NewRequest(tt.method, "/admin/reload", nil)
+			if tt.token != "" {
+				req.Header.Set("X-Admin-Token", tt.token)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus || reloads != tt.wantCalls {
+				t.Errorf("status = %d, reloads = %d, want %d, %d", w.Code, reloads, tt.wantStatus, tt.wantCalls)
+			}
+		})
+	}
+}
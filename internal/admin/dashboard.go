@@ -0,0 +1,39 @@
+package admin
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// RegisterDashboard registers the embedded admin dashboard at /admin/ui and
+// the stats it polls at /admin/ui/stats. The page itself holds no data and
+// is served without the admin token, which it asks for and sends with its
+// requests for stats; stats requires the token.
+func RegisterDashboard(mux *http.ServeMux, token string, stats http.Handler) {
+	mux.HandleFunc("/admin/ui", serveDashboard)
+	mux.HandleFunc("/admin/ui/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/ui/" {
+			http.NotFound(w, r)
+			return
+		}
+		serveDashboard(w, r)
+	})
+	mux.Handle("/admin/ui/stats", RequireToken(token, stats))
+}
+
+// serveDashboard serves the dashboard page
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(dashboardHTML)
+}
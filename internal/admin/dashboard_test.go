@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegisterDashboard(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterDashboard(mux, "admin-secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"throughput": []}`))
+	}))
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// The page holds no data and is served without the token
+	for _, path := range []string{"/admin/ui", "/admin/ui/"} {
+		w := get(path, "")
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "/admin/ui/stats") {
+			t.Errorf("GET %s = %d %s", path, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+	if w := get("/admin/ui/other", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/ui/other = %d, want 404", w.Code)
+	}
+
+	if w := get("/admin/ui/stats", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET stats without token = %d, want 401", w.Code)
+	}
+	if w := get("/admin/ui/stats", "admin-secret"); w.Code != http.StatusOK || w.Body.String() != `{"throughput": []}` {
+		t.Errorf("GET stats = %d %s", w.Code, w.Body.String())
+	}
+}
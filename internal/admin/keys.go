@@ -0,0 +1,207 @@
+package admin
+
+import (
+	"copilot-proxy/internal/auth"
+	"copilot-proxy/pkg/utils"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// createKeyRequest is the body of POST /admin/keys
+type createKeyRequest struct {
+	Name string `json:"name"`
+	// ExpiresIn is a Go duration such as "720h"; empty never expires
+	ExpiresIn string `json:"expires_in,omitempty"`
+	// ExpiresAt is an RFC 3339 expiry time, an alternative to ExpiresIn
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Scopes restricts the models, endpoints and streaming the key may use
+	Scopes *auth.KeyScopes `json:"scopes,omitempty"`
+}
+
+// rotateKeyRequest is the optional body of POST /admin/keys/{id}/rotate
+type rotateKeyRequest struct {
+	// Grace is how long the old key keeps working, a Go duration such as
+	// "72h" (default 24h)
+	Grace string `json:"grace,omitempty"`
+	// ExpiresIn and ExpiresAt set the lifetime of the replacement key
+	ExpiresIn string     `json:"expires_in,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// RegisterKeys registers the API key management endpoints, protected by the
+// admin token:
+//
+//	GET    /admin/keys       lists keys without their secrets
+//	POST   /admin/keys       issues a key; the response is the only time its secret is shown
+//	GET    /admin/keys/{id}  returns one key without its secret
+//	DELETE /admin/keys/{id}  revokes a key
+//	POST   /admin/keys/{id}/rotate  issues a replacement; the old key keeps working for a grace period
+func RegisterKeys(mux *http.ServeMux, token string, store auth.KeyStore) {
+	handler := RequireToken(token, keysHandler(store))
+	mux.Handle("/admin/keys", handler)
+	mux.Handle("/admin/keys/", handler)
+}
+
+func keysHandler(store auth.KeyStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idValue := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/keys"), "/")
+		if idValue == "" {
+			switch r.Method {
+			case http.MethodGet:
+				listKeys(w, store)
+			case http.MethodPost:
+				createKey(w, r, store)
+			default:
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			}
+			return
+		}
+
+		action := ""
+		if i := strings.Index(idValue, "/"); i >= 0 {
+			idValue, action = idValue[:i], idValue[i+1:]
+		}
+		id, err := strconv.ParseUint(idValue, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid key ID: "+idValue)
+			return
+		}
+		if action != "" {
+			if action != "rotate" {
+				writeError(w, http.StatusNotFound, "unknown key action: "+action)
+				return
+			}
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			rotateKey(w, r, store, id)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			if err := store.Revoke(id); err != nil {
+				writeKeyError(w, err)
+				return
+			}
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		key, err := store.Get(id)
+		if err != nil {
+			writeKeyError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, key.Redacted())
+	})
+}
+
+func listKeys(w http.ResponseWriter, store auth.KeyStore) {
+	keys, err := store.List()
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	data := make([]auth.APIKey, len(keys))
+	for i, key := range keys {
+		data[i] = key.Redacted()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"object": "list", "data": data})
+}
+
+func createKey(w http.ResponseWriter, r *http.Request, store auth.KeyStore) {
+	var req createKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if utils.IsRequestBodyTooLarge(err) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	expiresAt, ok := parseExpiry(w, req.ExpiresIn, req.ExpiresAt)
+	if !ok {
+		return
+	}
+	key, err := store.Create(req.Name, expiresAt, req.Scopes)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, key)
+}
+
+func rotateKey(w http.ResponseWriter, r *http.Request, store auth.KeyStore, id uint64) {
+	var req rotateKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		if utils.IsRequestBodyTooLarge(err) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	grace := auth.DefaultRotationGrace
+	if req.Grace != "" {
+		var err error
+		if grace, err = time.ParseDuration(req.Grace); err != nil || grace < 0 {
+			writeError(w, http.StatusBadRequest, "invalid grace: "+req.Grace)
+			return
+		}
+	}
+	expiresAt, ok := parseExpiry(w, req.ExpiresIn, req.ExpiresAt)
+	if !ok {
+		return
+	}
+	key, err := store.Rotate(id, grace, expiresAt)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, key)
+}
+
+// parseExpiry returns the expiry given as a lifetime or a time. On failure
+// the error response is written to w and false is returned.
+func parseExpiry(w http.ResponseWriter, expiresIn string, expiresAt *time.Time) (*time.Time, bool) {
+	if expiresIn == "" {
+		return expiresAt, true
+	}
+	lifetime, err := time.ParseDuration(expiresIn)
+	if err != nil || lifetime <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid expires_in: "+expiresIn)
+		return nil, false
+	}
+	t := time.Now().Add(lifetime).UTC()
+	return &t, true
+}
+
+// writeKeyError maps key store errors to HTTP responses
+func writeKeyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrKeyNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, auth.ErrKeyRevoked) || errors.Is(err, auth.ErrKeyExpired) || errors.Is(err, auth.ErrKeyRotated) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,87 @@
+package admin
+
+import (
+	"copilot-proxy/internal/auth"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeysAPI(t *testing.T) {
+	store, err := auth.NewFileKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	RegisterKeys(mux, "admin-secret", store)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/admin/keys", `{"name":"editor","expires_in":"720h"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST status = %d: %s", w.Code, w.Body.String())
+	}
+	var created auth.APIKey
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.ID == 0 || !strings.HasPrefix(created.Key, auth.APIKeyPrefix) || created.ExpiresAt == nil {
+		t.Errorf("created key = %+v", created)
+	}
+
+	if w := do("POST", "/admin/keys", `{"name":""}`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST without name status = %d, want 400", w.Code)
+	}
+	if w := do("POST", "/admin/keys", `{"name":"x","expires_in":"soon"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST with bad expires_in status = %d, want 400", w.Code)
+	}
+
+	w = do("GET", "/admin/keys", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), created.Key) {
+		t.Errorf("GET list status = %d, body leaks secrets or fails: %s", w.Code, w.Body.String())
+	}
+
+	w = do("POST", "/admin/keys/1/rotate", `{"grace":"1h"}`)
+	var rotated auth.APIKey
+	json.Unmarshal(w.Body.Bytes(), &rotated)
+	if w.Code != http.StatusCreated || rotated.RotatedFrom != created.ID || rotated.Key == "" || rotated.Key == created.Key {
+		t.Fatalf("rotate status = %d, key = %+v", w.Code, rotated)
+	}
+	if w := do("POST", "/admin/keys/1/rotate", ""); w.Code != http.StatusConflict {
+		t.Errorf("rotating a rotated key status = %d, want 409", w.Code)
+	}
+	if w := do("POST", "/admin/keys/1/renew", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown key action status = %d, want 404", w.Code)
+	}
+
+	w = do("DELETE", "/admin/keys/1", "")
+	var revoked auth.APIKey
+	json.Unmarshal(w.Body.Bytes(), &revoked)
+	if w.Code != http.StatusOK || revoked.RevokedAt == nil || revoked.Key != "" {
+		t.Errorf("DELETE status = %d, key = %+v", w.Code, revoked)
+	}
+	if _, err := store.Lookup(created.Key); err != nil {
+		t.Errorf("revoked key should remain listed: %v", err)
+	}
+
+	if w := do("GET", "/admin/keys/42", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET unknown key status = %d, want 404", w.Code)
+	}
+	if w := do("GET", "/admin/keys/abc", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("GET invalid ID status = %d, want 400", w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/admin/keys", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET without admin token status = %d, want 401", w.Code)
+	}
+}
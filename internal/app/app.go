@@ -1,12 +1,16 @@
 package app
 
 import (
+	"context"
 	"copilot-proxy/internal/auth"
+	"copilot-proxy/internal/buildinfo"
+	"copilot-proxy/internal/tracing"
 	"copilot-proxy/pkg/utils"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -37,9 +41,19 @@ func (a *App) initializeRoutes() {
 	a.Router.HandleFunc("/copilot", a.handleCopilot)
 }
 
+// handleStatus reports the authentication status and which build is running
 func (a *App) handleStatus(w http.ResponseWriter, r *http.Request) {
 	status := a.Auth.GetStatus()
-	json.NewEncoder(w).Encode(map[string]string{"status": status})
+	build := buildinfo.Get()
+	out := map[string]string{"status": status, "version": build.Version, "go_version": build.GoVersion}
+	if commit := build.Revision(); commit != "" {
+		out["commit"] = commit
+	}
+	if build.Date != "" {
+		out["build_date"] = build.Date
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
 }
 
 func (a *App) handleAuthenticate(w http.ResponseWriter, r *http.Request) {
@@ -90,7 +104,7 @@ func (a *App) handleCopilot(w http.ResponseWriter, r *http.Request) {
 		apiKey = authHeader
 	}
 
-	fmt.Printf("Extracted API key: %s\n", apiKey)
+	log.Printf("Extracted API key: %s", utils.MaskToken(apiKey))
 
 	// Verify that this is a valid app API key
 	if !auth.VerifyAppAPIKey(apiKey) {
@@ -100,10 +114,22 @@ func (a *App) handleCopilot(w http.ResponseWriter, r *http.Request) {
 
 	var payload map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		if utils.IsRequestBodyTooLarge(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
+	// Enforce the endpoint, model and streaming scopes of named keys
+	model, _ := payload["model"].(string)
+	stream, _ := payload["stream"].(bool)
+	if err := auth.AuthorizeAppAPIKey(apiKey, r.URL.Path, model, stream); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	// Format the payload for OpenAI-compatible request if needed
 	providerRequest := payload
 	if _, ok := payload["messages"]; ok {
@@ -122,7 +148,7 @@ func (a *App) handleCopilot(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// For debugging
-	fmt.Printf("Using Copilot API key: %s\n", copilotKey)
+	log.Printf("Using Copilot API key: %s", utils.MaskToken(copilotKey))
 
 	// Make the request to the Copilot API
 	response, err := utils.CallCopilotAPI(copilotKey, providerRequest)
@@ -153,20 +179,32 @@ func (a *App) handleCopilot(w http.ResponseWriter, r *http.Request) {
 //   - proxy-ep: Proxy endpoint for API calls
 //   - Various feature flags (chat, cit, malfil, etc.)
 func (a *App) GetAPIKey(oauthToken string) (string, error) {
-	// GitHub Copilot API endpoint for getting a token
-	copilotTokenURL := "https://api.github.com/copilot_internal/v2/token"
+	ctx, span := tracing.Start(context.Background(), "copilot.token_exchange", tracing.SpanKindClient)
+	defer span.End()
+
+	apiKey, err := a.exchangeOAuthToken(ctx, oauthToken)
+	span.RecordError(err)
+	return apiKey, err
+}
+
+// exchangeOAuthToken performs the OAuth token to Copilot API key exchange.
+func (a *App) exchangeOAuthToken(ctx context.Context, oauthToken string) (string, error) {
+	// GitHub Copilot API endpoint for getting a token; GitHub Enterprise
+	// instances serve it from their own API
+	copilotTokenURL := utils.GitHubAPIURL() + "/copilot_internal/v2/token"
 
 	req, err := http.NewRequest("GET", copilotTokenURL, nil)
 	if err != nil {
 		return "", err
 	}
+	tracing.Inject(ctx, req.Header)
 
 	// Add the OAuth token to the Authorization header
 	req.Header.Set("Authorization", "token "+oauthToken)
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("User-Agent", "copilot-proxy")
 
-	client := &http.Client{}
+	client := utils.NewUpstreamClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -192,8 +230,9 @@ func (a *App) GetAPIKey(oauthToken string) (string, error) {
 
 // GetCopilotAPIKey retrieves a valid GitHub Copilot API key following a priority order:
 // 1. First check for direct API key in environment variables
-// 2. Then try to use OAuth token from environment to get an API key
-// 3. Finally try to read OAuth token from Copilot config and use it to get an API key
+// 2. Then reuse an unexpired key cached in the system keychain
+// 3. Then try to use the OAuth token from the environment or login to get an API key
+// 4. Finally try to read OAuth token from Copilot config and use it to get an API key
 //
 // Returns the Copilot API key if successful or an error if all methods fail.
 func (a *App) GetCopilotAPIKey() (string, error) {
@@ -205,23 +244,32 @@ func (a *App) GetCopilotAPIKey() (string, error) {
 			return apiKey, nil
 		}
 		// If token has expired, continue to try other methods
-		fmt.Println("Copilot API key from environment variables has expired, trying OAuth token...")
+		log.Println("Copilot API key from environment variables has expired, trying OAuth token...")
+	}
+
+	// Step 2: Reuse a key cached in the system keychain by an earlier run
+	if apiKey, err := utils.GetCachedCopilotAPIKey(); err == nil {
+		os.Setenv("COPILOT_API_KEY", apiKey)
+		return apiKey, nil
 	}
 
-	// Step 2: Try to get an OAuth token from environment variables
+	// Step 3: Try to get an OAuth token from environment variables
 	oauthToken, err := utils.GetCopilotOAuthToken()
 	if err == nil && oauthToken != "" {
-		fmt.Println("Found OAuth token in environment variables, attempting to get Copilot API key...")
+		log.Println("Found OAuth token in environment variables, attempting to get Copilot API key...")
 		apiKey, err := a.GetAPIKey(oauthToken)
 		if err == nil {
 			// Cache the API key for future use
 			os.Setenv("COPILOT_API_KEY", apiKey)
+			if err := utils.SaveCopilotAPIKey(apiKey); err != nil {
+				log.Printf("Warning: %v", err)
+			}
 			return apiKey, nil
 		}
-		fmt.Printf("Failed to get Copilot API key using OAuth token: %v\n", err)
+		log.Printf("Failed to get Copilot API key using OAuth token: %v", err)
 	}
 
-	// Step 3: Attempt to use the local Copilot token from config
+	// Step 4: Attempt to use the local Copilot token from config
 	apiKey, err = utils.GetCopilotToken()
 	if err == nil {
 		return apiKey, nil
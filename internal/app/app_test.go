@@ -3,7 +3,9 @@ package app
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -45,6 +47,9 @@ func TestHandleStatus(t *testing.T) {
 	if _, ok := respBody["status"]; !ok {
 		t.Error("Response missing status field")
 	}
+	if respBody["version"] == "" || respBody["go_version"] == "" {
+		t.Errorf("Response missing build information: %v", respBody)
+	}
 }
 
 func TestHandleAuthenticate(t *testing.T) {
@@ -177,6 +182,38 @@ func TestHandleCopilot(t *testing.T) {
 	}
 }
 
+func TestHandleCopilotMasksSecrets(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer upstream.Close()
+	copilotKey := fmt.Sprintf("tid=0123456789abcdef0123;exp=%d;sku=secret_sku", time.Now().Add(time.Hour).Unix())
+	clientKey := "cpk_00112233445566778899aabbccddeeff"
+	os.Setenv("DISABLE_AUTH", "true")
+	os.Setenv("COPILOT_API_KEY", copilotKey)
+	os.Setenv("COPILOT_API_URL", upstream.URL)
+	defer os.Unsetenv("DISABLE_AUTH")
+	defer os.Unsetenv("COPILOT_API_KEY")
+	defer os.Unsetenv("COPILOT_API_URL")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	req := httptest.NewRequest("POST", "/copilot", strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer "+clientKey)
+	NewApp().handleCopilot(httptest.NewRecorder(), req)
+
+	for _, secret := range []string{copilotKey, "0123456789abcdef0123", "secret_sku", clientKey} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("log output leaks %q:\n%s", secret, logs.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "Using Copilot API key") {
+		t.Errorf("log output = %q, want the masked key logged", logs.String())
+	}
+}
+
 func TestGetAPIKey(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -206,6 +243,23 @@ func TestGetAPIKey(t *testing.T) {
 	}
 }
 
+func TestGetAPIKeyFromEnterpriseServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/copilot_internal/v2/token" || r.Header.Get("Authorization") != "token ghu_enterprise" {
+			http.Error(w, "unexpected request "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"token": "tid=1;exp=9999999999;proxy-ep=proxy.enterprise.githubcopilot.com;", "expires_at": 9999999999}`))
+	}))
+	defer server.Close()
+	t.Setenv("GITHUB_API_URL", server.URL+"/api/v3")
+
+	key, err := NewApp().GetAPIKey("ghu_enterprise")
+	if err != nil || !strings.Contains(key, "proxy-ep=proxy.enterprise.githubcopilot.com") {
+		t.Errorf("GetAPIKey() = %q, %v", key, err)
+	}
+}
+
 func TestGetCopilotAPIKey(t *testing.T) {
 	tests := []struct {
 		name           string
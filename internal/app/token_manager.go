@@ -0,0 +1,135 @@
+package app
+
+import (
+	"context"
+	"copilot-proxy/internal/llm"
+	"copilot-proxy/pkg/utils"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTokenRefreshMargin is how long before expiry the key is refreshed
+	defaultTokenRefreshMargin = 5 * time.Minute
+	// defaultTokenLifetime is assumed when a key carries no exp timestamp
+	defaultTokenLifetime = 25 * time.Minute
+	// tokenRetryInterval is the delay before retrying a failed exchange
+	tokenRetryInterval = time.Minute
+)
+
+// TokenManager keeps the Copilot API key in llm.Config fresh by exchanging
+// the GitHub OAuth token for a new key shortly before the current one expires.
+type TokenManager struct {
+	mu         sync.Mutex
+	oauthToken string
+	config     *llm.Config
+	// exchange trades the OAuth token for a Copilot API key
+	exchange func(oauthToken string) (string, error)
+	// save persists a new key for later runs; nil keeps it in memory only
+	save func(apiKey string) error
+	// margin is how long before expiry a refresh is attempted
+	margin time.Duration
+}
+
+// NewTokenManager creates a token manager that refreshes the key stored in
+// config using the app's OAuth exchange.
+func (a *App) NewTokenManager(oauthToken string, config *llm.Config) *TokenManager {
+	margin := defaultTokenRefreshMargin
+	if v, err := time.ParseDuration(os.Getenv("COPILOT_TOKEN_REFRESH_MARGIN")); err == nil && v > 0 {
+		margin = v
+	}
+	return &TokenManager{
+		oauthToken: oauthToken,
+		config:     config,
+		exchange:   a.GetAPIKey,
+		save:       utils.SaveCopilotAPIKey,
+		margin:     margin,
+	}
+}
+
+// Refresh exchanges the OAuth token for a new Copilot API key and swaps it
+// into the configuration.
+func (m *TokenManager) Refresh() error {
+	m.mu.Lock()
+	oauthToken := m.oauthToken
+	m.mu.Unlock()
+	key, err := m.exchange(oauthToken)
+	if err != nil {
+		return err
+	}
+	m.config.SetAPIKey(key)
+	os.Setenv("COPILOT_API_KEY", key)
+	if m.save != nil {
+		if err := m.save(key); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return nil
+}
+
+// SetOAuthToken replaces the OAuth token exchanged by later refreshes, e.g.
+// after the user signed in again in their editor.
+func (m *TokenManager) SetOAuthToken(oauthToken string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.oauthToken = oauthToken
+}
+
+// Start runs the refresh loop until ctx is canceled.
+func (m *TokenManager) Start(ctx context.Context) {
+	go func() {
+		for {
+			timer := time.NewTimer(m.nextRefresh(time.Now()))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if err := m.Refresh(); err != nil {
+				log.Printf("Warning: Copilot API key refresh failed: %v", err)
+				// Retry soon rather than waiting for the next expiry window
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(tokenRetryInterval):
+				}
+				continue
+			}
+			log.Println("Refreshed GitHub Copilot API key")
+		}
+	}()
+}
+
+// nextRefresh returns how long to wait before refreshing the current key.
+func (m *TokenManager) nextRefresh(now time.Time) time.Duration {
+	exp, ok := copilotKeyExpiry(m.config.APIKey())
+	if !ok {
+		return defaultTokenLifetime
+	}
+	wait := exp.Add(-m.margin).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// copilotKeyExpiry extracts the exp timestamp from a Copilot API key of the
+// form "tid=...;exp=1700000000;...".
+func copilotKeyExpiry(key string) (time.Time, bool) {
+	for _, part := range strings.Split(key, ";") {
+		if !strings.HasPrefix(part, "exp=") {
+			continue
+		}
+		exp, err := strconv.ParseInt(strings.TrimPrefix(part, "exp="), 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(exp, 0), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"copilot-proxy/internal/llm"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCopilotKeyExpiry(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		want   int64
+		wantOK bool
+	}{
+		{"exp after tid", "tid=abc;exp=1700000000;sku=free;proxy-ep=proxy.example.com", 1700000000, true},
+		{"exp later in key", "tid=abc;sku=free;exp=1700000123", 1700000123, true},
+		{"no exp", "tid=abc;sku=free", 0, false},
+		{"invalid exp", "tid=abc;exp=soon", 0, false},
+		{"empty key", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := copilotKeyExpiry(tt.key)
+			if ok != tt.wantOK {
+				t.Fatalf("copilotKeyExpiry() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && got.Unix() != tt.want {
+				t.Errorf("copilotKeyExpiry() = %d, want %d", got.Unix(), tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenManagerNextRefresh(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		key  string
+		want time.Duration
+	}{
+		{"refreshes before expiry", fmt.Sprintf("tid=a;exp=%d", now.Add(30*time.Minute).Unix()), 25 * time.Minute},
+		{"expired key refreshes immediately", fmt.Sprintf("tid=a;exp=%d", now.Add(-time.Minute).Unix()), 0},
+		{"unknown expiry uses default lifetime", "tid=a", defaultTokenLifetime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &TokenManager{config: &llm.Config{CopilotAPIKey: tt.key}, margin: 5 * time.Minute}
+			if got := m.nextRefresh(now); got != tt.want {
+				t.Errorf("nextRefresh() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenManagerRefresh(t *testing.T) {
+	defer os.Unsetenv("COPILOT_API_KEY")
+
+	config := &llm.Config{CopilotAPIKey: "tid=old"}
+	m := &TokenManager{
+		oauthToken: "gho_test",
+		config:     config,
+		exchange: func(oauthToken string) (string, error) {
+			if oauthToken != "gho_test" {
+				t.Errorf("exchange called with %q", oauthToken)
+			}
+			return "tid=new", nil
+		},
+	}
+	if err := m.Refresh(); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if got := config.APIKey(); got != "tid=new" {
+		t.Errorf("APIKey() = %q, want tid=new", got)
+	}
+
+	m.exchange = func(string) (string, error) { return "", errors.New("exchange failed") }
+	if err := m.Refresh(); err == nil {
+		t.Error("Refresh() expected error")
+	}
+	if got := config.APIKey(); got != "tid=new" {
+		t.Errorf("APIKey() = %q after failed refresh, want previous key", got)
+	}
+
+	// A new sign-in is exchanged by the next refresh
+	m.SetOAuthToken("gho_new")
+	m.exchange = func(oauthToken string) (string, error) { return "tid=" + oauthToken, nil }
+	if err := m.Refresh(); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if got := config.APIKey(); got != "tid=gho_new" {
+		t.Errorf("APIKey() = %q after SetOAuthToken, want tid=gho_new", got)
+	}
+}
+
+func TestTokenManagerStartRefreshesExpiredKey(t *testing.T) {
+	defer os.Unsetenv("COPILOT_API_KEY")
+
+	expired := fmt.Sprintf("tid=old;exp=%d", time.Now().Add(-time.Minute).Unix())
+	fresh := fmt.Sprintf("tid=new;exp=%d", time.Now().Add(time.Hour).Unix())
+	config := &llm.Config{CopilotAPIKey: expired}
+	m := &TokenManager{
+		config:   config,
+		exchange: func(string) (string, error) { return fresh, nil },
+		margin:   5 * time.Minute,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Start(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for config.APIKey() != fresh {
+		if time.Now().After(deadline) {
+			t.Fatalf("APIKey() = %q, want refreshed key", config.APIKey())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
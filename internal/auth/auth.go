@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -68,8 +70,9 @@ func (s *Service) Authenticate() error {
 }
 
 // VerifyAppAPIKey checks if the provided API key is valid for accessing this app's API.
-// This function verifies keys against the VALID_API_KEYS environment variable, which
-// should contain a comma-separated list of valid API keys.
+// This function verifies keys against the key store set with SetKeyStore and then
+// against the legacy VALID_API_KEYS environment variable, which should contain a
+// comma-separated list of valid API keys. Revoked and expired keys are rejected.
 //
 // If the DISABLE_AUTH environment variable is set to "true" or "1", all authentication
 // checks will be bypassed and any API key will be considered valid.
@@ -89,6 +92,11 @@ func VerifyAppAPIKey(apiKey string) bool {
 		return true
 	}
 
+	// Check named keys issued by the key store
+	if _, err := AuthenticateAppAPIKey(apiKey); err == nil {
+		return true
+	}
+
 	// Check environment variables
 	validKeys := os.Getenv("VALID_API_KEYS")
 	if validKeys == "" {
@@ -252,6 +260,67 @@ func (p *PublicKey) TryFrom(pemStr string) error {
 	return nil
 }
 
+// ParseSigningKey parses a PEM-encoded RSA (PKCS #1 or #8) or Ed25519
+// (PKCS #8) private key
+func ParseSigningKey(pemData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T; use an RSA or Ed25519 key", key)
+	}
+}
+
+// ParseVerificationKey parses a PEM-encoded RSA or Ed25519 public key
+// (PKIX), or the public key of a private key accepted by ParseSigningKey
+func ParseVerificationKey(pemData []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block")
+	}
+	if block.Type != "PUBLIC KEY" {
+		key, err := ParseSigningKey(pemData)
+		if err != nil {
+			return nil, err
+		}
+		return key.Public(), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return key, nil
+	case ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T; use an RSA or Ed25519 key", key)
+	}
+}
+
+// MarshalPublicKeyPEM returns the PEM-encoded public key of a signing key
+func MarshalPublicKeyPEM(key crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
 // EncryptString encrypts a string using the public key
 func (p *PublicKey) EncryptString(text string, format EncryptionFormat) (string, error) {
 	var encryptedBytes []byte
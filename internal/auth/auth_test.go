@@ -1,6 +1,12 @@
 package auth
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"os"
 	"strconv"
 	"strings"
@@ -230,6 +236,53 @@ MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA1234567890
 	}
 }
 
+func TestParseSigningKey(t *testing.T) {
+	_, rsaKey, err := GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := func(key interface{}) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey.Key)})
+	for name, data := range map[string][]byte{"RSA PKCS #1": pkcs1, "RSA PKCS #8": pkcs8(rsaKey.Key), "Ed25519": pkcs8(edKey)} {
+		key, err := ParseSigningKey(data)
+		if err != nil {
+			t.Errorf("ParseSigningKey(%s) error = %v", name, err)
+			continue
+		}
+		if public, err := MarshalPublicKeyPEM(key); err != nil || !strings.HasPrefix(public, "-----BEGIN PUBLIC KEY-----") {
+			t.Errorf("MarshalPublicKeyPEM(%s) = %q, %v", name, public, err)
+		}
+	}
+	public, _ := MarshalPublicKeyPEM(edKey)
+	if key, err := ParseVerificationKey([]byte(public)); err != nil || !edKey.Public().(ed25519.PublicKey).Equal(key) {
+		t.Errorf("ParseVerificationKey(public key) = %v, %v", key, err)
+	}
+	if key, err := ParseVerificationKey(pkcs1); err != nil || !rsaKey.Key.PublicKey.Equal(key) {
+		t.Errorf("ParseVerificationKey(private key) = %v, %v", key, err)
+	}
+	if _, err := ParseSigningKey(pkcs8(ecKey)); err == nil {
+		t.Error("ParseSigningKey(ECDSA) succeeded")
+	}
+	if _, err := ParseSigningKey([]byte("not a key")); err == nil {
+		t.Error("ParseSigningKey(garbage) succeeded")
+	}
+}
+
 func TestRandomToken(t *testing.T) {
 	token1 := RandomToken()
 	token2 := RandomToken()
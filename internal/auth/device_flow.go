@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"copilot-proxy/pkg/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultGitHubClientID is the OAuth app of the GitHub Copilot editor
+// plugins, whose tokens can be exchanged for Copilot API keys
+const DefaultGitHubClientID = "Iv1.b507a08c87ecfe98"
+
+// Device flow errors
+var (
+	ErrDeviceCodeExpired = errors.New("device code expired before it was authorized")
+	ErrAccessDenied      = errors.New("authorization was denied")
+)
+
+// DeviceCode is GitHub's response to a device authorization request
+type DeviceCode struct {
+	// DeviceCode identifies the request while polling for the token
+	DeviceCode string `json:"device_code"`
+	// UserCode is the code the user enters at VerificationURI
+	UserCode string `json:"user_code"`
+	// VerificationURI is the page where the user authorizes the request
+	VerificationURI string `json:"verification_uri"`
+	// ExpiresIn is how many seconds the codes stay valid
+	ExpiresIn int `json:"expires_in"`
+	// Interval is the minimum number of seconds between polls
+	Interval int `json:"interval"`
+}
+
+// DeviceFlow obtains a GitHub OAuth token with GitHub's device authorization
+// flow: the user enters a code on github.com while the client polls for the
+// resulting token.
+type DeviceFlow struct {
+	// ClientID is the OAuth app requesting access
+	ClientID string
+	// BaseURL is the GitHub web URL (default: https://github.com)
+	BaseURL string
+	// HTTPClient sends the requests (default: http.DefaultClient)
+	HTTPClient *http.Client
+}
+
+// NewDeviceFlow returns a device flow for the Copilot OAuth app, or the app
+// set in GITHUB_CLIENT_ID, on the GitHub instance set in GITHUB_HOST, sending
+// requests through the upstream proxy
+func NewDeviceFlow() *DeviceFlow {
+	clientID := os.Getenv("GITHUB_CLIENT_ID")
+	if clientID == "" {
+		clientID = DefaultGitHubClientID
+	}
+	return &DeviceFlow{ClientID: clientID, BaseURL: utils.GitHubWebURL(), HTTPClient: utils.NewUpstreamClient()}
+}
+
+// RequestCode starts the flow and returns the code to show to the user
+func (f *DeviceFlow) RequestCode(ctx context.Context) (*DeviceCode, error) {
+	var code DeviceCode
+	if err := f.post(ctx, "/login/device/code", url.Values{
+		"client_id": {f.ClientID},
+		"scope":     {"read:user"},
+	}, &code); err != nil {
+		return nil, fmt.Errorf("failed to request device code: %w", err)
+	}
+	if code.DeviceCode == "" || code.UserCode == "" {
+		return nil, errors.New("failed to request device code: empty response")
+	}
+	return &code, nil
+}
+
+// PollToken waits until the user has authorized the code and returns the
+// OAuth access token. It fails once the code expires, access is denied or
+// ctx is done.
+func (f *DeviceFlow) PollToken(ctx context.Context, code *DeviceCode) (string, error) {
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+
+		var resp struct {
+			AccessToken      string `json:"access_token"`
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+			Interval         int    `json:"interval"`
+		}
+		if err := f.post(ctx, "/login/oauth/access_token", url.Values{
+			"client_id":   {f.ClientID},
+			"device_code": {code.DeviceCode},
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		}, &resp); err != nil {
+			return "", fmt.Errorf("failed to poll for access token: %w", err)
+		}
+
+		switch resp.Error {
+		case "":
+			if resp.AccessToken == "" {
+				return "", errors.New("failed to poll for access token: empty response")
+			}
+			return resp.AccessToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			if resp.Interval > 0 {
+				interval = time.Duration(resp.Interval) * time.Second
+			} else {
+				interval += 5 * time.Second
+			}
+		case "expired_token":
+			return "", ErrDeviceCodeExpired
+		case "access_denied":
+			return "", ErrAccessDenied
+		default:
+			return "", fmt.Errorf("failed to poll for access token: %s: %s", resp.Error, resp.ErrorDescription)
+		}
+		if code.ExpiresIn > 0 && time.Now().After(deadline) {
+			return "", ErrDeviceCodeExpired
+		}
+	}
+}
+
+// post sends a form to GitHub and decodes the JSON response into out
+func (f *DeviceFlow) post(ctx context.Context, path string, form url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(f.BaseURL, "/")+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "copilot-proxy")
+
+	client := f.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
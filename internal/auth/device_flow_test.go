@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newGitHubServer fakes GitHub's device flow endpoints; the access token
+// endpoint answers with the given poll results in order
+func newGitHubServer(t *testing.T, polls ...map[string]string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "test-client" || r.Header.Get("Accept") != "application/json" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Form)
+		}
+		switch r.URL.Path {
+		case "/login/device/code":
+			json.NewEncoder(w).Encode(DeviceCode{DeviceCode: "dev-123", UserCode: "ABCD-1234",
+				VerificationURI: "https://github.com/login/device", ExpiresIn: 900})
+		case "/login/oauth/access_token":
+			if r.Form.Get("device_code") != "dev-123" {
+				t.Errorf("device_code = %q", r.Form.Get("device_code"))
+			}
+			if len(polls) == 0 {
+				t.Error("too many polls")
+				http.Error(w, "too many polls", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(polls[0])
+			polls = polls[1:]
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestDeviceFlow(t *testing.T) {
+	server := newGitHubServer(t,
+		map[string]string{"error": "authorization_pending"},
+		map[string]string{"access_token": "gho_token"},
+	)
+	defer server.Close()
+	flow := &DeviceFlow{ClientID: "test-client", BaseURL: server.URL}
+
+	code, err := flow.RequestCode(context.Background())
+	if err != nil || code.UserCode != "ABCD-1234" {
+		t.Fatalf("RequestCode() = %+v, %v", code, err)
+	}
+	token, err := flow.PollToken(context.Background(), code)
+	if err != nil || token != "gho_token" {
+		t.Errorf("PollToken() = %q, %v", token, err)
+	}
+}
+
+func TestDeviceFlowErrors(t *testing.T) {
+	tests := []struct {
+		poll    map[string]string
+		wantErr error
+	}{
+		{map[string]string{"error": "access_denied"}, ErrAccessDenied},
+		{map[string]string{"error": "expired_token"}, ErrDeviceCodeExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.poll["error"], func(t *testing.T) {
+			server := newGitHubServer(t, tt.poll)
+			defer server.Close()
+			flow := &DeviceFlow{ClientID: "test-client", BaseURL: server.URL}
+			if _, err := flow.PollToken(context.Background(), &DeviceCode{DeviceCode: "dev-123"}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("PollToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flow := &DeviceFlow{ClientID: "test-client", BaseURL: "http://127.0.0.1:0"}
+	if _, err := flow.PollToken(ctx, &DeviceCode{DeviceCode: "dev-123", Interval: 5}); !errors.Is(err, context.Canceled) {
+		t.Errorf("PollToken(canceled) error = %v, want context.Canceled", err)
+	}
+}
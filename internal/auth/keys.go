@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeyPrefix starts every API key issued by the key store
+const APIKeyPrefix = "cpk_"
+
+// Key store errors
+var (
+	ErrKeyNotFound = errors.New("API key not found")
+	ErrKeyRevoked  = errors.New("API key revoked")
+	ErrKeyExpired  = errors.New("API key expired")
+	ErrScopeDenied = errors.New("API key scope does not allow this request")
+	ErrKeyRotated  = errors.New("API key already rotated")
+)
+
+// DefaultRotationGrace is how long a rotated key keeps working by default
+const DefaultRotationGrace = 24 * time.Hour
+
+// KeyScopes restricts what an API key may be used for. Empty lists allow
+// everything. Entries ending in "*" match any value with that prefix, e.g.
+// "gpt-4o-mini*" or "/v1/chat/*".
+type KeyScopes struct {
+	// Models lists the models the key may use
+	Models []string `json:"models,omitempty"`
+	// Endpoints lists the request paths the key may call
+	Endpoints []string `json:"endpoints,omitempty"`
+	// NoStreaming rejects streaming completion requests
+	NoStreaming bool `json:"no_streaming,omitempty"`
+}
+
+// MatchScope reports whether value is allowed by patterns. An empty pattern
+// list allows every value.
+func MatchScope(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(value, prefix) {
+				return true
+			}
+		} else if pattern == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks a request against the scopes. An empty endpoint or model
+// is not checked. A nil KeyScopes allows everything.
+func (s *KeyScopes) Authorize(endpoint, model string, stream bool) error {
+	if s == nil {
+		return nil
+	}
+	if endpoint != "" && !MatchScope(s.Endpoints, endpoint) {
+		return fmt.Errorf("%w: endpoint %s is not allowed", ErrScopeDenied, endpoint)
+	}
+	if model != "" && !MatchScope(s.Models, model) {
+		return fmt.Errorf("%w: model %s is not allowed", ErrScopeDenied, model)
+	}
+	if stream && s.NoStreaming {
+		return fmt.Errorf("%w: streaming is not allowed", ErrScopeDenied)
+	}
+	return nil
+}
+
+// APIKey is a named application API key issued to one client or tool
+type APIKey struct {
+	// ID identifies the key in usage records, budgets and the admin API
+	ID uint64 `json:"id"`
+	// Name describes who or what the key was issued to
+	Name string `json:"name"`
+	// Key is the secret sent by clients as a bearer token. It is only set
+	// when a key is issued; stores keep just its hash.
+	Key string `json:"key,omitempty"`
+	// Hash is the SHA-256 hash of the secret, see HashAccessToken
+	Hash string `json:"hash,omitempty"`
+	// CreatedAt is when the key was issued
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the key stops working; nil never expires
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// RevokedAt is when the key was revoked; nil if it is still valid
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// Scopes restricts what the key may be used for; nil is unrestricted
+	Scopes *KeyScopes `json:"scopes,omitempty"`
+	// RotatedFrom is the ID of the key this one replaces
+	RotatedFrom uint64 `json:"rotated_from,omitempty"`
+	// ReplacedBy is the ID of the key that replaces this one. A replaced key
+	// keeps working until the end of its grace period at ExpiresAt.
+	ReplacedBy uint64 `json:"replaced_by,omitempty"`
+}
+
+// Check returns ErrKeyRevoked or ErrKeyExpired if the key cannot be used at now
+func (k APIKey) Check(now time.Time) error {
+	if k.RevokedAt != nil {
+		return ErrKeyRevoked
+	}
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+// replacement returns the key that replaces k when it is rotated at now, and
+// the expiry of k at the end of its grace period. The replacement inherits the
+// name and scopes of k; its ID and secret are filled in by the store.
+func (k APIKey) replacement(now time.Time, grace time.Duration, expiresAt *time.Time) (APIKey, *time.Time, error) {
+	if err := k.Check(now); err != nil {
+		return APIKey{}, nil, err
+	}
+	if k.ReplacedBy != 0 {
+		return APIKey{}, nil, fmt.Errorf("%w: replaced by key %d", ErrKeyRotated, k.ReplacedBy)
+	}
+	graceEnd := now.Add(grace).UTC()
+	if k.ExpiresAt != nil && k.ExpiresAt.Before(graceEnd) {
+		graceEnd = *k.ExpiresAt
+	}
+	next := APIKey{Name: k.Name, CreatedAt: now.UTC(), ExpiresAt: expiresAt, Scopes: k.Scopes, RotatedFrom: k.ID}
+	return next, &graceEnd, nil
+}
+
+// Redacted returns a copy of the key without its secret or hash, for listings
+func (k APIKey) Redacted() APIKey {
+	k.Key = ""
+	k.Hash = ""
+	return k
+}
+
+// issued returns the key as handed to its owner: with its secret but without
+// the stored hash
+func (k APIKey) issued(secret string) APIKey {
+	k.Key = secret
+	k.Hash = ""
+	return k
+}
+
+// KeyStore stores application API keys. Only hashes of the secrets are kept,
+// so a leaked store does not expose usable keys. Implementations must be safe
+// for concurrent use.
+type KeyStore interface {
+	// Create issues a new key; the returned key is the only one carrying its
+	// secret. A nil expiresAt never expires and nil scopes are unrestricted.
+	Create(name string, expiresAt *time.Time, scopes *KeyScopes) (APIKey, error)
+	// Get returns a key by ID
+	Get(id uint64) (APIKey, error)
+	// List returns all keys, including revoked and expired ones, by ID
+	List() ([]APIKey, error)
+	// Lookup returns the key with the given secret, or ErrKeyNotFound
+	Lookup(secret string) (APIKey, error)
+	// Revoke marks a key as revoked
+	Revoke(id uint64) error
+	// Rotate issues a replacement for an active key with the same name and
+	// scopes. The old key stays valid for grace and is then expired. A nil
+	// expiresAt lets the replacement never expire.
+	Rotate(id uint64, grace time.Duration, expiresAt *time.Time) (APIKey, error)
+	// Reload picks up keys changed outside this process
+	Reload() error
+	// Close releases the store's resources
+	Close() error
+}
+
+// newKeySecret generates a new random API key secret
+func newKeySecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	return APIKeyPrefix + hex.EncodeToString(b), nil
+}
+
+// OpenKeyStore opens a "file" (JSON) or "sqlite" key store at path. An empty
+// kind selects the file store and an empty path the default location in the
+// user's configuration directory.
+func OpenKeyStore(kind, path string) (KeyStore, error) {
+	if kind == "" {
+		kind = "file"
+	}
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate key store directory: %w", err)
+		}
+		name := "keys.json"
+		if kind == "sqlite" {
+			name = "keys.db"
+		}
+		path = filepath.Join(dir, "copilot-proxy", name)
+	}
+	switch kind {
+	case "file":
+		return NewFileKeyStore(path)
+	case "sqlite":
+		return NewSQLiteKeyStore(path)
+	default:
+		return nil, fmt.Errorf("unknown key store %q", kind)
+	}
+}
+
+// OpenKeyStoreFromEnv opens the key store selected by KEY_STORE and
+// KEY_STORE_PATH
+func OpenKeyStoreFromEnv() (KeyStore, error) {
+	return OpenKeyStore(os.Getenv("KEY_STORE"), os.Getenv("KEY_STORE_PATH"))
+}
+
+var (
+	keyStoreMu sync.RWMutex
+	keyStore   KeyStore
+)
+
+// SetKeyStore sets the key store consulted by VerifyAppAPIKey and
+// AuthenticateAppAPIKey; nil disables it.
+func SetKeyStore(store KeyStore) {
+	keyStoreMu.Lock()
+	defer keyStoreMu.Unlock()
+	keyStore = store
+}
+
+// ReloadKeyStore reloads the key store set by SetKeyStore, if any.
+func ReloadKeyStore() error {
+	keyStoreMu.RLock()
+	store := keyStore
+	keyStoreMu.RUnlock()
+	if store == nil {
+		return nil
+	}
+	return store.Reload()
+}
+
+// AuthenticateAppAPIKey returns the stored key matching secret if it is
+// neither revoked nor expired. It returns ErrKeyNotFound when no key store is
+// configured. Uses of rotated keys in their grace period are logged so that
+// remaining clients can be found and migrated.
+func AuthenticateAppAPIKey(secret string) (APIKey, error) {
+	keyStoreMu.RLock()
+	store := keyStore
+	keyStoreMu.RUnlock()
+	if store == nil || secret == "" {
+		return APIKey{}, ErrKeyNotFound
+	}
+	key, err := store.Lookup(secret)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if err := key.Check(time.Now()); err != nil {
+		return APIKey{}, err
+	}
+	if key.ReplacedBy != 0 {
+		log.Printf("Warning: deprecated API key %d (%s) used; it was replaced by key %d and stops working at %s",
+			key.ID, key.Name, key.ReplacedBy, key.ExpiresAt.Format(time.RFC3339))
+	}
+	return key, nil
+}
+
+// AppAPIKeyByID returns the stored key with the given ID if it is neither
+// revoked nor expired. It returns ErrKeyNotFound when no key store is
+// configured.
+func AppAPIKeyByID(id uint64) (APIKey, error) {
+	keyStoreMu.RLock()
+	store := keyStore
+	keyStoreMu.RUnlock()
+	if store == nil {
+		return APIKey{}, ErrKeyNotFound
+	}
+	key, err := store.Get(id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if err := key.Check(time.Now()); err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+// AuthorizeAppAPIKey checks a request made with secret against the scopes of
+// the stored key. Secrets that are not stored keys, such as the legacy
+// VALID_API_KEYS, are unrestricted.
+func AuthorizeAppAPIKey(secret, endpoint, model string, stream bool) error {
+	key, err := AuthenticateAppAPIKey(secret)
+	if err != nil {
+		return nil
+	}
+	return key.Scopes.Authorize(endpoint, model, stream)
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fileKeyStore keeps API keys in a JSON file that is rewritten on every change
+type fileKeyStore struct {
+	mu   sync.RWMutex
+	path string
+	keys []APIKey
+}
+
+// NewFileKeyStore opens the JSON key file at path, creating it on the first
+// change if it does not exist
+func NewFileKeyStore(path string) (KeyStore, error) {
+	store := &fileKeyStore{path: path}
+	if err := store.loadLocked(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload re-reads the key file, picking up keys edited by hand or by another
+// process. The current keys are kept if the file cannot be read.
+func (s *fileKeyStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadLocked()
+}
+
+// loadLocked reads the key file; a missing file holds no keys
+func (s *fileKeyStore) loadLocked() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.keys = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read key store: %w", err)
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("failed to parse key store %s: %w", s.path, err)
+	}
+	s.keys = keys
+
+	// Replace secrets written by earlier versions with their hashes
+	plaintext := false
+	for i := range s.keys {
+		if s.keys[i].Key != "" {
+			s.keys[i].Hash = HashAccessToken(s.keys[i].Key)
+			s.keys[i].Key = ""
+			plaintext = true
+		}
+	}
+	if plaintext {
+		return s.saveLocked()
+	}
+	return nil
+}
+
+func (s *fileKeyStore) Create(name string, expiresAt *time.Time, scopes *KeyScopes) (APIKey, error) {
+	secret, err := newKeySecret()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := APIKey{ID: s.nextIDLocked(), Name: name, Hash: HashAccessToken(secret), CreatedAt: time.Now().UTC(), ExpiresAt: expiresAt, Scopes: scopes}
+	s.keys = append(s.keys, key)
+	if err := s.saveLocked(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return APIKey{}, err
+	}
+	return key.issued(secret), nil
+}
+
+func (s *fileKeyStore) Get(id uint64) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.keys {
+		if k.ID == id {
+			return k, nil
+		}
+	}
+	return APIKey{}, ErrKeyNotFound
+}
+
+func (s *fileKeyStore) List() ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := append([]APIKey(nil), s.keys...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+func (s *fileKeyStore) Lookup(secret string) (APIKey, error) {
+	hash := []byte(HashAccessToken(secret))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(k.Hash), hash) == 1 {
+			return k, nil
+		}
+	}
+	return APIKey{}, ErrKeyNotFound
+}
+
+func (s *fileKeyStore) Revoke(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.keys {
+		if s.keys[i].ID != id {
+			continue
+		}
+		if s.keys[i].RevokedAt == nil {
+			now := time.Now().UTC()
+			s.keys[i].RevokedAt = &now
+			if err := s.saveLocked(); err != nil {
+				s.keys[i].RevokedAt = nil
+				return err
+			}
+		}
+		return nil
+	}
+	return ErrKeyNotFound
+}
+
+func (s *fileKeyStore) Rotate(id uint64, grace time.Duration, expiresAt *time.Time) (APIKey, error) {
+	secret, err := newKeySecret()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.keys {
+		if s.keys[i].ID != id {
+			continue
+		}
+		old := s.keys[i]
+		key, graceEnd, err := old.replacement(time.Now(), grace, expiresAt)
+		if err != nil {
+			return APIKey{}, err
+		}
+		key.ID, key.Hash = s.nextIDLocked(), HashAccessToken(secret)
+		s.keys[i].ReplacedBy, s.keys[i].ExpiresAt = key.ID, graceEnd
+		s.keys = append(s.keys, key)
+		if err := s.saveLocked(); err != nil {
+			s.keys = s.keys[:len(s.keys)-1]
+			s.keys[i] = old
+			return APIKey{}, err
+		}
+		return key.issued(secret), nil
+	}
+	return APIKey{}, ErrKeyNotFound
+}
+
+func (s *fileKeyStore) Close() error {
+	return nil
+}
+
+// nextIDLocked returns the ID of the next key
+func (s *fileKeyStore) nextIDLocked() uint64 {
+	var id uint64 = 1
+	for _, k := range s.keys {
+		if k.ID >= id {
+			id = k.ID + 1
+		}
+	}
+	return id
+}
+
+// saveLocked atomically rewrites the key file; it is only readable by the owner
+func (s *fileKeyStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create key store directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write key store: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
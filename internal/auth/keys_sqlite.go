@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	// Registers the "sqlite3" database/sql driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// keyMigrations upgrade the key database schema in order; SQLite's
+// user_version records how many of them have been applied.
+var keyMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		name       TEXT    NOT NULL,
+		secret     TEXT    NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER,
+		revoked_at INTEGER
+	);`,
+	`ALTER TABLE api_keys ADD COLUMN scopes TEXT;`,
+	`ALTER TABLE api_keys ADD COLUMN rotated_from INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE api_keys ADD COLUMN replaced_by INTEGER NOT NULL DEFAULT 0;`,
+	// Earlier versions stored the secrets themselves; hashPlaintextSecrets
+	// replaces them with their hashes
+	`ALTER TABLE api_keys RENAME COLUMN secret TO secret_hash;`,
+}
+
+// migrateKeyDB applies the migrations the database has not seen yet
+func migrateKeyDB(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(keyMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(keyMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteKeyStore keeps API keys in a SQLite database
+type sqliteKeyStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteKeyStore opens or creates the SQLite key database at path
+func NewSQLiteKeyStore(path string) (KeyStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create key store directory: %w", err)
+	}
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key store: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if err := migrateKeyDB(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize key store: %w", err)
+	}
+	if err := hashPlaintextSecrets(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to hash stored API keys: %w", err)
+	}
+	return &sqliteKeyStore{db: db}, nil
+}
+
+// hashPlaintextSecrets replaces secrets stored by earlier versions with
+// their hashes
+func hashPlaintextSecrets(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, secret_hash FROM api_keys WHERE secret_hash NOT LIKE '$sha256$%'`)
+	if err != nil {
+		return err
+	}
+	secrets := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var secret string
+		if err := rows.Scan(&id, &secret); err != nil {
+			rows.Close()
+			return err
+		}
+		secrets[id] = secret
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, secret := range secrets {
+		if _, err := db.Exec(`UPDATE api_keys SET secret_hash = ? WHERE id = ?`, HashAccessToken(secret), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const keyColumns = `id, name, secret_hash, created_at, expires_at, revoked_at, scopes, rotated_from, replaced_by`
+
+// scanKey reads one api_keys row
+func scanKey(row interface{ Scan(...interface{}) error }) (APIKey, error) {
+	var key APIKey
+	var createdAt int64
+	var expiresAt, revokedAt sql.NullInt64
+	var scopes sql.NullString
+	if err := row.Scan(&key.ID, &key.Name, &key.Hash, &createdAt, &expiresAt, &revokedAt, &scopes, &key.RotatedFrom, &key.ReplacedBy); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, ErrKeyNotFound
+		}
+		return APIKey{}, err
+	}
+	key.CreatedAt = time.UnixMilli(createdAt).UTC()
+	key.ExpiresAt = nullTime(expiresAt)
+	key.RevokedAt = nullTime(revokedAt)
+	if scopes.Valid {
+		key.Scopes = &KeyScopes{}
+		if err := json.Unmarshal([]byte(scopes.String), key.Scopes); err != nil {
+			return APIKey{}, fmt.Errorf("invalid scopes of API key %d: %w", key.ID, err)
+		}
+	}
+	return key, nil
+}
+
+func nullTime(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.UnixMilli(v.Int64).UTC()
+	return &t
+}
+
+func (s *sqliteKeyStore) Create(name string, expiresAt *time.Time, scopes *KeyScopes) (APIKey, error) {
+	secret, err := newKeySecret()
+	if err != nil {
+		return APIKey{}, err
+	}
+	key := APIKey{Name: name, Hash: HashAccessToken(secret), CreatedAt: time.Now().UTC(), ExpiresAt: expiresAt, Scopes: scopes}
+	if err := insertKey(s.db, &key); err != nil {
+		return APIKey{}, fmt.Errorf("failed to create API key: %w", err)
+	}
+	return key.issued(secret), nil
+}
+
+// insertKey stores a new key and sets its ID
+func insertKey(db interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, key *APIKey) error {
+	var scopes sql.NullString
+	if key.Scopes != nil {
+		data, err := json.Marshal(key.Scopes)
+		if err != nil {
+			return err
+		}
+		scopes = sql.NullString{String: string(data), Valid: true}
+	}
+	result, err := db.Exec(`INSERT INTO api_keys (name, secret_hash, created_at, expires_at, scopes, rotated_from) VALUES (?, ?, ?, ?, ?, ?)`,
+		key.Name, key.Hash, key.CreatedAt.UnixMilli(), nullMillis(key.ExpiresAt), scopes, key.RotatedFrom)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	key.ID = uint64(id)
+	return nil
+}
+
+func nullMillis(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixMilli(), Valid: true}
+}
+
+func (s *sqliteKeyStore) Get(id uint64) (APIKey, error) {
+	return scanKey(s.db.QueryRow(`SELECT `+keyColumns+` FROM api_keys WHERE id = ?`, id))
+}
+
+func (s *sqliteKeyStore) List() ([]APIKey, error) {
+	rows, err := s.db.Query(`SELECT ` + keyColumns + ` FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqliteKeyStore) Lookup(secret string) (APIKey, error) {
+	return scanKey(s.db.QueryRow(`SELECT `+keyColumns+` FROM api_keys WHERE secret_hash = ?`, HashAccessToken(secret)))
+}
+
+func (s *sqliteKeyStore) Revoke(id uint64) error {
+	result, err := s.db.Exec(`UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?`, time.Now().UnixMilli(), id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (s *sqliteKeyStore) Rotate(id uint64, grace time.Duration, expiresAt *time.Time) (APIKey, error) {
+	secret, err := newKeySecret()
+	if err != nil {
+		return APIKey{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return APIKey{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanKey(tx.QueryRow(`SELECT `+keyColumns+` FROM api_keys WHERE id = ?`, id))
+	if err != nil {
+		return APIKey{}, err
+	}
+	key, graceEnd, err := old.replacement(time.Now(), grace, expiresAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.Hash = HashAccessToken(secret)
+	if err := insertKey(tx, &key); err != nil {
+		return APIKey{}, fmt.Errorf("failed to rotate API key: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE api_keys SET replaced_by = ?, expires_at = ? WHERE id = ?`, key.ID, graceEnd.UnixMilli(), id); err != nil {
+		return APIKey{}, fmt.Errorf("failed to rotate API key: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return APIKey{}, err
+	}
+	return key.issued(secret), nil
+}
+
+// Reload is a no-op: the database is queried on every lookup
+func (s *sqliteKeyStore) Reload() error {
+	return nil
+}
+
+func (s *sqliteKeyStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,349 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyStores(t *testing.T) {
+	dir := t.TempDir()
+	for _, kind := range []string{"file", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			store, err := OpenKeyStore(kind, filepath.Join(dir, "keys-"+kind))
+			if err != nil {
+				t.Fatalf("OpenKeyStore() error = %v", err)
+			}
+			defer store.Close()
+
+			editor, err := store.Create("editor", nil, nil)
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			past := time.Now().Add(-time.Hour)
+			script, err := store.Create("script", &past, nil)
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			if !strings.HasPrefix(editor.Key, APIKeyPrefix) || editor.Key == script.Key || editor.ID == script.ID {
+				t.Fatalf("Create() returned keys %+v and %+v", editor, script)
+			}
+
+			found, err := store.Lookup(editor.Key)
+			if err != nil || found.ID != editor.ID || found.Name != "editor" || found.Check(time.Now()) != nil {
+				t.Errorf("Lookup() = %+v, %v", found, err)
+			}
+			if _, err := store.Lookup("cpk_unknown"); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Lookup(unknown) error = %v, want ErrKeyNotFound", err)
+			}
+			if found, _ := store.Lookup(script.Key); !errors.Is(found.Check(time.Now()), ErrKeyExpired) {
+				t.Errorf("expired key Check() = %v, want ErrKeyExpired", found.Check(time.Now()))
+			}
+
+			if err := store.Revoke(editor.ID); err != nil {
+				t.Fatalf("Revoke() error = %v", err)
+			}
+			if err := store.Revoke(999); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Revoke(999) error = %v, want ErrKeyNotFound", err)
+			}
+			revoked, err := store.Get(editor.ID)
+			if err != nil || !errors.Is(revoked.Check(time.Now()), ErrKeyRevoked) {
+				t.Errorf("Get() after revoke = %+v, %v", revoked, err)
+			}
+
+			keys, err := store.List()
+			if err != nil || len(keys) != 2 || keys[0].ID != editor.ID {
+				t.Errorf("List() = %+v, %v", keys, err)
+			}
+		})
+	}
+}
+
+func TestFileKeyStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, _ := NewFileKeyStore(path)
+	key, err := store.Create("editor", nil, nil)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	reopened, err := NewFileKeyStore(path)
+	if err != nil {
+		t.Fatalf("NewFileKeyStore() error = %v", err)
+	}
+	if found, err := reopened.Lookup(key.Key); err != nil || found.ID != key.ID {
+		t.Errorf("Lookup() after reopen = %+v, %v", found, err)
+	}
+	next, _ := reopened.Create("script", nil, nil)
+	if next.ID != key.ID+1 {
+		t.Errorf("next ID = %d, want %d", next.ID, key.ID+1)
+	}
+}
+
+func TestFileKeyStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, _ := NewFileKeyStore(path)
+	other, _ := NewFileKeyStore(path)
+	key, err := other.Create("editor", nil, nil)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	if _, err := store.Lookup(key.Key); err != ErrKeyNotFound {
+		t.Fatalf("Lookup() before reload error = %v", err)
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if found, err := store.Lookup(key.Key); err != nil || found.ID != key.ID {
+		t.Errorf("Lookup() after reload = %+v, %v", found, err)
+	}
+
+	// A broken file keeps the loaded keys
+	os.WriteFile(path, []byte("{"), 0o600)
+	if err := store.Reload(); err == nil {
+		t.Error("Reload() of a malformed file succeeded")
+	}
+	if _, err := store.Lookup(key.Key); err != nil {
+		t.Errorf("Lookup() after failed reload error = %v", err)
+	}
+}
+
+func TestVerifyAppAPIKeyWithKeyStore(t *testing.T) {
+	store, _ := NewFileKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	SetKeyStore(store)
+	defer SetKeyStore(nil)
+
+	active, _ := store.Create("active", nil, nil)
+	revoked, _ := store.Create("revoked", nil, nil)
+	store.Revoke(revoked.ID)
+
+	if !VerifyAppAPIKey(active.Key) {
+		t.Error("VerifyAppAPIKey() rejected an active key")
+	}
+	if VerifyAppAPIKey(revoked.Key) {
+		t.Error("VerifyAppAPIKey() accepted a revoked key")
+	}
+	if _, err := AuthenticateAppAPIKey(revoked.Key); !errors.Is(err, ErrKeyRevoked) {
+		t.Errorf("AuthenticateAppAPIKey() error = %v, want ErrKeyRevoked", err)
+	}
+}
+
+func TestKeyScopesAuthorize(t *testing.T) {
+	scopes := &KeyScopes{
+		Models:      []string{"gpt-4o-mini", "claude-*"},
+		Endpoints:   []string{"/v1/chat/completions"},
+		NoStreaming: true,
+	}
+	tests := []struct {
+		name     string
+		scopes   *KeyScopes
+		endpoint string
+		model    string
+		stream   bool
+		wantErr  bool
+	}{
+		{"unrestricted", nil, "/v1/embeddings", "gpt-4o", true, false},
+		{"allowed", scopes, "/v1/chat/completions", "gpt-4o-mini", false, false},
+		{"model prefix", scopes, "/v1/chat/completions", "claude-3.5-sonnet", false, false},
+		{"endpoint only", scopes, "/v1/chat/completions", "", false, false},
+		{"denied endpoint", scopes, "/v1/embeddings", "gpt-4o-mini", false, true},
+		{"denied model", scopes, "/v1/chat/completions", "gpt-4o", false, true},
+		{"no exact prefix match", scopes, "/v1/chat/completions", "gpt-4o-mini-2024", false, true},
+		{"denied streaming", scopes, "/v1/chat/completions", "gpt-4o-mini", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.scopes.Authorize(tt.endpoint, tt.model, tt.stream)
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrScopeDenied)) {
+				t.Errorf("Authorize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyStoresPersistScopes(t *testing.T) {
+	dir := t.TempDir()
+	for _, kind := range []string{"file", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			path := filepath.Join(dir, "keys-"+kind)
+			store, err := OpenKeyStore(kind, path)
+			if err != nil {
+				t.Fatalf("OpenKeyStore() error = %v", err)
+			}
+			scopes := &KeyScopes{Models: []string{"gpt-4o-mini"}, NoStreaming: true}
+			scoped, _ := store.Create("script", nil, scopes)
+			plain, _ := store.Create("editor", nil, nil)
+			store.Close()
+
+			reopened, err := OpenKeyStore(kind, path)
+			if err != nil {
+				t.Fatalf("OpenKeyStore() after close error = %v", err)
+			}
+			defer reopened.Close()
+			found, err := reopened.Get(scoped.ID)
+			if err != nil || found.Scopes == nil || found.Scopes.Models[0] != "gpt-4o-mini" || !found.Scopes.NoStreaming {
+				t.Errorf("Get(scoped) = %+v, %v", found, err)
+			}
+			if found, _ := reopened.Get(plain.ID); found.Scopes != nil {
+				t.Errorf("Get(plain) scopes = %+v, want nil", found.Scopes)
+			}
+		})
+	}
+}
+
+func TestAuthorizeAppAPIKey(t *testing.T) {
+	store, _ := NewFileKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	SetKeyStore(store)
+	defer SetKeyStore(nil)
+
+	key, _ := store.Create("script", nil, &KeyScopes{Models: []string{"gpt-4o-mini"}})
+	if err := AuthorizeAppAPIKey(key.Key, "/copilot", "gpt-4o-mini", true); err != nil {
+		t.Errorf("AuthorizeAppAPIKey(allowed) error = %v", err)
+	}
+	if err := AuthorizeAppAPIKey(key.Key, "/copilot", "gpt-4o", false); !errors.Is(err, ErrScopeDenied) {
+		t.Errorf("AuthorizeAppAPIKey(denied model) error = %v, want ErrScopeDenied", err)
+	}
+	if err := AuthorizeAppAPIKey("legacy-key", "/copilot", "gpt-4o", false); err != nil {
+		t.Errorf("AuthorizeAppAPIKey(legacy key) error = %v", err)
+	}
+}
+
+func TestKeyStoresRotate(t *testing.T) {
+	dir := t.TempDir()
+	for _, kind := range []string{"file", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			store, err := OpenKeyStore(kind, filepath.Join(dir, "keys-"+kind))
+			if err != nil {
+				t.Fatalf("OpenKeyStore() error = %v", err)
+			}
+			defer store.Close()
+
+			scopes := &KeyScopes{Models: []string{"gpt-4o-mini"}}
+			old, _ := store.Create("script", nil, scopes)
+			next, err := store.Rotate(old.ID, time.Hour, nil)
+			if err != nil {
+				t.Fatalf("Rotate() error = %v", err)
+			}
+			if next.ID == old.ID || next.Key == old.Key || next.Name != "script" || next.RotatedFrom != old.ID ||
+				next.Scopes == nil || next.Scopes.Models[0] != "gpt-4o-mini" || next.ExpiresAt != nil {
+				t.Errorf("Rotate() = %+v", next)
+			}
+
+			// The old key keeps working until the grace period ends
+			deprecated, err := store.Lookup(old.Key)
+			if err != nil || deprecated.ReplacedBy != next.ID || deprecated.ExpiresAt == nil {
+				t.Fatalf("Lookup(old) = %+v, %v", deprecated, err)
+			}
+			if err := deprecated.Check(time.Now()); err != nil {
+				t.Errorf("old key Check() during grace period = %v", err)
+			}
+			if err := deprecated.Check(time.Now().Add(2 * time.Hour)); !errors.Is(err, ErrKeyExpired) {
+				t.Errorf("old key Check() after grace period = %v, want ErrKeyExpired", err)
+			}
+
+			if _, err := store.Rotate(old.ID, time.Hour, nil); !errors.Is(err, ErrKeyRotated) {
+				t.Errorf("Rotate(rotated key) error = %v, want ErrKeyRotated", err)
+			}
+			if _, err := store.Rotate(999, time.Hour, nil); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Rotate(999) error = %v, want ErrKeyNotFound", err)
+			}
+			store.Revoke(next.ID)
+			if _, err := store.Rotate(next.ID, time.Hour, nil); !errors.Is(err, ErrKeyRevoked) {
+				t.Errorf("Rotate(revoked key) error = %v, want ErrKeyRevoked", err)
+			}
+		})
+	}
+}
+
+func TestRotateKeepsEarlierExpiry(t *testing.T) {
+	store, _ := NewFileKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	soon := time.Now().Add(time.Minute).UTC()
+	old, _ := store.Create("editor", &soon, nil)
+	if _, err := store.Rotate(old.ID, 24*time.Hour, nil); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if rotated, _ := store.Get(old.ID); !rotated.ExpiresAt.Equal(soon) {
+		t.Errorf("rotated key expires at %v, want %v", rotated.ExpiresAt, soon)
+	}
+}
+
+func TestKeyStoresKeepOnlyHashes(t *testing.T) {
+	dir := t.TempDir()
+	for _, kind := range []string{"file", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			path := filepath.Join(dir, "keys-"+kind)
+			store, err := OpenKeyStore(kind, path)
+			if err != nil {
+				t.Fatalf("OpenKeyStore() error = %v", err)
+			}
+			key, _ := store.Create("editor", nil, nil)
+			rotated, _ := store.Rotate(key.ID, time.Hour, nil)
+			if key.Hash != "" || rotated.Hash != "" {
+				t.Errorf("issued keys expose their hash: %+v, %+v", key, rotated)
+			}
+			stored, _ := store.Get(key.ID)
+			if stored.Key != "" || stored.Hash != HashAccessToken(key.Key) {
+				t.Errorf("Get() = %+v, want only the hash of the secret", stored)
+			}
+			store.Close()
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, secret := range []string{key.Key, rotated.Key} {
+				if strings.Contains(string(data), secret) {
+					t.Errorf("%s key store contains the secret %s", kind, secret)
+				}
+			}
+		})
+	}
+}
+
+func TestFileKeyStoreHashesPlaintextKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	legacy := `[{"id": 1, "name": "editor", "key": "cpk_legacy", "created_at": "2024-05-01T00:00:00Z"}]`
+	if err := os.WriteFile(path, []byte(legacy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileKeyStore(path)
+	if err != nil {
+		t.Fatalf("NewFileKeyStore() error = %v", err)
+	}
+	if key, err := store.Lookup("cpk_legacy"); err != nil || key.ID != 1 {
+		t.Errorf("Lookup(legacy key) = %+v, %v", key, err)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "cpk_legacy") {
+		t.Errorf("key file still contains the plaintext key: %s", data)
+	}
+}
+
+func TestSQLiteKeyStoreHashesPlaintextKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(keyMigrations[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO api_keys (name, secret, created_at) VALUES ('editor', 'cpk_legacy', 0)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := NewSQLiteKeyStore(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteKeyStore() error = %v", err)
+	}
+	defer store.Close()
+	key, err := store.Lookup("cpk_legacy")
+	if err != nil || key.Name != "editor" || key.Hash != HashAccessToken("cpk_legacy") {
+		t.Errorf("Lookup(legacy key) = %+v, %v", key, err)
+	}
+}
@@ -0,0 +1,353 @@
+// Package billing bills API key usage through Stripe.
+//
+// Each API key that is billed is mapped to a Stripe customer. The tokens
+// used by a key are summed and reported as a Stripe billing meter event per
+// key every report interval, so the customer's metered subscription price is
+// charged for them. Optionally, requests of keys whose customer has no active
+// or trialing subscription are rejected. Keys without a customer are neither
+// billed nor blocked.
+//
+// Billing is configured with:
+//   - STRIPE_API_KEY: Stripe secret key; billing is disabled without it
+//   - STRIPE_CUSTOMERS_FILE: JSON file mapping API key IDs to Stripe customer
+//     IDs, such as {"3": "cus_123"}
+//   - STRIPE_METER_EVENT: event name of the billing meter (default:
+//     copilot_proxy_tokens)
+//   - STRIPE_REPORT_INTERVAL: how often usage is reported (default: 1m)
+//   - STRIPE_REQUIRE_SUBSCRIPTION: reject keys whose customer has no active
+//     subscription (default: false)
+//   - STRIPE_SUBSCRIPTION_CACHE_TTL: how long a subscription status is
+//     trusted before Stripe is asked again (default: 5m)
+package billing
+
+import (
+	"context"
+	"copilot-proxy/internal/llm"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the optional settings
+const (
+	DefaultAPIURL               = "https://api.stripe.com"
+	DefaultMeterEvent           = "copilot_proxy_tokens"
+	DefaultReportInterval       = time.Minute
+	DefaultSubscriptionCacheTTL = 5 * time.Minute
+)
+
+// Config configures Stripe billing
+type Config struct {
+	APIKey               string
+	APIURL               string
+	CustomersFile        string
+	MeterEvent           string
+	ReportInterval       time.Duration
+	RequireSubscription  bool
+	SubscriptionCacheTTL time.Duration
+}
+
+// ConfigFromEnv reads the STRIPE_* variables
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		APIKey:               os.Getenv("STRIPE_API_KEY"),
+		APIURL:               os.Getenv("STRIPE_API_URL"),
+		CustomersFile:        os.Getenv("STRIPE_CUSTOMERS_FILE"),
+		MeterEvent:           os.Getenv("STRIPE_METER_EVENT"),
+		ReportInterval:       DefaultReportInterval,
+		SubscriptionCacheTTL: DefaultSubscriptionCacheTTL,
+	}
+	if config.APIURL == "" {
+		config.APIURL = DefaultAPIURL
+	}
+	if config.MeterEvent == "" {
+		config.MeterEvent = DefaultMeterEvent
+	}
+	var err error
+	if v := os.Getenv("STRIPE_REPORT_INTERVAL"); v != "" {
+		if config.ReportInterval, err = time.ParseDuration(v); err != nil || config.ReportInterval <= 0 {
+			return config, fmt.Errorf("invalid STRIPE_REPORT_INTERVAL %q", v)
+		}
+	}
+	if v := os.Getenv("STRIPE_SUBSCRIPTION_CACHE_TTL"); v != "" {
+		if config.SubscriptionCacheTTL, err = time.ParseDuration(v); err != nil || config.SubscriptionCacheTTL < 0 {
+			return config, fmt.Errorf("invalid STRIPE_SUBSCRIPTION_CACHE_TTL %q", v)
+		}
+	}
+	if v := os.Getenv("STRIPE_REQUIRE_SUBSCRIPTION"); v != "" {
+		if config.RequireSubscription, err = strconv.ParseBool(v); err != nil {
+			return config, fmt.Errorf("invalid STRIPE_REQUIRE_SUBSCRIPTION %q", v)
+		}
+	}
+	return config, nil
+}
+
+// Enabled reports whether a Stripe API key is configured
+func (c Config) Enabled() bool {
+	return c.APIKey != ""
+}
+
+// meterEvent is usage of one key waiting to be reported. The identifier is
+// kept across retries so Stripe counts the event once.
+type meterEvent struct {
+	identifier string
+	key        string
+	customer   string
+	tokens     int
+	time       time.Time
+}
+
+// subscriptionStatus is a cached answer to whether a customer has an active
+// subscription
+type subscriptionStatus struct {
+	active  bool
+	checked time.Time
+}
+
+// Stripe reports usage to Stripe and checks subscriptions
+type Stripe struct {
+	config Config
+	client *http.Client
+
+	mu            sync.Mutex
+	customers     map[string]string
+	pending       map[string]int
+	unsent        []meterEvent
+	subscriptions map[string]subscriptionStatus
+}
+
+// New creates a Stripe billing integration and loads the customers file
+func New(config Config) (*Stripe, error) {
+	s := &Stripe{
+		config:        config,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		pending:       make(map[string]int),
+		subscriptions: make(map[string]subscriptionStatus),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the customers file. The previous customers are kept if it
+// fails to load.
+func (s *Stripe) Reload() error {
+	customers := make(map[string]string)
+	if s.config.CustomersFile != "" {
+		data, err := os.ReadFile(s.config.CustomersFile)
+		if err != nil {
+			return fmt.Errorf("failed to read Stripe customers: %w", err)
+		}
+		if err := json.Unmarshal(data, &customers); err != nil {
+			return fmt.Errorf("failed to parse Stripe customers %s: %w", s.config.CustomersFile, err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.customers = customers
+	return nil
+}
+
+// customer returns the Stripe customer of a usage key
+func (s *Stripe) customer(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customer, ok := s.customers[key]
+	return customer, ok && customer != ""
+}
+
+// RecordUsage adds the tokens of a request to the usage of its key that is
+// reported next. Usage of keys without a customer is ignored.
+func (s *Stripe) RecordUsage(event models.UsageEvent) {
+	tokens := event.InputTokens + event.OutputTokens
+	if tokens <= 0 {
+		return
+	}
+	if _, ok := s.customer(event.Key); !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[event.Key] += tokens
+}
+
+// Start reports usage every report interval until ctx is canceled. Usage
+// recorded after the last report is left for a final Flush on shutdown.
+func (s *Stripe) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.config.ReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.Flush(ctx); err != nil {
+					log.Printf("Warning: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Flush reports the pending usage as one meter event per key. Events Stripe
+// did not accept are retried by the next flush.
+func (s *Stripe) Flush(ctx context.Context) error {
+	now := time.Now()
+	s.mu.Lock()
+	for key, tokens := range s.pending {
+		if customer, ok := s.customers[key]; ok && customer != "" {
+			s.unsent = append(s.unsent, meterEvent{
+				identifier: fmt.Sprintf("copilot-proxy-%s-%d", key, now.UnixNano()),
+				key:        key,
+				customer:   customer,
+				tokens:     tokens,
+				time:       now,
+			})
+		}
+	}
+	s.pending = make(map[string]int)
+	events := s.unsent
+	s.unsent = nil
+	s.mu.Unlock()
+
+	var failed []meterEvent
+	var firstErr error
+	for _, event := range events {
+		if err := s.sendMeterEvent(ctx, event); err != nil {
+			failed = append(failed, event)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if len(failed) > 0 {
+		s.mu.Lock()
+		s.unsent = append(failed, s.unsent...)
+		s.mu.Unlock()
+		return fmt.Errorf("failed to report usage of %d keys to Stripe, retrying later: %w", len(failed), firstErr)
+	}
+	return nil
+}
+
+// sendMeterEvent reports one meter event
+func (s *Stripe) sendMeterEvent(ctx context.Context, event meterEvent) error {
+	form := url.Values{
+		"event_name":                  {s.config.MeterEvent},
+		"identifier":                  {event.identifier},
+		"timestamp":                   {strconv.FormatInt(event.time.Unix(), 10)},
+		"payload[stripe_customer_id]": {event.customer},
+		"payload[value]":              {strconv.Itoa(event.tokens)},
+		"payload[api_key]":            {event.key},
+	}
+	resp, err := s.do(ctx, http.MethodPost, "/v1/billing/meter_events", form)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// CheckSubscription rejects requests of a user's key when STRIPE_REQUIRE_SUBSCRIPTION
+// is set and the key's customer has no active or trialing subscription.
+// If Stripe cannot be reached the last known status is used, and keys whose
+// status was never known are let through.
+func (s *Stripe) CheckSubscription(userID uint64) error {
+	if !s.config.RequireSubscription {
+		return nil
+	}
+	customer, ok := s.customer(strconv.FormatUint(userID, 10))
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	status, cached := s.subscriptions[customer]
+	s.mu.Unlock()
+	if !cached || time.Since(status.checked) >= s.config.SubscriptionCacheTTL {
+		active, err := s.hasActiveSubscription(context.Background(), customer)
+		if err != nil {
+			log.Printf("Warning: failed to check the Stripe subscription of %s: %v", customer, err)
+		} else {
+			status = subscriptionStatus{active: active, checked: time.Now()}
+			cached = true
+			s.mu.Lock()
+			s.subscriptions[customer] = status
+			s.mu.Unlock()
+		}
+	}
+	if cached && !status.active {
+		return fmt.Errorf("%w: the subscription of this API key is not active", llm.ErrSubscriptionInactive)
+	}
+	return nil
+}
+
+// hasActiveSubscription asks Stripe whether a customer has an active or
+// trialing subscription
+func (s *Stripe) hasActiveSubscription(ctx context.Context, customer string) (bool, error) {
+	query := url.Values{"customer": {customer}, "status": {"all"}, "limit": {"100"}}
+	resp, err := s.do(ctx, http.MethodGet, "/v1/subscriptions?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Data []struct {
+			Status string `json:"status"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return false, fmt.Errorf("invalid Stripe response: %w", err)
+	}
+	for _, subscription := range list.Data {
+		if subscription.Status == "active" || subscription.Status == "trialing" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// do sends a request to the Stripe API. Responses other than 2xx are
+// returned as errors with Stripe's error message.
+func (s *Stripe) do(ctx context.Context, method, path string, form url.Values) (*http.Response, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.config.APIURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.config.APIKey)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Stripe request failed: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var stripeErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, &stripeErr) == nil && stripeErr.Error.Message != "" {
+			return nil, fmt.Errorf("Stripe returned %s: %s", resp.Status, stripeErr.Error.Message)
+		}
+		return nil, fmt.Errorf("Stripe returned %s", resp.Status)
+	}
+	return resp, nil
+}
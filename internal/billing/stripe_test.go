@@ -0,0 +1,175 @@
+package billing
+
+import (
+	"context"
+	"copilot-proxy/internal/llm"
+	"copilot-proxy/pkg/models"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStripe records meter events and answers subscription lists with the
+// statuses of its customers
+type fakeStripe struct {
+	mu            sync.Mutex
+	events        []map[string]string
+	subscriptions map[string]string
+	failEvents    bool
+	lookups       int
+}
+
+func (f *fakeStripe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer sk_test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": {"message": "Invalid API Key provided"}}`))
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/billing/meter_events":
+		if f.failEvents {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.ParseForm()
+		event := make(map[string]string)
+		for k := range r.PostForm {
+			event[k] = r.PostForm.Get(k)
+		}
+		f.events = append(f.events, event)
+		w.Write([]byte(`{"object": "billing.meter_event"}`))
+	case "/v1/subscriptions":
+		f.lookups++
+		status := f.subscriptions[r.URL.Query().Get("customer")]
+		if status == "" {
+			w.Write([]byte(`{"data": []}`))
+			return
+		}
+		w.Write([]byte(`{"data": [{"status": "canceled"}, {"status": "` + status + `"}]}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestStripe(t *testing.T, fake *fakeStripe, requireSubscription bool) *Stripe {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	path := filepath.Join(t.TempDir(), "customers.json")
+	os.WriteFile(path, []byte(`{"1": "cus_active", "2": "cus_canceled"}`), 0o600)
+	s, err := New(Config{
+		APIKey:               "sk_test",
+		APIURL:               server.URL,
+		CustomersFile:        path,
+		MeterEvent:           DefaultMeterEvent,
+		ReportInterval:       time.Minute,
+		RequireSubscription:  requireSubscription,
+		SubscriptionCacheTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return s
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("STRIPE_API_KEY", "sk_test")
+	t.Setenv("STRIPE_REPORT_INTERVAL", "30s")
+	t.Setenv("STRIPE_REQUIRE_SUBSCRIPTION", "true")
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigFromEnv() error = %v", err)
+	}
+	if !config.Enabled() || config.ReportInterval != 30*time.Second || !config.RequireSubscription ||
+		config.APIURL != DefaultAPIURL || config.MeterEvent != DefaultMeterEvent {
+		t.Errorf("ConfigFromEnv() = %+v", config)
+	}
+
+	t.Setenv("STRIPE_REPORT_INTERVAL", "soon")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("ConfigFromEnv() with an invalid interval should fail")
+	}
+}
+
+func TestStripeReportsUsagePerKey(t *testing.T) {
+	fake := &fakeStripe{}
+	s := newTestStripe(t, fake, false)
+
+	s.RecordUsage(models.UsageEvent{Key: "1", InputTokens: 100, OutputTokens: 50})
+	s.RecordUsage(models.UsageEvent{Key: "1", InputTokens: 10})
+	s.RecordUsage(models.UsageEvent{Key: "2", InputTokens: 5})
+	s.RecordUsage(models.UsageEvent{Key: "3", InputTokens: 1000}) // no customer
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	values := make(map[string]string)
+	for _, event := range fake.events {
+		if event["event_name"] != DefaultMeterEvent || event["identifier"] == "" {
+			t.Errorf("meter event = %v", event)
+		}
+		values[event["payload[stripe_customer_id]"]] = event["payload[value]"]
+	}
+	if len(fake.events) != 2 || values["cus_active"] != "160" || values["cus_canceled"] != "5" {
+		t.Errorf("meter events = %v", fake.events)
+	}
+
+	// Nothing is reported without new usage
+	if err := s.Flush(context.Background()); err != nil || len(fake.events) != 2 {
+		t.Errorf("Flush() = %v with %d events, want no new events", err, len(fake.events))
+	}
+}
+
+func TestStripeRetriesFailedEvents(t *testing.T) {
+	fake := &fakeStripe{failEvents: true}
+	s := newTestStripe(t, fake, false)
+
+	s.RecordUsage(models.UsageEvent{Key: "1", InputTokens: 100})
+	if err := s.Flush(context.Background()); err == nil {
+		t.Fatal("Flush() should fail while Stripe is down")
+	}
+	identifier := s.unsent[0].identifier
+
+	fake.failEvents = false
+	s.RecordUsage(models.UsageEvent{Key: "1", InputTokens: 20})
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if len(fake.events) != 2 || fake.events[0]["identifier"] != identifier || fake.events[0]["payload[value]"] != "100" {
+		t.Errorf("meter events = %v, want the failed event retried with its identifier", fake.events)
+	}
+}
+
+func TestStripeCheckSubscription(t *testing.T) {
+	fake := &fakeStripe{subscriptions: map[string]string{"cus_active": "trialing", "cus_canceled": "past_due"}}
+	s := newTestStripe(t, fake, true)
+
+	if err := s.CheckSubscription(1); err != nil {
+		t.Errorf("CheckSubscription(active) error = %v", err)
+	}
+	if err := s.CheckSubscription(2); !errors.Is(err, llm.ErrSubscriptionInactive) {
+		t.Errorf("CheckSubscription(past due) error = %v, want ErrSubscriptionInactive", err)
+	}
+	if err := s.CheckSubscription(3); err != nil {
+		t.Errorf("CheckSubscription(no customer) error = %v", err)
+	}
+
+	// Statuses are cached
+	s.CheckSubscription(1)
+	if fake.lookups != 2 {
+		t.Errorf("subscription lookups = %d, want 2", fake.lookups)
+	}
+
+	// Without STRIPE_REQUIRE_SUBSCRIPTION nothing is checked
+	s.config.RequireSubscription = false
+	if err := s.CheckSubscription(2); err != nil {
+		t.Errorf("CheckSubscription() without the requirement error = %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Package buildinfo reports which build of the proxy is running.
+//
+// The version, commit and build date are set at link time:
+//
+//	go build -ldflags "-X copilot-proxy/internal/buildinfo.Version=v1.2.0 \
+//	  -X copilot-proxy/internal/buildinfo.Commit=$(git rev-parse --short HEAD) \
+//	  -X copilot-proxy/internal/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+//	  -o coproxy ./cmd
+//
+// Without them the commit and date are taken from the version control
+// information the Go toolchain embeds when building inside a checkout.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set with -ldflags "-X copilot-proxy/internal/buildinfo.Version=..."
+var (
+	// Version is the release version (default "dev")
+	Version = "dev"
+	// Commit is the VCS revision the binary was built from
+	Commit = ""
+	// Date is when the binary was built, in RFC 3339 format
+	Date = ""
+)
+
+// Info describes a build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"build_date,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information, filling in what the linker flags left
+// unset from the embedded version control information
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "dev" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+		info.Version = build.Main.Version
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+				if len(info.Commit) > 12 {
+					info.Commit = info.Commit[:12]
+				}
+			}
+		case "vcs.time":
+			if info.Date == "" {
+				info.Date = setting.Value
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// Revision returns the commit, marked "-dirty" if the checkout had
+// uncommitted changes
+func (i Info) Revision() string {
+	if i.Commit != "" && i.Modified {
+		return i.Commit + "-dirty"
+	}
+	return i.Commit
+}
+
+// String formats the build information for --version
+func (i Info) String() string {
+	s := "coproxy " + i.Version
+	if i.Commit != "" {
+		s += fmt.Sprintf(" (commit %s", i.Revision())
+		if i.Date != "" {
+			s += ", built " + i.Date
+		}
+		s += ")"
+	} else if i.Date != "" {
+		s += " (built " + i.Date + ")"
+	}
+	return s + " " + i.GoVersion
+}
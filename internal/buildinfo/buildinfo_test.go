@@ -0,0 +1,29 @@
+package buildinfo
+
+import "testing"
+
+func TestGetLinkerFlags(t *testing.T) {
+	defer func(version, commit, date string) { Version, Commit, Date = version, commit, date }(Version, Commit, Date)
+	Version, Commit, Date = "v1.2.0", "abc1234", "2024-05-01T12:00:00Z"
+
+	info := Get()
+	if info.Version != "v1.2.0" || info.Commit != "abc1234" || info.Date != "2024-05-01T12:00:00Z" || info.GoVersion == "" {
+		t.Errorf("Get() = %+v", info)
+	}
+}
+
+func TestInfoString(t *testing.T) {
+	tests := []struct {
+		info Info
+		want string
+	}{
+		{Info{Version: "dev", GoVersion: "go1.22.0"}, "coproxy dev go1.22.0"},
+		{Info{Version: "v1.2.0", Commit: "abc1234", Date: "2024-05-01T12:00:00Z", GoVersion: "go1.22.0"}, "coproxy v1.2.0 (commit abc1234, built 2024-05-01T12:00:00Z) go1.22.0"},
+		{Info{Version: "dev", Commit: "abc1234", Modified: true, GoVersion: "go1.22.0"}, "coproxy dev (commit abc1234-dirty) go1.22.0"},
+	}
+	for _, tt := range tests {
+		if got := tt.info.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
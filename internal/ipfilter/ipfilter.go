@@ -0,0 +1,171 @@
+// Package ipfilter restricts which client addresses may use the proxy.
+//
+// Addresses are matched against CIDR ranges or single IP addresses. A client
+// on the deny list is always rejected; when an allow list is configured, only
+// clients on it are served. The client address is the peer address of the
+// connection, so behind a reverse proxy the proxy's address is checked.
+//
+// The filter is configured with:
+//   - IP_ALLOWLIST: comma-separated CIDR ranges or addresses allowed to connect
+//     (default: all)
+//   - IP_DENYLIST: comma-separated CIDR ranges or addresses that are rejected
+package ipfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Config lists the allowed and denied networks
+type Config struct {
+	Allow []string
+	Deny  []string
+}
+
+// ConfigFromEnv reads IP_ALLOWLIST and IP_DENYLIST
+func ConfigFromEnv() Config {
+	return Config{
+		Allow: splitList(os.Getenv("IP_ALLOWLIST")),
+		Deny:  splitList(os.Getenv("IP_DENYLIST")),
+	}
+}
+
+// Enabled reports whether any network is listed
+func (c Config) Enabled() bool {
+	return len(c.Allow) > 0 || len(c.Deny) > 0
+}
+
+// Filter decides whether a client address may use the proxy
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// New parses the networks of a configuration
+func New(c Config) (*Filter, error) {
+	allow, err := parseNetworks(c.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP_ALLOWLIST: %w", err)
+	}
+	deny, err := parseNetworks(c.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP_DENYLIST: %w", err)
+	}
+	return &Filter{allow: allow, deny: deny}, nil
+}
+
+// Allowed reports whether ip may use the proxy
+func (f *Filter) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range f.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, network := range f.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap rejects requests from addresses that are not allowed with an
+// OpenAI-style 403 error
+func (f *Filter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if !f.Allowed(net.ParseIP(host)) {
+			log.Printf("Rejected request from %s to %s by the IP filter", host, r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": map[string]interface{}{
+					"message": "access from this address is not allowed",
+					"type":    "permission_error",
+					"param":   nil,
+					"code":    "ip_not_allowed",
+				},
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Listener wraps a listener so that connections from addresses that are not
+// allowed are closed as soon as they are accepted, for servers like gRPC
+// that are not served through Wrap
+func (f *Filter) Listener(l net.Listener) net.Listener {
+	return &filteredListener{Listener: l, filter: f}
+}
+
+// filteredListener drops the connections its filter rejects
+type filteredListener struct {
+	net.Listener
+	filter *Filter
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || l.filter.Allowed(addr.IP) {
+			return conn, nil
+		}
+		log.Printf("Rejected connection from %s by the IP filter", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// parseNetworks parses CIDR ranges and single addresses, which become /32
+// or /128 networks
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var result []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
@@ -0,0 +1,61 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	filter, err := New(Config{
+		Allow: []string{"192.168.1.0/24", "100.64.0.0/10", "fd7a:115c:a1e0::/48"},
+		Deny:  []string{"192.168.1.13", "100.64.5.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.20", true},
+		{"192.168.1.13", false},
+		{"100.100.1.1", true},
+		{"100.64.5.9", false},
+		{"fd7a:115c:a1e0::1", true},
+		{"10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := filter.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	denyOnly, _ := New(Config{Deny: []string{"10.0.0.0/8"}})
+	if !denyOnly.Allowed(net.ParseIP("192.168.1.1")) || denyOnly.Allowed(net.ParseIP("10.1.2.3")) {
+		t.Error("a deny list alone should allow every other address")
+	}
+
+	if _, err := New(Config{Allow: []string{"not-an-ip"}}); err == nil {
+		t.Error("New() accepted an invalid entry")
+	}
+}
+
+func TestFilterWrap(t *testing.T) {
+	filter, _ := New(Config{Allow: []string{"127.0.0.1"}})
+	handler := filter.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for addr, want := range map[string]int{
+		"127.0.0.1:5000": http.StatusOK,
+		"10.0.0.1:5000":  http.StatusForbidden,
+		"garbage":        http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", "/v1/models", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("request from %s: status = %d, want %d", addr, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// accountKeyRefreshMargin is how long before expiry a pooled account's
+	// Copilot API key is re-exchanged
+	accountKeyRefreshMargin = 5 * time.Minute
+	// accountBackoff is how long an account is skipped after its first
+	// failure; it doubles with every further failure up to accountMaxBackoff
+	accountBackoff    = 30 * time.Second
+	accountMaxBackoff = 5 * time.Minute
+)
+
+// Account selection strategies of COPILOT_POOL_STRATEGY
+const (
+	PoolRoundRobin = "round-robin"
+	PoolLeastUsed  = "least-used"
+)
+
+// copilotAccount is a Copilot seat of the account pool. Its API key is
+// exchanged from the account's OAuth token on first use and before it expires.
+type copilotAccount struct {
+	name string
+	// exchange trades the account's OAuth token for a Copilot API key
+	exchange func() (string, error)
+
+	mu             sync.Mutex
+	apiKey         string
+	inFlight       int
+	requests       uint64
+	failures       int
+	unhealthyUntil time.Time
+	lastError      string
+}
+
+// CopilotAccountStatus is the health of a pooled Copilot account as shown
+// by GET /admin/accounts
+type CopilotAccountStatus struct {
+	Name           string     `json:"name"`
+	Healthy        bool       `json:"healthy"`
+	InFlight       int        `json:"in_flight"`
+	Requests       uint64     `json:"requests"`
+	Failures       int        `json:"consecutive_failures"`
+	UnhealthyUntil *time.Time `json:"unhealthy_until,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	KeyExpiresAt   *time.Time `json:"key_expires_at,omitempty"`
+}
+
+// key returns the account's API key, exchanging a new one if there is none
+// yet, it is about to expire or it is the rejected key
+func (a *copilotAccount) key(rejected string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.apiKey != "" && a.apiKey != rejected {
+		if exp, ok := apiKeyExpiry(a.apiKey); !ok || time.Until(exp) > accountKeyRefreshMargin {
+			return a.apiKey, nil
+		}
+	}
+	key, err := a.exchange()
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange the OAuth token of Copilot account %s: %w", a.name, err)
+	}
+	a.apiKey = key
+	return key, nil
+}
+
+// record updates the account's health after a request. A failed account is
+// skipped with exponential backoff; a success makes it healthy again.
+func (a *copilotAccount) record(failure error, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if failure == nil {
+		a.failures = 0
+		a.unhealthyUntil = time.Time{}
+		return
+	}
+	a.failures++
+	backoff := accountBackoff << (a.failures - 1)
+	if backoff > accountMaxBackoff || backoff <= 0 {
+		backoff = accountMaxBackoff
+	}
+	a.unhealthyUntil = now.Add(backoff)
+	a.lastError = failure.Error()
+	log.Printf("Warning: Copilot account %s failed (%v), skipping it for %s", a.name, failure, backoff)
+}
+
+// status returns the account's health
+func (a *copilotAccount) status(now time.Time) CopilotAccountStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := CopilotAccountStatus{
+		Name:      a.name,
+		Healthy:   !now.Before(a.unhealthyUntil),
+		InFlight:  a.inFlight,
+		Requests:  a.requests,
+		Failures:  a.failures,
+		LastError: a.lastError,
+	}
+	if !status.Healthy {
+		until := a.unhealthyUntil
+		status.UnhealthyUntil = &until
+	}
+	if exp, ok := apiKeyExpiry(a.apiKey); ok {
+		status.KeyExpiresAt = &exp
+	}
+	return status
+}
+
+// accountPool balances Copilot requests over several accounts
+type accountPool struct {
+	mu       sync.Mutex
+	accounts []*copilotAccount
+	next     int
+}
+
+// size returns the number of pooled accounts
+func (p *accountPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.accounts)
+}
+
+// pick selects the account for a request with the strategy: round-robin
+// cycles through the healthy accounts, least-used takes the healthy account
+// with the fewest requests in flight, then the fewest requests overall. If
+// no account is healthy, the one that recovers first is used. The returned
+// function ends the request.
+func (p *accountPool) pick(strategy string, exclude map[*copilotAccount]bool, now time.Time) (*copilotAccount, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var chosen, fallback *copilotAccount
+	for i := range p.accounts {
+		idx := (p.next + i) % len(p.accounts)
+		a := p.accounts[idx]
+		if exclude[a] {
+			continue
+		}
+		a.mu.Lock()
+		healthy := !now.Before(a.unhealthyUntil)
+		if !healthy && (fallback == nil || a.unhealthyUntil.Before(fallback.unhealthyUntil)) {
+			fallback = a
+		}
+		better := healthy && (chosen == nil || (strategy == PoolLeastUsed &&
+			(a.inFlight < chosen.inFlight || (a.inFlight == chosen.inFlight && a.requests < chosen.requests))))
+		a.mu.Unlock()
+		if better {
+			chosen = a
+			if strategy != PoolLeastUsed {
+				p.next = idx + 1
+				break
+			}
+		}
+	}
+	if chosen == nil {
+		chosen = fallback
+	}
+	if chosen == nil {
+		return nil, nil
+	}
+
+	chosen.mu.Lock()
+	chosen.inFlight++
+	chosen.requests++
+	chosen.mu.Unlock()
+	var once sync.Once
+	return chosen, func() {
+		once.Do(func() {
+			chosen.mu.Lock()
+			chosen.inFlight--
+			chosen.mu.Unlock()
+		})
+	}
+}
+
+// AddCopilotAccount adds a Copilot account to the pool that completion
+// requests are balanced over with COPILOT_POOL_STRATEGY. exchange trades
+// the account's OAuth token for a Copilot API key. Without pooled accounts
+// every request uses the configured Copilot API key.
+func (s *Service) AddCopilotAccount(name string, exchange func() (string, error)) {
+	s.accounts.mu.Lock()
+	defer s.accounts.mu.Unlock()
+	s.accounts.accounts = append(s.accounts.accounts, &copilotAccount{name: name, exchange: exchange})
+}
+
+// CopilotAccounts returns the health of the pooled Copilot accounts
+func (s *Service) CopilotAccounts() []CopilotAccountStatus {
+	s.accounts.mu.Lock()
+	accounts := append([]*copilotAccount(nil), s.accounts.accounts...)
+	s.accounts.mu.Unlock()
+	now := time.Now()
+	statuses := make([]CopilotAccountStatus, len(accounts))
+	for i, a := range accounts {
+		statuses[i] = a.status(now)
+	}
+	return statuses
+}
+
+// doPooledChatRequest sends a chat completion payload with the key of a
+// pooled account. An account that is rate limited, failing or whose key
+// cannot be exchanged is marked unhealthy and the request moves on to the
+// next account; a 401 re-exchanges the account's key once.
+func (s *Service) doPooledChatRequest(ctx context.Context, body []byte, hasImages bool) (*http.Response, error) {
+	tried := make(map[*copilotAccount]bool)
+	for {
+		account, release := s.accounts.pick(s.config.poolStrategy(), tried, time.Now())
+		if account == nil {
+			return nil, ErrCopilotAPIKeyMissing
+		}
+		tried[account] = true
+		last := len(tried) == s.accounts.size()
+
+		resp, err := s.doAccountChatRequest(ctx, account, body, hasImages)
+		if err != nil {
+			release()
+			if !providerFailed(nil, err) && !isExchangeError(err) {
+				return nil, err
+			}
+			account.record(err, time.Now())
+			if last || ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		if providerFailed(resp, nil) {
+			account.record(fmt.Errorf("Copilot API returned %d", resp.StatusCode), time.Now())
+			if !last {
+				resp.Body.Close()
+				release()
+				continue
+			}
+		} else if resp.StatusCode < 400 {
+			account.record(nil, time.Now())
+		}
+		// The account is busy until the response, including any stream, is read
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+		return resp, nil
+	}
+}
+
+// doAccountChatRequest sends a chat completion payload with an account's
+// key, re-exchanging the key once if the Copilot API rejects it
+func (s *Service) doAccountChatRequest(ctx context.Context, account *copilotAccount, body []byte, hasImages bool) (*http.Response, error) {
+	return s.doAccountRequest(account, func(apiKey string) (*http.Response, error) {
+		return s.doChatRequest(ctx, body, hasImages, apiKey)
+	})
+}
+
+// doAccountRequest sends a request with an account's key, re-exchanging the
+// key once if the Copilot API rejects it
+func (s *Service) doAccountRequest(account *copilotAccount, send func(apiKey string) (*http.Response, error)) (*http.Response, error) {
+	apiKey, err := account.key("")
+	if err != nil {
+		return nil, &exchangeError{err}
+	}
+	resp, err := send(apiKey)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	freshKey, err := account.key(apiKey)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return resp, nil
+	}
+	resp.Body.Close()
+	return send(freshKey)
+}
+
+// exchangeError is a failed OAuth token exchange of a pooled account
+type exchangeError struct {
+	err error
+}
+
+func (e *exchangeError) Error() string { return e.err.Error() }
+func (e *exchangeError) Unwrap() error { return e.err }
+
+// isExchangeError reports whether err is a failed OAuth token exchange
+func isExchangeError(err error) bool {
+	_, ok := err.(*exchangeError)
+	return ok
+}
+
+// releasingBody ends a pooled account's request once the body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
+// apiKeyExpiry reads the exp field of a Copilot API key of the form
+// "tid=...;exp=1700000000;..."
+func apiKeyExpiry(key string) (time.Time, bool) {
+	for _, part := range strings.Split(key, ";") {
+		if value := strings.TrimPrefix(part, "exp="); value != part {
+			exp, err := strconv.ParseInt(value, 10, 64)
+			return time.Unix(exp, 0), err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+// HandleCopilotAccounts serves GET /admin/accounts with the balancing
+// strategy and the health of the pooled Copilot accounts. Callers must
+// protect the handler with the admin token.
+func (s *ServerState) HandleCopilotAccounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"strategy": s.Service.config.poolStrategy(),
+		"accounts": s.Service.CopilotAccounts(),
+	})
+}
@@ -0,0 +1,117 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccountPool(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	// status is the response per account key; 200 unless set
+	status := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		mu.Lock()
+		keys = append(keys, key)
+		code := status[key]
+		mu.Unlock()
+		if code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	s := &Service{config: &Config{CopilotAPIURL: server.URL}, httpClient: server.Client()}
+	exchanges := map[string]int{}
+	for _, name := range []string{"alice", "bob"} {
+		name := name
+		s.AddCopilotAccount(name, func() (string, error) {
+			exchanges[name]++
+			return fmt.Sprintf("tid=%s;exp=%d;v=%d", name, time.Now().Add(time.Hour).Unix(), exchanges[name]), nil
+		})
+	}
+	call := func() {
+		t.Helper()
+		resp, err := s.callCopilotAPI(context.Background(), `{"messages":[]}`, "gpt-4o")
+		if err != nil {
+			t.Fatalf("callCopilotAPI() error = %v", err)
+		}
+		resp.Body.Close()
+	}
+	lastAccount := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.TrimPrefix(strings.Split(keys[len(keys)-1], ";")[0], "tid=")
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		var got []string
+		for i := 0; i < 4; i++ {
+			call()
+			got = append(got, lastAccount())
+		}
+		if strings.Join(got, ",") != "alice,bob,alice,bob" {
+			t.Errorf("accounts = %v, want them to alternate", got)
+		}
+		if exchanges["alice"] != 1 || exchanges["bob"] != 1 {
+			t.Errorf("exchanges = %v, want one per account", exchanges)
+		}
+	})
+
+	t.Run("unhealthy account is skipped", func(t *testing.T) {
+		mu.Lock()
+		status[s.accounts.accounts[0].apiKey] = http.StatusTooManyRequests
+		mu.Unlock()
+		for i := 0; i < 3; i++ {
+			call()
+			if got := lastAccount(); got != "bob" {
+				t.Errorf("request %d went to %s, want bob while alice is rate limited", i, got)
+			}
+		}
+		statuses := s.CopilotAccounts()
+		if statuses[0].Healthy || statuses[0].Failures != 1 || statuses[0].UnhealthyUntil == nil || !statuses[1].Healthy {
+			t.Errorf("CopilotAccounts() = %+v", statuses)
+		}
+		if statuses[0].KeyExpiresAt == nil {
+			t.Error("the key expiry is not reported")
+		}
+	})
+
+	t.Run("rejected key is re-exchanged", func(t *testing.T) {
+		bob := s.accounts.accounts[1]
+		mu.Lock()
+		status[bob.apiKey] = http.StatusUnauthorized
+		mu.Unlock()
+		call()
+		if exchanges["bob"] != 2 || lastAccount() != "bob" {
+			t.Errorf("exchanges = %v, last account %s, want bob's key re-exchanged", exchanges, lastAccount())
+		}
+	})
+
+	t.Run("least-used", func(t *testing.T) {
+		s.config.CopilotPoolStrategy = PoolLeastUsed
+		s.accounts.accounts[0].record(nil, time.Now())
+		// Keep a request of bob's in flight
+		bob, release := s.accounts.pick(PoolRoundRobin, map[*copilotAccount]bool{s.accounts.accounts[0]: true}, time.Now())
+		defer release()
+		if bob.name != "bob" {
+			t.Fatalf("picked %s, want bob", bob.name)
+		}
+		mu.Lock()
+		delete(status, s.accounts.accounts[0].apiKey)
+		mu.Unlock()
+		call()
+		if got := lastAccount(); got != "alice" {
+			t.Errorf("request went to %s, want alice who has no request in flight", got)
+		}
+	})
+}
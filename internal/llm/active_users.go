@@ -0,0 +1,123 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultActiveUserWindow is how long a key counts as active after its last
+// request when ACTIVE_USER_WINDOW is unset
+const defaultActiveUserWindow = 5 * time.Minute
+
+// activeUserDays is the period of UsersInRecentDays
+const activeUserDays = 7
+
+// activeUsers tracks when each API key last made a request, in memory only
+type activeUsers struct {
+	mu       sync.Mutex
+	lastSeen map[uint64]time.Time
+}
+
+// touch marks a user's key as active at now
+func (a *activeUsers) touch(userID uint64, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastSeen == nil {
+		a.lastSeen = make(map[uint64]time.Time)
+	}
+	a.lastSeen[userID] = now
+}
+
+// count returns the number of keys active within window before now and
+// forgets the others
+func (a *activeUsers) count(now time.Time, window time.Duration) int {
+	if window <= 0 {
+		window = defaultActiveUserWindow
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for userID, seen := range a.lastSeen {
+		if now.Sub(seen) > window {
+			delete(a.lastSeen, userID)
+		}
+	}
+	return len(a.lastSeen)
+}
+
+// dynamicShare divides the global per-minute quota evenly among the keys
+// active at now. A zero share is unlimited; otherwise each key gets at
+// least one unit.
+func (s *Service) dynamicShare(now time.Time) (requests, tokens, active int) {
+	active = s.activeUsers.count(now, s.config.ActiveUserWindow)
+	if active < 1 {
+		active = 1
+	}
+	share := func(global int) int {
+		if global <= 0 {
+			return 0
+		}
+		if global < active {
+			return 1
+		}
+		return global / active
+	}
+	return share(s.config.GlobalRequestsPerMinute), share(s.config.GlobalTokensPerMinute), active
+}
+
+// dynamicLimited reports whether a global quota is set
+func (c *Config) dynamicLimited() bool {
+	return c.GlobalRequestsPerMinute > 0 || c.GlobalTokensPerMinute > 0
+}
+
+// checkDynamicRateLimit marks a user's key as active and enforces its share
+// of the global quota with its usage in the current minute. As more keys
+// become active each share shrinks, and it grows again as they go idle, so
+// the deployment as a whole stays under the quota.
+func (s *Service) checkDynamicRateLimit(userID uint64) error {
+	now := time.Now()
+	s.activeUsers.touch(userID, now)
+	if !s.config.dynamicLimited() {
+		return nil
+	}
+	requests, tokens, active := s.dynamicShare(now)
+	usage, err := s.currentKeyUsage(usageKeyForUser(userID))
+	if err != nil {
+		return err
+	}
+	nextMinute := now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+	switch {
+	case requests > 0 && usage.RequestsThisMinute >= requests:
+		return &retryAfterError{
+			err:        fmt.Errorf("%w: share of %d requests per minute among %d active keys reached", ErrRateLimitExceeded, s.config.GlobalRequestsPerMinute, active),
+			retryAfter: nextMinute,
+		}
+	case tokens > 0 && usage.TokensThisMinute >= tokens:
+		return &retryAfterError{
+			err:        fmt.Errorf("%w: share of %d tokens per minute among %d active keys reached", ErrRateLimitExceeded, s.config.GlobalTokensPerMinute, active),
+			retryAfter: nextMinute,
+		}
+	}
+	return nil
+}
+
+// ActiveUsers counts the keys that made a request within ACTIVE_USER_WINDOW
+// and the keys with recorded usage in the past seven days
+func (s *Service) ActiveUsers() (models.ActiveUserCount, error) {
+	now := time.Now()
+	count := models.ActiveUserCount{UsersInRecentMinutes: s.activeUsers.count(now, s.config.ActiveUserWindow)}
+	if s.usage == nil {
+		return count, nil
+	}
+	aggregates, err := s.usage.Aggregate(now.AddDate(0, 0, -activeUserDays), "")
+	if err != nil {
+		return count, err
+	}
+	keys := make(map[string]bool)
+	for _, agg := range aggregates {
+		keys[agg.Key] = true
+	}
+	count.UsersInRecentDays = len(keys)
+	return count, nil
+}
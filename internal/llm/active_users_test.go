@@ -0,0 +1,52 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActiveUsersCount(t *testing.T) {
+	var a activeUsers
+	now := time.Now()
+	a.touch(1, now.Add(-10*time.Minute))
+	a.touch(2, now.Add(-time.Minute))
+	a.touch(3, now)
+	if got := a.count(now, 5*time.Minute); got != 2 {
+		t.Errorf("count = %d, want 2", got)
+	}
+	if _, ok := a.lastSeen[1]; ok {
+		t.Error("idle key was not forgotten")
+	}
+}
+
+func TestCheckDynamicRateLimit(t *testing.T) {
+	s := &Service{config: &Config{GlobalRequestsPerMinute: 4, ActiveUserWindow: time.Minute}, usage: newUsageLedger()}
+
+	// Alone, a key may use the whole quota
+	for i := 0; i < 3; i++ {
+		if err := s.checkDynamicRateLimit(1); err != nil {
+			t.Fatalf("request %d error = %v", i, err)
+		}
+		s.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 1})
+	}
+	if err := s.checkDynamicRateLimit(1); err != nil {
+		t.Errorf("fourth request error = %v", err)
+	}
+
+	// Once another key is active, each gets half
+	if err := s.checkDynamicRateLimit(2); err != nil {
+		t.Errorf("second key error = %v", err)
+	}
+	err := s.checkDynamicRateLimit(1)
+	if wait, ok := retryAfter(err); !errors.Is(err, ErrRateLimitExceeded) || !strings.Contains(err.Error(), "2 active keys") || !ok || wait <= 0 {
+		t.Errorf("over share error = %v, retry after %v", err, wait)
+	}
+
+	count, err := s.ActiveUsers()
+	if err != nil || count.UsersInRecentMinutes != 2 || count.UsersInRecentDays != 1 {
+		t.Errorf("ActiveUsers() = %+v, %v", count, err)
+	}
+}
@@ -0,0 +1,467 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"copilot-proxy/internal/tracing"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAnthropicAPIURL is the Anthropic API base URL used unless
+	// ANTHROPIC_API_URL is set
+	defaultAnthropicAPIURL = "https://api.anthropic.com/v1"
+	// anthropicVersion is the Anthropic API version requests are made against
+	anthropicVersion = "2023-06-01"
+	// defaultAnthropicMaxTokens is sent when a request sets no token limit,
+	// which the Messages API requires
+	defaultAnthropicMaxTokens = 4096
+)
+
+// anthropicFinishReasons maps Messages API stop reasons to OpenAI finish reasons
+var anthropicFinishReasons = map[string]string{
+	"end_turn":      "stop",
+	"stop_sequence": "stop",
+	"max_tokens":    "length",
+	"tool_use":      "tool_calls",
+	"refusal":       "content_filter",
+}
+
+// anthropicProvider serves Claude models from the Anthropic Messages API. It
+// is registered when ANTHROPIC_API_KEY is set; requests and streams are
+// translated from and to the OpenAI chat completion format.
+type anthropicProvider struct {
+	s *Service
+}
+
+// ListModels fetches the Claude models of the Anthropic API
+func (p *anthropicProvider) ListModels(ctx context.Context) ([]models.LanguageModel, error) {
+	ctx, span := tracing.Start(ctx, "anthropic.fetch_models", tracing.SpanKindClient)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", p.url("/models?limit=1000"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create models request: %w", err)
+	}
+	p.setHeaders(req)
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := p.s.httpClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to fetch Anthropic models: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Anthropic models API returned %s: %s", resp.Status, string(body))
+	}
+
+	var wrapper struct {
+		Data []struct {
+			ID          string `json:"id"`
+			DisplayName string `json:"display_name"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&wrapper); err != nil {
+		return nil, fmt.Errorf("failed to decode Anthropic models response: %w", err)
+	}
+	var list []models.LanguageModel
+	for _, m := range wrapper.Data {
+		if !strings.HasPrefix(m.ID, "claude-") {
+			continue
+		}
+		name := m.DisplayName
+		if name == "" {
+			name = m.ID
+		}
+		list = append(list, models.LanguageModel{ID: m.ID, Name: name, Provider: models.ProviderAnthropic, Enabled: true})
+	}
+	span.SetAttributes(tracing.Int("llm.model_count", len(list)))
+	return list, nil
+}
+
+// Stream translates a chat completion request into a streaming Messages API
+// request and returns a response whose body is the translated OpenAI SSE
+// stream. Error responses are returned as they are: their body has the
+// {"error": {"type", "message"}} form of the OpenAI API.
+func (p *anthropicProvider) Stream(ctx context.Context, model, request string) (*http.Response, error) {
+	payload, err := anthropicRequest(model, request)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	ctx, span := tracing.Start(ctx, "anthropic.messages", tracing.SpanKindClient)
+	defer span.End()
+	url := p.url("/messages")
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	p.setHeaders(req)
+	tracing.Inject(ctx, req.Header)
+	span.SetAttributes(tracing.String("http.url", url))
+
+	req = req.WithContext(context.WithValue(req.Context(), upstreamStartKey{}, time.Now()))
+	resp, err := p.s.httpClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, wrapTransportError(err)
+	}
+	span.SetAttributes(tracing.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+
+	reader, writer := io.Pipe()
+	go translateAnthropicStream(resp.Body, writer, model)
+	header := resp.Header.Clone()
+	header.Set("Content-Type", "text/event-stream")
+	header.Del("Content-Length")
+	return &http.Response{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Header:     header,
+		Body:       reader,
+		Request:    resp.Request,
+	}, nil
+}
+
+// Complete streams a completion from the Anthropic API and aggregates it
+func (p *anthropicProvider) Complete(ctx context.Context, model, request string) (*ChatResult, error) {
+	resp, err := p.Stream(ctx, model, request)
+	if err != nil {
+		return nil, err
+	}
+	return collectResponse(resp)
+}
+
+// setHeaders sets the authentication and version headers
+func (p *anthropicProvider) setHeaders(req *http.Request) {
+	req.Header.Set("x-api-key", p.s.config.AnthropicAPIKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+}
+
+// url builds a full URL to the Anthropic API for the given path
+func (p *anthropicProvider) url(path string) string {
+	base := strings.TrimRight(p.s.config.AnthropicAPIURL, "/")
+	if base == "" {
+		base = defaultAnthropicAPIURL
+	}
+	return base + path
+}
+
+// anthropicRequest translates an OpenAI chat completion request into a
+// streaming Messages API request. System messages become the system prompt,
+// tool calls and results become tool_use and tool_result blocks, and
+// consecutive messages of the same role are merged as the API requires.
+func anthropicRequest(model, request string) (map[string]interface{}, error) {
+	var openai map[string]interface{}
+	if err := json.Unmarshal([]byte(request), &openai); err != nil {
+		return nil, err
+	}
+
+	var system []string
+	var messages []interface{}
+	list, _ := openai["messages"].([]interface{})
+	for i, m := range list {
+		msg, ok := m.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("messages[%d] must be an object", i)
+		}
+		role, _ := msg["role"].(string)
+		switch role {
+		case "system", "developer":
+			blocks, err := anthropicContent(msg["content"])
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			for _, b := range blocks {
+				if text, ok := b.(map[string]interface{})["text"].(string); ok {
+					system = append(system, text)
+				}
+			}
+		case "user":
+			blocks, err := anthropicContent(msg["content"])
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			messages = appendAnthropicMessage(messages, "user", blocks)
+		case "assistant":
+			blocks, err := anthropicContent(msg["content"])
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			calls, _ := msg["tool_calls"].([]interface{})
+			for _, c := range calls {
+				call, _ := c.(map[string]interface{})
+				function, _ := call["function"].(map[string]interface{})
+				input := map[string]interface{}{}
+				if args, _ := function["arguments"].(string); args != "" {
+					if err := json.Unmarshal([]byte(args), &input); err != nil {
+						return nil, fmt.Errorf("messages[%d]: tool call arguments are not a JSON object", i)
+					}
+				}
+				blocks = append(blocks, map[string]interface{}{
+					"type":  "tool_use",
+					"id":    call["id"],
+					"name":  function["name"],
+					"input": input,
+				})
+			}
+			messages = appendAnthropicMessage(messages, "assistant", blocks)
+		case "tool":
+			result := map[string]interface{}{"type": "tool_result", "tool_use_id": msg["tool_call_id"]}
+			blocks, err := anthropicContent(msg["content"])
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			if len(blocks) > 0 {
+				result["content"] = blocks
+			}
+			messages = appendAnthropicMessage(messages, "user", []interface{}{result})
+		default:
+			return nil, fmt.Errorf("messages[%d]: unsupported role %q", i, role)
+		}
+	}
+
+	payload := map[string]interface{}{
+		"model":      model,
+		"messages":   messages,
+		"max_tokens": defaultAnthropicMaxTokens,
+		"stream":     true,
+	}
+	if len(system) > 0 {
+		payload["system"] = strings.Join(system, "\n\n")
+	}
+	for _, key := range []string{"max_completion_tokens", "max_tokens"} {
+		if v, ok := openai[key].(float64); ok && v > 0 {
+			payload["max_tokens"] = int(v)
+			break
+		}
+	}
+	for _, key := range []string{"temperature", "top_p"} {
+		if v, ok := openai[key]; ok && v != nil {
+			payload[key] = v
+		}
+	}
+	switch stop := openai["stop"].(type) {
+	case string:
+		payload["stop_sequences"] = []string{stop}
+	case []interface{}:
+		payload["stop_sequences"] = stop
+	}
+	if tools, ok := openai["tools"].([]interface{}); ok && len(tools) > 0 {
+		converted := make([]interface{}, 0, len(tools))
+		for _, t := range tools {
+			tool, _ := t.(map[string]interface{})
+			function, _ := tool["function"].(map[string]interface{})
+			schema, ok := function["parameters"]
+			if !ok || schema == nil {
+				schema = map[string]interface{}{"type": "object"}
+			}
+			converted = append(converted, map[string]interface{}{
+				"name":         function["name"],
+				"description":  function["description"],
+				"input_schema": schema,
+			})
+		}
+		payload["tools"] = converted
+	}
+	switch choice := openai["tool_choice"].(type) {
+	case string:
+		switch choice {
+		case "auto", "none":
+			payload["tool_choice"] = map[string]interface{}{"type": choice}
+		case "required":
+			payload["tool_choice"] = map[string]interface{}{"type": "any"}
+		}
+	case map[string]interface{}:
+		if function, ok := choice["function"].(map[string]interface{}); ok {
+			payload["tool_choice"] = map[string]interface{}{"type": "tool", "name": function["name"]}
+		}
+	}
+	return payload, nil
+}
+
+// anthropicContent converts OpenAI message content, a string or content
+// parts, into Messages API content blocks. Empty text is dropped since the
+// API rejects empty text blocks.
+func anthropicContent(content interface{}) ([]interface{}, error) {
+	switch c := content.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if c == "" {
+			return nil, nil
+		}
+		return []interface{}{map[string]interface{}{"type": "text", "text": c}}, nil
+	case []interface{}:
+		var blocks []interface{}
+		for _, p := range c {
+			part, ok := p.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("content parts must be objects")
+			}
+			switch part["type"] {
+			case "text":
+				if text, _ := part["text"].(string); text != "" {
+					blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+				}
+			case "image_url":
+				image, err := transcodeImagePart(part)
+				if err != nil {
+					return nil, err
+				}
+				url := image["image_url"].(map[string]interface{})["url"].(string)
+				blocks = append(blocks, map[string]interface{}{"type": "image", "source": anthropicImageSource(url)})
+			default:
+				return nil, fmt.Errorf("unsupported content part type %v", part["type"])
+			}
+		}
+		return blocks, nil
+	}
+	return nil, fmt.Errorf("content must be a string or content parts")
+}
+
+// anthropicImageSource converts an image URL into an image source, inlining
+// data URLs as base64 data
+func anthropicImageSource(url string) map[string]interface{} {
+	if rest := strings.TrimPrefix(url, "data:"); rest != url {
+		if meta, data, ok := strings.Cut(rest, ","); ok && strings.HasSuffix(meta, ";base64") {
+			return map[string]interface{}{
+				"type":       "base64",
+				"media_type": strings.TrimSuffix(meta, ";base64"),
+				"data":       data,
+			}
+		}
+	}
+	return map[string]interface{}{"type": "url", "url": url}
+}
+
+// appendAnthropicMessage appends content blocks as a message, merging them
+// into the previous message if it has the same role
+func appendAnthropicMessage(messages []interface{}, role string, blocks []interface{}) []interface{} {
+	if len(blocks) == 0 {
+		return messages
+	}
+	if n := len(messages); n > 0 {
+		if last := messages[n-1].(map[string]interface{}); last["role"] == role {
+			last["content"] = append(last["content"].([]interface{}), blocks...)
+			return messages
+		}
+	}
+	return append(messages, map[string]interface{}{"role": role, "content": blocks})
+}
+
+// translateAnthropicStream reads a Messages API event stream and writes it
+// as an OpenAI chat completion SSE stream, ending with a usage chunk and the
+// [DONE] marker
+func translateAnthropicStream(body io.ReadCloser, w *io.PipeWriter, model string) {
+	defer body.Close()
+	id := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+	// toolCalls maps content block indexes to tool call indexes
+	toolCalls := make(map[float64]int)
+	var inputTokens, outputTokens float64
+	var writeErr error
+
+	write := func(chunk map[string]interface{}) {
+		if writeErr != nil {
+			return
+		}
+		data, _ := json.Marshal(chunk)
+		if _, writeErr = fmt.Fprintf(w, "data: %s\n\n", data); writeErr != nil {
+			// The reader is gone; stop reading the upstream stream
+			body.Close()
+		}
+	}
+	emit := func(delta map[string]interface{}, finishReason interface{}) {
+		write(map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   model,
+			"choices": []interface{}{map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finishReason}},
+		})
+	}
+
+	err := forEachSSEChunk(body, func(event map[string]interface{}) {
+		index, _ := event["index"].(float64)
+		switch event["type"] {
+		case "message_start":
+			message, _ := event["message"].(map[string]interface{})
+			usage, _ := message["usage"].(map[string]interface{})
+			inputTokens, _ = usage["input_tokens"].(float64)
+			emit(map[string]interface{}{"role": "assistant", "content": ""}, nil)
+		case "content_block_start":
+			block, _ := event["content_block"].(map[string]interface{})
+			if block["type"] == "tool_use" {
+				toolCalls[index] = len(toolCalls)
+				emit(map[string]interface{}{"tool_calls": []interface{}{map[string]interface{}{
+					"index":    toolCalls[index],
+					"id":       block["id"],
+					"type":     "function",
+					"function": map[string]interface{}{"name": block["name"], "arguments": ""},
+				}}}, nil)
+			}
+		case "content_block_delta":
+			delta, _ := event["delta"].(map[string]interface{})
+			switch delta["type"] {
+			case "text_delta":
+				emit(map[string]interface{}{"content": delta["text"]}, nil)
+			case "input_json_delta":
+				emit(map[string]interface{}{"tool_calls": []interface{}{map[string]interface{}{
+					"index":    toolCalls[index],
+					"function": map[string]interface{}{"arguments": delta["partial_json"]},
+				}}}, nil)
+			}
+		case "message_delta":
+			if usage, ok := event["usage"].(map[string]interface{}); ok {
+				outputTokens, _ = usage["output_tokens"].(float64)
+			}
+			delta, _ := event["delta"].(map[string]interface{})
+			if reason, _ := delta["stop_reason"].(string); reason != "" {
+				finishReason, ok := anthropicFinishReasons[reason]
+				if !ok {
+					finishReason = "stop"
+				}
+				emit(map[string]interface{}{}, finishReason)
+			}
+		case "error":
+			write(map[string]interface{}{"error": event["error"]})
+		}
+	})
+	if err == nil && writeErr == nil {
+		write(map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   model,
+			"choices": []interface{}{},
+			"usage": map[string]interface{}{
+				"prompt_tokens":     int(inputTokens),
+				"completion_tokens": int(outputTokens),
+				"total_tokens":      int(inputTokens + outputTokens),
+			},
+		})
+		if writeErr == nil {
+			_, writeErr = io.WriteString(w, "data: [DONE]\n\n")
+		}
+	}
+	if writeErr != nil {
+		err = writeErr
+	}
+	w.CloseWithError(err)
+}
@@ -0,0 +1,116 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAnthropicRequest(t *testing.T) {
+	payload, err := anthropicRequest("claude-sonnet-4-0", `{
+		"messages": [
+			{"role": "system", "content": "be brief"},
+			{"role": "user", "content": [{"type": "text", "text": "weather?"}, {"type": "image_url", "image_url": {"url": "data:image/png;base64,AAAA"}}]},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{\"city\":\"Berlin\"}"}}]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "sunny"},
+			{"role": "user", "content": "thanks"}
+		],
+		"stop": "END",
+		"tools": [{"type": "function", "function": {"name": "weather", "parameters": {"type": "object"}}}],
+		"tool_choice": "required"
+	}`)
+	if err != nil {
+		t.Fatalf("anthropicRequest() error = %v", err)
+	}
+	got, _ := json.Marshal(payload)
+	var decoded map[string]interface{}
+	json.Unmarshal(got, &decoded)
+
+	want := map[string]interface{}{
+		"model":          "claude-sonnet-4-0",
+		"max_tokens":     4096.0,
+		"stream":         true,
+		"system":         "be brief",
+		"stop_sequences": []interface{}{"END"},
+		"tool_choice":    map[string]interface{}{"type": "any"},
+		"tools":          []interface{}{map[string]interface{}{"name": "weather", "description": nil, "input_schema": map[string]interface{}{"type": "object"}}},
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "text", "text": "weather?"},
+				map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "base64", "media_type": "image/png", "data": "AAAA"}},
+			}},
+			map[string]interface{}{"role": "assistant", "content": []interface{}{
+				map[string]interface{}{"type": "tool_use", "id": "call_1", "name": "weather", "input": map[string]interface{}{"city": "Berlin"}},
+			}},
+			map[string]interface{}{"role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "tool_result", "tool_use_id": "call_1", "content": []interface{}{map[string]interface{}{"type": "text", "text": "sunny"}}},
+				map[string]interface{}{"type": "text", "text": "thanks"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("anthropicRequest() = %s", got)
+	}
+}
+
+func TestAnthropicProvider(t *testing.T) {
+	var upstream map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") != "sk-ant-test" || r.Header.Get("anthropic-version") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/v1/models" {
+			fmt.Fprint(w, `{"data":[{"id":"claude-sonnet-4-0","display_name":"Claude Sonnet 4"}]}`)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&upstream)
+		for _, event := range []string{
+			`{"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me check"}}`,
+			`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"weather","input":{}}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Berlin\"}"}}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":7}}`,
+			`{"type":"message_stop"}`,
+		} {
+			var e struct{ Type string }
+			json.Unmarshal([]byte(event), &e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, event)
+		}
+	}))
+	defer server.Close()
+
+	s := &Service{
+		config:     &Config{AnthropicAPIKey: "sk-ant-test", AnthropicAPIURL: server.URL + "/v1"},
+		httpClient: server.Client(),
+		usage:      newUsageLedger(),
+	}
+	s.RegisterProvider(models.ProviderCopilot, &fakeProvider{})
+	s.RegisterProvider(models.ProviderAnthropic, &anthropicProvider{s: s})
+
+	token := &models.LLMToken{UserID: 1, HasLLMSubscription: true}
+	list, err := s.Models(token, nil)
+	if err != nil || len(list) != 1 || list[0].Name != "Claude Sonnet 4" || list[0].Provider != models.ProviderAnthropic {
+		t.Fatalf("Models() = %+v, %v", list, err)
+	}
+
+	result, err := s.Chat(CompletionRequest{Model: "claude-sonnet-4-0", ProviderRequest: `{"messages":[{"role":"user","content":"weather in Berlin?"}],"max_tokens":100}`, Token: token})
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	if upstream["model"] != "claude-sonnet-4-0" || upstream["max_tokens"] != 100.0 {
+		t.Errorf("upstream request = %v", upstream)
+	}
+	if result.Content != "Let me check" || result.FinishReason != "tool_calls" || result.PromptTokens != 10 || result.CompletionTokens != 7 {
+		t.Errorf("Chat() = %+v", result)
+	}
+	if len(result.ToolCalls) != 1 || result.ToolCalls[0].ID != "toolu_1" || result.ToolCalls[0].Function.Arguments != `{"city":"Berlin"}` {
+		t.Errorf("tool calls = %+v", result.ToolCalls)
+	}
+}
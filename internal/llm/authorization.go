@@ -1,19 +1,25 @@
 package llm
 
 import (
+	appauth "copilot-proxy/internal/auth"
 	"copilot-proxy/pkg/models"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 )
 
 // Authorization errors
 var (
-	ErrNoCountryCode     = errors.New("no country code provided")
-	ErrTorNetwork        = errors.New("access via TOR network is not allowed")
-	ErrRestrictedRegion  = errors.New("access from this region is restricted")
-	ErrModelNotAvailable = errors.New("this model is not available in your plan")
-	ErrRateLimitExceeded = errors.New("rate limit exceeded")
+	ErrNoCountryCode         = errors.New("no country code provided")
+	ErrTorNetwork            = errors.New("access via TOR network is not allowed")
+	ErrRestrictedRegion      = errors.New("access from this region is restricted")
+	ErrModelNotAvailable     = errors.New("this model is not available in your plan")
+	ErrRateLimitExceeded     = errors.New("rate limit exceeded")
+	ErrSpendingLimitExceeded = errors.New("monthly spending limit reached")
+	ErrQuotaExceeded         = errors.New("monthly budget exhausted")
+	ErrSubscriptionInactive  = errors.New("no active subscription")
 )
 
 // Restricted countries based on export regulations
@@ -46,7 +52,19 @@ var (
 
 // AuthorizeAccessToModel checks if a user can access a specific model
 func AuthorizeAccessToModel(token *models.LLMToken, provider models.LanguageModelProvider, modelName string) error {
-	// For personal use, everyone has access to all models
+	// For personal use, everyone has access to all models unless the token
+	// is scoped to a subset of them
+	if !appauth.MatchScope(token.AllowedModels, modelName) || !appauth.MatchScope(token.TenantModels, modelName) {
+		return fmt.Errorf("%w: model %s is not allowed", appauth.ErrScopeDenied, modelName)
+	}
+	return nil
+}
+
+// AuthorizeStreaming checks if a user may request streaming responses
+func AuthorizeStreaming(token *models.LLMToken, stream bool) error {
+	if stream && token.NoStreaming {
+		return fmt.Errorf("%w: streaming is not allowed", appauth.ErrScopeDenied)
+	}
 	return nil
 }
 
@@ -115,15 +133,48 @@ func CheckRateLimit(modelName string, usage models.ModelUsage) error {
 	return nil
 }
 
+// CheckSpendingLimit verifies the user's spending this month is below their
+// monthly limit. A custom allowance takes precedence over the token's maximum
+// and a limit of zero means unlimited.
+func CheckSpendingLimit(token *models.LLMToken, currentSpending uint32) error {
+	limit := token.MaxMonthlySpendInCents
+	if token.CustomMonthlyAllowanceInCents != nil {
+		limit = *token.CustomMonthlyAllowanceInCents
+	}
+	if limit > 0 && currentSpending >= limit {
+		return fmt.Errorf("%w: spent %d of %d cents", ErrSpendingLimitExceeded, currentSpending, limit)
+	}
+	return nil
+}
+
+// CheckBudget verifies a key's usage this month is within its budget
+func CheckBudget(budget Budget, tokensThisMonth int, costThisMonthUSD float64) error {
+	if budget.MonthlyTokens > 0 && tokensThisMonth >= budget.MonthlyTokens {
+		return fmt.Errorf("%w: used %d of %d tokens this month", ErrQuotaExceeded, tokensThisMonth, budget.MonthlyTokens)
+	}
+	if budget.MonthlyCostUSD > 0 && costThisMonthUSD >= budget.MonthlyCostUSD {
+		return fmt.Errorf("%w: used $%.2f of $%.2f this month", ErrQuotaExceeded, costThisMonthUSD, budget.MonthlyCostUSD)
+	}
+	return nil
+}
+
 // SetErrorResponseHeaders sets the appropriate headers for error responses
 func SetErrorResponseHeaders(w http.ResponseWriter, err error) {
-	if errors.Is(err, ErrRateLimitExceeded) {
+	if wait, ok := retryAfter(err); ok {
+		seconds := int(math.Ceil(wait.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	} else if errors.Is(err, ErrConcurrencyLimitExceeded) {
+		w.Header().Set("Retry-After", "1")
+	} else if errors.Is(err, ErrRateLimitExceeded) {
 		w.Header().Set("Retry-After", "60")
 	}
 }
 
 // ValidateAccess performs simplified authorization checks for personal use
 func ValidateAccess(token *models.LLMToken, modelName string, usage models.ModelUsage) error {
-	// Personal use: no rate limits enforced, always allow
-	return nil
+	// Personal use: no rate limits enforced, only the token's model scope
+	return AuthorizeAccessToModel(token, "", modelName)
 }
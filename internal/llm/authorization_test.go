@@ -215,3 +215,50 @@ func TestValidateAccess(t *testing.T) {
 func strPtr(s string) *string {
 	return &s
 }
+
+func TestCheckSpendingLimit(t *testing.T) {
+	allowance := uint32(500)
+	tests := []struct {
+		name     string
+		token    *models.LLMToken
+		spending uint32
+		wantErr  error
+	}{
+		{"below limit", &models.LLMToken{MaxMonthlySpendInCents: 1000}, 999, nil},
+		{"limit reached", &models.LLMToken{MaxMonthlySpendInCents: 1000}, 1000, ErrSpendingLimitExceeded},
+		{"unlimited", &models.LLMToken{}, 1 << 30, nil},
+		{"custom allowance", &models.LLMToken{MaxMonthlySpendInCents: 1000, CustomMonthlyAllowanceInCents: &allowance}, 600, ErrSpendingLimitExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckSpendingLimit(tt.token, tt.spending)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("CheckSpendingLimit() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		budget  Budget
+		tokens  int
+		cost    float64
+		wantErr error
+	}{
+		{"unlimited", Budget{}, 1 << 30, 1e6, nil},
+		{"within token budget", Budget{MonthlyTokens: 1000}, 999, 0, nil},
+		{"token budget exhausted", Budget{MonthlyTokens: 1000}, 1000, 0, ErrQuotaExceeded},
+		{"within cost budget", Budget{MonthlyCostUSD: 5}, 0, 4.99, nil},
+		{"cost budget exhausted", Budget{MonthlyTokens: 1000, MonthlyCostUSD: 5}, 10, 5, ErrQuotaExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckBudget(tt.budget, tt.tokens, tt.cost)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("CheckBudget() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// azureDeploymentsPrefix is the path prefix of Azure OpenAI style routes
+const azureDeploymentsPrefix = "/openai/deployments/"
+
+// DeploymentModel maps an Azure deployment name to a Copilot model ID.
+// Deployments without an explicit mapping use their name as the model ID.
+func (c *Config) DeploymentModel(deployment string) string {
+	if model, ok := c.AzureDeployments[deployment]; ok {
+		return model
+	}
+	return deployment
+}
+
+// HandleAzureDeployment serves Azure OpenAI style routes such as
+// /openai/deployments/{deployment}/chat/completions?api-version=...
+// by rewriting them into the equivalent OpenAI-compatible request.
+func (s *ServerState) HandleAzureDeployment(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, azureDeploymentsPrefix), "/", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		writeOpenAIError(w, http.StatusNotFound, "unknown deployment route: "+r.URL.Path, "invalid_request_error")
+		return
+	}
+	deployment, operation := parts[0], strings.Trim(parts[1], "/")
+
+	var handler http.HandlerFunc
+	switch operation {
+	case "chat/completions":
+		handler = s.HandleCompletion
+	case "completions":
+		handler = s.HandleTextCompletion
+	default:
+		writeOpenAIError(w, http.StatusNotFound, "unsupported deployment operation: "+operation, "invalid_request_error")
+		return
+	}
+
+	// Azure clients authenticate with the api-key header instead of a bearer token
+	if apiKey := r.Header.Get("api-key"); apiKey != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	bodyBytes, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	// The deployment selects the model; Azure payloads usually omit it
+	var payload map[string]interface{}
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), "invalid_request_error")
+		return
+	}
+	payload["model"] = s.Service.config.DeploymentModel(deployment)
+	bodyBytes, err := json.Marshal(payload)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "error formatting request: "+err.Error(), "internal_error")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	r.ContentLength = int64(len(bodyBytes))
+
+	handler(w, r)
+}
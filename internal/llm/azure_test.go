@@ -0,0 +1,61 @@
+package llm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDeploymentModel(t *testing.T) {
+	c := &Config{AzureDeployments: parseKeyValueList("prod-gpt4=gpt-4o, broken, =x")}
+	if got := c.DeploymentModel("prod-gpt4"); got != "gpt-4o" {
+		t.Errorf("DeploymentModel(prod-gpt4) = %q, want gpt-4o", got)
+	}
+	if got := c.DeploymentModel("gpt-4o-mini"); got != "gpt-4o-mini" {
+		t.Errorf("unmapped deployment should be used as model, got %q", got)
+	}
+	if len(c.AzureDeployments) != 1 {
+		t.Errorf("expected malformed entries to be skipped, got %v", c.AzureDeployments)
+	}
+}
+
+func TestHandleAzureDeployment(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	var upstreamModel string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		upstreamModel, _ = body["model"].(string)
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n"))
+	}))
+	defer upstream.Close()
+
+	state := newTestServerState(upstream)
+	state.Service.config.AzureDeployments = map[string]string{"my-deployment": "test-model"}
+	mux := http.NewServeMux()
+	state.RegisterHandlers(mux)
+
+	req := httptest.NewRequest("POST", "/openai/deployments/my-deployment/chat/completions?api-version=2024-02-01",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("api-key", "azure-key")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if upstreamModel != "test-model" {
+		t.Errorf("expected deployment to map to test-model, got %q", upstreamModel)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/openai/deployments/my-deployment/images/generations", strings.NewReader(`{}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unsupported operation, got %d", w.Code)
+	}
+}
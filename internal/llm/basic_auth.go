@@ -0,0 +1,61 @@
+package llm
+
+import (
+	appauth "copilot-proxy/internal/auth"
+	"copilot-proxy/pkg/models"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+)
+
+// basicAuthRealm is announced in the WWW-Authenticate header of 401
+// responses while Basic credentials are configured
+const basicAuthRealm = `Basic realm="copilot-proxy", charset="UTF-8"`
+
+// basicAuthUsers parses BASIC_AUTH_USERS, comma-separated "user:password"
+// entries whose password is given in plain text or, to keep it out of the
+// configuration, as hashed by appauth.HashAccessToken ("$sha256$..."). Like
+// VALID_API_KEYS it is read on every request.
+func basicAuthUsers() map[string]string {
+	users := map[string]string{}
+	for _, entry := range parseList(os.Getenv("BASIC_AUTH_USERS")) {
+		if user, password, ok := strings.Cut(entry, ":"); ok && user != "" && password != "" {
+			users[user] = password
+		}
+	}
+	return users
+}
+
+// basicPasswordMatches compares a password with a configured one in
+// constant time
+func basicPasswordMatches(given, configured string) bool {
+	if strings.HasPrefix(configured, "$sha256$") {
+		given = appauth.HashAccessToken(given)
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(configured)) == 1
+}
+
+// authenticateBasic validates the credentials of an "Authorization: Basic"
+// header. A user of BASIC_AUTH_USERS is authenticated as itself and rate
+// limited and recorded under its name. Otherwise the password may be an LLM
+// token or stored API key, with any user name, for tools that only let
+// users configure a user name and password.
+func (s *ServerState) authenticateBasic(credentials, endpoint string) (*models.LLMToken, error) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return nil, errors.New("invalid basic authorization header")
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || password == "" {
+		return nil, errors.New("invalid basic authorization header")
+	}
+	if configured, ok := basicAuthUsers()[user]; ok {
+		if !basicPasswordMatches(password, configured) {
+			return nil, ErrInvalidToken
+		}
+		return identityToken(identityBasicAuth, user), nil
+	}
+	return s.Authenticate("Bearer "+password, endpoint)
+}
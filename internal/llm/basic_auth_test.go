@@ -0,0 +1,59 @@
+package llm
+
+import (
+	appauth "copilot-proxy/internal/auth"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticateBasic(t *testing.T) {
+	t.Setenv("DISABLE_AUTH", "")
+	t.Setenv("BASIC_AUTH_USERS", "alice:wonderland, bob:"+appauth.HashAccessToken("s3cret:with-colon"))
+	s := &ServerState{Secret: "secret"}
+	basic := func(user, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+
+	for _, tt := range []struct{ user, password string }{
+		{"alice", "wonderland"},
+		{"bob", "s3cret:with-colon"},
+	} {
+		token, err := s.Authenticate(basic(tt.user, tt.password), "/v1/chat/completions")
+		if err != nil || token.GithubUserLogin != tt.user || token.UserID != identityUserID(identityBasicAuth, tt.user) || token.IsStaff {
+			t.Errorf("Authenticate(%s) = %+v, %v", tt.user, token, err)
+		}
+	}
+
+	// Any other user name may send an LLM token as the password
+	signed, _ := CreateLLMToken(7, "carol", s.Secret)
+	if token, err := s.Authenticate(basic("carol", signed), "/v1/chat/completions"); err != nil || token.UserID != 7 {
+		t.Errorf("Authenticate(token as password) = %+v, %v", token, err)
+	}
+
+	for name, authorization := range map[string]string{
+		"wrong password":          basic("alice", "looking-glass"),
+		"hashed password sent":    basic("bob", appauth.HashAccessToken("s3cret:with-colon")),
+		"configured user's token": basic("alice", signed),
+		"no password":             basic("alice", ""),
+		"not base64":              "Basic !!!",
+	} {
+		if _, err := s.Authenticate(authorization, "/v1/chat/completions"); err == nil {
+			t.Errorf("%s: Authenticate() succeeded", name)
+		}
+	}
+
+	// 401 responses challenge clients for Basic credentials
+	w := httptest.NewRecorder()
+	writeTokenError(w, errors.New("invalid or missing authorization header"))
+	if got := w.Header().Get("WWW-Authenticate"); got != basicAuthRealm {
+		t.Errorf("WWW-Authenticate = %q, want %q", got, basicAuthRealm)
+	}
+	t.Setenv("BASIC_AUTH_USERS", "")
+	w = httptest.NewRecorder()
+	writeTokenError(w, errors.New("invalid or missing authorization header"))
+	if got := w.Header().Get("WWW-Authenticate"); got != "" {
+		t.Errorf("WWW-Authenticate without Basic users = %q", got)
+	}
+}
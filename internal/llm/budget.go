@@ -0,0 +1,103 @@
+package llm
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Budget limits how much an API key may use per calendar month in the
+// usage time zone (USAGE_TIMEZONE).
+// A zero limit is unlimited.
+type Budget struct {
+	MonthlyTokens  int     `json:"monthly_tokens,omitempty"`
+	MonthlyCostUSD float64 `json:"monthly_cost_usd,omitempty"`
+}
+
+// loadBudgets reads the per-key budgets from a JSON file such as
+// {"1": {"monthly_tokens": 1000000}, "*": {"monthly_cost_usd": 20}}
+func loadBudgets(path string) (*keyedSettings[Budget], error) {
+	return loadKeyedSettings[Budget](path, "budgets")
+}
+
+// monthlyUsage returns the tokens and estimated cost a key used this month
+func (s *Service) monthlyUsage(key string) (tokens int, costUSD float64, err error) {
+	aggregates, err := s.UsageStats(s.config.startOfMonth(time.Now()), key)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, agg := range aggregates {
+		tokens += agg.TotalTokens
+		costUSD += agg.EstimatedCostUSD
+	}
+	return tokens, costUSD, nil
+}
+
+// checkBudget enforces the subscription and monthly budget of a user's key
+// and the budget of the key's tenant
+func (s *Service) checkBudget(userID uint64) error {
+	if s.subscriptionCheck != nil {
+		if err := s.subscriptionCheck(userID); err != nil {
+			return err
+		}
+	}
+	if err := s.checkTenantBudget(userID); err != nil {
+		return err
+	}
+	if s.budgets == nil {
+		return nil
+	}
+	key := usageKeyForUser(userID)
+	budget, ok := s.budgets.lookup(key)
+	if !ok {
+		return nil
+	}
+	tokens, cost, err := s.monthlyUsage(key)
+	if err != nil {
+		return err
+	}
+	return CheckBudget(budget, tokens, cost)
+}
+
+// budgetStatus is a budget together with this month's usage, as returned by
+// the admin budgets API
+type budgetStatus struct {
+	Key            string  `json:"key"`
+	MonthlyTokens  int     `json:"monthly_tokens"`
+	MonthlyCostUSD float64 `json:"monthly_cost_usd"`
+	UsedTokens     int     `json:"used_tokens"`
+	UsedCostUSD    float64 `json:"used_cost_usd"`
+}
+
+// budgetStatus combines a budget with the key's usage this month. The usage
+// of the default budget is not attributed to a single key and is left zero.
+func (s *Service) budgetStatus(key string, budget Budget) (interface{}, error) {
+	status := budgetStatus{Key: key, MonthlyTokens: budget.MonthlyTokens, MonthlyCostUSD: budget.MonthlyCostUSD}
+	if key == defaultSettingsKey {
+		return status, nil
+	}
+	tokens, cost, err := s.monthlyUsage(key)
+	status.UsedTokens, status.UsedCostUSD = tokens, cost
+	return status, err
+}
+
+// HandleBudgets serves the admin budgets API under /admin/budgets: GET lists
+// budgets with this month's usage and GET, PUT and DELETE on
+// /admin/budgets/{key} read, set and remove one budget. The key "*" is the
+// default budget for keys without one. Callers must protect the handler with
+// the admin token.
+func (s *ServerState) HandleBudgets(w http.ResponseWriter, r *http.Request) {
+	if s.Service.budgets == nil {
+		writeOpenAIError(w, http.StatusNotFound, "budgets are disabled", "invalid_request_error")
+		return
+	}
+	serveKeyedSettings(w, r, "/admin/budgets", s.Service.budgets, validateBudget, s.Service.budgetStatus)
+}
+
+// validateBudget checks a budget set through the admin API
+func validateBudget(budget Budget) error {
+	if budget.MonthlyTokens < 0 || budget.MonthlyCostUSD < 0 {
+		return errors.New("budget limits must not be negative")
+	}
+	return nil
+}
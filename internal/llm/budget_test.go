@@ -0,0 +1,159 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadBudgets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "budgets.json")
+	os.WriteFile(path, []byte(`{"1": {"monthly_tokens": 1000}, "*": {"monthly_cost_usd": 2.5}}`), 0o600)
+
+	table, err := loadBudgets(path)
+	if err != nil {
+		t.Fatalf("loadBudgets() error = %v", err)
+	}
+	if budget, ok := table.lookup("1"); !ok || budget.MonthlyTokens != 1000 {
+		t.Errorf("lookup(1) = %+v, %v", budget, ok)
+	}
+	if budget, ok := table.lookup("2"); !ok || budget.MonthlyCostUSD != 2.5 {
+		t.Errorf("lookup(2) = %+v, %v, want default budget", budget, ok)
+	}
+
+	if table, err := loadBudgets(filepath.Join(dir, "missing.json")); err != nil || len(table.snapshot()) != 0 {
+		t.Errorf("loadBudgets(missing) = %v, %v, want empty table", table, err)
+	}
+	os.WriteFile(path+".bad", []byte(`{`), 0o600)
+	if _, err := loadBudgets(path + ".bad"); err == nil {
+		t.Error("loadBudgets() of invalid JSON should fail")
+	}
+}
+
+func TestBudgetTableSavesChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budgets.json")
+	table, _ := loadBudgets(path)
+	if err := table.set("1", &Budget{MonthlyTokens: 50}); err != nil {
+		t.Fatalf("set() error = %v", err)
+	}
+	reloaded, err := loadBudgets(path)
+	if err != nil {
+		t.Fatalf("loadBudgets() error = %v", err)
+	}
+	if budget, ok := reloaded.lookup("1"); !ok || budget.MonthlyTokens != 50 {
+		t.Errorf("reloaded budget = %+v, %v", budget, ok)
+	}
+}
+
+func TestHandleBudgets(t *testing.T) {
+	table, _ := loadBudgets("")
+	state := &ServerState{Service: &Service{
+		config:  &Config{ModelPrices: map[string]ModelPrice{"gpt-4o": {Input: 1, Output: 1}}},
+		usage:   newUsageLedger(),
+		budgets: table,
+	}}
+	state.Service.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 300, Output: 200})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		state.HandleBudgets(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do("PUT", "/admin/budgets/1", `{"monthly_tokens": 1000}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/admin/budgets/2", `{"monthly_tokens": -1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT negative budget status = %d, want 400", w.Code)
+	}
+
+	w := do("GET", "/admin/budgets", "")
+	var list struct {
+		Data []budgetStatus `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 1 {
+		t.Fatalf("GET list = %s, %v", w.Body.String(), err)
+	}
+	if got := list.Data[0]; got.Key != "1" || got.MonthlyTokens != 1000 || got.UsedTokens != 500 {
+		t.Errorf("budget status = %+v", got)
+	}
+
+	if w := do("DELETE", "/admin/budgets/1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %d", w.Code)
+	}
+	if w := do("GET", "/admin/budgets/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET deleted budget status = %d, want 404", w.Code)
+	}
+	if w := do("POST", "/admin/budgets", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", w.Code)
+	}
+}
+
+func TestHandleCompletionRejectsExhaustedKeyBudget(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	upstream := newSSEUpstream(t, `{"choices":[{"delta":{"content":"hi"}}]}`)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	state.Service.budgets, _ = loadBudgets("")
+	state.Service.budgets.set(defaultSettingsKey, &Budget{MonthlyTokens: 5})
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`))
+		state.HandleCompletion(w, req)
+		return w
+	}
+	if w := send(); w.Code != http.StatusOK {
+		t.Fatalf("first request status = %d: %s", w.Code, w.Body.String())
+	}
+	// The first request used 9 tokens, exhausting the budget
+	w := send()
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `"code":"insufficient_quota"`) {
+		t.Errorf("status = %d, body = %s, want 429 insufficient_quota", w.Code, w.Body.String())
+	}
+}
+
+func TestSubscriptionCheckAndUsageReporter(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	upstream := newSSEUpstream(t, `{"choices":[{"delta":{"content":"hi"}}]}`)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	var reported []models.UsageEvent
+	state.Service.SetUsageReporter(func(event models.UsageEvent) { reported = append(reported, event) })
+	active := true
+	state.Service.SetSubscriptionCheck(func(userID uint64) error {
+		if !active {
+			return ErrSubscriptionInactive
+		}
+		return nil
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`))
+		state.HandleCompletion(w, req)
+		return w
+	}
+	if w := send(); w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if len(reported) != 1 || reported[0].Model != "test-model" || reported[0].InputTokens == 0 {
+		t.Errorf("reported usage = %+v", reported)
+	}
+
+	active = false
+	w := send()
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `"code":"insufficient_quota"`) {
+		t.Errorf("status = %d, body = %s, want 429 insufficient_quota", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,102 @@
+package llm
+
+import "copilot-proxy/pkg/models"
+
+// ChatResult is an aggregated chat completion
+type ChatResult struct {
+	Content          string
+	FinishReason     string
+	ToolCalls        []ToolCall
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// ChatDelta is the text generated in one chunk of a streamed chat completion
+type ChatDelta struct {
+	Content string
+}
+
+// Chat performs a chat completion and returns it once the upstream stream
+// is complete. It is the non-HTTP counterpart of HandleCompletion: the
+// request counts against the caller's concurrency, rate limits and budget
+// and its usage is recorded.
+func (s *Service) Chat(req CompletionRequest) (*ChatResult, error) {
+	return s.chat(req, nil)
+}
+
+// StreamChat performs a chat completion and calls fn with the text of every
+// chunk as it arrives. The aggregated completion is returned at the end of
+// the stream. Canceling req.Context aborts the upstream request.
+func (s *Service) StreamChat(req CompletionRequest, fn func(ChatDelta)) (*ChatResult, error) {
+	if err := AuthorizeStreaming(req.Token, true); err != nil {
+		return nil, err
+	}
+	return s.chat(req, func(chunk map[string]interface{}) {
+		choices, _ := chunk["choices"].([]interface{})
+		if len(choices) == 0 {
+			return
+		}
+		choice, _ := choices[0].(map[string]interface{})
+		delta, _ := choice["delta"].(map[string]interface{})
+		if content, ok := delta["content"].(string); ok && content != "" {
+			fn(ChatDelta{Content: content})
+		}
+	})
+}
+
+func (s *Service) chat(req CompletionRequest, fn func(chunk map[string]interface{})) (*ChatResult, error) {
+	release, err := s.acquireRequestSlot(req.Token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	req.ProviderRequest = s.config.applySystemPrompt(req.ProviderRequest)
+	resp, err := s.PerformCompletion(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	reader, err := s.ProcessStreamingResponse(resp, req)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	result, err := collectStreamChunks(reader, fn)
+	if err != nil {
+		return nil, wrapTransportError(err)
+	}
+	fillUsage(result, reader)
+	return result.chatResult(), nil
+}
+
+// chatResult converts an aggregated stream
+func (r *streamResult) chatResult() *ChatResult {
+	return &ChatResult{
+		Content:          r.Content,
+		FinishReason:     r.FinishReason,
+		ToolCalls:        r.ToolCalls,
+		PromptTokens:     r.Usage.PromptTokens,
+		CompletionTokens: r.Usage.CompletionTokens,
+	}
+}
+
+// Models returns the cached Copilot models the token may use from the given
+// country, which may be nil.
+func (s *Service) Models(token *models.LLMToken, countryCode *string) ([]models.LanguageModel, error) {
+	if err := s.ensureAuthAndModels(); err != nil {
+		return nil, err
+	}
+	var visible []models.LanguageModel
+	for _, model := range s.cachedModels() {
+		if AuthorizeAccessForCountry(countryCode, model.Provider) != nil {
+			continue
+		}
+		if AuthorizeAccessToModel(token, model.Provider, model.ID) != nil {
+			continue
+		}
+		visible = append(visible, model)
+	}
+	return visible, nil
+}
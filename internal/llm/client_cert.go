@@ -0,0 +1,55 @@
+package llm
+
+import (
+	"copilot-proxy/internal/tlsserver"
+	"copilot-proxy/pkg/models"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"time"
+)
+
+// Sources of identities authenticated without an API key
+const (
+	identityClientCert = "cert"
+	identityBasicAuth  = "basic"
+)
+
+// identityUserID returns the user ID the requests of an identity from a
+// source are rate limited and recorded under. The top bit is set so the IDs
+// cannot collide with stored API keys, which are numbered from 1.
+func identityUserID(source, identity string) uint64 {
+	sum := sha256.Sum256([]byte("copilot-proxy-" + source + ":" + identity))
+	return binary.BigEndian.Uint64(sum[:8]) | 1<<63
+}
+
+// identityToken returns the LLM token of requests made by an identity from
+// a source, such as a client certificate. Like stored API keys, such clients
+// are not staff.
+func identityToken(source, identity string) *models.LLMToken {
+	now := time.Now()
+	return &models.LLMToken{
+		Iat:                    now.Unix(),
+		Exp:                    now.Add(TokenLifetime * time.Second).Unix(),
+		Jti:                    source + "-" + identity,
+		UserID:                 identityUserID(source, identity),
+		GithubUserLogin:        identity,
+		AccountCreatedAt:       now,
+		HasLLMSubscription:     true,
+		MaxMonthlySpendInCents: 10000,
+	}
+}
+
+// AuthenticateClient authenticates a request like Authenticate, except that
+// a request without an Authorization header made over a connection with a
+// verified TLS client certificate is authenticated as the certificate's
+// identity (see tlsserver.ClientIdentity). An Authorization header always
+// takes precedence, so certificate clients can still use API keys.
+func (s *ServerState) AuthenticateClient(authorization, endpoint string, conn *tls.ConnectionState) (*models.LLMToken, error) {
+	if authorization == "" {
+		if identity := tlsserver.ClientIdentity(conn); identity != "" {
+			return identityToken(identityClientCert, identity), nil
+		}
+	}
+	return s.Authenticate(authorization, endpoint)
+}
@@ -0,0 +1,38 @@
+package llm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestAuthenticateClient(t *testing.T) {
+	t.Setenv("DISABLE_AUTH", "")
+	s := &ServerState{Secret: "secret"}
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: "ci-runner"}}
+	conn := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+
+	token, err := s.AuthenticateClient("", "/v1/chat/completions", conn)
+	if err != nil || token.GithubUserLogin != "ci-runner" || token.UserID != identityUserID(identityClientCert, "ci-runner") || token.IsStaff {
+		t.Fatalf("AuthenticateClient() = %+v, %v", token, err)
+	}
+	if id := identityUserID(identityClientCert, "ci-runner"); id == identityUserID(identityClientCert, "other-runner") ||
+		id == identityUserID(identityBasicAuth, "ci-runner") || id < 1<<63 {
+		t.Error("client certificate user IDs collide")
+	}
+
+	// An Authorization header takes precedence over the certificate
+	signed, _ := CreateLLMToken(7, "alice", s.Secret)
+	if token, err := s.AuthenticateClient("Bearer "+signed, "/v1/chat/completions", conn); err != nil || token.UserID != 7 {
+		t.Errorf("AuthenticateClient() with a token = %+v, %v", token, err)
+	}
+
+	// Unverified certificates do not authenticate
+	if _, err := s.AuthenticateClient("", "/v1/chat/completions", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}); err == nil {
+		t.Error("AuthenticateClient() accepted an unverified certificate")
+	}
+	if _, err := s.AuthenticateClient("", "/v1/chat/completions", nil); err == nil {
+		t.Error("AuthenticateClient() accepted a plain connection")
+	}
+}
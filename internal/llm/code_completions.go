@@ -0,0 +1,256 @@
+package llm
+
+import (
+	"copilot-proxy/internal/accesslog"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// defaultCodeCompletionEngine is the Copilot engine used for inline code
+// completions when COPILOT_COMPLETION_ENGINE is unset
+const defaultCodeCompletionEngine = "copilot-codex"
+
+// defaultCodeCompletionMaxTokens bounds a code completion without max_tokens
+const defaultCodeCompletionMaxTokens = 500
+
+// CodeCompletionParams is the request body of /copilot/completions: the code
+// before (prompt) and after (suffix) the cursor, fill-in-the-middle style
+type CodeCompletionParams struct {
+	Prompt      string      `json:"prompt"`
+	Suffix      string      `json:"suffix"`
+	Language    string      `json:"language,omitempty"`
+	MaxTokens   *int        `json:"max_tokens,omitempty"`
+	Temperature *float64    `json:"temperature,omitempty"`
+	TopP        *float64    `json:"top_p,omitempty"`
+	N           *int        `json:"n,omitempty"`
+	Stop        interface{} `json:"stop,omitempty"`
+	Stream      bool        `json:"stream"`
+}
+
+// codeCompletionEngine returns the Copilot code completion engine
+func (c *Config) codeCompletionEngine() string {
+	if c.CopilotCompletionEngine == "" {
+		return defaultCodeCompletionEngine
+	}
+	return c.CopilotCompletionEngine
+}
+
+// upstreamRequest builds the Copilot code completion payload, which is
+// always streamed
+func (p *CodeCompletionParams) upstreamRequest() map[string]interface{} {
+	request := map[string]interface{}{
+		"prompt":     p.Prompt,
+		"suffix":     p.Suffix,
+		"max_tokens": defaultCodeCompletionMaxTokens,
+		"stream":     true,
+	}
+	if p.MaxTokens != nil {
+		request["max_tokens"] = *p.MaxTokens
+	}
+	if p.Temperature != nil {
+		request["temperature"] = *p.Temperature
+	}
+	if p.TopP != nil {
+		request["top_p"] = *p.TopP
+	}
+	if p.N != nil {
+		request["n"] = *p.N
+	}
+	if p.Stop != nil {
+		request["stop"] = p.Stop
+	}
+	if p.Language != "" {
+		request["extra"] = map[string]interface{}{"language": p.Language}
+	}
+	return request
+}
+
+// codeCompletionChoice is a code completion aggregated from its stream
+type codeCompletionChoice struct {
+	text         string
+	finishReason interface{}
+}
+
+// HandleCodeCompletion bridges /copilot/completions to the Copilot code
+// completion API that editors use for inline (ghost text) suggestions. The
+// response is an OpenAI text_completion object, or a stream of them.
+func (s *ServerState) HandleCodeCompletion(w http.ResponseWriter, r *http.Request) {
+	token, err := s.validateToken(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	release, err := s.Service.acquireRequestSlot(token.UserID)
+	if err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+	defer release()
+
+	bodyBytes, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+	var params CodeCompletionParams
+	if err := json.Unmarshal(bodyBytes, &params); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), "invalid_request_error")
+		return
+	}
+	if params.Prompt == "" && params.Suffix == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "prompt or suffix is required", "invalid_request_error")
+		return
+	}
+	engine := s.Service.config.codeCompletionEngine()
+	accesslog.SetModel(r.Context(), engine)
+	if err := AuthorizeStreaming(token, params.Stream); err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+	if err := s.Service.checkBudget(token.UserID); err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+	if err := s.Service.checkKeyRateLimit(token.UserID); err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+
+	body, err := json.Marshal(params.upstreamRequest())
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "error formatting request: "+err.Error(), "internal_error")
+		return
+	}
+	resp, err := s.Service.copilotRequest(withTenant(r.Context(), token.Tenant), "copilot.code_completions", "/v1/engines/"+engine+"/completions", "copilot-ghost", body)
+	if err != nil {
+		logRequestf(r.Context(), "Code completion failed: %v", err)
+		s.Service.publishUpstreamError(r.Context(), models.ProviderCopilot, engine, nil, err)
+		writeCompletionError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.Service.publishUpstreamError(r.Context(), models.ProviderCopilot, engine, resp, nil)
+		body, _ := io.ReadAll(resp.Body)
+		writeCompletionError(w, newUpstreamError(resp, body))
+		return
+	}
+
+	now := time.Now().Unix()
+	id := fmt.Sprintf("cmpl-%d%06d", now, rand.Intn(1000000))
+	promptTokens := countTokens(engine, params.Prompt) + countTokens(engine, params.Suffix)
+	var generated string
+	defer func() {
+		s.Service.recordUsage(token.UserID, engine, models.TokenUsage{Input: promptTokens, Output: countTokens(engine, generated)}, upstreamLatency(resp))
+	}()
+
+	if !params.Stream {
+		choices := make(map[int]*codeCompletionChoice)
+		err := forEachSSEChunk(resp.Body, func(chunk map[string]interface{}) {
+			list, _ := chunk["choices"].([]interface{})
+			for _, c := range list {
+				choice, _ := c.(map[string]interface{})
+				index, _ := choice["index"].(float64)
+				aggregated := choices[int(index)]
+				if aggregated == nil {
+					aggregated = &codeCompletionChoice{}
+					choices[int(index)] = aggregated
+				}
+				text, _ := choice["text"].(string)
+				aggregated.text += text
+				generated += text
+				if reason := choice["finish_reason"]; reason != nil {
+					aggregated.finishReason = reason
+				}
+			}
+		})
+		if err != nil {
+			writeCompletionError(w, wrapTransportError(err))
+			return
+		}
+		indexes := make([]int, 0, len(choices))
+		for index := range choices {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		out := make([]map[string]interface{}, len(indexes))
+		for i, index := range indexes {
+			out[i] = map[string]interface{}{
+				"text":          choices[index].text,
+				"index":         index,
+				"logprobs":      nil,
+				"finish_reason": choices[index].finishReason,
+			}
+		}
+		completionTokens := countTokens(engine, generated)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      id,
+			"object":  "text_completion",
+			"created": now,
+			"model":   engine,
+			"choices": out,
+			"usage": map[string]interface{}{
+				"prompt_tokens":     promptTokens,
+				"completion_tokens": completionTokens,
+				"total_tokens":      promptTokens + completionTokens,
+			},
+		})
+		return
+	}
+
+	// Streaming: re-encode every upstream chunk as a text_completion chunk
+	stream, ok := s.beginStream(w, resp.Body)
+	if !ok {
+		return
+	}
+	defer s.endStream(w, stream)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher, _ := w.(http.Flusher)
+	done := false
+	pumpSSE(w, resp.Body, s.Service.config.SSEKeepaliveInterval, func(line []byte) {
+		chunk, last := decodeSSELine(string(line))
+		done = done || last
+		if done || chunk == nil {
+			return
+		}
+		choices, ok := chunk["choices"].([]interface{})
+		if !ok || len(choices) == 0 {
+			return
+		}
+		for _, c := range choices {
+			choice, _ := c.(map[string]interface{})
+			text, _ := choice["text"].(string)
+			generated += text
+		}
+		data, _ := json.Marshal(map[string]interface{}{
+			"id":      id,
+			"object":  "text_completion",
+			"created": now,
+			"model":   engine,
+			"choices": choices,
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if s.streams.wasAborted(stream) {
+		return
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,74 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHandleCodeCompletion(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	upstreamBodies := make(chan map[string]interface{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/engines/copilot-codex/completions" || r.Header.Get("OpenAI-Intent") != "copilot-ghost" {
+			http.NotFound(w, r)
+			return
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		upstreamBodies <- body
+		io.WriteString(w, strings.Join([]string{
+			`data: {"choices":[{"text":"return a","index":0}]}`,
+			`data: {"choices":[{"text":" + b","index":0,"finish_reason":"stop"}]}`,
+			`data: [DONE]`,
+		}, "\n\n")+"\n\n")
+	}))
+	defer server.Close()
+	state := newTestServerState(server)
+	mux := http.NewServeMux()
+	state.RegisterHandlers(mux)
+
+	request := `{"prompt":"func add(a, b int) int {\n\t","suffix":"\n}","language":"go","max_tokens":50`
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/copilot/completions", strings.NewReader(request+`}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	body := <-upstreamBodies
+	if body["suffix"] != "\n}" || body["max_tokens"] != 50.0 || body["stream"] != true {
+		t.Errorf("upstream request = %v", body)
+	}
+	if extra, _ := body["extra"].(map[string]interface{}); extra["language"] != "go" {
+		t.Errorf("upstream extra = %v, want the language", body["extra"])
+	}
+	var out struct {
+		Object  string `json:"object"`
+		Choices []struct {
+			Text         string `json:"text"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	json.NewDecoder(w.Body).Decode(&out)
+	if out.Object != "text_completion" || len(out.Choices) != 1 || out.Choices[0].Text != "return a + b" || out.Choices[0].FinishReason != "stop" {
+		t.Errorf("unexpected completion: %+v", out)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/copilot/completions", strings.NewReader(request+`,"stream":true}`)))
+	<-upstreamBodies
+	stream := w.Body.String()
+	if !strings.Contains(stream, `"text":"return a"`) || !strings.Contains(stream, `"object":"text_completion"`) || !strings.HasSuffix(stream, "data: [DONE]\n\n") {
+		t.Errorf("unexpected stream: %s", stream)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/copilot/completions", strings.NewReader(`{}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("empty request: status = %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,83 @@
+package llm
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ErrConcurrencyLimitExceeded is returned when the proxy or an API key already
+// has the maximum number of requests in flight
+var ErrConcurrencyLimitExceeded = fmt.Errorf("%w: too many concurrent requests", ErrRateLimitExceeded)
+
+// concurrencyLimiter counts in-flight requests in total and per key, acting
+// as a non-blocking semaphore: requests beyond a limit are rejected rather
+// than queued so a single client cannot tie up every upstream connection.
+type concurrencyLimiter struct {
+	mu     sync.Mutex
+	total  int
+	perKey map[string]int
+}
+
+// acquire reserves a slot for key unless that would exceed the global limit
+// or the key's limit (0 = unlimited). The returned function frees the slot.
+func (l *concurrencyLimiter) acquire(key string, globalLimit, keyLimit int) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if globalLimit > 0 && l.total >= globalLimit {
+		return nil, fmt.Errorf("%w: the proxy is at its limit of %d concurrent requests", ErrConcurrencyLimitExceeded, globalLimit)
+	}
+	if keyLimit > 0 && l.perKey[key] >= keyLimit {
+		return nil, fmt.Errorf("%w: maximum max_concurrent_requests of %d reached", ErrConcurrencyLimitExceeded, keyLimit)
+	}
+	if l.perKey == nil {
+		l.perKey = make(map[string]int)
+	}
+	l.total++
+	l.perKey[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.perKey[key]--; l.perKey[key] <= 0 {
+				delete(l.perKey, key)
+			}
+		})
+	}, nil
+}
+
+// inFlight returns the number of requests a key has in flight
+func (l *concurrencyLimiter) inFlight(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.perKey[key]
+}
+
+// acquireRequestSlot reserves an in-flight request slot for a user's key
+// within MAX_CONCURRENT_REQUESTS and the max_concurrent_requests rate limits
+// of the key and its tenant. The slot must be released once the response, including any stream,
+// is complete.
+func (s *Service) acquireRequestSlot(userID uint64) (func(), error) {
+	key := usageKeyForUser(userID)
+	keyLimit := 0
+	if s.rateLimits != nil {
+		if limit, ok := s.rateLimits.lookup(key); ok {
+			keyLimit = limit.MaxConcurrentRequests
+		}
+	}
+	release, err := s.concurrency.acquire(key, s.config.MaxConcurrentRequests, keyLimit)
+	if err != nil {
+		return nil, err
+	}
+	releaseTenant, err := s.acquireTenantSlot(userID)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return func() {
+		releaseTenant()
+		release()
+	}, nil
+}
@@ -0,0 +1,76 @@
+package llm
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	var l concurrencyLimiter
+
+	releaseA, err := l.acquire("1", 3, 2)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	releaseB, _ := l.acquire("1", 3, 2)
+	if _, err := l.acquire("1", 3, 2); !errors.Is(err, ErrConcurrencyLimitExceeded) || !errors.Is(err, ErrRateLimitExceeded) {
+		t.Errorf("acquire() over the key limit error = %v", err)
+	}
+	releaseC, err := l.acquire("2", 3, 2)
+	if err != nil {
+		t.Fatalf("acquire() for another key error = %v", err)
+	}
+	if _, err := l.acquire("3", 3, 0); !errors.Is(err, ErrConcurrencyLimitExceeded) {
+		t.Errorf("acquire() over the global limit error = %v", err)
+	}
+
+	releaseA()
+	releaseA() // releasing twice frees one slot only
+	if got := l.inFlight("1"); got != 1 {
+		t.Errorf("inFlight(1) = %d, want 1", got)
+	}
+	if _, err := l.acquire("3", 3, 0); err != nil {
+		t.Errorf("acquire() after release error = %v", err)
+	}
+	releaseB()
+	releaseC()
+	if _, err := l.acquire("1", 0, 0); err != nil {
+		t.Errorf("acquire() without limits error = %v", err)
+	}
+}
+
+func TestHandleCompletionEnforcesConcurrencyLimit(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	release := make(chan struct{})
+	upstream := newBlockingUpstream(release)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	state.Service.rateLimits, _ = loadRateLimits("")
+	state.Service.rateLimits.set(defaultSettingsKey, &RateLimit{MaxConcurrentRequests: 1})
+
+	_, done := startStream(t, state)
+	if got := state.Service.concurrency.inFlight(usageKeyForUser(1)); got != 1 {
+		t.Errorf("in-flight requests = %d, want 1", got)
+	}
+
+	w := httptest.NewRecorder()
+	state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`)))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("second request status = %d, Retry-After = %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), `"code":"rate_limit_exceeded"`) {
+		t.Errorf("second request body = %s", w.Body.String())
+	}
+
+	close(release)
+	<-done
+	if got := state.Service.concurrency.inFlight(usageKeyForUser(1)); got != 0 {
+		t.Errorf("in-flight requests after the stream = %d, want 0", got)
+	}
+}
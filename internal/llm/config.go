@@ -4,9 +4,14 @@ package llm
 import (
 	"copilot-proxy/pkg/models"
 	"copilot-proxy/pkg/utils"
+	"encoding/json"
 	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Config contains configuration for the Copilot LLM service including API keys.
@@ -26,6 +31,170 @@ type Config struct {
 	DefaultMaxMonthlySpend uint32
 	// FreeTierMonthlyAllowance is the free usage allowance in cents per month
 	FreeTierMonthlyAllowance uint32
+	// StructuredOutputRetries is how often a completion is retried when its
+	// output does not match the requested response_format (0 disables retries)
+	StructuredOutputRetries int
+	// AzureDeployments maps Azure OpenAI deployment names to Copilot model IDs
+	AzureDeployments map[string]string
+	// ModerationURL is an external moderation endpoint to proxy /v1/moderations
+	// to; the built-in classifier is used when empty
+	ModerationURL string
+	// ModerationAPIKey is the bearer token sent to the external moderation endpoint
+	ModerationAPIKey string
+	// OpenAIAPIKey enables the OpenAI provider for models Copilot does not offer
+	OpenAIAPIKey string
+	// OpenAIAPIURL overrides the OpenAI API base URL
+	OpenAIAPIURL string
+	// OpenAIModels are the model IDs or ID prefixes ("gpt-4.5*") served by the
+	// OpenAI provider; empty selects its chat models
+	OpenAIModels []string
+	// AnthropicAPIKey enables the Anthropic provider for Claude models
+	AnthropicAPIKey string
+	// AnthropicAPIURL overrides the Anthropic API base URL
+	AnthropicAPIURL string
+	// CopilotPoolStrategy selects how requests are balanced over the pooled
+	// Copilot accounts: PoolRoundRobin (default) or PoolLeastUsed
+	CopilotPoolStrategy string
+	// ProviderFallbacks maps a provider to the provider its failed requests
+	// are retried against
+	ProviderFallbacks map[string]string
+	// CircuitBreakerThreshold is how many consecutive failures open a
+	// provider's circuit breaker (0 disables it)
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown is how long an open circuit breaker sends
+	// requests to the fallback
+	CircuitBreakerCooldown time.Duration
+	// ModelAliases maps requested model names to concrete Copilot model IDs
+	ModelAliases map[string]string
+	// ModelMetadata overrides the metadata listed for models by model ID
+	ModelMetadata map[string]ModelMetadata
+	// ModelRateLimits are the per-minute and daily limits of each user per
+	// model, by model ID or ID prefix ending in "*"
+	ModelRateLimits map[string]ModelRateLimit
+	// ModelCacheTTL is how long the fetched model catalog is considered fresh
+	ModelCacheTTL time.Duration
+	// CopilotCompletionEngine is the Copilot engine of /copilot/completions
+	CopilotCompletionEngine string
+	// CopilotAPIURL overrides the Copilot API base URL, which is otherwise
+	// taken from the proxy-ep endpoint of the API key
+	CopilotAPIURL string
+	// UpstreamTimeout bounds a whole upstream request including the response
+	// body; 0 disables it so long streaming responses are not cut off
+	UpstreamTimeout time.Duration
+	// UpstreamResponseHeaderTimeout bounds the wait for upstream response headers
+	UpstreamResponseHeaderTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake with the upstream
+	TLSHandshakeTimeout time.Duration
+	// IdleConnTimeout is how long idle upstream connections are kept open
+	IdleConnTimeout time.Duration
+	// MaxIdleConns limits idle upstream connections across all hosts
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits idle upstream connections per host
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits all upstream connections per host (0 = unlimited)
+	MaxConnsPerHost int
+	// ResponseCacheSize is the number of cached deterministic completions (0 disables the cache)
+	ResponseCacheSize int
+	// ResponseCacheTTL is how long a cached completion may be served
+	ResponseCacheTTL time.Duration
+	// TokenCacheSize is the number of validated LLM tokens to cache (0
+	// disables the cache)
+	TokenCacheSize int
+	// TokenRefreshGrace is how long after expiring an LLM token may still be
+	// refreshed at /auth/refresh
+	TokenRefreshGrace time.Duration
+	// AuthGitHubUsers are the GitHub logins that may exchange their OAuth
+	// token for an LLM token at /auth/token
+	AuthGitHubUsers []string
+	// EmbeddingCacheSize is the number of cached embedding vectors (0 disables the cache)
+	EmbeddingCacheSize int
+	// EmbeddingCacheTTL is how long a cached embedding vector may be served
+	EmbeddingCacheTTL time.Duration
+	// ModelPrices maps model IDs and patterns such as "claude-*" to prices
+	// used for usage cost estimates
+	ModelPrices map[string]ModelPrice
+	// UsageStore selects where usage is recorded: "sqlite" (default) or "memory"
+	UsageStore string
+	// UsageDBPath is the SQLite database file used by the sqlite usage store
+	UsageDBPath string
+	// SessionStore selects where sessions are kept: "memory" (default) or "sqlite"
+	SessionStore string
+	// SessionDBPath is the SQLite database file used by the sqlite session store
+	SessionDBPath string
+	// SessionMaxMessages is how many messages a session keeps (0 = all)
+	SessionMaxMessages int
+	// BudgetsFile is a JSON file of per-key monthly budgets
+	BudgetsFile string
+	// RateLimitsFile is a JSON file of per-key rate limits
+	RateLimitsFile string
+	// UsageTimezone is the time zone whose midnight starts the daily and
+	// monthly usage windows (default UTC)
+	UsageTimezone *time.Location
+	// TenantsFile is a JSON file of the tenants the API keys belong to
+	TenantsFile string
+	// MaxConcurrentRequests limits completion requests in flight across all
+	// keys (0 = unlimited)
+	MaxConcurrentRequests int
+	// GlobalRequestsPerMinute and GlobalTokensPerMinute are the quota of the
+	// whole deployment, shared evenly among the keys active within
+	// ActiveUserWindow (0 = unlimited)
+	GlobalRequestsPerMinute int
+	GlobalTokensPerMinute   int
+	ActiveUserWindow        time.Duration
+	// SSEKeepaliveInterval is how long a stream may be idle before a
+	// heartbeat comment is sent (0 disables heartbeats)
+	SSEKeepaliveInterval time.Duration
+
+	// PromptTemplatesDir is the directory of named prompt templates (*.tmpl)
+	PromptTemplatesDir string
+	// SystemPrompt is injected as a system message into every chat completion
+	SystemPrompt string
+	// SystemPromptMode is SystemPromptPrepend (default) or SystemPromptReplace
+	SystemPromptMode string
+	// RequestHooks are the commands and webhook URLs every chat completion
+	// request is passed through before it is forwarded
+	RequestHooks []string
+	// RequestHookTimeout bounds each request hook call
+	RequestHookTimeout time.Duration
+	// ContentFilterFile is the file of keyword and regex content filter rules
+	ContentFilterFile string
+	// ContentFilterAction is ContentFilterReject (default) or ContentFilterScrub
+	ContentFilterAction string
+	// ContentFilterModeration also rejects prompts the moderation
+	// classifier flags
+	ContentFilterModeration bool
+	// StrictValidation rejects chat completion requests that do not match
+	// the OpenAI schema instead of forwarding them
+	StrictValidation bool
+	// CORSAllowedOrigins are the browser origins allowed to call the
+	// OpenAI-compatible routes ("*" for any); empty disables CORS
+	CORSAllowedOrigins []string
+	// CORSAllowedHeaders are the request headers allowed in CORS requests
+	CORSAllowedHeaders []string
+	// CORSMaxAge is how long browsers may cache a preflight response
+	CORSMaxAge time.Duration
+	// ContextTruncation is how prompts that exceed the context window are
+	// shortened: ContextTruncationTrim, ContextTruncationSummarize or, when
+	// empty, not at all
+	ContextTruncation string
+	// ContextSummaryModel writes the summaries of ContextTruncationSummarize
+	ContextSummaryModel string
+	// MaxRequestTimeout caps the timeout a client may request with
+	// X-Request-Timeout or the timeout query parameter
+	MaxRequestTimeout time.Duration
+
+	// keyMu guards CopilotAPIKey once background token refresh is running
+	keyMu sync.RWMutex
+	// aliasMu guards ModelAliases once the configuration can be reloaded
+	aliasMu sync.RWMutex
+	// metadataMu guards ModelMetadata
+	metadataMu sync.RWMutex
+	// modelLimitsMu guards ModelRateLimits
+	modelLimitsMu sync.RWMutex
+	// promptMu guards SystemPrompt and SystemPromptMode
+	promptMu sync.RWMutex
+	// pricesMu guards ModelPrices
+	pricesMu sync.RWMutex
 }
 
 var (
@@ -41,8 +210,9 @@ var (
 //
 // It attempts to load the Copilot API key from the following sources in order:
 // 1. COPILOT_API_KEY environment variable
-// 2. Local GitHub Copilot configuration file (~/.config/github-copilot/apps.json)
-// 3. Using OAuth token from environment variables via the app.GetCopilotAPIKey() method
+// 2. An unexpired key cached in the system keychain
+// 3. Local GitHub Copilot configuration file (~/.config/github-copilot/apps.json)
+// 4. Using OAuth token from environment variables via the app.GetCopilotAPIKey() method
 //
 // Returns a pointer to the configuration structure.
 func GetConfig() *Config {
@@ -50,7 +220,9 @@ func GetConfig() *Config {
 		// Try to load Copilot API key from local config if not in environment
 		copilotAPIKey := os.Getenv("COPILOT_API_KEY")
 		if copilotAPIKey == "" {
-			if token, err := utils.GetCopilotToken(); err == nil {
+			if token, err := utils.GetCachedCopilotAPIKey(); err == nil {
+				copilotAPIKey = token
+			} else if token, err := utils.GetCopilotToken(); err == nil {
 				copilotAPIKey = token
 			}
 
@@ -76,11 +248,229 @@ func GetConfig() *Config {
 			VSCodeSessionID:          os.Getenv("VSCODE_SESSION_ID"),
 			DefaultMaxMonthlySpend:   1000, // $10.00 in cents
 			FreeTierMonthlyAllowance: 1000, // $10.00 in cents
+			StructuredOutputRetries:  getEnvInt("STRUCTURED_OUTPUT_RETRIES", 0),
+			AzureDeployments:         parseKeyValueList(os.Getenv("AZURE_DEPLOYMENTS")),
+			ModerationURL:            os.Getenv("MODERATION_URL"),
+			ModerationAPIKey:         os.Getenv("MODERATION_API_KEY"),
+			OpenAIAPIKey:             os.Getenv("OPENAI_API_KEY"),
+			OpenAIAPIURL:             os.Getenv("OPENAI_API_URL"),
+			OpenAIModels:             parseList(os.Getenv("OPENAI_MODELS")),
+			AnthropicAPIKey:          os.Getenv("ANTHROPIC_API_KEY"),
+			AnthropicAPIURL:          os.Getenv("ANTHROPIC_API_URL"),
+			CopilotPoolStrategy:      os.Getenv("COPILOT_POOL_STRATEGY"),
+			PromptTemplatesDir:       os.Getenv("PROMPT_TEMPLATES_DIR"),
+			RequestHooks:             parseList(os.Getenv("REQUEST_HOOKS")),
+			RequestHookTimeout:       getEnvDuration("REQUEST_HOOK_TIMEOUT", 5*time.Second),
+			ContentFilterFile:        os.Getenv("CONTENT_FILTER_FILE"),
+			ContentFilterAction:      os.Getenv("CONTENT_FILTER_ACTION"),
+			ContentFilterModeration:  os.Getenv("CONTENT_FILTER_MODERATION") == "true",
+			StrictValidation:         os.Getenv("STRICT_VALIDATION") == "true",
+			CORSAllowedOrigins:       parseList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+			CORSAllowedHeaders:       parseList(os.Getenv("CORS_ALLOWED_HEADERS")),
+			CORSMaxAge:               getEnvDuration("CORS_MAX_AGE", 10*time.Minute),
+			MaxRequestTimeout:        getEnvDuration("MAX_REQUEST_TIMEOUT", 10*time.Minute),
+			ContextTruncation:        os.Getenv("CONTEXT_TRUNCATION"),
+			ContextSummaryModel:      os.Getenv("CONTEXT_SUMMARY_MODEL"),
+			ProviderFallbacks:        parseKeyValueList(os.Getenv("PROVIDER_FALLBACKS")),
+			CircuitBreakerThreshold:  getEnvInt("CIRCUIT_BREAKER_THRESHOLD", 5),
+			CircuitBreakerCooldown:   getEnvDuration("CIRCUIT_BREAKER_COOLDOWN", 30*time.Second),
+			ModelAliases:             loadModelAliases(),
+			ModelMetadata:            loadModelMetadata(),
+			ModelRateLimits:          loadModelRateLimits(),
+			ModelCacheTTL:            getEnvDuration("MODEL_CACHE_TTL", defaultModelCacheTTL),
+			CopilotAPIURL:            utils.CopilotAPIURL(),
+			CopilotCompletionEngine:  os.Getenv("COPILOT_COMPLETION_ENGINE"),
+
+			UpstreamTimeout:               getEnvDuration("UPSTREAM_TIMEOUT", 0),
+			UpstreamResponseHeaderTimeout: getEnvDuration("UPSTREAM_RESPONSE_HEADER_TIMEOUT", 30*time.Second),
+			TLSHandshakeTimeout:           getEnvDuration("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+			IdleConnTimeout:               getEnvDuration("UPSTREAM_IDLE_CONN_TIMEOUT", 90*time.Second),
+			MaxIdleConns:                  getEnvInt("UPSTREAM_MAX_IDLE_CONNS", 100),
+			MaxIdleConnsPerHost:           getEnvInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 10),
+			MaxConnsPerHost:               getEnvInt("UPSTREAM_MAX_CONNS_PER_HOST", 0),
+
+			ResponseCacheSize:  getEnvInt("RESPONSE_CACHE_SIZE", 0),
+			ResponseCacheTTL:   getEnvDuration("RESPONSE_CACHE_TTL", defaultResponseCacheTTL),
+			TokenCacheSize:     getEnvInt("TOKEN_CACHE_SIZE", defaultTokenCacheSize),
+			TokenRefreshGrace:  getEnvDuration("TOKEN_REFRESH_GRACE", defaultTokenRefreshGrace),
+			AuthGitHubUsers:    parseList(os.Getenv("AUTH_GITHUB_USERS")),
+			EmbeddingCacheSize: getEnvInt("EMBEDDING_CACHE_SIZE", 0),
+			EmbeddingCacheTTL:  getEnvDuration("EMBEDDING_CACHE_TTL", defaultEmbeddingCacheTTL),
+			ModelPrices:        loadModelPrices(),
+			UsageStore:         os.Getenv("USAGE_STORE"),
+			UsageDBPath:        os.Getenv("USAGE_DB_PATH"),
+			SessionStore:       os.Getenv("SESSION_STORE"),
+			SessionDBPath:      os.Getenv("SESSION_DB_PATH"),
+			SessionMaxMessages: getEnvInt("SESSION_MAX_MESSAGES", 100),
+			BudgetsFile:        os.Getenv("BUDGETS_FILE"),
+			RateLimitsFile:     os.Getenv("RATE_LIMITS_FILE"),
+			UsageTimezone:      loadUsageTimezone(),
+			TenantsFile:        os.Getenv("TENANTS_FILE"),
+
+			MaxConcurrentRequests:   getEnvInt("MAX_CONCURRENT_REQUESTS", 0),
+			GlobalRequestsPerMinute: getEnvInt("GLOBAL_REQUESTS_PER_MINUTE", 0),
+			GlobalTokensPerMinute:   getEnvInt("GLOBAL_TOKENS_PER_MINUTE", 0),
+			ActiveUserWindow:        getEnvDuration("ACTIVE_USER_WINDOW", defaultActiveUserWindow),
+			SSEKeepaliveInterval:    sseKeepaliveInterval(),
 		}
+		config.SystemPrompt, config.SystemPromptMode = loadSystemPrompt()
 	})
 	return config
 }
 
+// APIKey returns the current Copilot API key. The key may be swapped by a
+// background refresh at any time, so running code should use this accessor
+// rather than reading CopilotAPIKey directly.
+func (c *Config) APIKey() string {
+	c.keyMu.RLock()
+	defer c.keyMu.RUnlock()
+	return c.CopilotAPIKey
+}
+
+// editorVersions returns the Editor-Version and Editor-Plugin-Version headers
+// sent to Copilot: the configured versions or, for those not configured, the
+// detected or known-good ones of utils.EditorVersions.
+func (c *Config) editorVersions() (editor, plugin string) {
+	editor, plugin = utils.EditorVersions()
+	if c.EditorVersion != "" {
+		editor = c.EditorVersion
+	}
+	if c.EditorPluginVersion != "" {
+		plugin = c.EditorPluginVersion
+	}
+	return editor, plugin
+}
+
+// clientIDs returns the Vscode-Machineid and Vscode-Sessionid headers sent
+// to Copilot: the configured IDs or, for those not configured, the generated
+// ones of utils.ClientIDs.
+func (c *Config) clientIDs() (machineID, sessionID string) {
+	machineID, sessionID = utils.ClientIDs()
+	if c.VSCodeMachineID != "" {
+		machineID = c.VSCodeMachineID
+	}
+	if c.VSCodeSessionID != "" {
+		sessionID = c.VSCodeSessionID
+	}
+	return machineID, sessionID
+}
+
+// SetAPIKey atomically replaces the Copilot API key.
+func (c *Config) SetAPIKey(key string) {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	c.CopilotAPIKey = key
+}
+
+// getEnvInt reads an integer environment variable, returning defaultValue if
+// it is unset or invalid.
+func getEnvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvDuration reads a duration environment variable such as "10m",
+// returning defaultValue if it is unset or invalid.
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// sseKeepaliveInterval reads SSE_KEEPALIVE_INTERVAL, where "0" disables
+// heartbeats
+func sseKeepaliveInterval() time.Duration {
+	if os.Getenv("SSE_KEEPALIVE_INTERVAL") == "0" {
+		return 0
+	}
+	return getEnvDuration("SSE_KEEPALIVE_INTERVAL", defaultSSEKeepaliveInterval)
+}
+
+// parseKeyValueList parses a comma-separated list of key=value pairs such as
+// "a=b,c=d" into a map. Malformed entries are skipped.
+func parseKeyValueList(value string) map[string]string {
+	result := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if key != "" && val != "" {
+			result[key] = val
+		}
+	}
+	return result
+}
+
+// poolStrategy returns the account pool strategy, round-robin unless
+// least-used is configured
+func (c *Config) poolStrategy() string {
+	if c.CopilotPoolStrategy == PoolLeastUsed {
+		return PoolLeastUsed
+	}
+	return PoolRoundRobin
+}
+
+// parseList parses a comma-separated list, skipping empty entries
+func parseList(value string) []string {
+	var result []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// loadModelAliases builds the model alias map from the JSON file named by
+// MODEL_ALIASES_FILE and the MODEL_ALIASES environment variable
+// ("alias=model,..."). Entries from the environment take precedence.
+func loadModelAliases() map[string]string {
+	aliases := make(map[string]string)
+	if path := os.Getenv("MODEL_ALIASES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &aliases)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to load model aliases from %s: %v", path, err)
+		}
+	}
+	for alias, model := range parseKeyValueList(os.Getenv("MODEL_ALIASES")) {
+		aliases[alias] = model
+	}
+	return aliases
+}
+
+// SetModelAliases atomically replaces the model alias map.
+func (c *Config) SetModelAliases(aliases map[string]string) {
+	c.aliasMu.Lock()
+	defer c.aliasMu.Unlock()
+	c.ModelAliases = aliases
+}
+
+// ResolveModel rewrites a requested model name through the alias map.
+// Aliases may point to other aliases; cycles stop at the last distinct name.
+func (c *Config) ResolveModel(name string) string {
+	c.aliasMu.RLock()
+	defer c.aliasMu.RUnlock()
+	seen := map[string]bool{name: true}
+	for {
+		target, ok := c.ModelAliases[name]
+		if !ok || seen[target] {
+			return name
+		}
+		seen[target] = true
+		name = target
+	}
+}
+
 // createAppInstance creates a new instance of the app.App type using reflection
 // to avoid import cycles.
 func createAppInstance() interface{} {
@@ -1,9 +1,13 @@
 package llm
 
 import (
+	"copilot-proxy/pkg/models"
+	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetConfig(t *testing.T) {
@@ -93,15 +97,15 @@ func TestGetConfig(t *testing.T) {
 }
 
 func TestDefaultModels(t *testing.T) {
-	models := DefaultModels()
+	defaults := DefaultModels()
 
-	if len(models) == 0 {
+	if len(defaults) == 0 {
 		t.Fatal("DefaultModels() returned empty slice")
 	}
 
 	// Test the copilot-chat model which should always be present
 	var found bool
-	for _, model := range models {
+	for _, model := range defaults {
 		if model.ID == "copilot-chat" {
 			found = true
 			if model.Provider != models.ProviderCopilot {
@@ -124,3 +128,155 @@ func TestDefaultModels(t *testing.T) {
 		t.Error("copilot-chat model not found in default models")
 	}
 }
+
+func TestResolveModel(t *testing.T) {
+	c := &Config{ModelAliases: map[string]string{
+		"gpt-4":      "gpt-4o",
+		"my-default": "gpt-4",
+		"loop-a":     "loop-b",
+		"loop-b":     "loop-a",
+	}}
+
+	tests := []struct {
+		name  string
+		model string
+		want  string
+	}{
+		{"direct alias", "gpt-4", "gpt-4o"},
+		{"chained alias", "my-default", "gpt-4o"},
+		{"unaliased model", "claude-3.5-sonnet", "claude-3.5-sonnet"},
+		{"alias cycle", "loop-a", "loop-b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.ResolveModel(tt.model); got != tt.want {
+				t.Errorf("ResolveModel(%q) = %q, want %q", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadModelAliases(t *testing.T) {
+	path := t.TempDir() + "/aliases.json"
+	if err := os.WriteFile(path, []byte(`{"gpt-4":"gpt-4o","gpt-4-turbo":"gpt-4o"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("MODEL_ALIASES_FILE", path)
+	os.Setenv("MODEL_ALIASES", "gpt-4=gpt-4.1,my-default=claude-3.5-sonnet")
+	defer os.Unsetenv("MODEL_ALIASES_FILE")
+	defer os.Unsetenv("MODEL_ALIASES")
+
+	aliases := loadModelAliases()
+	want := map[string]string{
+		"gpt-4":       "gpt-4.1",
+		"gpt-4-turbo": "gpt-4o",
+		"my-default":  "claude-3.5-sonnet",
+	}
+	if len(aliases) != len(want) {
+		t.Fatalf("loadModelAliases() = %v, want %v", aliases, want)
+	}
+	for k, v := range want {
+		if aliases[k] != v {
+			t.Errorf("aliases[%q] = %q, want %q", k, aliases[k], v)
+		}
+	}
+}
+
+func TestNewUpstreamClient(t *testing.T) {
+	env := map[string]string{
+		"UPSTREAM_TIMEOUT":                 "10m",
+		"UPSTREAM_RESPONSE_HEADER_TIMEOUT": "45s",
+		"UPSTREAM_TLS_HANDSHAKE_TIMEOUT":   "5s",
+		"UPSTREAM_IDLE_CONN_TIMEOUT":       "2m",
+		"UPSTREAM_MAX_IDLE_CONNS":          "50",
+		"UPSTREAM_MAX_IDLE_CONNS_PER_HOST": "20",
+		"UPSTREAM_MAX_CONNS_PER_HOST":      "30",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	config = nil
+	configOnce = sync.Once{}
+	defer func() {
+		config = nil
+		configOnce = sync.Once{}
+	}()
+
+	client := newUpstreamClient(GetConfig())
+	if client.Timeout != 10*time.Minute {
+		t.Errorf("Timeout = %v, want 10m", client.Timeout)
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Transport = %T, want *http.Transport", client.Transport)
+	}
+	if transport.ResponseHeaderTimeout != 45*time.Second {
+		t.Errorf("ResponseHeaderTimeout = %v, want 45s", transport.ResponseHeaderTimeout)
+	}
+	if transport.TLSHandshakeTimeout != 5*time.Second {
+		t.Errorf("TLSHandshakeTimeout = %v, want 5s", transport.TLSHandshakeTimeout)
+	}
+	if transport.IdleConnTimeout != 2*time.Minute {
+		t.Errorf("IdleConnTimeout = %v, want 2m", transport.IdleConnTimeout)
+	}
+	if transport.MaxIdleConns != 50 || transport.MaxIdleConnsPerHost != 20 || transport.MaxConnsPerHost != 30 {
+		t.Errorf("connection limits = %d/%d/%d, want 50/20/30",
+			transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost)
+	}
+}
+
+func TestNewUpstreamClientDefaultsAllowLongStreams(t *testing.T) {
+	config = nil
+	configOnce = sync.Once{}
+	defer func() {
+		config = nil
+		configOnce = sync.Once{}
+	}()
+
+	client := newUpstreamClient(GetConfig())
+	if client.Timeout != 0 {
+		t.Errorf("Timeout = %v, want no overall timeout by default", client.Timeout)
+	}
+	if transport := client.Transport.(*http.Transport); transport.ResponseHeaderTimeout != 30*time.Second {
+		t.Errorf("ResponseHeaderTimeout = %v, want 30s", transport.ResponseHeaderTimeout)
+	}
+}
+
+func TestServiceReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	aliasesPath := filepath.Join(dir, "aliases.json")
+	limitsPath := filepath.Join(dir, "limits.json")
+	t.Setenv("MODEL_ALIASES_FILE", aliasesPath)
+	t.Setenv("MODEL_ALIASES", "")
+	os.WriteFile(aliasesPath, []byte(`{"fast": "gpt-4o-mini"}`), 0o600)
+	os.WriteFile(limitsPath, []byte(`{"1": {"requests_per_minute": 5}}`), 0o600)
+
+	limits, err := loadRateLimits(limitsPath)
+	if err != nil {
+		t.Fatalf("loadRateLimits() error = %v", err)
+	}
+	budgets, _ := loadBudgets("")
+	s := &Service{config: &Config{ModelAliases: loadModelAliases()}, budgets: budgets, rateLimits: limits}
+
+	os.WriteFile(aliasesPath, []byte(`{"fast": "gpt-4.1"}`), 0o600)
+	os.WriteFile(limitsPath, []byte(`{"1": {"requests_per_minute": 10}}`), 0o600)
+	if err := s.ReloadConfig(); err != nil {
+		t.Fatalf("ReloadConfig() error = %v", err)
+	}
+	if got := s.config.ResolveModel("fast"); got != "gpt-4.1" {
+		t.Errorf("ResolveModel(fast) after reload = %q", got)
+	}
+	if limit, _ := s.rateLimits.lookup("1"); limit.RequestsPerMinute != 10 {
+		t.Errorf("rate limit after reload = %+v", limit)
+	}
+
+	// Invalid files are reported and the loaded settings kept
+	os.WriteFile(limitsPath, []byte(`{"1": `), 0o600)
+	if err := s.ReloadConfig(); err == nil {
+		t.Error("ReloadConfig() with a malformed rate limits file succeeded")
+	}
+	if limit, _ := s.rateLimits.lookup("1"); limit.RequestsPerMinute != 10 {
+		t.Errorf("rate limit after failed reload = %+v", limit)
+	}
+}
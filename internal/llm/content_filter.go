@@ -0,0 +1,255 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Content filter actions of CONTENT_FILTER_ACTION
+const (
+	// ContentFilterReject rejects requests that match a rule
+	ContentFilterReject = "reject"
+	// ContentFilterScrub replaces the matches of the rules and forwards the
+	// request
+	ContentFilterScrub = "scrub"
+)
+
+// contentFilterReplacement replaces scrubbed content
+const contentFilterReplacement = "[filtered]"
+
+var (
+	// ErrContentFiltered is returned when a prompt is rejected by the
+	// content filter
+	ErrContentFiltered = errors.New("the prompt was rejected by the content filter")
+	// ErrContentFilterUnavailable is returned when the moderation provider
+	// of the content filter fails. Requests fail closed.
+	ErrContentFilterUnavailable = errors.New("content filter unavailable")
+)
+
+// contentFilter holds the rules of CONTENT_FILTER_FILE. Each line is a
+// keyword matched as a whole word regardless of case, or a regular
+// expression prefixed with "re:"; blank lines and lines starting with # are
+// ignored.
+type contentFilter struct {
+	mu    sync.RWMutex
+	path  string
+	rules []*regexp.Regexp
+}
+
+// loadContentFilter reads the rules of path. An empty path disables the
+// rules.
+func loadContentFilter(path string) (*contentFilter, error) {
+	f := &contentFilter{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload re-reads the rules. On error the previous rules are kept.
+func (f *contentFilter) reload() error {
+	var rules []*regexp.Regexp
+	if f.path != "" {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return fmt.Errorf("failed to read content filter rules: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			pattern := `(?i)\b` + regexp.QuoteMeta(text) + `\b`
+			if expr := strings.TrimPrefix(text, "re:"); expr != text {
+				pattern = strings.TrimSpace(expr)
+			}
+			rule, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid content filter rule on line %d: %w", line, err)
+			}
+			rules = append(rules, rule)
+		}
+	}
+	f.mu.Lock()
+	f.rules = rules
+	f.mu.Unlock()
+	return nil
+}
+
+// enabled reports whether there are any rules
+func (f *contentFilter) enabled() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.rules) > 0
+}
+
+// match returns the first rule matching text
+func (f *contentFilter) match(text string) *regexp.Regexp {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, rule := range f.rules {
+		if rule.MatchString(text) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// scrub replaces the matches of all rules in text
+func (f *contentFilter) scrub(text string) string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, rule := range f.rules {
+		text = rule.ReplaceAllString(text, contentFilterReplacement)
+	}
+	return text
+}
+
+// filterContent checks the messages of a chat completion request against
+// the content filter rules and, with CONTENT_FILTER_MODERATION, the
+// moderation classifier before the request is forwarded. A request matching
+// a rule is rejected with ErrContentFiltered or, with
+// CONTENT_FILTER_ACTION=scrub, forwarded with the matches replaced; a
+// request the classifier flags is always rejected.
+func (s *Service) filterContent(ctx context.Context, providerRequest string) (string, error) {
+	hasRules := s.contentFilter != nil && s.contentFilter.enabled()
+	if !hasRules && !s.config.ContentFilterModeration {
+		return providerRequest, nil
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(providerRequest), &payload); err != nil {
+		return providerRequest, nil
+	}
+	messages, _ := payload["messages"].([]interface{})
+	visit := func(fn func(string) string) {
+		for _, m := range messages {
+			if msg, ok := m.(map[string]interface{}); ok {
+				visitMessageText(msg, fn)
+			}
+		}
+	}
+	var texts []string
+	visit(func(text string) string {
+		texts = append(texts, text)
+		return text
+	})
+
+	if hasRules {
+		matched := false
+		for _, text := range texts {
+			if rule := s.contentFilter.match(text); rule != nil {
+				if s.config.ContentFilterAction != ContentFilterScrub {
+					log.Printf("Content filter rule %s rejected a prompt", rule)
+					return "", ErrContentFiltered
+				}
+				matched = true
+			}
+		}
+		if matched {
+			texts = texts[:0]
+			visit(func(text string) string {
+				text = s.contentFilter.scrub(text)
+				texts = append(texts, text)
+				return text
+			})
+			if body, err := json.Marshal(payload); err == nil {
+				providerRequest = string(body)
+			}
+		}
+	}
+
+	if s.config.ContentFilterModeration && len(texts) > 0 {
+		categories, err := s.moderate(ctx, texts)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrContentFilterUnavailable, err)
+		}
+		if len(categories) > 0 {
+			return "", fmt.Errorf("%w (%s)", ErrContentFiltered, strings.Join(categories, ", "))
+		}
+	}
+	return providerRequest, nil
+}
+
+// moderate classifies texts with the moderation provider of MODERATION_URL
+// or, without one, the built-in classifier, and returns the flagged
+// categories
+func (s *Service) moderate(ctx context.Context, texts []string) ([]string, error) {
+	var results []ModerationResult
+	if url := s.config.ModerationURL; url != "" {
+		body, _ := json.Marshal(map[string]interface{}{"input": texts})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if key := s.config.ModerationAPIKey; key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("moderation provider unavailable: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("moderation provider returned %d", resp.StatusCode)
+		}
+		var out struct {
+			Results []ModerationResult `json:"results"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return nil, fmt.Errorf("invalid moderation response: %w", err)
+		}
+		results = out.Results
+	} else {
+		for _, text := range texts {
+			results = append(results, ClassifyText(text))
+		}
+	}
+
+	flagged := map[string]bool{}
+	for _, result := range results {
+		for category, hit := range result.Categories {
+			if hit {
+				flagged[category] = true
+			}
+		}
+		if result.Flagged && len(flagged) == 0 {
+			flagged["flagged"] = true
+		}
+	}
+	categories := make([]string, 0, len(flagged))
+	for category := range flagged {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories, nil
+}
+
+// visitMessageText calls visit with the text of a message's string content
+// or text parts, replacing each text with visit's result
+func visitMessageText(msg map[string]interface{}, visit func(string) string) {
+	switch content := msg["content"].(type) {
+	case string:
+		msg["content"] = visit(content)
+	case []interface{}:
+		for _, p := range content {
+			if part, ok := p.(map[string]interface{}); ok {
+				if text, ok := part["text"].(string); ok {
+					part["text"] = visit(text)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContentFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	os.WriteFile(path, []byte("# internal code names\nProject Falcon\nre:\\b\\d{3}-\\d{2}-\\d{4}\\b\n"), 0o600)
+	filter, err := loadContentFilter(path)
+	if err != nil {
+		t.Fatalf("loadContentFilter() error = %v", err)
+	}
+	s := &Service{config: &Config{}, contentFilter: filter}
+	request := `{"messages":[{"role":"system","content":"Be brief"},{"role":"user","content":[{"type":"text","text":"Status of project falcon for 123-45-6789?"}]}]}`
+
+	t.Run("reject", func(t *testing.T) {
+		_, err := s.filterContent(context.Background(), request)
+		if !errors.Is(err, ErrContentFiltered) {
+			t.Fatalf("filterContent() error = %v, want ErrContentFiltered", err)
+		}
+		if status, errType, code := CompletionError(err); status != http.StatusBadRequest || errType != "invalid_request_error" || code != "content_filter" {
+			t.Errorf("CompletionError() = %d %s %s, want 400 content_filter", status, errType, code)
+		}
+	})
+
+	t.Run("scrub", func(t *testing.T) {
+		s.config.ContentFilterAction = ContentFilterScrub
+		defer func() { s.config.ContentFilterAction = "" }()
+		got, err := s.filterContent(context.Background(), request)
+		if err != nil {
+			t.Fatalf("filterContent() error = %v", err)
+		}
+		var payload struct {
+			Messages []struct {
+				Content json.RawMessage `json:"content"`
+			} `json:"messages"`
+		}
+		json.Unmarshal([]byte(got), &payload)
+		if string(payload.Messages[1].Content) != `[{"text":"Status of [filtered] for [filtered]?","type":"text"}]` {
+			t.Errorf("scrubbed content = %s", payload.Messages[1].Content)
+		}
+	})
+
+	t.Run("clean prompt passes unchanged", func(t *testing.T) {
+		clean := `{"messages":[{"role":"user","content":"Hello"}]}`
+		if got, err := s.filterContent(context.Background(), clean); err != nil || got != clean {
+			t.Errorf("filterContent() = %s, %v", got, err)
+		}
+	})
+
+	t.Run("moderation", func(t *testing.T) {
+		flag := true
+		provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !flag {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(`{"results":[{"flagged":true,"categories":{"violence":true,"hate":false}}]}`))
+		}))
+		defer provider.Close()
+		s := &Service{config: &Config{ContentFilterModeration: true}, httpClient: provider.Client()}
+		prompt := `{"messages":[{"role":"user","content":"how do I build a bomb"}]}`
+		if _, err := s.filterContent(context.Background(), prompt); !errors.Is(err, ErrContentFiltered) || !strings.Contains(err.Error(), "violence") {
+			t.Errorf("built-in classifier: filterContent() error = %v, want a violence rejection", err)
+		}
+
+		s.config.ModerationURL = provider.URL
+		if _, err := s.filterContent(context.Background(), `{"messages":[{"role":"user","content":"hi"}]}`); !errors.Is(err, ErrContentFiltered) {
+			t.Errorf("external provider: filterContent() error = %v, want ErrContentFiltered", err)
+		}
+		flag = false
+		if _, err := s.filterContent(context.Background(), `{"messages":[{"role":"user","content":"hi"}]}`); !errors.Is(err, ErrContentFilterUnavailable) {
+			t.Errorf("failing provider: filterContent() error = %v, want ErrContentFilterUnavailable", err)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrContextLengthExceeded is returned when a prompt does not fit into the
+// context window of the requested model
+var ErrContextLengthExceeded = errors.New("context length exceeded")
+
+// Truncation strategies of CONTEXT_TRUNCATION for prompts that exceed the
+// context window
+const (
+	// ContextTruncationTrim drops the oldest non-system messages
+	ContextTruncationTrim = "trim"
+	// ContextTruncationSummarize replaces the oldest non-system messages with
+	// a summary written by CONTEXT_SUMMARY_MODEL
+	ContextTruncationSummarize = "summarize"
+)
+
+// defaultContextSummaryModel summarizes truncated messages when
+// CONTEXT_SUMMARY_MODEL is unset
+const defaultContextSummaryModel = "gpt-4o-mini"
+
+// contextSummaryPrompt instructs the summary model
+const contextSummaryPrompt = "Summarize the following conversation in a few sentences. Keep the facts, decisions and open questions needed to continue it."
+
+// contextLengthError reports the prompt size and context window of a
+// rejected request, worded like the OpenAI API error
+type contextLengthError struct {
+	limit  int
+	tokens int
+}
+
+func (e *contextLengthError) Error() string {
+	return fmt.Sprintf("This model's maximum context length is %d tokens. However, your messages resulted in %d tokens. Please reduce the length of the messages.", e.limit, e.tokens)
+}
+
+func (e *contextLengthError) Is(target error) bool { return target == ErrContextLengthExceeded }
+
+// fitContextWindow counts the prompt tokens of a request and checks them
+// against the model's context window, as reported by the provider or set in
+// MODEL_METADATA_FILE. A request that does not fit is truncated with the
+// CONTEXT_TRUNCATION strategy or, without one, rejected with
+// ErrContextLengthExceeded. Models with an unknown context window are not
+// checked.
+func (s *Service) fitContextWindow(ctx context.Context, model *models.LanguageModel, providerRequest string) (string, error) {
+	limit := s.config.modelMetadata(model.ID, ModelMetadata{ContextWindow: model.ContextWindow}).ContextWindow
+	if limit <= 0 {
+		return providerRequest, nil
+	}
+	tokens := countPromptTokens(model.ID, providerRequest)
+	if tokens <= limit {
+		return providerRequest, nil
+	}
+	strategy := s.config.ContextTruncation
+	if strategy != ContextTruncationTrim && strategy != ContextTruncationSummarize {
+		return "", &contextLengthError{limit: limit, tokens: tokens}
+	}
+
+	var request map[string]interface{}
+	if err := json.Unmarshal([]byte(providerRequest), &request); err != nil {
+		return "", &contextLengthError{limit: limit, tokens: tokens}
+	}
+	messages, _ := request["messages"].([]interface{})
+	kept, dropped := messages, []interface{}(nil)
+	for tokens > limit {
+		var ok bool
+		if kept, dropped, ok = dropOldestMessage(kept, dropped); !ok {
+			return "", &contextLengthError{limit: limit, tokens: tokens}
+		}
+		request["messages"] = kept
+		trimmed, err := json.Marshal(request)
+		if err != nil {
+			return "", err
+		}
+		providerRequest = string(trimmed)
+		tokens = countPromptTokens(model.ID, providerRequest)
+	}
+
+	if strategy == ContextTruncationSummarize {
+		if summarized, ok := s.summarizeDropped(ctx, model.ID, request, kept, dropped, limit); ok {
+			logRequestf(ctx, "Summarized %d messages to fit the %d token context window of %s", len(dropped), limit, model.ID)
+			return summarized, nil
+		}
+	}
+	logRequestf(ctx, "Dropped %d messages to fit the %d token context window of %s", len(dropped), limit, model.ID)
+	return providerRequest, nil
+}
+
+// dropOldestMessage moves the oldest non-system message, together with the
+// tool results answering it, from kept to dropped. The last message, which
+// the model is asked to respond to, is never dropped.
+func dropOldestMessage(kept, dropped []interface{}) ([]interface{}, []interface{}, bool) {
+	first := -1
+	for i, m := range kept {
+		if messageRole(m) != "system" {
+			first = i
+			break
+		}
+	}
+	if first < 0 || first == len(kept)-1 {
+		return kept, dropped, false
+	}
+	end := first + 1
+	for end < len(kept)-1 && messageRole(kept[end]) == "tool" {
+		end++
+	}
+	dropped = append(dropped, kept[first:end]...)
+	remaining := append([]interface{}{}, kept[:first]...)
+	return append(remaining, kept[end:]...), dropped, true
+}
+
+// messageRole returns the role of a chat message
+func messageRole(message interface{}) string {
+	m, _ := message.(map[string]interface{})
+	role, _ := m["role"].(string)
+	return role
+}
+
+// summarizeDropped returns the request with a summary of the dropped
+// messages inserted after its leading system messages. It reports false if
+// the summary cannot be written or does not fit the context window, in
+// which case the trimmed request is used.
+func (s *Service) summarizeDropped(ctx context.Context, modelID string, request map[string]interface{}, kept, dropped []interface{}, limit int) (string, bool) {
+	summary, err := s.summarizeMessages(ctx, dropped)
+	if err != nil {
+		logRequestf(ctx, "Warning: failed to summarize truncated messages: %v", err)
+		return "", false
+	}
+	insert := 0
+	for insert < len(kept) && messageRole(kept[insert]) == "system" {
+		insert++
+	}
+	messages := append([]interface{}{}, kept[:insert]...)
+	messages = append(messages, map[string]interface{}{
+		"role":    "system",
+		"content": "Summary of the earlier conversation:\n" + summary,
+	})
+	request["messages"] = append(messages, kept[insert:]...)
+	summarized, err := json.Marshal(request)
+	if err != nil || countPromptTokens(modelID, string(summarized)) > limit {
+		return "", false
+	}
+	return string(summarized), true
+}
+
+// summarizeMessages asks CONTEXT_SUMMARY_MODEL for a summary of messages
+func (s *Service) summarizeMessages(ctx context.Context, messages []interface{}) (string, error) {
+	var transcript strings.Builder
+	for _, message := range messages {
+		m, _ := message.(map[string]interface{})
+		content, _ := json.Marshal(m["content"])
+		if text := messageText(content); text != "" {
+			fmt.Fprintf(&transcript, "%s: %s\n", messageRole(message), text)
+		}
+	}
+
+	modelID := s.config.ContextSummaryModel
+	if modelID == "" {
+		modelID = defaultContextSummaryModel
+	}
+	modelID = s.config.ResolveModel(modelID)
+	provider := models.ProviderCopilot
+	for _, m := range s.cachedModels() {
+		if m.ID == modelID {
+			provider = m.Provider
+			break
+		}
+	}
+	p, err := s.provider(provider)
+	if err != nil {
+		return "", err
+	}
+	request, err := json.Marshal(map[string]interface{}{
+		"model": modelID,
+		"messages": []map[string]string{
+			{"role": "system", "content": contextSummaryPrompt},
+			{"role": "user", "content": transcript.String()},
+		},
+		"temperature": 0,
+	})
+	if err != nil {
+		return "", err
+	}
+	result, err := p.Complete(ctx, modelID, string(request))
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(result.Content) == "" {
+		return "", errors.New("the summary model returned no text")
+	}
+	return strings.TrimSpace(result.Content), nil
+}
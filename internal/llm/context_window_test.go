@@ -0,0 +1,160 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestContextWindowGuard(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+	state := newTestServerState(server)
+	state.Service.modelsCache[0].ContextWindow = 50
+
+	post := func(prompt string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"model":    "test-model",
+			"messages": []map[string]string{{"role": "user", "content": prompt}},
+		})
+		w := httptest.NewRecorder()
+		state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(string(body))))
+		return w
+	}
+
+	if w := post("hello"); w.Code != http.StatusOK {
+		t.Fatalf("short prompt: status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	w := post(strings.Repeat("lorem ipsum dolor sit amet ", 40))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("long prompt: status = %d, want 400", w.Code)
+	}
+	var out struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	json.NewDecoder(w.Body).Decode(&out)
+	if out.Error.Code != "context_length_exceeded" || out.Error.Type != "invalid_request_error" ||
+		!strings.Contains(out.Error.Message, "maximum context length is 50 tokens") {
+		t.Errorf("unexpected error: %+v", out.Error)
+	}
+	if calls != 1 {
+		t.Errorf("upstream called %d times, want only for the short prompt", calls)
+	}
+
+	// A metadata override raises the limit
+	state.Service.config.SetModelMetadata(map[string]ModelMetadata{"test-model": {ContextWindow: 100000}})
+	if w := post(strings.Repeat("lorem ipsum dolor sit amet ", 40)); w.Code != http.StatusOK {
+		t.Errorf("overridden context window: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+// longConversation returns a chat request with a system prompt, a tool call
+// exchange and many long turns before the final question
+func longConversation() string {
+	messages := []map[string]interface{}{
+		{"role": "system", "content": "You are terse."},
+		{"role": "assistant", "tool_calls": []interface{}{map[string]interface{}{"id": "call_1", "type": "function"}}},
+		{"role": "tool", "tool_call_id": "call_1", "content": strings.Repeat("tool output ", 20)},
+	}
+	for i := 0; i < 10; i++ {
+		messages = append(messages, map[string]interface{}{"role": "user", "content": strings.Repeat("earlier words ", 20)})
+	}
+	messages = append(messages, map[string]interface{}{"role": "user", "content": "final question"})
+	request, _ := json.Marshal(map[string]interface{}{"model": "test-model", "messages": messages})
+	return string(request)
+}
+
+// requestRoles returns the roles of a request's messages
+func requestRoles(t *testing.T, request string) []string {
+	t.Helper()
+	var out struct {
+		Messages []map[string]interface{} `json:"messages"`
+	}
+	if err := json.Unmarshal([]byte(request), &out); err != nil {
+		t.Fatal(err)
+	}
+	var roles []string
+	for _, m := range out.Messages {
+		roles = append(roles, m["role"].(string))
+	}
+	return roles
+}
+
+func TestContextTruncationTrim(t *testing.T) {
+	s := &Service{config: &Config{ContextTruncation: ContextTruncationTrim}, usage: newUsageLedger()}
+	model := &models.LanguageModel{ID: "test-model", ContextWindow: 150}
+
+	request := longConversation()
+	fitted, err := s.fitContextWindow(context.Background(), model, request)
+	if err != nil {
+		t.Fatalf("fitContextWindow() error = %v", err)
+	}
+	if tokens := countPromptTokens("test-model", fitted); tokens > 150 {
+		t.Errorf("trimmed request has %d tokens, want at most 150", tokens)
+	}
+	roles := requestRoles(t, fitted)
+	if roles[0] != "system" || len(roles) < 2 {
+		t.Fatalf("roles = %v, want the system prompt kept", roles)
+	}
+	for _, role := range roles[1:] {
+		if role != "user" {
+			t.Errorf("roles = %v, want the tool exchange dropped first", roles)
+		}
+	}
+	if !strings.Contains(fitted, "final question") {
+		t.Errorf("the last message was dropped")
+	}
+
+	// The last message alone does not fit
+	model.ContextWindow = 5
+	if _, err := s.fitContextWindow(context.Background(), model, request); !errors.Is(err, ErrContextLengthExceeded) {
+		t.Errorf("fitContextWindow() error = %v, want ErrContextLengthExceeded", err)
+	}
+}
+
+func TestContextTruncationSummarize(t *testing.T) {
+	s := &Service{config: &Config{ContextTruncation: ContextTruncationSummarize}, usage: newUsageLedger()}
+	summarizer := &fakeProvider{stream: "data: {\"choices\":[{\"delta\":{\"content\":\"They discussed earlier words.\"}}]}\n\n"}
+	s.RegisterProvider(models.ProviderCopilot, summarizer)
+	model := &models.LanguageModel{ID: "test-model", ContextWindow: 150}
+
+	fitted, err := s.fitContextWindow(context.Background(), model, longConversation())
+	if err != nil {
+		t.Fatalf("fitContextWindow() error = %v", err)
+	}
+	if summarizer.calls != 1 || !strings.Contains(summarizer.request, "earlier words") {
+		t.Errorf("summary model called %d times with %q", summarizer.calls, summarizer.request)
+	}
+	roles := requestRoles(t, fitted)
+	if len(roles) < 3 || roles[0] != "system" || roles[1] != "system" {
+		t.Fatalf("roles = %v, want the summary after the system prompt", roles)
+	}
+	if !strings.Contains(fitted, "They discussed earlier words.") || !strings.Contains(fitted, "final question") {
+		t.Errorf("summarized request = %s", fitted)
+	}
+
+	// Without a summary the messages are trimmed
+	summarizer.status = http.StatusInternalServerError
+	fitted, err = s.fitContextWindow(context.Background(), model, longConversation())
+	if err != nil || strings.Contains(fitted, "Summary of the earlier conversation") {
+		t.Errorf("fitContextWindow() = %s, %v; want the trimmed request", fitted, err)
+	}
+}
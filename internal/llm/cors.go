@@ -0,0 +1,82 @@
+package llm
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCORSAllowedHeaders are the request headers browsers may send
+// without CORS_ALLOWED_HEADERS: those of the OpenAI and Azure SDKs
+var defaultCORSAllowedHeaders = []string{
+	"Authorization", "Content-Type", "api-key", "OpenAI-Organization", "OpenAI-Beta",
+	"X-Request-ID", "X-Request-Timeout",
+	"X-Stainless-Arch", "X-Stainless-Lang", "X-Stainless-OS", "X-Stainless-Package-Version",
+	"X-Stainless-Retry-Count", "X-Stainless-Runtime", "X-Stainless-Runtime-Version",
+}
+
+// corsExposedHeaders are the response headers browser clients may read
+var corsExposedHeaders = []string{
+	"Retry-After", "X-Cache", "X-LLM-Token-Expired", "X-Request-ID",
+	"x-ratelimit-limit-requests", "x-ratelimit-remaining-requests", "x-ratelimit-reset-requests",
+	"x-ratelimit-limit-tokens", "x-ratelimit-remaining-tokens", "x-ratelimit-reset-tokens",
+}
+
+// corsMethods are the methods of the OpenAI-compatible routes
+const corsMethods = "GET, POST, DELETE, OPTIONS"
+
+// allowsOrigin reports whether a browser origin may call the proxy. An
+// entry of "*" allows every origin.
+func (c *Config) allowsOrigin(origin string) bool {
+	for _, allowed := range c.CORSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS wraps an OpenAI-compatible handler with the CORS policy of
+// CORS_ALLOWED_ORIGINS. Preflight requests from allowed origins are
+// answered with 204, from other origins with 403; actual requests get the
+// CORS response headers when their origin is allowed. Without allowed
+// origins the handler is unchanged.
+func (s *ServerState) withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := s.Service.config
+		origin := r.Header.Get("Origin")
+		if len(config.CORSAllowedOrigins) == 0 || origin == "" {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := config.allowsOrigin(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if !allowed {
+				writeOpenAIError(w, http.StatusForbidden, "origin not allowed", "permission_error")
+				return
+			}
+			headers := config.CORSAllowedHeaders
+			if len(headers) == 0 {
+				headers = defaultCORSAllowedHeaders
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			if config.CORSMaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.CORSMaxAge/time.Second)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,76 @@
+package llm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	state := &ServerState{Service: &Service{config: &Config{
+		CORSAllowedOrigins: []string{"https://chat.example.com"},
+		CORSMaxAge:         time.Hour,
+	}}}
+	handler := state.withCORS(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	serve := func(method, origin string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/v1/chat/completions", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	preflight := http.Header{"Access-Control-Request-Method": {"POST"}}
+
+	t.Run("preflight from allowed origin", func(t *testing.T) {
+		w := serve(http.MethodOptions, "https://chat.example.com", preflight)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("status = %d, want 204", w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://chat.example.com" {
+			t.Errorf("Access-Control-Allow-Origin = %q", got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Authorization") {
+			t.Errorf("Access-Control-Allow-Headers = %q, want Authorization allowed", got)
+		}
+		if got := w.Header().Get("Access-Control-Max-Age"); got != "3600" {
+			t.Errorf("Access-Control-Max-Age = %q, want 3600", got)
+		}
+	})
+
+	t.Run("preflight from other origin", func(t *testing.T) {
+		w := serve(http.MethodOptions, "https://evil.example.com", preflight)
+		if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("status = %d, headers = %v, want 403 without CORS headers", w.Code, w.Header())
+		}
+	})
+
+	t.Run("actual request", func(t *testing.T) {
+		w := serve(http.MethodPost, "https://chat.example.com", nil)
+		if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://chat.example.com" {
+			t.Errorf("status = %d, headers = %v", w.Code, w.Header())
+		}
+		if !strings.Contains(w.Header().Get("Access-Control-Expose-Headers"), "x-ratelimit-remaining-requests") {
+			t.Errorf("rate limit headers are not exposed: %v", w.Header())
+		}
+		if w := serve(http.MethodPost, "https://evil.example.com", nil); w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("other origin got CORS headers: %v", w.Header())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		state.Service.config.CORSAllowedOrigins = nil
+		w := serve(http.MethodOptions, "https://chat.example.com", preflight)
+		if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("status = %d, headers = %v, want the handler without CORS", w.Code, w.Header())
+		}
+	})
+}
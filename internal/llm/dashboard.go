@@ -0,0 +1,258 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// activityMinutes is how many minutes of request counts the dashboard shows
+const activityMinutes = 60
+
+// maxRecentErrors is how many failed requests the dashboard keeps
+const maxRecentErrors = 50
+
+// maxErrorBodyBytes bounds how much of an error response is kept to read its
+// message
+const maxErrorBodyBytes = 4096
+
+// RecentError is a request the proxy answered with an error status
+type RecentError struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Message   string    `json:"message"`
+}
+
+// ThroughputPoint counts the requests finished in one minute, which starts
+// at the Unix time Minute
+type ThroughputPoint struct {
+	Minute   int64 `json:"minute"`
+	Requests int   `json:"requests"`
+	Errors   int   `json:"errors"`
+}
+
+// activityLog counts the requests of the last hour per minute and keeps the
+// most recent errors, in memory only
+type activityLog struct {
+	mu      sync.Mutex
+	minutes [activityMinutes]ThroughputPoint
+	errors  []RecentError
+}
+
+// record counts a finished request; failed is the request's error, if any
+func (l *activityLog) record(now time.Time, failed *RecentError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	minute := now.Unix() / 60 * 60
+	point := &l.minutes[minute/60%activityMinutes]
+	if point.Minute != minute {
+		*point = ThroughputPoint{Minute: minute}
+	}
+	point.Requests++
+	if failed == nil {
+		return
+	}
+	point.Errors++
+	if len(l.errors) == maxRecentErrors {
+		l.errors = append(l.errors[:0], l.errors[1:]...)
+	}
+	l.errors = append(l.errors, *failed)
+}
+
+// throughput returns the request counts of the last hour, oldest first.
+// Minutes without requests are included with zero counts.
+func (l *activityLog) throughput(now time.Time) []ThroughputPoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := now.Unix() / 60 * 60
+	points := make([]ThroughputPoint, 0, activityMinutes)
+	for minute := current - (activityMinutes-1)*60; minute <= current; minute += 60 {
+		point := l.minutes[minute/60%activityMinutes]
+		if point.Minute != minute {
+			point = ThroughputPoint{Minute: minute}
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// recentErrors returns the kept errors, newest first
+func (l *activityLog) recentErrors() []RecentError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := make([]RecentError, len(l.errors))
+	for i, e := range l.errors {
+		recent[len(l.errors)-1-i] = e
+	}
+	return recent
+}
+
+// activityWriter records the status of a response and the start of an
+// error response's body
+type activityWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (w *activityWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *activityWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && len(w.body) < maxErrorBodyBytes {
+		n := len(b)
+		if n > maxErrorBodyBytes-len(w.body) {
+			n = maxErrorBodyBytes - len(w.body)
+		}
+		w.body = append(w.body, b[:n]...)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes of streamed responses through
+func (w *activityWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// errorMessage returns the message of an OpenAI-style error body, or the
+// body itself
+func (w *activityWriter) errorMessage() string {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(w.body, &body) == nil && body.Error.Message != "" {
+		return body.Error.Message
+	}
+	return strings.TrimSpace(string(w.body))
+}
+
+// withActivity wraps a handler so its requests are counted for the admin
+// dashboard, its error responses kept as recent errors and its start and end
+// published to the admin event stream
+func (s *ServerState) withActivity(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := RequestIDFromContext(r.Context())
+		s.publish(Event{Type: EventRequestStarted, Time: start, RequestID: requestID, Method: r.Method, Path: r.URL.Path})
+		aw := &activityWriter{ResponseWriter: w}
+		next(aw, r)
+		now := time.Now()
+		finished := Event{
+			Type:       EventRequestFinished,
+			Time:       now,
+			RequestID:  requestID,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     aw.status,
+			DurationMs: now.Sub(start).Milliseconds(),
+		}
+		if aw.status < 400 {
+			s.activity.record(now, nil)
+			s.publish(finished)
+			return
+		}
+		finished.Message = aw.errorMessage()
+		s.activity.record(now, &RecentError{
+			Time:      now,
+			RequestID: requestID,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    aw.status,
+			Message:   finished.Message,
+		})
+		if aw.status == http.StatusTooManyRequests {
+			limited := finished
+			limited.Type = EventRateLimitHit
+			limited.DurationMs = 0
+			s.publish(limited)
+		}
+		s.publish(finished)
+	}
+}
+
+// publish sends an event to the admin event stream
+func (s *ServerState) publish(event Event) {
+	if s.Service != nil {
+		s.Service.events.publish(event)
+	}
+}
+
+// DashboardStats is the data shown by the admin dashboard
+type DashboardStats struct {
+	Time          time.Time               `json:"time"`
+	ActiveStreams int                     `json:"active_streams"`
+	ActiveUsers   models.ActiveUserCount  `json:"active_users"`
+	Throughput    []ThroughputPoint       `json:"throughput"`
+	UsageWindow   string                  `json:"usage_window"`
+	Usage         []models.UsageAggregate `json:"usage"`
+	KeyExpiresAt  *time.Time              `json:"key_expires_at,omitempty"`
+	Accounts      []CopilotAccountStatus  `json:"accounts"`
+	RecentErrors  []RecentError           `json:"recent_errors"`
+}
+
+// HandleDashboardStats serves GET /admin/ui/stats with the request
+// throughput of the last hour, the token usage per key and model over the
+// window query parameter (1h, 24h (default), 7d or 30d), when the Copilot
+// API keys expire and the most recent errors. Callers must protect the
+// handler with the admin token.
+func (s *ServerState) HandleDashboardStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "24h"
+	}
+	duration, ok := usageWindows[window]
+	if !ok {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid window: "+window, "invalid_request_error")
+		return
+	}
+
+	now := time.Now()
+	usage, err := s.Service.UsageStats(now.Add(-duration), "")
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "failed to read usage: "+err.Error(), "internal_error")
+		return
+	}
+	activeUsers, err := s.Service.ActiveUsers()
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "failed to read usage: "+err.Error(), "internal_error")
+		return
+	}
+	stats := DashboardStats{
+		Time:          now,
+		ActiveStreams: s.ActiveStreams(),
+		ActiveUsers:   activeUsers,
+		Throughput:    s.activity.throughput(now),
+		UsageWindow:   window,
+		Usage:         usage,
+		Accounts:      s.Service.CopilotAccounts(),
+		RecentErrors:  s.activity.recentErrors(),
+	}
+	if exp, ok := apiKeyExpiry(s.Service.config.APIKey()); ok {
+		stats.KeyExpiresAt = &exp
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,93 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActivityLog(t *testing.T) {
+	var l activityLog
+	now := time.Unix(1700000000, 0)
+	l.record(now.Add(-2*time.Hour), nil) // outside the window
+	l.record(now.Add(-time.Minute), nil)
+	l.record(now, nil)
+	l.record(now, &RecentError{Status: 500, Message: "boom"})
+
+	points := l.throughput(now)
+	if len(points) != activityMinutes {
+		t.Fatalf("throughput() has %d points, want %d", len(points), activityMinutes)
+	}
+	last, previous := points[len(points)-1], points[len(points)-2]
+	if last.Minute != now.Unix()/60*60 || last.Requests != 2 || last.Errors != 1 || previous.Requests != 1 {
+		t.Errorf("last points = %+v, %+v", previous, last)
+	}
+	total := 0
+	for _, p := range points {
+		total += p.Requests
+	}
+	if total != 3 {
+		t.Errorf("requests in the last hour = %d, want 3", total)
+	}
+
+	for i := 0; i < maxRecentErrors+5; i++ {
+		l.record(now, &RecentError{Message: fmt.Sprint(i)})
+	}
+	recent := l.recentErrors()
+	if len(recent) != maxRecentErrors || recent[0].Message != fmt.Sprint(maxRecentErrors+4) {
+		t.Errorf("recentErrors() = %d errors starting with %+v", len(recent), recent[0])
+	}
+}
+
+func TestHandleDashboardStats(t *testing.T) {
+	state := &ServerState{Service: &Service{
+		config: &Config{CopilotAPIKey: fmt.Sprintf("tid=a;exp=%d", time.Now().Add(time.Hour).Unix())},
+		usage:  newUsageLedger(),
+	}}
+	state.Service.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 10, Output: 5})
+
+	// Requests through route are counted, and errors kept with their message
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", state.route(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }))
+	mux.HandleFunc("/fail", state.route(func(w http.ResponseWriter, r *http.Request) {
+		writeOpenAIError(w, http.StatusBadGateway, "upstream failed", "api_error")
+	}))
+	for _, path := range []string{"/ok", "/ok", "/fail"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	state.HandleDashboardStats(w, httptest.NewRequest("GET", "/admin/ui/stats?window=1h", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	var stats DashboardStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	last := stats.Throughput[len(stats.Throughput)-1]
+	if last.Requests != 3 || last.Errors != 1 {
+		t.Errorf("last minute = %+v, want 3 requests and 1 error", last)
+	}
+	if len(stats.RecentErrors) != 1 || stats.RecentErrors[0].Message != "upstream failed" ||
+		stats.RecentErrors[0].Path != "/fail" || stats.RecentErrors[0].RequestID == "" {
+		t.Errorf("recent errors = %+v", stats.RecentErrors)
+	}
+	if len(stats.Usage) != 1 || stats.Usage[0].TotalTokens != 15 || stats.UsageWindow != "1h" {
+		t.Errorf("usage = %+v", stats.Usage)
+	}
+	if stats.KeyExpiresAt == nil || time.Until(*stats.KeyExpiresAt) < 59*time.Minute {
+		t.Errorf("key_expires_at = %v", stats.KeyExpiresAt)
+	}
+
+	w = httptest.NewRecorder()
+	state.HandleDashboardStats(w, httptest.NewRequest("GET", "/admin/ui/stats?window=soon", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid window") {
+		t.Errorf("invalid window status = %d", w.Code)
+	}
+}
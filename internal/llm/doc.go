@@ -42,12 +42,21 @@ The typical request flow through the system is:
 
 # Provider Integration
 
-The system supports multiple LLM providers:
-
-- GitHub Copilot Chat API
-- OpenAI API (for GPT models)
-- Anthropic API (for Claude models)
-- Google AI API (for Gemini models)
+Completions and model listing go through the Provider interface. The
+GitHub Copilot Chat API is built in; the OpenAI API is registered when
+OPENAI_API_KEY is set and serves the selected OpenAI models that Copilot
+does not offer, and the Anthropic Messages API is registered when
+ANTHROPIC_API_KEY is set and serves the claude-* models, translating
+requests and streams from and to the OpenAI format. Further backends are
+added with Service.RegisterProvider.
+
+# Middleware
+
+Programs embedding the package can log, redact or rewrite chat completions
+without forking by registering hooks on the ServerState:
+UseRequestMutator runs on every decoded request, UseResponseFilter on every
+non-streaming response and UseChunkTransformer on every chunk of a
+streaming response. Hooks run in registration order.
 
 # GitHub Copilot Integration
 
@@ -60,8 +69,8 @@ For GitHub Copilot requests, the service:
 
 2. Formats requests to match Copilot API requirements with appropriate headers:
   - X-GitHub-API-Version: 2025-04-01
-  - Editor-Version: vscode/1.99.2
-  - Editor-Plugin-Version: copilot-chat/0.26.3
+  - Editor-Version: the installed VS Code version, e.g. vscode/1.99.2
+  - Editor-Plugin-Version: the installed Copilot Chat version, e.g. copilot-chat/0.26.3
 
 3. Handles token refreshing when the current token expires
   - Automatically retries with a fresh token on 401 responses
@@ -80,6 +89,9 @@ Rate limiting occurs at multiple levels:
 3. Per-user, per-day token limits
 4. Dynamic adjustment based on active user counts
 
+A global quota (GLOBAL_REQUESTS_PER_MINUTE, GLOBAL_TOKENS_PER_MINUTE) is
+shared evenly among the keys active within ACTIVE_USER_WINDOW.
+
 The rate limits are designed to:
 - Prevent abuse and excessive usage
 - Ensure fair resource allocation among users
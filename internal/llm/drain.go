@@ -0,0 +1,154 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// abortWait bounds how long Shutdown waits for aborted streams to send their
+// final event and return
+const abortWait = 5 * time.Second
+
+// trackedStream is an SSE response in progress
+type trackedStream struct {
+	// abort stops the stream, typically by closing its upstream body
+	abort   func()
+	aborted bool
+}
+
+// streamTracker keeps track of active SSE streams so that shutdown can wait
+// for them to finish instead of cutting them off
+type streamTracker struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	active   map[*trackedStream]struct{}
+}
+
+// begin registers a stream that abort stops. It returns false once the
+// server is shutting down.
+func (t *streamTracker) begin(abort func()) (*trackedStream, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return nil, false
+	}
+	if t.active == nil {
+		t.active = make(map[*trackedStream]struct{})
+	}
+	stream := &trackedStream{abort: abort}
+	t.active[stream] = struct{}{}
+	t.wg.Add(1)
+	return stream, true
+}
+
+// end unregisters a finished stream
+func (t *streamTracker) end(stream *trackedStream) {
+	t.mu.Lock()
+	delete(t.active, stream)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// wasAborted reports whether shutdown aborted the stream
+func (t *streamTracker) wasAborted(stream *trackedStream) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return stream.aborted
+}
+
+// count returns the number of active streams
+func (t *streamTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.active)
+}
+
+// drain refuses new streams and waits until the active ones finish or ctx is
+// done. Streams still running then are aborted; it returns their number.
+func (t *streamTracker) drain(ctx context.Context) int {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	aborted := 0
+	for stream := range t.active {
+		if !stream.aborted {
+			stream.aborted = true
+			stream.abort()
+			aborted++
+		}
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(abortWait):
+	}
+	return aborted
+}
+
+// ActiveStreams returns the number of SSE responses currently streaming
+func (s *ServerState) ActiveStreams() int {
+	return s.streams.count()
+}
+
+// Shutdown stops accepting new streams and waits for the active ones to
+// finish until ctx is done. Streams still running then receive a final SSE
+// error event and are closed. It returns the number of aborted streams.
+// Admin event streams are closed right away.
+func (s *ServerState) Shutdown(ctx context.Context) int {
+	s.Service.events.close()
+	return s.streams.drain(ctx)
+}
+
+// writeSSEError writes an OpenAI-style error as a final SSE event
+func writeSSEError(w http.ResponseWriter, message, errType, code string) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+			"param":   nil,
+			"code":    code,
+		},
+	})
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// beginStream registers a streaming response whose upstream body is reader.
+// While the server shuts down it writes a 503 error and returns false.
+func (s *ServerState) beginStream(w http.ResponseWriter, reader interface{ Close() error }) (*trackedStream, bool) {
+	stream, ok := s.streams.begin(func() { reader.Close() })
+	if !ok {
+		writeOpenAIErrorCode(w, http.StatusServiceUnavailable, "server is shutting down", "server_error", "server_shutting_down")
+	}
+	return stream, ok
+}
+
+// endStream unregisters a stream, first sending the final error event if
+// shutdown aborted it
+func (s *ServerState) endStream(w http.ResponseWriter, stream *trackedStream) {
+	if s.streams.wasAborted(stream) {
+		writeSSEError(w, "server is shutting down; the response was cut short", "server_error", "server_shutting_down")
+	}
+	s.streams.end(stream)
+}
@@ -0,0 +1,105 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBlockingUpstream returns a test server that sends one SSE chunk and
+// finishes the stream only once release is closed
+func newBlockingUpstream(release <-chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		case <-r.Context().Done():
+		}
+	}))
+}
+
+// startStream runs a streaming completion in the background and waits until
+// it is registered as active
+func startStream(t *testing.T, state *ServerState) (*httptest.ResponseRecorder, <-chan struct{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+		state.HandleCompletion(w, req)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for state.ActiveStreams() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return w, done
+}
+
+func TestShutdownWaitsForStreams(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	release := make(chan struct{})
+	upstream := newBlockingUpstream(release)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+
+	w, done := startStream(t, state)
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if aborted := state.Shutdown(ctx); aborted != 0 {
+		t.Errorf("Shutdown() aborted %d streams, want 0", aborted)
+	}
+	<-done
+	if body := w.Body.String(); !strings.Contains(body, "[DONE]") || strings.Contains(body, "server_shutting_down") {
+		t.Errorf("drained stream body = %q", body)
+	}
+
+	// New streams are refused while shutting down
+	rejected := httptest.NewRecorder()
+	state.HandleCompletion(rejected, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`)))
+	if rejected.Code != http.StatusServiceUnavailable {
+		t.Errorf("stream during shutdown status = %d, want 503", rejected.Code)
+	}
+}
+
+func TestShutdownAbortsStreams(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	release := make(chan struct{})
+	defer close(release)
+	upstream := newBlockingUpstream(release)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+
+	w, done := startStream(t, state)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if aborted := state.Shutdown(ctx); aborted != 1 {
+		t.Errorf("Shutdown() aborted %d streams, want 1", aborted)
+	}
+	<-done
+	body := w.Body.String()
+	if !strings.Contains(body, `"content":"hi"`) || !strings.Contains(body, `"code":"server_shutting_down"`) {
+		t.Errorf("aborted stream body = %q", body)
+	}
+	if state.ActiveStreams() != 0 {
+		t.Errorf("ActiveStreams() after shutdown = %d", state.ActiveStreams())
+	}
+}
@@ -0,0 +1,237 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/internal/accesslog"
+	"copilot-proxy/pkg/models"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// CopilotEmbeddingsURL is the endpoint for creating embeddings
+const CopilotEmbeddingsURL = "/embeddings"
+
+// defaultEmbeddingCacheTTL is used when EMBEDDING_CACHE_TTL is unset or invalid
+const defaultEmbeddingCacheTTL = 24 * time.Hour
+
+// embeddingOptions are the request parameters that change the returned
+// vectors, so they are forwarded and part of the cache key
+var embeddingOptions = []string{"dimensions", "encoding_format"}
+
+// embeddingCache holds embedding vectors keyed by embeddingCacheKey
+type embeddingCache = lruCache[json.RawMessage]
+
+// newEmbeddingCache creates an embedding cache holding at most size
+// vectors, or returns nil (caching disabled) if size is not positive.
+func newEmbeddingCache(size int, ttl time.Duration) *embeddingCache {
+	if ttl <= 0 {
+		ttl = defaultEmbeddingCacheTTL
+	}
+	return newLRUCache[json.RawMessage](size, ttl)
+}
+
+// embeddingCacheKey hashes the model, the options and one input
+func embeddingCacheKey(model string, options map[string]interface{}, input interface{}) string {
+	// json.Marshal sorts map keys, so equal requests hash identically
+	data, _ := json.Marshal(map[string]interface{}{"model": model, "options": options, "input": input})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// embeddingInputs splits the input of an embeddings request into its items.
+// The input is a string, an array of strings, an array of token IDs or an
+// array of token ID arrays.
+func embeddingInputs(input interface{}) ([]interface{}, error) {
+	switch v := input.(type) {
+	case string:
+		return []interface{}{v}, nil
+	case []interface{}:
+		if len(v) == 0 {
+			return nil, errors.New("input must not be empty")
+		}
+		if _, ok := v[0].(float64); ok {
+			return []interface{}{v}, nil
+		}
+		for _, item := range v {
+			switch item.(type) {
+			case string, []interface{}:
+			default:
+				return nil, errors.New("input must be a string, an array of strings or an array of token arrays")
+			}
+		}
+		return v, nil
+	}
+	return nil, errors.New("input must be a string or an array")
+}
+
+// createEmbeddings requests the embeddings of inputs from the Copilot API
+// and returns their vectors in input order and the prompt tokens used
+func (s *Service) createEmbeddings(ctx context.Context, model string, options map[string]interface{}, inputs []interface{}) ([]json.RawMessage, int, error) {
+	request := map[string]interface{}{"model": model, "input": inputs}
+	for key, value := range options {
+		request[key] = value
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	resp, err := s.copilotRequest(ctx, "copilot.embeddings", CopilotEmbeddingsURL, "conversation-agent", body)
+	if err != nil {
+		s.publishUpstreamError(ctx, models.ProviderCopilot, model, nil, err)
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.publishUpstreamError(ctx, models.ProviderCopilot, model, resp, nil)
+		body, _ := io.ReadAll(resp.Body)
+		return nil, 0, newUpstreamError(resp, body)
+	}
+
+	var out struct {
+		Data []struct {
+			Index     int             `json:"index"`
+			Embedding json.RawMessage `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, 0, wrapTransportError(fmt.Errorf("failed to decode embeddings response: %w", err))
+	}
+	if len(out.Data) != len(inputs) {
+		return nil, 0, wrapTransportError(fmt.Errorf("embeddings response has %d vectors for %d inputs", len(out.Data), len(inputs)))
+	}
+	sort.Slice(out.Data, func(i, j int) bool { return out.Data[i].Index < out.Data[j].Index })
+	vectors := make([]json.RawMessage, len(out.Data))
+	for i, d := range out.Data {
+		vectors[i] = d.Embedding
+	}
+	return vectors, out.Usage.PromptTokens, nil
+}
+
+// HandleEmbeddings handles the OpenAI embeddings endpoint by forwarding the
+// request to the Copilot API. With EMBEDDING_CACHE_SIZE set, vectors are
+// cached per model, options and input, and only the inputs that miss the
+// cache are sent upstream and count against rate limits and budgets.
+func (s *ServerState) HandleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	token, err := s.validateToken(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	release, err := s.Service.acquireRequestSlot(token.UserID)
+	if err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+	defer release()
+
+	bodyBytes, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+	var request map[string]interface{}
+	if err := json.Unmarshal(bodyBytes, &request); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), "invalid_request_error")
+		return
+	}
+	model, _ := request["model"].(string)
+	if model == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "model is required", "invalid_request_error")
+		return
+	}
+	model = s.Service.config.ResolveModel(model)
+	accesslog.SetModel(r.Context(), model)
+	if err := AuthorizeAccessToModel(token, models.ProviderCopilot, model); err != nil {
+		writeOpenAIError(w, http.StatusForbidden, err.Error(), "permission_error")
+		return
+	}
+	inputs, err := embeddingInputs(request["input"])
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	options := make(map[string]interface{})
+	for _, key := range embeddingOptions {
+		if value, ok := request[key]; ok {
+			options[key] = value
+		}
+	}
+
+	cache := s.Service.embeddingCache
+	vectors := make([]json.RawMessage, len(inputs))
+	keys := make([]string, len(inputs))
+	var missing []int
+	for i, input := range inputs {
+		if cache != nil {
+			keys[i] = embeddingCacheKey(model, options, input)
+			if vector, ok := cache.get(keys[i]); ok {
+				vectors[i] = vector
+				continue
+			}
+		}
+		missing = append(missing, i)
+	}
+
+	promptTokens := 0
+	if len(missing) > 0 {
+		if err := s.Service.checkBudget(token.UserID); err != nil {
+			writeCompletionError(w, err)
+			return
+		}
+		if err := s.Service.checkKeyRateLimit(token.UserID); err != nil {
+			writeCompletionError(w, err)
+			return
+		}
+		batch := make([]interface{}, len(missing))
+		for j, i := range missing {
+			batch[j] = inputs[i]
+		}
+		fetched, tokens, err := s.Service.createEmbeddings(withTenant(r.Context(), token.Tenant), model, options, batch)
+		if err != nil {
+			logRequestf(r.Context(), "Embeddings for %s failed: %v", model, err)
+			writeCompletionError(w, err)
+			return
+		}
+		for j, i := range missing {
+			vectors[i] = fetched[j]
+			if cache != nil {
+				cache.put(keys[i], fetched[j])
+			}
+		}
+		promptTokens = tokens
+		s.Service.recordUsage(token.UserID, model, models.TokenUsage{Input: tokens}, 0)
+	}
+	if cache != nil {
+		if len(missing) == 0 {
+			w.Header().Set("X-Cache", "HIT")
+		} else {
+			w.Header().Set("X-Cache", "MISS")
+		}
+	}
+
+	data := make([]map[string]interface{}, len(vectors))
+	for i, vector := range vectors {
+		data[i] = map[string]interface{}{"object": "embedding", "index": i, "embedding": vector}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   data,
+		"model":  model,
+		"usage":  map[string]interface{}{"prompt_tokens": promptTokens, "total_tokens": promptTokens},
+	})
+}
@@ -0,0 +1,102 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleEmbeddingsCache(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	var upstreamInputs [][]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != CopilotEmbeddingsURL {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Input []interface{} `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		upstreamInputs = append(upstreamInputs, req.Input)
+		var data []string
+		for i, input := range req.Input {
+			data = append(data, fmt.Sprintf(`{"object":"embedding","index":%d,"embedding":[%d]}`, i, len(fmt.Sprint(input))))
+		}
+		fmt.Fprintf(w, `{"object":"list","data":[%s],"usage":{"prompt_tokens":%d}}`, strings.Join(data, ","), 2*len(req.Input))
+	}))
+	defer server.Close()
+	state := newTestServerState(server)
+	state.Service.embeddingCache = newEmbeddingCache(10, time.Hour)
+
+	embed := func(input string) (*httptest.ResponseRecorder, []string) {
+		w := httptest.NewRecorder()
+		state.HandleEmbeddings(w, httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model":"text-embedding-3-small","input":`+input+`}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		var out struct {
+			Data []struct {
+				Index     int             `json:"index"`
+				Embedding json.RawMessage `json:"embedding"`
+			} `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&out)
+		var vectors []string
+		for i, d := range out.Data {
+			if d.Index != i {
+				t.Errorf("data[%d].index = %d", i, d.Index)
+			}
+			vectors = append(vectors, string(d.Embedding))
+		}
+		return w, vectors
+	}
+
+	w, vectors := embed(`["a", "bbb"]`)
+	if strings.Join(vectors, " ") != "[1] [3]" || w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("first request: vectors %v, X-Cache %q", vectors, w.Header().Get("X-Cache"))
+	}
+	w, vectors = embed(`["bbb", "cc", "a"]`)
+	if strings.Join(vectors, " ") != "[3] [2] [1]" {
+		t.Errorf("second request: vectors %v", vectors)
+	}
+	if len(upstreamInputs) != 2 || len(upstreamInputs[1]) != 1 || upstreamInputs[1][0] != "cc" {
+		t.Errorf("upstream inputs = %v, want only the uncached input forwarded", upstreamInputs)
+	}
+	w, _ = embed(`"a"`)
+	if w.Header().Get("X-Cache") != "HIT" || len(upstreamInputs) != 2 {
+		t.Errorf("cached request: X-Cache %q, %d upstream calls", w.Header().Get("X-Cache"), len(upstreamInputs))
+	}
+	var usage struct {
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
+	}
+	json.NewDecoder(w.Body).Decode(&usage)
+	if usage.Usage.PromptTokens != 0 {
+		t.Errorf("cached request billed %d prompt tokens", usage.Usage.PromptTokens)
+	}
+}
+
+func TestEmbeddingInputs(t *testing.T) {
+	for input, want := range map[string]int{`"text"`: 1, `["a","b"]`: 2, `[1,2,3]`: 1, `[[1,2],[3]]`: 2} {
+		var v interface{}
+		json.Unmarshal([]byte(input), &v)
+		if items, err := embeddingInputs(v); err != nil || len(items) != want {
+			t.Errorf("embeddingInputs(%s) = %v, %v; want %d items", input, items, err, want)
+		}
+	}
+	for _, input := range []string{`[]`, `42`, `[{"a":1}]`} {
+		var v interface{}
+		json.Unmarshal([]byte(input), &v)
+		if _, err := embeddingInputs(v); err == nil {
+			t.Errorf("embeddingInputs(%s) accepted invalid input", input)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of the events streamed by HandleEvents
+const (
+	EventRequestStarted  = "request.started"
+	EventRequestFinished = "request.finished"
+	EventRateLimitHit    = "rate_limit.hit"
+	EventUpstreamError   = "upstream.error"
+)
+
+// eventTypes are the known event types
+var eventTypes = map[string]bool{
+	EventRequestStarted:  true,
+	EventRequestFinished: true,
+	EventRateLimitHit:    true,
+	EventUpstreamError:   true,
+}
+
+// eventBuffer is how many events a subscriber may fall behind before further
+// events are dropped for it
+const eventBuffer = 256
+
+// Event is something that happened while serving a request
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Provider   string    `json:"provider,omitempty"`
+	Model      string    `json:"model,omitempty"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// eventSubscriber receives published events until it unsubscribes
+type eventSubscriber struct {
+	events chan Event
+	// dropped counts the events the subscriber was too slow to receive
+	dropped int
+}
+
+// eventHub fans events out to the subscribers of the admin event stream.
+// Publishing never blocks: events a subscriber has no room for are dropped.
+type eventHub struct {
+	mu          sync.Mutex
+	closed      bool
+	subscribers map[*eventSubscriber]struct{}
+}
+
+// subscribe adds a subscriber. It returns false once the hub is closed.
+func (h *eventHub) subscribe() (*eventSubscriber, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, false
+	}
+	if h.subscribers == nil {
+		h.subscribers = make(map[*eventSubscriber]struct{})
+	}
+	sub := &eventSubscriber{events: make(chan Event, eventBuffer)}
+	h.subscribers[sub] = struct{}{}
+	return sub, true
+}
+
+// unsubscribe removes a subscriber and closes its channel
+func (h *eventHub) unsubscribe(sub *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// takeDropped returns and resets the number of events dropped for sub
+func (h *eventHub) takeDropped(sub *eventSubscriber) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dropped := sub.dropped
+	sub.dropped = 0
+	return dropped
+}
+
+// publish sends an event to every subscriber
+func (h *eventHub) publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subscribers) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// close ends the streams of all subscribers and refuses new ones
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// publishUpstreamError publishes a failed upstream call of a request, which
+// either returned the error status of resp or err
+func (s *Service) publishUpstreamError(ctx context.Context, provider models.LanguageModelProvider, model string, resp *http.Response, err error) {
+	event := Event{
+		Type:      EventUpstreamError,
+		RequestID: RequestIDFromContext(ctx),
+		Provider:  string(provider),
+		Model:     model,
+	}
+	if err != nil {
+		event.Message = err.Error()
+	} else {
+		event.Status = resp.StatusCode
+		event.Message = resp.Status
+	}
+	s.events.publish(event)
+}
+
+// HandleEvents serves GET /admin/events, a server-sent event stream of what
+// happens while requests are served: request.started, request.finished,
+// rate_limit.hit and upstream.error. The type query parameter, repeated or
+// comma-separated, selects the types to stream. Events a client is too slow
+// to receive are dropped and counted in an SSE comment. Callers must protect
+// the handler with the admin token.
+func (s *ServerState) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	var types map[string]bool
+	for _, param := range r.URL.Query()["type"] {
+		for _, t := range strings.Split(param, ",") {
+			t = strings.TrimSpace(t)
+			if t == "" {
+				continue
+			}
+			if !eventTypes[t] {
+				writeOpenAIError(w, http.StatusBadRequest, "unknown event type: "+t, "invalid_request_error")
+				return
+			}
+			if types == nil {
+				types = make(map[string]bool)
+			}
+			types[t] = true
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOpenAIError(w, http.StatusInternalServerError, "streaming is not supported", "internal_error")
+		return
+	}
+	hub := &s.Service.events
+	sub, ok := hub.subscribe()
+	if !ok {
+		writeOpenAIErrorCode(w, http.StatusServiceUnavailable, "server is shutting down", "server_error", "server_shutting_down")
+		return
+	}
+	defer hub.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var heartbeat <-chan time.Time
+	if interval := s.Service.config.SSEKeepaliveInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat:
+			w.Write(sseHeartbeat)
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if dropped := hub.takeDropped(sub); dropped > 0 {
+				fmt.Fprintf(w, ": %d events dropped\n\n", dropped)
+			}
+			if types != nil && !types[event.Type] {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,132 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventHub(t *testing.T) {
+	var h eventHub
+	h.publish(Event{Type: EventRequestStarted}) // no subscribers
+
+	sub, ok := h.subscribe()
+	if !ok {
+		t.Fatal("subscribe() failed")
+	}
+	for i := 0; i < eventBuffer+3; i++ {
+		h.publish(Event{Type: EventRequestStarted})
+	}
+	if len(sub.events) != eventBuffer || h.takeDropped(sub) != 3 || h.takeDropped(sub) != 0 {
+		t.Errorf("subscriber has %d events, want %d and 3 dropped", len(sub.events), eventBuffer)
+	}
+	if event := <-sub.events; event.Time.IsZero() {
+		t.Error("published event has no time")
+	}
+
+	h.close()
+	for range sub.events {
+	}
+	if _, ok := h.subscribe(); ok {
+		t.Error("subscribe() after close should fail")
+	}
+	h.unsubscribe(sub) // already closed
+}
+
+// readEvent reads the next SSE event of a stream, skipping comments
+func readEvent(t *testing.T, reader *bufio.Reader) Event {
+	t.Helper()
+	var name string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var event Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatalf("invalid event data %q: %v", line, err)
+			}
+			if event.Type != name {
+				t.Errorf("event %q has type %q", name, event.Type)
+			}
+			return event
+		}
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	state := &ServerState{Service: &Service{config: &Config{}}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/events", state.HandleEvents)
+	mux.HandleFunc("/limited", state.route(func(w http.ResponseWriter, r *http.Request) {
+		writeOpenAIError(w, http.StatusTooManyRequests, "slow down", "rate_limit_exceeded")
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/admin/events?type=bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown event type status = %d, want 400", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/admin/events?type=request.finished,rate_limit.hit&type=upstream.error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/limited", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	limited, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited.Body.Close()
+	state.Service.publishUpstreamError(context.Background(), "openai", "gpt-4o", nil, errors.New("connection refused"))
+
+	// request.started is filtered out
+	if event := readEvent(t, reader); event.Type != EventRateLimitHit || event.RequestID != "req-1" ||
+		event.Status != http.StatusTooManyRequests || event.Message != "slow down" {
+		t.Errorf("first event = %+v, want the rate limit hit", event)
+	}
+	if event := readEvent(t, reader); event.Type != EventRequestFinished || event.Path != "/limited" ||
+		event.Method != http.MethodPost || event.Status != http.StatusTooManyRequests {
+		t.Errorf("second event = %+v, want the finished request", event)
+	}
+	if event := readEvent(t, reader); event.Type != EventUpstreamError || event.Provider != "openai" ||
+		event.Model != "gpt-4o" || event.Message != "connection refused" {
+		t.Errorf("third event = %+v, want the upstream error", event)
+	}
+
+	// Shutdown ends the stream
+	done := make(chan struct{})
+	go func() {
+		reader.ReadString(0)
+		close(done)
+	}()
+	state.Shutdown(context.Background())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("event stream still open after Shutdown")
+	}
+}
@@ -0,0 +1,134 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// circuitBreakers track consecutive failures per provider. After a
+// provider fails CIRCUIT_BREAKER_THRESHOLD times in a row its breaker opens
+// for CIRCUIT_BREAKER_COOLDOWN, during which requests go straight to its
+// fallback; the first request after the cooldown tries the provider again.
+type circuitBreakers struct {
+	mu    sync.Mutex
+	state map[models.LanguageModelProvider]*breakerState
+}
+
+// breakerState is the failure count of a provider and when its breaker closes
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// isOpen reports whether a provider's breaker is open
+func (b *circuitBreakers) isOpen(provider models.LanguageModelProvider, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.state[provider]
+	return state != nil && now.Before(state.openUntil)
+}
+
+// record counts a provider's success or failure, opening its breaker once
+// threshold failures (0 = never) happened in a row
+func (b *circuitBreakers) record(provider models.LanguageModelProvider, failed bool, threshold int, cooldown time.Duration, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		delete(b.state, provider)
+		return
+	}
+	if b.state == nil {
+		b.state = make(map[models.LanguageModelProvider]*breakerState)
+	}
+	state := b.state[provider]
+	if state == nil {
+		state = &breakerState{}
+		b.state[provider] = state
+	}
+	state.failures++
+	if threshold > 0 && state.failures >= threshold {
+		if now.After(state.openUntil) {
+			log.Printf("Warning: %s failed %d times in a row, opening its circuit breaker for %s", provider, state.failures, cooldown)
+		}
+		state.openUntil = now.Add(cooldown)
+	}
+}
+
+// fallbackChain returns the provider followed by its registered fallbacks
+// from PROVIDER_FALLBACKS, e.g. copilot, openai, anthropic for
+// "copilot=openai,openai=anthropic"
+func (s *Service) fallbackChain(primary models.LanguageModelProvider) []models.LanguageModelProvider {
+	if primary == "" {
+		primary = models.ProviderCopilot
+	}
+	chain := []models.LanguageModelProvider{primary}
+	seen := map[models.LanguageModelProvider]bool{primary: true}
+	for name := primary; ; {
+		next := models.LanguageModelProvider(s.config.ProviderFallbacks[string(name)])
+		if next == "" || seen[next] {
+			return chain
+		}
+		seen[next] = true
+		if _, err := s.provider(next); err == nil {
+			chain = append(chain, next)
+		}
+		name = next
+	}
+}
+
+// streamWithFallback streams a completion from the model's provider. When
+// the provider answers 429 or 5xx, cannot be reached or has an open circuit
+// breaker, the request is sent for the same model to the next provider of
+// its fallback chain. All providers stream the OpenAI format, so clients
+// see the same response whichever provider served it. The last provider's
+// response or error is returned when all of them fail.
+func (s *Service) streamWithFallback(ctx context.Context, primary models.LanguageModelProvider, model, request string) (*http.Response, error) {
+	chain := s.fallbackChain(primary)
+	for i, name := range chain {
+		last := i == len(chain)-1
+		if !last && s.breakers.isOpen(name, time.Now()) {
+			logRequestf(ctx, "Circuit breaker of %s is open, sending %s to %s", name, model, chain[i+1])
+			continue
+		}
+		provider, err := s.provider(name)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := provider.Stream(ctx, model, request)
+		if err != nil || resp.StatusCode >= 400 {
+			s.publishUpstreamError(ctx, name, model, resp, err)
+		}
+		if ctx.Err() == nil {
+			s.recordUpstreamCall(model, start, resp, err)
+		}
+		failed := providerFailed(resp, err)
+		s.breakers.record(name, failed, s.config.CircuitBreakerThreshold, s.config.CircuitBreakerCooldown, time.Now())
+		if !failed || last || ctx.Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			logRequestf(ctx, "Warning: %s returned %d for %s, falling back to %s", name, resp.StatusCode, model, chain[i+1])
+			resp.Body.Close()
+		} else {
+			logRequestf(ctx, "Warning: %s failed for %s, falling back to %s: %v", name, model, chain[i+1], err)
+		}
+	}
+	// Unreachable: the last provider of the chain always returns
+	return nil, errors.New("no provider available")
+}
+
+// providerFailed reports whether a provider call failed in a way another
+// provider may not: the provider was unreachable, rate limited or broken.
+// Invalid requests are not retried elsewhere.
+func providerFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, ErrUpstreamUnavailable)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
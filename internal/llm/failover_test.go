@@ -0,0 +1,59 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestProviderFailover(t *testing.T) {
+	s := &Service{
+		config: &Config{
+			ProviderFallbacks:       map[string]string{"copilot": "openai", "openai": "anthropic", "anthropic": "copilot"},
+			CircuitBreakerThreshold: 2,
+			CircuitBreakerCooldown:  time.Minute,
+		},
+		usage: newUsageLedger(),
+	}
+	copilot := &fakeProvider{models: []models.LanguageModel{{ID: "gpt-4o"}}, status: http.StatusServiceUnavailable}
+	openai := &fakeProvider{stream: "data: {\"choices\":[{\"delta\":{\"content\":\"from openai\"}}]}\n\n"}
+	s.RegisterProvider(models.ProviderCopilot, copilot)
+	s.RegisterProvider(models.ProviderOpenAI, openai)
+
+	if chain := s.fallbackChain(models.ProviderCopilot); len(chain) != 2 || chain[1] != models.ProviderOpenAI {
+		t.Errorf("fallbackChain() = %v, want copilot and openai without the unregistered anthropic", chain)
+	}
+
+	token := &models.LLMToken{UserID: 1, HasLLMSubscription: true}
+	chat := func() string {
+		t.Helper()
+		result, err := s.Chat(CompletionRequest{Model: "gpt-4o", ProviderRequest: `{"messages":[{"role":"user","content":"hi"}]}`, Token: token})
+		if err != nil {
+			t.Fatalf("Chat() error = %v", err)
+		}
+		return result.Content
+	}
+	for i := 0; i < 3; i++ {
+		if got := chat(); got != "from openai" {
+			t.Fatalf("Chat() = %q, want the fallback's completion", got)
+		}
+	}
+	if copilot.calls != 2 || openai.calls != 3 {
+		t.Errorf("copilot called %d times and openai %d times, want 2 and 3 once the breaker is open", copilot.calls, openai.calls)
+	}
+
+	// A failing fallback's response is returned as it is
+	openai.status = http.StatusTooManyRequests
+	s.breakers = circuitBreakers{}
+	_, err := s.Chat(CompletionRequest{Model: "gpt-4o", ProviderRequest: `{"messages":[]}`, Token: token})
+	if upstreamErr, ok := err.(*UpstreamError); !ok || upstreamErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Chat() error = %v, want the fallback's 429", err)
+	}
+
+	// Invalid requests are not sent to the fallback
+	copilot.status, openai.calls = http.StatusBadRequest, 0
+	if _, err := s.Chat(CompletionRequest{Model: "gpt-4o", ProviderRequest: `{"messages":[]}`, Token: token}); err == nil || openai.calls != 0 {
+		t.Errorf("Chat() error = %v after %d fallback calls, want the 400 without a fallback", err, openai.calls)
+	}
+}
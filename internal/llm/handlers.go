@@ -1,9 +1,12 @@
 package llm
 
 import (
-	"bufio"
 	"bytes"
+	"copilot-proxy/internal/accesslog"
+	appauth "copilot-proxy/internal/auth"
+	"copilot-proxy/internal/tracing"
 	"copilot-proxy/pkg/models"
+	"copilot-proxy/pkg/utils"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,13 +22,27 @@ import (
 type ServerState struct {
 	Service *Service
 	Secret  string
+
+	// streams tracks active SSE responses for graceful shutdown
+	streams streamTracker
+	// middleware are the hooks registered with UseRequestMutator,
+	// UseResponseFilter and UseChunkTransformer
+	middleware middleware
+	// activity counts requests and keeps recent errors for the dashboard
+	activity activityLog
+	// tokens caches validated LLM tokens; nil disables the cache
+	tokens *tokenCache
+	// signingKey signs LLM tokens instead of Secret; see SetSigningKey
+	signingKey *tokenKey
 }
 
 // NewLLMServerState creates a new LLM server state
 func NewLLMServerState(secret string) *ServerState {
+	service := NewService()
 	return &ServerState{
-		Service: NewService(),
+		Service: service,
 		Secret:  secret,
+		tokens:  newTokenCache(service.config.TokenCacheSize),
 	}
 }
 
@@ -40,8 +57,22 @@ type CompletionParams struct {
 	ProviderRequest string `json:"provider_request"` // Raw JSON payload
 }
 
-// validateToken extracts and validates the LLM token from a request
+// validateToken extracts and validates the LLM token or TLS client
+// certificate of a request and reports its key to the access log
 func (s *ServerState) validateToken(r *http.Request) (*models.LLMToken, error) {
+	token, err := s.AuthenticateClient(r.Header.Get("Authorization"), r.URL.Path, r.TLS)
+	if err == nil {
+		accesslog.SetKey(r.Context(), token.UserID)
+	}
+	return token, err
+}
+
+// Authenticate validates the value of an Authorization header, an LLM token
+// or a stored API key sent as "Bearer <key>", or "Basic" credentials (see
+// authenticateBasic). Scoped API keys must allow endpoint, and LLM tokens
+// issued for a stored API key are rejected once the key is revoked or
+// expired.
+func (s *ServerState) Authenticate(authorization, endpoint string) (*models.LLMToken, error) {
 	// Check if auth is disabled globally
 	if disableAuth := os.Getenv("DISABLE_AUTH"); disableAuth == "true" || disableAuth == "1" {
 		// Return a default admin token when auth is disabled
@@ -54,17 +85,72 @@ func (s *ServerState) validateToken(r *http.Request) (*models.LLMToken, error) {
 		}, nil
 	}
 
-	auth := r.Header.Get("Authorization")
+	auth := authorization
+	if strings.HasPrefix(auth, "Basic ") {
+		return s.authenticateBasic(auth[6:], endpoint)
+	}
 	if auth == "" || len(auth) < 7 || auth[:7] != "Bearer " {
 		return nil, errors.New("invalid or missing authorization header")
 	}
 
-	token, err := ValidateLLMToken(auth[7:], s.Secret)
-	if err != nil {
-		return nil, err
+	token, err := s.validateLLMToken(auth[7:])
+	if err == nil {
+		// Tokens issued for stored API keys end with the key and share its
+		// tenant
+		if token.KeyID != 0 {
+			if _, keyErr := appauth.AppAPIKeyByID(token.KeyID); errors.Is(keyErr, appauth.ErrKeyNotFound) {
+				return nil, ErrInvalidToken
+			} else if keyErr != nil {
+				return nil, keyErr
+			}
+			if s.Service != nil {
+				s.Service.applyTenant(token)
+			}
+		}
+		return token, nil
 	}
 
-	return token, nil
+	// Fall back to a named API key issued by the key store
+	if key, keyErr := appauth.AuthenticateAppAPIKey(auth[7:]); keyErr == nil {
+		if err := key.Scopes.Authorize(endpoint, "", false); err != nil {
+			return nil, err
+		}
+		token := tokenForAPIKey(key)
+		if s.Service != nil {
+			s.Service.applyTenant(token)
+		}
+		return token, nil
+	} else if !errors.Is(keyErr, appauth.ErrKeyNotFound) {
+		return nil, keyErr
+	}
+	return nil, err
+}
+
+// tokenForAPIKey returns the LLM token for requests made with a stored API
+// key. The key's ID identifies it in usage records and budgets and its model
+// and streaming scopes carry over to the token.
+func tokenForAPIKey(key appauth.APIKey) *models.LLMToken {
+	now := time.Now()
+	token := &models.LLMToken{
+		Iat:                    key.CreatedAt.Unix(),
+		Jti:                    fmt.Sprintf("key-%d", key.ID),
+		UserID:                 key.ID,
+		KeyID:                  key.ID,
+		GithubUserLogin:        key.Name,
+		AccountCreatedAt:       key.CreatedAt,
+		HasLLMSubscription:     true,
+		MaxMonthlySpendInCents: 10000,
+	}
+	if key.Scopes != nil {
+		token.AllowedModels = key.Scopes.Models
+		token.NoStreaming = key.Scopes.NoStreaming
+	}
+	if key.ExpiresAt != nil {
+		token.Exp = key.ExpiresAt.Unix()
+	} else {
+		token.Exp = now.Add(TokenLifetime * time.Second).Unix()
+	}
+	return token
 }
 
 // getCountryCode extracts country code from a request header
@@ -79,54 +165,200 @@ func getCountryCode(r *http.Request) *string {
 
 // Helper for OpenAI-style error responses
 func writeOpenAIError(w http.ResponseWriter, status int, message, errType string) {
+	writeOpenAIErrorCode(w, status, message, errType, "")
+}
+
+// writeOpenAIErrorCode writes an OpenAI-style error response with an error code.
+// An empty code is encoded as null.
+func writeOpenAIErrorCode(w http.ResponseWriter, status int, message, errType, code string) {
+	writeOpenAIErrorParam(w, status, message, errType, code, "")
+}
+
+// writeOpenAIErrorParam writes an OpenAI-style error response naming the
+// offending request parameter. Empty codes and params are encoded as null.
+func writeOpenAIErrorParam(w http.ResponseWriter, status int, message, errType, code, param string) {
+	var codeValue, paramValue interface{}
+	if code != "" {
+		codeValue = code
+	}
+	if param != "" {
+		paramValue = param
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"error": map[string]interface{}{
 			"message": message,
 			"type":    errType,
-			"param":   nil,
-			"code":    nil,
+			"param":   paramValue,
+			"code":    codeValue,
 		},
 	})
 }
 
-// HandleListModels handles the list models endpoint
+// writeCompletionError writes the OpenAI-style error for a failed completion request
+func writeCompletionError(w http.ResponseWriter, err error) {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		writeUpstreamError(w, upstreamErr)
+		return
+	}
+	status, errType, code := CompletionError(err)
+	if status == http.StatusTooManyRequests && errors.Is(err, ErrRateLimitExceeded) {
+		SetErrorResponseHeaders(w, err)
+	}
+	writeOpenAIErrorCode(w, status, err.Error(), errType, code)
+}
+
+// CompletionError returns the HTTP status, OpenAI error type and error code
+// the OpenAI-compatible API responds with for a failed completion request
+func CompletionError(err error) (status int, errType, code string) {
+	var upstreamErr *UpstreamError
+	switch {
+	case errors.As(err, &upstreamErr):
+		return upstreamErr.openAIError()
+	case errors.Is(err, ErrUpstreamUnavailable) && isTimeout(err):
+		return http.StatusGatewayTimeout, "api_error", "upstream_timeout"
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return http.StatusBadGateway, "api_error", "upstream_unavailable"
+	case errors.Is(err, ErrSpendingLimitExceeded) || errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrSubscriptionInactive):
+		return http.StatusTooManyRequests, "insufficient_quota", "insufficient_quota"
+	case errors.Is(err, ErrRateLimitExceeded):
+		return http.StatusTooManyRequests, "requests", "rate_limit_exceeded"
+	case errors.Is(err, appauth.ErrScopeDenied):
+		return http.StatusForbidden, "permission_error", ""
+	case errors.Is(err, ErrRequestDenied):
+		return http.StatusForbidden, "permission_error", "request_denied"
+	case errors.Is(err, ErrRequestHookFailed):
+		return http.StatusBadGateway, "api_error", "request_hook_failed"
+	case errors.Is(err, ErrContentFiltered):
+		return http.StatusBadRequest, "invalid_request_error", "content_filter"
+	case errors.Is(err, ErrContentFilterUnavailable):
+		return http.StatusBadGateway, "api_error", "content_filter_unavailable"
+	case errors.Is(err, ErrContextLengthExceeded):
+		return http.StatusBadRequest, "invalid_request_error", "context_length_exceeded"
+	}
+	return http.StatusBadRequest, "invalid_request_error", ""
+}
+
+// readRequestBody reads and closes a request body. A body over the
+// MAX_REQUEST_BODY_BYTES limit is answered with 413, an unreadable one with
+// 400.
+func readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeBodyError(w, err)
+		return nil, false
+	}
+	return body, true
+}
+
+// writeBodyError writes the error of a failed request body read
+func writeBodyError(w http.ResponseWriter, err error) {
+	if utils.IsRequestBodyTooLarge(err) {
+		utils.WriteRequestBodyTooLarge(w, utils.MaxRequestBodyBytes())
+		return
+	}
+	writeOpenAIError(w, http.StatusBadRequest, "error reading request body", "invalid_request_error")
+}
+
+// writeTokenError writes the OpenAI-style error for a failed token validation
+func writeTokenError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrTokenExpired) {
+		w.Header().Set("X-LLM-Token-Expired", "true")
+		writeOpenAIError(w, http.StatusUnauthorized, "token expired", "invalid_request_error")
+	} else if errors.Is(err, appauth.ErrScopeDenied) {
+		writeOpenAIError(w, http.StatusForbidden, err.Error(), "permission_error")
+	} else {
+		if len(basicAuthUsers()) > 0 {
+			w.Header().Set("WWW-Authenticate", basicAuthRealm)
+		}
+		writeOpenAIError(w, http.StatusUnauthorized, "unauthorized", "invalid_request_error")
+	}
+}
+
+// HandleListModels handles the list models endpoint. Query parameters
+// filter the list by capability, family, provider and context window.
 func (s *ServerState) HandleListModels(w http.ResponseWriter, r *http.Request) {
 	token, err := s.validateToken(r)
 	if err != nil {
-		if errors.Is(err, ErrTokenExpired) {
-			w.Header().Set("X-LLM-Token-Expired", "true")
-			writeOpenAIError(w, http.StatusUnauthorized, "token expired", "invalid_request_error")
-		} else {
-			writeOpenAIError(w, http.StatusUnauthorized, "unauthorized", "invalid_request_error")
+		writeTokenError(w, err)
+		return
+	}
+
+	filter, err := parseModelFilter(r.URL.Query())
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	visible, ok := s.listVisibleModels(w, r, token)
+	if !ok {
+		return
+	}
+	filtered := make([]map[string]interface{}, 0, len(visible))
+	for _, model := range visible {
+		if filter.match(model) {
+			filtered = append(filtered, model)
 		}
+	}
+
+	out := map[string]interface{}{
+		"object": "list",
+		"data":   filtered,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// HandleGetModel handles the model retrieval endpoint (/v1/models/{id})
+func (s *ServerState) HandleGetModel(w http.ResponseWriter, r *http.Request) {
+	token, err := s.validateToken(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1"), "/models/")
+	if id == "" {
+		s.HandleListModels(w, r)
+		return
+	}
+
+	visible, ok := s.listVisibleModels(w, r, token)
+	if !ok {
 		return
 	}
+	for _, model := range visible {
+		if model["id"] == id {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(model)
+			return
+		}
+	}
+	writeOpenAIErrorCode(w, http.StatusNotFound, fmt.Sprintf("The model '%s' does not exist", id), "invalid_request_error", "model_not_found")
+}
 
+// listVisibleModels fetches the upstream model list and filters it by the
+// caller's country and model access. On failure the error response is
+// written to w and false is returned.
+func (s *ServerState) listVisibleModels(w http.ResponseWriter, r *http.Request, token *models.LLMToken) ([]map[string]interface{}, bool) {
 	countryCode := getCountryCode(r)
 
 	// --- Directly proxy the upstream Copilot API response, but filter if needed ---
-	apiKey := s.Service.config.CopilotAPIKey
+	apiKey := s.Service.config.APIKey()
 	if apiKey == "" {
 		writeOpenAIError(w, http.StatusInternalServerError, "missing Copilot API key", "internal_error")
-		return
+		return nil, false
 	}
 	reqURL := s.Service.getProxyURL(CopilotModelsURL)
 	req, err := http.NewRequest("GET", reqURL, nil)
 	if err != nil {
 		writeOpenAIError(w, http.StatusBadGateway, "failed to create models request: "+err.Error(), "api_error")
-		return
+		return nil, false
 	}
 	req.Header.Set("Authorization", "Bearer "+apiKey)
-	editorVersion := s.Service.config.EditorVersion
-	if editorVersion == "" {
-		editorVersion = "vscode/1.99.2"
-	}
-	pluginVersion := s.Service.config.EditorPluginVersion
-	if pluginVersion == "" {
-		pluginVersion = "copilot-chat/0.26.3"
-	}
+	editorVersion, pluginVersion := s.Service.config.editorVersions()
 	req.Header.Set("Editor-Version", editorVersion)
 	req.Header.Set("Editor-Plugin-Version", pluginVersion)
 	req.Header.Set("Copilot-Integration-ID", "vscode-chat")
@@ -137,14 +369,14 @@ func (s *ServerState) HandleListModels(w http.ResponseWriter, r *http.Request) {
 	resp, err := s.Service.httpClient.Do(req)
 	if err != nil {
 		writeOpenAIError(w, http.StatusBadGateway, "failed to fetch models: "+err.Error(), "api_error")
-		return
+		return nil, false
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		writeOpenAIError(w, http.StatusBadGateway, "models API returned "+resp.Status+": "+string(body), "api_error")
-		return
+		return nil, false
 	}
 
 	// Read the upstream response as raw JSON
@@ -154,62 +386,110 @@ func (s *ServerState) HandleListModels(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&upstream); err != nil {
 		writeOpenAIError(w, http.StatusBadGateway, "failed to decode models response: "+err.Error(), "api_error")
-		return
+		return nil, false
 	}
 
 	// Filter models according to authorization/country if needed
 	filtered := make([]map[string]interface{}, 0, len(upstream.Data))
 	for _, model := range upstream.Data {
 		provider, _ := model["provider"].(string)
-		name, _ := model["name"].(string)
+		id, _ := model["id"].(string)
 		if err := AuthorizeAccessForCountry(countryCode, models.LanguageModelProvider(provider)); err == nil {
-			if err := AuthorizeAccessToModel(token, models.LanguageModelProvider(provider), name); err == nil {
+			if err := AuthorizeAccessToModel(token, models.LanguageModelProvider(provider), id); err == nil {
 				// Ensure "object": "model" is present for OpenAI compatibility
 				model["object"] = "model"
+				s.Service.config.modelMetadata(id, copilotModelMetadata(model)).apply(model)
 				filtered = append(filtered, model)
 			}
 		}
 	}
 
-	out := map[string]interface{}{
-		"object": "list",
-		"data":   filtered,
+	// Add the models of the other providers from the catalog
+	if err := s.Service.ensureAuthAndModels(); err == nil {
+		for _, model := range s.Service.cachedModels() {
+			if model.Provider == models.ProviderCopilot {
+				continue
+			}
+			if AuthorizeAccessForCountry(countryCode, model.Provider) != nil || AuthorizeAccessToModel(token, model.Provider, model.ID) != nil {
+				continue
+			}
+			listed := map[string]interface{}{
+				"id":       model.ID,
+				"object":   "model",
+				"name":     model.Name,
+				"owned_by": string(model.Provider),
+			}
+			s.Service.config.modelMetadata(model.ID, ModelMetadata{ContextWindow: model.ContextWindow, Provider: string(model.Provider)}).apply(listed)
+			filtered = append(filtered, listed)
+		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(out)
+
+	return filtered, true
 }
 
 // HandleCompletion handles the completion endpoint
 func (s *ServerState) HandleCompletion(w http.ResponseWriter, r *http.Request) {
+	// Continue the caller's trace, if any
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "HandleCompletion", tracing.SpanKindServer,
+		tracing.String("http.method", r.Method), tracing.String("http.route", r.URL.Path))
+	defer span.End()
+
 	// Track if client requested streaming
 	var isStream bool
+	// session records the exchange of a request with a session_id
+	var session *sessionTurn
 
 	token, err := s.validateToken(r)
 	if err != nil {
-		if errors.Is(err, ErrTokenExpired) {
-			w.Header().Set("X-LLM-Token-Expired", "true")
-			writeOpenAIError(w, http.StatusUnauthorized, "token expired", "invalid_request_error")
-		} else {
-			writeOpenAIError(w, http.StatusUnauthorized, "unauthorized", "invalid_request_error")
-		}
+		writeTokenError(w, err)
 		return
 	}
+	release, err := s.Service.acquireRequestSlot(token.UserID)
+	if err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+	defer release()
 
 	// Read the request body
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		writeOpenAIError(w, http.StatusBadRequest, "error reading request body", "invalid_request_error")
+	bodyBytes, ok := readRequestBody(w, r)
+	if !ok {
 		return
 	}
-	r.Body.Close()
 
 	// Remove any 'stream' from incoming payload before processing
 	var incoming map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &incoming); err == nil {
 		// Determine if streaming was requested
 		isStream, _ = incoming["stream"].(bool)
+		// Expand a prompt template into messages
+		if err := s.Service.expandPromptTemplate(incoming); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+			return
+		}
+		// Reject requests that do not match the OpenAI schema in strict mode
+		if s.Service.config.StrictValidation {
+			if err := validateChatRequest(incoming); err != nil {
+				writeOpenAIErrorParam(w, http.StatusBadRequest, err.message, "invalid_request_error", "", err.param)
+				return
+			}
+		}
 		// Clean out the stream key for internal processing
 		delete(incoming, "stream")
+		// Prepend the stored history of the client's session
+		if session, err = s.Service.loadSession(token.UserID, incoming); err != nil {
+			if errors.Is(err, ErrInvalidSessionID) {
+				writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+			} else {
+				writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "internal_error")
+			}
+			return
+		}
+		// Let registered middleware inspect or rewrite the request
+		if err := s.mutateRequest(r, incoming); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+			return
+		}
 		// Re-marshal to remove 'stream' from bodyBytes
 		cleanBody, err2 := json.Marshal(incoming)
 		if err2 == nil {
@@ -219,10 +499,17 @@ func (s *ServerState) HandleCompletion(w http.ResponseWriter, r *http.Request) {
 		// Use this for branching later
 		r = r.Clone(r.Context())
 		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	} else if s.Service.config.StrictValidation {
+		writeOpenAIError(w, http.StatusBadRequest, "request body must be a JSON object: "+err.Error(), "invalid_request_error")
+		return
 	} else {
 		// Fall back if unmarshal fails
 		isStream = false
 	}
+	if err := AuthorizeStreaming(token, isStream); err != nil {
+		writeCompletionError(w, err)
+		return
+	}
 
 	// First, try to parse as standard CompletionParams
 	var params CompletionParams
@@ -259,126 +546,207 @@ func (s *ServerState) HandleCompletion(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Inject the configured system prompt before the request is cached or forwarded
+	params.ProviderRequest = s.Service.config.applySystemPrompt(params.ProviderRequest)
+
+	accesslog.SetModel(r.Context(), params.Model)
+	s.Service.setRateLimitHeaders(w, token.UserID, params.Model)
+
 	countryCode := getCountryCode(r)
 
-	// In a real implementation, we would fetch the current spending from a database
-	// Here we'll use a placeholder value
-	currentSpending := uint32(0)
+	currentSpending := s.Service.CurrentSpending(token.UserID)
+
+	span.SetAttributes(tracing.String("llm.model", params.Model), tracing.Bool("llm.stream", isStream),
+		tracing.String("http.request_id", RequestIDFromContext(ctx)))
 
 	req := CompletionRequest{
+		Context:         ctx,
 		Model:           params.Model,
 		ProviderRequest: params.ProviderRequest,
 		Token:           token,
 		CountryCode:     countryCode,
 		CurrentSpending: currentSpending,
+		Endpoint:        r.URL.Path,
+	}
+
+	// Enforce access, limits, budgets and the content filter before the
+	// response cache, so cached answers only go to requests that could have
+	// been forwarded
+	completionCtx, checked, err := s.Service.checkCompletion(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		logRequestf(ctx, "Completion for %s failed: %v", params.Model, err)
+		writeCompletionError(w, err)
+		return
+	}
+
+	// Serve repeated deterministic requests from the response cache
+	var cacheKey string
+	cacheable := false
+	if cache := s.Service.responseCache; cache != nil && !isStream {
+		cacheKey, cacheable = responseCacheKey(token, params.Model, params.ProviderRequest)
+		if cacheable {
+			if cached, ok := cache.get(cacheKey); ok {
+				span.SetAttributes(tracing.Bool("llm.cache_hit", true))
+				w.Header().Set("X-Cache", "HIT")
+				s.writeChatCompletion(w, r, params.Model, cached)
+				session.record(cached.message())
+				return
+			}
+		}
 	}
 
 	// Always use streaming on the Copilot API side
-	resp, err := s.Service.PerformCompletion(req)
+	resp, err := s.Service.sendCompletion(completionCtx, checked)
 	if err != nil {
-		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		span.RecordError(err)
+		logRequestf(ctx, "Completion for %s failed: %v", params.Model, err)
+		writeCompletionError(w, err)
 		return
 	}
 
 	defer resp.Body.Close()
 	// Process streaming SSE for both modes
-	reader, err := s.Service.ProcessStreamingResponse(resp, token.UserID, params.Model)
+	reader, err := s.Service.ProcessStreamingResponse(resp, req)
 	if err != nil {
-		writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "internal_error")
+		span.RecordError(err)
+		writeCompletionError(w, err)
 		return
 	}
 	defer reader.Close()
 	if !isStream {
 		// Accumulate all chunks into one message
-		var full strings.Builder
-		var usage struct {
-			PromptTokens     int
-			CompletionTokens int
-			TotalTokens      int
-		}
-		scanner := bufio.NewScanner(reader)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if !strings.HasPrefix(line, "data: ") {
-				continue
-			}
-			data := strings.TrimPrefix(line, "data: ")
-			if data == "[DONE]" {
-				break
-			}
-			var chunk map[string]interface{}
-			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
-				continue
-			}
-			choices, ok := chunk["choices"].([]interface{})
-			if !ok || len(choices) == 0 {
-				continue
-			}
-			choice, _ := choices[0].(map[string]interface{})
-			delta, _ := choice["delta"].(map[string]interface{})
-			if content, ok := delta["content"].(string); ok {
-				full.WriteString(content)
-			}
-			// Try to extract usage if present
-			if u, ok := chunk["usage"].(map[string]interface{}); ok {
-				if v, ok := u["prompt_tokens"].(float64); ok {
-					usage.PromptTokens = int(v)
-				}
-				if v, ok := u["completion_tokens"].(float64); ok {
-					usage.CompletionTokens = int(v)
-				}
-				if v, ok := u["total_tokens"].(float64); ok {
-					usage.TotalTokens = int(v)
+		result, streamErr := collectStream(reader)
+		fillUsage(result, reader)
+		// Honor JSON mode and structured outputs by repairing, retrying or rejecting non-conforming output
+		if format := parseResponseFormat(params.ProviderRequest); format.wantsJSON() && len(result.ToolCalls) == 0 {
+			content, verr := format.validate(result.Content)
+			for attempt := 0; verr != nil && attempt < s.Service.config.StructuredOutputRetries; attempt++ {
+				retried, err := s.retryStructuredOutput(req, result.Content, verr)
+				if err != nil {
+					break
 				}
+				result = retried
+				content, verr = format.validate(result.Content)
+			}
+			if verr != nil {
+				writeOpenAIErrorCode(w, http.StatusBadGateway, verr.Error(), "api_error", responseFormatErrorCode(verr))
+				return
 			}
+			result.Content = content
 		}
-		// Write OpenAI-compliant response
-		w.Header().Set("Content-Type", "application/json")
-		now := time.Now().Unix()
-		id := fmt.Sprintf("chatcmpl-%d%06d", now, rand.Intn(1000000))
-		out := map[string]interface{}{
-			"id":      id,
-			"object":  "chat.completion",
-			"created": now,
-			"model":   params.Model,
-			"choices": []map[string]interface{}{{
-				"message":       map[string]string{"role": "assistant", "content": full.String()},
-				"finish_reason": "stop", "index": 0,
-			}},
-			"usage": map[string]interface{}{
-				"prompt_tokens":     usage.PromptTokens,
-				"completion_tokens": usage.CompletionTokens,
-				"total_tokens":      usage.TotalTokens,
-			},
+		if cacheable && streamErr == nil {
+			s.Service.responseCache.put(cacheKey, result)
+			w.Header().Set("X-Cache", "MISS")
 		}
-		json.NewEncoder(w).Encode(out)
+		s.writeChatCompletion(w, r, params.Model, result)
+		session.record(result.message())
 		return
 	}
 	// Streaming SSE: proxy raw event stream line-by-line with flush
+	stream, ok := s.beginStream(w, reader)
+	if !ok {
+		return
+	}
+	defer s.endStream(w, stream)
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	flusher, _ := w.(http.Flusher)
-	bufReader := bufio.NewReader(reader)
-	for {
-		line, err := bufReader.ReadBytes('\n')
-		if len(line) > 0 {
-			w.Write(line)
-			flusher.Flush()
+	stitcher := newToolCallStitcher()
+	var transformErr error
+	// transcript collects the streamed reply for the session
+	var transcript bytes.Buffer
+	pumpSSE(w, reader, s.Service.config.SSEKeepaliveInterval, func(line []byte) {
+		if transformErr != nil {
+			return
 		}
+		out, err := s.transformStreamLine(r, stitcher.normalizeStreamLine(line))
 		if err != nil {
-			break
+			// Stop reading upstream; the pump ends once the body is closed
+			transformErr = err
+			reader.Close()
+			return
 		}
+		if out != nil {
+			w.Write(out)
+			flusher.Flush()
+			if session != nil {
+				transcript.Write(out)
+			}
+		}
+	})
+	if transformErr != nil {
+		writeSSEError(w, transformErr.Error(), "api_error", "middleware_error")
+		return
+	}
+	if session != nil {
+		if result, err := collectStream(&transcript); err == nil {
+			session.record(result.message())
+		}
+	}
+}
+
+// writeChatCompletion writes an aggregated completion as an OpenAI
+// chat.completion response, after the registered response filters ran on it.
+func (s *ServerState) writeChatCompletion(w http.ResponseWriter, r *http.Request, model string, result *streamResult) {
+	out := chatCompletion(model, result)
+	if err := s.filterResponse(r, out); err != nil {
+		writeOpenAIError(w, http.StatusBadGateway, err.Error(), "api_error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// chatCompletion builds the OpenAI chat.completion response of an
+// aggregated completion
+func chatCompletion(model string, result *streamResult) map[string]interface{} {
+	now := time.Now().Unix()
+	id := fmt.Sprintf("chatcmpl-%d%06d", now, rand.Intn(1000000))
+	out := map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": now,
+		"model":   model,
+		"choices": []map[string]interface{}{{
+			"message":       result.message(),
+			"logprobs":      result.logprobs(),
+			"finish_reason": result.FinishReason, "index": 0,
+		}},
+		"usage": map[string]interface{}{
+			"prompt_tokens":     result.Usage.PromptTokens,
+			"completion_tokens": result.Usage.CompletionTokens,
+			"total_tokens":      result.Usage.TotalTokens,
+		},
 	}
-	return
+	return out
+}
+
+// route wraps an OpenAI-compatible handler with request IDs, dashboard
+// activity, CORS and client-requested timeouts
+func (s *ServerState) route(h http.HandlerFunc) http.HandlerFunc {
+	return withRequestID(s.withActivity(s.withCORS(s.withRequestTimeout(h))))
 }
 
 // RegisterHandlers registers the LLM handlers with a router
 func (s *ServerState) RegisterHandlers(mux *http.ServeMux) {
-	mux.HandleFunc("/models", s.HandleListModels)
-	mux.HandleFunc("/v1/models", s.HandleListModels) // OpenAI alias
-	mux.HandleFunc("/completion", s.HandleCompletion)
-	mux.HandleFunc("/openai", s.HandleCompletion)
-	mux.HandleFunc("/v1/chat/completions", s.HandleCompletion)
-	// (Optional) Add /v1/completions and /v1/embeddings handlers here if implemented
+	mux.HandleFunc("/models", s.route(s.HandleListModels))
+	mux.HandleFunc("/v1/models", s.route(s.HandleListModels)) // OpenAI alias
+	mux.HandleFunc("/models/", s.route(s.HandleGetModel))
+	mux.HandleFunc("/v1/models/", s.route(s.HandleGetModel))
+	mux.HandleFunc("/completion", s.route(s.HandleCompletion))
+	mux.HandleFunc("/openai", s.route(s.HandleCompletion))
+	mux.HandleFunc("/v1/chat/completions", s.route(s.HandleCompletion))
+	mux.HandleFunc("/v1/completions", s.route(s.HandleTextCompletion))
+	mux.HandleFunc("/copilot/completions", s.route(s.HandleCodeCompletion))
+	mux.HandleFunc("/v1/embeddings", s.route(s.HandleEmbeddings))
+	mux.HandleFunc("/v1/moderations", s.route(s.HandleModerations))
+	mux.HandleFunc("/v1/usage", s.route(s.HandleUsage))
+	mux.HandleFunc("/v1/sessions", s.route(s.HandleSessions))
+	mux.HandleFunc("/v1/sessions/", s.route(s.HandleSessions))
+	mux.HandleFunc("/auth/token", s.route(s.HandleTokenIssue))
+	mux.HandleFunc("/auth/refresh", s.route(s.HandleTokenRefresh))
+	mux.HandleFunc(JWKSPath, s.route(s.HandleJWKS))
+	mux.HandleFunc(azureDeploymentsPrefix, s.route(s.HandleAzureDeployment))
 }
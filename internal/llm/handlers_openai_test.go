@@ -2,6 +2,7 @@ package llm
 
 import (
 	"bytes"
+	"copilot-proxy/pkg/utils"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -194,6 +195,34 @@ func TestOpenAIErrorFormat(t *testing.T) {
 	}
 }
 
+func TestOpenAIRequestBodyTooLarge(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	handler := utils.LimitRequestBody(64, http.HandlerFunc(state.HandleCompletion))
+
+	// A chunked body does not declare its size, so the handler hits the limit
+	body := `{"model":"test-model","messages":[{"role":"user","content":"` + strings.Repeat("x", 100) + `"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", io.MultiReader(strings.NewReader(body)))
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", w.Code)
+	}
+	var out struct {
+		Error struct {
+			Type string `json:"type"`
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || out.Error.Code != "request_too_large" || out.Error.Type != "invalid_request_error" {
+		t.Errorf("body = %s, want an OpenAI request_too_large error", w.Body.String())
+	}
+}
+
 func TestOpenAIAuthRequired(t *testing.T) {
 	os.Unsetenv("DISABLE_AUTH")
 	state := NewLLMServerState("test-secret")
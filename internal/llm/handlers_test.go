@@ -0,0 +1,196 @@
+package llm
+
+import (
+	appauth "copilot-proxy/internal/auth"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newModelsUpstream returns a test server that serves a fixed Copilot model list
+func newModelsUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != CopilotModelsURL {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"object":"list","data":[
+			{"id":"gpt-4o","name":"GPT-4o","vendor":"Azure OpenAI"},
+			{"id":"claude-3.5-sonnet","name":"Claude 3.5 Sonnet","vendor":"Anthropic"}
+		]}`)
+	}))
+}
+
+func TestHandleGetModel(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	upstream := newModelsUpstream(t)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	mux := http.NewServeMux()
+	state.RegisterHandlers(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models/gpt-4o", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var model map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&model)
+	if model["id"] != "gpt-4o" || model["object"] != "model" {
+		t.Errorf("unexpected model object: %v", model)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models/does-not-exist", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	var out struct {
+		Error struct {
+			Type string `json:"type"`
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	json.NewDecoder(w.Body).Decode(&out)
+	if out.Error.Code != "model_not_found" || out.Error.Type != "invalid_request_error" {
+		t.Errorf("unexpected error body: %+v", out)
+	}
+}
+
+func TestHandleCompletionPropagatesTraceContext(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	traceparent := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	state.HandleCompletion(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	got := <-traceparent
+	if !strings.HasPrefix(got, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(got, "00f067aa0ba902b7") {
+		t.Errorf("upstream traceparent = %q, want a child span of the incoming trace", got)
+	}
+}
+
+func TestValidateTokenAcceptsStoredAPIKeys(t *testing.T) {
+	store, err := appauth.NewFileKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appauth.SetKeyStore(store)
+	defer appauth.SetKeyStore(nil)
+	active, _ := store.Create("editor", nil, nil)
+	revoked, _ := store.Create("old-script", nil, nil)
+	store.Revoke(revoked.ID)
+
+	state := &ServerState{Secret: "secret"}
+	validate := func(bearer string) (*models.LLMToken, error) {
+		req := httptest.NewRequest("GET", "/v1/models", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		return state.validateToken(req)
+	}
+
+	token, err := validate(active.Key)
+	if err != nil || token.UserID != active.ID || token.GithubUserLogin != "editor" || token.IsStaff {
+		t.Errorf("validateToken(active key) = %+v, %v", token, err)
+	}
+	if _, err := validate(revoked.Key); !errors.Is(err, appauth.ErrKeyRevoked) {
+		t.Errorf("validateToken(revoked key) error = %v, want ErrKeyRevoked", err)
+	}
+	if _, err := validate("cpk_unknown"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("validateToken(unknown key) error = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestAuthenticateRejectsTokensOfRevokedKeys(t *testing.T) {
+	store, err := appauth.NewFileKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appauth.SetKeyStore(store)
+	defer appauth.SetKeyStore(nil)
+	key, _ := store.Create("script", nil, nil)
+	claims, _ := apiKeyClaims(key)
+	issued, err := IssueLLMToken(claims, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := &ServerState{Secret: "secret", tokens: newTokenCache(8)}
+	token, err := state.Authenticate("Bearer "+issued, "/v1/models")
+	if err != nil || token.KeyID != key.ID || token.IsStaff {
+		t.Fatalf("Authenticate(key token) = %+v, %v", token, err)
+	}
+	// The cached token is not served once the key is revoked
+	store.Revoke(key.ID)
+	if _, err := state.Authenticate("Bearer "+issued, "/v1/models"); !errors.Is(err, appauth.ErrKeyRevoked) {
+		t.Errorf("Authenticate(revoked key token) error = %v, want ErrKeyRevoked", err)
+	}
+	unknown, _ := IssueLLMToken(TokenClaims{UserID: 999, KeyID: 999}, "secret")
+	if _, err := state.Authenticate("Bearer "+unknown, "/v1/models"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate(unknown key token) error = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestScopedAPIKeys(t *testing.T) {
+	store, err := appauth.NewFileKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appauth.SetKeyStore(store)
+	defer appauth.SetKeyStore(nil)
+	key, _ := store.Create("script", nil, &appauth.KeyScopes{
+		Models:      []string{"cheap-model"},
+		Endpoints:   []string{"/v1/chat/completions"},
+		NoStreaming: true,
+	})
+
+	upstream := newSSEUpstream(t, `{"choices":[{"delta":{"content":"hi"}}]}`)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	state.Service.modelsCache = append(state.Service.modelsCache,
+		models.LanguageModel{ID: "cheap-model", Name: "cheap-model", Provider: models.ProviderCopilot, Enabled: true})
+
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key.Key)
+		w := httptest.NewRecorder()
+		state.HandleCompletion(w, req)
+		return w
+	}
+
+	if w := send("/v1/chat/completions", `{"model":"cheap-model","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusOK {
+		t.Errorf("allowed request status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("/v1/chat/completions", `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusForbidden {
+		t.Errorf("other model status = %d, want 403: %s", w.Code, w.Body.String())
+	}
+	if w := send("/v1/chat/completions", `{"model":"cheap-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusForbidden {
+		t.Errorf("streaming status = %d, want 403: %s", w.Code, w.Body.String())
+	}
+	if w := send("/chat/completions", `{"model":"cheap-model","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusForbidden {
+		t.Errorf("other endpoint status = %d, want 403: %s", w.Code, w.Body.String())
+	}
+}
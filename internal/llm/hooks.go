@@ -0,0 +1,166 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// ErrRequestDenied is returned when a request hook rejects a request
+	ErrRequestDenied = errors.New("request denied by policy")
+	// ErrRequestHookFailed is returned when a request hook cannot be run or
+	// answers with something other than a verdict. Requests fail closed.
+	ErrRequestHookFailed = errors.New("request hook failed")
+)
+
+// hookInput is what a request hook receives: the chat completion request
+// and who sent it to which endpoint
+type hookInput struct {
+	UserID   uint64                 `json:"user_id"`
+	Endpoint string                 `json:"endpoint"`
+	Request  map[string]interface{} `json:"request"`
+}
+
+// hookVerdict is a request hook's answer. An empty answer allows the
+// request unchanged; "allow": false denies it with "reason"; "request"
+// replaces the request.
+type hookVerdict struct {
+	Allow   *bool                  `json:"allow"`
+	Reason  string                 `json:"reason"`
+	Request map[string]interface{} `json:"request"`
+}
+
+// hookCompletion passes a completion request through the request hooks,
+// taking over the request and model a hook rewrites. It runs for every
+// completion, whichever API it came in on.
+func (s *Service) hookCompletion(ctx context.Context, req CompletionRequest) (CompletionRequest, error) {
+	if len(s.config.RequestHooks) == 0 {
+		return req, nil
+	}
+	var request map[string]interface{}
+	if err := json.Unmarshal([]byte(req.ProviderRequest), &request); err != nil {
+		return req, fmt.Errorf("%w: %v", ErrRequestHookFailed, err)
+	}
+	if err := s.runRequestHooks(ctx, req.Token.UserID, req.Endpoint, request); err != nil {
+		return req, err
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return req, fmt.Errorf("%w: %v", ErrRequestHookFailed, err)
+	}
+	req.ProviderRequest = string(body)
+	if model, ok := request["model"].(string); ok && model != "" {
+		req.Model = model
+	}
+	return req, nil
+}
+
+// runRequestHooks passes a chat completion request through the hooks of
+// REQUEST_HOOKS in order. Entries starting with http:// or https:// are
+// webhooks that receive the hook input as a POST; other entries are
+// commands that receive it on stdin and answer on stdout, where a non-zero
+// exit status denies the request with the command's stderr as the reason.
+// Each hook sees the request as rewritten by the previous one.
+func (s *Service) runRequestHooks(ctx context.Context, userID uint64, endpoint string, request map[string]interface{}) error {
+	for _, hook := range s.config.RequestHooks {
+		input, err := json.Marshal(hookInput{UserID: userID, Endpoint: endpoint, Request: request})
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrRequestHookFailed, err)
+		}
+		hookCtx, cancel := ctx, context.CancelFunc(func() {})
+		if s.config.RequestHookTimeout > 0 {
+			hookCtx, cancel = context.WithTimeout(ctx, s.config.RequestHookTimeout)
+		}
+		var output []byte
+		if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+			output, err = s.callWebhook(hookCtx, hook, input)
+		} else {
+			output, err = runHookCommand(hookCtx, hook, input)
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		var verdict hookVerdict
+		if len(bytes.TrimSpace(output)) > 0 {
+			if err := json.Unmarshal(output, &verdict); err != nil {
+				return fmt.Errorf("%w: invalid answer: %v", ErrRequestHookFailed, err)
+			}
+		}
+		if verdict.Allow != nil && !*verdict.Allow {
+			return requestDenied(verdict.Reason)
+		}
+		if verdict.Request != nil {
+			for k := range request {
+				delete(request, k)
+			}
+			for k, v := range verdict.Request {
+				request[k] = v
+			}
+		}
+	}
+	return nil
+}
+
+// callWebhook posts the hook input to a webhook. A 403 denies the request;
+// any other non-2xx status is a hook failure.
+func (s *Service) callWebhook(ctx context.Context, url string, input []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(input))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRequestHookFailed, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRequestHookFailed, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRequestHookFailed, err)
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		var verdict hookVerdict
+		json.Unmarshal(body, &verdict)
+		return nil, requestDenied(verdict.Reason)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%w: webhook returned %d", ErrRequestHookFailed, resp.StatusCode)
+	}
+	return body, nil
+}
+
+// runHookCommand runs a hook command, split on whitespace without a shell
+func runHookCommand(ctx context.Context, command string, input []byte) ([]byte, error) {
+	args := strings.Fields(command)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return nil, requestDenied(strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRequestHookFailed, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// requestDenied returns ErrRequestDenied with the hook's reason
+func requestDenied(reason string) error {
+	if reason == "" {
+		return ErrRequestDenied
+	}
+	return fmt.Errorf("%w: %s", ErrRequestDenied, reason)
+}
@@ -0,0 +1,92 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRequestHooks(t *testing.T) {
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o700)
+		return path
+	}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input hookInput
+		json.NewDecoder(r.Body).Decode(&input)
+		switch input.Request["model"] {
+		case "forbidden-model":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"reason":"model not allowed"}`))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			input.Request["user"] = "policy-checked"
+			json.NewEncoder(w).Encode(map[string]interface{}{"request": input.Request})
+		}
+	}))
+	defer webhook.Close()
+
+	s := &Service{config: &Config{}, httpClient: webhook.Client()}
+	run := func(request map[string]interface{}) error {
+		return s.runRequestHooks(context.Background(), 7, "/v1/chat/completions", request)
+	}
+
+	t.Run("allow and rewrite", func(t *testing.T) {
+		s.config.RequestHooks = []string{script("allow.sh", "cat >/dev/null"), webhook.URL}
+		request := map[string]interface{}{"model": "gpt-4o"}
+		if err := run(request); err != nil {
+			t.Fatalf("runRequestHooks() error = %v", err)
+		}
+		if request["user"] != "policy-checked" || request["model"] != "gpt-4o" {
+			t.Errorf("request = %v, want the webhook's rewrite", request)
+		}
+	})
+
+	t.Run("command denies", func(t *testing.T) {
+		s.config.RequestHooks = []string{script("deny.sh", `grep -q '"user_id":7' && echo "no access for 7" >&2; exit 1`)}
+		err := run(map[string]interface{}{"model": "gpt-4o"})
+		if !errors.Is(err, ErrRequestDenied) || !strings.Contains(err.Error(), "no access for 7") {
+			t.Errorf("runRequestHooks() error = %v, want the command's denial", err)
+		}
+	})
+
+	t.Run("command verdict", func(t *testing.T) {
+		s.config.RequestHooks = []string{script("verdict.sh", `cat >/dev/null; echo '{"allow":false,"reason":"off hours"}'`)}
+		if err := run(map[string]interface{}{}); !errors.Is(err, ErrRequestDenied) {
+			t.Errorf("runRequestHooks() error = %v, want ErrRequestDenied", err)
+		}
+	})
+
+	t.Run("webhook denies", func(t *testing.T) {
+		s.config.RequestHooks = []string{webhook.URL}
+		err := run(map[string]interface{}{"model": "forbidden-model"})
+		if !errors.Is(err, ErrRequestDenied) || !strings.Contains(err.Error(), "model not allowed") {
+			t.Errorf("runRequestHooks() error = %v, want the webhook's denial", err)
+		}
+		if status, _, code := CompletionError(err); status != http.StatusForbidden || code != "request_denied" {
+			t.Errorf("CompletionError() = %d %s, want 403 request_denied", status, code)
+		}
+	})
+
+	t.Run("failing hooks fail closed", func(t *testing.T) {
+		for _, hooks := range [][]string{
+			{webhook.URL},
+			{filepath.Join(dir, "missing.sh")},
+			{script("garbage.sh", "cat >/dev/null; echo not-json")},
+		} {
+			s.config.RequestHooks = hooks
+			if err := run(map[string]interface{}{"model": "broken"}); !errors.Is(err, ErrRequestHookFailed) {
+				t.Errorf("%v: runRequestHooks() error = %v, want ErrRequestHookFailed", hooks, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,279 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SchemaError describes where a JSON value failed schema validation
+type SchemaError struct {
+	Path    string
+	Message string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidateJSONSchema validates a JSON document against a JSON Schema.
+//
+// The subset of JSON Schema supported matches what OpenAI structured outputs
+// accept: type, enum, const, properties, required, additionalProperties,
+// items, min/maxItems, minimum/maximum (and exclusive variants), min/maxLength,
+// pattern, anyOf, oneOf, allOf and local $ref pointers into $defs/definitions.
+func ValidateJSONSchema(schema map[string]interface{}, document string) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(document), &value); err != nil {
+		return &SchemaError{Path: "$", Message: "invalid JSON: " + err.Error()}
+	}
+	v := &schemaValidator{root: schema}
+	return v.validate(schema, value, "$", 0)
+}
+
+// maxSchemaDepth guards against unbounded $ref recursion
+const maxSchemaDepth = 64
+
+type schemaValidator struct {
+	root map[string]interface{}
+}
+
+func (v *schemaValidator) validate(schema map[string]interface{}, value interface{}, path string, depth int) error {
+	if depth > maxSchemaDepth {
+		return &SchemaError{Path: path, Message: "schema nesting too deep"}
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := v.resolve(ref)
+		if err != nil {
+			return &SchemaError{Path: path, Message: err.Error()}
+		}
+		return v.validate(resolved, value, path, depth+1)
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("expected type %v, got %s", t, jsonTypeName(value))}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &SchemaError{Path: path, Message: "value is not one of the allowed enum values"}
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("expected constant %v", c)}
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		if err := v.validateObject(schema, val, path, depth); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := v.validateArray(schema, val, path, depth); err != nil {
+			return err
+		}
+	case string:
+		if n, ok := schema["minLength"].(float64); ok && float64(len([]rune(val))) < n {
+			return &SchemaError{Path: path, Message: fmt.Sprintf("string shorter than %v", n)}
+		}
+		if n, ok := schema["maxLength"].(float64); ok && float64(len([]rune(val))) > n {
+			return &SchemaError{Path: path, Message: fmt.Sprintf("string longer than %v", n)}
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return &SchemaError{Path: path, Message: "invalid pattern in schema: " + err.Error()}
+			}
+			if !re.MatchString(val) {
+				return &SchemaError{Path: path, Message: fmt.Sprintf("string does not match pattern %q", pattern)}
+			}
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && val < n {
+			return &SchemaError{Path: path, Message: fmt.Sprintf("value below minimum %v", n)}
+		}
+		if n, ok := schema["maximum"].(float64); ok && val > n {
+			return &SchemaError{Path: path, Message: fmt.Sprintf("value above maximum %v", n)}
+		}
+		if n, ok := schema["exclusiveMinimum"].(float64); ok && val <= n {
+			return &SchemaError{Path: path, Message: fmt.Sprintf("value not above %v", n)}
+		}
+		if n, ok := schema["exclusiveMaximum"].(float64); ok && val >= n {
+			return &SchemaError{Path: path, Message: fmt.Sprintf("value not below %v", n)}
+		}
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if s, ok := sub.(map[string]interface{}); ok {
+				if err := v.validate(s, value, path, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		if v.countMatches(anyOf, value, path, depth) == 0 {
+			return &SchemaError{Path: path, Message: "value does not match any allowed schema"}
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		if v.countMatches(oneOf, value, path, depth) != 1 {
+			return &SchemaError{Path: path, Message: "value must match exactly one schema"}
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateObject(schema map[string]interface{}, obj map[string]interface{}, path string, depth int) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, present := obj[name]; !present {
+				return &SchemaError{Path: path, Message: fmt.Sprintf("missing required property %q", name)}
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	// Validate in a stable order so error messages are deterministic
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		childPath := path + "." + k
+		if propSchema, ok := properties[k].(map[string]interface{}); ok {
+			if err := v.validate(propSchema, obj[k], childPath, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return &SchemaError{Path: childPath, Message: "additional property not allowed"}
+			}
+		case map[string]interface{}:
+			if err := v.validate(additional, obj[k], childPath, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateArray(schema map[string]interface{}, arr []interface{}, path string, depth int) error {
+	if n, ok := schema["minItems"].(float64); ok && float64(len(arr)) < n {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("array has fewer than %v items", n)}
+	}
+	if n, ok := schema["maxItems"].(float64); ok && float64(len(arr)) > n {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("array has more than %v items", n)}
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, item := range arr {
+			if err := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i), depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) countMatches(schemas []interface{}, value interface{}, path string, depth int) int {
+	matches := 0
+	for _, sub := range schemas {
+		if s, ok := sub.(map[string]interface{}); ok && v.validate(s, value, path, depth+1) == nil {
+			matches++
+		}
+	}
+	return matches
+}
+
+// resolve looks up a local JSON pointer such as "#/$defs/Item"
+func (v *schemaValidator) resolve(ref string) (map[string]interface{}, error) {
+	if ref == "#" {
+		return v.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	var node interface{} = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		node = obj[part]
+	}
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %q", ref)
+	}
+	return schema, nil
+}
+
+// matchesType checks a value against a schema type (string or list of strings)
+func matchesType(t interface{}, value interface{}) bool {
+	switch typ := t.(type) {
+	case string:
+		return matchesTypeName(typ, value)
+	case []interface{}:
+		for _, name := range typ {
+			if s, ok := name.(string); ok && matchesTypeName(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesTypeName(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return jsonTypeName(value) == name
+	}
+}
+
+// jsonTypeName returns the JSON Schema type name of a decoded JSON value
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// jsonEqual compares two decoded JSON values
+func jsonEqual(a, b interface{}) bool {
+	aj, _ := json.Marshal(a)
+	bj, _ := json.Marshal(b)
+	return string(aj) == string(bj)
+}
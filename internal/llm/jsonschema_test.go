@@ -0,0 +1,65 @@
+package llm
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateJSONSchema(t *testing.T) {
+	var schema map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "maxItems": 2},
+			"kind": {"enum": ["a", "b"]},
+			"note": {"type": ["string", "null"]}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"$defs": {"tag": {"type": "string", "pattern": "^[a-z]+$"}}
+	}`), &schema)
+
+	tests := []struct {
+		name     string
+		document string
+		wantErr  bool
+	}{
+		{name: "valid", document: `{"name":"x","age":3,"tags":["go"],"kind":"a","note":null}`},
+		{name: "missing required", document: `{"name":"x"}`, wantErr: true},
+		{name: "wrong type", document: `{"name":"x","age":"3"}`, wantErr: true},
+		{name: "non-integer", document: `{"name":"x","age":3.5}`, wantErr: true},
+		{name: "below minimum", document: `{"name":"x","age":-1}`, wantErr: true},
+		{name: "additional property", document: `{"name":"x","age":1,"extra":true}`, wantErr: true},
+		{name: "ref pattern mismatch", document: `{"name":"x","age":1,"tags":["Go"]}`, wantErr: true},
+		{name: "too many items", document: `{"name":"x","age":1,"tags":["a","b","c"]}`, wantErr: true},
+		{name: "enum mismatch", document: `{"name":"x","age":1,"kind":"c"}`, wantErr: true},
+		{name: "empty string", document: `{"name":"","age":1}`, wantErr: true},
+		{name: "not json", document: `{`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateJSONSchema(schema, tt.document)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateJSONSchema() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateJSONSchemaCombinators(t *testing.T) {
+	var schema map[string]interface{}
+	json.Unmarshal([]byte(`{"anyOf":[{"type":"string"},{"type":"number"}],"oneOf":[{"type":"number","maximum":5},{"type":"number","minimum":3}]}`), &schema)
+
+	if err := ValidateJSONSchema(schema, `1`); err != nil {
+		t.Errorf("expected 1 to be valid: %v", err)
+	}
+	if err := ValidateJSONSchema(schema, `4`); err == nil {
+		t.Error("expected 4 to match both oneOf branches and fail")
+	}
+	if err := ValidateJSONSchema(schema, `true`); err == nil {
+		t.Error("expected boolean to fail anyOf")
+	}
+}
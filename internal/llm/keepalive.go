@@ -0,0 +1,69 @@
+package llm
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"time"
+)
+
+// defaultSSEKeepaliveInterval is how long a stream may be idle before a
+// heartbeat is sent
+const defaultSSEKeepaliveInterval = 15 * time.Second
+
+// sseHeartbeat is an SSE comment, which clients ignore
+var sseHeartbeat = []byte(": ping\n\n")
+
+// pumpSSE hands every line of an upstream SSE stream to handle until the
+// stream ends. Whenever the upstream stays silent for interval, a heartbeat
+// comment is written to w so that proxies and browsers do not drop the idle
+// connection. An interval of 0 disables heartbeats. handle and the
+// heartbeats run on the calling goroutine, so writes to w never overlap.
+func pumpSSE(w http.ResponseWriter, upstream io.Reader, interval time.Duration, handle func(line []byte)) {
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(upstream)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				lines <- line
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var heartbeat <-chan time.Time
+	var timer *time.Timer
+	if interval > 0 {
+		timer = time.NewTimer(interval)
+		defer timer.Stop()
+		heartbeat = timer.C
+	}
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			handle(line)
+		case <-heartbeat:
+			w.Write(sseHeartbeat)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if timer != nil {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(interval)
+		}
+	}
+}
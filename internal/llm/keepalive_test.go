@@ -0,0 +1,36 @@
+package llm
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPumpSSEHeartbeats(t *testing.T) {
+	for _, interval := range []time.Duration{20 * time.Millisecond, 0} {
+		upstream, write := io.Pipe()
+		go func() {
+			io.WriteString(write, "data: a\n")
+			time.Sleep(100 * time.Millisecond)
+			io.WriteString(write, "data: b\n")
+			write.Close()
+		}()
+
+		w := httptest.NewRecorder()
+		pumpSSE(w, upstream, interval, func(line []byte) { w.Write(line) })
+
+		body := w.Body.String()
+		a, ping, b := strings.Index(body, "data: a"), strings.Index(body, ": ping"), strings.Index(body, "data: b")
+		if interval == 0 {
+			if ping >= 0 || a < 0 || b < 0 {
+				t.Errorf("body without heartbeats = %q", body)
+			}
+			continue
+		}
+		if a < 0 || ping < a || b < ping {
+			t.Errorf("body = %q, want a heartbeat between the two events", body)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultSettingsKey holds the settings applied to keys without their own
+const defaultSettingsKey = "*"
+
+// keyedSettings holds per-key settings such as budgets and rate limits.
+// Changes made through the admin API are written back to the settings file
+// when one is configured.
+type keyedSettings[T any] struct {
+	mu     sync.RWMutex
+	path   string
+	what   string
+	values map[string]T
+}
+
+// loadKeyedSettings reads a JSON object mapping usage keys (or "*" for every
+// other key) to settings. A missing file yields an empty table that will be
+// created on the first change.
+func loadKeyedSettings[T any](path, what string) (*keyedSettings[T], error) {
+	table := &keyedSettings[T]{path: path, what: what, values: make(map[string]T)}
+	return table, table.reload()
+}
+
+// reload re-reads the settings file. The current settings are kept if the
+// file cannot be read or parsed; a missing file clears them.
+func (t *keyedSettings[T]) reload() error {
+	if t.path == "" {
+		return nil
+	}
+	values := make(map[string]T)
+	data, err := os.ReadFile(t.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s file: %w", t.what, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &values); err != nil {
+			return fmt.Errorf("failed to parse %s file %s: %w", t.what, t.path, err)
+		}
+	}
+	t.mu.Lock()
+	t.values = values
+	t.mu.Unlock()
+	return nil
+}
+
+// lookup returns the settings of a key, falling back to the default settings
+func (t *keyedSettings[T]) lookup(key string) (T, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if value, ok := t.values[key]; ok {
+		return value, true
+	}
+	value, ok := t.values[defaultSettingsKey]
+	return value, ok
+}
+
+// snapshot returns a copy of all settings
+func (t *keyedSettings[T]) snapshot() map[string]T {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	values := make(map[string]T, len(t.values))
+	for key, value := range t.values {
+		values[key] = value
+	}
+	return values
+}
+
+// set stores or, when value is nil, removes the settings of a key
+func (t *keyedSettings[T]) set(key string, value *T) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if value == nil {
+		delete(t.values, key)
+	} else {
+		t.values[key] = *value
+	}
+	return t.saveLocked()
+}
+
+// saveLocked atomically rewrites the settings file, if any
+func (t *keyedSettings[T]) saveLocked() error {
+	if t.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(t.values, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o700); err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// serveKeyedSettings implements an admin API over a settings table:
+//
+//	GET    {prefix}        lists all settings
+//	GET    {prefix}/{key}  returns the settings of one key
+//	PUT    {prefix}/{key}  replaces them from a JSON body
+//	DELETE {prefix}/{key}  removes them
+//
+// validate checks settings before they are stored and describe renders a
+// key's settings, typically together with its current usage.
+func serveKeyedSettings[T any](w http.ResponseWriter, r *http.Request, prefix string, table *keyedSettings[T],
+	validate func(T) error, describe func(key string, value T) (interface{}, error)) {
+	key := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	writeDescription := func(key string, value T) {
+		out, err := describe(key, value)
+		if err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "internal_error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		values := table.snapshot()
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		data := make([]interface{}, 0, len(keys))
+		for _, k := range keys {
+			out, err := describe(k, values[k])
+			if err != nil {
+				writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "internal_error")
+				return
+			}
+			data = append(data, out)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "list", "data": data})
+	case r.Method == http.MethodGet:
+		value, ok := table.snapshot()[key]
+		if !ok {
+			writeOpenAIError(w, http.StatusNotFound, "no settings for key "+key, "invalid_request_error")
+			return
+		}
+		writeDescription(key, value)
+	case r.Method == http.MethodPut && key != "":
+		var value T
+		if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+			if utils.IsRequestBodyTooLarge(err) {
+				writeBodyError(w, err)
+				return
+			}
+			writeOpenAIError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), "invalid_request_error")
+			return
+		}
+		if err := validate(value); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+			return
+		}
+		if err := table.set(key, &value); err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, "failed to save settings: "+err.Error(), "internal_error")
+			return
+		}
+		writeDescription(key, value)
+	case r.Method == http.MethodDelete && key != "":
+		if err := table.set(key, nil); err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, "failed to save settings: "+err.Error(), "internal_error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+	}
+}
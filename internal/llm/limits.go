@@ -0,0 +1,161 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RateLimit limits how fast an API key may use the proxy across all models
+// and how many requests it may have in flight. A zero limit is unlimited.
+// The per-minute limits are token buckets that refill continuously; the
+// bursts set how much a key may use at once after being idle and default
+// to one minute's worth. The input and output token limits count prompt and
+// completion tokens on their own.
+type RateLimit struct {
+	RequestsPerMinute     int `json:"requests_per_minute,omitempty"`
+	RequestBurst          int `json:"request_burst,omitempty"`
+	TokensPerMinute       int `json:"tokens_per_minute,omitempty"`
+	TokenBurst            int `json:"token_burst,omitempty"`
+	InputTokensPerMinute  int `json:"input_tokens_per_minute,omitempty"`
+	OutputTokensPerMinute int `json:"output_tokens_per_minute,omitempty"`
+	TokensPerDay          int `json:"tokens_per_day,omitempty"`
+	MaxConcurrentRequests int `json:"max_concurrent_requests,omitempty"`
+}
+
+// loadRateLimits reads the per-key rate limits from a JSON file such as
+// {"3": {"requests_per_minute": 10}, "*": {"tokens_per_day": 2000000}}
+func loadRateLimits(path string) (*keyedSettings[RateLimit], error) {
+	return loadKeyedSettings[RateLimit](path, "rate limits")
+}
+
+// keyUsage is a key's usage across all models in the current minute and
+// day, and its requests in flight
+type keyUsage struct {
+	RequestsThisMinute     int `json:"requests_this_minute"`
+	TokensThisMinute       int `json:"tokens_this_minute"`
+	InputTokensThisMinute  int `json:"input_tokens_this_minute"`
+	OutputTokensThisMinute int `json:"output_tokens_this_minute"`
+	TokensThisDay          int `json:"tokens_this_day"`
+	InFlightRequests       int `json:"in_flight_requests"`
+}
+
+// currentKeyUsage sums a key's usage over all models
+func (s *Service) currentKeyUsage(key string) (keyUsage, error) {
+	usage := keyUsage{InFlightRequests: s.concurrency.inFlight(key)}
+	if s.usage == nil {
+		return usage, nil
+	}
+	now := time.Now()
+	minute, err := s.usage.Aggregate(now.Truncate(time.Minute), key)
+	if err != nil {
+		return usage, err
+	}
+	for _, agg := range minute {
+		usage.RequestsThisMinute += agg.Requests
+		usage.TokensThisMinute += agg.TotalTokens
+		usage.InputTokensThisMinute += agg.InputTokens
+		usage.OutputTokensThisMinute += agg.OutputTokens
+	}
+	day, err := s.usage.Aggregate(s.config.startOfDay(now), key)
+	if err != nil {
+		return usage, err
+	}
+	for _, agg := range day {
+		usage.TokensThisDay += agg.TotalTokens
+	}
+	return usage, nil
+}
+
+// checkKeyRateLimit enforces the rate limit of a user's key, of the key's
+// tenant and the key's share of the global quota
+func (s *Service) checkKeyRateLimit(userID uint64) error {
+	if err := s.checkTenantRateLimit(userID); err != nil {
+		return err
+	}
+	if err := s.checkDynamicRateLimit(userID); err != nil {
+		return err
+	}
+	if s.rateLimits == nil {
+		return nil
+	}
+	key := usageKeyForUser(userID)
+	limit, ok := s.rateLimits.lookup(key)
+	if !ok {
+		return nil
+	}
+	if err := s.limiter.check(key, limit, time.Now()); err != nil {
+		return err
+	}
+	if limit.TokensPerDay <= 0 {
+		return nil
+	}
+	usage, err := s.currentKeyUsage(key)
+	if err != nil {
+		return err
+	}
+	if usage.TokensThisDay >= limit.TokensPerDay {
+		return &retryAfterError{
+			err:        fmt.Errorf("%w: maximum tokens_per_day reached", ErrRateLimitExceeded),
+			retryAfter: time.Until(s.config.startOfDay(time.Now()).AddDate(0, 0, 1)),
+		}
+	}
+	return nil
+}
+
+// recordKeyRateLimit takes a completed request and its tokens from the
+// buckets of a user's key and of the key's tenant
+func (s *Service) recordKeyRateLimit(userID uint64, usage models.TokenUsage) {
+	s.recordTenantRateLimit(userID, usage)
+	if s.rateLimits == nil {
+		return
+	}
+	key := usageKeyForUser(userID)
+	if limit, ok := s.rateLimits.lookup(key); ok {
+		s.limiter.record(key, limit, usage, time.Now())
+	}
+}
+
+// rateLimitStatus is a rate limit together with the key's current usage, as
+// returned by the admin limits API
+type rateLimitStatus struct {
+	Key string `json:"key"`
+	RateLimit
+	Usage keyUsage `json:"usage"`
+}
+
+// rateLimitStatus combines a rate limit with the key's current usage. The
+// usage of the default limit is not attributed to a single key and is zero.
+func (s *Service) rateLimitStatus(key string, limit RateLimit) (interface{}, error) {
+	status := rateLimitStatus{Key: key, RateLimit: limit}
+	if key == defaultSettingsKey {
+		return status, nil
+	}
+	usage, err := s.currentKeyUsage(key)
+	status.Usage = usage
+	return status, err
+}
+
+// HandleLimits serves the admin rate limits API under /admin/limits: GET
+// lists limits with current usage and GET, PUT and DELETE on
+// /admin/limits/{key} read, set and remove the limits of one key. Changes
+// apply to the next request. The key "*" is the default for keys without
+// their own limits. Callers must protect the handler with the admin token.
+func (s *ServerState) HandleLimits(w http.ResponseWriter, r *http.Request) {
+	if s.Service.rateLimits == nil {
+		writeOpenAIError(w, http.StatusNotFound, "rate limits are disabled", "invalid_request_error")
+		return
+	}
+	serveKeyedSettings(w, r, "/admin/limits", s.Service.rateLimits, validateRateLimit, s.Service.rateLimitStatus)
+}
+
+// validateRateLimit checks a rate limit set through the admin API
+func validateRateLimit(limit RateLimit) error {
+	if limit.RequestsPerMinute < 0 || limit.RequestBurst < 0 || limit.TokensPerMinute < 0 || limit.TokenBurst < 0 ||
+		limit.InputTokensPerMinute < 0 || limit.OutputTokensPerMinute < 0 || limit.TokensPerDay < 0 || limit.MaxConcurrentRequests < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	return nil
+}
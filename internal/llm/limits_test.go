@@ -0,0 +1,98 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckKeyRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   RateLimit
+		wantErr error
+	}{
+		{"unlimited", RateLimit{}, nil},
+		{"requests per minute", RateLimit{RequestsPerMinute: 2}, ErrRateLimitExceeded},
+		{"requests below limit", RateLimit{RequestsPerMinute: 3}, nil},
+		{"tokens per minute", RateLimit{TokensPerMinute: 300}, ErrRateLimitExceeded},
+		{"tokens per day", RateLimit{TokensPerDay: 300}, ErrRateLimitExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits, _ := loadRateLimits("")
+			limits.set("1", &tt.limit)
+			s := &Service{config: &Config{}, usage: newUsageLedger(), rateLimits: limits}
+			s.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 100, Output: 100})
+			s.RecordUsage(1, "claude-3.5-sonnet", models.TokenUsage{Input: 100, Output: 100})
+
+			if err := s.checkKeyRateLimit(1); !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkKeyRateLimit() error = %v, want %v", err, tt.wantErr)
+			}
+			// Other keys are not limited
+			if err := s.checkKeyRateLimit(2); err != nil {
+				t.Errorf("checkKeyRateLimit(other key) error = %v", err)
+			}
+		})
+	}
+}
+
+func TestHandleCompletionEnforcesKeyRateLimit(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	upstream := newSSEUpstream(t, `{"choices":[{"delta":{"content":"hi"}}]}`)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	state.Service.rateLimits, _ = loadRateLimits("")
+	state.Service.rateLimits.set(defaultSettingsKey, &RateLimit{RequestsPerMinute: 1})
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`))
+		state.HandleCompletion(w, req)
+		return w
+	}
+	if w := send(); w.Code != http.StatusOK {
+		t.Fatalf("first request status = %d: %s", w.Code, w.Body.String())
+	}
+	w := send()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), `"code":"rate_limit_exceeded"`) {
+		t.Errorf("status = %d, Retry-After = %q, body = %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+}
+
+func TestHandleLimits(t *testing.T) {
+	limits, _ := loadRateLimits("")
+	state := &ServerState{Service: &Service{config: &Config{}, usage: newUsageLedger(), rateLimits: limits}}
+	state.Service.RecordUsage(7, "gpt-4o", models.TokenUsage{Input: 10, Output: 5})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		state.HandleLimits(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	if w := do("PUT", "/admin/limits/7", `{"requests_per_minute": 30}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/admin/limits/7", `{"tokens_per_day": -5}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT negative limit status = %d, want 400", w.Code)
+	}
+
+	w := do("GET", "/admin/limits/7", "")
+	var status rateLimitStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("GET = %s: %v", w.Body.String(), err)
+	}
+	if status.RequestsPerMinute != 30 || status.Usage.RequestsThisMinute != 1 || status.Usage.TokensThisDay != 15 {
+		t.Errorf("limit status = %+v", status)
+	}
+	if limit, ok := limits.lookup("7"); !ok || limit.RequestsPerMinute != 30 {
+		t.Errorf("runtime limit = %+v, %v", limit, ok)
+	}
+}
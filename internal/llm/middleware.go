@@ -0,0 +1,115 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// RequestMutator inspects or rewrites a decoded chat completion request
+// before it is forwarded. An error rejects the request with 400.
+type RequestMutator func(r *http.Request, request map[string]interface{}) error
+
+// ResponseFilter inspects or rewrites a non-streaming chat.completion
+// response before it is written. An error fails the request with 502.
+type ResponseFilter func(r *http.Request, response map[string]interface{}) error
+
+// ChunkTransformer inspects or rewrites a chat.completion.chunk of a
+// streaming response. Returning a nil chunk drops it from the stream; an
+// error ends the stream with an SSE error event.
+type ChunkTransformer func(r *http.Request, chunk map[string]interface{}) (map[string]interface{}, error)
+
+// middleware are the hooks integrators register on a ServerState; they run
+// in registration order
+type middleware struct {
+	mu                sync.RWMutex
+	requestMutators   []RequestMutator
+	responseFilters   []ResponseFilter
+	chunkTransformers []ChunkTransformer
+}
+
+// UseRequestMutator registers a hook that runs on every chat completion
+// request after prompt templates are expanded, e.g. to log or redact
+// messages or to rewrite parameters.
+func (s *ServerState) UseRequestMutator(m RequestMutator) {
+	s.middleware.mu.Lock()
+	defer s.middleware.mu.Unlock()
+	s.middleware.requestMutators = append(s.middleware.requestMutators, m)
+}
+
+// UseResponseFilter registers a hook that runs on every non-streaming chat
+// completion response, including responses served from the cache.
+func (s *ServerState) UseResponseFilter(f ResponseFilter) {
+	s.middleware.mu.Lock()
+	defer s.middleware.mu.Unlock()
+	s.middleware.responseFilters = append(s.middleware.responseFilters, f)
+}
+
+// UseChunkTransformer registers a hook that runs on every chunk of a
+// streaming chat completion response.
+func (s *ServerState) UseChunkTransformer(t ChunkTransformer) {
+	s.middleware.mu.Lock()
+	defer s.middleware.mu.Unlock()
+	s.middleware.chunkTransformers = append(s.middleware.chunkTransformers, t)
+}
+
+// mutateRequest runs the request mutators on a chat completion request
+func (s *ServerState) mutateRequest(r *http.Request, request map[string]interface{}) error {
+	s.middleware.mu.RLock()
+	mutators := s.middleware.requestMutators
+	s.middleware.mu.RUnlock()
+	for _, m := range mutators {
+		if err := m(r, request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterResponse runs the response filters on a chat.completion response
+func (s *ServerState) filterResponse(r *http.Request, response map[string]interface{}) error {
+	s.middleware.mu.RLock()
+	filters := s.middleware.responseFilters
+	s.middleware.mu.RUnlock()
+	for _, f := range filters {
+		if err := f(r, response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transformStreamLine runs the chunk transformers on an SSE line. Lines that
+// are not data chunks, like blank lines, comments and [DONE], pass as they
+// are; a dropped chunk yields no line.
+func (s *ServerState) transformStreamLine(r *http.Request, line []byte) ([]byte, error) {
+	s.middleware.mu.RLock()
+	transformers := s.middleware.chunkTransformers
+	s.middleware.mu.RUnlock()
+	if len(transformers) == 0 || !bytes.HasPrefix(line, []byte("data: ")) {
+		return line, nil
+	}
+	data := bytes.TrimSpace(line[len("data: "):])
+	if bytes.Equal(data, []byte("[DONE]")) {
+		return line, nil
+	}
+	var chunk map[string]interface{}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return line, nil
+	}
+	for _, t := range transformers {
+		var err error
+		if chunk, err = t(r, chunk); err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			return nil, nil
+		}
+	}
+	out, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte("data: "), out...), '\n'), nil
+}
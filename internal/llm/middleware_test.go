@@ -0,0 +1,84 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	upstream := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		upstream <- body
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"secret\"}}]}\n\n"+
+			"data: {\"choices\":[{\"delta\":{\"content\":\" ok\"}}]}\n\n"+
+			"data: [DONE]\n\n")
+	}))
+	defer server.Close()
+	state := newTestServerState(server)
+
+	state.UseRequestMutator(func(r *http.Request, request map[string]interface{}) error {
+		if request["user"] == "blocked" {
+			return errors.New("user is blocked")
+		}
+		request["temperature"] = 0.0
+		return nil
+	})
+	state.UseResponseFilter(func(r *http.Request, response map[string]interface{}) error {
+		message := response["choices"].([]map[string]interface{})[0]["message"].(map[string]interface{})
+		message["content"] = strings.ReplaceAll(message["content"].(string), "secret", "[redacted]")
+		return nil
+	})
+	state.UseChunkTransformer(func(r *http.Request, chunk map[string]interface{}) (map[string]interface{}, error) {
+		choices := chunk["choices"].([]interface{})
+		delta := choices[0].(map[string]interface{})["delta"].(map[string]interface{})
+		if delta["content"] == "secret" {
+			return nil, nil
+		}
+		return chunk, nil
+	})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		return w
+	}
+
+	t.Run("request mutator and response filter", func(t *testing.T) {
+		w := post(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		if got := (<-upstream)["temperature"]; got != 0.0 {
+			t.Errorf("upstream temperature = %v, want the mutator's 0", got)
+		}
+		if !strings.Contains(w.Body.String(), `"content":"[redacted] ok"`) {
+			t.Errorf("body = %s, want the filtered content", w.Body.String())
+		}
+	})
+
+	t.Run("request mutator rejects", func(t *testing.T) {
+		w := post(`{"model":"test-model","user":"blocked","messages":[]}`)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "user is blocked") {
+			t.Errorf("status = %d, body = %s, want 400", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("chunk transformer", func(t *testing.T) {
+		w := post(`{"model":"test-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+		<-upstream
+		body := w.Body.String()
+		if strings.Contains(body, "secret") || !strings.Contains(body, `" ok"`) || !strings.Contains(body, "[DONE]") {
+			t.Errorf("stream = %q, want the secret chunk dropped", body)
+		}
+	})
+}
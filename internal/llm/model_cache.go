@@ -0,0 +1,133 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"log"
+	"time"
+)
+
+// defaultModelCacheTTL is used when MODEL_CACHE_TTL is unset or invalid
+const defaultModelCacheTTL = 30 * time.Minute
+
+// modelCacheTTL returns the configured model catalog TTL
+func (s *Service) modelCacheTTL() time.Duration {
+	if s.config.ModelCacheTTL <= 0 {
+		return defaultModelCacheTTL
+	}
+	return s.config.ModelCacheTTL
+}
+
+// ensureAuthAndModels ensures the API key is valid and models are cached.
+//
+// A cold cache is filled synchronously. Once the catalog has been fetched,
+// expired entries keep being served while a single background refresh
+// revalidates them, so the upstream round-trip stays off the request path.
+func (s *Service) ensureAuthAndModels() error {
+	s.authMu.Lock()
+	if len(s.modelsCache) > 0 {
+		if time.Since(s.lastAuthTime) >= s.modelCacheTTL() && !s.refreshing {
+			s.refreshing = true
+			go s.revalidateModels()
+		}
+		s.authMu.Unlock()
+		return nil
+	}
+	s.authMu.Unlock()
+
+	models, err := s.loadModelsShared()
+	if err != nil {
+		return err
+	}
+	s.storeModels(models)
+	return nil
+}
+
+// cachedModels returns the current model catalog
+func (s *Service) cachedModels() []models.LanguageModel {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	return s.modelsCache
+}
+
+// storeModels replaces the cached model catalog
+func (s *Service) storeModels(models []models.LanguageModel) {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	s.modelsCache = models
+	s.lastAuthTime = time.Now()
+}
+
+// revalidateModels refreshes the model cache in the background. On failure
+// the stale catalog is kept and the next request triggers another attempt.
+func (s *Service) revalidateModels() {
+	models, err := s.loadModelsShared()
+
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	s.refreshing = false
+	if err != nil {
+		log.Printf("Warning: background model refresh failed: %v", err)
+		return
+	}
+	s.modelsCache = models
+	s.lastAuthTime = time.Now()
+}
+
+// modelFetch is an upstream model list fetch shared by concurrent callers
+type modelFetch struct {
+	done   chan struct{}
+	models []models.LanguageModel
+	err    error
+}
+
+// loadModelsShared calls loadModels, coalescing concurrent calls so that only
+// one upstream fetch is in flight and every caller receives its result.
+func (s *Service) loadModelsShared() ([]models.LanguageModel, error) {
+	s.fetchMu.Lock()
+	if f := s.inflight; f != nil {
+		s.fetchMu.Unlock()
+		<-f.done
+		return f.models, f.err
+	}
+	f := &modelFetch{done: make(chan struct{})}
+	s.inflight = f
+	s.fetchMu.Unlock()
+
+	f.models, f.err = s.loadModels()
+
+	s.fetchMu.Lock()
+	s.inflight = nil
+	s.fetchMu.Unlock()
+	close(f.done)
+	return f.models, f.err
+}
+
+// loadModels fetches the live model list of every provider.
+func (s *Service) loadModels() ([]models.LanguageModel, error) {
+	return s.listProviderModels(context.Background())
+}
+
+// StartModelRefresher periodically refreshes the model cache until ctx is
+// canceled, so that the catalog rarely expires on the request path.
+func (s *Service) StartModelRefresher(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.modelCacheTTL())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.authMu.Lock()
+				if s.refreshing {
+					s.authMu.Unlock()
+					continue
+				}
+				s.refreshing = true
+				s.authMu.Unlock()
+				s.revalidateModels()
+			}
+		}
+	}()
+}
@@ -0,0 +1,142 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCountingModelsUpstream wraps newModelsUpstream and counts /models fetches
+func newCountingModelsUpstream(t *testing.T, hits *int32) *httptest.Server {
+	t.Helper()
+	inner := newModelsUpstream(t)
+	t.Cleanup(inner.Close)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		inner.Config.Handler.ServeHTTP(w, r)
+	}))
+}
+
+func newCacheTestService(upstream *httptest.Server, cache []models.LanguageModel, fetchedAt time.Time) *Service {
+	return &Service{
+		config: &Config{
+			CopilotAPIKey: "test-key;proxy-ep=" + upstream.URL,
+			ModelCacheTTL: time.Minute,
+		},
+		httpClient:   upstream.Client(),
+		usage:        newUsageLedger(),
+		modelsCache:  cache,
+		lastAuthTime: fetchedAt,
+	}
+}
+
+func cachedModelIDs(s *Service) []string {
+	cache := s.cachedModels()
+	ids := make([]string, len(cache))
+	for i, m := range cache {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+func TestEnsureAuthAndModelsColdCache(t *testing.T) {
+	var hits int32
+	upstream := newCountingModelsUpstream(t, &hits)
+	defer upstream.Close()
+
+	s := newCacheTestService(upstream, nil, time.Time{})
+	if err := s.ensureAuthAndModels(); err != nil {
+		t.Fatalf("ensureAuthAndModels() error = %v", err)
+	}
+	if ids := cachedModelIDs(s); len(ids) != 2 || ids[0] != "gpt-4o" {
+		t.Errorf("cache = %v, want upstream models", ids)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("upstream fetches = %d, want 1", n)
+	}
+}
+
+func TestEnsureAuthAndModelsFreshCache(t *testing.T) {
+	var hits int32
+	upstream := newCountingModelsUpstream(t, &hits)
+	defer upstream.Close()
+
+	cache := []models.LanguageModel{{ID: "cached-model", Enabled: true}}
+	s := newCacheTestService(upstream, cache, time.Now())
+	if err := s.ensureAuthAndModels(); err != nil {
+		t.Fatalf("ensureAuthAndModels() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("upstream fetches = %d, want 0 for a fresh cache", n)
+	}
+}
+
+func TestEnsureAuthAndModelsStaleWhileRevalidate(t *testing.T) {
+	var hits int32
+	upstream := newCountingModelsUpstream(t, &hits)
+	defer upstream.Close()
+
+	cache := []models.LanguageModel{{ID: "cached-model", Enabled: true}}
+	s := newCacheTestService(upstream, cache, time.Now().Add(-time.Hour))
+	if err := s.ensureAuthAndModels(); err != nil {
+		t.Fatalf("ensureAuthAndModels() error = %v", err)
+	}
+	// The stale catalog is served while the refresh runs
+	if err := s.ensureAuthAndModels(); err != nil {
+		t.Fatalf("ensureAuthAndModels() error = %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ids := cachedModelIDs(s)
+		if len(ids) == 2 && ids[0] == "gpt-4o" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cache = %v, background refresh did not complete", ids)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("upstream fetches = %d, want a single background refresh", n)
+	}
+}
+
+func TestEnsureAuthAndModelsCoalescesColdFetches(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	inner := newModelsUpstream(t)
+	defer inner.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		inner.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	s := newCacheTestService(upstream, nil, time.Time{})
+	const callers = 10
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() { errs <- s.ensureAuthAndModels() }()
+	}
+	// Let every caller join the in-flight fetch before it completes
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("ensureAuthAndModels() error = %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("upstream fetches = %d, want 1", n)
+	}
+	if ids := cachedModelIDs(s); len(ids) != 2 {
+		t.Errorf("cache = %v, want upstream models", ids)
+	}
+}
@@ -0,0 +1,147 @@
+package llm
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// modelFilter selects models of /v1/models by the query parameters
+// capability, vision, tools, family, provider and min_context_window
+type modelFilter struct {
+	capabilities     []string
+	vision           *bool
+	tools            *bool
+	families         []string
+	providers        []string
+	minContextWindow int
+}
+
+// parseModelFilter reads the model filter of a /v1/models query. Repeated
+// parameters and comma-separated values are combined: a model must have
+// every capability and match one of the families and providers.
+func parseModelFilter(query url.Values) (*modelFilter, error) {
+	var f modelFilter
+	f.capabilities = queryList(query, "capability")
+	for _, capability := range f.capabilities {
+		switch capability {
+		case "tools", "vision", "chat", "embeddings", "completion":
+		default:
+			return nil, fmt.Errorf("unknown capability %q; use tools, vision, chat, embeddings or completion", capability)
+		}
+	}
+	var err error
+	if f.vision, err = queryBool(query, "vision"); err != nil {
+		return nil, err
+	}
+	if f.tools, err = queryBool(query, "tools"); err != nil {
+		return nil, err
+	}
+	f.families = queryList(query, "family")
+	f.providers = queryList(query, "provider")
+	if value := query.Get("min_context_window"); value != "" {
+		if f.minContextWindow, err = strconv.Atoi(value); err != nil || f.minContextWindow < 0 {
+			return nil, fmt.Errorf("invalid min_context_window %q", value)
+		}
+	}
+	return &f, nil
+}
+
+// queryList returns the comma-separated values of a repeatable parameter
+func queryList(query url.Values, name string) []string {
+	var values []string
+	for _, value := range query[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
+
+// queryBool returns a boolean parameter, or nil if it is not set
+func queryBool(query url.Values, name string) (*bool, error) {
+	value := query.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q; use true or false", name, value)
+	}
+	return &b, nil
+}
+
+// match reports whether a model of the /v1/models response passes the
+// filter. Capabilities a model does not report count as unsupported.
+func (f *modelFilter) match(model map[string]interface{}) bool {
+	vision, _ := model["supports_vision"].(bool)
+	tools, _ := model["supports_tool_calls"].(bool)
+	if f.vision != nil && *f.vision != vision {
+		return false
+	}
+	if f.tools != nil && *f.tools != tools {
+		return false
+	}
+	capabilities, _ := model["capabilities"].(map[string]interface{})
+	modelType, _ := capabilities["type"].(string)
+	for _, capability := range f.capabilities {
+		switch capability {
+		case "tools":
+			if !tools {
+				return false
+			}
+		case "vision":
+			if !vision {
+				return false
+			}
+		default:
+			// Models of the other providers are chat models
+			if modelType == "" {
+				modelType = "chat"
+			}
+			if !strings.EqualFold(modelType, capability) {
+				return false
+			}
+		}
+	}
+	if len(f.families) > 0 && !matchesAny(f.families, modelFamily(model)) {
+		return false
+	}
+	if len(f.providers) > 0 {
+		provider, _ := model["provider"].(string)
+		if !matchesAny(f.providers, strings.ToLower(provider)) {
+			return false
+		}
+	}
+	if f.minContextWindow > 0 {
+		window, _ := model["context_window"].(int)
+		if window < f.minContextWindow {
+			return false
+		}
+	}
+	return true
+}
+
+// modelFamily returns the family Copilot reports for a model or, for the
+// models of the other providers, the model ID
+func modelFamily(model map[string]interface{}) string {
+	capabilities, _ := model["capabilities"].(map[string]interface{})
+	if family, ok := capabilities["family"].(string); ok && family != "" {
+		return strings.ToLower(family)
+	}
+	id, _ := model["id"].(string)
+	return strings.ToLower(id)
+}
+
+// matchesAny reports whether value is one of values
+func matchesAny(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestListModelsFilter(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"object":"list","data":[
+			{"id":"gpt-4o","capabilities":{"family":"gpt-4o","type":"chat",
+				"limits":{"max_context_window_tokens":128000},"supports":{"vision":true,"tool_calls":true}}},
+			{"id":"gpt-4o-mini","capabilities":{"family":"gpt-4o-mini","type":"chat",
+				"limits":{"max_context_window_tokens":128000},"supports":{"tool_calls":true}}},
+			{"id":"o3-mini","capabilities":{"family":"o3-mini","type":"chat","limits":{"max_context_window_tokens":200000}}},
+			{"id":"text-embedding-3-small","capabilities":{"family":"text-embedding-3-small","type":"embeddings"}}
+		]}`)
+	}))
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	state.Service.modelsCache = append(state.Service.modelsCache,
+		models.LanguageModel{ID: "claude-3-opus", Name: "claude-3-opus", Provider: models.ProviderAnthropic, ContextWindow: 200000, Enabled: true})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"claude-3-opus", "gpt-4o", "gpt-4o-mini", "o3-mini", "text-embedding-3-small"}},
+		{"?capability=tools&vision=true&family=gpt-4o", []string{"gpt-4o"}},
+		{"?capability=tools", []string{"gpt-4o", "gpt-4o-mini"}},
+		{"?vision=false&capability=chat&provider=copilot", []string{"gpt-4o-mini", "o3-mini"}},
+		{"?capability=embeddings", []string{"text-embedding-3-small"}},
+		{"?family=gpt-4o,o3-mini", []string{"gpt-4o", "o3-mini"}},
+		{"?min_context_window=150000", []string{"claude-3-opus", "o3-mini"}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		state.HandleListModels(w, httptest.NewRequest("GET", "/v1/models"+tt.query, nil))
+		var out struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		var ids []string
+		for _, model := range out.Data {
+			ids = append(ids, model["id"].(string))
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: listed %v, want %v", tt.query, ids, tt.want)
+		}
+	}
+
+	for _, query := range []string{"?capability=telepathy", "?vision=maybe", "?min_context_window=-1"} {
+		w := httptest.NewRecorder()
+		state.HandleListModels(w, httptest.NewRequest("GET", "/v1/models"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ModelRateLimit limits how much each user may use one model. A zero limit
+// is unlimited. Unlike the token buckets of RateLimit, the per-minute
+// limits count the usage in the current clock minute.
+type ModelRateLimit struct {
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	TokensPerMinute   int `json:"tokens_per_minute,omitempty"`
+	TokensPerDay      int `json:"tokens_per_day,omitempty"`
+}
+
+// limited reports whether any limit is set
+func (l ModelRateLimit) limited() bool {
+	return l.RequestsPerMinute > 0 || l.TokensPerMinute > 0 || l.TokensPerDay > 0
+}
+
+// loadModelRateLimits reads the per-model rate limits of
+// MODEL_RATE_LIMITS_FILE, a JSON object keyed by model ID or ID prefix
+// ending in "*", e.g. {"gpt-4o": {"requests_per_minute": 30}, "claude-*":
+// {"tokens_per_day": 500000}}
+func loadModelRateLimits() map[string]ModelRateLimit {
+	limits := make(map[string]ModelRateLimit)
+	if path := os.Getenv("MODEL_RATE_LIMITS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &limits)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to load model rate limits from %s: %v", path, err)
+		}
+	}
+	return limits
+}
+
+// SetModelRateLimits atomically replaces the per-model rate limits.
+func (c *Config) SetModelRateLimits(limits map[string]ModelRateLimit) {
+	c.modelLimitsMu.Lock()
+	defer c.modelLimitsMu.Unlock()
+	c.ModelRateLimits = limits
+}
+
+// modelRateLimit returns the rate limit of a model: the configured entry of
+// its ID or, without one, of the longest matching prefix, and otherwise the
+// built-in limits of DefaultModels. ok is false for unlimited models.
+func (c *Config) modelRateLimit(model string) (limit ModelRateLimit, ok bool) {
+	for _, m := range DefaultModels() {
+		if m.ID == model || m.Name == model {
+			limit = ModelRateLimit{
+				RequestsPerMinute: m.MaxRequestsPerMinute,
+				TokensPerMinute:   m.MaxTokensPerMinute,
+				TokensPerDay:      m.MaxTokensPerDay,
+			}
+			break
+		}
+	}
+	c.modelLimitsMu.RLock()
+	defer c.modelLimitsMu.RUnlock()
+	if configured, found := c.ModelRateLimits[model]; found {
+		return configured, configured.limited()
+	}
+	bestLen := -1
+	for pattern, configured := range c.ModelRateLimits {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if prefix != pattern && strings.HasPrefix(model, prefix) && len(prefix) > bestLen {
+			limit, bestLen = configured, len(prefix)
+		}
+	}
+	return limit, limit.limited()
+}
+
+// checkModelRateLimit enforces the rate limit of a model with a user's usage
+// of it in the current minute and day
+func (s *Service) checkModelRateLimit(model string, usage models.ModelUsage) error {
+	limit, ok := s.config.modelRateLimit(model)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	nextMinute := now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+	switch {
+	case limit.RequestsPerMinute > 0 && usage.RequestsThisMinute >= limit.RequestsPerMinute:
+		return &retryAfterError{
+			err:        fmt.Errorf("%w: maximum requests_per_minute of %s reached", ErrRateLimitExceeded, model),
+			retryAfter: nextMinute,
+		}
+	case limit.TokensPerMinute > 0 && usage.TokensThisMinute >= limit.TokensPerMinute:
+		return &retryAfterError{
+			err:        fmt.Errorf("%w: maximum tokens_per_minute of %s reached", ErrRateLimitExceeded, model),
+			retryAfter: nextMinute,
+		}
+	case limit.TokensPerDay > 0 && usage.TokensThisDay >= limit.TokensPerDay:
+		return &retryAfterError{
+			err:        fmt.Errorf("%w: maximum tokens_per_day of %s reached", ErrRateLimitExceeded, model),
+			retryAfter: s.config.startOfDay(now).AddDate(0, 0, 1).Sub(now),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModelRateLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model_limits.json")
+	os.WriteFile(path, []byte(`{
+		"gpt-4o": {"requests_per_minute": 30},
+		"claude-*": {"tokens_per_day": 500000},
+		"claude-3.5-*": {"tokens_per_minute": 20000},
+		"copilot-chat": {}
+	}`), 0o600)
+	t.Setenv("MODEL_RATE_LIMITS_FILE", path)
+	c := &Config{ModelRateLimits: loadModelRateLimits()}
+
+	tests := []struct {
+		model string
+		want  ModelRateLimit
+		ok    bool
+	}{
+		{"gpt-4o", ModelRateLimit{RequestsPerMinute: 30}, true},
+		{"claude-3.7-sonnet", ModelRateLimit{TokensPerDay: 500000}, true},
+		{"claude-3.5-sonnet", ModelRateLimit{TokensPerMinute: 20000}, true},
+		// An empty entry lifts the built-in limits
+		{"copilot-chat", ModelRateLimit{}, false},
+		{"o3-mini", ModelRateLimit{}, false},
+	}
+	for _, tt := range tests {
+		if got, ok := c.modelRateLimit(tt.model); got != tt.want || ok != tt.ok {
+			t.Errorf("modelRateLimit(%s) = %+v, %v, want %+v, %v", tt.model, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// Without configuration, the limits of DefaultModels apply
+	if got, ok := (&Config{}).modelRateLimit("copilot-chat"); !ok || got.RequestsPerMinute != 25 || got.TokensPerDay != 100000 {
+		t.Errorf("default modelRateLimit(copilot-chat) = %+v, %v", got, ok)
+	}
+}
+
+func TestCheckModelRateLimit(t *testing.T) {
+	s := &Service{config: &Config{ModelRateLimits: map[string]ModelRateLimit{
+		"gpt-4o":   {RequestsPerMinute: 2, TokensPerDay: 1000},
+		"claude-*": {TokensPerMinute: 500},
+	}}, usage: newUsageLedger()}
+	s.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 10, Output: 10})
+	if err := s.checkModelRateLimit("gpt-4o", s.GetModelUsage(1, "gpt-4o")); err != nil {
+		t.Errorf("first request error = %v", err)
+	}
+	s.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 10, Output: 10})
+	err := s.checkModelRateLimit("gpt-4o", s.GetModelUsage(1, "gpt-4o"))
+	if wait, ok := retryAfter(err); !errors.Is(err, ErrRateLimitExceeded) || !strings.Contains(err.Error(), "requests_per_minute") || !ok || wait <= 0 {
+		t.Errorf("over requests_per_minute error = %v, retry after %v", err, wait)
+	}
+	// Other users and models are counted on their own
+	if err := s.checkModelRateLimit("gpt-4o", s.GetModelUsage(2, "gpt-4o")); err != nil {
+		t.Errorf("other user error = %v", err)
+	}
+
+	s.RecordUsage(1, "claude-3.5-sonnet", models.TokenUsage{Input: 400, Output: 100})
+	if err := s.checkModelRateLimit("claude-3.5-sonnet", s.GetModelUsage(1, "claude-3.5-sonnet")); err == nil || !strings.Contains(err.Error(), "tokens_per_minute") {
+		t.Errorf("over tokens_per_minute error = %v", err)
+	}
+	if err := s.checkModelRateLimit("o3-mini", s.GetModelUsage(1, "o3-mini")); err != nil {
+		t.Errorf("unlimited model error = %v", err)
+	}
+}
+
+func TestModelRateLimitCountsAliasedRequests(t *testing.T) {
+	s := &Service{config: &Config{
+		ModelAliases:    map[string]string{"fast": "gpt-4o"},
+		ModelRateLimits: map[string]ModelRateLimit{"gpt-4o": {RequestsPerMinute: 1}},
+	}, usage: newUsageLedger()}
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("data: [DONE]\n\n"))}
+	body, err := s.ProcessStreamingResponse(resp, CompletionRequest{
+		Token:           &models.LLMToken{UserID: 1},
+		Model:           "fast",
+		ProviderRequest: `{"model":"fast","messages":[{"role":"user","content":"hi"}]}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, body)
+	body.Close()
+
+	// The request through the alias counts against the model it resolves to
+	if err := s.checkModelRateLimit("gpt-4o", s.GetModelUsage(1, "gpt-4o")); !errors.Is(err, ErrRateLimitExceeded) {
+		t.Errorf("after a request through an alias error = %v, want ErrRateLimitExceeded", err)
+	}
+}
@@ -0,0 +1,118 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// ModelMetadata describes what a model can do, so that clients can pick
+// models programmatically. It is listed with every model of /v1/models.
+type ModelMetadata struct {
+	// ContextWindow is the maximum number of prompt and output tokens
+	ContextWindow int `json:"context_window,omitempty"`
+	// MaxOutputTokens is the maximum number of tokens the model generates
+	MaxOutputTokens int `json:"max_output_tokens,omitempty"`
+	// Vision reports whether the model accepts image input
+	Vision *bool `json:"supports_vision,omitempty"`
+	// ToolCalls reports whether the model supports tool calls
+	ToolCalls *bool `json:"supports_tool_calls,omitempty"`
+	// Provider is the provider that serves the model
+	Provider string `json:"provider,omitempty"`
+}
+
+// merge returns the metadata with the fields set in override replacing its own
+func (m ModelMetadata) merge(override ModelMetadata) ModelMetadata {
+	if override.ContextWindow > 0 {
+		m.ContextWindow = override.ContextWindow
+	}
+	if override.MaxOutputTokens > 0 {
+		m.MaxOutputTokens = override.MaxOutputTokens
+	}
+	if override.Vision != nil {
+		m.Vision = override.Vision
+	}
+	if override.ToolCalls != nil {
+		m.ToolCalls = override.ToolCalls
+	}
+	if override.Provider != "" {
+		m.Provider = override.Provider
+	}
+	return m
+}
+
+// apply adds the metadata to a model of the /v1/models response
+func (m ModelMetadata) apply(model map[string]interface{}) {
+	if m.ContextWindow > 0 {
+		model["context_window"] = m.ContextWindow
+	}
+	if m.MaxOutputTokens > 0 {
+		model["max_output_tokens"] = m.MaxOutputTokens
+	}
+	if m.Vision != nil {
+		model["supports_vision"] = *m.Vision
+	}
+	if m.ToolCalls != nil {
+		model["supports_tool_calls"] = *m.ToolCalls
+	}
+	if m.Provider != "" {
+		model["provider"] = m.Provider
+	}
+}
+
+// copilotModelMetadata reads the metadata of a model from the capabilities
+// object of the Copilot models response
+func copilotModelMetadata(model map[string]interface{}) ModelMetadata {
+	metadata := ModelMetadata{Provider: string(models.ProviderCopilot)}
+	capabilities, _ := model["capabilities"].(map[string]interface{})
+	limits, _ := capabilities["limits"].(map[string]interface{})
+	if n, ok := limits["max_context_window_tokens"].(float64); ok {
+		metadata.ContextWindow = int(n)
+	}
+	if n, ok := limits["max_output_tokens"].(float64); ok {
+		metadata.MaxOutputTokens = int(n)
+	}
+	supports, _ := capabilities["supports"].(map[string]interface{})
+	if v, ok := supports["vision"].(bool); ok {
+		metadata.Vision = &v
+	}
+	if v, ok := supports["tool_calls"].(bool); ok {
+		metadata.ToolCalls = &v
+	}
+	return metadata
+}
+
+// loadModelMetadata reads the model metadata overrides of
+// MODEL_METADATA_FILE, a JSON object keyed by model ID
+func loadModelMetadata() map[string]ModelMetadata {
+	overrides := make(map[string]ModelMetadata)
+	if path := os.Getenv("MODEL_METADATA_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &overrides)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to load model metadata from %s: %v", path, err)
+		}
+	}
+	return overrides
+}
+
+// SetModelMetadata atomically replaces the model metadata overrides.
+func (c *Config) SetModelMetadata(overrides map[string]ModelMetadata) {
+	c.metadataMu.Lock()
+	defer c.metadataMu.Unlock()
+	c.ModelMetadata = overrides
+}
+
+// modelMetadata returns the metadata of a model: what the provider reports,
+// with the configured overrides applied
+func (c *Config) modelMetadata(id string, reported ModelMetadata) ModelMetadata {
+	c.metadataMu.RLock()
+	defer c.metadataMu.RUnlock()
+	if override, ok := c.ModelMetadata[id]; ok {
+		return reported.merge(override)
+	}
+	return reported
+}
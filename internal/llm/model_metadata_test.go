@@ -0,0 +1,72 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListModelsMetadata(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"object":"list","data":[
+			{"id":"gpt-4o","name":"GPT-4o","vendor":"Azure OpenAI","capabilities":{
+				"limits":{"max_context_window_tokens":128000,"max_output_tokens":4096},
+				"supports":{"vision":true,"tool_calls":true,"streaming":true}}},
+			{"id":"o3-mini","name":"o3-mini","capabilities":{"limits":{"max_context_window_tokens":200000}}}
+		]}`)
+	}))
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	state.Service.modelsCache = append(state.Service.modelsCache,
+		models.LanguageModel{ID: "claude-3-opus", Name: "claude-3-opus", Provider: models.ProviderAnthropic, Enabled: true})
+
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	os.WriteFile(path, []byte(`{
+		"o3-mini": {"max_output_tokens": 100000, "supports_vision": false},
+		"claude-3-opus": {"context_window": 200000, "supports_tool_calls": true}
+	}`), 0o600)
+	os.Setenv("MODEL_METADATA_FILE", path)
+	defer os.Unsetenv("MODEL_METADATA_FILE")
+	state.Service.config.SetModelMetadata(loadModelMetadata())
+
+	w := httptest.NewRecorder()
+	state.HandleListModels(w, httptest.NewRequest("GET", "/v1/models", nil))
+	var out struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]map[string]interface{})
+	for _, model := range out.Data {
+		listed[model["id"].(string)] = model
+	}
+
+	want := map[string]map[string]interface{}{
+		"gpt-4o":        {"context_window": 128000.0, "max_output_tokens": 4096.0, "supports_vision": true, "supports_tool_calls": true, "provider": "copilot"},
+		"o3-mini":       {"context_window": 200000.0, "max_output_tokens": 100000.0, "supports_vision": false, "provider": "copilot"},
+		"claude-3-opus": {"context_window": 200000.0, "supports_tool_calls": true, "provider": "anthropic"},
+	}
+	for id, fields := range want {
+		model, ok := listed[id]
+		if !ok {
+			t.Errorf("model %s not listed", id)
+			continue
+		}
+		for field, value := range fields {
+			if model[field] != value {
+				t.Errorf("%s: %s = %v, want %v", id, field, model[field], value)
+			}
+		}
+	}
+	if _, ok := listed["o3-mini"]["supports_tool_calls"]; ok {
+		t.Errorf("o3-mini: unknown tool call support listed")
+	}
+}
@@ -0,0 +1,269 @@
+package llm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modelMetricsSamples is how many upstream calls are kept per model for the
+// latency percentiles
+const modelMetricsSamples = 1024
+
+// modelSample is one upstream call of a model
+type modelSample struct {
+	time    time.Time
+	latency time.Duration
+	// firstToken is the time to the first byte of the response body; zero
+	// for failed calls
+	firstToken time.Duration
+	failed     bool
+}
+
+// modelSeries holds the most recent calls of a model in a ring buffer and
+// counts all of them
+type modelSeries struct {
+	samples  [modelMetricsSamples]modelSample
+	next     int
+	count    int
+	requests int64
+	errors   int64
+}
+
+// modelMetrics records the latency, time to first token and errors of the
+// upstream calls per model, in memory only
+type modelMetrics struct {
+	mu     sync.Mutex
+	models map[string]*modelSeries
+}
+
+// record adds an upstream call of model
+func (m *modelMetrics) record(model string, sample modelSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.models == nil {
+		m.models = make(map[string]*modelSeries)
+	}
+	series := m.models[model]
+	if series == nil {
+		series = &modelSeries{}
+		m.models[model] = series
+	}
+	series.samples[series.next] = sample
+	series.next = (series.next + 1) % modelMetricsSamples
+	if series.count < modelMetricsSamples {
+		series.count++
+	}
+	series.requests++
+	if sample.failed {
+		series.errors++
+	}
+}
+
+// LatencyPercentiles are latency percentiles in milliseconds
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// ModelMetrics are the upstream performance of a model over the recent calls
+// the proxy keeps
+type ModelMetrics struct {
+	Model     string  `json:"model"`
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	// LatencyMs is the time from sending a request to the end of its
+	// response, of successful calls
+	LatencyMs LatencyPercentiles `json:"latency_ms"`
+	// TimeToFirstTokenMs is the time from sending a request to the first
+	// byte of its response body, of successful calls
+	TimeToFirstTokenMs LatencyPercentiles `json:"time_to_first_token_ms"`
+}
+
+// snapshot returns the metrics of the kept calls made since the given
+// time, sorted by model
+func (m *modelMetrics) snapshot(since time.Time) []ModelMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := []ModelMetrics{}
+	for model, series := range m.models {
+		metrics := ModelMetrics{Model: model}
+		var latencies, firstTokens []time.Duration
+		for i := 0; i < series.count; i++ {
+			sample := series.samples[i]
+			if sample.time.Before(since) {
+				continue
+			}
+			metrics.Requests++
+			if sample.failed {
+				metrics.Errors++
+				continue
+			}
+			latencies = append(latencies, sample.latency)
+			firstTokens = append(firstTokens, sample.firstToken)
+		}
+		if metrics.Requests == 0 {
+			continue
+		}
+		metrics.ErrorRate = float64(metrics.Errors) / float64(metrics.Requests)
+		metrics.LatencyMs = percentiles(latencies)
+		metrics.TimeToFirstTokenMs = percentiles(firstTokens)
+		result = append(result, metrics)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Model < result[j].Model })
+	return result
+}
+
+// modelTotals counts the calls of a model since the proxy started
+type modelTotals struct {
+	requests, errors int64
+}
+
+// totals returns the number of calls and failed calls per model since the
+// proxy started
+func (m *modelMetrics) totals() map[string]modelTotals {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	totals := make(map[string]modelTotals, len(m.models))
+	for model, series := range m.models {
+		totals[model] = modelTotals{requests: series.requests, errors: series.errors}
+	}
+	return totals
+}
+
+// percentiles returns the nearest-rank percentiles of durations in
+// milliseconds
+func percentiles(durations []time.Duration) LatencyPercentiles {
+	if len(durations) == 0 {
+		return LatencyPercentiles{}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	at := func(p float64) float64 {
+		rank := int(math.Ceil(p*float64(len(durations)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		return float64(durations[rank].Microseconds()) / 1000
+	}
+	return LatencyPercentiles{P50: at(0.50), P95: at(0.95), P99: at(0.99)}
+}
+
+// recordUpstreamCall records an upstream call of model started at start.
+// Failed calls are recorded at once; the latency and time to first token of
+// successful ones when the returned body is closed.
+func (s *Service) recordUpstreamCall(model string, start time.Time, resp *http.Response, err error) {
+	if err != nil || resp.StatusCode >= 400 {
+		s.modelMetrics.record(model, modelSample{time: start, latency: time.Since(start), failed: true})
+		return
+	}
+	resp.Body = &metricsBody{ReadCloser: resp.Body, metrics: &s.modelMetrics, model: model, start: start}
+}
+
+// metricsBody measures the time to the first byte and the end of an upstream
+// response body
+type metricsBody struct {
+	io.ReadCloser
+	metrics *modelMetrics
+	model   string
+	start   time.Time
+
+	mu         sync.Mutex
+	firstToken time.Duration
+	failed     bool
+	done       bool
+}
+
+func (b *metricsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if n > 0 && b.firstToken == 0 {
+		b.firstToken = time.Since(b.start)
+	}
+	if err != nil && err != io.EOF {
+		b.failed = true
+	}
+	b.mu.Unlock()
+	return n, err
+}
+
+func (b *metricsBody) Close() error {
+	b.mu.Lock()
+	if !b.done {
+		b.done = true
+		b.metrics.record(b.model, modelSample{
+			time:       b.start,
+			latency:    time.Since(b.start),
+			firstToken: b.firstToken,
+			failed:     b.failed,
+		})
+	}
+	b.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// ModelMetrics returns the upstream latency, time to first token and error
+// rate per model of the chat completion calls since the given time, out of
+// the most recent calls kept per model
+func (s *Service) ModelMetrics(since time.Time) []ModelMetrics {
+	return s.modelMetrics.snapshot(since)
+}
+
+// HandleMetrics serves GET /admin/metrics: the per-model upstream metrics in
+// the Prometheus text format, as counters since the proxy started and gauges
+// of the percentiles and error ratio of the calls kept per model. Callers
+// must protect the handler with the admin token.
+func (s *ServerState) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	var b strings.Builder
+	totals := s.Service.modelMetrics.totals()
+	snapshot := s.Service.ModelMetrics(time.Time{})
+
+	b.WriteString("# HELP copilot_proxy_upstream_requests_total Upstream chat completion calls per model.\n")
+	b.WriteString("# TYPE copilot_proxy_upstream_requests_total counter\n")
+	for _, m := range snapshot {
+		fmt.Fprintf(&b, "copilot_proxy_upstream_requests_total{model=%q} %d\n", m.Model, totals[m.Model].requests)
+	}
+	b.WriteString("# HELP copilot_proxy_upstream_errors_total Failed upstream chat completion calls per model.\n")
+	b.WriteString("# TYPE copilot_proxy_upstream_errors_total counter\n")
+	for _, m := range snapshot {
+		fmt.Fprintf(&b, "copilot_proxy_upstream_errors_total{model=%q} %d\n", m.Model, totals[m.Model].errors)
+	}
+	b.WriteString("# HELP copilot_proxy_upstream_error_ratio Share of failed calls among the recent upstream calls per model.\n")
+	b.WriteString("# TYPE copilot_proxy_upstream_error_ratio gauge\n")
+	for _, m := range snapshot {
+		fmt.Fprintf(&b, "copilot_proxy_upstream_error_ratio{model=%q} %g\n", m.Model, m.ErrorRate)
+	}
+	writeQuantiles(&b, "copilot_proxy_upstream_latency_seconds", "Time from sending an upstream call to the end of its response.",
+		snapshot, func(m ModelMetrics) LatencyPercentiles { return m.LatencyMs })
+	writeQuantiles(&b, "copilot_proxy_upstream_time_to_first_token_seconds", "Time from sending an upstream call to the first byte of its response.",
+		snapshot, func(m ModelMetrics) LatencyPercentiles { return m.TimeToFirstTokenMs })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, b.String())
+}
+
+// writeQuantiles writes a gauge of the latency percentiles per model
+func writeQuantiles(b *strings.Builder, name, help string, snapshot []ModelMetrics, value func(ModelMetrics) LatencyPercentiles) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, m := range snapshot {
+		p := value(m)
+		for _, q := range []struct {
+			quantile string
+			ms       float64
+		}{{"0.5", p.P50}, {"0.95", p.P95}, {"0.99", p.P99}} {
+			fmt.Fprintf(b, "%s{model=%q,quantile=%q} %g\n", name, m.Model, q.quantile, q.ms/1000)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModelMetricsSnapshot(t *testing.T) {
+	var m modelMetrics
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		m.record("gpt-4o", modelSample{time: now, latency: time.Duration(i) * time.Millisecond, firstToken: time.Duration(i) * time.Microsecond * 100})
+	}
+	m.record("gpt-4o", modelSample{time: now, latency: time.Second, failed: true})
+	m.record("gpt-4o", modelSample{time: now.Add(-2 * time.Hour), latency: time.Minute})
+	m.record("claude-3.5-sonnet", modelSample{time: now, latency: 5 * time.Millisecond})
+
+	snapshot := m.snapshot(now.Add(-time.Hour))
+	if len(snapshot) != 2 || snapshot[0].Model != "claude-3.5-sonnet" || snapshot[1].Model != "gpt-4o" {
+		t.Fatalf("snapshot = %+v", snapshot)
+	}
+	gpt := snapshot[1]
+	if gpt.Requests != 101 || gpt.Errors != 1 || gpt.ErrorRate != 1.0/101 {
+		t.Errorf("counts = %d requests, %d errors, %g error rate", gpt.Requests, gpt.Errors, gpt.ErrorRate)
+	}
+	if gpt.LatencyMs != (LatencyPercentiles{P50: 50, P95: 95, P99: 99}) {
+		t.Errorf("latency = %+v", gpt.LatencyMs)
+	}
+	if gpt.TimeToFirstTokenMs != (LatencyPercentiles{P50: 5, P95: 9.5, P99: 9.9}) {
+		t.Errorf("time to first token = %+v", gpt.TimeToFirstTokenMs)
+	}
+	if totals := m.totals()["gpt-4o"]; totals.requests != 102 || totals.errors != 1 {
+		t.Errorf("totals = %+v", totals)
+	}
+
+	// Only the most recent calls are kept for the percentiles
+	for i := 0; i < modelMetricsSamples; i++ {
+		m.record("gpt-4o", modelSample{time: now, latency: time.Millisecond})
+	}
+	if gpt := m.snapshot(time.Time{})[1]; gpt.Requests != modelMetricsSamples || gpt.LatencyMs.P99 != 1 {
+		t.Errorf("after %d more calls: %+v", modelMetricsSamples, gpt)
+	}
+}
+
+func TestUpstreamMetrics(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	fail := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	body := `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`
+	state.HandleCompletion(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	fail = true
+	state.HandleCompletion(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+
+	w := httptest.NewRecorder()
+	state.HandleUsage(w, httptest.NewRequest("GET", "/v1/usage", nil))
+	var usage struct {
+		Models []ModelMetrics `json:"models"`
+	}
+	json.NewDecoder(w.Body).Decode(&usage)
+	if len(usage.Models) != 1 || usage.Models[0].Model != "test-model" || usage.Models[0].Requests != 2 ||
+		usage.Models[0].Errors != 1 || usage.Models[0].LatencyMs.P50 <= 0 || usage.Models[0].TimeToFirstTokenMs.P50 <= 0 {
+		t.Errorf("usage models = %+v", usage.Models)
+	}
+
+	w = httptest.NewRecorder()
+	state.HandleMetrics(w, httptest.NewRequest("GET", "/admin/metrics", nil))
+	for _, line := range []string{
+		`copilot_proxy_upstream_requests_total{model="test-model"} 2`,
+		`copilot_proxy_upstream_errors_total{model="test-model"} 1`,
+		`copilot_proxy_upstream_error_ratio{model="test-model"} 0.5`,
+		`copilot_proxy_upstream_latency_seconds{model="test-model",quantile="0.99"} `,
+		`copilot_proxy_upstream_time_to_first_token_seconds{model="test-model",quantile="0.5"} `,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("metrics lack %q:\n%s", line, w.Body.String())
+		}
+	}
+}
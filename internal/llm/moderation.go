@@ -0,0 +1,194 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// builtinModerationModel is reported as the model of built-in moderation results
+const builtinModerationModel = "text-moderation-builtin"
+
+// moderationCategories lists the OpenAI moderation categories in response order
+var moderationCategories = []string{
+	"harassment",
+	"harassment/threatening",
+	"hate",
+	"hate/threatening",
+	"self-harm",
+	"self-harm/intent",
+	"self-harm/instructions",
+	"sexual",
+	"sexual/minors",
+	"violence",
+	"violence/graphic",
+}
+
+// moderationRules are the keyword patterns of the built-in classifier.
+// They are intentionally conservative: the goal is to give clients that call
+// moderations before chat a sensible answer, not to replace a real classifier.
+var moderationRules = map[string][]*regexp.Regexp{
+	"harassment": {
+		regexp.MustCompile(`(?i)\b(you are|you're) (worthless|pathetic|disgusting)\b`),
+		regexp.MustCompile(`(?i)\bnobody (likes|wants) you\b`),
+	},
+	"harassment/threatening": {
+		regexp.MustCompile(`(?i)\bi('m| am| will) (going to )?(find|hurt|kill) you\b`),
+	},
+	"hate": {
+		regexp.MustCompile(`(?i)\b(all|those) \w+ (should|must) (die|be exterminated)\b`),
+	},
+	"hate/threatening": {
+		regexp.MustCompile(`(?i)\bexterminate (all|every) \w+\b`),
+	},
+	"self-harm": {
+		regexp.MustCompile(`(?i)\b(cut|hurt|harm) myself\b`),
+	},
+	"self-harm/intent": {
+		regexp.MustCompile(`(?i)\bi (want|plan|am going) to (kill myself|end my life|commit suicide)\b`),
+	},
+	"self-harm/instructions": {
+		regexp.MustCompile(`(?i)\bhow (to|do i) (kill myself|commit suicide)\b`),
+	},
+	"sexual": {
+		regexp.MustCompile(`(?i)\b(explicit sex|pornograph(y|ic))\b`),
+	},
+	"sexual/minors": {
+		regexp.MustCompile(`(?i)\b(child|minor|underage)\s+(porn|sexual)\w*\b`),
+	},
+	"violence": {
+		regexp.MustCompile(`(?i)\bhow (to|do i) (make|build) (a )?(bomb|explosive)s?\b`),
+		regexp.MustCompile(`(?i)\b(kill|murder|shoot|stab) (him|her|them|people)\b`),
+	},
+	"violence/graphic": {
+		regexp.MustCompile(`(?i)\b(dismember|disembowel|decapitat)\w*\b`),
+	},
+}
+
+// ModerationResult is a single OpenAI moderation result
+type ModerationResult struct {
+	Flagged        bool               `json:"flagged"`
+	Categories     map[string]bool    `json:"categories"`
+	CategoryScores map[string]float64 `json:"category_scores"`
+}
+
+// ClassifyText runs the built-in rule-based classifier on a text
+func ClassifyText(text string) ModerationResult {
+	result := ModerationResult{
+		Categories:     make(map[string]bool, len(moderationCategories)),
+		CategoryScores: make(map[string]float64, len(moderationCategories)),
+	}
+	for _, category := range moderationCategories {
+		matches := 0
+		for _, rule := range moderationRules[category] {
+			matches += len(rule.FindAllStringIndex(text, -1))
+		}
+		// Each additional match halves the remaining distance to 1.0
+		score := 1 - math.Pow(0.5, float64(matches))
+		result.CategoryScores[category] = score
+		result.Categories[category] = matches > 0
+		if matches > 0 {
+			result.Flagged = true
+		}
+	}
+	return result
+}
+
+// moderationInputs extracts the texts to classify from a moderation input field,
+// which may be a string, an array of strings, or an array of text content parts.
+func moderationInputs(input interface{}) ([]string, error) {
+	switch v := input.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		texts := make([]string, 0, len(v))
+		for _, item := range v {
+			switch it := item.(type) {
+			case string:
+				texts = append(texts, it)
+			case map[string]interface{}:
+				if text, ok := it["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			default:
+				return nil, fmt.Errorf("input items must be strings or text parts")
+			}
+		}
+		return texts, nil
+	}
+	return nil, fmt.Errorf("input must be a string or an array")
+}
+
+// HandleModerations serves /v1/moderations. When MODERATION_URL is configured
+// the request is proxied to that provider; otherwise the built-in classifier is used.
+func (s *ServerState) HandleModerations(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.validateToken(r); err != nil {
+		writeTokenError(w, err)
+		return
+	}
+
+	bodyBytes, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	if url := s.Service.config.ModerationURL; url != "" {
+		s.proxyModeration(w, url, bodyBytes)
+		return
+	}
+
+	var req struct {
+		Input interface{} `json:"input"`
+		Model string      `json:"model"`
+	}
+	if err := json.Unmarshal(bodyBytes, &req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), "invalid_request_error")
+		return
+	}
+	texts, err := moderationInputs(req.Input)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+
+	results := make([]ModerationResult, len(texts))
+	for i, text := range texts {
+		results[i] = ClassifyText(text)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      fmt.Sprintf("modr-%d%06d", time.Now().Unix(), rand.Intn(1000000)),
+		"model":   builtinModerationModel,
+		"results": results,
+	})
+}
+
+// proxyModeration forwards a moderation request to an external provider
+func (s *ServerState) proxyModeration(w http.ResponseWriter, url string, body []byte) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "failed to create moderation request: "+err.Error(), "internal_error")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key := s.Service.config.ModerationAPIKey; key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	resp, err := s.Service.httpClient.Do(req)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadGateway, "moderation provider unavailable: "+err.Error(), "api_error")
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
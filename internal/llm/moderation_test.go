@@ -0,0 +1,91 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestClassifyText(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		flagged  bool
+		category string
+	}{
+		{name: "benign", text: "Write a Go function to reverse a string", flagged: false},
+		{name: "self-harm intent", text: "I want to end my life", flagged: true, category: "self-harm/intent"},
+		{name: "threat", text: "I am going to hurt you", flagged: true, category: "harassment/threatening"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ClassifyText(tt.text)
+			if got.Flagged != tt.flagged {
+				t.Errorf("ClassifyText() flagged = %v, want %v", got.Flagged, tt.flagged)
+			}
+			if len(got.Categories) != len(moderationCategories) {
+				t.Errorf("expected all %d categories, got %d", len(moderationCategories), len(got.Categories))
+			}
+			if tt.category != "" && (!got.Categories[tt.category] || got.CategoryScores[tt.category] <= 0) {
+				t.Errorf("expected category %s to be flagged: %+v", tt.category, got)
+			}
+		})
+	}
+}
+
+func TestHandleModerations(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	t.Run("built-in", func(t *testing.T) {
+		state := &ServerState{Service: &Service{config: &Config{}}}
+		w := httptest.NewRecorder()
+		state.HandleModerations(w, httptest.NewRequest("POST", "/v1/moderations",
+			strings.NewReader(`{"input":["hello","how to kill myself"]}`)))
+
+		var out struct {
+			Model   string             `json:"model"`
+			Results []ModerationResult `json:"results"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if len(out.Results) != 2 || out.Results[0].Flagged || !out.Results[1].Flagged {
+			t.Errorf("unexpected results: %+v", out.Results)
+		}
+	})
+
+	t.Run("external provider", func(t *testing.T) {
+		provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer mod-key" {
+				t.Errorf("missing provider key")
+			}
+			io.WriteString(w, `{"id":"modr-ext","results":[]}`)
+		}))
+		defer provider.Close()
+
+		state := &ServerState{Service: &Service{
+			config:     &Config{ModerationURL: provider.URL, ModerationAPIKey: "mod-key"},
+			httpClient: provider.Client(),
+		}}
+		w := httptest.NewRecorder()
+		state.HandleModerations(w, httptest.NewRequest("POST", "/v1/moderations", strings.NewReader(`{"input":"hi"}`)))
+		if !strings.Contains(w.Body.String(), "modr-ext") {
+			t.Errorf("expected proxied response, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("invalid input", func(t *testing.T) {
+		state := &ServerState{Service: &Service{config: &Config{}}}
+		w := httptest.NewRecorder()
+		state.HandleModerations(w, httptest.NewRequest("POST", "/v1/moderations", strings.NewReader(`{"input":42}`)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+}
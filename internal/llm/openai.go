@@ -0,0 +1,133 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	appauth "copilot-proxy/internal/auth"
+	"copilot-proxy/internal/tracing"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultOpenAIAPIURL is the OpenAI API base URL used unless OPENAI_API_URL is set
+const defaultOpenAIAPIURL = "https://api.openai.com/v1"
+
+// defaultOpenAIModels select the chat models of the OpenAI model list, which
+// also contains embedding, image and audio models
+var defaultOpenAIModels = []string{"gpt-*", "chatgpt-*", "o1*", "o3*", "o4*"}
+
+// openAIProvider forwards chat completions to the OpenAI API. It is
+// registered when OPENAI_API_KEY is set and serves the models matching
+// OPENAI_MODELS that Copilot does not offer.
+type openAIProvider struct {
+	s *Service
+}
+
+// ListModels fetches the OpenAI model list and keeps the selected models
+func (p *openAIProvider) ListModels(ctx context.Context) ([]models.LanguageModel, error) {
+	ctx, span := tracing.Start(ctx, "openai.fetch_models", tracing.SpanKindClient)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", p.url("/models"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create models request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.s.config.OpenAIAPIKey)
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := p.s.httpClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to fetch OpenAI models: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("OpenAI models API returned %s: %s", resp.Status, string(body))
+	}
+
+	var wrapper struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&wrapper); err != nil {
+		return nil, fmt.Errorf("failed to decode OpenAI models response: %w", err)
+	}
+	patterns := p.s.config.OpenAIModels
+	if len(patterns) == 0 {
+		patterns = defaultOpenAIModels
+	}
+	var list []models.LanguageModel
+	for _, m := range wrapper.Data {
+		if appauth.MatchScope(patterns, m.ID) {
+			list = append(list, models.LanguageModel{ID: m.ID, Name: m.ID, Provider: models.ProviderOpenAI, Enabled: true})
+		}
+	}
+	span.SetAttributes(tracing.Int("llm.model_count", len(list)))
+	return list, nil
+}
+
+// Stream forwards a chat completion request to the OpenAI API in streaming
+// mode. The request is passed through as is apart from the model, the
+// proxy's provider field and the streaming options, which make OpenAI
+// report usage for the accounting.
+func (p *openAIProvider) Stream(ctx context.Context, model, request string) (*http.Response, error) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(request), &payload); err != nil {
+		return nil, err
+	}
+	// The provider field is the proxy's own and unknown to the OpenAI API
+	delete(payload, "provider")
+	payload["model"] = model
+	payload["stream"] = true
+	payload["stream_options"] = map[string]interface{}{"include_usage": true}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	ctx, span := tracing.Start(ctx, "openai.chat_completions", tracing.SpanKindClient)
+	defer span.End()
+	url := p.url("/chat/completions")
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.s.config.OpenAIAPIKey)
+	tracing.Inject(ctx, req.Header)
+	span.SetAttributes(tracing.String("http.url", url))
+
+	req = req.WithContext(context.WithValue(req.Context(), upstreamStartKey{}, time.Now()))
+	resp, err := p.s.httpClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, wrapTransportError(err)
+	}
+	span.SetAttributes(tracing.Int("http.status_code", resp.StatusCode))
+	return resp, nil
+}
+
+// Complete streams a chat completion from the OpenAI API and aggregates it
+func (p *openAIProvider) Complete(ctx context.Context, model, request string) (*ChatResult, error) {
+	resp, err := p.Stream(ctx, model, request)
+	if err != nil {
+		return nil, err
+	}
+	return collectResponse(resp)
+}
+
+// url builds a full URL to the OpenAI API for the given path
+func (p *openAIProvider) url(path string) string {
+	base := strings.TrimRight(p.s.config.OpenAIAPIURL, "/")
+	if base == "" {
+		base = defaultOpenAIAPIURL
+	}
+	return base + path
+}
@@ -0,0 +1,67 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAIProvider(t *testing.T) {
+	var upstream map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/v1/models" {
+			fmt.Fprint(w, `{"data":[{"id":"gpt-4o"},{"id":"gpt-4.5-preview"},{"id":"text-embedding-3-small"}]}`)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&upstream)
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"from openai\"},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":4,\"completion_tokens\":2}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	s := &Service{
+		config:     &Config{OpenAIAPIKey: "sk-test", OpenAIAPIURL: server.URL + "/v1"},
+		httpClient: server.Client(),
+		usage:      newUsageLedger(),
+	}
+	s.RegisterProvider(models.ProviderCopilot, &fakeProvider{models: []models.LanguageModel{{ID: "gpt-4o"}}})
+	s.RegisterProvider(models.ProviderOpenAI, &openAIProvider{s: s})
+
+	token := &models.LLMToken{UserID: 1, HasLLMSubscription: true}
+	list, err := s.Models(token, nil)
+	if err != nil {
+		t.Fatalf("Models() error = %v", err)
+	}
+	if len(list) != 2 || list[0].Provider != models.ProviderCopilot || list[1].ID != "gpt-4.5-preview" || list[1].Provider != models.ProviderOpenAI {
+		t.Fatalf("Models() = %+v, want gpt-4o from Copilot and only the other chat model from OpenAI", list)
+	}
+
+	result, err := s.Chat(CompletionRequest{Model: "gpt-4.5-preview", ProviderRequest: `{"messages":[{"role":"user","content":"hi"}],"seed":7,"provider":"copilot"}`, Token: token})
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	if result.Content != "from openai" || result.PromptTokens != 4 || result.CompletionTokens != 2 {
+		t.Errorf("Chat() = %+v", result)
+	}
+	if _, ok := upstream["provider"]; ok || upstream["model"] != "gpt-4.5-preview" || upstream["stream"] != true || upstream["seed"] != 7.0 {
+		t.Errorf("upstream request = %v", upstream)
+	}
+	if options, _ := upstream["stream_options"].(map[string]interface{}); options["include_usage"] != true {
+		t.Errorf("upstream request does not ask for usage: %v", upstream)
+	}
+
+	s.config.OpenAIModels = []string{"text-embedding-*"}
+	list, err = (&openAIProvider{s: s}).ListModels(context.Background())
+	if err != nil || len(list) != 1 || list[0].ID != "text-embedding-3-small" {
+		t.Errorf("ListModels() with OPENAI_MODELS = %+v, %v", list, err)
+	}
+}
@@ -0,0 +1,169 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"copilot-proxy/pkg/utils"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Provider is a chat completion backend. Requests are OpenAI chat completion
+// request bodies and streams are OpenAI SSE streams, so that the handlers,
+// limits and usage accounting work the same for every provider.
+type Provider interface {
+	// ListModels returns the models the provider serves
+	ListModels(ctx context.Context) ([]models.LanguageModel, error)
+	// Stream sends a chat completion request for model and returns the
+	// upstream SSE response. An upstream error is returned as the response
+	// with its status code.
+	Stream(ctx context.Context, model, request string) (*http.Response, error)
+	// Complete sends a chat completion request for model and returns the
+	// aggregated completion
+	Complete(ctx context.Context, model, request string) (*ChatResult, error)
+}
+
+// registeredProvider is a provider and the name its models are tagged with
+type registeredProvider struct {
+	name     models.LanguageModelProvider
+	provider Provider
+}
+
+// RegisterProvider adds a backend serving the models it lists, or replaces
+// the provider registered under the same name. The Copilot provider is
+// built in; registering ProviderCopilot replaces it, e.g. with a fake in
+// tests. The model catalog picks up new providers on its next refresh.
+func (s *Service) RegisterProvider(name models.LanguageModelProvider, p Provider) {
+	s.providersMu.Lock()
+	defer s.providersMu.Unlock()
+	for i := range s.providers {
+		if s.providers[i].name == name {
+			s.providers[i].provider = p
+			return
+		}
+	}
+	s.providers = append(s.providers, registeredProvider{name: name, provider: p})
+}
+
+// registeredProviders returns the providers in the order their models are
+// listed, the Copilot provider first
+func (s *Service) registeredProviders() []registeredProvider {
+	s.providersMu.RLock()
+	defer s.providersMu.RUnlock()
+	providers := []registeredProvider{{name: models.ProviderCopilot, provider: &copilotProvider{s: s}}}
+	for _, p := range s.providers {
+		if p.name == models.ProviderCopilot {
+			providers[0] = p
+		} else {
+			providers = append(providers, p)
+		}
+	}
+	return providers
+}
+
+// provider returns the provider registered under name
+func (s *Service) provider(name models.LanguageModelProvider) (Provider, error) {
+	if name == "" {
+		name = models.ProviderCopilot
+	}
+	for _, p := range s.registeredProviders() {
+		if p.name == name {
+			return p.provider, nil
+		}
+	}
+	return nil, fmt.Errorf("no provider registered for %s models", name)
+}
+
+// listProviderModels fetches the models of every provider, tagged with the
+// provider's name. A model offered by several providers is served by the
+// first of them. A provider that fails is skipped unless all of them fail.
+func (s *Service) listProviderModels(ctx context.Context) ([]models.LanguageModel, error) {
+	var all []models.LanguageModel
+	seen := make(map[string]bool)
+	var firstErr error
+	providers := s.registeredProviders()
+	for _, p := range providers {
+		list, err := p.provider.ListModels(ctx)
+		if err != nil {
+			if len(providers) > 1 {
+				log.Printf("Warning: failed to list %s models: %v", p.name, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, m := range list {
+			if seen[m.ID] {
+				continue
+			}
+			seen[m.ID] = true
+			m.Provider = p.name
+			all = append(all, m)
+		}
+	}
+	if len(all) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return all, nil
+}
+
+// copilotProvider serves models from the GitHub Copilot API
+type copilotProvider struct {
+	s *Service
+}
+
+// ListModels refreshes the Copilot API key and fetches the live model list
+func (p *copilotProvider) ListModels(ctx context.Context) ([]models.LanguageModel, error) {
+	// Try to load a fresh Copilot token from VS Code config
+	token, err := utils.GetCopilotToken()
+	if err != nil {
+		// Fallback to previously set config or environment var
+		token = p.s.config.APIKey()
+		if token == "" {
+			token = os.Getenv("COPILOT_API_KEY")
+		}
+		if token == "" {
+			return nil, fmt.Errorf("failed to refresh API key: %w", err)
+		}
+	}
+	p.s.config.SetAPIKey(token)
+
+	list, err := p.s.FetchModels()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch models: %w", err)
+	}
+	return list, nil
+}
+
+// Stream sends a streaming chat completion request to the Copilot API
+func (p *copilotProvider) Stream(ctx context.Context, model, request string) (*http.Response, error) {
+	return p.s.callCopilotAPI(ctx, request, model)
+}
+
+// Complete streams a chat completion from the Copilot API, which is always
+// called in streaming mode, and aggregates it
+func (p *copilotProvider) Complete(ctx context.Context, model, request string) (*ChatResult, error) {
+	resp, err := p.Stream(ctx, model, request)
+	if err != nil {
+		return nil, err
+	}
+	return collectResponse(resp)
+}
+
+// collectResponse aggregates an upstream SSE response into a completion
+func collectResponse(resp *http.Response) (*ChatResult, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, newUpstreamError(resp, body)
+	}
+	result, err := collectStream(resp.Body)
+	if err != nil {
+		return nil, wrapTransportError(err)
+	}
+	return result.chatResult(), nil
+}
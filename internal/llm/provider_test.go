@@ -0,0 +1,86 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fakeProvider serves a fixed model list and stream, or fails its
+// completions with status
+type fakeProvider struct {
+	models  []models.LanguageModel
+	err     error
+	stream  string
+	status  int
+	request string
+	calls   int
+}
+
+func (p *fakeProvider) ListModels(ctx context.Context) ([]models.LanguageModel, error) {
+	return p.models, p.err
+}
+
+func (p *fakeProvider) Stream(ctx context.Context, model, request string) (*http.Response, error) {
+	p.request = request
+	p.calls++
+	if p.status != 0 {
+		return &http.Response{StatusCode: p.status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(`{"error":{"message":"failed"}}`))}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(p.stream))}, nil
+}
+
+func (p *fakeProvider) Complete(ctx context.Context, model, request string) (*ChatResult, error) {
+	resp, _ := p.Stream(ctx, model, request)
+	return collectResponse(resp)
+}
+
+func TestProviderRouting(t *testing.T) {
+	s := &Service{config: &Config{}, usage: newUsageLedger()}
+	copilot := &fakeProvider{
+		models: []models.LanguageModel{{ID: "gpt-4o", Name: "GPT-4o"}},
+		stream: "data: {\"choices\":[{\"delta\":{\"content\":\"from copilot\"}}]}\n\n",
+	}
+	other := &fakeProvider{
+		models: []models.LanguageModel{{ID: "other-model", Name: "Other", Provider: "ignored"}},
+		stream: "data: {\"choices\":[{\"delta\":{\"content\":\"from other\"}}]}\n\n",
+	}
+	broken := &fakeProvider{err: errors.New("down")}
+	s.RegisterProvider("other", other)
+	s.RegisterProvider("broken", broken)
+	s.RegisterProvider(models.ProviderCopilot, copilot)
+
+	token := &models.LLMToken{UserID: 1, HasLLMSubscription: true}
+	list, err := s.Models(token, nil)
+	if err != nil {
+		t.Fatalf("Models() error = %v", err)
+	}
+	if len(list) != 2 || list[0].ID != "gpt-4o" || list[0].Provider != models.ProviderCopilot || list[1].ID != "other-model" || list[1].Provider != "other" {
+		t.Fatalf("Models() = %+v, want the Copilot model first, then the other provider's", list)
+	}
+
+	for model, want := range map[string]string{"gpt-4o": "from copilot", "other-model": "from other"} {
+		result, err := s.Chat(CompletionRequest{Model: model, ProviderRequest: `{"messages":[{"role":"user","content":"hi"}]}`, Token: token})
+		if err != nil {
+			t.Fatalf("Chat(%s) error = %v", model, err)
+		}
+		if result.Content != want {
+			t.Errorf("Chat(%s) = %q, want %q", model, result.Content, want)
+		}
+	}
+	if other.request == "" {
+		t.Error("the other provider did not receive its request")
+	}
+}
+
+func TestListProviderModelsFails(t *testing.T) {
+	s := &Service{config: &Config{}}
+	s.RegisterProvider(models.ProviderCopilot, &fakeProvider{err: errors.New("down")})
+	if _, err := s.listProviderModels(context.Background()); err == nil || err.Error() != "down" {
+		t.Errorf("listProviderModels() error = %v, want the provider's error", err)
+	}
+}
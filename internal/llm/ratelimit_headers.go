@@ -0,0 +1,85 @@
+package llm
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rateLimitWindow is a per-minute limit, what is left of it and when it is
+// fully available again
+type rateLimitWindow struct {
+	limit     int
+	remaining int
+	reset     time.Duration
+}
+
+// tighter returns the window with fewer remaining units, ignoring windows
+// without a limit
+func (w rateLimitWindow) tighter(other rateLimitWindow) rateLimitWindow {
+	if other.limit <= 0 {
+		return w
+	}
+	if w.limit <= 0 || other.remaining < w.remaining {
+		return other
+	}
+	return w
+}
+
+// minuteWindow returns the window of a fixed per-minute limit with used
+// units in the current minute
+func minuteWindow(limit, used int, now time.Time) rateLimitWindow {
+	remaining := limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return rateLimitWindow{limit: limit, remaining: remaining, reset: now.Truncate(time.Minute).Add(time.Minute).Sub(now)}
+}
+
+// setRateLimitHeaders sets the x-ratelimit-* headers OpenAI clients read
+// for their backoff logic. The limits are the model's per-minute limits, the
+// key's rate limit or its share of the global quota, whichever leaves less
+// room; the remaining counts of the model and the share come from the
+// user's usage in the current minute and the key's from its token buckets. Headers for a dimension without any limit are
+// left out. They must be set before the response is written.
+func (s *Service) setRateLimitHeaders(w http.ResponseWriter, userID uint64, model string) {
+	now := time.Now()
+	model = s.config.ResolveModel(model)
+
+	var requests, tokens rateLimitWindow
+	if limit, ok := s.config.modelRateLimit(model); ok {
+		usage := s.GetModelUsage(userID, model)
+		if limit.RequestsPerMinute > 0 {
+			requests = minuteWindow(limit.RequestsPerMinute, usage.RequestsThisMinute, now)
+		}
+		if limit.TokensPerMinute > 0 {
+			tokens = minuteWindow(limit.TokensPerMinute, usage.TokensThisMinute, now)
+		}
+	}
+	if s.rateLimits != nil {
+		key := usageKeyForUser(userID)
+		if limit, ok := s.rateLimits.lookup(key); ok {
+			leftRequests, leftTokens, requestsReset, tokensReset := s.limiter.remaining(key, limit, now)
+			requests = requests.tighter(rateLimitWindow{limit: limit.RequestsPerMinute, remaining: leftRequests, reset: requestsReset})
+			tokens = tokens.tighter(rateLimitWindow{limit: limit.TokensPerMinute, remaining: leftTokens, reset: tokensReset})
+		}
+	}
+	if s.config.dynamicLimited() {
+		shareRequests, shareTokens, _ := s.dynamicShare(now)
+		if usage, err := s.currentKeyUsage(usageKeyForUser(userID)); err == nil {
+			requests = requests.tighter(minuteWindow(shareRequests, usage.RequestsThisMinute, now))
+			tokens = tokens.tighter(minuteWindow(shareTokens, usage.TokensThisMinute, now))
+		}
+	}
+
+	if requests.limit > 0 {
+		w.Header().Set("x-ratelimit-limit-requests", strconv.Itoa(requests.limit))
+		w.Header().Set("x-ratelimit-remaining-requests", strconv.Itoa(requests.remaining))
+		w.Header().Set("x-ratelimit-reset-requests", requests.reset.Round(time.Second).String())
+	}
+	if tokens.limit > 0 {
+		w.Header().Set("x-ratelimit-limit-tokens", strconv.Itoa(tokens.limit))
+		w.Header().Set("x-ratelimit-remaining-tokens", strconv.Itoa(tokens.remaining))
+		w.Header().Set("x-ratelimit-reset-tokens", tokens.reset.Round(time.Second).String())
+	}
+}
@@ -0,0 +1,77 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		model string
+		limit *RateLimit
+		want  map[string]string
+	}{
+		{"model limits", "copilot-chat", nil, map[string]string{
+			"x-ratelimit-limit-requests": "25", "x-ratelimit-remaining-requests": "23",
+			"x-ratelimit-limit-tokens": "5000", "x-ratelimit-remaining-tokens": "4600",
+		}},
+		{"key limit is tighter", "copilot-chat", &RateLimit{RequestsPerMinute: 3, TokensPerMinute: 10000}, map[string]string{
+			"x-ratelimit-limit-requests": "3", "x-ratelimit-remaining-requests": "0",
+			"x-ratelimit-limit-tokens": "5000", "x-ratelimit-remaining-tokens": "4600",
+		}},
+		{"key limit only", "gpt-4o", &RateLimit{TokensPerMinute: 1000}, map[string]string{
+			"x-ratelimit-limit-requests": "", "x-ratelimit-remaining-requests": "",
+			"x-ratelimit-limit-tokens": "1000", "x-ratelimit-remaining-tokens": "400",
+		}},
+		{"unlimited", "gpt-4o", nil, map[string]string{
+			"x-ratelimit-limit-requests": "", "x-ratelimit-limit-tokens": "",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits, _ := loadRateLimits("")
+			if tt.limit != nil {
+				limits.set("1", tt.limit)
+			}
+			s := &Service{config: &Config{}, usage: newUsageLedger(), rateLimits: limits}
+			s.RecordUsage(1, "copilot-chat", models.TokenUsage{Input: 100, Output: 100})
+			s.RecordUsage(1, "copilot-chat", models.TokenUsage{Input: 100, Output: 100})
+			s.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 100, Output: 100})
+
+			w := httptest.NewRecorder()
+			s.setRateLimitHeaders(w, 1, tt.model)
+			for header, want := range tt.want {
+				if got := w.Header().Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+			if tt.want["x-ratelimit-limit-requests"] != "" && w.Header().Get("x-ratelimit-reset-requests") == "" {
+				t.Error("x-ratelimit-reset-requests is missing")
+			}
+		})
+	}
+}
+
+func TestHandleCompletionSetsRateLimitHeaders(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	upstream := newSSEUpstream(t, `{"choices":[{"delta":{"content":"hi"}}]}`)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	state.Service.rateLimits, _ = loadRateLimits("")
+	state.Service.rateLimits.set(defaultSettingsKey, &RateLimit{RequestsPerMinute: 5, TokensPerMinute: 1000})
+
+	w := httptest.NewRecorder()
+	state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`)))
+	if w.Header().Get("x-ratelimit-limit-requests") != "5" || w.Header().Get("x-ratelimit-remaining-requests") != "5" {
+		t.Errorf("request headers = %q, %q", w.Header().Get("x-ratelimit-limit-requests"), w.Header().Get("x-ratelimit-remaining-requests"))
+	}
+	if w.Header().Get("x-ratelimit-limit-tokens") != "1000" || w.Header().Get("x-ratelimit-remaining-tokens") != "1000" {
+		t.Errorf("token headers = %q, %q", w.Header().Get("x-ratelimit-limit-tokens"), w.Header().Get("x-ratelimit-remaining-tokens"))
+	}
+}
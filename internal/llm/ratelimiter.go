@@ -0,0 +1,219 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// retryAfterError is a rate limit error that knows when the request may be
+// retried
+type retryAfterError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// retryAfter returns the wait carried by a rate limit error, if any
+func retryAfter(err error) (time.Duration, bool) {
+	var rae *retryAfterError
+	if errors.As(err, &rae) {
+		return rae.retryAfter, true
+	}
+	return 0, false
+}
+
+// tokenBucket holds up to capacity units and refills continuously at
+// perMinute units per minute. Taking more than is available leaves the
+// bucket in debt, which blocks further requests until it has refilled.
+type tokenBucket struct {
+	capacity  float64
+	perMinute float64
+	level     float64
+	updated   time.Time
+}
+
+// newTokenBucket returns a full bucket
+func newTokenBucket(capacity, perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: float64(capacity), perMinute: float64(perMinute), level: float64(capacity), updated: now}
+}
+
+// configure applies changed limits, keeping the current level within the
+// new capacity
+func (b *tokenBucket) configure(capacity, perMinute int, now time.Time) {
+	b.refill(now)
+	b.capacity, b.perMinute = float64(capacity), float64(perMinute)
+	b.level = math.Min(b.level, b.capacity)
+}
+
+// refill adds the units accrued since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.level = math.Min(b.capacity, b.level+elapsed.Minutes()*b.perMinute)
+		b.updated = now
+	}
+}
+
+// take removes n units
+func (b *tokenBucket) take(n int, now time.Time) {
+	b.refill(now)
+	b.level -= float64(n)
+}
+
+// available returns the whole units in the bucket
+func (b *tokenBucket) available(now time.Time) int {
+	b.refill(now)
+	if b.level <= 0 {
+		return 0
+	}
+	return int(b.level)
+}
+
+// wait returns how long until the bucket holds at least n units
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	if b.level >= n || b.perMinute <= 0 {
+		return 0
+	}
+	return time.Duration((n - b.level) / b.perMinute * float64(time.Minute))
+}
+
+// burst returns the bucket capacity for a per-minute limit: the configured
+// burst or, without one, the limit itself
+func burst(perMinute, burst int) int {
+	if burst > 0 {
+		return burst
+	}
+	return perMinute
+}
+
+// keyBuckets are the request and token buckets of one key. The input and
+// output buckets count prompt and completion tokens separately.
+type keyBuckets struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+	input    *tokenBucket
+	output   *tokenBucket
+}
+
+// rateLimiter enforces the per-minute limits of API keys with token buckets,
+// so a key's budget refills continuously instead of resetting at minute
+// boundaries and short bursts up to the configured size are allowed.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*keyBuckets
+}
+
+// bucketsLocked returns the buckets of key configured for limit, creating
+// them full on first use. A bucket is nil when its dimension is unlimited.
+func (l *rateLimiter) bucketsLocked(key string, limit RateLimit, now time.Time) *keyBuckets {
+	if l.buckets == nil {
+		l.buckets = make(map[string]*keyBuckets)
+	}
+	kb, ok := l.buckets[key]
+	if !ok {
+		kb = &keyBuckets{}
+		l.buckets[key] = kb
+	}
+	configure := func(b **tokenBucket, perMinute, burstSize int) {
+		switch {
+		case perMinute <= 0:
+			*b = nil
+		case *b == nil:
+			*b = newTokenBucket(burst(perMinute, burstSize), perMinute, now)
+		default:
+			(*b).configure(burst(perMinute, burstSize), perMinute, now)
+		}
+	}
+	configure(&kb.requests, limit.RequestsPerMinute, limit.RequestBurst)
+	configure(&kb.tokens, limit.TokensPerMinute, limit.TokenBurst)
+	configure(&kb.input, limit.InputTokensPerMinute, 0)
+	configure(&kb.output, limit.OutputTokensPerMinute, 0)
+	return kb
+}
+
+// check returns an error wrapping ErrRateLimitExceeded while the key has no
+// request left or one of its token buckets is empty
+func (l *rateLimiter) check(key string, limit RateLimit, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kb := l.bucketsLocked(key, limit, now)
+	for _, b := range []struct {
+		bucket *tokenBucket
+		name   string
+	}{
+		{kb.requests, "requests_per_minute"},
+		{kb.tokens, "tokens_per_minute"},
+		{kb.input, "input_tokens_per_minute"},
+		{kb.output, "output_tokens_per_minute"},
+	} {
+		if b.bucket != nil && b.bucket.available(now) < 1 {
+			return &retryAfterError{
+				err:        fmt.Errorf("%w: maximum %s reached", ErrRateLimitExceeded, b.name),
+				retryAfter: b.bucket.wait(1, now),
+			}
+		}
+	}
+	return nil
+}
+
+// record takes one request and the used tokens from the key's buckets
+func (l *rateLimiter) record(key string, limit RateLimit, usage models.TokenUsage, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kb := l.bucketsLocked(key, limit, now)
+	if kb.requests != nil {
+		kb.requests.take(1, now)
+	}
+	if kb.tokens != nil {
+		kb.tokens.take(usage.Input+usage.Output, now)
+	}
+	if kb.input != nil {
+		kb.input.take(usage.Input, now)
+	}
+	if kb.output != nil {
+		kb.output.take(usage.Output, now)
+	}
+}
+
+// remaining returns the requests and tokens the key has left and how long
+// until its buckets are full again. It returns -1 for unlimited dimensions.
+func (l *rateLimiter) remaining(key string, limit RateLimit, now time.Time) (requests, tokens int, requestsReset, tokensReset time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kb := l.bucketsLocked(key, limit, now)
+	requests, tokens = -1, -1
+	if kb.requests != nil {
+		requests = kb.requests.available(now)
+		requestsReset = kb.requests.wait(kb.requests.capacity, now)
+	}
+	if kb.tokens != nil {
+		tokens = kb.tokens.available(now)
+		tokensReset = kb.tokens.wait(kb.tokens.capacity, now)
+	}
+	return requests, tokens, requestsReset, tokensReset
+}
+
+// prune forgets the keys whose buckets are all full, which behave like new
+// ones, so the limiter does not grow with every key ever seen
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, kb := range l.buckets {
+		full := true
+		for _, b := range []*tokenBucket{kb.requests, kb.tokens, kb.input, kb.output} {
+			if b != nil {
+				b.refill(now)
+				full = full && b.level >= b.capacity
+			}
+		}
+		if full {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)
+	b := newTokenBucket(10, 60, start)
+
+	b.take(10, start)
+	if got := b.available(start); got != 0 {
+		t.Errorf("available() after draining = %d, want 0", got)
+	}
+	// The bucket refills continuously rather than at the minute boundary
+	if got := b.available(start.Add(5 * time.Second)); got != 5 {
+		t.Errorf("available() after 5s = %d, want 5", got)
+	}
+	if got := b.available(start.Add(time.Hour)); got != 10 {
+		t.Errorf("available() after an hour = %d, want the capacity 10", got)
+	}
+
+	// Taking more than is available leaves the bucket in debt
+	now := start.Add(time.Hour)
+	b.take(25, now)
+	if got := b.wait(1, now); got != 16*time.Second {
+		t.Errorf("wait(1) in debt = %v, want 16s", got)
+	}
+
+	// Shrinking the capacity caps the level
+	b.configure(4, 60, now.Add(time.Minute))
+	if got := b.available(now.Add(time.Minute)); got != 4 {
+		t.Errorf("available() after configure = %d, want 4", got)
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		limit    RateLimit
+		allowed  int
+		refilled time.Duration
+	}{
+		{"burst defaults to the limit", RateLimit{RequestsPerMinute: 6}, 6, 10 * time.Second},
+		{"smaller burst", RateLimit{RequestsPerMinute: 6, RequestBurst: 2}, 2, 10 * time.Second},
+		{"larger burst", RateLimit{RequestsPerMinute: 6, RequestBurst: 12}, 12, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l rateLimiter
+			allowed := 0
+			for l.check("1", tt.limit, now) == nil {
+				l.record("1", tt.limit, models.TokenUsage{}, now)
+				allowed++
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed %d requests at once, want %d", allowed, tt.allowed)
+			}
+			err := l.check("1", tt.limit, now)
+			if wait, ok := retryAfter(err); !errors.Is(err, ErrRateLimitExceeded) || !ok || wait != tt.refilled {
+				t.Errorf("check() error = %v, retry after %v", err, wait)
+			}
+			if err := l.check("1", tt.limit, now.Add(tt.refilled)); err != nil {
+				t.Errorf("check() after %v error = %v", tt.refilled, err)
+			}
+			if err := l.check("2", tt.limit, now); err != nil {
+				t.Errorf("check(other key) error = %v", err)
+			}
+		})
+	}
+}
+
+func TestRateLimiterTokens(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limit := RateLimit{TokensPerMinute: 600}
+	var l rateLimiter
+
+	l.record("1", limit, models.TokenUsage{Input: 900}, now)
+	if err := l.check("1", limit, now); !errors.Is(err, ErrRateLimitExceeded) {
+		t.Errorf("check() after overspending error = %v", err)
+	}
+	// The 300 token debt takes 30s to repay
+	if err := l.check("1", limit, now.Add(30*time.Second)); !errors.Is(err, ErrRateLimitExceeded) {
+		t.Errorf("check() after 30s error = %v", err)
+	}
+	if err := l.check("1", limit, now.Add(31*time.Second)); err != nil {
+		t.Errorf("check() after 31s error = %v", err)
+	}
+
+	// Removing the limit lifts it
+	if err := l.check("1", RateLimit{}, now); err != nil {
+		t.Errorf("check() without limits error = %v", err)
+	}
+}
+
+func TestRateLimiterInputOutputTokens(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limit := RateLimit{InputTokensPerMinute: 1000, OutputTokensPerMinute: 100}
+	var l rateLimiter
+
+	// Prompt tokens do not use up the output limit
+	l.record("1", limit, models.TokenUsage{Input: 900, Output: 50}, now)
+	if err := l.check("1", limit, now); err != nil {
+		t.Errorf("check() within both limits error = %v", err)
+	}
+	l.record("1", limit, models.TokenUsage{Input: 10, Output: 60}, now)
+	err := l.check("1", limit, now)
+	if wait, ok := retryAfter(err); !errors.Is(err, ErrRateLimitExceeded) || !strings.Contains(err.Error(), "output_tokens_per_minute") || !ok || wait <= 0 {
+		t.Errorf("check() over the output limit error = %v, retry after %v", err, wait)
+	}
+
+	l.record("2", limit, models.TokenUsage{Input: 1200}, now)
+	if err := l.check("2", limit, now); err == nil || !strings.Contains(err.Error(), "input_tokens_per_minute") {
+		t.Errorf("check() over the input limit error = %v", err)
+	}
+}
+
+func TestSetErrorResponseHeadersRetryAfter(t *testing.T) {
+	w := httptest.NewRecorder()
+	SetErrorResponseHeaders(w, &retryAfterError{err: ErrRateLimitExceeded, retryAfter: 1500 * time.Millisecond})
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+}
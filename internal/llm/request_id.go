@@ -0,0 +1,68 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// RequestIDHeader carries the ID that correlates a request across the
+// client, the proxy, the upstream and traces
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds client-supplied request IDs
+const maxRequestIDLength = 128
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying a request ID, which upstream
+// calls made with the context send as X-Request-ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID of a context, or "" if it has
+// none
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether a client-supplied request ID is short
+// printable ASCII, so it is safe to forward and log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID wraps a handler so that every request has an ID: the
+// client's X-Request-ID or, without a valid one, a generated ID. The ID is
+// echoed in the response headers and carried in the request context.
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = generateRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next(w, r.WithContext(WithRequestID(r.Context(), id)))
+	}
+}
+
+// logRequestf logs a message prefixed with the request ID of ctx, if any
+func logRequestf(ctx context.Context, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if id := RequestIDFromContext(ctx); id != "" {
+		message = "[" + id + "] " + message
+	}
+	log.Print(message)
+}
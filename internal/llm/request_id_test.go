@@ -0,0 +1,55 @@
+package llm
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDPropagation(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	upstreamIDs := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamIDs <- r.Header.Get(RequestIDHeader)
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+	state := newTestServerState(server)
+	handler := state.route(state.HandleCompletion)
+
+	post := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`))
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	w := post("client-trace-42")
+	if got := w.Header().Get(RequestIDHeader); got != "client-trace-42" {
+		t.Errorf("response %s = %q, want the client's ID", RequestIDHeader, got)
+	}
+	if got := <-upstreamIDs; got != "client-trace-42" {
+		t.Errorf("upstream %s = %q, want the client's ID", RequestIDHeader, got)
+	}
+
+	for _, id := range []string{"", "has spaces\tand tabs", strings.Repeat("x", maxRequestIDLength+1)} {
+		w := post(id)
+		generated := w.Header().Get(RequestIDHeader)
+		if generated == "" || generated == id {
+			t.Errorf("client ID %q: response %s = %q, want a generated ID", id, RequestIDHeader, generated)
+		}
+		if got := <-upstreamIDs; got != generated {
+			t.Errorf("client ID %q: upstream %s = %q, want %q", id, RequestIDHeader, got, generated)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RequestTimeoutHeader lets a client bound how long the proxy works on its
+// request, including the upstream call. The timeout query parameter does
+// the same for clients that cannot set headers.
+const RequestTimeoutHeader = "X-Request-Timeout"
+
+// parseRequestTimeout parses a client timeout, either a duration such as
+// "90s" or a number of seconds
+func parseRequestTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds <= 0 {
+			return 0, fmt.Errorf("invalid timeout %q: must be positive", value)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q: use a number of seconds or a duration such as 90s", value)
+	}
+	return timeout, nil
+}
+
+// requestTimeout returns the timeout a request asks for, capped at
+// MAX_REQUEST_TIMEOUT, or 0 if it asks for none
+func (c *Config) requestTimeout(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get(RequestTimeoutHeader)
+	if value == "" {
+		value = r.URL.Query().Get("timeout")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := parseRequestTimeout(value)
+	if err != nil {
+		return 0, err
+	}
+	if c.MaxRequestTimeout > 0 && timeout > c.MaxRequestTimeout {
+		timeout = c.MaxRequestTimeout
+	}
+	return timeout, nil
+}
+
+// withRequestTimeout wraps a handler so that a client-requested timeout
+// bounds the request context, and with it the upstream call. A request
+// that runs out of time is answered with 504.
+func (s *ServerState) withRequestTimeout(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout, err := s.Service.config.requestTimeout(r)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+			return
+		}
+		if timeout == 0 {
+			next(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,69 @@
+package llm
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeoutOverride(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+			return
+		}
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+	state := newTestServerState(server)
+	handler := state.route(state.HandleCompletion)
+
+	post := func(target, timeout string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", target, strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`))
+		if timeout != "" {
+			req.Header.Set(RequestTimeoutHeader, timeout)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	if w := post("/v1/chat/completions", "50ms"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("header timeout: status = %d, want 504; body = %s", w.Code, w.Body.String())
+	}
+	if w := post("/v1/chat/completions?timeout=0.05", ""); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("query timeout: status = %d, want 504; body = %s", w.Code, w.Body.String())
+	}
+	if w := post("/v1/chat/completions", "soon"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid timeout: status = %d, want 400", w.Code)
+	}
+	if w := post("/v1/chat/completions", "5s"); w.Code != http.StatusOK {
+		t.Errorf("long timeout: status = %d, want 200; body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRequestTimeoutCappedAtMaximum(t *testing.T) {
+	config := &Config{MaxRequestTimeout: time.Minute}
+	for value, want := range map[string]time.Duration{"": 0, "30": 30 * time.Second, "1.5": 1500 * time.Millisecond, "2h": time.Minute} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		if value != "" {
+			req.Header.Set(RequestTimeoutHeader, value)
+		}
+		if got, err := config.requestTimeout(req); err != nil || got != want {
+			t.Errorf("requestTimeout(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"0", "-5", "-1s", "later"} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions?timeout="+value, nil)
+		if _, err := config.requestTimeout(req); err == nil {
+			t.Errorf("requestTimeout(%q) accepted an invalid timeout", value)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package llm
+
+import (
+	"container/list"
+	"copilot-proxy/pkg/models"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// defaultResponseCacheTTL is used when RESPONSE_CACHE_TTL is unset or invalid
+const defaultResponseCacheTTL = 10 * time.Minute
+
+// lruCache is an LRU cache with a per-entry TTL. It is safe for concurrent
+// use.
+type lruCache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	// order holds the entries with the most recently used at the front
+	order *list.List
+}
+
+type lruCacheEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// newLRUCache creates a cache holding at most size entries for ttl each, or
+// returns nil (caching disabled) if size is not positive.
+func newLRUCache[V any](size int, ttl time.Duration) *lruCache[V] {
+	if size <= 0 {
+		return nil
+	}
+	return &lruCache[V]{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached value for key if present and not expired
+func (c *lruCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	elem, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := elem.Value.(*lruCacheEntry[V])
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return zero, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+// put stores a value for the cache's TTL, evicting the least recently used
+// entry when full
+func (c *lruCache[V]) put(key string, value V) {
+	c.putUntil(key, value, time.Now().Add(c.ttl))
+}
+
+// putUntil stores a value that expires at the given time, evicting the least
+// recently used entry when full
+func (c *lruCache[V]) putUntil(key string, value V, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lruCacheEntry[V])
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruCacheEntry[V]{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruCacheEntry[V]).key)
+	}
+}
+
+// responseCache holds aggregated non-streaming completions
+type responseCache = lruCache[*streamResult]
+
+// newResponseCache creates a completion cache holding at most size entries,
+// or returns nil (caching disabled) if size is not positive.
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	if ttl <= 0 {
+		ttl = defaultResponseCacheTTL
+	}
+	return newLRUCache[*streamResult](size, ttl)
+}
+
+// responseCacheKey hashes the normalized request (model plus the parameters
+// forwarded upstream) together with the key and tenant of the token, so
+// responses are never shared across keys. Only deterministic requests, i.e.
+// those with an explicit temperature of 0, are cacheable.
+func responseCacheKey(token *models.LLMToken, model, providerRequest string) (string, bool) {
+	var request map[string]interface{}
+	if err := json.Unmarshal([]byte(providerRequest), &request); err != nil {
+		return "", false
+	}
+	if temperature, ok := request["temperature"].(float64); !ok || temperature != 0 {
+		return "", false
+	}
+	normalized := map[string]interface{}{"model": model, "key": token.UserID, "tenant": token.Tenant}
+	for _, key := range forwardedParams {
+		if v, ok := request[key]; ok {
+			normalized[key] = v
+		}
+	}
+	// json.Marshal sorts map keys, so equivalent requests hash identically
+	data, err := json.Marshal(normalized)
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), true
+}
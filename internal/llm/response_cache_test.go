@@ -0,0 +1,150 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheLRU(t *testing.T) {
+	c := newResponseCache(2, time.Minute)
+	c.put("a", &streamResult{Content: "A"})
+	c.put("b", &streamResult{Content: "B"})
+	// Touch "a" so that "b" becomes the least recently used entry
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	c.put("c", &streamResult{Content: "C"})
+
+	if _, ok := c.get("b"); ok {
+		t.Error("expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+}
+
+func TestResponseCacheTTL(t *testing.T) {
+	c := newResponseCache(2, time.Millisecond)
+	c.put("a", &streamResult{Content: "A"})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Error("expected expired entry to be dropped")
+	}
+}
+
+func TestNewResponseCacheDisabled(t *testing.T) {
+	if c := newResponseCache(0, time.Minute); c != nil {
+		t.Error("expected nil cache for size 0")
+	}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	base := `{"messages":[{"role":"user","content":"hi"}],"temperature":0,"max_tokens":5}`
+	reordered := `{"max_tokens":5,"temperature":0,"messages":[{"role":"user","content":"hi"}],"user":"ignored"}`
+	token := &models.LLMToken{UserID: 1}
+
+	k1, ok1 := responseCacheKey(token, "gpt-4o", base)
+	k2, ok2 := responseCacheKey(token, "gpt-4o", reordered)
+	if !ok1 || !ok2 {
+		t.Fatal("expected temperature 0 requests to be cacheable")
+	}
+	if k1 != k2 {
+		t.Error("expected equivalent requests to share a cache key")
+	}
+	if k3, _ := responseCacheKey(token, "claude-3.5-sonnet", base); k3 == k1 {
+		t.Error("expected different models to have different cache keys")
+	}
+	if k4, _ := responseCacheKey(&models.LLMToken{UserID: 2}, "gpt-4o", base); k4 == k1 {
+		t.Error("expected different keys to have different cache keys")
+	}
+	if k5, _ := responseCacheKey(&models.LLMToken{UserID: 1, Tenant: "acme"}, "gpt-4o", base); k5 == k1 {
+		t.Error("expected different tenants to have different cache keys")
+	}
+
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{"no temperature", `{"messages":[]}`},
+		{"non-zero temperature", `{"messages":[],"temperature":0.7}`},
+		{"invalid json", `{`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := responseCacheKey(token, "gpt-4o", tt.request); ok {
+				t.Errorf("responseCacheKey(%s) should not be cacheable", tt.request)
+			}
+		})
+	}
+}
+
+func TestHandleCompletionServesCachedResponse(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	var hits int32
+	inner := newSSEUpstream(t, `{"choices":[{"delta":{"content":"cached answer"}}]}`)
+	defer inner.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		inner.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	state := newTestServerState(upstream)
+	state.Service.responseCache = newResponseCache(8, time.Minute)
+
+	body := `{"model":"test-model","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+	wantCache := []string{"MISS", "HIT"}
+	for i, want := range wantCache {
+		w := httptest.NewRecorder()
+		state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, body = %s", i, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Cache"); got != want {
+			t.Errorf("request %d: X-Cache = %q, want %q", i, got, want)
+		}
+		if !strings.Contains(w.Body.String(), "cached answer") {
+			t.Errorf("request %d: unexpected body %s", i, w.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+}
+
+func TestCachedResponseRequiresModelAccess(t *testing.T) {
+	t.Setenv("DISABLE_AUTH", "")
+	upstream := newSSEUpstream(t, `{"choices":[{"delta":{"content":"cached answer"}}]}`)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	state.Service.responseCache = newResponseCache(8, time.Minute)
+
+	unscoped, _ := IssueLLMToken(TokenClaims{UserID: 1, GithubUserLogin: "testuser"}, state.Secret)
+	scoped, _ := IssueLLMToken(TokenClaims{UserID: 1, GithubUserLogin: "testuser", AllowedModels: []string{"other-model"}}, state.Secret)
+	body := `{"model":"test-model","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+	complete := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		state.HandleCompletion(w, req)
+		return w
+	}
+
+	if w := complete(unscoped); w.Code != http.StatusOK || w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("unscoped token: status = %d, X-Cache = %q", w.Code, w.Header().Get("X-Cache"))
+	}
+	// The same key, scoped to another model, must not read the cached answer
+	if w := complete(scoped); w.Code != http.StatusForbidden || w.Header().Get("X-Cache") != "" {
+		t.Errorf("scoped token: status = %d, X-Cache = %q, want 403 without a cached response", w.Code, w.Header().Get("X-Cache"))
+	}
+}
@@ -0,0 +1,139 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidJSONOutput is returned when JSON mode output cannot be repaired into valid JSON
+var ErrInvalidJSONOutput = errors.New("model output is not valid JSON")
+
+// ErrSchemaMismatch is returned when structured output does not conform to the requested schema
+var ErrSchemaMismatch = errors.New("model output does not match the requested JSON schema")
+
+// ResponseFormat is the OpenAI response_format request field
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat describes the schema of a json_schema response format
+type JSONSchemaFormat struct {
+	Name   string                 `json:"name"`
+	Schema map[string]interface{} `json:"schema"`
+	Strict bool                   `json:"strict"`
+}
+
+// parseResponseFormat extracts the response_format field from a provider request.
+// Returns nil if the field is absent or the request cannot be parsed.
+func parseResponseFormat(providerRequest string) *ResponseFormat {
+	var req struct {
+		ResponseFormat *ResponseFormat `json:"response_format"`
+	}
+	if err := json.Unmarshal([]byte(providerRequest), &req); err != nil {
+		return nil
+	}
+	return req.ResponseFormat
+}
+
+// wantsJSON reports whether the response format requires JSON output
+func (f *ResponseFormat) wantsJSON() bool {
+	return f != nil && (f.Type == "json_object" || f.Type == "json_schema")
+}
+
+// validate checks content against the format, repairing it into valid JSON
+// where possible. It returns the repaired content.
+func (f *ResponseFormat) validate(content string) (string, error) {
+	repaired, ok := repairJSON(content)
+	if !ok {
+		return content, ErrInvalidJSONOutput
+	}
+	if f.Type == "json_schema" && f.JSONSchema != nil && f.JSONSchema.Schema != nil {
+		if err := ValidateJSONSchema(f.JSONSchema.Schema, repaired); err != nil {
+			return repaired, fmt.Errorf("%w: %v", ErrSchemaMismatch, err)
+		}
+	}
+	return repaired, nil
+}
+
+// repairJSON returns content as valid JSON, stripping markdown code fences and
+// surrounding prose if necessary. The second result is false when no valid
+// JSON value could be recovered.
+func repairJSON(content string) (string, bool) {
+	trimmed := strings.TrimSpace(content)
+	if json.Valid([]byte(trimmed)) {
+		return trimmed, true
+	}
+
+	// Models often wrap JSON in ```json fences despite JSON mode
+	if start := strings.Index(trimmed, "```"); start >= 0 {
+		inner := trimmed[start+3:]
+		if nl := strings.Index(inner, "\n"); nl >= 0 {
+			inner = inner[nl+1:]
+		}
+		if end := strings.Index(inner, "```"); end >= 0 {
+			inner = strings.TrimSpace(inner[:end])
+			if json.Valid([]byte(inner)) {
+				return inner, true
+			}
+		}
+	}
+
+	// Fall back to the outermost object or array in the text
+	for _, pair := range [][2]string{{"{", "}"}, {"[", "]"}} {
+		start := strings.Index(trimmed, pair[0])
+		end := strings.LastIndex(trimmed, pair[1])
+		if start >= 0 && end > start {
+			candidate := trimmed[start : end+1]
+			if json.Valid([]byte(candidate)) {
+				return candidate, true
+			}
+		}
+	}
+	return content, false
+}
+
+// responseFormatErrorCode returns the OpenAI error code for a response format failure
+func responseFormatErrorCode(err error) string {
+	if errors.Is(err, ErrSchemaMismatch) {
+		return "json_schema_validation_failed"
+	}
+	return "invalid_json_output"
+}
+
+// retryStructuredOutput re-issues a completion with the rejected output and
+// the validation error appended to the conversation so the model can correct itself.
+func (s *ServerState) retryStructuredOutput(req CompletionRequest, rejected string, cause error) (*streamResult, error) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(req.ProviderRequest), &payload); err != nil {
+		return nil, err
+	}
+	messages, _ := payload["messages"].([]interface{})
+	messages = append(messages,
+		map[string]interface{}{"role": "assistant", "content": rejected},
+		map[string]interface{}{"role": "user", "content": "Your previous reply was rejected (" + cause.Error() +
+			"). Reply again with only JSON that satisfies the requested format."},
+	)
+	payload["messages"] = messages
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req.ProviderRequest = string(body)
+
+	resp, err := s.Service.PerformCompletion(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	reader, err := s.Service.ProcessStreamingResponse(resp, req)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	result, err := collectStream(reader)
+	fillUsage(result, reader)
+	return result, err
+}
@@ -0,0 +1,95 @@
+package llm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseResponseFormat(t *testing.T) {
+	if f := parseResponseFormat(`{"response_format":{"type":"json_object"}}`); !f.wantsJSON() {
+		t.Errorf("expected json_object response format, got %+v", f)
+	}
+	if f := parseResponseFormat(`{"response_format":{"type":"text"}}`); f.wantsJSON() {
+		t.Errorf("text response format should not require JSON")
+	}
+	if f := parseResponseFormat(`{}`); f.wantsJSON() {
+		t.Errorf("missing response format should not require JSON")
+	}
+}
+
+func TestRepairJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantOK  bool
+	}{
+		{name: "valid", content: ` {"a":1} `, want: `{"a":1}`, wantOK: true},
+		{name: "code fence", content: "```json\n{\"a\":1}\n```", want: `{"a":1}`, wantOK: true},
+		{name: "surrounding prose", content: `Sure! Here it is: {"a":[1,2]} Hope that helps.`, want: `{"a":[1,2]}`, wantOK: true},
+		{name: "array", content: `result: [1,2,3]`, want: `[1,2,3]`, wantOK: true},
+		{name: "unrecoverable", content: `{"a":`, want: `{"a":`, wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := repairJSON(tt.content)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("repairJSON() = %q, %v; want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestHandleCompletionStructuredOutputRetry(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		content := `{\"answer\":\"forty-two\"}`
+		if calls > 1 {
+			content = `{\"answer\":42}`
+		}
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"%s\"}}]}\n\ndata: [DONE]\n\n", content)
+	}))
+	defer upstream.Close()
+
+	body := `{"model":"test-model","messages":[{"role":"user","content":"answer"}],
+		"response_format":{"type":"json_schema","json_schema":{"name":"a","schema":{"type":"object","properties":{"answer":{"type":"integer"}},"required":["answer"]}}}}`
+
+	t.Run("without retries", func(t *testing.T) {
+		calls = 0
+		state := newTestServerState(upstream)
+		w := httptest.NewRecorder()
+		state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusBadGateway {
+			t.Fatalf("expected 502, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "json_schema_validation_failed") {
+			t.Errorf("expected schema validation error code, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("with retry", func(t *testing.T) {
+		calls = 0
+		state := newTestServerState(upstream)
+		state.Service.config.StructuredOutputRetries = 1
+		w := httptest.NewRecorder()
+		state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if calls != 2 {
+			t.Errorf("expected 2 upstream calls, got %d", calls)
+		}
+		if !strings.Contains(w.Body.String(), `{\"answer\":42}`) {
+			t.Errorf("expected corrected output, got %s", w.Body.String())
+		}
+	})
+}
@@ -3,15 +3,18 @@ package llm
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"copilot-proxy/internal/tracing"
 	"copilot-proxy/pkg/models"
 	"copilot-proxy/pkg/utils"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"math/rand"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +27,23 @@ const (
 	CopilotModelsURL = "/models"
 )
 
+// forwardedParams lists the request fields passed through to the Copilot API unchanged.
+var forwardedParams = []string{
+	"messages",
+	"temperature",
+	"top_p",
+	"max_tokens",
+	"stop",
+	"tools",
+	"tool_choice",
+	"parallel_tool_calls",
+	"functions",
+	"function_call",
+	"response_format",
+	"logprobs",
+	"top_logprobs",
+}
+
 var (
 	// ErrCopilotAPIKeyMissing is returned when no Copilot API key is configured
 	ErrCopilotAPIKeyMissing = errors.New("Copilot API key not configured")
@@ -33,20 +53,125 @@ var (
 type Service struct {
 	config       *Config
 	httpClient   *http.Client
-	usageLock    sync.RWMutex
-	userUsage    map[uint64]models.ModelUsage
 	authMu       sync.Mutex
 	modelsCache  []models.LanguageModel
 	lastAuthTime time.Time
+	// refreshing is set while a background model refresh is in flight
+	refreshing bool
+	// inflight is the model fetch shared by concurrent cold-cache callers
+	fetchMu  sync.Mutex
+	inflight *modelFetch
+	// keyRefresher re-exchanges the Copilot API key; see SetKeyRefresher
+	keyRefresher func() error
+	keyMu        sync.Mutex
+	// responseCache holds deterministic non-streaming completions; nil when disabled
+	responseCache *responseCache
+	// embeddingCache holds embedding vectors; nil when disabled
+	embeddingCache *embeddingCache
+	// usage records usage for rate limits, spending checks and the usage
+	// statistics API; nil disables usage accounting
+	usage UsageStore
+	// usageReporter is passed every usage event; see SetUsageReporter
+	usageReporter func(models.UsageEvent)
+	// subscriptionCheck rejects keys without an active subscription; see
+	// SetSubscriptionCheck
+	subscriptionCheck func(userID uint64) error
+	// events fans out the events of the admin event stream
+	events eventHub
+	// budgets holds the per-key monthly budgets; nil disables budgets
+	budgets *keyedSettings[Budget]
+	// rateLimits holds the per-key rate limits; nil disables them
+	rateLimits *keyedSettings[RateLimit]
+	// tenants holds the tenants of the API keys; nil disables them
+	tenants *keyedSettings[Tenant]
+	// tenantConcurrency counts the in-flight requests of each tenant
+	tenantConcurrency concurrencyLimiter
+	// tenantAccounts are the Copilot accounts of tenants with their own
+	// credentials, whose OAuth tokens exchangeToken trades for API keys
+	tenantAccountsMu sync.Mutex
+	tenantAccounts   map[string]*tenantAccount
+	exchangeToken    func(oauthToken string) (string, error)
+	// concurrency counts in-flight requests for the concurrency limits
+	concurrency concurrencyLimiter
+	// limiter holds the token buckets of the per-minute rate limits
+	limiter rateLimiter
+	// activeUsers tracks the recently active keys for the dynamic rate limits
+	activeUsers activeUsers
+	// providers are the backends registered besides the built-in Copilot
+	// provider; see RegisterProvider
+	providersMu sync.RWMutex
+	providers   []registeredProvider
+	// breakers are the circuit breakers of the providers
+	breakers circuitBreakers
+	// modelMetrics records the upstream latency and errors per model
+	modelMetrics modelMetrics
+	// accounts are the pooled Copilot accounts; see AddCopilotAccount
+	accounts accountPool
+	// templates are the prompt templates; nil when they failed to load
+	templates *promptTemplates
+	// contentFilter holds the content filter rules; nil when they failed to
+	// load
+	contentFilter *contentFilter
+	// sessions holds the conversation sessions; nil disables them
+	sessions SessionStore
 }
 
 // NewService creates a new LLM service
 func NewService() *Service {
-	return &Service{
-		config:     GetConfig(),
-		httpClient: &http.Client{Timeout: 30 * time.Second},
-		userUsage:  make(map[uint64]models.ModelUsage),
+	config := GetConfig()
+	budgets, err := loadBudgets(config.BudgetsFile)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	rateLimits, err := loadRateLimits(config.RateLimitsFile)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	tenants, err := loadTenants(config.TenantsFile)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	templates, err := loadPromptTemplates(config.PromptTemplatesDir)
+	if err != nil {
+		log.Printf("Warning: %v", err)
 	}
+	contentFilter, err := loadContentFilter(config.ContentFilterFile)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	s := &Service{
+		config:         config,
+		httpClient:     newUpstreamClient(config),
+		responseCache:  newResponseCache(config.ResponseCacheSize, config.ResponseCacheTTL),
+		embeddingCache: newEmbeddingCache(config.EmbeddingCacheSize, config.EmbeddingCacheTTL),
+		usage:          newUsageLedger(),
+		sessions:       newMemorySessionStore(),
+		budgets:        budgets,
+		rateLimits:     rateLimits,
+		tenants:        tenants,
+		templates:      templates,
+		contentFilter:  contentFilter,
+	}
+	if config.OpenAIAPIKey != "" {
+		s.RegisterProvider(models.ProviderOpenAI, &openAIProvider{s: s})
+	}
+	if config.AnthropicAPIKey != "" {
+		s.RegisterProvider(models.ProviderAnthropic, &anthropicProvider{s: s})
+	}
+	return s
+}
+
+// newUpstreamClient builds the HTTP client used for Copilot API calls from
+// the timeout and connection pool settings in the configuration.
+func newUpstreamClient(c *Config) *http.Client {
+	transport := utils.NewUpstreamTransport()
+	transport.ResponseHeaderTimeout = c.UpstreamResponseHeaderTimeout
+	transport.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	transport.IdleConnTimeout = c.IdleConnTimeout
+	transport.MaxIdleConns = c.MaxIdleConns
+	transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = c.MaxConnsPerHost
+	return &http.Client{Timeout: c.UpstreamTimeout, Transport: transport}
 }
 
 // GetConfig returns the service's configuration
@@ -54,9 +179,54 @@ func (s *Service) GetConfig() *Config {
 	return s.config
 }
 
+// SetUsageReporter registers a function that is passed the usage of every
+// request as it is recorded, such as a billing integration. It must return
+// quickly and must be set before requests are served.
+func (s *Service) SetUsageReporter(report func(models.UsageEvent)) {
+	s.usageReporter = report
+}
+
+// SetSubscriptionCheck registers a function that rejects requests of keys
+// without an active subscription with an error wrapping
+// ErrSubscriptionInactive. It must be set before requests are served.
+func (s *Service) SetSubscriptionCheck(check func(userID uint64) error) {
+	s.subscriptionCheck = check
+}
+
+// SetKeyRefresher registers a function that obtains a fresh Copilot API key
+// and stores it in the configuration. It is called when the Copilot API
+// rejects the current key with a 401.
+func (s *Service) SetKeyRefresher(refresh func() error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	s.keyRefresher = refresh
+}
+
+// refreshAPIKey replaces a rejected API key and returns the new one.
+// Concurrent callers that saw the same rejected key share a single refresh.
+func (s *Service) refreshAPIKey(rejected string) (string, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+
+	if current := s.config.APIKey(); current != rejected {
+		return current, nil
+	}
+	if s.keyRefresher == nil {
+		return "", errors.New("no key refresher configured")
+	}
+	if err := s.keyRefresher(); err != nil {
+		return "", err
+	}
+	current := s.config.APIKey()
+	if current == rejected {
+		return "", errors.New("key refresher returned the rejected key")
+	}
+	return current, nil
+}
+
 // getProxyEndpoint extracts the proxy endpoint hostname from the Copilot API token.
 func (s *Service) getProxyEndpoint() string {
-	for _, part := range strings.Split(s.config.CopilotAPIKey, ";") {
+	for _, part := range strings.Split(s.config.APIKey(), ";") {
 		if strings.HasPrefix(part, "proxy-ep=") {
 			return strings.TrimPrefix(part, "proxy-ep=")
 		}
@@ -66,6 +236,10 @@ func (s *Service) getProxyEndpoint() string {
 
 // getProxyURL builds a full URL to the Copilot API for the given path.
 func (s *Service) getProxyURL(path string) string {
+	// A configured Copilot API URL takes precedence over the key's endpoint
+	if base := strings.TrimRight(s.config.CopilotAPIURL, "/"); base != "" {
+		return base + path
+	}
 	// Build full API URL using proxy endpoint
 	host := s.getProxyEndpoint()
 	// If endpoint includes scheme, use it directly
@@ -77,99 +251,277 @@ func (s *Service) getProxyURL(path string) string {
 
 // CompletionRequest contains the data needed for a completion request
 type CompletionRequest struct {
+	// Context carries the caller's trace and cancellation: the upstream
+	// request is aborted once it is done. nil is treated as
+	// context.Background().
+	Context         context.Context
 	Model           string
 	ProviderRequest string // JSON payload for the provider
 	Token           *models.LLMToken
 	CountryCode     *string
 	CurrentSpending uint32
+	// Endpoint is the HTTP path or RPC method the request came in on, as
+	// reported to request hooks
+	Endpoint string
 }
 
-// RecordUsage records token usage for a user and model
-func (s *Service) RecordUsage(userID uint64, model string, usage models.TokenUsage) {
-	s.usageLock.Lock()
-	defer s.usageLock.Unlock()
-
-	existing, exists := s.userUsage[userID]
+// SetUsageStore replaces the in-memory usage store, typically with a
+// persistent one opened by OpenUsageStore.
+func (s *Service) SetUsageStore(store UsageStore) {
+	s.usage = store
+}
 
-	if !exists {
-		existing = models.ModelUsage{
-			UserID:             userID,
-			Model:              model,
-			RequestsThisMinute: 1,
-			TokensThisMinute:   usage.Input + usage.Output,
+// ReloadConfig re-reads the model aliases, model prices, system prompt,
+// prompt templates, content filter rules, budgets, rate limits and tenants
+// from their files and the environment. Requests
+// already in flight, including open streams, are unaffected; settings that
+// fail to load are kept.
+func (s *Service) ReloadConfig() error {
+	s.config.SetModelAliases(loadModelAliases())
+	s.config.SetModelMetadata(loadModelMetadata())
+	s.config.SetModelRateLimits(loadModelRateLimits())
+	s.config.SetModelPrices(loadModelPrices())
+	s.config.SetSystemPrompt(loadSystemPrompt())
+	var errs []string
+	if s.budgets != nil {
+		if err := s.budgets.reload(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if s.rateLimits != nil {
+		if err := s.rateLimits.reload(); err != nil {
+			errs = append(errs, err.Error())
 		}
-	} else {
-		existing.RequestsThisMinute++
-		existing.TokensThisMinute += usage.Input + usage.Output
 	}
+	if s.tenants != nil {
+		if err := s.tenants.reload(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if s.templates != nil {
+		if err := s.templates.reload(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if s.contentFilter != nil {
+		if err := s.contentFilter.reload(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
 
-	s.userUsage[userID] = existing
+// RecordUsage records token usage for a user and model
+func (s *Service) RecordUsage(userID uint64, model string, usage models.TokenUsage) {
+	s.recordUsage(userID, model, usage, 0)
+}
+
+// recordUsage records token usage together with the upstream latency
+func (s *Service) recordUsage(userID uint64, model string, usage models.TokenUsage, latency time.Duration) {
+	s.recordKeyRateLimit(userID, usage)
+	event := models.UsageEvent{
+		Time:             time.Now(),
+		Key:              usageKeyForUser(userID),
+		Model:            model,
+		InputTokens:      usage.Input,
+		OutputTokens:     usage.Output,
+		LatencyMs:        latency.Milliseconds(),
+		EstimatedCostUSD: s.config.modelPrice(model).cost(usage.Input, usage.Output),
+	}
+	if s.usageReporter != nil {
+		s.usageReporter(event)
+	}
+	if s.usage == nil {
+		return
+	}
+	if err := s.usage.Record(event); err != nil {
+		log.Printf("Warning: %v", err)
+	}
 }
 
-// GetModelUsage returns the current usage for a user and model
+// GetModelUsage returns the usage of a model by a user in the current
+// minute and the current day
 func (s *Service) GetModelUsage(userID uint64, model string) models.ModelUsage {
-	s.usageLock.RLock()
-	defer s.usageLock.RUnlock()
-
-	existing, exists := s.userUsage[userID]
-	if !exists {
-		return models.ModelUsage{
-			UserID: userID,
-			Model:  model,
+	result := models.ModelUsage{UserID: userID, Model: model}
+	if s.usage == nil {
+		return result
+	}
+
+	now := time.Now()
+	key := usageKeyForUser(userID)
+	minute, err := s.usage.Aggregate(now.Truncate(time.Minute), key)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return result
+	}
+	for _, agg := range minute {
+		if agg.Model == model {
+			result.RequestsThisMinute = agg.Requests
+			result.TokensThisMinute = agg.TotalTokens
+			result.InputTokensThisMinute = agg.InputTokens
+			result.OutputTokensThisMinute = agg.OutputTokens
 		}
 	}
-	return existing
+	day, err := s.usage.Aggregate(s.config.startOfDay(now), key)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return result
+	}
+	for _, agg := range day {
+		if agg.Model == model {
+			result.TokensThisDay = agg.TotalTokens
+		}
+	}
+	return result
+}
+
+// CurrentSpending returns a user's estimated spending in cents in the
+// current month, priced with the configured model prices
+func (s *Service) CurrentSpending(userID uint64) uint32 {
+	aggregates, err := s.UsageStats(s.config.startOfMonth(time.Now()), usageKeyForUser(userID))
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return 0
+	}
+	var cost float64
+	for _, agg := range aggregates {
+		cost += agg.EstimatedCostUSD
+	}
+	return uint32(math.Ceil(cost * 100))
 }
 
 // PerformCompletion handles a GitHub Copilot completion request
 func (s *Service) PerformCompletion(req CompletionRequest) (*http.Response, error) {
-	// Ensure we have a valid API key and model list (30m TTL)
+	ctx := req.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracing.Start(ctx, "PerformCompletion", tracing.SpanKindInternal, tracing.String("llm.model", req.Model))
+	defer span.End()
+
+	resp, err := s.performCompletion(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+	} else {
+		span.SetAttributes(tracing.Int("http.status_code", resp.StatusCode))
+	}
+	return resp, err
+}
+
+func (s *Service) performCompletion(ctx context.Context, req CompletionRequest) (*http.Response, error) {
+	ctx, checked, err := s.checkCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return s.sendCompletion(ctx, checked)
+}
+
+// checkedCompletion is a completion request that passed checkCompletion
+type checkedCompletion struct {
+	provider        models.LanguageModelProvider
+	modelID         string
+	providerRequest string
+}
+
+// checkCompletion resolves the model of a completion request and enforces
+// everything a request must pass before it is answered, from the cache or
+// upstream: the token's model access, the model, key and tenant rate limits,
+// spending limits and budgets, the request hooks, the content filter and
+// the context window. The returned context carries the key's tenant.
+func (s *Service) checkCompletion(ctx context.Context, req CompletionRequest) (context.Context, checkedCompletion, error) {
+	// Enforce the external policy hooks of REQUEST_HOOKS
+	req, err := s.hookCompletion(ctx, req)
+	if err != nil {
+		return ctx, checkedCompletion{}, err
+	}
+
+	// Ensure we have a valid API key and model list
 	if err := s.ensureAuthAndModels(); err != nil {
-		return nil, fmt.Errorf("authorization refresh failed: %w", err)
+		return ctx, checkedCompletion{}, fmt.Errorf("authorization refresh failed: %w", err)
 	}
-	copilotModels := s.modelsCache
+	copilotModels := s.cachedModels()
 
-	modelID := req.Model
-	found := false
-	for _, m := range copilotModels {
-		if m.ID == modelID {
-			found = true
+	// Rewrite aliases such as "gpt-4" to a concrete Copilot model ID
+	modelID := s.config.ResolveModel(req.Model)
+	var model *models.LanguageModel
+	for i := range copilotModels {
+		if copilotModels[i].ID == modelID {
+			model = &copilotModels[i]
 			break
 		}
 	}
-	if !found {
+	if model == nil {
 		// Refresh cache and try again
 		if err := s.ensureAuthAndModels(); err != nil {
-			return nil, fmt.Errorf("authorization refresh failed: %w", err)
+			return ctx, checkedCompletion{}, fmt.Errorf("authorization refresh failed: %w", err)
 		}
-		copilotModels = s.modelsCache
-		for _, m := range copilotModels {
-			if m.ID == modelID {
-				found = true
+		copilotModels = s.cachedModels()
+		for i := range copilotModels {
+			if copilotModels[i].ID == modelID {
+				model = &copilotModels[i]
 				break
 			}
 		}
 	}
-	if !found {
-		return nil, fmt.Errorf("unknown model: %s", modelID)
+	if model == nil {
+		return ctx, checkedCompletion{}, fmt.Errorf("unknown model: %s", modelID)
+	}
+	if _, err := s.provider(model.Provider); err != nil {
+		return ctx, checkedCompletion{}, err
 	}
 
+	// Send the request with the Copilot credentials of the key's tenant
+	ctx = withTenant(ctx, req.Token.Tenant)
+
 	// Get current usage
 	usage := s.GetModelUsage(req.Token.UserID, modelID)
 
 	// Validate access (personal use: always allowed)
 	if err := ValidateAccess(req.Token, modelID, usage); err != nil {
-		return nil, err
+		return ctx, checkedCompletion{}, err
+	}
+	if err := s.checkModelRateLimit(modelID, usage); err != nil {
+		return ctx, checkedCompletion{}, err
+	}
+	if err := CheckSpendingLimit(req.Token, req.CurrentSpending); err != nil {
+		return ctx, checkedCompletion{}, err
+	}
+	if err := s.checkBudget(req.Token.UserID); err != nil {
+		return ctx, checkedCompletion{}, err
+	}
+	if err := s.checkKeyRateLimit(req.Token.UserID); err != nil {
+		return ctx, checkedCompletion{}, err
 	}
 
-	// Call Copilot API passing the selected model (no modifications)
-	return s.callCopilotAPI(req.ProviderRequest, modelID)
+	// Check the prompt against the content filter before spending quota
+	providerRequest, err := s.filterContent(ctx, req.ProviderRequest)
+	if err != nil {
+		return ctx, checkedCompletion{}, err
+	}
+	providerRequest, err = s.fitContextWindow(ctx, model, providerRequest)
+	if err != nil {
+		return ctx, checkedCompletion{}, err
+	}
+	return ctx, checkedCompletion{provider: model.Provider, modelID: modelID, providerRequest: providerRequest}, nil
+}
+
+// sendCompletion calls the model's provider passing the selected model (no
+// modifications), falling back to other providers if it fails
+func (s *Service) sendCompletion(ctx context.Context, c checkedCompletion) (*http.Response, error) {
+	return s.streamWithFallback(ctx, c.provider, c.modelID, c.providerRequest)
 }
 
 // callCopilotAPI calls the GitHub Copilot API for chat completions.
-func (s *Service) callCopilotAPI(providerRequest, modelID string) (*http.Response, error) {
-	apiKey := s.config.CopilotAPIKey
-	if apiKey == "" {
+func (s *Service) callCopilotAPI(ctx context.Context, providerRequest, modelID string) (*http.Response, error) {
+	tenantAccount, err := s.tenantAccount(tenantFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	apiKey := s.config.APIKey()
+	if tenantAccount == nil && apiKey == "" && s.accounts.size() == 0 {
 		return nil, ErrCopilotAPIKeyMissing
 	}
 
@@ -179,27 +531,97 @@ func (s *Service) callCopilotAPI(providerRequest, modelID string) (*http.Respons
 	}
 
 	// Build clean request payload for Copilot API
-	cleanData := map[string]interface{}{"model": modelID, "stream": true}
-	if msgs, ok := requestData["messages"]; ok {
-		cleanData["messages"] = msgs
-	}
-	if temp, ok := requestData["temperature"]; ok {
-		cleanData["temperature"] = temp
+	// Ask for the usage chunk at the end of the stream for the accounting
+	cleanData := map[string]interface{}{"model": modelID, "stream": true, "stream_options": map[string]interface{}{"include_usage": true}}
+	for _, key := range forwardedParams {
+		if v, ok := requestData[key]; ok {
+			cleanData[key] = v
+		}
 	}
-	if topP, ok := requestData["top_p"]; ok {
-		cleanData["top_p"] = topP
+	messages, hasImages, err := transcodeMessages(cleanData["messages"])
+	if err != nil {
+		return nil, err
 	}
-	if maxTok, ok := requestData["max_tokens"]; ok {
-		cleanData["max_tokens"] = maxTok
+	if messages != nil {
+		cleanData["messages"] = messages
 	}
 	body, err := json.Marshal(cleanData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
+	// Tenants with their own credentials only use those
+	if tenantAccount != nil {
+		return s.doAccountChatRequest(ctx, tenantAccount, body, hasImages)
+	}
+	// Balance requests over the pooled accounts when there are any
+	if s.accounts.size() > 0 {
+		return s.doPooledChatRequest(ctx, body, hasImages)
+	}
+
+	resp, err := s.doChatRequest(ctx, body, hasImages, apiKey)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// The key was rejected before its expiry: re-exchange it and retry once
+	freshKey, err := s.refreshAPIKey(apiKey)
+	if err != nil {
+		log.Printf("Warning: Copilot API key refresh after 401 failed: %v", err)
+		return resp, nil
+	}
+	resp.Body.Close()
+	return s.doChatRequest(ctx, body, hasImages, freshKey)
+}
+
+// copilotRequest sends a prepared payload to a Copilot API endpoint other
+// than chat completions with the configured API key, or the credentials of
+// the context's tenant. A key rejected before its expiry is re-exchanged and
+// the request retried once.
+func (s *Service) copilotRequest(ctx context.Context, spanName, path, intent string, body []byte) (*http.Response, error) {
+	tenantAccount, err := s.tenantAccount(tenantFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if tenantAccount != nil {
+		return s.doAccountRequest(tenantAccount, func(apiKey string) (*http.Response, error) {
+			return s.doCopilotRequest(ctx, spanName, path, intent, body, false, apiKey)
+		})
+	}
+	apiKey := s.config.APIKey()
+	if apiKey == "" {
+		return nil, ErrCopilotAPIKeyMissing
+	}
+	resp, err := s.doCopilotRequest(ctx, spanName, path, intent, body, false, apiKey)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	freshKey, err := s.refreshAPIKey(apiKey)
+	if err != nil {
+		log.Printf("Warning: Copilot API key refresh after 401 failed: %v", err)
+		return resp, nil
+	}
+	resp.Body.Close()
+	return s.doCopilotRequest(ctx, spanName, path, intent, body, false, freshKey)
+}
+
+// doChatRequest sends a prepared chat completion payload to the Copilot API.
+func (s *Service) doChatRequest(ctx context.Context, body []byte, hasImages bool, apiKey string) (*http.Response, error) {
+	return s.doCopilotRequest(ctx, "copilot.chat_completions", "/chat/completions", "conversation-agent", body, hasImages, apiKey)
+}
+
+// doCopilotRequest sends a prepared payload to a Copilot API endpoint with
+// the editor headers the API expects for intent, tracing it as a span named
+// spanName.
+func (s *Service) doCopilotRequest(ctx context.Context, spanName, path, intent string, body []byte, hasImages bool, apiKey string) (*http.Response, error) {
+	ctx, span := tracing.Start(ctx, spanName, tracing.SpanKindClient)
+	defer span.End()
+
 	// Create HTTP request
-	url := s.getProxyURL("/chat/completions")
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	url := s.getProxyURL(path)
+	// Bind the request to the caller's context so that a client disconnect
+	// aborts the upstream generation
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -209,15 +631,7 @@ func (s *Service) callCopilotAPI(providerRequest, modelID string) (*http.Respons
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 
 	// Editor and plugin version
-	editorVersion := s.config.EditorVersion
-	if editorVersion == "" {
-		editorVersion = "vscode/1.99.2" // Default value
-	}
-
-	pluginVersion := s.config.EditorPluginVersion
-	if pluginVersion == "" {
-		pluginVersion = "copilot-chat/0.26.3" // Default value
-	}
+	editorVersion, pluginVersion := s.config.editorVersions()
 
 	integrationID := "vscode-chat"
 	userAgent := "GitHubCopilotChat/" + strings.TrimPrefix(pluginVersion, "copilot-chat/")
@@ -227,35 +641,76 @@ func (s *Service) callCopilotAPI(providerRequest, modelID string) (*http.Respons
 	req.Header.Set("Editor-Plugin-Version", pluginVersion)
 	req.Header.Set("Copilot-Integration-ID", integrationID)
 	req.Header.Set("User-Agent", userAgent)
-	req.Header.Set("OpenAI-Intent", "conversation-agent")
+	req.Header.Set("OpenAI-Intent", intent)
 	req.Header.Set("X-GitHub-API-Version", "2025-04-01")
 	req.Header.Set("X-Initiator", "user")
-	req.Header.Set("X-Interaction-Type", "conversation-agent")
+	req.Header.Set("X-Interaction-Type", intent)
 
-	// Generate unique request ID
-	requestID := generateRequestID()
-	req.Header.Set("X-Request-ID", requestID)
+	// Image inputs are only accepted on vision requests
+	if hasImages {
+		req.Header.Set("Copilot-Vision-Request", "true")
+	}
 
-	// If provided, set VS Code specific headers
-	if s.config.VSCodeMachineID != "" {
-		req.Header.Set("Vscode-Machineid", s.config.VSCodeMachineID)
+	// Forward the client's request ID, or generate a unique one
+	requestID := RequestIDFromContext(ctx)
+	if requestID == "" {
+		requestID = generateRequestID()
 	}
+	req.Header.Set(RequestIDHeader, requestID)
+
+	// Identify as the same VS Code machine across runs
+	machineID, sessionID := s.config.clientIDs()
+	req.Header.Set("Vscode-Machineid", machineID)
+	req.Header.Set("Vscode-Sessionid", sessionID)
 
-	if s.config.VSCodeSessionID != "" {
-		req.Header.Set("Vscode-Sessionid", s.config.VSCodeSessionID)
+	// Propagate the trace to the upstream
+	tracing.Inject(ctx, req.Header)
+	span.SetAttributes(tracing.String("http.url", url), tracing.String("http.request_id", requestID))
+
+	// Remember when the request was sent so usage records carry its latency
+	req = req.WithContext(context.WithValue(req.Context(), upstreamStartKey{}, time.Now()))
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, wrapTransportError(err)
 	}
+	span.SetAttributes(tracing.Int("http.status_code", resp.StatusCode))
+	return resp, nil
+}
 
-	// Debug: log outgoing HTTP request body
-	reqBodyBytes, _ := io.ReadAll(req.Body)
-	// Reset body after reading
-	req.Body = io.NopCloser(bytes.NewBuffer(reqBodyBytes))
+// upstreamStartKey is the request context key holding when an upstream
+// completion request was sent
+type upstreamStartKey struct{}
 
-	return s.httpClient.Do(req)
+// upstreamLatency returns how long the upstream took to respond with headers,
+// or 0 if the response did not come from doChatRequest
+func upstreamLatency(resp *http.Response) time.Duration {
+	if resp.Request == nil {
+		return 0
+	}
+	start, ok := resp.Request.Context().Value(upstreamStartKey{}).(time.Time)
+	if !ok {
+		return 0
+	}
+	return time.Since(start)
 }
 
 // FetchModels calls the GitHub Copilot API to retrieve available models.
 func (s *Service) FetchModels() ([]models.LanguageModel, error) {
-	apiKey := s.config.CopilotAPIKey
+	ctx, span := tracing.Start(context.Background(), "copilot.fetch_models", tracing.SpanKindClient)
+	defer span.End()
+
+	modelsList, err := s.fetchModels(ctx)
+	if err != nil {
+		span.RecordError(err)
+	} else {
+		span.SetAttributes(tracing.Int("llm.model_count", len(modelsList)))
+	}
+	return modelsList, err
+}
+
+func (s *Service) fetchModels(ctx context.Context) ([]models.LanguageModel, error) {
+	apiKey := s.config.APIKey()
 	if apiKey == "" {
 		return nil, ErrCopilotAPIKeyMissing
 	}
@@ -269,14 +724,7 @@ func (s *Service) FetchModels() ([]models.LanguageModel, error) {
 
 	// Required IDE auth headers
 	req.Header.Set("Authorization", "Bearer "+apiKey)
-	editorVersion := s.config.EditorVersion
-	if editorVersion == "" {
-		editorVersion = "vscode/1.99.2"
-	}
-	pluginVersion := s.config.EditorPluginVersion
-	if pluginVersion == "" {
-		pluginVersion = "copilot-chat/0.26.3"
-	}
+	editorVersion, pluginVersion := s.config.editorVersions()
 	// Set headers
 	req.Header.Set("Editor-Version", editorVersion)
 	req.Header.Set("Editor-Plugin-Version", pluginVersion)
@@ -284,6 +732,7 @@ func (s *Service) FetchModels() ([]models.LanguageModel, error) {
 	req.Header.Set("User-Agent", "GitHubCopilotChat/"+strings.TrimPrefix(pluginVersion, "copilot-chat/"))
 	req.Header.Set("OpenAI-Intent", "conversation-agent")
 	req.Header.Set("X-GitHub-API-Version", "2025-04-01")
+	tracing.Inject(ctx, req.Header)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
@@ -299,8 +748,13 @@ func (s *Service) FetchModels() ([]models.LanguageModel, error) {
 	// Decode models response which contains `data` array of model objects
 	var wrapper struct {
 		Data []struct {
-			ID   string `json:"id"`
-			Name string `json:"name"`
+			ID           string `json:"id"`
+			Name         string `json:"name"`
+			Capabilities struct {
+				Limits struct {
+					MaxContextWindowTokens int `json:"max_context_window_tokens"`
+				} `json:"limits"`
+			} `json:"capabilities"`
 		} `json:"data"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&wrapper); err != nil {
@@ -310,49 +764,16 @@ func (s *Service) FetchModels() ([]models.LanguageModel, error) {
 	modelsList := make([]models.LanguageModel, len(wrapper.Data))
 	for i, m := range wrapper.Data {
 		modelsList[i] = models.LanguageModel{
-			ID:       m.ID,
-			Name:     m.Name,
-			Provider: models.ProviderCopilot,
-			Enabled:  true,
+			ID:            m.ID,
+			Name:          m.Name,
+			Provider:      models.ProviderCopilot,
+			Enabled:       true,
+			ContextWindow: m.Capabilities.Limits.MaxContextWindowTokens,
 		}
 	}
 	return modelsList, nil
 }
 
-// ensureAuthAndModels ensures the API key is valid and models are cached.
-func (s *Service) ensureAuthAndModels() error {
-	s.authMu.Lock()
-	defer s.authMu.Unlock()
-
-	// If cache is fresh, nothing to do
-	if time.Since(s.lastAuthTime) < 30*time.Minute && len(s.modelsCache) > 0 {
-		return nil
-	}
-
-	// Try to load a fresh Copilot token from VS Code config
-	token, err := utils.GetCopilotToken()
-	if err != nil {
-		// Fallback to previously set config or environment var
-		token = s.config.CopilotAPIKey
-		if token == "" {
-			token = os.Getenv("COPILOT_API_KEY")
-		}
-		if token == "" {
-			return fmt.Errorf("failed to refresh API key: %w", err)
-		}
-	}
-	s.config.CopilotAPIKey = token
-
-	// Fetch the live model list
-	models, err := s.FetchModels()
-	if err != nil {
-		return fmt.Errorf("failed to fetch models: %w", err)
-	}
-	s.modelsCache = models
-	s.lastAuthTime = time.Now()
-	return nil
-}
-
 // generateRequestID creates a unique request ID for Copilot API calls
 func generateRequestID() string {
 	return fmt.Sprintf("%x-%x-%x-%x-%x",
@@ -385,51 +806,15 @@ func (s *Service) SubmitTestPrompt(prompt string) (string, error) {
 	}
 
 	// Call the Copilot API
-	resp, err := s.callCopilotAPI(string(providerRequest), "gpt-4o")
+	provider, err := s.provider(models.ProviderCopilot)
 	if err != nil {
-		return "", fmt.Errorf("API call failed: %w", err)
+		return "", err
 	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
+	result, err := provider.Complete(context.Background(), "gpt-4o", string(providerRequest))
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
-	}
-
-	// If response status is not successful, return the error
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API returned error: %s - %s", resp.Status, string(body))
-	}
-
-	// Parse the JSON response
-	var responseData map[string]interface{}
-	if err := json.Unmarshal(body, &responseData); err != nil {
-		return "", fmt.Errorf("failed to parse response: %w", err)
-	}
-
-	// Extract the assistant's message content
-	choices, ok := responseData["choices"].([]interface{})
-	if !ok || len(choices) == 0 {
-		return "", fmt.Errorf("no choices in response")
-	}
-
-	choice, ok := choices[0].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("invalid choice format")
-	}
-
-	message, ok := choice["message"].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("invalid message format")
-	}
-
-	content, ok := message["content"].(string)
-	if !ok {
-		return "", fmt.Errorf("invalid content format")
+		return "", fmt.Errorf("API call failed: %w", err)
 	}
-
-	return content, nil
+	return result.Content, nil
 }
 
 // SubmitStreamingTestPrompt sends a test prompt to the GitHub Copilot API and streams the response to the terminal.
@@ -455,26 +840,31 @@ func (s *Service) SubmitStreamingTestPrompt(prompt string) error {
 	}
 
 	// Call the Copilot API
-	resp, err := s.callCopilotAPI(string(providerRequest), "gpt-4o")
+	resp, err := s.callCopilotAPI(context.Background(), string(providerRequest), "gpt-4o")
 	if err != nil {
 		return fmt.Errorf("API call failed: %w", err)
 	}
-	defer resp.Body.Close()
 
 	// If response status is not successful, return the error
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
 		return fmt.Errorf("API returned error: %s - %s", resp.Status, string(body))
 	}
 
-	// Process the streaming response
-	scanner := bufio.NewScanner(resp.Body)
+	// Process the streaming response; the reader records the usage the
+	// upstream reports, or the counted tokens, when it is closed
+	body := &usageReader{
+		ReadCloser:   resp.Body,
+		service:      s,
+		model:        "gpt-4o",
+		promptTokens: countPromptTokens("gpt-4o", string(providerRequest)),
+	}
+	defer body.Close()
+	scanner := bufio.NewScanner(body)
 
 	fmt.Println("\nStreaming response from Copilot API:")
 
-	// Create a buffer to hold the complete response
-	var fullResponse strings.Builder
-
 	for scanner.Scan() {
 		line := scanner.Text()
 
@@ -525,34 +915,33 @@ func (s *Service) SubmitStreamingTestPrompt(prompt string) error {
 
 		// Print the content chunk without a newline to create a stream effect
 		fmt.Print(content)
-		fullResponse.WriteString(content)
 	}
 
 	// Print a final newline
 	fmt.Println()
 
-	// Record usage statistics (simplified for CLI usage)
-	s.RecordUsage(0, "gpt-4o", models.TokenUsage{
-		Input:  100, // Simplified estimation
-		Output: 100, // Simplified estimation
-	})
-
 	return scanner.Err()
 }
 
-// ProcessStreamingResponse processes a streaming response from the Copilot API
-func (s *Service) ProcessStreamingResponse(resp *http.Response, userID uint64, model string) (io.ReadCloser, error) {
+// ProcessStreamingResponse processes a streaming response from the Copilot
+// API. The returned reader records the request's token usage when closed,
+// under the model the request's alias resolves to so the usage counts
+// against that model's limits; failed responses are returned as an
+// *UpstreamError.
+func (s *Service) ProcessStreamingResponse(resp *http.Response, req CompletionRequest) (io.ReadCloser, error) {
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
-		return nil, fmt.Errorf("API returned error: %s", string(body))
-	}
-
-	// Record basic usage statistics (this is a simplified version)
-	s.RecordUsage(userID, model, models.TokenUsage{
-		Input:  100, // Simplified estimation
-		Output: 100, // Simplified estimation
-	})
-
-	return resp.Body, nil
+		return nil, newUpstreamError(resp, body)
+	}
+
+	modelID := s.config.ResolveModel(req.Model)
+	return &usageReader{
+		ReadCloser:   resp.Body,
+		service:      s,
+		userID:       req.Token.UserID,
+		model:        modelID,
+		promptTokens: countPromptTokens(modelID, req.ProviderRequest),
+		latency:      upstreamLatency(resp),
+	}, nil
 }
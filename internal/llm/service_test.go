@@ -1,8 +1,10 @@
 package llm
 
 import (
+	"context"
 	"copilot-proxy/pkg/models"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -20,8 +22,8 @@ func TestNewService(t *testing.T) {
 	if service.httpClient == nil {
 		t.Error("NewService() returned service with nil httpClient")
 	}
-	if service.userUsage == nil {
-		t.Error("NewService() returned service with nil userUsage map")
+	if service.usage == nil {
+		t.Error("NewService() returned service with nil usage store")
 	}
 }
 
@@ -60,6 +62,17 @@ func TestGetProxyEndpoint(t *testing.T) {
 	}
 }
 
+func TestGetProxyURL(t *testing.T) {
+	s := &Service{config: &Config{CopilotAPIKey: "tid=1;proxy-ep=proxy.enterprise.githubcopilot.com;"}}
+	if got := s.getProxyURL("/models"); got != "https://proxy.enterprise.githubcopilot.com/models" {
+		t.Errorf("getProxyURL() = %q", got)
+	}
+	s.config.CopilotAPIURL = "https://copilot.example.com/"
+	if got := s.getProxyURL("/models"); got != "https://copilot.example.com/models" {
+		t.Errorf("getProxyURL() with CopilotAPIURL = %q", got)
+	}
+}
+
 func TestRecordAndGetModelUsage(t *testing.T) {
 	s := NewService()
 	userID := uint64(1)
@@ -159,3 +172,101 @@ func TestGenerateRequestID(t *testing.T) {
 		t.Errorf("generateRequestID() returned ID with wrong format: %s", id1)
 	}
 }
+
+func TestCallCopilotAPIForwardsTools(t *testing.T) {
+	var received map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	s := &Service{
+		config:     &Config{CopilotAPIKey: "test-key;proxy-ep=" + ts.URL},
+		httpClient: ts.Client(),
+	}
+	providerRequest := `{"messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"f"}}],"tool_choice":"auto","unknown_field":1}`
+	resp, err := s.callCopilotAPI(context.Background(), providerRequest, "test-model")
+	if err != nil {
+		t.Fatalf("callCopilotAPI() error = %v", err)
+	}
+	resp.Body.Close()
+
+	for _, key := range []string{"tools", "tool_choice", "messages"} {
+		if _, ok := received[key]; !ok {
+			t.Errorf("expected %s to be forwarded upstream", key)
+		}
+	}
+	if _, ok := received["unknown_field"]; ok {
+		t.Error("unexpected field forwarded upstream")
+	}
+}
+
+func TestCallCopilotAPIRetriesUnauthorized(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		requests = append(requests, auth)
+		if !strings.HasPrefix(auth, "Bearer fresh-key") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name         string
+		refresher    func(c *Config) func() error
+		wantStatus   int
+		wantRequests int
+	}{
+		{
+			name: "retries with refreshed key",
+			refresher: func(c *Config) func() error {
+				return func() error {
+					c.SetAPIKey("fresh-key;proxy-ep=" + ts.URL)
+					return nil
+				}
+			},
+			wantStatus:   http.StatusOK,
+			wantRequests: 2,
+		},
+		{
+			name:         "no refresher returns 401",
+			refresher:    func(c *Config) func() error { return nil },
+			wantStatus:   http.StatusUnauthorized,
+			wantRequests: 1,
+		},
+		{
+			name: "failed refresh returns 401",
+			refresher: func(c *Config) func() error {
+				return func() error { return errors.New("exchange failed") }
+			},
+			wantStatus:   http.StatusUnauthorized,
+			wantRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = nil
+			s := &Service{
+				config:     &Config{CopilotAPIKey: "stale-key;proxy-ep=" + ts.URL},
+				httpClient: ts.Client(),
+			}
+			s.SetKeyRefresher(tt.refresher(s.config))
+
+			resp, err := s.callCopilotAPI(context.Background(), `{"messages":[{"role":"user","content":"hi"}]}`, "test-model")
+			if err != nil {
+				t.Fatalf("callCopilotAPI() error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if len(requests) != tt.wantRequests {
+				t.Errorf("upstream requests = %d, want %d", len(requests), tt.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package llm
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session summarizes a stored conversation
+type Session struct {
+	ID           string    `json:"id"`
+	MessageCount int       `json:"message_count"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// SessionStore keeps the message history of conversation sessions. Sessions
+// belong to an API key, so a key only sees its own. Implementations must be
+// safe for concurrent use.
+type SessionStore interface {
+	// Messages returns the history of a session in order; a session that
+	// does not exist has none
+	Messages(key, id string) ([]json.RawMessage, error)
+	// Append adds messages to a session, creating it if needed, and drops
+	// the oldest messages beyond max (0 keeps all)
+	Append(key, id string, messages []json.RawMessage, max int) error
+	// List returns the sessions of a key, most recently updated first
+	List(key string) ([]Session, error)
+	// Delete removes a session and reports whether it existed
+	Delete(key, id string) (bool, error)
+	// Close releases the store's resources
+	Close() error
+}
+
+// OpenSessionStore opens the session store selected by the configuration.
+// Sessions are kept in memory by default; SESSION_STORE=sqlite keeps them
+// in a SQLite database so that they survive restarts.
+func OpenSessionStore(c *Config) (SessionStore, error) {
+	switch c.SessionStore {
+	case "", "memory":
+		return newMemorySessionStore(), nil
+	case "sqlite":
+		path := c.SessionDBPath
+		if path == "" {
+			dir, err := os.UserConfigDir()
+			if err != nil {
+				return nil, fmt.Errorf("failed to locate session database directory: %w", err)
+			}
+			path = filepath.Join(dir, "copilot-proxy", "sessions.db")
+		}
+		return NewSQLiteSessionStore(path)
+	default:
+		return nil, fmt.Errorf("unknown session store %q", c.SessionStore)
+	}
+}
+
+// memorySession is the history of one session held in memory
+type memorySession struct {
+	messages  []json.RawMessage
+	updatedAt time.Time
+}
+
+// memorySessionStore keeps sessions in memory only
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]map[string]*memorySession
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]map[string]*memorySession)}
+}
+
+// Messages returns a copy of the history of a session
+func (m *memorySessionStore) Messages(key, id string) ([]json.RawMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[key][id]
+	if !ok {
+		return nil, nil
+	}
+	return append([]json.RawMessage(nil), session.messages...), nil
+}
+
+// Append adds messages to a session
+func (m *memorySessionStore) Append(key, id string, messages []json.RawMessage, max int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions[key] == nil {
+		m.sessions[key] = make(map[string]*memorySession)
+	}
+	session := m.sessions[key][id]
+	if session == nil {
+		session = &memorySession{}
+		m.sessions[key][id] = session
+	}
+	session.messages = append(session.messages, messages...)
+	if max > 0 && len(session.messages) > max {
+		session.messages = append([]json.RawMessage(nil), session.messages[len(session.messages)-max:]...)
+	}
+	session.updatedAt = time.Now().UTC()
+	return nil
+}
+
+// List returns the sessions of a key
+func (m *memorySessionStore) List(key string) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []Session{}
+	for id, session := range m.sessions[key] {
+		list = append(list, Session{ID: id, MessageCount: len(session.messages), UpdatedAt: session.updatedAt})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UpdatedAt.After(list[j].UpdatedAt) })
+	return list, nil
+}
+
+// Delete removes a session
+func (m *memorySessionStore) Delete(key, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[key][id]; !ok {
+		return false, nil
+	}
+	delete(m.sessions[key], id)
+	return true, nil
+}
+
+// Close does nothing; the sessions are discarded with the store
+func (m *memorySessionStore) Close() error {
+	return nil
+}
+
+// sessionSchema creates the tables of the session database
+const sessionSchema = `CREATE TABLE IF NOT EXISTS session_messages (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	usage_key   TEXT    NOT NULL,
+	session_id  TEXT    NOT NULL,
+	created_at  INTEGER NOT NULL,
+	message     TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS session_messages_session ON session_messages (usage_key, session_id, id);`
+
+// sqliteSessionStore persists sessions in a SQLite database
+type sqliteSessionStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteSessionStore opens or creates the SQLite session database at path
+func NewSQLiteSessionStore(path string) (SessionStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create session database directory: %w", err)
+	}
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session database: %w", err)
+	}
+	// A single connection serializes writers instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sessionSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize session database: %w", err)
+	}
+	return &sqliteSessionStore{db: db}, nil
+}
+
+// Messages reads the history of a session
+func (s *sqliteSessionStore) Messages(key, id string) ([]json.RawMessage, error) {
+	rows, err := s.db.Query(
+		`SELECT message FROM session_messages WHERE usage_key = ? AND session_id = ? ORDER BY id`,
+		key, id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query session: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []json.RawMessage
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			return nil, fmt.Errorf("failed to read session: %w", err)
+		}
+		messages = append(messages, json.RawMessage(message))
+	}
+	return messages, rows.Err()
+}
+
+// Append inserts messages into a session and prunes its oldest ones
+func (s *sqliteSessionStore) Append(key, id string, messages []json.RawMessage, max int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to store session: %w", err)
+	}
+	now := time.Now().UnixMilli()
+	for _, message := range messages {
+		if _, err := tx.Exec(
+			`INSERT INTO session_messages (usage_key, session_id, created_at, message) VALUES (?, ?, ?, ?)`,
+			key, id, now, string(message),
+		); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to store session: %w", err)
+		}
+	}
+	if max > 0 {
+		if _, err := tx.Exec(
+			`DELETE FROM session_messages WHERE usage_key = ? AND session_id = ? AND id NOT IN (
+				SELECT id FROM session_messages WHERE usage_key = ? AND session_id = ? ORDER BY id DESC LIMIT ?)`,
+			key, id, key, id, max,
+		); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to prune session: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to store session: %w", err)
+	}
+	return nil
+}
+
+// List returns the sessions of a key
+func (s *sqliteSessionStore) List(key string) ([]Session, error) {
+	rows, err := s.db.Query(
+		`SELECT session_id, COUNT(*), MAX(created_at)
+		FROM session_messages
+		WHERE usage_key = ?
+		GROUP BY session_id
+		ORDER BY MAX(created_at) DESC, session_id`,
+		key,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	list := []Session{}
+	for rows.Next() {
+		var session Session
+		var updatedAt int64
+		if err := rows.Scan(&session.ID, &session.MessageCount, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read sessions: %w", err)
+		}
+		session.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+		list = append(list, session)
+	}
+	return list, rows.Err()
+}
+
+// Delete removes the messages of a session
+func (s *sqliteSessionStore) Delete(key, id string) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM session_messages WHERE usage_key = ? AND session_id = ?`, key, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete session: %w", err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Close closes the database
+func (s *sqliteSessionStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,149 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidSessionID is returned for a session_id that is not up to 128
+// printable ASCII characters, the same rule as for request IDs
+var ErrInvalidSessionID = errors.New("invalid session_id")
+
+// SetSessionStore replaces the in-memory session store, typically with a
+// persistent one opened by OpenSessionStore.
+func (s *Service) SetSessionStore(store SessionStore) {
+	s.sessions = store
+}
+
+// sessionTurn is a chat completion request that continues a session: the
+// messages it adds, which are stored together with the reply
+type sessionTurn struct {
+	store    SessionStore
+	key, id  string
+	messages []json.RawMessage
+	max      int
+}
+
+// loadSession removes the session_id of a chat completion request and, if
+// there is one, inserts the session's history after the request's system
+// messages. The returned turn records the exchange once it completes; it is
+// nil for requests without a session.
+func (s *Service) loadSession(userID uint64, request map[string]interface{}) (*sessionTurn, error) {
+	value, ok := request["session_id"]
+	if !ok {
+		return nil, nil
+	}
+	delete(request, "session_id")
+	id, _ := value.(string)
+	if !validRequestID(id) {
+		return nil, ErrInvalidSessionID
+	}
+	if s.sessions == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(request["messages"])
+	if err != nil {
+		return nil, err
+	}
+	var messages []json.RawMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("invalid messages: %w", err)
+	}
+	key := usageKeyForUser(userID)
+	history, err := s.sessions.Messages(key, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var system, added []json.RawMessage
+	for _, message := range messages {
+		var m struct {
+			Role string `json:"role"`
+		}
+		json.Unmarshal(message, &m)
+		if m.Role == "system" {
+			system = append(system, message)
+		} else {
+			added = append(added, message)
+		}
+	}
+	combined := append(append(system, history...), added...)
+	request["messages"] = combined
+	return &sessionTurn{store: s.sessions, key: key, id: id, messages: added, max: s.config.SessionMaxMessages}, nil
+}
+
+// record stores the messages of the turn and the reply to them
+func (t *sessionTurn) record(reply map[string]interface{}) {
+	if t == nil {
+		return
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("Warning: failed to store session %s: %v", t.id, err)
+		return
+	}
+	if err := t.store.Append(t.key, t.id, append(t.messages, data), t.max); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// HandleSessions serves the conversation sessions of the caller's key:
+// GET /v1/sessions lists them, GET /v1/sessions/{id} returns the history of
+// one and DELETE /v1/sessions/{id} clears it.
+func (s *ServerState) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	token, err := s.validateToken(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	store := s.Service.sessions
+	if store == nil {
+		writeOpenAIError(w, http.StatusNotFound, "sessions are disabled", "invalid_request_error")
+		return
+	}
+	key := usageKeyForUser(token.UserID)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/sessions"), "/")
+
+	var out interface{}
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		sessions, err := store.List(key)
+		if err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "internal_error")
+			return
+		}
+		out = map[string]interface{}{"object": "list", "data": sessions}
+	case id != "" && r.Method == http.MethodGet:
+		messages, err := store.Messages(key, id)
+		if err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "internal_error")
+			return
+		}
+		if len(messages) == 0 {
+			writeOpenAIErrorCode(w, http.StatusNotFound, fmt.Sprintf("The session '%s' does not exist", id), "invalid_request_error", "session_not_found")
+			return
+		}
+		out = map[string]interface{}{"id": id, "object": "session", "messages": messages}
+	case id != "" && r.Method == http.MethodDelete:
+		deleted, err := store.Delete(key, id)
+		if err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "internal_error")
+			return
+		}
+		if !deleted {
+			writeOpenAIErrorCode(w, http.StatusNotFound, fmt.Sprintf("The session '%s' does not exist", id), "invalid_request_error", "session_not_found")
+			return
+		}
+		out = map[string]interface{}{"id": id, "object": "session", "deleted": true}
+	default:
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
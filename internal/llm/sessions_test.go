@@ -0,0 +1,124 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSessionStores(t *testing.T) {
+	sqliteStore, err := NewSQLiteSessionStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+
+	for name, store := range map[string]SessionStore{"memory": newMemorySessionStore(), "sqlite": sqliteStore} {
+		t.Run(name, func(t *testing.T) {
+			for _, m := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+				if err := store.Append("1", "chat", []json.RawMessage{json.RawMessage(m)}, 2); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store.Append("1", "other", []json.RawMessage{json.RawMessage(`{"n":9}`)}, 0)
+			store.Append("2", "chat", []json.RawMessage{json.RawMessage(`{"n":7}`)}, 0)
+
+			messages, err := store.Messages("1", "chat")
+			if err != nil || len(messages) != 2 || string(messages[0]) != `{"n":2}` || string(messages[1]) != `{"n":3}` {
+				t.Errorf("Messages() = %s, %v; want the two latest messages", messages, err)
+			}
+			list, err := store.List("1")
+			if err != nil || len(list) != 2 {
+				t.Fatalf("List() = %+v, %v", list, err)
+			}
+			if deleted, err := store.Delete("1", "chat"); !deleted || err != nil {
+				t.Errorf("Delete() = %v, %v", deleted, err)
+			}
+			if deleted, _ := store.Delete("1", "chat"); deleted {
+				t.Errorf("deleted a session twice")
+			}
+			if messages, _ := store.Messages("2", "chat"); len(messages) != 1 {
+				t.Errorf("deleting key 1's session changed key 2's: %s", messages)
+			}
+		})
+	}
+}
+
+func TestHandleCompletionWithSession(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	upstreamRequests := make(chan string, 2)
+	replies := []string{"first reply", "second reply"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamRequests <- string(body)
+		reply := replies[0]
+		replies = replies[1:]
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\""+reply+"\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+	state := newTestServerState(server)
+	state.Service.sessions = newMemorySessionStore()
+	mux := http.NewServeMux()
+	state.RegisterHandlers(mux)
+
+	post := func(body string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+	}
+	post(`{"model":"test-model","session_id":"cli","messages":[{"role":"user","content":"first question"}]}`)
+	<-upstreamRequests
+	post(`{"model":"test-model","session_id":"cli","stream":true,"messages":[{"role":"system","content":"be brief"},{"role":"user","content":"second question"}]}`)
+	var second struct {
+		Messages []map[string]interface{} `json:"messages"`
+	}
+	json.Unmarshal([]byte(<-upstreamRequests), &second)
+	var contents []string
+	for _, m := range second.Messages {
+		contents = append(contents, m["content"].(string))
+	}
+	if strings.Join(contents, "|") != "be brief|first question|first reply|second question" {
+		t.Errorf("upstream messages = %v, want the system prompt, the history and the new question", contents)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/v1/sessions/cli", nil))
+	var session struct {
+		Messages []map[string]interface{} `json:"messages"`
+	}
+	json.NewDecoder(w.Body).Decode(&session)
+	if len(session.Messages) != 4 || session.Messages[3]["content"] != "second reply" {
+		t.Errorf("stored session = %v, want both exchanges", session.Messages)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/v1/sessions", nil))
+	if !strings.Contains(w.Body.String(), `"id":"cli"`) {
+		t.Errorf("session list = %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/sessions/cli", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("DELETE status = %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/v1/sessions/cli", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET of a deleted session: status = %d, want 404", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","session_id":"has space","messages":[]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid session_id: status = %d, want 400", w.Code)
+	}
+}
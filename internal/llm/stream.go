@@ -0,0 +1,321 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// streamUsage holds token counts reported by the upstream stream.
+type streamUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+// ToolCallFunction is the function name and JSON arguments of a tool call
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolCall is a tool invocation requested by the model
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// streamResult is the aggregated content of an upstream SSE stream.
+type streamResult struct {
+	Content      string
+	FinishReason string
+	ToolCalls    []ToolCall
+	Usage        streamUsage
+	// Logprobs collects the per-token logprobs entries of all chunks, or nil
+	// if the upstream did not report any
+	Logprobs []interface{}
+
+	// tools numbers the tool call fragments like a streamed response
+	tools *toolCallStitcher
+}
+
+// logprobs returns the choice logprobs object of a non-streaming response
+func (r *streamResult) logprobs() interface{} {
+	if r.Logprobs == nil {
+		return nil
+	}
+	return map[string]interface{}{"content": r.Logprobs}
+}
+
+// message builds the assistant message of a non-streaming chat completion
+func (r *streamResult) message() map[string]interface{} {
+	msg := map[string]interface{}{"role": "assistant", "content": r.Content}
+	if len(r.ToolCalls) > 0 {
+		msg["tool_calls"] = r.ToolCalls
+		if r.Content == "" {
+			msg["content"] = nil
+		}
+	}
+	return msg
+}
+
+// addToolCallDelta merges a streamed tool call fragment into the result.
+// Fragments are matched to calls by the same toolCallStitcher that renumbers
+// streamed responses, so both return the same calls for an upstream stream:
+// a fragment without an index continues the last call, and the upstream
+// index never sizes the list. The id, type and name arrive once while the
+// arguments are split across many chunks.
+func (r *streamResult) addToolCallDelta(delta map[string]interface{}) {
+	if r.tools == nil {
+		r.tools = newToolCallStitcher()
+	}
+	delta = r.tools.stitch(delta)
+	index := delta["index"].(int)
+	for len(r.ToolCalls) <= index {
+		r.ToolCalls = append(r.ToolCalls, ToolCall{Type: "function"})
+	}
+	call := &r.ToolCalls[index]
+	if id, ok := delta["id"].(string); ok && id != "" {
+		call.ID = id
+	}
+	if t, ok := delta["type"].(string); ok && t != "" {
+		call.Type = t
+	}
+	if fn, ok := delta["function"].(map[string]interface{}); ok {
+		if name, ok := fn["name"].(string); ok && name != "" {
+			call.Function.Name = name
+		}
+		if args, ok := fn["arguments"].(string); ok {
+			call.Function.Arguments += args
+		}
+	}
+}
+
+// decodeSSELine decodes the JSON data chunk of an SSE line. It returns a
+// nil chunk for other lines and done for the [DONE] marker.
+func decodeSSELine(line string) (chunk map[string]interface{}, done bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "data: ") {
+		return nil, false
+	}
+	data := strings.TrimPrefix(line, "data: ")
+	if data == "[DONE]" {
+		return nil, true
+	}
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return nil, false
+	}
+	return chunk, false
+}
+
+// forEachSSEChunk reads an SSE stream and calls fn with every decoded JSON
+// data chunk until the [DONE] marker or the end of the stream.
+func forEachSSEChunk(r io.Reader, fn func(chunk map[string]interface{})) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		chunk, done := decodeSSELine(scanner.Text())
+		if done {
+			break
+		}
+		if chunk != nil {
+			fn(chunk)
+		}
+	}
+	return scanner.Err()
+}
+
+// collectStream accumulates all chunks of an upstream SSE stream into a single result.
+func collectStream(r io.Reader) (*streamResult, error) {
+	return collectStreamChunks(r, nil)
+}
+
+// collectStreamChunks is collectStream that also hands every decoded chunk
+// to fn, if not nil, as it arrives.
+func collectStreamChunks(r io.Reader, fn func(chunk map[string]interface{})) (*streamResult, error) {
+	result := &streamResult{}
+	var content strings.Builder
+	var finishReason string
+	err := forEachSSEChunk(r, func(chunk map[string]interface{}) {
+		if fn != nil {
+			fn(chunk)
+		}
+		// Try to extract usage if present
+		if u, ok := chunk["usage"].(map[string]interface{}); ok {
+			if v, ok := u["prompt_tokens"].(float64); ok {
+				result.Usage.PromptTokens = int(v)
+			}
+			if v, ok := u["completion_tokens"].(float64); ok {
+				result.Usage.CompletionTokens = int(v)
+			}
+			if v, ok := u["total_tokens"].(float64); ok {
+				result.Usage.TotalTokens = int(v)
+			}
+		}
+		choices, ok := chunk["choices"].([]interface{})
+		if !ok || len(choices) == 0 {
+			return
+		}
+		choice, _ := choices[0].(map[string]interface{})
+		delta, _ := choice["delta"].(map[string]interface{})
+		if c, ok := delta["content"].(string); ok {
+			content.WriteString(c)
+		}
+		if calls, ok := delta["tool_calls"].([]interface{}); ok {
+			for _, c := range calls {
+				if call, ok := c.(map[string]interface{}); ok {
+					result.addToolCallDelta(call)
+				}
+			}
+		}
+		// Legacy function_call deltas are folded into a single tool call
+		if fn, ok := delta["function_call"].(map[string]interface{}); ok {
+			result.addToolCallDelta(map[string]interface{}{"index": float64(0), "function": fn})
+		}
+		if lp, ok := choice["logprobs"].(map[string]interface{}); ok {
+			if entries, ok := lp["content"].([]interface{}); ok {
+				result.Logprobs = append(result.Logprobs, entries...)
+			}
+		}
+		if reason, ok := choice["finish_reason"].(string); ok && reason != "" {
+			finishReason = reason
+		}
+	})
+	result.Content = content.String()
+	result.FinishReason = normalizeFinishReason(finishReason, len(result.ToolCalls) > 0)
+	return result, err
+}
+
+// normalizeFinishReason maps the final upstream finish_reason to its OpenAI
+// value. Truncation ("length") and filtering ("content_filter") are kept as
+// they are; a stream that ends without a reason, or with "stop" after tool
+// calls, finished normally.
+func normalizeFinishReason(reason string, hasToolCalls bool) string {
+	switch reason {
+	case "function_call":
+		return "tool_calls"
+	case "", "stop":
+		if hasToolCalls {
+			return "tool_calls"
+		}
+		return "stop"
+	}
+	return reason
+}
+
+// toolCallStitcher rewrites upstream tool call fragments into OpenAI
+// delta.tool_calls chunks. Some Copilot models omit the index or repeat the
+// id on every fragment, which breaks client-side reassembly, so fragments are
+// renumbered by call id and the id, type and name are only sent once per call.
+type toolCallStitcher struct {
+	byID    map[string]int
+	byIndex map[int]int
+	started map[int]bool
+	last    int
+	next    int
+}
+
+// newToolCallStitcher creates an empty stitcher for one response stream
+func newToolCallStitcher() *toolCallStitcher {
+	return &toolCallStitcher{
+		byID:    make(map[string]int),
+		byIndex: make(map[int]int),
+		started: make(map[int]bool),
+	}
+}
+
+// stitch returns the normalized form of a single tool call fragment
+func (t *toolCallStitcher) stitch(fragment map[string]interface{}) map[string]interface{} {
+	id, _ := fragment["id"].(string)
+	upstreamIndex, hasIndex := fragment["index"].(float64)
+
+	index, known := -1, false
+	if id != "" {
+		index, known = t.byID[id]
+	}
+	if !known && hasIndex {
+		index, known = t.byIndex[int(upstreamIndex)]
+		// A new id on a known upstream index is a new call
+		if known && id != "" && t.started[index] {
+			known = false
+		}
+	}
+	if !known {
+		if id == "" && !hasIndex && t.next > 0 {
+			index = t.last
+		} else {
+			index = t.next
+			t.next++
+		}
+	}
+	if id != "" {
+		t.byID[id] = index
+	}
+	if hasIndex {
+		t.byIndex[int(upstreamIndex)] = index
+	}
+	t.last = index
+
+	out := map[string]interface{}{"index": index}
+	fn, _ := fragment["function"].(map[string]interface{})
+	outFn := map[string]interface{}{}
+	if args, ok := fn["arguments"].(string); ok {
+		outFn["arguments"] = args
+	}
+	if !t.started[index] {
+		t.started[index] = true
+		if id == "" {
+			id = fmt.Sprintf("call_%d_%d", time.Now().UnixNano(), index)
+		}
+		out["id"] = id
+		out["type"] = "function"
+		if name, ok := fn["name"].(string); ok {
+			outFn["name"] = name
+		}
+		if _, ok := outFn["arguments"]; !ok {
+			outFn["arguments"] = ""
+		}
+	}
+	if len(outFn) > 0 {
+		out["function"] = outFn
+	}
+	return out
+}
+
+// normalizeStreamLine rewrites an SSE data line carrying tool call fragments
+// into OpenAI format. Lines without tool calls are returned unchanged.
+func (t *toolCallStitcher) normalizeStreamLine(line []byte) []byte {
+	if !bytes.HasPrefix(line, []byte("data: ")) || !bytes.Contains(line, []byte(`"tool_calls"`)) {
+		return line
+	}
+	var chunk map[string]interface{}
+	if err := json.Unmarshal(bytes.TrimSpace(line[len("data: "):]), &chunk); err != nil {
+		return line
+	}
+	choices, _ := chunk["choices"].([]interface{})
+	for _, c := range choices {
+		choice, _ := c.(map[string]interface{})
+		delta, _ := choice["delta"].(map[string]interface{})
+		calls, ok := delta["tool_calls"].([]interface{})
+		if !ok {
+			continue
+		}
+		stitched := make([]interface{}, 0, len(calls))
+		for _, call := range calls {
+			if fragment, ok := call.(map[string]interface{}); ok {
+				stitched = append(stitched, t.stitch(fragment))
+			}
+		}
+		delta["tool_calls"] = stitched
+	}
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return line
+	}
+	return append(append([]byte("data: "), data...), '\n')
+}
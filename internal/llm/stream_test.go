@@ -0,0 +1,253 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSSEUpstream returns a test server that answers every request with the given SSE data chunks
+func newSSEUpstream(t *testing.T, chunks ...string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, c := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", c)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+}
+
+// newTestServerState returns a ServerState whose service talks to the given upstream
+// with a pre-populated model cache
+func newTestServerState(upstream *httptest.Server) *ServerState {
+	return &ServerState{
+		Service: &Service{
+			config:     &Config{CopilotAPIKey: "test-key;proxy-ep=" + upstream.URL},
+			httpClient: upstream.Client(),
+			usage:      newUsageLedger(),
+			modelsCache: []models.LanguageModel{
+				{ID: "test-model", Name: "test-model", Provider: models.ProviderCopilot, Enabled: true},
+			},
+			lastAuthTime: time.Now(),
+		},
+		Secret: "test-secret",
+	}
+}
+
+func TestCollectStream(t *testing.T) {
+	stream := strings.Join([]string{
+		`data: {"choices":[{"delta":{"content":"Hel"}}]}`,
+		``,
+		`data: {"choices":[{"delta":{"content":"lo"}}]}`,
+		`data: not-json`,
+		`data: {"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		`data: [DONE]`,
+		`data: {"choices":[{"delta":{"content":"ignored"}}]}`,
+	}, "\n")
+
+	result, err := collectStream(strings.NewReader(stream))
+	if err != nil {
+		t.Fatalf("collectStream() error = %v", err)
+	}
+	if result.Content != "Hello" {
+		t.Errorf("collectStream() content = %q, want %q", result.Content, "Hello")
+	}
+	if result.FinishReason != "stop" {
+		t.Errorf("collectStream() finish reason = %q, want stop", result.FinishReason)
+	}
+	if result.Usage.TotalTokens != 5 || result.Usage.PromptTokens != 3 || result.Usage.CompletionTokens != 2 {
+		t.Errorf("collectStream() usage = %+v", result.Usage)
+	}
+}
+
+func TestCollectStreamToolCalls(t *testing.T) {
+	stream := strings.Join([]string{
+		`data: {"choices":[{"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_2","function":{"name":"get_time","arguments":"{}"}}]}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}}]}`,
+		`data: {"choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+		`data: [DONE]`,
+	}, "\n")
+
+	result, err := collectStream(strings.NewReader(stream))
+	if err != nil {
+		t.Fatalf("collectStream() error = %v", err)
+	}
+	if result.FinishReason != "tool_calls" {
+		t.Errorf("finish reason = %q, want tool_calls", result.FinishReason)
+	}
+	if len(result.ToolCalls) != 2 {
+		t.Fatalf("got %d tool calls, want 2", len(result.ToolCalls))
+	}
+	first := result.ToolCalls[0]
+	if first.ID != "call_1" || first.Function.Name != "get_weather" || first.Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("unexpected first tool call: %+v", first)
+	}
+	if result.ToolCalls[1].Type != "function" || result.ToolCalls[1].ID != "call_2" {
+		t.Errorf("unexpected second tool call: %+v", result.ToolCalls[1])
+	}
+	msg := result.message()
+	if msg["content"] != nil {
+		t.Errorf("expected null content alongside tool calls, got %v", msg["content"])
+	}
+}
+
+func TestCollectStreamToolCallsWithoutIndex(t *testing.T) {
+	stream := strings.Join([]string{
+		`data: {"choices":[{"delta":{"tool_calls":[{"id":"call_1","function":{"name":"get_weather","arguments":"{\"city\":"}}]}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"function":{"arguments":"\"Paris\"}"}}]}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":1e9,"id":"call_2","function":{"name":"get_time","arguments":"{}"}}]}}]}`,
+		`data: [DONE]`,
+	}, "\n")
+
+	result, err := collectStream(strings.NewReader(stream))
+	if err != nil {
+		t.Fatalf("collectStream() error = %v", err)
+	}
+	// Fragments without an index continue the last call, as when streaming,
+	// and a huge upstream index does not size the list
+	if len(result.ToolCalls) != 2 || cap(result.ToolCalls) > 4 {
+		t.Fatalf("got %d tool calls (capacity %d), want 2", len(result.ToolCalls), cap(result.ToolCalls))
+	}
+	if first := result.ToolCalls[0]; first.ID != "call_1" || first.Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("unexpected first tool call: %+v", first)
+	}
+	if second := result.ToolCalls[1]; second.ID != "call_2" || second.Function.Name != "get_time" {
+		t.Errorf("unexpected second tool call: %+v", second)
+	}
+}
+func TestCollectStreamFinishReason(t *testing.T) {
+	toolCall := `data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"f","arguments":"{}"}}]}}]}`
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"no reason", []string{`data: {"choices":[{"delta":{"content":"hi"}}]}`}, "stop"},
+		{"length", []string{`data: {"choices":[{"delta":{"content":"hi"}}]}`, `data: {"choices":[{"delta":{},"finish_reason":"length"}]}`}, "length"},
+		{"content filter", []string{`data: {"choices":[{"delta":{"content":"hi"},"finish_reason":"content_filter"}]}`}, "content_filter"},
+		{"reason before usage chunk", []string{`data: {"choices":[{"delta":{},"finish_reason":"length"}]}`, `data: {"choices":[{"delta":{},"finish_reason":null}],"usage":{"total_tokens":3}}`}, "length"},
+		{"stop after tool calls", []string{toolCall, `data: {"choices":[{"delta":{},"finish_reason":"stop"}]}`}, "tool_calls"},
+		{"truncated tool calls", []string{toolCall, `data: {"choices":[{"delta":{},"finish_reason":"length"}]}`}, "length"},
+		{"legacy function call", []string{`data: {"choices":[{"delta":{"function_call":{"name":"f","arguments":"{}"}},"finish_reason":"function_call"}]}`}, "tool_calls"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := collectStream(strings.NewReader(strings.Join(append(tt.lines, "data: [DONE]"), "\n")))
+			if err != nil {
+				t.Fatalf("collectStream() error = %v", err)
+			}
+			if result.FinishReason != tt.want {
+				t.Errorf("finish reason = %q, want %q", result.FinishReason, tt.want)
+			}
+		})
+	}
+}
+
+func TestToolCallStitcher(t *testing.T) {
+	// Upstream repeats index 0 for two distinct calls and resends the id on every fragment
+	lines := []string{
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"a","function":{"name":"one","arguments":"{\"x\""}}]}}]}` + "\n",
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"a","function":{"arguments":":1}"}}]}}]}` + "\n",
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"b","function":{"name":"two","arguments":"{}"}}]}}]}` + "\n",
+		`data: {"choices":[{"delta":{"tool_calls":[{"function":{"arguments":""}}]}}]}` + "\n",
+	}
+
+	stitcher := newToolCallStitcher()
+	var stream strings.Builder
+	for _, l := range lines {
+		stream.Write(stitcher.normalizeStreamLine([]byte(l)))
+	}
+	result, _ := collectStream(strings.NewReader(stream.String()))
+
+	if len(result.ToolCalls) != 2 {
+		t.Fatalf("got %d tool calls, want 2: %s", len(result.ToolCalls), stream.String())
+	}
+	if result.ToolCalls[0].ID != "a" || result.ToolCalls[0].Function.Arguments != `{"x":1}` {
+		t.Errorf("unexpected first call: %+v", result.ToolCalls[0])
+	}
+	if result.ToolCalls[1].ID != "b" || result.ToolCalls[1].Function.Name != "two" {
+		t.Errorf("unexpected second call: %+v", result.ToolCalls[1])
+	}
+	if strings.Count(stream.String(), `"id":"a"`) != 1 {
+		t.Errorf("expected call id to be sent only once: %s", stream.String())
+	}
+}
+
+func TestNormalizeStreamLinePassthrough(t *testing.T) {
+	line := []byte(`data: {"choices":[{"delta":{"content":"hi"}}]}` + "\n")
+	if got := newToolCallStitcher().normalizeStreamLine(line); string(got) != string(line) {
+		t.Errorf("normalizeStreamLine() modified a line without tool calls: %s", got)
+	}
+}
+
+func TestCollectStreamLogprobs(t *testing.T) {
+	stream := strings.Join([]string{
+		`data: {"choices":[{"delta":{"content":"Hi"},"logprobs":{"content":[{"token":"Hi","logprob":-0.1,"top_logprobs":[]}]}}]}`,
+		`data: {"choices":[{"delta":{"content":"!"},"logprobs":{"content":[{"token":"!","logprob":-0.5,"top_logprobs":[]}]}}]}`,
+		`data: [DONE]`,
+	}, "\n")
+
+	result, _ := collectStream(strings.NewReader(stream))
+	if len(result.Logprobs) != 2 {
+		t.Fatalf("expected 2 logprob entries, got %d", len(result.Logprobs))
+	}
+	lp, ok := result.logprobs().(map[string]interface{})
+	if !ok || lp["content"] == nil {
+		t.Errorf("expected logprobs object with content, got %v", result.logprobs())
+	}
+
+	plain, _ := collectStream(strings.NewReader(`data: {"choices":[{"delta":{"content":"x"}}]}`))
+	if plain.logprobs() != nil {
+		t.Errorf("expected nil logprobs when upstream reports none")
+	}
+}
+
+func TestClientDisconnectCancelsUpstream(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	canceled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`)).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		state.HandleCompletion(httptest.NewRecorder(), req)
+	}()
+	for state.ActiveStreams() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request was not canceled after the client disconnected")
+	}
+	<-done
+	if usage := state.Service.GetModelUsage(1, "test-model"); usage.RequestsThisMinute != 1 {
+		t.Errorf("usage of the canceled stream = %+v, want one recorded request", usage)
+	}
+}
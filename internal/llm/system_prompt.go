@@ -0,0 +1,82 @@
+package llm
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+)
+
+// System prompt modes of SYSTEM_PROMPT_MODE
+const (
+	// SystemPromptPrepend adds the system prompt before the request's messages
+	SystemPromptPrepend = "prepend"
+	// SystemPromptReplace drops the request's system messages and uses the
+	// system prompt instead
+	SystemPromptReplace = "replace"
+)
+
+// loadSystemPrompt reads the system prompt injected into every chat
+// completion from the file named by SYSTEM_PROMPT_FILE or, without one,
+// SYSTEM_PROMPT, and its mode from SYSTEM_PROMPT_MODE
+func loadSystemPrompt() (prompt, mode string) {
+	prompt = os.Getenv("SYSTEM_PROMPT")
+	if path := os.Getenv("SYSTEM_PROMPT_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Warning: failed to read system prompt file: %v", err)
+		} else {
+			prompt = string(data)
+		}
+	}
+	mode = os.Getenv("SYSTEM_PROMPT_MODE")
+	if mode != SystemPromptReplace {
+		mode = SystemPromptPrepend
+	}
+	return strings.TrimSpace(prompt), mode
+}
+
+// SetSystemPrompt atomically replaces the injected system prompt and its mode
+func (c *Config) SetSystemPrompt(prompt, mode string) {
+	c.promptMu.Lock()
+	defer c.promptMu.Unlock()
+	c.SystemPrompt = prompt
+	c.SystemPromptMode = mode
+}
+
+// applySystemPrompt injects the configured system prompt into an OpenAI chat
+// completion request. Requests without a messages array are left as they
+// are.
+func (c *Config) applySystemPrompt(providerRequest string) string {
+	c.promptMu.RLock()
+	prompt, mode := c.SystemPrompt, c.SystemPromptMode
+	c.promptMu.RUnlock()
+	if prompt == "" {
+		return providerRequest
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(providerRequest), &payload); err != nil {
+		return providerRequest
+	}
+	messages, ok := payload["messages"].([]interface{})
+	if !ok {
+		return providerRequest
+	}
+	injected := make([]interface{}, 0, len(messages)+1)
+	injected = append(injected, map[string]interface{}{"role": "system", "content": prompt})
+	for _, m := range messages {
+		if msg, ok := m.(map[string]interface{}); ok && mode == SystemPromptReplace {
+			if role := msg["role"]; role == "system" || role == "developer" {
+				continue
+			}
+		}
+		injected = append(injected, m)
+	}
+	payload["messages"] = injected
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return providerRequest
+	}
+	return string(body)
+}
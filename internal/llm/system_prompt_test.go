@@ -0,0 +1,64 @@
+package llm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplySystemPrompt(t *testing.T) {
+	request := `{"model":"gpt-4o","messages":[{"role":"system","content":"You are an IDE assistant"},{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name    string
+		prompt  string
+		mode    string
+		request string
+		want    []string
+	}{
+		{"disabled", "", SystemPromptPrepend, request, []string{"system:You are an IDE assistant", "user:hi"}},
+		{"prepend", "Answer in German", SystemPromptPrepend, request, []string{"system:Answer in German", "system:You are an IDE assistant", "user:hi"}},
+		{"replace", "Answer in German", SystemPromptReplace, request, []string{"system:Answer in German", "user:hi"}},
+		{"replace developer", "Be terse", SystemPromptReplace, `{"messages":[{"role":"developer","content":"x"},{"role":"user","content":"hi"}]}`, []string{"system:Be terse", "user:hi"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{}
+			c.SetSystemPrompt(tt.prompt, tt.mode)
+			var payload struct {
+				Messages []struct {
+					Role    string `json:"role"`
+					Content string `json:"content"`
+				} `json:"messages"`
+			}
+			if err := json.Unmarshal([]byte(c.applySystemPrompt(tt.request)), &payload); err != nil {
+				t.Fatalf("invalid request: %v", err)
+			}
+			var got []string
+			for _, m := range payload.Messages {
+				got = append(got, m.Role+":"+m.Content)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	c := &Config{}
+	c.SetSystemPrompt("x", SystemPromptPrepend)
+	if got := c.applySystemPrompt(`{"prompt":"hi"}`); got != `{"prompt":"hi"}` {
+		t.Errorf("request without messages = %s, want it unchanged", got)
+	}
+}
+
+func TestLoadSystemPrompt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompt.txt")
+	os.WriteFile(path, []byte("From the file\n"), 0o600)
+	t.Setenv("SYSTEM_PROMPT", "From the environment")
+	t.Setenv("SYSTEM_PROMPT_FILE", path)
+	t.Setenv("SYSTEM_PROMPT_MODE", "bogus")
+	if prompt, mode := loadSystemPrompt(); prompt != "From the file" || mode != SystemPromptPrepend {
+		t.Errorf("loadSystemPrompt() = %q, %q", prompt, mode)
+	}
+}
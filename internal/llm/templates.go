@@ -0,0 +1,136 @@
+package llm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// promptTemplateExt is the file extension of prompt templates
+const promptTemplateExt = ".tmpl"
+
+// promptTemplateRoles are the message roles a template may define, in the
+// order the messages are added
+var promptTemplateRoles = []string{"system", "user", "assistant"}
+
+// promptTemplates are the named prompt templates of PROMPT_TEMPLATES_DIR.
+// A template file defines its messages as {{define "system"}} and
+// {{define "user"}} blocks; a file without such blocks is a single user
+// message. Requests invoke a template with "template" and "variables".
+type promptTemplates struct {
+	mu        sync.RWMutex
+	dir       string
+	templates map[string]*template.Template
+}
+
+// loadPromptTemplates parses the *.tmpl files of dir. An empty dir disables
+// templates.
+func loadPromptTemplates(dir string) (*promptTemplates, error) {
+	t := &promptTemplates{dir: dir}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// reload re-parses the templates. On error the previous templates are kept.
+func (t *promptTemplates) reload() error {
+	templates := make(map[string]*template.Template)
+	if t.dir != "" {
+		paths, err := filepath.Glob(filepath.Join(t.dir, "*"+promptTemplateExt))
+		if err != nil {
+			return fmt.Errorf("failed to list prompt templates: %w", err)
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read prompt template: %w", err)
+			}
+			name := strings.TrimSuffix(filepath.Base(path), promptTemplateExt)
+			tmpl, err := template.New(name).Option("missingkey=error").Parse(string(data))
+			if err != nil {
+				return fmt.Errorf("failed to parse prompt template %s: %w", name, err)
+			}
+			templates[name] = tmpl
+		}
+	}
+	t.mu.Lock()
+	t.templates = templates
+	t.mu.Unlock()
+	return nil
+}
+
+// expand renders a template into messages
+func (t *promptTemplates) expand(name string, variables map[string]interface{}) ([]interface{}, error) {
+	t.mu.RLock()
+	tmpl, ok := t.templates[name]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown prompt template %q", name)
+	}
+
+	var messages []interface{}
+	render := func(tmpl *template.Template, role string) error {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, variables); err != nil {
+			return fmt.Errorf("prompt template %s: %w", name, err)
+		}
+		if content := strings.TrimSpace(buf.String()); content != "" {
+			messages = append(messages, map[string]interface{}{"role": role, "content": content})
+		}
+		return nil
+	}
+	defined := false
+	for _, role := range promptTemplateRoles {
+		if block := tmpl.Lookup(role); block != nil {
+			defined = true
+			if err := render(block, role); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !defined {
+		if err := render(tmpl, "user"); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// expandPromptTemplate replaces the "template" and "variables" fields of a
+// chat completion request with the template's messages, followed by any
+// messages of the request
+func (s *Service) expandPromptTemplate(request map[string]interface{}) error {
+	name, ok := request["template"]
+	if !ok {
+		return nil
+	}
+	templateName, _ := name.(string)
+	if templateName == "" {
+		return fmt.Errorf("template must be a template name")
+	}
+	variables := map[string]interface{}{}
+	if v, ok := request["variables"]; ok && v != nil {
+		if variables, ok = v.(map[string]interface{}); !ok {
+			return fmt.Errorf("variables must be an object")
+		}
+	}
+	if s.templates == nil {
+		return fmt.Errorf("unknown prompt template %q", templateName)
+	}
+	messages, err := s.templates.expand(templateName, variables)
+	if err != nil {
+		return err
+	}
+	if existing, ok := request["messages"].([]interface{}); ok {
+		messages = append(messages, existing...)
+	}
+	request["messages"] = messages
+	delete(request, "template")
+	delete(request, "variables")
+	return nil
+}
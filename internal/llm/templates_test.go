@@ -0,0 +1,69 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPromptTemplates(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "summarize.tmpl"), []byte(`{{define "system"}}You summarize text in {{.language}}.{{end}}
+{{define "user"}}Summarize: {{.text}}{{end}}`), 0o600)
+	os.WriteFile(filepath.Join(dir, "greet.tmpl"), []byte("Say hello to {{.name}}"), 0o600)
+	templates, err := loadPromptTemplates(dir)
+	if err != nil {
+		t.Fatalf("loadPromptTemplates() error = %v", err)
+	}
+
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+	upstream := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		upstream <- body
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+	state := newTestServerState(server)
+	state.Service.templates = templates
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`{"model":"test-model","template":"summarize","variables":{"language":"German","text":"a long text"},"messages":[{"role":"user","content":"Keep it short"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	got, _ := json.Marshal((<-upstream)["messages"])
+	want := `[{"content":"You summarize text in German.","role":"system"},{"content":"Summarize: a long text","role":"user"},{"content":"Keep it short","role":"user"}]`
+	if string(got) != want {
+		t.Errorf("upstream messages = %s, want %s", got, want)
+	}
+
+	if w := post(`{"model":"test-model","template":"greet","variables":{"name":"Ada"}}`); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got, _ := json.Marshal((<-upstream)["messages"]); string(got) != `[{"content":"Say hello to Ada","role":"user"}]` {
+		t.Errorf("upstream messages = %s", got)
+	}
+
+	for _, body := range []string{
+		`{"model":"test-model","template":"unknown"}`,
+		`{"model":"test-model","template":"greet"}`,
+		`{"model":"test-model","template":"greet","variables":["Ada"]}`,
+	} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+}
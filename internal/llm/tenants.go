@@ -0,0 +1,283 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"copilot-proxy/pkg/utils"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// tenantUsagePrefix prefixes tenant names in the keys of the rate limiter
+// and concurrency limiter, so they do not collide with API key IDs
+const tenantUsagePrefix = "tenant:"
+
+// Tenant is a user or team sharing one proxy: the stored API keys issued to
+// it share its Copilot credentials, model allowlist, rate limit and budget,
+// isolated from the other tenants
+type Tenant struct {
+	// Keys are the IDs of the stored API keys that belong to the tenant
+	Keys []uint64 `json:"keys"`
+	// CopilotOAuthToken is exchanged for the Copilot API keys the tenant's
+	// requests are sent with; CopilotAPIKey is used as is. Without either the
+	// tenant uses the proxy's Copilot credentials.
+	CopilotOAuthToken string `json:"copilot_oauth_token,omitempty"`
+	CopilotAPIKey     string `json:"copilot_api_key,omitempty"`
+	// Models restricts the models the tenant's keys may use; a trailing *
+	// matches a prefix
+	Models []string `json:"models,omitempty"`
+	// RateLimit and Budget apply to all of the tenant's keys together, in
+	// addition to the limits and budgets of each key
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+	Budget    *Budget    `json:"budget,omitempty"`
+}
+
+// loadTenants reads the tenants from a JSON file mapping tenant names to
+// tenants, such as {"acme": {"keys": [3, 4], "models": ["gpt-4o"]}}
+func loadTenants(path string) (*keyedSettings[Tenant], error) {
+	return loadKeyedSettings[Tenant](path, "tenants")
+}
+
+// tenantKey is the context key of the tenant a request is made for
+type tenantKey struct{}
+
+// withTenant returns a context carrying the name of the tenant a request is
+// made for, whose Copilot credentials upstream calls made with the context use
+func withTenant(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantKey{}, name)
+}
+
+// tenantFromContext returns the tenant of a context, or "" if it has none
+func tenantFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(tenantKey{}).(string)
+	return name
+}
+
+// tenantOf returns the tenant a user's key belongs to. A key listed by
+// several tenants belongs to the first of them by name.
+func (s *Service) tenantOf(userID uint64) (string, Tenant, bool) {
+	if s.tenants == nil {
+		return "", Tenant{}, false
+	}
+	tenants := s.tenants.snapshot()
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		if name != defaultSettingsKey {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, id := range tenants[name].Keys {
+			if id == userID {
+				return name, tenants[name], true
+			}
+		}
+	}
+	return "", Tenant{}, false
+}
+
+// applyTenant assigns the token of a stored API key to the key's tenant and
+// restricts it to the tenant's models
+func (s *Service) applyTenant(token *models.LLMToken) {
+	if name, tenant, ok := s.tenantOf(token.UserID); ok {
+		token.Tenant = name
+		token.TenantModels = tenant.Models
+	}
+}
+
+// tenantUsage sums the usage of a tenant's keys since a time
+func (s *Service) tenantUsage(tenant Tenant, since time.Time) (tokens int, costUSD float64, err error) {
+	for _, id := range tenant.Keys {
+		aggregates, err := s.UsageStats(since, usageKeyForUser(id))
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, agg := range aggregates {
+			tokens += agg.TotalTokens
+			costUSD += agg.EstimatedCostUSD
+		}
+	}
+	return tokens, costUSD, nil
+}
+
+// checkTenantBudget enforces the monthly budget of the tenant of a user's key
+func (s *Service) checkTenantBudget(userID uint64) error {
+	name, tenant, ok := s.tenantOf(userID)
+	if !ok || tenant.Budget == nil {
+		return nil
+	}
+	tokens, cost, err := s.tenantUsage(tenant, s.config.startOfMonth(time.Now()))
+	if err != nil {
+		return err
+	}
+	if err := CheckBudget(*tenant.Budget, tokens, cost); err != nil {
+		return fmt.Errorf("tenant %s: %w", name, err)
+	}
+	return nil
+}
+
+// checkTenantRateLimit enforces the rate limit of the tenant of a user's key
+func (s *Service) checkTenantRateLimit(userID uint64) error {
+	name, tenant, ok := s.tenantOf(userID)
+	if !ok || tenant.RateLimit == nil {
+		return nil
+	}
+	if err := s.limiter.check(tenantUsagePrefix+name, *tenant.RateLimit, time.Now()); err != nil {
+		return err
+	}
+	if tenant.RateLimit.TokensPerDay <= 0 {
+		return nil
+	}
+	tokens, _, err := s.tenantUsage(tenant, s.config.startOfDay(time.Now()))
+	if err != nil {
+		return err
+	}
+	if tokens >= tenant.RateLimit.TokensPerDay {
+		return &retryAfterError{
+			err:        fmt.Errorf("%w: tenant %s reached its maximum tokens_per_day", ErrRateLimitExceeded, name),
+			retryAfter: time.Until(s.config.startOfDay(time.Now()).AddDate(0, 0, 1)),
+		}
+	}
+	return nil
+}
+
+// recordTenantRateLimit takes a completed request and its tokens from the
+// buckets of the tenant of a user's key
+func (s *Service) recordTenantRateLimit(userID uint64, usage models.TokenUsage) {
+	if name, tenant, ok := s.tenantOf(userID); ok && tenant.RateLimit != nil {
+		s.limiter.record(tenantUsagePrefix+name, *tenant.RateLimit, usage, time.Now())
+	}
+}
+
+// acquireTenantSlot reserves an in-flight request slot within the
+// max_concurrent_requests of the tenant of a user's key
+func (s *Service) acquireTenantSlot(userID uint64) (func(), error) {
+	name, tenant, ok := s.tenantOf(userID)
+	if !ok || tenant.RateLimit == nil || tenant.RateLimit.MaxConcurrentRequests <= 0 {
+		return func() {}, nil
+	}
+	return s.tenantConcurrency.acquire(tenantUsagePrefix+name, 0, tenant.RateLimit.MaxConcurrentRequests)
+}
+
+// tenantAccount is the Copilot account of a tenant with its own
+// credentials, together with the credential it was created from
+type tenantAccount struct {
+	credential string
+	account    *copilotAccount
+}
+
+// SetTokenExchanger registers the function that trades the GitHub OAuth
+// tokens of tenants for Copilot API keys
+func (s *Service) SetTokenExchanger(exchange func(oauthToken string) (string, error)) {
+	s.tenantAccountsMu.Lock()
+	defer s.tenantAccountsMu.Unlock()
+	s.exchangeToken = exchange
+}
+
+// tenantAccount returns the Copilot account of a tenant, or nil if the
+// tenant uses the proxy's Copilot credentials. The account is replaced when
+// the tenant's credentials change.
+func (s *Service) tenantAccount(name string) (*copilotAccount, error) {
+	if name == "" || s.tenants == nil {
+		return nil, nil
+	}
+	tenant, ok := s.tenants.snapshot()[name]
+	if !ok || (tenant.CopilotOAuthToken == "" && tenant.CopilotAPIKey == "") {
+		return nil, nil
+	}
+
+	s.tenantAccountsMu.Lock()
+	defer s.tenantAccountsMu.Unlock()
+	credential := tenant.CopilotOAuthToken
+	if credential == "" {
+		credential = tenant.CopilotAPIKey
+	}
+	if current, ok := s.tenantAccounts[name]; ok && current.credential == credential {
+		return current.account, nil
+	}
+
+	account := &copilotAccount{name: "tenant " + name}
+	if tenant.CopilotOAuthToken != "" {
+		if s.exchangeToken == nil {
+			return nil, fmt.Errorf("tenant %s: no OAuth token exchange configured", name)
+		}
+		exchange, oauthToken := s.exchangeToken, tenant.CopilotOAuthToken
+		account.exchange = func() (string, error) { return exchange(oauthToken) }
+	} else {
+		account.apiKey = tenant.CopilotAPIKey
+		account.exchange = func() (string, error) {
+			return "", errors.New("the Copilot API key was rejected or has expired; configure copilot_oauth_token to refresh it")
+		}
+	}
+	if s.tenantAccounts == nil {
+		s.tenantAccounts = make(map[string]*tenantAccount)
+	}
+	s.tenantAccounts[name] = &tenantAccount{credential: credential, account: account}
+	return account, nil
+}
+
+// tenantStatus is a tenant together with its current usage, as returned by
+// the admin tenants API. Copilot credentials are masked.
+type tenantStatus struct {
+	Name string `json:"name"`
+	Tenant
+	Usage tenantUsageStatus `json:"usage"`
+}
+
+// tenantUsageStatus is the usage of all of a tenant's keys
+type tenantUsageStatus struct {
+	TokensThisDay    int     `json:"tokens_this_day"`
+	TokensThisMonth  int     `json:"tokens_this_month"`
+	CostThisMonthUSD float64 `json:"cost_this_month_usd"`
+	InFlightRequests int     `json:"in_flight_requests"`
+}
+
+// tenantStatus combines a tenant with its usage
+func (s *Service) tenantStatus(name string, tenant Tenant) (interface{}, error) {
+	if tenant.CopilotOAuthToken != "" {
+		tenant.CopilotOAuthToken = utils.MaskToken(tenant.CopilotOAuthToken)
+	}
+	if tenant.CopilotAPIKey != "" {
+		tenant.CopilotAPIKey = utils.MaskToken(tenant.CopilotAPIKey)
+	}
+	status := tenantStatus{Name: name, Tenant: tenant}
+	status.Usage.InFlightRequests = s.tenantConcurrency.inFlight(tenantUsagePrefix + name)
+	var err error
+	if status.Usage.TokensThisMonth, status.Usage.CostThisMonthUSD, err = s.tenantUsage(tenant, s.config.startOfMonth(time.Now())); err != nil {
+		return status, err
+	}
+	status.Usage.TokensThisDay, _, err = s.tenantUsage(tenant, s.config.startOfDay(time.Now()))
+	return status, err
+}
+
+// HandleTenants serves the admin tenants API under /admin/tenants: GET lists
+// tenants with their usage and GET, PUT and DELETE on /admin/tenants/{name}
+// read, set and remove one tenant. Changes apply to the next request.
+// Callers must protect the handler with the admin token.
+func (s *ServerState) HandleTenants(w http.ResponseWriter, r *http.Request) {
+	if s.Service.tenants == nil {
+		writeOpenAIError(w, http.StatusNotFound, "tenants are disabled", "invalid_request_error")
+		return
+	}
+	serveKeyedSettings(w, r, "/admin/tenants", s.Service.tenants, func(tenant Tenant) error {
+		if tenant.CopilotOAuthToken != "" && tenant.CopilotAPIKey != "" {
+			return errors.New("set copilot_oauth_token or copilot_api_key, not both")
+		}
+		if tenant.RateLimit != nil {
+			if err := validateRateLimit(*tenant.RateLimit); err != nil {
+				return err
+			}
+		}
+		if tenant.Budget != nil {
+			return validateBudget(*tenant.Budget)
+		}
+		return nil
+	}, s.Service.tenantStatus)
+}
@@ -0,0 +1,188 @@
+package llm
+
+import (
+	"context"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTenants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	os.WriteFile(path, []byte(`{"acme": {"keys": [3, 4], "models": ["gpt-4o"]}, "beta": {"keys": [5]}}`), 0o600)
+
+	s := &Service{}
+	var err error
+	if s.tenants, err = loadTenants(path); err != nil {
+		t.Fatalf("loadTenants() error = %v", err)
+	}
+	if name, tenant, ok := s.tenantOf(4); !ok || name != "acme" || len(tenant.Models) != 1 {
+		t.Errorf("tenantOf(4) = %q, %+v, %v", name, tenant, ok)
+	}
+	if name, _, ok := s.tenantOf(5); !ok || name != "beta" {
+		t.Errorf("tenantOf(5) = %q, %v", name, ok)
+	}
+	if _, _, ok := s.tenantOf(6); ok {
+		t.Error("tenantOf(6) found a tenant for a key no tenant lists")
+	}
+}
+
+func TestTenantModels(t *testing.T) {
+	s := &Service{}
+	s.tenants, _ = loadTenants("")
+	s.tenants.set("acme", &Tenant{Keys: []uint64{3}, Models: []string{"gpt-4*"}})
+
+	token := &models.LLMToken{UserID: 3}
+	s.applyTenant(token)
+	if token.Tenant != "acme" {
+		t.Fatalf("Tenant = %q, want acme", token.Tenant)
+	}
+	if err := AuthorizeAccessToModel(token, "copilot", "gpt-4o"); err != nil {
+		t.Errorf("AuthorizeAccessToModel(gpt-4o) error = %v", err)
+	}
+	if err := AuthorizeAccessToModel(token, "copilot", "claude-3.5-sonnet"); err == nil {
+		t.Error("AuthorizeAccessToModel(claude-3.5-sonnet) should fail outside the tenant's models")
+	}
+
+	// Keys of no tenant are not restricted
+	other := &models.LLMToken{UserID: 4}
+	s.applyTenant(other)
+	if other.Tenant != "" || AuthorizeAccessToModel(other, "copilot", "claude-3.5-sonnet") != nil {
+		t.Errorf("key without tenant = %+v", other)
+	}
+}
+
+func TestTenantLimitsAreShared(t *testing.T) {
+	s := &Service{config: &Config{}, usage: newUsageLedger()}
+	s.tenants, _ = loadTenants("")
+	s.tenants.set("acme", &Tenant{
+		Keys:      []uint64{1, 2},
+		RateLimit: &RateLimit{TokensPerDay: 300, MaxConcurrentRequests: 1},
+		Budget:    &Budget{MonthlyTokens: 500},
+	})
+	s.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 100, Output: 100})
+
+	if err := s.checkKeyRateLimit(2); err != nil {
+		t.Errorf("checkKeyRateLimit(2) error = %v", err)
+	}
+	s.RecordUsage(2, "gpt-4o", models.TokenUsage{Input: 100, Output: 100})
+	// Both keys together used 400 tokens today
+	if err := s.checkKeyRateLimit(1); !errors.Is(err, ErrRateLimitExceeded) {
+		t.Errorf("checkKeyRateLimit(1) error = %v, want tenant limit", err)
+	}
+	if err := s.checkBudget(2); err != nil {
+		t.Errorf("checkBudget(2) error = %v", err)
+	}
+	s.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 100})
+	if err := s.checkBudget(2); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("checkBudget(2) error = %v, want tenant budget", err)
+	}
+	// Keys of other tenants are not affected
+	if err := s.checkBudget(3); err != nil {
+		t.Errorf("checkBudget(3) error = %v", err)
+	}
+
+	release, err := s.acquireRequestSlot(1)
+	if err != nil {
+		t.Fatalf("acquireRequestSlot(1) error = %v", err)
+	}
+	if _, err := s.acquireRequestSlot(2); !errors.Is(err, ErrConcurrencyLimitExceeded) {
+		t.Errorf("acquireRequestSlot(2) error = %v, want tenant concurrency limit", err)
+	}
+	release()
+	if release, err := s.acquireRequestSlot(2); err != nil {
+		t.Errorf("acquireRequestSlot(2) after release error = %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestTenantCopilotCredentials(t *testing.T) {
+	var gotAuth []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = append(gotAuth, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer upstream.Close()
+
+	s := newTestServerState(upstream).Service
+	s.tenants, _ = loadTenants("")
+	s.tenants.set("acme", &Tenant{Keys: []uint64{1}, CopilotAPIKey: "acme-key;proxy-ep=" + upstream.URL})
+	s.tenants.set("beta", &Tenant{Keys: []uint64{2}, CopilotOAuthToken: "gho_beta"})
+
+	request := `{"messages":[{"role":"user","content":"hi"}]}`
+	for _, tenant := range []string{"acme", ""} {
+		resp, err := s.callCopilotAPI(withTenant(context.Background(), tenant), request, "test-model")
+		if err != nil {
+			t.Fatalf("callCopilotAPI(%q) error = %v", tenant, err)
+		}
+		resp.Body.Close()
+	}
+	if len(gotAuth) != 2 || !strings.Contains(gotAuth[0], "acme-key") || !strings.Contains(gotAuth[1], "test-key") {
+		t.Errorf("Authorization headers = %q, want the tenant's key then the proxy's", gotAuth)
+	}
+
+	// OAuth tokens need an exchange
+	if _, err := s.tenantAccount("beta"); err == nil {
+		t.Error("tenantAccount(beta) without a token exchanger should fail")
+	}
+	s.SetTokenExchanger(func(oauthToken string) (string, error) { return "beta-key;exchanged-from=" + oauthToken, nil })
+	account, err := s.tenantAccount("beta")
+	if err != nil || account == nil {
+		t.Fatalf("tenantAccount(beta) = %v, %v", account, err)
+	}
+	if key, err := account.exchange(); err != nil || key != "beta-key;exchanged-from=gho_beta" {
+		t.Errorf("exchange() = %q, %v", key, err)
+	}
+}
+
+func TestHandleTenants(t *testing.T) {
+	state := &ServerState{Service: &Service{config: &Config{}, usage: newUsageLedger()}}
+	state.Service.tenants, _ = loadTenants("")
+	state.Service.RecordUsage(3, "gpt-4o", models.TokenUsage{Input: 300, Output: 200})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		state.HandleTenants(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do("PUT", "/admin/tenants/acme", `{"keys": [3], "copilot_oauth_token": "gho_0123456789abcdef"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/admin/tenants/beta", `{"copilot_oauth_token": "gho_a", "copilot_api_key": "tid=b"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with both credentials status = %d, want 400", w.Code)
+	}
+	if w := do("PUT", "/admin/tenants/beta", `{"budget": {"monthly_tokens": -1}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT negative budget status = %d, want 400", w.Code)
+	}
+
+	w := do("GET", "/admin/tenants", "")
+	var list struct {
+		Data []tenantStatus `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 1 {
+		t.Fatalf("GET list = %s, %v", w.Body.String(), err)
+	}
+	got := list.Data[0]
+	if got.Name != "acme" || got.Usage.TokensThisMonth != 500 || got.Usage.TokensThisDay != 500 {
+		t.Errorf("tenant status = %+v", got)
+	}
+	if strings.Contains(w.Body.String(), "gho_0123456789abcdef") {
+		t.Errorf("GET list exposes the OAuth token: %s", w.Body.String())
+	}
+
+	if w := do("DELETE", "/admin/tenants/acme", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %d", w.Code)
+	}
+	if w := do("GET", "/admin/tenants/acme", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET deleted tenant status = %d, want 404", w.Code)
+	}
+}
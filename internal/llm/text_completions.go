@@ -0,0 +1,224 @@
+package llm
+
+import (
+	"copilot-proxy/internal/accesslog"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// TextCompletionParams is the request body of the legacy /v1/completions endpoint
+type TextCompletionParams struct {
+	Model       string          `json:"model"`
+	Prompt      json.RawMessage `json:"prompt"`
+	MaxTokens   *int            `json:"max_tokens,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+	Stop        interface{}     `json:"stop,omitempty"`
+	Stream      bool            `json:"stream"`
+	Echo        bool            `json:"echo"`
+}
+
+// promptText extracts a single prompt string from the legacy prompt field,
+// which may be either a string or an array containing one string.
+func (p *TextCompletionParams) promptText() (string, error) {
+	if len(p.Prompt) == 0 {
+		return "", fmt.Errorf("prompt is required")
+	}
+	var single string
+	if err := json.Unmarshal(p.Prompt, &single); err == nil {
+		return single, nil
+	}
+	var list []string
+	if err := json.Unmarshal(p.Prompt, &list); err == nil {
+		if len(list) != 1 {
+			return "", fmt.Errorf("exactly one prompt is supported, got %d", len(list))
+		}
+		return list[0], nil
+	}
+	return "", fmt.Errorf("prompt must be a string or an array of strings")
+}
+
+// toChatRequest converts the legacy payload into a chat completion payload
+func (p *TextCompletionParams) toChatRequest(prompt string) map[string]interface{} {
+	chat := map[string]interface{}{
+		"model":    p.Model,
+		"messages": []map[string]string{{"role": "user", "content": prompt}},
+	}
+	if p.MaxTokens != nil {
+		chat["max_tokens"] = *p.MaxTokens
+	}
+	if p.Temperature != nil {
+		chat["temperature"] = *p.Temperature
+	}
+	if p.TopP != nil {
+		chat["top_p"] = *p.TopP
+	}
+	if p.Stop != nil {
+		chat["stop"] = p.Stop
+	}
+	return chat
+}
+
+// HandleTextCompletion handles the legacy /v1/completions endpoint by
+// translating the prompt into a chat request and mapping the response back
+// to text_completion objects.
+func (s *ServerState) HandleTextCompletion(w http.ResponseWriter, r *http.Request) {
+	token, err := s.validateToken(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	release, err := s.Service.acquireRequestSlot(token.UserID)
+	if err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+	defer release()
+
+	bodyBytes, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	var params TextCompletionParams
+	if err := json.Unmarshal(bodyBytes, &params); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), "invalid_request_error")
+		return
+	}
+	if params.Model == "" {
+		params.Model = "copilot-chat" // Default model
+	}
+	accesslog.SetModel(r.Context(), params.Model)
+	s.Service.setRateLimitHeaders(w, token.UserID, params.Model)
+	if err := AuthorizeStreaming(token, params.Stream); err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+	prompt, err := params.promptText()
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+
+	providerRequest, err := json.Marshal(params.toChatRequest(prompt))
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "error formatting request: "+err.Error(), "internal_error")
+		return
+	}
+
+	req := CompletionRequest{
+		Context:         r.Context(),
+		Model:           params.Model,
+		ProviderRequest: string(providerRequest),
+		Token:           token,
+		CountryCode:     getCountryCode(r),
+		CurrentSpending: s.Service.CurrentSpending(token.UserID),
+		Endpoint:        r.URL.Path,
+	}
+	resp, err := s.Service.PerformCompletion(req)
+	if err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	reader, err := s.Service.ProcessStreamingResponse(resp, req)
+	if err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+	defer reader.Close()
+
+	now := time.Now().Unix()
+	id := fmt.Sprintf("cmpl-%d%06d", now, rand.Intn(1000000))
+
+	if !params.Stream {
+		result, _ := collectStream(reader)
+		fillUsage(result, reader)
+		text := result.Content
+		if params.Echo {
+			text = prompt + text
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      id,
+			"object":  "text_completion",
+			"created": now,
+			"model":   params.Model,
+			"choices": []map[string]interface{}{{
+				"text":          text,
+				"index":         0,
+				"logprobs":      nil,
+				"finish_reason": result.FinishReason,
+			}},
+			"usage": map[string]interface{}{
+				"prompt_tokens":     result.Usage.PromptTokens,
+				"completion_tokens": result.Usage.CompletionTokens,
+				"total_tokens":      result.Usage.TotalTokens,
+			},
+		})
+		return
+	}
+
+	// Streaming: re-encode each chat chunk as a text_completion chunk
+	stream, ok := s.beginStream(w, reader)
+	if !ok {
+		return
+	}
+	defer s.endStream(w, stream)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher, _ := w.(http.Flusher)
+	writeChunk := func(text string, finishReason interface{}) {
+		data, _ := json.Marshal(map[string]interface{}{
+			"id":      id,
+			"object":  "text_completion",
+			"created": now,
+			"model":   params.Model,
+			"choices": []map[string]interface{}{{
+				"text":          text,
+				"index":         0,
+				"logprobs":      nil,
+				"finish_reason": finishReason,
+			}},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if params.Echo {
+		writeChunk(prompt, nil)
+	}
+	done := false
+	pumpSSE(w, reader, s.Service.config.SSEKeepaliveInterval, func(line []byte) {
+		chunk, last := decodeSSELine(string(line))
+		done = done || last
+		if done || chunk == nil {
+			return
+		}
+		choices, ok := chunk["choices"].([]interface{})
+		if !ok || len(choices) == 0 {
+			return
+		}
+		choice, _ := choices[0].(map[string]interface{})
+		delta, _ := choice["delta"].(map[string]interface{})
+		text, _ := delta["content"].(string)
+		finishReason := choice["finish_reason"]
+		if text == "" && finishReason == nil {
+			return
+		}
+		writeChunk(text, finishReason)
+	})
+	if s.streams.wasAborted(stream) {
+		return
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
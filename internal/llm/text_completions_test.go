@@ -0,0 +1,105 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTextCompletionPromptText(t *testing.T) {
+	tests := []struct {
+		name    string
+		prompt  string
+		want    string
+		wantErr bool
+	}{
+		{name: "string prompt", prompt: `"hello"`, want: "hello"},
+		{name: "single element array", prompt: `["hello"]`, want: "hello"},
+		{name: "multiple prompts", prompt: `["a","b"]`, wantErr: true},
+		{name: "missing prompt", prompt: ``, wantErr: true},
+		{name: "token array", prompt: `[1,2,3]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := TextCompletionParams{Prompt: json.RawMessage(tt.prompt)}
+			got, err := p.promptText()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("promptText() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("promptText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleTextCompletion(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	upstream := newSSEUpstream(t,
+		`{"choices":[{"delta":{"content":"Hello"}}]}`,
+		`{"choices":[{"delta":{"content":" world"},"finish_reason":"stop"}]}`,
+	)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+
+	t.Run("non-streaming", func(t *testing.T) {
+		body := `{"model":"test-model","prompt":"Say hello","echo":true}`
+		req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		state.HandleTextCompletion(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+		}
+		var out struct {
+			Object  string `json:"object"`
+			Choices []struct {
+				Text         string `json:"text"`
+				FinishReason string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if out.Object != "text_completion" {
+			t.Errorf("expected object=text_completion, got %s", out.Object)
+		}
+		if len(out.Choices) != 1 || out.Choices[0].Text != "Say helloHello world" {
+			t.Errorf("unexpected choices: %+v", out.Choices)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		body := `{"model":"test-model","prompt":["Say hello"],"stream":true}`
+		req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		state.HandleTextCompletion(w, req)
+
+		all, _ := io.ReadAll(w.Body)
+		if !strings.Contains(string(all), `"object":"text_completion"`) {
+			t.Errorf("expected text_completion chunks, got %s", all)
+		}
+		if !strings.Contains(string(all), `"text":" world"`) {
+			t.Errorf("expected delta text in stream, got %s", all)
+		}
+		if !strings.HasSuffix(string(all), "data: [DONE]\n\n") {
+			t.Errorf("expected [DONE] marker at end of stream")
+		}
+	})
+
+	t.Run("invalid prompt", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model":"test-model"}`))
+		w := httptest.NewRecorder()
+		state.HandleTextCompletion(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+}
@@ -2,6 +2,8 @@ package llm
 
 import (
 	"copilot-proxy/pkg/models"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"time"
 
@@ -11,6 +13,9 @@ import (
 const (
 	// TokenLifetime defines how long tokens are valid
 	TokenLifetime = 60 * 60 // 1 hour in seconds
+
+	// defaultTokenCacheSize is used when TOKEN_CACHE_SIZE is unset
+	defaultTokenCacheSize = 1024
 )
 
 var (
@@ -26,32 +31,52 @@ type TokenClaims struct {
 	jwt.RegisteredClaims
 	UserID          uint64 `json:"user_id"`
 	GithubUserLogin string `json:"github_user_login"`
+	// KeyID is the stored API key the token was issued for at /auth/token;
+	// such tokens carry the key's model and streaming scopes
+	KeyID         uint64   `json:"key_id,omitempty"`
+	AllowedModels []string `json:"allowed_models,omitempty"`
+	NoStreaming   bool     `json:"no_streaming,omitempty"`
+	// Staff is set on the personal tokens of CreateLLMToken, never on the
+	// tokens issued at /auth/token
+	Staff bool `json:"staff,omitempty"`
 }
 
-// CreateLLMToken generates a JWT token for LLM API access
+// CreateLLMToken generates a personal JWT token for LLM API access, which
+// is a staff token
 func CreateLLMToken(userID uint64, githubLogin string, secret string) (string, error) {
-	now := time.Now()
-
-	claims := TokenClaims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(now.Add(TokenLifetime * time.Second)),
-			IssuedAt:  jwt.NewNumericDate(now),
-			ID:        now.Format(time.RFC3339Nano), // Simple ID based on timestamp
-		},
-		UserID:          userID,
-		GithubUserLogin: githubLogin,
-	}
+	return IssueLLMToken(TokenClaims{UserID: userID, GithubUserLogin: githubLogin, Staff: true}, secret)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+// IssueLLMToken signs a JWT token with the given claims. The issue time and
+// ID are set to now and, unless claims sets an earlier expiry, the token
+// expires after TokenLifetime.
+func IssueLLMToken(claims TokenClaims, secret string) (string, error) {
+	return issueLLMToken(claims, hmacTokenKey(secret))
+}
 
-	return token.SignedString([]byte(secret))
+// issueLLMToken is IssueLLMToken with any signing key
+func issueLLMToken(claims TokenClaims, key *tokenKey) (string, error) {
+	now := time.Now()
+	expiresAt := now.Add(TokenLifetime * time.Second)
+	if claims.ExpiresAt != nil && claims.ExpiresAt.Before(expiresAt) {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ID:        now.Format(time.RFC3339Nano), // Simple ID based on timestamp
+	}
+	return key.sign(claims)
 }
 
 // ValidateLLMToken validates and parses a JWT token
 func ValidateLLMToken(tokenString string, secret string) (*models.LLMToken, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+	return parseLLMToken(tokenString, hmacTokenKey(secret))
+}
+
+// parseLLMToken is ValidateLLMToken with any signing key
+func parseLLMToken(tokenString string, key *tokenKey) (*models.LLMToken, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, key.keyFunc)
 
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
@@ -73,8 +98,48 @@ func ValidateLLMToken(tokenString string, secret string) (*models.LLMToken, erro
 		UserID:                 claims.UserID,
 		GithubUserLogin:        claims.GithubUserLogin,
 		AccountCreatedAt:       time.Now().AddDate(-1, 0, 0), // Default to 1 year ago
-		IsStaff:                true,                         // Default to true for personal use
-		HasLLMSubscription:     true,                         // Default to true for personal use
-		MaxMonthlySpendInCents: 10000,                        // Default high limit for personal use
+		IsStaff:                claims.Staff,
+		HasLLMSubscription:     true,  // Default to true for personal use
+		MaxMonthlySpendInCents: 10000, // Default high limit for personal use
+		AllowedModels:          claims.AllowedModels,
+		NoStreaming:            claims.NoStreaming,
+		KeyID:                  claims.KeyID,
 	}, nil
 }
+
+// tokenCache holds validated LLM tokens until they expire
+type tokenCache = lruCache[models.LLMToken]
+
+// newTokenCache creates a token cache holding at most size tokens, or
+// returns nil (caching disabled) if size is not positive.
+func newTokenCache(size int) *tokenCache {
+	return newLRUCache[models.LLMToken](size, TokenLifetime*time.Second)
+}
+
+// tokenCacheKey hashes a token together with the ID of the key it was
+// verified with, so a changed key does not serve tokens signed with the old
+// one
+func tokenCacheKey(keyID, tokenString string) string {
+	sum := sha256.Sum256([]byte(keyID + "\x00" + tokenString))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateLLMToken validates an LLM token like ValidateLLMToken, serving
+// tokens seen before from the token cache until they expire. Each call
+// returns its own copy of the token. Invalid tokens are not cached.
+func (s *ServerState) validateLLMToken(tokenString string) (*models.LLMToken, error) {
+	signingKey := s.tokenKey()
+	if s.tokens == nil {
+		return parseLLMToken(tokenString, signingKey)
+	}
+	key := tokenCacheKey(signingKey.id, tokenString)
+	if token, ok := s.tokens.get(key); ok {
+		return &token, nil
+	}
+	token, err := parseLLMToken(tokenString, signingKey)
+	if err != nil {
+		return nil, err
+	}
+	s.tokens.putUntil(key, *token, time.Unix(token.Exp, 0))
+	return token, nil
+}
@@ -0,0 +1,161 @@
+package llm
+
+import (
+	appauth "copilot-proxy/internal/auth"
+	"copilot-proxy/pkg/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// errEndpointScopedKey is returned for stored API keys restricted to
+// endpoints, which an LLM token cannot carry
+var errEndpointScopedKey = fmt.Errorf("%w: API keys restricted to endpoints cannot be exchanged for LLM tokens", appauth.ErrScopeDenied)
+
+// errGitHubUserNotAllowed is returned for GitHub users missing from
+// AUTH_GITHUB_USERS
+var errGitHubUserNotAllowed = fmt.Errorf("%w: GitHub user may not obtain LLM tokens", appauth.ErrScopeDenied)
+
+// apiKeyClaims returns the claims of an LLM token issued for a stored API
+// key: its ID and name, its model and streaming scopes and, if it expires
+// sooner than TokenLifetime, its expiry
+func apiKeyClaims(key appauth.APIKey) (TokenClaims, error) {
+	claims := TokenClaims{UserID: key.ID, GithubUserLogin: key.Name, KeyID: key.ID}
+	if key.Scopes != nil {
+		if len(key.Scopes.Endpoints) > 0 {
+			return TokenClaims{}, errEndpointScopedKey
+		}
+		claims.AllowedModels = key.Scopes.Models
+		claims.NoStreaming = key.Scopes.NoStreaming
+	}
+	if key.ExpiresAt != nil {
+		claims.ExpiresAt = jwt.NewNumericDate(*key.ExpiresAt)
+	}
+	return claims, nil
+}
+
+// githubUser is the part of GET /user of the GitHub API the proxy uses
+type githubUser struct {
+	ID    uint64 `json:"id"`
+	Login string `json:"login"`
+}
+
+// fetchGitHubUser returns the GitHub user an OAuth token belongs to
+func fetchGitHubUser(oauthToken string) (githubUser, error) {
+	req, err := http.NewRequest("GET", utils.GitHubAPIURL()+"/user", nil)
+	if err != nil {
+		return githubUser{}, err
+	}
+	req.Header.Set("Authorization", "token "+oauthToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "copilot-proxy")
+
+	resp, err := utils.NewUpstreamClient().Do(req)
+	if err != nil {
+		return githubUser{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return githubUser{}, ErrInvalidToken
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return githubUser{}, fmt.Errorf("GitHub API returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var user githubUser
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return githubUser{}, err
+	}
+	if user.ID == 0 || user.Login == "" {
+		return githubUser{}, errors.New("GitHub API returned no user")
+	}
+	return user, nil
+}
+
+// githubUserAllowed reports whether login is listed in AUTH_GITHUB_USERS,
+// ignoring case
+func (c *Config) githubUserAllowed(login string) bool {
+	for _, allowed := range c.AuthGitHubUsers {
+		if strings.EqualFold(allowed, login) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenClaimsFor returns the claims of an LLM token for a credential: a
+// stored API key or, for the GitHub users of AUTH_GITHUB_USERS, a GitHub
+// OAuth token
+func (s *ServerState) tokenClaimsFor(credential string) (TokenClaims, error) {
+	key, err := appauth.AuthenticateAppAPIKey(credential)
+	if err == nil {
+		return apiKeyClaims(key)
+	}
+	if !errors.Is(err, appauth.ErrKeyNotFound) {
+		return TokenClaims{}, err
+	}
+	if s.Service == nil || len(s.Service.config.AuthGitHubUsers) == 0 {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	user, err := fetchGitHubUser(credential)
+	if err != nil {
+		return TokenClaims{}, err
+	}
+	if !s.Service.config.githubUserAllowed(user.Login) {
+		return TokenClaims{}, errGitHubUserNotAllowed
+	}
+	return TokenClaims{UserID: user.ID, GithubUserLogin: user.Login}, nil
+}
+
+// HandleTokenIssue serves POST /auth/token: it exchanges the credential of
+// the Authorization header, a stored API key or the GitHub OAuth token of a
+// user listed in AUTH_GITHUB_USERS, for a signed LLM token valid for
+// TokenLifetime.
+func (s *ServerState) HandleTokenIssue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		writeTokenError(w, errors.New("invalid or missing authorization header"))
+		return
+	}
+	claims, err := s.tokenClaimsFor(auth[7:])
+	if err == nil {
+		var token string
+		if token, err = issueLLMToken(claims, s.tokenKey()); err == nil {
+			writeIssuedToken(w, token)
+			return
+		}
+	}
+	switch {
+	case errors.Is(err, ErrInvalidToken), errors.Is(err, appauth.ErrKeyRevoked), errors.Is(err, appauth.ErrKeyExpired):
+		writeTokenError(w, ErrInvalidToken)
+	case errors.Is(err, appauth.ErrScopeDenied):
+		writeTokenError(w, err)
+	default:
+		writeOpenAIError(w, http.StatusBadGateway, "failed to issue token: "+err.Error(), "api_error")
+	}
+}
+
+// writeIssuedToken writes an LLM token issued at /auth/token or
+// /auth/refresh with its expiry
+func writeIssuedToken(w http.ResponseWriter, token string) {
+	out := map[string]interface{}{"token": token, "token_type": "Bearer"}
+	if parsed, _, err := jwt.NewParser().ParseUnverified(token, &TokenClaims{}); err == nil {
+		if claims, ok := parsed.Claims.(*TokenClaims); ok && claims.ExpiresAt != nil {
+			out["expires_at"] = claims.ExpiresAt.Unix()
+			out["expires_in"] = int64(claims.ExpiresAt.Sub(claims.IssuedAt.Time).Seconds())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,115 @@
+package llm
+
+import (
+	appauth "copilot-proxy/internal/auth"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandleTokenIssue(t *testing.T) {
+	store, err := appauth.NewFileKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appauth.SetKeyStore(store)
+	defer appauth.SetKeyStore(nil)
+	soon := time.Now().Add(10 * time.Minute)
+	scoped, _ := store.Create("script", &soon, &appauth.KeyScopes{Models: []string{"gpt-4o"}, NoStreaming: true})
+	endpointScoped, _ := store.Create("embedder", nil, &appauth.KeyScopes{Endpoints: []string{"/v1/embeddings"}})
+	revoked, _ := store.Create("old-script", nil, nil)
+	store.Revoke(revoked.ID)
+
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "token gho_alice":
+			io.WriteString(w, `{"id": 1001, "login": "Alice"}`)
+		case "token gho_mallory":
+			io.WriteString(w, `{"id": 1002, "login": "mallory"}`)
+		default:
+			http.Error(w, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+		}
+	}))
+	defer github.Close()
+	t.Setenv("GITHUB_API_URL", github.URL)
+
+	state := &ServerState{Secret: "secret", Service: &Service{config: &Config{AuthGitHubUsers: []string{"alice"}}}}
+	issue := func(bearer string) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest("POST", "/auth/token", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		w := httptest.NewRecorder()
+		state.HandleTokenIssue(w, req)
+		var out struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(w.Body).Decode(&out)
+		return w, out.Token
+	}
+
+	// A stored key's token carries its scopes and expiry and is no staff token
+	w, issued := issue(scoped.Key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("stored key: status = %d", w.Code)
+	}
+	token, err := ValidateLLMToken(issued, state.Secret)
+	if err != nil || token.UserID != scoped.ID || token.KeyID != scoped.ID || token.IsStaff ||
+		len(token.AllowedModels) != 1 || !token.NoStreaming || token.Exp > soon.Unix() {
+		t.Errorf("stored key token = %+v, %v", token, err)
+	}
+	refreshed, err := RefreshLLMToken(issued, state.Secret, 0)
+	if err != nil {
+		t.Fatalf("RefreshLLMToken() error = %v", err)
+	}
+	if token, err := ValidateLLMToken(refreshed, state.Secret); err != nil || token.KeyID != scoped.ID || !token.NoStreaming {
+		t.Errorf("refreshed stored key token = %+v, %v", token, err)
+	}
+
+	// GitHub users of AUTH_GITHUB_USERS, case-insensitively, and not as staff
+	w, issued = issue("gho_alice")
+	if token, err := ValidateLLMToken(issued, state.Secret); w.Code != http.StatusOK || err != nil || token.UserID != 1001 || token.GithubUserLogin != "Alice" || token.IsStaff {
+		t.Errorf("GitHub token: status = %d, token = %+v, %v", w.Code, token, err)
+	}
+
+	// Their tokens are refreshed only while they stay in AUTH_GITHUB_USERS
+	refresh := func(token string) int {
+		req := httptest.NewRequest("POST", "/auth/refresh", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		state.HandleTokenRefresh(w, req)
+		return w.Code
+	}
+	if code := refresh(issued); code != http.StatusOK {
+		t.Errorf("refresh GitHub token: status = %d", code)
+	}
+	state.Service.config.AuthGitHubUsers = []string{"bob"}
+	if code := refresh(issued); code != http.StatusForbidden {
+		t.Errorf("refresh token of removed GitHub user: status = %d, want %d", code, http.StatusForbidden)
+	}
+	state.Service.config.AuthGitHubUsers = []string{"alice"}
+
+	for _, tt := range []struct {
+		name   string
+		bearer string
+		status int
+	}{
+		{"endpoint-scoped key", endpointScoped.Key, http.StatusForbidden},
+		{"revoked key", revoked.Key, http.StatusUnauthorized},
+		{"GitHub user not allowed", "gho_mallory", http.StatusForbidden},
+		{"bad credentials", "gho_unknown", http.StatusUnauthorized},
+	} {
+		if w, _ := issue(tt.bearer); w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+
+	// Tokens of revoked keys are no longer refreshed
+	_, issued = issue(scoped.Key)
+	store.Revoke(scoped.ID)
+	if _, err := RefreshLLMToken(issued, state.Secret, 0); err == nil {
+		t.Error("token of a revoked key was refreshed")
+	}
+}
@@ -0,0 +1,91 @@
+package llm
+
+import (
+	appauth "copilot-proxy/internal/auth"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// defaultTokenRefreshGrace is used when TOKEN_REFRESH_GRACE is unset or
+// invalid
+const defaultTokenRefreshGrace = 5 * time.Minute
+
+// RefreshLLMToken issues a new LLM token with the claims of a token that is
+// still valid or expired at most grace ago. The signature is always
+// verified; tokens expired for longer fail with ErrTokenExpired. Tokens
+// issued for a stored API key take the key's current scopes and are only
+// refreshed while the key is neither revoked nor expired. Tokens issued for
+// GitHub users are not refreshed, as there is no AUTH_GITHUB_USERS to check
+// them against.
+func RefreshLLMToken(tokenString string, secret string, grace time.Duration) (string, error) {
+	return refreshLLMToken(tokenString, hmacTokenKey(secret), grace, nil)
+}
+
+// refreshLLMToken is RefreshLLMToken with any signing key. Tokens issued for
+// GitHub users are only refreshed while config lists them in
+// AUTH_GITHUB_USERS.
+func refreshLLMToken(tokenString string, key *tokenKey, grace time.Duration, config *Config) (string, error) {
+	parser := jwt.NewParser(jwt.WithoutClaimsValidation())
+	token, err := parser.ParseWithClaims(tokenString, &TokenClaims{}, key.keyFunc)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	claims, ok := token.Claims.(*TokenClaims)
+	if !ok || !token.Valid || claims.ExpiresAt == nil {
+		return "", ErrInvalidToken
+	}
+	if time.Now().After(claims.ExpiresAt.Add(grace)) {
+		return "", ErrTokenExpired
+	}
+	refreshed := *claims
+	refreshed.RegisteredClaims = jwt.RegisteredClaims{}
+	switch {
+	case claims.KeyID != 0:
+		apiKey, err := appauth.AppAPIKeyByID(claims.KeyID)
+		if err != nil {
+			return "", ErrInvalidToken
+		}
+		if refreshed, err = apiKeyClaims(apiKey); err != nil {
+			return "", err
+		}
+	case !claims.Staff:
+		if config == nil || !config.githubUserAllowed(claims.GithubUserLogin) {
+			return "", errGitHubUserNotAllowed
+		}
+	}
+	return issueLLMToken(refreshed, key)
+}
+
+// HandleTokenRefresh serves POST /auth/refresh: it trades the LLM token of
+// the Authorization header, while valid or within TOKEN_REFRESH_GRACE of its
+// expiry, for a new one valid for another TokenLifetime. Stored API keys do
+// not expire this way and cannot be refreshed, and GitHub users removed from
+// AUTH_GITHUB_USERS can no longer refresh their tokens.
+func (s *ServerState) HandleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		writeTokenError(w, errors.New("invalid or missing authorization header"))
+		return
+	}
+	grace := defaultTokenRefreshGrace
+	var config *Config
+	if s.Service != nil {
+		config = s.Service.config
+		grace = config.TokenRefreshGrace
+	}
+	token, err := refreshLLMToken(auth[7:], s.tokenKey(), grace, config)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	writeIssuedToken(w, token)
+}
@@ -0,0 +1,81 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRefreshLLMToken(t *testing.T) {
+	const secret = "test-secret"
+	valid, _ := CreateLLMToken(42, "testuser", secret)
+	// Expired an hour ago
+	expired := createExpiredToken(42, "testuser", secret)
+
+	tests := []struct {
+		name    string
+		token   string
+		secret  string
+		grace   time.Duration
+		wantErr error
+	}{
+		{"valid token", valid, secret, 0, nil},
+		{"expired within grace", expired, secret, 2 * time.Hour, nil},
+		{"expired beyond grace", expired, secret, 5 * time.Minute, ErrTokenExpired},
+		{"wrong secret", valid, "other-secret", time.Hour, ErrInvalidToken},
+		{"malformed token", "not-a-token", secret, time.Hour, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refreshed, err := RefreshLLMToken(tt.token, tt.secret, tt.grace)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RefreshLLMToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			token, err := ValidateLLMToken(refreshed, tt.secret)
+			if err != nil || token.UserID != 42 || token.GithubUserLogin != "testuser" {
+				t.Errorf("refreshed token = %+v, %v", token, err)
+			}
+		})
+	}
+}
+
+func TestHandleTokenRefresh(t *testing.T) {
+	s := &ServerState{Secret: "test-secret"}
+	valid, _ := CreateLLMToken(42, "testuser", s.Secret)
+
+	req := httptest.NewRequest("POST", "/auth/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+valid)
+	w := httptest.NewRecorder()
+	s.HandleTokenRefresh(w, req)
+	var out struct {
+		Token     string `json:"token"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	json.NewDecoder(w.Body).Decode(&out)
+	if w.Code != http.StatusOK || out.ExpiresAt <= time.Now().Unix() {
+		t.Fatalf("refresh: status = %d, response = %+v", w.Code, out)
+	}
+	if _, err := ValidateLLMToken(out.Token, s.Secret); err != nil {
+		t.Errorf("refreshed token is invalid: %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/auth/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+createExpiredToken(42, "testuser", s.Secret))
+	w = httptest.NewRecorder()
+	s.HandleTokenRefresh(w, req)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("X-LLM-Token-Expired") != "true" {
+		t.Errorf("long expired token: status = %d, headers = %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleTokenRefresh(w, httptest.NewRequest("GET", "/auth/refresh", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
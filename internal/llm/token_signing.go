@@ -0,0 +1,206 @@
+package llm
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// JWKSPath is where the public keys of asymmetrically signed LLM tokens are
+// served as a JSON Web Key Set
+const JWKSPath = "/.well-known/jwks.json"
+
+// tokenKey signs and verifies LLM tokens with one algorithm
+type tokenKey struct {
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+	// id identifies the key in the token cache and, for asymmetric keys, in
+	// the kid header of tokens and the JWKS
+	id string
+	// public is the public key of asymmetric keys; nil for HMAC secrets
+	public crypto.PublicKey
+	// retired are earlier signing keys whose tokens are still accepted and
+	// whose public keys are still published; see AddVerificationKey
+	retired []*tokenKey
+}
+
+// hmacTokenKey returns the key of tokens signed with HS256 and secret
+func hmacTokenKey(secret string) *tokenKey {
+	return &tokenKey{method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret), id: secret}
+}
+
+// newSigningTokenKey returns the key of tokens signed with RS256 or EdDSA by
+// an RSA or Ed25519 private key
+func newSigningTokenKey(key crypto.Signer) (*tokenKey, error) {
+	k, err := newVerificationTokenKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	k.signKey = key
+	return k, nil
+}
+
+// newVerificationTokenKey returns the key verifying tokens signed with RS256
+// or EdDSA by the private key of an RSA or Ed25519 public key. Its ID is
+// derived from the public key, so it matches the kid of the tokens signed
+// with the private key.
+func newVerificationTokenKey(public crypto.PublicKey) (*tokenKey, error) {
+	k := &tokenKey{verifyKey: public, public: public}
+	switch public.(type) {
+	case *rsa.PublicKey:
+		k.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		k.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T; use an RSA or Ed25519 key", public)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	k.id = base64.RawURLEncoding.EncodeToString(sum[:12])
+	return k, nil
+}
+
+// sign signs a token with the key, naming asymmetric keys in its header
+func (k *tokenKey) sign(claims TokenClaims) (string, error) {
+	token := jwt.NewWithClaims(k.method, claims)
+	if k.public != nil {
+		token.Header["kid"] = k.id
+	}
+	return token.SignedString(k.signKey)
+}
+
+// keyFunc returns the verification key for tokens signed with the key's
+// algorithm and rejects all others, so an HMAC token cannot pass as
+// signed with a public key and vice versa. Asymmetrically signed tokens are
+// verified with the key or retired key their kid header names.
+func (k *tokenKey) keyFunc(token *jwt.Token) (interface{}, error) {
+	if k.public != nil {
+		kid, _ := token.Header["kid"].(string)
+		if k = k.byID(kid); k == nil {
+			return nil, fmt.Errorf("unknown key ID %q", kid)
+		}
+	}
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return k.verifyKey, nil
+}
+
+// byID returns the key or the retired key with the given ID, or nil
+func (k *tokenKey) byID(id string) *tokenKey {
+	if k.id == id {
+		return k
+	}
+	for _, retired := range k.retired {
+		if retired.id == id {
+			return retired
+		}
+	}
+	return nil
+}
+
+// SetSigningKey signs LLM tokens with an RSA (RS256) or Ed25519 (EdDSA)
+// private key instead of the HMAC secret, so that other services can verify
+// them with the public key served at JWKSPath. Tokens signed with the
+// secret are no longer accepted.
+func (s *ServerState) SetSigningKey(key crypto.Signer) error {
+	k, err := newSigningTokenKey(key)
+	if err != nil {
+		return err
+	}
+	s.signingKey = k
+	return nil
+}
+
+// AddVerificationKey keeps accepting the tokens signed with the private key
+// of an RSA or Ed25519 public key, typically the signing key before a
+// rotation, and publishes it at JWKSPath along with the current key. It
+// must be called after SetSigningKey.
+func (s *ServerState) AddVerificationKey(public crypto.PublicKey) error {
+	if s.signingKey == nil {
+		return errors.New("verification keys require a signing key")
+	}
+	k, err := newVerificationTokenKey(public)
+	if err != nil {
+		return err
+	}
+	if s.signingKey.byID(k.id) == nil {
+		s.signingKey.retired = append(s.signingKey.retired, k)
+	}
+	return nil
+}
+
+// tokenKey returns the key LLM tokens are signed and verified with
+func (s *ServerState) tokenKey() *tokenKey {
+	if s.signingKey != nil {
+		return s.signingKey
+	}
+	return hmacTokenKey(s.Secret)
+}
+
+// jwk is a public key in the JSON Web Key format
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// jwk returns the public key of an asymmetric key as a JSON Web Key
+func (k *tokenKey) jwk() jwk {
+	key := jwk{Use: "sig", Alg: k.method.Alg(), Kid: k.id}
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		key.Kty, key.Crv = "OKP", "Ed25519"
+		key.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return key
+}
+
+// HandleJWKS serves GET /.well-known/jwks.json: the public keys of the
+// current and retired signing keys, for gateways validating LLM tokens
+// without calling the proxy. It is not found while tokens are signed with
+// the HMAC secret.
+func (s *ServerState) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	k := s.signingKey
+	if k == nil {
+		writeOpenAIError(w, http.StatusNotFound, "asymmetric token signing is disabled", "invalid_request_error")
+		return
+	}
+	keys := []jwk{k.jwk()}
+	for _, retired := range k.retired {
+		keys = append(keys, retired.jwk())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
@@ -0,0 +1,145 @@
+package llm
+
+import (
+	appauth "copilot-proxy/internal/auth"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestAsymmetricTokenSigning(t *testing.T) {
+	_, rsaKey, err := appauth.GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		alg string
+		key crypto.Signer
+	}{
+		{"RS256", rsaKey.Key},
+		{"EdDSA", edKey},
+	} {
+		t.Run(tt.alg, func(t *testing.T) {
+			s := &ServerState{Secret: "secret", tokens: newTokenCache(8)}
+			if err := s.SetSigningKey(tt.key); err != nil {
+				t.Fatal(err)
+			}
+			signed, err := issueLLMToken(TokenClaims{UserID: 42, GithubUserLogin: "testuser"}, s.tokenKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token, err := s.validateLLMToken(signed); err != nil || token.UserID != 42 {
+				t.Errorf("validateLLMToken() = %+v, %v", token, err)
+			}
+
+			// A sidecar verifies the token with the published key alone
+			w := httptest.NewRecorder()
+			s.HandleJWKS(w, httptest.NewRequest("GET", JWKSPath, nil))
+			var jwks struct {
+				Keys []jwk `json:"keys"`
+			}
+			json.NewDecoder(w.Body).Decode(&jwks)
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Alg != tt.alg {
+				t.Fatalf("JWKS = %+v", jwks)
+			}
+			parsed, err := jwt.ParseWithClaims(signed, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+				if token.Header["kid"] != jwks.Keys[0].Kid {
+					return nil, errors.New("unknown kid")
+				}
+				if jwks.Keys[0].Kty == "OKP" {
+					x, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+					return ed25519.PublicKey(x), err
+				}
+				return s.signingKey.verifyKey, nil
+			})
+			if err != nil || !parsed.Valid {
+				t.Errorf("token does not verify with the published key: %v", err)
+			}
+
+			// Tokens signed with the HMAC secret are no longer accepted
+			hmacSigned, _ := CreateLLMToken(42, "testuser", s.Secret)
+			if _, err := s.validateLLMToken(hmacSigned); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("HMAC token error = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+
+	// Without a signing key, there is no key set
+	w := httptest.NewRecorder()
+	(&ServerState{Secret: "secret"}).HandleJWKS(w, httptest.NewRequest("GET", JWKSPath, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("HMAC JWKS status = %d, want 404", w.Code)
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, unknownKey, _ := ed25519.GenerateKey(rand.Reader)
+	sign := func(key crypto.Signer) string {
+		k, err := newSigningTokenKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := issueLLMToken(TokenClaims{UserID: 42, Staff: true}, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	s := &ServerState{Secret: "secret"}
+	if err := s.AddVerificationKey(oldKey.Public()); err == nil {
+		t.Error("AddVerificationKey() without a signing key succeeded")
+	}
+	if err := s.SetSigningKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddVerificationKey(oldKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.validateLLMToken(sign(oldKey)); err != nil {
+		t.Errorf("token of the retired key: %v", err)
+	}
+	if _, err := s.validateLLMToken(sign(newKey)); err != nil {
+		t.Errorf("token of the current key: %v", err)
+	}
+	if _, err := s.validateLLMToken(sign(unknownKey)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token of an unknown key error = %v, want ErrInvalidToken", err)
+	}
+	// Refreshing a token of the retired key signs it with the current key
+	refreshed, err := refreshLLMToken(sign(oldKey), s.tokenKey(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, _, _ := jwt.NewParser().ParseUnverified(refreshed, &TokenClaims{}); parsed.Header["kid"] != s.signingKey.id {
+		t.Errorf("refreshed token kid = %v, want the current key", parsed.Header["kid"])
+	}
+
+	w := httptest.NewRecorder()
+	s.HandleJWKS(w, httptest.NewRequest("GET", JWKSPath, nil))
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	json.NewDecoder(w.Body).Decode(&jwks)
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != s.signingKey.id || jwks.Keys[1].Kid != s.signingKey.retired[0].id {
+		t.Errorf("JWKS = %+v, want the current and the retired key", jwks)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc == "" {
+		t.Error("JWKS is missing Cache-Control")
+	}
+}
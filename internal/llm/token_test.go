@@ -136,9 +136,45 @@ func createExpiredToken(userID uint64, githubLogin string, secret string) string
 		},
 		UserID:          userID,
 		GithubUserLogin: githubLogin,
+		Staff:           true,
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, _ := token.SignedString([]byte(secret))
 	return tokenString
 }
+
+func TestValidateLLMTokenCache(t *testing.T) {
+	s := &ServerState{Secret: "test-secret", tokens: newTokenCache(2)}
+	tokenString, err := CreateLLMToken(42, "testuser", s.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.validateLLMToken(tokenString)
+	if err != nil || first.UserID != 42 {
+		t.Fatalf("validateLLMToken() = %+v, %v", first, err)
+	}
+	// Callers get their own copy of the cached token
+	first.UserID = 7
+	second, err := s.validateLLMToken(tokenString)
+	if err != nil || second.UserID != 42 || second == first {
+		t.Errorf("cached validateLLMToken() = %+v, %v", second, err)
+	}
+	if _, ok := s.tokens.get(tokenCacheKey(s.Secret, tokenString)); !ok {
+		t.Error("valid token was not cached")
+	}
+
+	// A changed secret does not serve tokens signed with the old one
+	s.Secret = "other-secret"
+	if _, err := s.validateLLMToken(tokenString); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("validateLLMToken() with changed secret error = %v", err)
+	}
+
+	expired := createExpiredToken(42, "testuser", s.Secret)
+	if _, err := s.validateLLMToken(expired); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("expired validateLLMToken() error = %v", err)
+	}
+	if _, ok := s.tokens.get(tokenCacheKey(s.Secret, expired)); ok {
+		t.Error("expired token was cached")
+	}
+}
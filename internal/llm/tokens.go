@@ -0,0 +1,274 @@
+package llm
+
+import (
+	"bytes"
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// encodingRetryInterval is how long token counting falls back to estimates
+// after an encoding failed to load, e.g. because its BPE ranks could not be
+// downloaded
+const encodingRetryInterval = 10 * time.Minute
+
+// Per-message overhead of the chat format, as documented by OpenAI
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+)
+
+// tokenEncoder splits text into BPE tokens
+type tokenEncoder interface {
+	Encode(text string, allowedSpecial, disallowedSpecial []string) []int
+}
+
+// loadEncoding loads a tiktoken encoding by name. Its BPE ranks are
+// downloaded on first use and cached in TIKTOKEN_CACHE_DIR.
+var loadEncoding = func(name string) (tokenEncoder, error) {
+	return tiktoken.GetEncoding(name)
+}
+
+// encodingCache holds the loaded encodings and when loading one last failed
+type encodingCache struct {
+	mu     sync.Mutex
+	loaded map[string]tokenEncoder
+	failed map[string]time.Time
+}
+
+var encodings encodingCache
+
+// get returns the named encoding, or nil while it cannot be loaded
+func (c *encodingCache) get(name string) tokenEncoder {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if enc, ok := c.loaded[name]; ok {
+		return enc
+	}
+	if failedAt, ok := c.failed[name]; ok && time.Since(failedAt) < encodingRetryInterval {
+		return nil
+	}
+	enc, err := loadEncoding(name)
+	if err != nil {
+		log.Printf("Warning: failed to load the %s tokenizer, estimating token counts: %v", name, err)
+		if c.failed == nil {
+			c.failed = make(map[string]time.Time)
+		}
+		c.failed[name] = time.Now()
+		return nil
+	}
+	if c.loaded == nil {
+		c.loaded = make(map[string]tokenEncoder)
+	}
+	c.loaded[name] = enc
+	delete(c.failed, name)
+	return enc
+}
+
+// encodingForModel returns the tiktoken encoding of a model. Newer OpenAI
+// models use o200k_base; older ones and models of other vendors, whose
+// tokenizers are not public, are counted with cl100k_base.
+func encodingForModel(model string) string {
+	model = strings.ToLower(model)
+	for _, prefix := range []string{"gpt-4o", "gpt-4.1", "gpt-5", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return tiktoken.MODEL_O200K_BASE
+		}
+	}
+	return tiktoken.MODEL_CL100K_BASE
+}
+
+// countTokens returns the number of tokens of text for a model. Without a
+// tokenizer it estimates four bytes per token.
+func countTokens(model, text string) int {
+	if text == "" {
+		return 0
+	}
+	if enc := encodings.get(encodingForModel(model)); enc != nil {
+		return len(enc.Encode(text, nil, nil))
+	}
+	return (len(text) + 3) / 4
+}
+
+// countPromptTokens returns the prompt tokens of an OpenAI chat request:
+// the text of every message and tool definition plus the chat format
+// overhead. Images are not counted.
+func countPromptTokens(model, providerRequest string) int {
+	var request struct {
+		Messages []struct {
+			Role      string          `json:"role"`
+			Name      string          `json:"name"`
+			Content   json.RawMessage `json:"content"`
+			ToolCalls json.RawMessage `json:"tool_calls"`
+		} `json:"messages"`
+		Tools     json.RawMessage `json:"tools"`
+		Functions json.RawMessage `json:"functions"`
+	}
+	if err := json.Unmarshal([]byte(providerRequest), &request); err != nil {
+		return 0
+	}
+	tokens := 0
+	for _, msg := range request.Messages {
+		tokens += tokensPerMessage + countTokens(model, msg.Role) + countTokens(model, messageText(msg.Content))
+		if msg.Name != "" {
+			tokens += tokensPerName + countTokens(model, msg.Name)
+		}
+		if len(msg.ToolCalls) > 0 && string(msg.ToolCalls) != "null" {
+			tokens += countTokens(model, string(msg.ToolCalls))
+		}
+	}
+	for _, defs := range []json.RawMessage{request.Tools, request.Functions} {
+		if len(defs) > 0 && string(defs) != "null" {
+			tokens += countTokens(model, string(defs))
+		}
+	}
+	if len(request.Messages) > 0 {
+		tokens += tokensPerReply
+	}
+	return tokens
+}
+
+// messageText returns the text of a message content, which is either a
+// string or an array of content parts
+func messageText(content json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, part := range parts {
+		if part.Type == "text" {
+			b.WriteString(part.Text)
+		}
+	}
+	return b.String()
+}
+
+// usageReader passes an upstream SSE stream through while collecting the
+// generated text, and records the request's token usage when it is closed.
+// Usage reported by the upstream takes precedence over the counted tokens.
+type usageReader struct {
+	io.ReadCloser
+	service      *Service
+	userID       uint64
+	model        string
+	promptTokens int
+	latency      time.Duration
+
+	// mu guards the scan state, since shutdown may close the stream while
+	// it is being read
+	mu       sync.Mutex
+	pending  []byte
+	output   strings.Builder
+	reported *streamUsage
+	counted  *models.TokenUsage
+	closed   sync.Once
+}
+
+// Read reads from the upstream stream, scanning every complete line
+func (r *usageReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = append(r.pending, p[:n]...)
+	for {
+		i := bytes.IndexByte(r.pending, '\n')
+		if i < 0 {
+			break
+		}
+		r.scanLine(r.pending[:i])
+		r.pending = r.pending[i+1:]
+	}
+	return n, err
+}
+
+// scanLine collects the generated text and any reported usage of one SSE
+// line
+func (r *usageReader) scanLine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("data: ")) {
+		return
+	}
+	var chunk struct {
+		Choices []struct {
+			Delta struct {
+				Content   string `json:"content"`
+				ToolCalls []struct {
+					Function ToolCallFunction `json:"function"`
+				} `json:"tool_calls"`
+				FunctionCall *ToolCallFunction `json:"function_call"`
+			} `json:"delta"`
+		} `json:"choices"`
+		Usage *struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(line[len("data: "):], &chunk); err != nil {
+		return
+	}
+	if u := chunk.Usage; u != nil && (u.PromptTokens > 0 || u.CompletionTokens > 0) {
+		r.reported = &streamUsage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens, TotalTokens: u.TotalTokens}
+	}
+	for _, choice := range chunk.Choices {
+		r.output.WriteString(choice.Delta.Content)
+		for _, call := range choice.Delta.ToolCalls {
+			r.output.WriteString(call.Function.Name)
+			r.output.WriteString(call.Function.Arguments)
+		}
+		if fn := choice.Delta.FunctionCall; fn != nil {
+			r.output.WriteString(fn.Name)
+			r.output.WriteString(fn.Arguments)
+		}
+	}
+}
+
+// usage returns the token usage of the stream. The output is counted on
+// the first call, so it must only be called once the stream has been read.
+func (r *usageReader) usage() models.TokenUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counted == nil {
+		if r.reported != nil {
+			r.counted = &models.TokenUsage{Input: r.reported.PromptTokens, Output: r.reported.CompletionTokens}
+		} else {
+			r.counted = &models.TokenUsage{Input: r.promptTokens, Output: countTokens(r.model, r.output.String())}
+		}
+	}
+	return *r.counted
+}
+
+// Close closes the upstream stream and records its usage once
+func (r *usageReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.closed.Do(func() {
+		r.service.recordUsage(r.userID, r.model, r.usage(), r.latency)
+	})
+	return err
+}
+
+// fillUsage sets the usage of a result the upstream did not report from the
+// tokens counted by reader
+func fillUsage(result *streamResult, reader io.Reader) {
+	r, ok := reader.(*usageReader)
+	if !ok || result.Usage.PromptTokens > 0 || result.Usage.CompletionTokens > 0 {
+		return
+	}
+	usage := r.usage()
+	result.Usage = streamUsage{PromptTokens: usage.Input, CompletionTokens: usage.Output, TotalTokens: usage.Input + usage.Output}
+}
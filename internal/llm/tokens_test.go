@@ -0,0 +1,131 @@
+package llm
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wordEncoder is a stand-in tokenizer with one token per word
+type wordEncoder struct{}
+
+func (wordEncoder) Encode(text string, _, _ []string) []int {
+	return make([]int, len(strings.Fields(text)))
+}
+
+// useEncoder replaces the tokenizer loader for the duration of a test
+func useEncoder(t *testing.T, load func(name string) (tokenEncoder, error)) {
+	t.Helper()
+	saved := loadEncoding
+	loadEncoding = load
+	encodings = encodingCache{}
+	t.Cleanup(func() {
+		loadEncoding = saved
+		encodings = encodingCache{}
+	})
+}
+
+func TestEncodingForModel(t *testing.T) {
+	for model, want := range map[string]string{
+		"gpt-4o":            "o200k_base",
+		"gpt-4o-mini":       "o200k_base",
+		"o3-mini":           "o200k_base",
+		"gpt-4":             "cl100k_base",
+		"gpt-3.5-turbo":     "cl100k_base",
+		"claude-3.5-sonnet": "cl100k_base",
+	} {
+		if got := encodingForModel(model); got != want {
+			t.Errorf("encodingForModel(%q) = %q, want %q", model, got, want)
+		}
+	}
+}
+
+func TestCountPromptTokens(t *testing.T) {
+	useEncoder(t, func(string) (tokenEncoder, error) { return wordEncoder{}, nil })
+
+	request := `{"messages":[
+		{"role":"system","content":"be brief"},
+		{"role":"user","name":"ann","content":[{"type":"text","text":"what is this"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]}
+	]}`
+	// 2 messages * 3 + roles 2 + "be brief" 2 + name 1+1 + "what is this" 3 + reply 3
+	if got := countPromptTokens("gpt-4o", request); got != 18 {
+		t.Errorf("countPromptTokens() = %d, want 18", got)
+	}
+	if got := countPromptTokens("gpt-4o", "not json"); got != 0 {
+		t.Errorf("countPromptTokens(invalid) = %d, want 0", got)
+	}
+}
+
+func TestCountTokensFallsBackToEstimate(t *testing.T) {
+	loads := 0
+	useEncoder(t, func(string) (tokenEncoder, error) {
+		loads++
+		return nil, errors.New("offline")
+	})
+
+	if got := countTokens("gpt-4o", "twelve bytes"); got != 3 {
+		t.Errorf("countTokens() without a tokenizer = %d, want 3", got)
+	}
+	countTokens("gpt-4o", "again")
+	if loads != 1 {
+		t.Errorf("loaded the tokenizer %d times, want 1 until the retry interval passes", loads)
+	}
+	encodings.failed["o200k_base"] = time.Now().Add(-encodingRetryInterval)
+	countTokens("gpt-4o", "again")
+	if loads != 2 {
+		t.Errorf("loaded the tokenizer %d times after the retry interval, want 2", loads)
+	}
+}
+
+func TestUsageReaderRecordsUsage(t *testing.T) {
+	useEncoder(t, func(string) (tokenEncoder, error) { return wordEncoder{}, nil })
+
+	tests := []struct {
+		name       string
+		stream     string
+		wantInput  int
+		wantOutput int
+	}{
+		{
+			"counted",
+			"data: {\"choices\":[{\"delta\":{\"content\":\"one two \"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"function\":{\"name\":\"f\",\"arguments\":\" {}\"}}]}}]}\n\n" +
+				"data: [DONE]\n\n",
+			8, 4,
+		},
+		{
+			"reported by the upstream",
+			"data: {\"choices\":[{\"delta\":{\"content\":\"one two\"}}]}\n\n" +
+				"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":11,\"completion_tokens\":22,\"total_tokens\":33}}\n\n",
+			11, 22,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{config: &Config{}, usage: newUsageLedger()}
+			reader := &usageReader{
+				ReadCloser:   io.NopCloser(strings.NewReader(tt.stream)),
+				service:      s,
+				userID:       1,
+				model:        "gpt-4o",
+				promptTokens: countPromptTokens("gpt-4o", `{"messages":[{"role":"user","content":"hi"}]}`),
+			}
+			result, err := collectStream(reader)
+			if err != nil {
+				t.Fatalf("collectStream() error = %v", err)
+			}
+			fillUsage(result, reader)
+			if result.Usage.PromptTokens != tt.wantInput || result.Usage.CompletionTokens != tt.wantOutput {
+				t.Errorf("usage = %+v, want %d prompt and %d completion tokens", result.Usage, tt.wantInput, tt.wantOutput)
+			}
+			reader.Close()
+			reader.Close()
+			usage := s.GetModelUsage(1, "gpt-4o")
+			if usage.RequestsThisMinute != 1 || usage.InputTokensThisMinute != tt.wantInput || usage.OutputTokensThisMinute != tt.wantOutput {
+				t.Errorf("recorded usage = %+v", usage)
+			}
+		})
+	}
+}
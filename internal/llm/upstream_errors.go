@@ -0,0 +1,239 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUpstreamUnavailable is returned when the Copilot API cannot be reached
+var ErrUpstreamUnavailable = errors.New("Copilot API unavailable")
+
+// UpstreamError is an error response of the Copilot API
+type UpstreamError struct {
+	// StatusCode is the HTTP status of the upstream response
+	StatusCode int
+	// Message is the upstream error message or, without one, the body
+	Message string
+	// Code is the upstream error code, if any
+	Code string
+	// RetryAfter is the upstream Retry-After header or, without one, the
+	// seconds until the rate limit reset the upstream reported
+	RetryAfter string
+	// RateLimitHeaders are the upstream x-ratelimit-* headers, if any
+	RateLimitHeaders http.Header
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("Copilot API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// newUpstreamError reads a failed upstream response into an UpstreamError.
+// The Copilot API reports errors as {"error": {"message", "code"}}, but
+// some failures come with a plain text body.
+func newUpstreamError(resp *http.Response, body []byte) *UpstreamError {
+	e := &UpstreamError{StatusCode: resp.StatusCode, RetryAfter: upstreamRetryAfter(resp.Header, time.Now())}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ratelimit-") {
+			if e.RateLimitHeaders == nil {
+				e.RateLimitHeaders = make(http.Header)
+			}
+			e.RateLimitHeaders[name] = values
+		}
+	}
+	var payload struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && len(payload.Error) > 0 {
+		var detail struct {
+			Message string      `json:"message"`
+			Code    interface{} `json:"code"`
+			Type    string      `json:"type"`
+		}
+		if err := json.Unmarshal(payload.Error, &detail); err == nil {
+			e.Message = detail.Message
+			if code, ok := detail.Code.(string); ok {
+				e.Code = code
+			} else if detail.Type != "" {
+				e.Code = detail.Type
+			}
+		} else {
+			json.Unmarshal(payload.Error, &e.Message)
+		}
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+// upstreamRetryAfter returns the Retry-After for a failed upstream response:
+// its Retry-After header or, without one, the wait until the reset given by
+// retry-after-ms, x-ratelimit-reset (a Unix time, as GitHub sends it) or the
+// later of x-ratelimit-reset-requests and x-ratelimit-reset-tokens (durations
+// such as 6m0s, as OpenAI sends them), rounded up to whole seconds
+func upstreamRetryAfter(h http.Header, now time.Time) string {
+	if v := strings.TrimSpace(h.Get("Retry-After")); v != "" {
+		return v
+	}
+	var wait time.Duration
+	if ms, err := strconv.ParseFloat(h.Get("retry-after-ms"), 64); err == nil {
+		wait = time.Duration(ms * float64(time.Millisecond))
+	} else if reset, err := strconv.ParseInt(h.Get("x-ratelimit-reset"), 10, 64); err == nil {
+		wait = time.Unix(reset, 0).Sub(now)
+	} else {
+		for _, name := range []string{"x-ratelimit-reset-requests", "x-ratelimit-reset-tokens"} {
+			if d, err := time.ParseDuration(h.Get(name)); err == nil && d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait <= 0 {
+		return ""
+	}
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// isContextLengthError reports whether an upstream error says the prompt
+// does not fit the model's context window
+func (e *UpstreamError) isContextLengthError() bool {
+	switch e.Code {
+	case "context_length_exceeded", "model_max_prompt_tokens_exceeded":
+		return true
+	}
+	msg := strings.ToLower(e.Message)
+	for _, hint := range []string{"context length", "context window", "prompt is too long", "too many tokens", "max_prompt_tokens"} {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// isContentFilterError reports whether an upstream error says the prompt or
+// the response was blocked by Copilot's content policy, e.g. the Responsible
+// AI filter or the public code filter
+func (e *UpstreamError) isContentFilterError() bool {
+	switch e.Code {
+	case "content_filter", "content_policy_violation", "responsible_ai_policy_violation", "public_code_filter":
+		return true
+	}
+	msg := strings.ToLower(e.Message)
+	for _, hint := range []string{"content filter", "content_filter", "content management policy", "responsible ai", "filtered due to", "public code"} {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// isModelUnavailableError reports whether an upstream error says the model
+// is not offered to the account: unsupported, or disabled by a policy of the
+// user or the organization
+func (e *UpstreamError) isModelUnavailableError() bool {
+	switch e.Code {
+	case "model_not_found", "model_not_supported", "model_not_enabled", "model_disabled", "unsupported_model", "unsupported_api_for_model":
+		return true
+	}
+	msg := strings.ToLower(e.Message)
+	if !strings.Contains(msg, "model") {
+		return false
+	}
+	for _, hint := range []string{"not supported", "not enabled", "disabled", "not available", "not have access", "no access"} {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// openAIError returns the HTTP status, OpenAI error type and error code a
+// client should see for an upstream error. Copilot answers prompts blocked by
+// its content policy and models the account may not use with 400 or 403;
+// they become content_filter and model_not_found, and other 403 policy
+// blocks permission_denied.
+func (e *UpstreamError) openAIError() (status int, errType, code string) {
+	clientError := e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusForbidden
+	switch {
+	case (e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusRequestEntityTooLarge) && e.isContextLengthError():
+		return http.StatusBadRequest, "invalid_request_error", "context_length_exceeded"
+	case clientError && e.isContentFilterError():
+		return http.StatusBadRequest, "invalid_request_error", "content_filter"
+	case clientError && e.isModelUnavailableError():
+		return http.StatusNotFound, "invalid_request_error", "model_not_found"
+	case e.StatusCode == http.StatusBadRequest:
+		return http.StatusBadRequest, "invalid_request_error", e.Code
+	case e.StatusCode == http.StatusUnauthorized:
+		// The client's key was accepted; it is the proxy's Copilot credentials
+		// that failed
+		return http.StatusBadGateway, "api_error", "upstream_authentication_failed"
+	case e.StatusCode == http.StatusForbidden:
+		return http.StatusForbidden, "permission_error", "permission_denied"
+	case e.StatusCode == http.StatusNotFound:
+		return http.StatusNotFound, "invalid_request_error", "model_not_found"
+	case e.StatusCode == http.StatusRequestEntityTooLarge:
+		return http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large"
+	case e.StatusCode == http.StatusTooManyRequests:
+		return http.StatusTooManyRequests, "requests", "rate_limit_exceeded"
+	case e.StatusCode == http.StatusServiceUnavailable:
+		return http.StatusServiceUnavailable, "api_error", "service_unavailable"
+	case e.StatusCode == http.StatusGatewayTimeout:
+		return http.StatusGatewayTimeout, "api_error", "upstream_timeout"
+	case e.StatusCode >= 500:
+		return http.StatusBadGateway, "api_error", "upstream_error"
+	}
+	return http.StatusBadGateway, "api_error", e.Code
+}
+
+// writeUpstreamError writes the OpenAI-style error for a failed upstream
+// request. When the upstream rate limited the proxy or is overloaded, its
+// Retry-After and x-ratelimit-* headers replace the proxy's own, so clients
+// back off for as long as the upstream asks.
+func writeUpstreamError(w http.ResponseWriter, e *UpstreamError) {
+	status, errType, code := e.openAIError()
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		if e.RetryAfter != "" {
+			w.Header().Set("Retry-After", e.RetryAfter)
+		}
+		for name, values := range e.RateLimitHeaders {
+			w.Header()[name] = values
+		}
+	}
+	writeOpenAIErrorCode(w, status, e.Error(), errType, code)
+}
+
+// transportError is an error sending a request upstream. It matches
+// ErrUpstreamUnavailable so that it is reported as a gateway error rather
+// than a bad request.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string        { return ErrUpstreamUnavailable.Error() + ": " + e.err.Error() }
+func (e *transportError) Unwrap() error        { return e.err }
+func (e *transportError) Is(target error) bool { return target == ErrUpstreamUnavailable }
+
+// wrapTransportError marks an error sending a request upstream. Requests
+// canceled by the client are left as they are.
+func wrapTransportError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+	return &transportError{err: err}
+}
+
+// isTimeout reports whether an error is a timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
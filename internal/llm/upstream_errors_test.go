@@ -0,0 +1,140 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleCompletionTranslatesUpstreamErrors(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	tests := []struct {
+		name           string
+		upstreamStatus int
+		upstreamBody   string
+		retryAfter     string
+		wantStatus     int
+		wantType       string
+		wantCode       interface{}
+	}{
+		{"context length by code", 400, `{"error":{"message":"prompt token count of 130000 exceeds the limit of 128000","code":"model_max_prompt_tokens_exceeded"}}`, "", 400, "invalid_request_error", "context_length_exceeded"},
+		{"context length by message", 413, `{"error":{"message":"This model's maximum context length is 8192 tokens"}}`, "", 400, "invalid_request_error", "context_length_exceeded"},
+		{"bad request", 400, `{"error":{"message":"invalid temperature","code":"invalid_value"}}`, "", 400, "invalid_request_error", "invalid_value"},
+		{"unauthorized", 401, `unauthorized: token expired`, "", 502, "api_error", "upstream_authentication_failed"},
+		{"model disabled by policy", 403, `{"error":{"message":"model is disabled by policy","code":"model_not_enabled"}}`, "", 404, "invalid_request_error", "model_not_found"},
+		{"model not supported", 400, `{"error":{"message":"The requested model is not supported","code":"model_not_supported"}}`, "", 404, "invalid_request_error", "model_not_found"},
+		{"content policy", 403, `{"error":{"message":"Sorry, the response was filtered by the Responsible AI Service"}}`, "", 400, "invalid_request_error", "content_filter"},
+		{"content filter code", 400, `{"error":{"message":"blocked","code":"content_filter"}}`, "", 400, "invalid_request_error", "content_filter"},
+		{"forbidden", 403, `{"error":{"message":"Copilot Chat is disabled by your organization","code":"access_denied"}}`, "", 403, "permission_error", "permission_denied"},
+		{"not found", 404, `{"error":{"message":"model not found"}}`, "", 404, "invalid_request_error", "model_not_found"},
+		{"too large", 413, `request entity too large`, "", 413, "invalid_request_error", "request_too_large"},
+		{"rate limited", 429, `{"error":{"message":"rate limited"}}`, "17", 429, "requests", "rate_limit_exceeded"},
+		{"server error", 500, `internal error`, "", 502, "api_error", "upstream_error"},
+		{"unavailable", 503, `overloaded`, "5", 503, "api_error", "service_unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.upstreamStatus)
+				w.Write([]byte(tt.upstreamBody))
+			}))
+			defer upstream.Close()
+			state := newTestServerState(upstream)
+
+			w := httptest.NewRecorder()
+			state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`)))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			var body struct {
+				Error struct {
+					Message string      `json:"message"`
+					Type    string      `json:"type"`
+					Code    interface{} `json:"code"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid error body %q: %v", w.Body.String(), err)
+			}
+			if body.Error.Type != tt.wantType || body.Error.Code != tt.wantCode {
+				t.Errorf("error = %+v, want type %q and code %v", body.Error, tt.wantType, tt.wantCode)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestHandleCompletionPassesUpstreamRateLimit(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	reset := time.Now().Add(90 * time.Second).Unix()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ratelimit-remaining", "0")
+		w.Header().Set("x-ratelimit-reset", strconv.FormatInt(reset, 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, `{"error":{"message":"rate limited"}}`)
+	}))
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+
+	w := httptest.NewRecorder()
+	state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`)))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	if got, _ := strconv.Atoi(w.Header().Get("Retry-After")); got < 85 || got > 91 {
+		t.Errorf("Retry-After = %q, want the seconds until x-ratelimit-reset", w.Header().Get("Retry-After"))
+	}
+	if w.Header().Get("x-ratelimit-remaining") != "0" || w.Header().Get("x-ratelimit-reset") != strconv.FormatInt(reset, 10) {
+		t.Errorf("rate limit headers not passed on: %v", w.Header())
+	}
+}
+
+func TestUpstreamRetryAfter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		header http.Header
+		want   string
+	}{
+		{http.Header{"Retry-After": {"17"}, "Retry-After-Ms": {"500"}}, "17"},
+		{http.Header{"Retry-After-Ms": {"1500"}}, "2"},
+		{http.Header{"X-Ratelimit-Reset": {"1700000030"}}, "30"},
+		{http.Header{"X-Ratelimit-Reset": {"1699999990"}}, ""},
+		{http.Header{"X-Ratelimit-Reset-Requests": {"1s"}, "X-Ratelimit-Reset-Tokens": {"6m0s"}}, "360"},
+		{http.Header{}, ""},
+	}
+	for _, tt := range tests {
+		if got := upstreamRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("upstreamRetryAfter(%v) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestHandleCompletionUpstreamUnreachable(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	state := newTestServerState(upstream)
+	upstream.Close()
+
+	w := httptest.NewRecorder()
+	state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`)))
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), `"code":"upstream_unavailable"`) {
+		t.Errorf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
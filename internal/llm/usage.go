@@ -0,0 +1,333 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUsageEventsUnavailable is returned when exporting from a usage store that
+// does not keep individual events
+var ErrUsageEventsUnavailable = errors.New("individual usage events are not kept by the in-memory usage store; set USAGE_STORE=sqlite")
+
+// usageRetention is how long per-minute usage buckets are kept
+const usageRetention = 31 * 24 * time.Hour
+
+// usageWindows are the named windows accepted by GET /v1/usage
+var usageWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// ModelPrice is the price of a model in USD per million tokens
+type ModelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// cost returns the estimated USD cost of the given token counts
+func (p ModelPrice) cost(inputTokens, outputTokens int) float64 {
+	return (float64(inputTokens)*p.Input + float64(outputTokens)*p.Output) / 1e6
+}
+
+// modelPricePer1K is an entry of MODEL_PRICING_FILE, in USD per 1K tokens
+type modelPricePer1K struct {
+	Input  float64 `json:"input_per_1k"`
+	Output float64 `json:"output_per_1k"`
+}
+
+// loadModelPrices reads the pricing table of MODEL_PRICING_FILE, a JSON
+// object mapping models or patterns such as "claude-*" to USD per 1K tokens,
+// e.g. {"gpt-4o": {"input_per_1k": 0.0025, "output_per_1k": 0.01}}. Entries
+// of MODEL_PRICES take precedence.
+func loadModelPrices() map[string]ModelPrice {
+	prices := make(map[string]ModelPrice)
+	if path := os.Getenv("MODEL_PRICING_FILE"); path != "" {
+		var table map[string]modelPricePer1K
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &table)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to load model prices from %s: %v", path, err)
+		}
+		for model, price := range table {
+			prices[model] = ModelPrice{Input: price.Input * 1000, Output: price.Output * 1000}
+		}
+	}
+	for model, price := range parseModelPrices(os.Getenv("MODEL_PRICES")) {
+		prices[model] = price
+	}
+	return prices
+}
+
+// priceFor returns the price of a model: its own entry, else that of the
+// longest matching pattern ending in *, so "*" prices every other model.
+// Models without a price cost nothing.
+func priceFor(prices map[string]ModelPrice, model string) ModelPrice {
+	if price, ok := prices[model]; ok {
+		return price
+	}
+	best, bestLen := ModelPrice{}, -1
+	for pattern, price := range prices {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if prefix != pattern && strings.HasPrefix(model, prefix) && len(prefix) > bestLen {
+			best, bestLen = price, len(prefix)
+		}
+	}
+	return best
+}
+
+// SetModelPrices atomically replaces the model prices
+func (c *Config) SetModelPrices(prices map[string]ModelPrice) {
+	c.pricesMu.Lock()
+	defer c.pricesMu.Unlock()
+	c.ModelPrices = prices
+}
+
+// modelPrices returns the model prices. The map is replaced rather than
+// modified, so callers may read it without holding the lock.
+func (c *Config) modelPrices() map[string]ModelPrice {
+	c.pricesMu.RLock()
+	defer c.pricesMu.RUnlock()
+	return c.ModelPrices
+}
+
+// modelPrice returns the price of a model, or of the model an alias
+// resolves to, so requests made through an alias are not free
+func (c *Config) modelPrice(model string) ModelPrice {
+	return priceFor(c.modelPrices(), c.ResolveModel(model))
+}
+
+// parseModelPrices parses MODEL_PRICES entries of the form
+// "model=input:output" (USD per million tokens). Malformed entries are skipped.
+func parseModelPrices(value string) map[string]ModelPrice {
+	prices := make(map[string]ModelPrice)
+	for model, price := range parseKeyValueList(value) {
+		parts := strings.SplitN(price, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		input, err1 := strconv.ParseFloat(parts[0], 64)
+		output, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		prices[model] = ModelPrice{Input: input, Output: output}
+	}
+	return prices
+}
+
+// usageBucketKey identifies the usage of one key and model in one minute
+type usageBucketKey struct {
+	minute int64
+	key    string
+	model  string
+}
+
+type usageBucket struct {
+	requests     int
+	inputTokens  int
+	outputTokens int
+}
+
+// usageLedger is the in-memory UsageStore. It records usage in per-minute
+// buckets so that aggregates can be computed over arbitrary recent windows,
+// and forgets everything on restart.
+type usageLedger struct {
+	mu      sync.Mutex
+	buckets map[usageBucketKey]*usageBucket
+}
+
+func newUsageLedger() *usageLedger {
+	return &usageLedger{buckets: make(map[usageBucketKey]*usageBucket)}
+}
+
+// Record adds one request with the given token usage
+func (l *usageLedger) Record(event models.UsageEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bk := usageBucketKey{minute: event.Time.Unix() / 60, key: event.Key, model: event.Model}
+	bucket, ok := l.buckets[bk]
+	if !ok {
+		bucket = &usageBucket{}
+		l.buckets[bk] = bucket
+		l.pruneLocked(event.Time)
+	}
+	bucket.requests++
+	bucket.inputTokens += event.InputTokens
+	bucket.outputTokens += event.OutputTokens
+	return nil
+}
+
+// prune drops buckets older than the retention period
+func (l *usageLedger) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(now)
+}
+
+// pruneLocked drops buckets older than the retention period
+func (l *usageLedger) pruneLocked(now time.Time) {
+	oldest := now.Add(-usageRetention).Unix() / 60
+	for bk := range l.buckets {
+		if bk.minute < oldest {
+			delete(l.buckets, bk)
+		}
+	}
+}
+
+// Aggregate sums usage since the given time per key and model. An empty key
+// includes every key. Results are sorted by key and model.
+func (l *usageLedger) Aggregate(since time.Time, key string) ([]models.UsageAggregate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	type groupKey struct{ key, model string }
+	groups := make(map[groupKey]*models.UsageAggregate)
+	first := since.Unix() / 60
+	for bk, bucket := range l.buckets {
+		if bk.minute < first || (key != "" && bk.key != key) {
+			continue
+		}
+		gk := groupKey{bk.key, bk.model}
+		agg, ok := groups[gk]
+		if !ok {
+			agg = &models.UsageAggregate{Key: bk.key, Model: bk.model}
+			groups[gk] = agg
+		}
+		agg.Requests += bucket.requests
+		agg.InputTokens += bucket.inputTokens
+		agg.OutputTokens += bucket.outputTokens
+	}
+
+	result := make([]models.UsageAggregate, 0, len(groups))
+	for _, agg := range groups {
+		agg.TotalTokens = agg.InputTokens + agg.OutputTokens
+		result = append(result, *agg)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Key != result[j].Key {
+			return result[i].Key < result[j].Key
+		}
+		return result[i].Model < result[j].Model
+	})
+	return result, nil
+}
+
+// Events is not supported: the ledger only keeps per-minute totals
+func (l *usageLedger) Events(since, until time.Time, key string, fn func(models.UsageEvent) error) error {
+	return ErrUsageEventsUnavailable
+}
+
+// Close implements UsageStore; the in-memory ledger holds no resources
+func (l *usageLedger) Close() error {
+	return nil
+}
+
+// applyPrices fills in the estimated cost of each aggregate
+func (c *Config) applyPrices(aggregates []models.UsageAggregate) {
+	for i := range aggregates {
+		agg := &aggregates[i]
+		agg.EstimatedCostUSD = c.modelPrice(agg.Model).cost(agg.InputTokens, agg.OutputTokens)
+	}
+}
+
+// usageKeyForUser returns the usage key of a user
+func usageKeyForUser(userID uint64) string {
+	return strconv.FormatUint(userID, 10)
+}
+
+// UsageStats returns usage aggregates since the given time, priced with the
+// configured model prices. An empty key includes every key.
+func (s *Service) UsageStats(since time.Time, key string) ([]models.UsageAggregate, error) {
+	if s.usage == nil {
+		return []models.UsageAggregate{}, nil
+	}
+	aggregates, err := s.usage.Aggregate(since, key)
+	if err != nil {
+		return nil, err
+	}
+	s.config.applyPrices(aggregates)
+	return aggregates, nil
+}
+
+// HandleUsage serves GET /v1/usage with per-key and per-model aggregates and
+// the upstream latency and error rate per model. The window query parameter
+// selects 1h, 24h (default), 7d, 30d or any Go duration. Staff tokens see
+// every key and may filter with the key parameter; other callers only see
+// their own usage. The model metrics cover the calls of all keys.
+func (s *ServerState) HandleUsage(w http.ResponseWriter, r *http.Request) {
+	token, err := s.validateToken(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "24h"
+	}
+	duration, ok := usageWindows[window]
+	if !ok {
+		duration, err = time.ParseDuration(window)
+		if err != nil || duration <= 0 {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid window: "+window, "invalid_request_error")
+			return
+		}
+	}
+
+	key := usageKeyForUser(token.UserID)
+	if token.IsStaff {
+		key = r.URL.Query().Get("key")
+	}
+
+	end := time.Now()
+	start := end.Add(-duration)
+	data, err := s.Service.UsageStats(start, key)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "failed to read usage: "+err.Error(), "internal_error")
+		return
+	}
+
+	totals := models.UsageAggregate{}
+	for _, agg := range data {
+		totals.Requests += agg.Requests
+		totals.InputTokens += agg.InputTokens
+		totals.OutputTokens += agg.OutputTokens
+		totals.TotalTokens += agg.TotalTokens
+		totals.EstimatedCostUSD += agg.EstimatedCostUSD
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "usage",
+		"window": window,
+		"start":  start.Unix(),
+		"end":    end.Unix(),
+		"data":   data,
+		"models": s.Service.ModelMetrics(start),
+		"totals": map[string]interface{}{
+			"requests":           totals.Requests,
+			"input_tokens":       totals.InputTokens,
+			"output_tokens":      totals.OutputTokens,
+			"total_tokens":       totals.TotalTokens,
+			"estimated_cost_usd": totals.EstimatedCostUSD,
+		},
+	})
+}
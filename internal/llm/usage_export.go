@@ -0,0 +1,150 @@
+package llm
+
+import (
+	"bufio"
+	"copilot-proxy/pkg/models"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Usage export formats
+const (
+	UsageExportCSV   = "csv"
+	UsageExportJSONL = "jsonl"
+)
+
+// usageCSVHeader is the header row of CSV usage exports
+var usageCSVHeader = []string{"timestamp", "key", "model", "input_tokens", "output_tokens", "total_tokens", "latency_ms", "estimated_cost_usd"}
+
+// ExportUsage writes the usage events recorded in [since, until) to w as CSV
+// or JSON Lines. An empty key exports every key.
+func ExportUsage(w io.Writer, store UsageStore, format string, since, until time.Time, key string) error {
+	switch format {
+	case UsageExportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(usageCSVHeader); err != nil {
+			return err
+		}
+		err := store.Events(since, until, key, func(event models.UsageEvent) error {
+			return cw.Write([]string{
+				event.Time.UTC().Format(time.RFC3339Nano),
+				event.Key,
+				event.Model,
+				strconv.Itoa(event.InputTokens),
+				strconv.Itoa(event.OutputTokens),
+				strconv.Itoa(event.InputTokens + event.OutputTokens),
+				strconv.FormatInt(event.LatencyMs, 10),
+				strconv.FormatFloat(event.EstimatedCostUSD, 'f', -1, 64),
+			})
+		})
+		if err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
+	case UsageExportJSONL:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		err := store.Events(since, until, key, func(event models.UsageEvent) error {
+			event.Time = event.Time.UTC()
+			return enc.Encode(event)
+		})
+		if err != nil {
+			return err
+		}
+		return bw.Flush()
+	default:
+		return fmt.Errorf("unsupported usage export format %q (want csv or jsonl)", format)
+	}
+}
+
+// ParseUsageTime parses an export bound given as RFC 3339 or as a UTC date
+// such as 2024-05-01. An empty value returns the zero time.
+func ParseUsageTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: use RFC 3339 or YYYY-MM-DD", value)
+	}
+	return t, nil
+}
+
+// HandleUsageExport serves the admin usage export. The format query parameter
+// selects csv (default) or jsonl; since and until bound the export and key
+// restricts it to one API key. Callers must protect it with the admin token.
+func (s *ServerState) HandleUsageExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed", "invalid_request_error")
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = UsageExportCSV
+	}
+	contentType := map[string]string{
+		UsageExportCSV:   "text/csv",
+		UsageExportJSONL: "application/x-ndjson",
+	}[format]
+	if contentType == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "unsupported format: "+format, "invalid_request_error")
+		return
+	}
+	since, err := ParseUsageTime(query.Get("since"))
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	until := time.Now()
+	if value := query.Get("until"); value != "" {
+		if until, err = ParseUsageTime(value); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+			return
+		}
+	}
+	if s.Service.usage == nil {
+		writeOpenAIError(w, http.StatusNotFound, "usage accounting is disabled", "invalid_request_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s.%s"`, until.UTC().Format("20060102"), format))
+	out := &countingWriter{w: w}
+	if err := ExportUsage(out, s.Service.usage, format, since, until, query.Get("key")); err != nil {
+		if out.n > 0 {
+			// The response has started; a truncated body is all we can signal
+			log.Printf("Usage export failed after %d bytes: %v", out.n, err)
+			return
+		}
+		w.Header().Del("Content-Disposition")
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrUsageEventsUnavailable) {
+			status = http.StatusNotImplemented
+		}
+		writeOpenAIError(w, status, err.Error(), "internal_error")
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,156 @@
+package llm
+
+import (
+	"bytes"
+	"copilot-proxy/pkg/models"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newExportTestStore returns a SQLite usage store with three recorded events
+func newExportTestStore(t *testing.T) UsageStore {
+	t.Helper()
+	store, err := NewSQLiteUsageStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteUsageStore() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, event := range []models.UsageEvent{
+		{Key: "1", Model: "gpt-4o", InputTokens: 10, OutputTokens: 5, LatencyMs: 120, EstimatedCostUSD: 0.000075},
+		{Key: "2", Model: "gpt-4o", InputTokens: 20, OutputTokens: 10, LatencyMs: 80},
+		{Key: "1", Model: "claude-3.5-sonnet", InputTokens: 30, OutputTokens: 15, LatencyMs: 200},
+	} {
+		event.Time = base.Add(time.Duration(i) * time.Hour)
+		if err := store.Record(event); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+	return store
+}
+
+func TestExportUsageCSV(t *testing.T) {
+	store := newExportTestStore(t)
+	var buf bytes.Buffer
+	since := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	if err := ExportUsage(&buf, store, UsageExportCSV, since, until, "1"); err != nil {
+		t.Fatalf("ExportUsage() error = %v", err)
+	}
+	want := "timestamp,key,model,input_tokens,output_tokens,total_tokens,latency_ms,estimated_cost_usd\n" +
+		"2024-05-01T12:00:00Z,1,gpt-4o,10,5,15,120,0.000075\n"
+	if buf.String() != want {
+		t.Errorf("ExportUsage() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestExportUsageJSONL(t *testing.T) {
+	store := newExportTestStore(t)
+	var buf bytes.Buffer
+	if err := ExportUsage(&buf, store, UsageExportJSONL, time.Time{}, time.Now(), ""); err != nil {
+		t.Fatalf("ExportUsage() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3: %s", len(lines), buf.String())
+	}
+	var last models.UsageEvent
+	if err := json.Unmarshal([]byte(lines[2]), &last); err != nil {
+		t.Fatalf("invalid JSON line: %v", err)
+	}
+	if last.Model != "claude-3.5-sonnet" || last.LatencyMs != 200 || !last.Time.Equal(time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("last event = %+v", last)
+	}
+}
+
+func TestExportUsageFromMemoryStore(t *testing.T) {
+	err := ExportUsage(&bytes.Buffer{}, newUsageLedger(), UsageExportCSV, time.Time{}, time.Now(), "")
+	if err != ErrUsageEventsUnavailable {
+		t.Errorf("ExportUsage() error = %v, want ErrUsageEventsUnavailable", err)
+	}
+}
+
+func TestParseUsageTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", time.Time{}, false},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2024-05-01T10:30:00Z", time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC), false},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseUsageTime(tt.value)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("ParseUsageTime(%q) = %v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestHandleUsageExport(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      UsageStore
+		query      string
+		wantStatus int
+		wantType   string
+		wantLines  int
+	}{
+		{"csv", newExportTestStore(t), "?since=2024-05-01", http.StatusOK, "text/csv", 4},
+		{"jsonl for key", newExportTestStore(t), "?format=jsonl&key=2", http.StatusOK, "application/x-ndjson", 1},
+		{"bad format", newExportTestStore(t), "?format=xml", http.StatusBadRequest, "application/json", 0},
+		{"bad bound", newExportTestStore(t), "?until=soon", http.StatusBadRequest, "application/json", 0},
+		{"memory store", newUsageLedger(), "", http.StatusNotImplemented, "application/json", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &ServerState{Service: &Service{config: &Config{}, usage: tt.store}}
+			w := httptest.NewRecorder()
+			state.HandleUsageExport(w, httptest.NewRequest("GET", "/admin/usage/export"+tt.query, nil))
+			if w.Code != tt.wantStatus || w.Header().Get("Content-Type") != tt.wantType {
+				t.Fatalf("status = %d, Content-Type = %q, want %d %q: %s", w.Code, w.Header().Get("Content-Type"), tt.wantStatus, tt.wantType, w.Body.String())
+			}
+			if tt.wantLines > 0 {
+				if lines := strings.Count(w.Body.String(), "\n"); lines != tt.wantLines {
+					t.Errorf("got %d lines, want %d: %s", lines, tt.wantLines, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestSQLiteUsageStoreMigratesExistingDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A database created before latency was recorded
+	if _, err := db.Exec(usageMigrations[0] + `PRAGMA user_version = 1;
+		INSERT INTO usage_events (created_at, usage_key, model, input_tokens, output_tokens) VALUES (1714564800000, '1', 'gpt-4o', 1, 2);`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := NewSQLiteUsageStore(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteUsageStore() error = %v", err)
+	}
+	defer store.Close()
+	var events []models.UsageEvent
+	err = store.Events(time.Time{}, time.Now(), "", func(event models.UsageEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil || len(events) != 1 || events[0].LatencyMs != 0 || events[0].OutputTokens != 2 {
+		t.Errorf("Events() = %+v, %v", events, err)
+	}
+}
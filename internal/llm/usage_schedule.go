@@ -0,0 +1,83 @@
+package llm
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// loadUsageTimezone reads USAGE_TIMEZONE, the IANA time zone such as
+// "Europe/Berlin" whose midnight starts the daily and monthly usage windows.
+// It defaults to UTC.
+func loadUsageTimezone() *time.Location {
+	name := os.Getenv("USAGE_TIMEZONE")
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Warning: invalid USAGE_TIMEZONE %q, using UTC: %v", name, err)
+		return time.UTC
+	}
+	return loc
+}
+
+// usageLocation returns the time zone of the daily and monthly usage windows
+func (c *Config) usageLocation() *time.Location {
+	if c.UsageTimezone == nil {
+		return time.UTC
+	}
+	return c.UsageTimezone
+}
+
+// startOfDay returns midnight of the day containing t in the usage time zone
+func (c *Config) startOfDay(t time.Time) time.Time {
+	y, m, d := t.In(c.usageLocation()).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, c.usageLocation())
+}
+
+// startOfMonth returns midnight on the first day of the month containing t in
+// the usage time zone
+func (c *Config) startOfMonth(t time.Time) time.Time {
+	y, m, _ := t.In(c.usageLocation()).Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, c.usageLocation())
+}
+
+// rollUsageWindows expires the state of the usage windows that ended between
+// last and now: usage buckets past retention, keys no longer active and the
+// token buckets of idle keys, which are full again and recreated on their
+// next request. Day and month boundaries are logged.
+func (s *Service) rollUsageWindows(last, now time.Time) {
+	if ledger, ok := s.usage.(*usageLedger); ok {
+		ledger.prune(now)
+	}
+	s.activeUsers.count(now, s.config.ActiveUserWindow)
+	s.limiter.prune(now)
+
+	if day := s.config.startOfDay(now); last.Before(day) {
+		if month := s.config.startOfMonth(now); last.Before(month) {
+			log.Printf("Monthly usage window rolled over to %s", month.Format("2006-01"))
+		}
+		log.Printf("Daily usage window rolled over to %s", day.Format("2006-01-02 MST"))
+	}
+}
+
+// StartUsageWindowScheduler rolls the usage windows at the start of every
+// minute until ctx is canceled.
+func (s *Service) StartUsageWindowScheduler(ctx context.Context) {
+	go func() {
+		last := time.Now()
+		for {
+			timer := time.NewTimer(last.Truncate(time.Minute).Add(time.Minute).Sub(last))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case now := <-timer.C:
+				s.rollUsageWindows(last, now)
+				last = now
+			}
+		}
+	}()
+}
@@ -0,0 +1,56 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"testing"
+	"time"
+)
+
+func TestUsageWindowsTimezone(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	c := &Config{UsageTimezone: berlin}
+	// 23:30 UTC on January 31st is already February 1st in Berlin
+	now := time.Date(2025, 1, 31, 23, 30, 0, 0, time.UTC)
+	if got, want := c.startOfDay(now), time.Date(2025, 1, 31, 23, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("startOfDay() = %v, want %v", got, want)
+	}
+	if got, want := c.startOfMonth(now), time.Date(2025, 1, 31, 23, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("startOfMonth() = %v, want %v", got, want)
+	}
+	if got, want := (&Config{}).startOfDay(now), time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("UTC startOfDay() = %v, want %v", got, want)
+	}
+
+	t.Setenv("USAGE_TIMEZONE", "Mars/Olympus_Mons")
+	if loc := loadUsageTimezone(); loc != time.UTC {
+		t.Errorf("invalid USAGE_TIMEZONE = %v, want UTC", loc)
+	}
+}
+
+func TestRollUsageWindows(t *testing.T) {
+	ledger := newUsageLedger()
+	s := &Service{config: &Config{}, usage: ledger}
+	now := time.Now()
+	ledger.buckets[usageBucketKey{minute: now.Add(-usageRetention-time.Hour).Unix() / 60, key: "1", model: "gpt-4o"}] = &usageBucket{requests: 1}
+	ledger.Record(models.UsageEvent{Time: now, Key: "1", Model: "gpt-4o", InputTokens: 10})
+	s.activeUsers.touch(1, now.Add(-time.Hour))
+	s.limiter.record("idle", RateLimit{RequestsPerMinute: 10}, models.TokenUsage{}, now.Add(-time.Hour))
+	s.limiter.record("busy", RateLimit{RequestsPerMinute: 10}, models.TokenUsage{}, now)
+
+	s.rollUsageWindows(now.Add(-time.Minute), now)
+	if len(ledger.buckets) != 1 {
+		t.Errorf("ledger keeps %d buckets, want 1", len(ledger.buckets))
+	}
+	if len(s.activeUsers.lastSeen) != 0 {
+		t.Errorf("active users = %v, want none", s.activeUsers.lastSeen)
+	}
+	if _, ok := s.limiter.buckets["idle"]; ok {
+		t.Error("full buckets of an idle key were kept")
+	}
+	if _, ok := s.limiter.buckets["busy"]; !ok {
+		t.Error("buckets of a busy key were dropped")
+	}
+}
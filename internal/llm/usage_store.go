@@ -0,0 +1,196 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	// Registers the "sqlite3" database/sql driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// UsageStore records usage events and answers aggregate queries over them.
+// Implementations must be safe for concurrent use.
+type UsageStore interface {
+	// Record stores a single completion request
+	Record(event models.UsageEvent) error
+	// Aggregate sums usage since the given time per key and model, sorted by
+	// key and model. An empty key includes every key. Costs are left unset.
+	Aggregate(since time.Time, key string) ([]models.UsageAggregate, error)
+	// Events calls fn for each event recorded in [since, until) in time order.
+	// An empty key includes every key.
+	Events(since, until time.Time, key string, fn func(models.UsageEvent) error) error
+	// Close releases the store's resources
+	Close() error
+}
+
+// OpenUsageStore opens the usage store selected by the configuration. The
+// default is a SQLite database so that usage and spending survive restarts;
+// USAGE_STORE=memory keeps usage in memory only.
+func OpenUsageStore(c *Config) (UsageStore, error) {
+	switch c.UsageStore {
+	case "memory":
+		return newUsageLedger(), nil
+	case "", "sqlite":
+		path := c.UsageDBPath
+		if path == "" {
+			var err error
+			if path, err = defaultUsageDBPath(); err != nil {
+				return nil, err
+			}
+		}
+		return NewSQLiteUsageStore(path)
+	default:
+		return nil, fmt.Errorf("unknown usage store %q", c.UsageStore)
+	}
+}
+
+// defaultUsageDBPath returns usage.db in the user's configuration directory
+func defaultUsageDBPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate usage database directory: %w", err)
+	}
+	return filepath.Join(dir, "copilot-proxy", "usage.db"), nil
+}
+
+// usageMigrations upgrade the usage database schema. The database's
+// user_version records how many of them have been applied.
+var usageMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS usage_events (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at    INTEGER NOT NULL,
+		usage_key     TEXT    NOT NULL,
+		model         TEXT    NOT NULL,
+		input_tokens  INTEGER NOT NULL,
+		output_tokens INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS usage_events_created_at ON usage_events (created_at);
+	CREATE INDEX IF NOT EXISTS usage_events_key_created_at ON usage_events (usage_key, created_at);`,
+	`ALTER TABLE usage_events ADD COLUMN latency_ms INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE usage_events ADD COLUMN cost_usd REAL NOT NULL DEFAULT 0;`,
+}
+
+// migrateUsageDB applies the migrations the database has not seen yet
+func migrateUsageDB(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(usageMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(usageMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteUsageStore persists every usage event in a SQLite database
+type sqliteUsageStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteUsageStore opens or creates the SQLite usage database at path
+func NewSQLiteUsageStore(path string) (UsageStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create usage database directory: %w", err)
+	}
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage database: %w", err)
+	}
+	// A single connection serializes writers instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if err := migrateUsageDB(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize usage database: %w", err)
+	}
+	return &sqliteUsageStore{db: db}, nil
+}
+
+// Record inserts a usage event
+func (s *sqliteUsageStore) Record(event models.UsageEvent) error {
+	_, err := s.db.Exec(
+		`INSERT INTO usage_events (created_at, usage_key, model, input_tokens, output_tokens, latency_ms, cost_usd) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		event.Time.UnixMilli(), event.Key, event.Model, event.InputTokens, event.OutputTokens, event.LatencyMs, event.EstimatedCostUSD,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	return nil
+}
+
+// Aggregate sums usage events since the given time per key and model
+func (s *sqliteUsageStore) Aggregate(since time.Time, key string) ([]models.UsageAggregate, error) {
+	rows, err := s.db.Query(
+		`SELECT usage_key, model, COUNT(*), SUM(input_tokens), SUM(output_tokens)
+		FROM usage_events
+		WHERE created_at >= ? AND (? = '' OR usage_key = ?)
+		GROUP BY usage_key, model
+		ORDER BY usage_key, model`,
+		since.UnixMilli(), key, key,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	result := []models.UsageAggregate{}
+	for rows.Next() {
+		var agg models.UsageAggregate
+		if err := rows.Scan(&agg.Key, &agg.Model, &agg.Requests, &agg.InputTokens, &agg.OutputTokens); err != nil {
+			return nil, fmt.Errorf("failed to read usage: %w", err)
+		}
+		agg.TotalTokens = agg.InputTokens + agg.OutputTokens
+		result = append(result, agg)
+	}
+	return result, rows.Err()
+}
+
+// Events streams the recorded events in [since, until) in time order
+func (s *sqliteUsageStore) Events(since, until time.Time, key string, fn func(models.UsageEvent) error) error {
+	rows, err := s.db.Query(
+		`SELECT created_at, usage_key, model, input_tokens, output_tokens, latency_ms, cost_usd
+		FROM usage_events
+		WHERE created_at >= ? AND created_at < ? AND (? = '' OR usage_key = ?)
+		ORDER BY created_at, id`,
+		since.UnixMilli(), until.UnixMilli(), key, key,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event models.UsageEvent
+		var createdAt int64
+		if err := rows.Scan(&createdAt, &event.Key, &event.Model, &event.InputTokens, &event.OutputTokens, &event.LatencyMs, &event.EstimatedCostUSD); err != nil {
+			return fmt.Errorf("failed to read usage: %w", err)
+		}
+		event.Time = time.UnixMilli(createdAt).UTC()
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Close closes the database
+func (s *sqliteUsageStore) Close() error {
+	return s.db.Close()
+}
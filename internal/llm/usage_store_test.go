@@ -0,0 +1,103 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLiteUsageStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "usage.db")
+	store, err := NewSQLiteUsageStore(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteUsageStore() error = %v", err)
+	}
+	store.Record(models.UsageEvent{Time: time.Now(), Key: "1", Model: "gpt-4o", InputTokens: 10, OutputTokens: 5})
+	store.Close()
+
+	reopened, err := NewSQLiteUsageStore(path)
+	if err != nil {
+		t.Fatalf("reopening usage store: %v", err)
+	}
+	defer reopened.Close()
+	got, err := reopened.Aggregate(time.Now().Add(-time.Hour), "")
+	if err != nil || len(got) != 1 || got[0].TotalTokens != 15 {
+		t.Errorf("Aggregate() after reopen = %+v, %v, want the recorded event", got, err)
+	}
+}
+
+func TestOpenUsageStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{"memory", &Config{UsageStore: "memory"}, false},
+		{"sqlite", &Config{UsageStore: "sqlite", UsageDBPath: filepath.Join(t.TempDir(), "usage.db")}, false},
+		{"default is sqlite", &Config{UsageDBPath: filepath.Join(t.TempDir(), "usage.db")}, false},
+		{"unknown", &Config{UsageStore: "redis"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := OpenUsageStore(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OpenUsageStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if store != nil {
+				store.Close()
+			}
+		})
+	}
+}
+
+func TestGetModelUsageWindows(t *testing.T) {
+	store := newUsageLedger()
+	s := &Service{config: &Config{}, usage: store}
+	now := time.Now()
+	// Outside the current minute, and inside the current day unless it just began
+	earlier := now.Add(-2 * time.Minute)
+	store.Record(models.UsageEvent{Time: earlier, Key: "1", Model: "gpt-4o", InputTokens: 1000, OutputTokens: 1000})
+	store.Record(models.UsageEvent{Time: now.Add(-48 * time.Hour), Key: "1", Model: "gpt-4o", InputTokens: 5000})
+	s.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 30, Output: 20})
+	s.RecordUsage(1, "claude-3.5-sonnet", models.TokenUsage{Input: 7})
+
+	got := s.GetModelUsage(1, "gpt-4o")
+	if got.RequestsThisMinute != 1 || got.TokensThisMinute != 50 || got.InputTokensThisMinute != 30 || got.OutputTokensThisMinute != 20 {
+		t.Errorf("GetModelUsage() minute window = %+v", got)
+	}
+	wantDay := 50
+	if !earlier.Before(s.config.startOfDay(now)) {
+		wantDay += 2000
+	}
+	if got.TokensThisDay != wantDay {
+		t.Errorf("GetModelUsage() TokensThisDay = %d, want %d", got.TokensThisDay, wantDay)
+	}
+}
+
+func TestHandleCompletionRejectsExhaustedBudget(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	upstream := newSSEUpstream(t, `{"choices":[{"delta":{"content":"hi"}}]}`)
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	state.Service.config.ModelPrices = map[string]ModelPrice{"test-model": {Input: 1000, Output: 0}}
+
+	// 100000 input tokens at $1000 per million tokens is $100, the default allowance
+	state.Service.RecordUsage(1, "test-model", models.TokenUsage{Input: 100000})
+	if got := state.Service.CurrentSpending(1); got != 10000 {
+		t.Fatalf("CurrentSpending() = %d, want 10000", got)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`))
+	state.HandleCompletion(w, req)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `"insufficient_quota"`) {
+		t.Errorf("status = %d, body = %s, want 429 insufficient_quota", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,210 @@
+package llm
+
+import (
+	"copilot-proxy/pkg/models"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseModelPrices(t *testing.T) {
+	prices := parseModelPrices("gpt-4o=2.5:10, claude-3.5-sonnet=3:15,bad=1,worse=a:b")
+	if len(prices) != 2 {
+		t.Fatalf("parseModelPrices() = %v, want 2 entries", prices)
+	}
+	if p := prices["gpt-4o"]; p.Input != 2.5 || p.Output != 10 {
+		t.Errorf("gpt-4o price = %+v", p)
+	}
+}
+
+func TestLoadModelPrices(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pricing.json")
+	os.WriteFile(path, []byte(`{"gpt-4o": {"input_per_1k": 0.0025, "output_per_1k": 0.01}, "claude-*": {"input_per_1k": 0.003, "output_per_1k": 0.015}}`), 0o600)
+	t.Setenv("MODEL_PRICING_FILE", path)
+	t.Setenv("MODEL_PRICES", "gpt-4o=5:20")
+
+	prices := loadModelPrices()
+	if p := prices["claude-*"]; math.Abs(p.Input-3) > 1e-9 || math.Abs(p.Output-15) > 1e-9 {
+		t.Errorf("claude-* price = %+v, want 3:15 per million tokens", p)
+	}
+	if p := prices["gpt-4o"]; p.Input != 5 || p.Output != 20 {
+		t.Errorf("gpt-4o price = %+v, want MODEL_PRICES to take precedence", p)
+	}
+
+	t.Setenv("MODEL_PRICING_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	if prices := loadModelPrices(); len(prices) != 1 {
+		t.Errorf("loadModelPrices() with a missing file = %v, want MODEL_PRICES only", prices)
+	}
+}
+
+func TestPriceFor(t *testing.T) {
+	prices := map[string]ModelPrice{
+		"gpt-4o":            {Input: 1},
+		"claude-*":          {Input: 2},
+		"claude-3.5-*":      {Input: 3},
+		"*":                 {Input: 4},
+		"claude-3.5-sonnet": {Input: 5},
+	}
+	tests := map[string]float64{
+		"gpt-4o":            1,
+		"claude-3-opus":     2,
+		"claude-3.5-haiku":  3,
+		"o1":                4,
+		"claude-3.5-sonnet": 5,
+	}
+	for model, want := range tests {
+		if got := priceFor(prices, model).Input; got != want {
+			t.Errorf("priceFor(%s) = %v, want %v", model, got, want)
+		}
+	}
+	if got := priceFor(map[string]ModelPrice{"gpt-4o": {Input: 1}}, "o1"); got != (ModelPrice{}) {
+		t.Errorf("priceFor(unpriced) = %+v, want zero", got)
+	}
+}
+
+func TestUsageStoreAggregate(t *testing.T) {
+	sqliteStore, err := NewSQLiteUsageStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteUsageStore() error = %v", err)
+	}
+	defer sqliteStore.Close()
+
+	stores := []struct {
+		name  string
+		store UsageStore
+	}{
+		{"memory", newUsageLedger()},
+		{"sqlite", sqliteStore},
+	}
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			record := func(at time.Time, key, model string, input, output int) {
+				err := tt.store.Record(models.UsageEvent{Time: at, Key: key, Model: model, InputTokens: input, OutputTokens: output})
+				if err != nil {
+					t.Fatalf("Record() error = %v", err)
+				}
+			}
+			record(now.Add(-2*time.Hour), "1", "gpt-4o", 100, 50)
+			record(now.Add(-10*time.Minute), "1", "gpt-4o", 200, 100)
+			record(now, "1", "claude-3.5-sonnet", 10, 10)
+			record(now, "2", "gpt-4o", 1, 1)
+
+			lastHour, err := tt.store.Aggregate(now.Add(-time.Hour), "")
+			if err != nil || len(lastHour) != 3 {
+				t.Fatalf("Aggregate(1h) = %+v, %v, want 3 groups", lastHour, err)
+			}
+			second := lastHour[1] // sorted: 1/claude, 1/gpt-4o, 2/gpt-4o
+			if second.Key != "1" || second.Model != "gpt-4o" || second.Requests != 1 || second.TotalTokens != 300 {
+				t.Errorf("Aggregate(1h)[1] = %+v", second)
+			}
+
+			day, err := tt.store.Aggregate(now.Add(-24*time.Hour), "1")
+			if err != nil || len(day) != 2 {
+				t.Fatalf("Aggregate(24h, key 1) = %+v, %v, want 2 groups", day, err)
+			}
+			if day[1].Requests != 2 || day[1].InputTokens != 300 || day[1].OutputTokens != 150 {
+				t.Errorf("Aggregate(24h)[1] = %+v", day[1])
+			}
+		})
+	}
+}
+
+func TestApplyPrices(t *testing.T) {
+	aggregates := []models.UsageAggregate{
+		{Model: "gpt-4o", InputTokens: 200, OutputTokens: 100},
+		{Model: "unpriced", InputTokens: 200, OutputTokens: 100},
+		{Model: "fast", InputTokens: 200, OutputTokens: 100},
+	}
+	c := &Config{
+		ModelPrices:  map[string]ModelPrice{"gpt-4o": {Input: 2.5, Output: 10}},
+		ModelAliases: map[string]string{"fast": "gpt-4o"},
+	}
+	c.applyPrices(aggregates)
+	if want := (200*2.5 + 100*10) / 1e6; math.Abs(aggregates[0].EstimatedCostUSD-want) > 1e-12 {
+		t.Errorf("EstimatedCostUSD = %v, want %v", aggregates[0].EstimatedCostUSD, want)
+	}
+	if aggregates[1].EstimatedCostUSD != 0 {
+		t.Errorf("unpriced EstimatedCostUSD = %v, want 0", aggregates[1].EstimatedCostUSD)
+	}
+	// Aliases are priced as the model they resolve to
+	if aggregates[2].EstimatedCostUSD != aggregates[0].EstimatedCostUSD {
+		t.Errorf("aliased EstimatedCostUSD = %v, want %v", aggregates[2].EstimatedCostUSD, aggregates[0].EstimatedCostUSD)
+	}
+}
+
+func TestAliasedRequestsArePriced(t *testing.T) {
+	s := &Service{config: &Config{
+		ModelPrices:  map[string]ModelPrice{"gpt-4o": {Input: 2, Output: 8}},
+		ModelAliases: map[string]string{"fast": "gpt-4o"},
+	}, usage: newUsageLedger()}
+	s.RecordUsage(1, "fast", models.TokenUsage{Input: 1000000})
+	if got := s.CurrentSpending(1); got != 200 {
+		t.Errorf("CurrentSpending() after a request through an alias = %d, want 200", got)
+	}
+}
+
+func TestUsageLedgerPrunesOldBuckets(t *testing.T) {
+	l := newUsageLedger()
+	now := time.Now()
+	l.Record(models.UsageEvent{Time: now.Add(-usageRetention - time.Hour), Key: "1", Model: "gpt-4o", InputTokens: 1})
+	l.Record(models.UsageEvent{Time: now, Key: "1", Model: "gpt-4o", InputTokens: 1})
+	if len(l.buckets) != 1 {
+		t.Errorf("buckets = %d, want expired bucket pruned", len(l.buckets))
+	}
+}
+
+func TestHandleUsage(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	state := &ServerState{Service: &Service{
+		config: &Config{ModelPrices: map[string]ModelPrice{"gpt-4o": {Input: 1, Output: 1}}},
+		usage:  newUsageLedger(),
+	}}
+	state.Service.RecordUsage(1, "gpt-4o", models.TokenUsage{Input: 600000, Output: 400000})
+	state.Service.RecordUsage(2, "gpt-4o", models.TokenUsage{Input: 1, Output: 1})
+
+	tests := []struct {
+		name         string
+		query        string
+		wantStatus   int
+		wantGroups   int
+		wantRequests int
+	}{
+		{"default window", "", http.StatusOK, 2, 2},
+		{"filtered by key", "?window=1h&key=1", http.StatusOK, 1, 1},
+		{"duration window", "?window=90m", http.StatusOK, 2, 2},
+		{"invalid window", "?window=forever", http.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			state.HandleUsage(w, httptest.NewRequest("GET", "/v1/usage"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var body struct {
+				Data   []models.UsageAggregate `json:"data"`
+				Totals struct {
+					Requests         int     `json:"requests"`
+					EstimatedCostUSD float64 `json:"estimated_cost_usd"`
+				} `json:"totals"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid JSON: %v", err)
+			}
+			if len(body.Data) != tt.wantGroups || body.Totals.Requests != tt.wantRequests {
+				t.Errorf("data = %+v, totals = %+v", body.Data, body.Totals)
+			}
+		})
+	}
+}
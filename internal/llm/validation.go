@@ -0,0 +1,318 @@
+package llm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// validationError names the parameter of a request that does not match the
+// OpenAI schema
+type validationError struct {
+	param   string
+	message string
+}
+
+func (e *validationError) Error() string {
+	return e.message
+}
+
+// invalidParam returns a validationError for param
+func invalidParam(param, format string, args ...interface{}) *validationError {
+	return &validationError{param: param, message: fmt.Sprintf(format, args...)}
+}
+
+// messageRoles are the roles of chat messages
+var messageRoles = map[string]bool{
+	"system": true, "developer": true, "user": true, "assistant": true, "tool": true, "function": true,
+}
+
+// contentPartTypes are the types of the parts of an array message content
+var contentPartTypes = map[string]bool{
+	"text": true, "image_url": true, "input_audio": true, "file": true, "refusal": true,
+}
+
+// responseFormatTypes are the types of response_format
+var responseFormatTypes = map[string]bool{
+	"text": true, "json_object": true, "json_schema": true,
+}
+
+// numberRanges are the bounds of the numeric parameters of a chat request
+var numberRanges = []struct {
+	param    string
+	min, max float64
+	integer  bool
+}{
+	{"temperature", 0, 2, false},
+	{"top_p", 0, 1, false},
+	{"presence_penalty", -2, 2, false},
+	{"frequency_penalty", -2, 2, false},
+	{"n", 1, 128, true},
+	{"max_tokens", 1, math.MaxInt32, true},
+	{"max_completion_tokens", 1, math.MaxInt32, true},
+	{"top_logprobs", 0, 20, true},
+}
+
+// validateChatRequest checks a decoded chat completion request against the
+// OpenAI schema: the types of the messages, their roles and the ranges of
+// the sampling parameters. Unknown parameters are left to the upstream.
+func validateChatRequest(request map[string]interface{}) *validationError {
+	model, ok := request["model"]
+	if !ok {
+		return invalidParam("model", "you must provide a model parameter")
+	}
+	if name, ok := model.(string); !ok || strings.TrimSpace(name) == "" {
+		return invalidParam("model", "model must be a non-empty string")
+	}
+
+	messages, ok := request["messages"].([]interface{})
+	if !ok {
+		if _, present := request["messages"]; !present {
+			return invalidParam("messages", "you must provide a messages parameter")
+		}
+		return invalidParam("messages", "messages must be an array")
+	}
+	if len(messages) == 0 {
+		return invalidParam("messages", "messages must contain at least one message")
+	}
+	for i, m := range messages {
+		if err := validateMessage(fmt.Sprintf("messages[%d]", i), m); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range numberRanges {
+		value, present := request[r.param]
+		if !present || value == nil {
+			continue
+		}
+		number, ok := value.(float64)
+		if !ok || (r.integer && number != math.Trunc(number)) {
+			kind := "a number"
+			if r.integer {
+				kind = "an integer"
+			}
+			return invalidParam(r.param, "%s must be %s", r.param, kind)
+		}
+		if number < r.min || number > r.max {
+			if r.max == math.MaxInt32 {
+				return invalidParam(r.param, "%s must be at least %g, got %g", r.param, r.min, number)
+			}
+			return invalidParam(r.param, "%s must be between %g and %g, got %g", r.param, r.min, r.max, number)
+		}
+	}
+
+	for _, param := range []string{"stream", "logprobs", "parallel_tool_calls", "store"} {
+		if value, present := request[param]; present && value != nil {
+			if _, ok := value.(bool); !ok {
+				return invalidParam(param, "%s must be a boolean", param)
+			}
+		}
+	}
+	for _, param := range []string{"user", "reasoning_effort"} {
+		if value, present := request[param]; present && value != nil {
+			if _, ok := value.(string); !ok {
+				return invalidParam(param, "%s must be a string", param)
+			}
+		}
+	}
+
+	if err := validateStop(request["stop"]); err != nil {
+		return err
+	}
+	if err := validateTools(request); err != nil {
+		return err
+	}
+	if value, present := request["response_format"]; present && value != nil {
+		format, ok := value.(map[string]interface{})
+		if !ok {
+			return invalidParam("response_format", "response_format must be an object")
+		}
+		formatType, _ := format["type"].(string)
+		if !responseFormatTypes[formatType] {
+			return invalidParam("response_format.type", "response_format.type must be text, json_object or json_schema")
+		}
+		if formatType == "json_schema" {
+			if _, ok := format["json_schema"].(map[string]interface{}); !ok {
+				return invalidParam("response_format.json_schema", "response_format.json_schema must be an object")
+			}
+		}
+	}
+	if value, present := request["logit_bias"]; present && value != nil {
+		bias, ok := value.(map[string]interface{})
+		if !ok {
+			return invalidParam("logit_bias", "logit_bias must be an object")
+		}
+		for token, v := range bias {
+			if number, ok := v.(float64); !ok || number < -100 || number > 100 {
+				return invalidParam("logit_bias."+token, "logit_bias values must be numbers between -100 and 100")
+			}
+		}
+	}
+	return nil
+}
+
+// validateMessage checks the message at param
+func validateMessage(param string, value interface{}) *validationError {
+	message, ok := value.(map[string]interface{})
+	if !ok {
+		return invalidParam(param, "%s must be an object", param)
+	}
+	role, ok := message["role"].(string)
+	if !ok {
+		return invalidParam(param+".role", "%s.role must be a string", param)
+	}
+	if !messageRoles[role] {
+		return invalidParam(param+".role", "%s.role must be one of system, developer, user, assistant, tool or function, got %q", param, role)
+	}
+
+	_, hasToolCalls := message["tool_calls"]
+	_, hasFunctionCall := message["function_call"]
+	switch content := message["content"].(type) {
+	case string:
+	case []interface{}:
+		if len(content) == 0 {
+			return invalidParam(param+".content", "%s.content must not be an empty array", param)
+		}
+		for i, p := range content {
+			partParam := fmt.Sprintf("%s.content[%d]", param, i)
+			part, ok := p.(map[string]interface{})
+			if !ok {
+				return invalidParam(partParam, "%s must be an object", partParam)
+			}
+			partType, _ := part["type"].(string)
+			if !contentPartTypes[partType] {
+				return invalidParam(partParam+".type", "%s.type must be one of text, image_url, input_audio, file or refusal", partParam)
+			}
+			if partType == "text" {
+				if _, ok := part["text"].(string); !ok {
+					return invalidParam(partParam+".text", "%s.text must be a string", partParam)
+				}
+			}
+		}
+	case nil:
+		if role != "assistant" || !(hasToolCalls || hasFunctionCall) {
+			return invalidParam(param+".content", "%s.content is required", param)
+		}
+	default:
+		return invalidParam(param+".content", "%s.content must be a string or an array of content parts", param)
+	}
+
+	if name, present := message["name"]; present && name != nil {
+		if _, ok := name.(string); !ok {
+			return invalidParam(param+".name", "%s.name must be a string", param)
+		}
+	}
+	if role == "tool" {
+		if id, _ := message["tool_call_id"].(string); id == "" {
+			return invalidParam(param+".tool_call_id", "%s.tool_call_id is required for tool messages", param)
+		}
+	}
+	if hasToolCalls {
+		if role != "assistant" {
+			return invalidParam(param+".tool_calls", "%s.tool_calls is only allowed in assistant messages", param)
+		}
+		calls, ok := message["tool_calls"].([]interface{})
+		if !ok {
+			return invalidParam(param+".tool_calls", "%s.tool_calls must be an array", param)
+		}
+		for i, c := range calls {
+			callParam := fmt.Sprintf("%s.tool_calls[%d]", param, i)
+			call, ok := c.(map[string]interface{})
+			if !ok {
+				return invalidParam(callParam, "%s must be an object", callParam)
+			}
+			if id, _ := call["id"].(string); id == "" {
+				return invalidParam(callParam+".id", "%s.id must be a non-empty string", callParam)
+			}
+			function, ok := call["function"].(map[string]interface{})
+			if !ok {
+				return invalidParam(callParam+".function", "%s.function must be an object", callParam)
+			}
+			if name, _ := function["name"].(string); name == "" {
+				return invalidParam(callParam+".function.name", "%s.function.name must be a non-empty string", callParam)
+			}
+			if _, ok := function["arguments"].(string); !ok {
+				return invalidParam(callParam+".function.arguments", "%s.function.arguments must be a JSON-encoded string", callParam)
+			}
+		}
+	}
+	return nil
+}
+
+// validateStop checks that stop is a string or up to 4 strings
+func validateStop(value interface{}) *validationError {
+	switch stop := value.(type) {
+	case nil, string:
+	case []interface{}:
+		if len(stop) > 4 {
+			return invalidParam("stop", "stop must contain at most 4 sequences")
+		}
+		for i, s := range stop {
+			if _, ok := s.(string); !ok {
+				return invalidParam(fmt.Sprintf("stop[%d]", i), "stop[%d] must be a string", i)
+			}
+		}
+	default:
+		return invalidParam("stop", "stop must be a string or an array of strings")
+	}
+	return nil
+}
+
+// validateTools checks tools and tool_choice
+func validateTools(request map[string]interface{}) *validationError {
+	names := make(map[string]bool)
+	if value, present := request["tools"]; present && value != nil {
+		tools, ok := value.([]interface{})
+		if !ok {
+			return invalidParam("tools", "tools must be an array")
+		}
+		for i, t := range tools {
+			param := fmt.Sprintf("tools[%d]", i)
+			tool, ok := t.(map[string]interface{})
+			if !ok {
+				return invalidParam(param, "%s must be an object", param)
+			}
+			if toolType, _ := tool["type"].(string); toolType != "function" {
+				return invalidParam(param+".type", "%s.type must be function", param)
+			}
+			function, ok := tool["function"].(map[string]interface{})
+			if !ok {
+				return invalidParam(param+".function", "%s.function must be an object", param)
+			}
+			name, _ := function["name"].(string)
+			if name == "" {
+				return invalidParam(param+".function.name", "%s.function.name must be a non-empty string", param)
+			}
+			if parameters, present := function["parameters"]; present && parameters != nil {
+				if _, ok := parameters.(map[string]interface{}); !ok {
+					return invalidParam(param+".function.parameters", "%s.function.parameters must be a JSON schema object", param)
+				}
+			}
+			names[name] = true
+		}
+	}
+
+	switch choice := request["tool_choice"].(type) {
+	case nil:
+	case string:
+		if choice != "none" && choice != "auto" && choice != "required" {
+			return invalidParam("tool_choice", "tool_choice must be none, auto, required or an object naming a function")
+		}
+		if choice == "required" && len(names) == 0 {
+			return invalidParam("tool_choice", "tool_choice required needs at least one tool")
+		}
+	case map[string]interface{}:
+		function, _ := choice["function"].(map[string]interface{})
+		name, _ := function["name"].(string)
+		if choiceType, _ := choice["type"].(string); choiceType != "function" || name == "" {
+			return invalidParam("tool_choice", "tool_choice must name a function as {\"type\": \"function\", \"function\": {\"name\": ...}}")
+		}
+		if !names[name] {
+			return invalidParam("tool_choice.function.name", "tool_choice names the function %q, which is not in tools", name)
+		}
+	default:
+		return invalidParam("tool_choice", "tool_choice must be a string or an object")
+	}
+	return nil
+}
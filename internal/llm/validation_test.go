@@ -0,0 +1,97 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateChatRequest(t *testing.T) {
+	tests := []struct {
+		body  string
+		param string
+	}{
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`, ""},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":[{"type":"text","text":"hi"},{"type":"image_url","image_url":{"url":"data:"}}]}],"temperature":0.5,"stop":["a","b"],"n":2}`, ""},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"},{"role":"assistant","content":null,"tool_calls":[{"id":"c1","type":"function","function":{"name":"f","arguments":"{}"}}]},{"role":"tool","tool_call_id":"c1","content":"42"}],"tools":[{"type":"function","function":{"name":"f","parameters":{}}}],"tool_choice":{"type":"function","function":{"name":"f"}}}`, ""},
+		{`{"messages":[{"role":"user","content":"hi"}]}`, "model"},
+		{`{"model":"gpt-4o"}`, "messages"},
+		{`{"model":"gpt-4o","messages":"hi"}`, "messages"},
+		{`{"model":"gpt-4o","messages":[]}`, "messages"},
+		{`{"model":"gpt-4o","messages":["hi"]}`, "messages[0]"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"},{"role":"robot","content":"hi"}]}`, "messages[1].role"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":42}]}`, "messages[0].content"},
+		{`{"model":"gpt-4o","messages":[{"role":"user"}]}`, "messages[0].content"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":[{"type":"video"}]}]}`, "messages[0].content[0].type"},
+		{`{"model":"gpt-4o","messages":[{"role":"tool","content":"42"}]}`, "messages[0].tool_call_id"},
+		{`{"model":"gpt-4o","messages":[{"role":"assistant","content":null,"tool_calls":[{"id":"c1","function":{"name":"f","arguments":{}}}]}]}`, "messages[0].tool_calls[0].function.arguments"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"temperature":3}`, "temperature"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"top_p":"high"}`, "top_p"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"max_tokens":0}`, "max_tokens"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"n":1.5}`, "n"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":"yes"}`, "stream"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stop":["a",1]}`, "stop[1]"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{}}]}`, "tools[0].function.name"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"tool_choice":"always"}`, "tool_choice"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"tool_choice":{"type":"function","function":{"name":"g"}}}`, "tool_choice.function.name"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"response_format":{"type":"yaml"}}`, "response_format.type"},
+	}
+	for _, tt := range tests {
+		var request map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.body), &request); err != nil {
+			t.Fatal(err)
+		}
+		err := validateChatRequest(request)
+		switch {
+		case tt.param == "" && err != nil:
+			t.Errorf("validateChatRequest(%s) = %v, want nil", tt.body, err)
+		case tt.param != "" && (err == nil || err.param != tt.param):
+			t.Errorf("validateChatRequest(%s) = %+v, want param %s", tt.body, err, tt.param)
+		}
+	}
+}
+
+func TestHandleCompletionStrictValidation(t *testing.T) {
+	os.Setenv("DISABLE_AUTH", "true")
+	defer os.Unsetenv("DISABLE_AUTH")
+
+	forwarded := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = true
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	state := newTestServerState(upstream)
+	state.Service.config.StrictValidation = true
+
+	w := httptest.NewRecorder()
+	state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}],"temperature":-1}`)))
+	var out struct {
+		Error struct {
+			Type  string `json:"type"`
+			Param string `json:"param"`
+		} `json:"error"`
+	}
+	json.NewDecoder(w.Body).Decode(&out)
+	if w.Code != http.StatusBadRequest || out.Error.Type != "invalid_request_error" || out.Error.Param != "temperature" || forwarded {
+		t.Errorf("invalid request: status = %d, error = %+v, forwarded = %v", w.Code, out.Error, forwarded)
+	}
+
+	w = httptest.NewRecorder()
+	state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`not json`)))
+	if w.Code != http.StatusBadRequest || forwarded {
+		t.Errorf("malformed body: status = %d, forwarded = %v", w.Code, forwarded)
+	}
+
+	w = httptest.NewRecorder()
+	state.HandleCompletion(w, httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`)))
+	if w.Code != http.StatusOK || !forwarded {
+		t.Errorf("valid request: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,68 @@
+package llm
+
+import (
+	"fmt"
+)
+
+// transcodeMessages normalizes OpenAI multimodal message content into the
+// form accepted by the Copilot API and reports whether any image parts are
+// present. String content is left untouched; content part arrays have their
+// image_url parts rewritten to the object form ({"url": ..., "detail": ...}).
+func transcodeMessages(messages interface{}) (interface{}, bool, error) {
+	list, ok := messages.([]interface{})
+	if !ok {
+		return messages, false, nil
+	}
+	hasImages := false
+	for i, m := range list {
+		msg, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		parts, ok := msg["content"].([]interface{})
+		if !ok {
+			continue
+		}
+		converted := make([]interface{}, 0, len(parts))
+		for _, p := range parts {
+			part, ok := p.(map[string]interface{})
+			if !ok {
+				return nil, false, fmt.Errorf("messages[%d]: content parts must be objects", i)
+			}
+			switch part["type"] {
+			case "text":
+				converted = append(converted, part)
+			case "image_url":
+				image, err := transcodeImagePart(part)
+				if err != nil {
+					return nil, false, fmt.Errorf("messages[%d]: %w", i, err)
+				}
+				converted = append(converted, image)
+				hasImages = true
+			default:
+				return nil, false, fmt.Errorf("messages[%d]: unsupported content part type %v", i, part["type"])
+			}
+		}
+		msg["content"] = converted
+	}
+	return list, hasImages, nil
+}
+
+// transcodeImagePart converts an image_url content part to the object form
+func transcodeImagePart(part map[string]interface{}) (map[string]interface{}, error) {
+	image := map[string]interface{}{}
+	switch v := part["image_url"].(type) {
+	case string:
+		image["url"] = v
+	case map[string]interface{}:
+		url, _ := v["url"].(string)
+		image["url"] = url
+		if detail, ok := v["detail"].(string); ok && detail != "" {
+			image["detail"] = detail
+		}
+	}
+	if url, _ := image["url"].(string); url == "" {
+		return nil, fmt.Errorf("image_url content part requires a url")
+	}
+	return map[string]interface{}{"type": "image_url", "image_url": image}, nil
+}
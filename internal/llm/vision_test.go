@@ -0,0 +1,84 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTranscodeMessages(t *testing.T) {
+	var messages []interface{}
+	json.Unmarshal([]byte(`[
+		{"role":"system","content":"be brief"},
+		{"role":"user","content":[
+			{"type":"text","text":"what is this?"},
+			{"type":"image_url","image_url":"data:image/png;base64,AAAA"},
+			{"type":"image_url","image_url":{"url":"https://example.com/a.png","detail":"low"}}
+		]}
+	]`), &messages)
+
+	out, hasImages, err := transcodeMessages(messages)
+	if err != nil {
+		t.Fatalf("transcodeMessages() error = %v", err)
+	}
+	if !hasImages {
+		t.Error("expected images to be detected")
+	}
+	parts := out.([]interface{})[1].(map[string]interface{})["content"].([]interface{})
+	first := parts[1].(map[string]interface{})["image_url"].(map[string]interface{})
+	if first["url"] != "data:image/png;base64,AAAA" {
+		t.Errorf("string image_url not converted to object form: %v", first)
+	}
+	second := parts[2].(map[string]interface{})["image_url"].(map[string]interface{})
+	if second["detail"] != "low" {
+		t.Errorf("detail not preserved: %v", second)
+	}
+}
+
+func TestTranscodeMessagesErrors(t *testing.T) {
+	tests := []string{
+		`[{"role":"user","content":[{"type":"image_url","image_url":{}}]}]`,
+		`[{"role":"user","content":[{"type":"audio","audio":"x"}]}]`,
+		`[{"role":"user","content":["plain string part"]}]`,
+	}
+	for _, raw := range tests {
+		var messages []interface{}
+		json.Unmarshal([]byte(raw), &messages)
+		if _, _, err := transcodeMessages(messages); err == nil {
+			t.Errorf("transcodeMessages(%s) expected error", raw)
+		}
+	}
+}
+
+func TestCallCopilotAPISetsVisionHeader(t *testing.T) {
+	var vision string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vision = r.Header.Get("Copilot-Vision-Request")
+	}))
+	defer ts.Close()
+
+	s := &Service{
+		config:     &Config{CopilotAPIKey: "test-key;proxy-ep=" + ts.URL},
+		httpClient: ts.Client(),
+	}
+
+	resp, err := s.callCopilotAPI(context.Background(), `{"messages":[{"role":"user","content":"hi"}]}`, "test-model")
+	if err != nil {
+		t.Fatalf("callCopilotAPI() error = %v", err)
+	}
+	resp.Body.Close()
+	if vision != "" {
+		t.Errorf("unexpected vision header on text-only request: %q", vision)
+	}
+
+	resp, err = s.callCopilotAPI(context.Background(), `{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,AA"}}]}]}`, "test-model")
+	if err != nil {
+		t.Fatalf("callCopilotAPI() error = %v", err)
+	}
+	resp.Body.Close()
+	if vision != "true" {
+		t.Errorf("expected Copilot-Vision-Request: true, got %q", vision)
+	}
+}
@@ -0,0 +1,48 @@
+// Package openapi serves the OpenAPI 3.1 description of the proxy's HTTP
+// API, for client generators and tools such as Swagger UI.
+package openapi
+
+import (
+	"copilot-proxy/internal/buildinfo"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+)
+
+// Path is where the document is served
+const Path = "/openapi.json"
+
+//go:embed openapi.json
+var document []byte
+
+// Document returns the OpenAPI document with the version of this build
+func Document() ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, err
+	}
+	if info, ok := doc["info"].(map[string]interface{}); ok {
+		info["version"] = buildinfo.Get().Version
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// Handler serves the document. It is public and may be fetched from other
+// origins, so that API tools running elsewhere can load it.
+func Handler() http.Handler {
+	data, err := Document()
+	if err != nil {
+		// The embedded document is checked by the tests
+		panic("openapi: invalid document: " + err.Error())
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(data)
+	})
+}
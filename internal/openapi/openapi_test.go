@@ -0,0 +1,105 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// collectRefs returns every $ref in a decoded JSON value
+func collectRefs(v interface{}, refs *[]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if ref, ok := value.(string); ok && key == "$ref" {
+				*refs = append(*refs, ref)
+			}
+			collectRefs(value, refs)
+		}
+	case []interface{}:
+		for _, value := range v {
+			collectRefs(value, refs)
+		}
+	}
+}
+
+// resolve looks up a local reference such as #/components/schemas/Error
+func resolve(doc map[string]interface{}, ref string) bool {
+	var node interface{} = doc
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if node, ok = m[part]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDocument(t *testing.T) {
+	data, err := Document()
+	if err != nil {
+		t.Fatalf("Document() error = %v", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["openapi"] != "3.1.0" {
+		t.Errorf("openapi = %v, want 3.1.0", doc["openapi"])
+	}
+
+	var refs []string
+	collectRefs(doc, &refs)
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref, "#/") || !resolve(doc, ref) {
+			t.Errorf("unresolved reference %s", ref)
+		}
+	}
+
+	// Every route the proxy registers is described, each operation once
+	paths := doc["paths"].(map[string]interface{})
+	for _, path := range []string{
+		"/v1/models", "/v1/models/{model}", "/v1/chat/completions", "/v1/completions",
+		"/v1/embeddings", "/v1/moderations", "/v1/usage", "/v1/sessions", "/v1/sessions/{session}",
+		"/copilot/completions", "/openai/deployments/{deployment}/chat/completions", "/rpc", "/status", "/auth/token", "/auth/refresh", "/.well-known/jwks.json", Path,
+		"/admin/keys", "/admin/keys/{id}", "/admin/keys/{id}/rotate", "/admin/limits", "/admin/limits/{key}",
+		"/admin/budgets", "/admin/budgets/{key}", "/admin/tenants", "/admin/tenants/{name}",
+		"/admin/accounts", "/admin/usage/export", "/admin/reload", "/admin/events", "/admin/metrics", "/admin/ui", "/admin/ui/stats",
+	} {
+		if paths[path] == nil {
+			t.Errorf("path %s is not described", path)
+		}
+	}
+	operations := make(map[string]bool)
+	for path, item := range paths {
+		for method, op := range item.(map[string]interface{}) {
+			if method == "parameters" {
+				continue
+			}
+			id, _ := op.(map[string]interface{})["operationId"].(string)
+			if id == "" || operations[id] {
+				t.Errorf("%s %s has a missing or duplicate operationId %q", method, path, id)
+			}
+			operations[id] = true
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, Path, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("GET %s = %d %q", Path, w.Code, w.Header().Get("Content-Type"))
+	}
+
+	w = httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, Path, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST %s = %d, want 405", Path, w.Code)
+	}
+}
@@ -0,0 +1,225 @@
+// Copilot proxy gRPC API.
+//
+// Requests are authorized like the HTTP API: send an LLM token or API key as
+// "authorization: Bearer <key>" metadata. The Go code in this directory is
+// generated from this file with protoc-gen-go and protoc-gen-go-grpc.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: copilotpb/copilot.proto
+
+package copilotpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Copilot_Chat_FullMethodName       = "/copilot.v1.Copilot/Chat"
+	Copilot_StreamChat_FullMethodName = "/copilot.v1.Copilot/StreamChat"
+	Copilot_ListModels_FullMethodName = "/copilot.v1.Copilot/ListModels"
+)
+
+// CopilotClient is the client API for Copilot service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type CopilotClient interface {
+	// Chat returns a complete chat completion
+	Chat(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (*ChatResponse, error)
+	// StreamChat streams a chat completion as it is generated. The last chunk
+	// carries the finish reason and the token usage.
+	StreamChat(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (Copilot_StreamChatClient, error)
+	// ListModels lists the models the caller may use
+	ListModels(ctx context.Context, in *ListModelsRequest, opts ...grpc.CallOption) (*ListModelsResponse, error)
+}
+
+type copilotClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCopilotClient(cc grpc.ClientConnInterface) CopilotClient {
+	return &copilotClient{cc}
+}
+
+func (c *copilotClient) Chat(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (*ChatResponse, error) {
+	out := new(ChatResponse)
+	err := c.cc.Invoke(ctx, Copilot_Chat_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *copilotClient) StreamChat(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (Copilot_StreamChatClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Copilot_ServiceDesc.Streams[0], Copilot_StreamChat_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &copilotStreamChatClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Copilot_StreamChatClient interface {
+	Recv() (*ChatChunk, error)
+	grpc.ClientStream
+}
+
+type copilotStreamChatClient struct {
+	grpc.ClientStream
+}
+
+func (x *copilotStreamChatClient) Recv() (*ChatChunk, error) {
+	m := new(ChatChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *copilotClient) ListModels(ctx context.Context, in *ListModelsRequest, opts ...grpc.CallOption) (*ListModelsResponse, error) {
+	out := new(ListModelsResponse)
+	err := c.cc.Invoke(ctx, Copilot_ListModels_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CopilotServer is the server API for Copilot service.
+// All implementations must embed UnimplementedCopilotServer
+// for forward compatibility
+type CopilotServer interface {
+	// Chat returns a complete chat completion
+	Chat(context.Context, *ChatRequest) (*ChatResponse, error)
+	// StreamChat streams a chat completion as it is generated. The last chunk
+	// carries the finish reason and the token usage.
+	StreamChat(*ChatRequest, Copilot_StreamChatServer) error
+	// ListModels lists the models the caller may use
+	ListModels(context.Context, *ListModelsRequest) (*ListModelsResponse, error)
+	mustEmbedUnimplementedCopilotServer()
+}
+
+// UnimplementedCopilotServer must be embedded to have forward compatible implementations.
+type UnimplementedCopilotServer struct {
+}
+
+func (UnimplementedCopilotServer) Chat(context.Context, *ChatRequest) (*ChatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Chat not implemented")
+}
+func (UnimplementedCopilotServer) StreamChat(*ChatRequest, Copilot_StreamChatServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamChat not implemented")
+}
+func (UnimplementedCopilotServer) ListModels(context.Context, *ListModelsRequest) (*ListModelsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListModels not implemented")
+}
+func (UnimplementedCopilotServer) mustEmbedUnimplementedCopilotServer() {}
+
+// UnsafeCopilotServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CopilotServer will
+// result in compilation errors.
+type UnsafeCopilotServer interface {
+	mustEmbedUnimplementedCopilotServer()
+}
+
+func RegisterCopilotServer(s grpc.ServiceRegistrar, srv CopilotServer) {
+	s.RegisterService(&Copilot_ServiceDesc, srv)
+}
+
+func _Copilot_Chat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CopilotServer).Chat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Copilot_Chat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CopilotServer).Chat(ctx, req.(*ChatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Copilot_StreamChat_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChatRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CopilotServer).StreamChat(m, &copilotStreamChatServer{stream})
+}
+
+type Copilot_StreamChatServer interface {
+	Send(*ChatChunk) error
+	grpc.ServerStream
+}
+
+type copilotStreamChatServer struct {
+	grpc.ServerStream
+}
+
+func (x *copilotStreamChatServer) Send(m *ChatChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Copilot_ListModels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListModelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CopilotServer).ListModels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Copilot_ListModels_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CopilotServer).ListModels(ctx, req.(*ListModelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Copilot_ServiceDesc is the grpc.ServiceDesc for Copilot service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Copilot_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "copilot.v1.Copilot",
+	HandlerType: (*CopilotServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Chat",
+			Handler:    _Copilot_Chat_Handler,
+		},
+		{
+			MethodName: "ListModels",
+			Handler:    _Copilot_ListModels_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamChat",
+			Handler:       _Copilot_StreamChat_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "copilotpb/copilot.proto",
+}
@@ -0,0 +1,261 @@
+package rpc
+
+import (
+	"bytes"
+	"copilot-proxy/internal/llm"
+	"copilot-proxy/pkg/models"
+	"copilot-proxy/pkg/utils"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// JSONRPCPath is where the JSON-RPC endpoint is mounted
+const JSONRPCPath = "/rpc"
+
+// JSON-RPC 2.0 error codes
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	// codeServerError reports a failed completion or model listing; the
+	// error data carries the HTTP status and OpenAI error of the HTTP API
+	codeServerError = -32000
+)
+
+// jsonRPCRequest is a JSON-RPC 2.0 request or, without an ID, notification
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// jsonRPCResponse is a JSON-RPC 2.0 response
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// jsonRPCError is the error object of a failed call
+type jsonRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// jsonRPCHandler serves JSON-RPC 2.0 calls over HTTP
+type jsonRPCHandler struct {
+	state *llm.ServerState
+}
+
+// NewJSONRPCHandler returns an HTTP handler speaking JSON-RPC 2.0, with
+// single and batch calls, on top of the LLM server state. It offers the
+// methods:
+//
+//   - chat: params are an OpenAI chat completion request (without stream);
+//     the result is the chat.completion object
+//   - models.list: the result is the OpenAI model list of the caller
+//
+// Requests are authorized with the Authorization header or TLS client
+// certificate like the HTTP API.
+func NewJSONRPCHandler(state *llm.ServerState) http.Handler {
+	return &jsonRPCHandler{state: state}
+}
+
+func (h *jsonRPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONRPC(w, http.StatusMethodNotAllowed, errorResponse(nil, codeInvalidRequest, "JSON-RPC requests must be sent with POST"))
+		return
+	}
+	token, err := h.state.AuthenticateClient(r.Header.Get("Authorization"), r.URL.Path, r.TLS)
+	if err != nil {
+		writeJSONRPC(w, http.StatusUnauthorized, errorResponse(nil, codeInvalidRequest, err.Error()))
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if utils.IsRequestBodyTooLarge(err) {
+		writeJSONRPC(w, http.StatusRequestEntityTooLarge, errorResponse(nil, codeInvalidRequest, "request body too large"))
+		return
+	}
+	if err != nil {
+		writeJSONRPC(w, http.StatusBadRequest, errorResponse(nil, codeParseError, "error reading request body"))
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			writeJSONRPC(w, http.StatusOK, errorResponse(nil, codeParseError, "parse error: "+err.Error()))
+			return
+		}
+		if len(batch) == 0 {
+			writeJSONRPC(w, http.StatusOK, errorResponse(nil, codeInvalidRequest, "empty batch"))
+			return
+		}
+		responses := make([]*jsonRPCResponse, 0, len(batch))
+		for _, raw := range batch {
+			if resp := h.call(r, token, raw); resp != nil {
+				responses = append(responses, resp)
+			}
+		}
+		if len(responses) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSONRPC(w, http.StatusOK, responses)
+		return
+	}
+	if !json.Valid(body) {
+		writeJSONRPC(w, http.StatusOK, errorResponse(nil, codeParseError, "parse error"))
+		return
+	}
+	if resp := h.call(r, token, body); resp != nil {
+		writeJSONRPC(w, http.StatusOK, resp)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// call runs a single request. Notifications are run as well, but their
+// response is nil.
+func (h *jsonRPCHandler) call(r *http.Request, token *models.LLMToken, raw json.RawMessage) *jsonRPCResponse {
+	var req jsonRPCRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return errorResponse(nil, codeInvalidRequest, "invalid JSON-RPC 2.0 request")
+	}
+
+	var result interface{}
+	var rpcErr *jsonRPCError
+	switch req.Method {
+	case "chat":
+		result, rpcErr = h.chat(r, token, req.Params)
+	case "models.list":
+		result, rpcErr = h.listModels(r, token)
+	default:
+		rpcErr = &jsonRPCError{Code: codeMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)}
+	}
+
+	if req.ID == nil {
+		return nil
+	}
+	if rpcErr != nil {
+		return &jsonRPCResponse{JSONRPC: "2.0", Error: rpcErr, ID: req.ID}
+	}
+	return &jsonRPCResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+}
+
+// chat performs a chat completion
+func (h *jsonRPCHandler) chat(r *http.Request, token *models.LLMToken, params json.RawMessage) (interface{}, *jsonRPCError) {
+	var request map[string]interface{}
+	if err := json.Unmarshal(params, &request); err != nil || request == nil {
+		return nil, &jsonRPCError{Code: codeInvalidParams, Message: "params must be a chat completion request object"}
+	}
+	if stream, _ := request["stream"].(bool); stream {
+		return nil, &jsonRPCError{Code: codeInvalidParams, Message: "streaming is not supported over JSON-RPC"}
+	}
+	delete(request, "stream")
+	model, _ := request["model"].(string)
+	if model == "" {
+		return nil, &jsonRPCError{Code: codeInvalidParams, Message: "model is required"}
+	}
+	if messages, _ := request["messages"].([]interface{}); len(messages) == 0 {
+		return nil, &jsonRPCError{Code: codeInvalidParams, Message: "messages are required"}
+	}
+	providerRequest, err := json.Marshal(request)
+	if err != nil {
+		return nil, &jsonRPCError{Code: codeInvalidParams, Message: err.Error()}
+	}
+
+	result, err := h.state.Service.Chat(llm.CompletionRequest{
+		Context:         r.Context(),
+		Model:           model,
+		ProviderRequest: string(providerRequest),
+		Token:           token,
+		CountryCode:     requestCountryCode(r),
+		CurrentSpending: h.state.Service.CurrentSpending(token.UserID),
+		Endpoint:        r.URL.Path,
+	})
+	if err != nil {
+		return nil, serverError(err)
+	}
+
+	message := map[string]interface{}{"role": "assistant", "content": result.Content}
+	if len(result.ToolCalls) > 0 {
+		message["tool_calls"] = result.ToolCalls
+		if result.Content == "" {
+			message["content"] = nil
+		}
+	}
+	return map[string]interface{}{
+		"id":      completionID(),
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []map[string]interface{}{{
+			"index":         0,
+			"message":       message,
+			"finish_reason": result.FinishReason,
+		}},
+		"usage": map[string]interface{}{
+			"prompt_tokens":     result.PromptTokens,
+			"completion_tokens": result.CompletionTokens,
+			"total_tokens":      result.PromptTokens + result.CompletionTokens,
+		},
+	}, nil
+}
+
+// listModels lists the models the caller may use
+func (h *jsonRPCHandler) listModels(r *http.Request, token *models.LLMToken) (interface{}, *jsonRPCError) {
+	visible, err := h.state.Service.Models(token, requestCountryCode(r))
+	if err != nil {
+		return nil, &jsonRPCError{Code: codeServerError, Message: "failed to fetch models: " + err.Error()}
+	}
+	data := make([]map[string]interface{}, len(visible))
+	for i, model := range visible {
+		data[i] = map[string]interface{}{"id": model.ID, "object": "model", "name": model.Name, "owned_by": string(model.Provider)}
+	}
+	return map[string]interface{}{"object": "list", "data": data}, nil
+}
+
+// serverError converts a failed completion into a JSON-RPC error carrying
+// the error the HTTP API would respond with
+func serverError(err error) *jsonRPCError {
+	status, errType, code := llm.CompletionError(err)
+	data := map[string]interface{}{"status": status, "type": errType}
+	if code != "" {
+		data["code"] = code
+	}
+	return &jsonRPCError{Code: codeServerError, Message: err.Error(), Data: data}
+}
+
+// requestCountryCode reads the caller's country from the CF-IPCountry header
+func requestCountryCode(r *http.Request) *string {
+	country := r.Header.Get("CF-IPCountry")
+	if country == "" || country == "XX" {
+		return nil
+	}
+	return &country
+}
+
+// errorResponse returns an error response
+func errorResponse(id json.RawMessage, code int, message string) *jsonRPCResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &jsonRPCResponse{JSONRPC: "2.0", Error: &jsonRPCError{Code: code, Message: message}, ID: id}
+}
+
+// writeJSONRPC writes a response or batch of responses
+func writeJSONRPC(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
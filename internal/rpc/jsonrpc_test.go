@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"copilot-proxy/internal/llm"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONRPCHandler(t *testing.T) {
+	handler := NewJSONRPCHandler(llm.NewLLMServerState("test-secret"))
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", JSONRPCPath, strings.NewReader(body)))
+		return w
+	}
+
+	t.Run("single call", func(t *testing.T) {
+		w := post(`{"jsonrpc":"2.0","id":7,"method":"chat","params":{"model":"test-model","messages":[{"role":"user","content":"hi"}],"temperature":0.2}}`)
+		var resp struct {
+			ID     int `json:"id"`
+			Result struct {
+				Object  string `json:"object"`
+				Choices []struct {
+					Message struct {
+						Content string `json:"content"`
+					} `json:"message"`
+					FinishReason string `json:"finish_reason"`
+				} `json:"choices"`
+				Usage struct {
+					TotalTokens int `json:"total_tokens"`
+				} `json:"usage"`
+			} `json:"result"`
+			Error *jsonRPCError `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+		}
+		if resp.Error != nil || resp.ID != 7 || resp.Result.Object != "chat.completion" || len(resp.Result.Choices) != 1 {
+			t.Fatalf("response = %s", w.Body.String())
+		}
+		if choice := resp.Result.Choices[0]; choice.Message.Content != "Hello" || choice.FinishReason != "stop" || resp.Result.Usage.TotalTokens != 5 {
+			t.Errorf("response = %s", w.Body.String())
+		}
+		if upstream := lastUpstreamRequest(); upstream["temperature"] != 0.2 {
+			t.Errorf("upstream request = %v", upstream)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		w := post(`[
+			{"jsonrpc":"2.0","id":"models","method":"models.list"},
+			{"jsonrpc":"2.0","method":"models.list"},
+			{"jsonrpc":"2.0","id":2,"method":"nope"},
+			{"jsonrpc":"2.0","id":3,"method":"chat","params":{"model":"test-model","messages":[],"stream":true}},
+			{"id":4,"method":"chat"}
+		]`)
+		var responses []struct {
+			ID     json.RawMessage `json:"id"`
+			Result struct {
+				Data []struct {
+					ID string `json:"id"`
+				} `json:"data"`
+			} `json:"result"`
+			Error *jsonRPCError `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+			t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+		}
+		if len(responses) != 4 {
+			t.Fatalf("got %d responses, want 4 without the notification: %s", len(responses), w.Body.String())
+		}
+		if string(responses[0].ID) != `"models"` || len(responses[0].Result.Data) != 1 || responses[0].Result.Data[0].ID != "test-model" {
+			t.Errorf("models.list response = %s", w.Body.String())
+		}
+		for i, want := range []int{codeMethodNotFound, codeInvalidParams, codeInvalidRequest} {
+			if got := responses[i+1].Error; got == nil || got.Code != want {
+				t.Errorf("response %d error = %+v, want code %d", i+1, got, want)
+			}
+		}
+	})
+
+	t.Run("parse error", func(t *testing.T) {
+		w := post(`{"jsonrpc":`)
+		if !strings.Contains(w.Body.String(), `"code":-32700`) || !strings.Contains(w.Body.String(), `"id":null`) {
+			t.Errorf("response = %s", w.Body.String())
+		}
+	})
+
+	t.Run("notification only", func(t *testing.T) {
+		if w := post(`{"jsonrpc":"2.0","method":"models.list"}`); w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+			t.Errorf("status = %d, body = %q", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestJSONRPCChatRunsRequestHooks(t *testing.T) {
+	state := llm.NewLLMServerState("test-secret")
+	deny := filepath.Join(t.TempDir(), "deny.sh")
+	if err := os.WriteFile(deny, []byte("#!/bin/sh\necho 'no chats over RPC' >&2\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	config := state.Service.GetConfig()
+	hooks := config.RequestHooks
+	config.RequestHooks = []string{deny}
+	t.Cleanup(func() { config.RequestHooks = hooks })
+
+	w := httptest.NewRecorder()
+	NewJSONRPCHandler(state).ServeHTTP(w, httptest.NewRequest("POST", JSONRPCPath,
+		strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"chat","params":{"model":"test-model","messages":[{"role":"user","content":"hi"}]}}`)))
+	var resp struct {
+		Error *jsonRPCError `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Error == nil || !strings.Contains(resp.Error.Message, "no chats over RPC") {
+		t.Errorf("response = %s, want the hook's denial", w.Body.String())
+	}
+}
@@ -0,0 +1,258 @@
+// Package rpc serves remote procedure call APIs alongside the HTTP server:
+// the gRPC Copilot service defined in copilotpb/copilot.proto and a JSON-RPC
+// 2.0 endpoint at /rpc.
+//
+// Both share the HTTP server's llm.ServerState, so all APIs use the same
+// Copilot credentials, model cache, rate limits, budgets and usage records.
+// gRPC clients authenticate with "authorization: Bearer <key>" metadata,
+// JSON-RPC clients with the Authorization header, exactly like the HTTP API;
+// with TLS client authentication, a verified client certificate can stand in
+// for either.
+//
+// The server is configured with:
+//   - GRPC_ADDR: listen address of the gRPC server, e.g. ":9090"
+//     (default: no gRPC server)
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative copilotpb/copilot.proto
+
+import (
+	"context"
+	appauth "copilot-proxy/internal/auth"
+	"copilot-proxy/internal/llm"
+	"copilot-proxy/internal/rpc/copilotpb"
+	"copilot-proxy/pkg/models"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Config controls the gRPC server
+type Config struct {
+	// Addr is the listen address; the gRPC server is disabled when it is empty
+	Addr string
+}
+
+// ConfigFromEnv reads GRPC_ADDR
+func ConfigFromEnv() Config {
+	return Config{Addr: os.Getenv("GRPC_ADDR")}
+}
+
+// Server implements copilotpb.CopilotServer on top of the LLM service
+type Server struct {
+	copilotpb.UnimplementedCopilotServer
+	state *llm.ServerState
+}
+
+// NewServer creates a Copilot service backed by the given LLM server state
+func NewServer(state *llm.ServerState) *Server {
+	return &Server{state: state}
+}
+
+// NewGRPCServer returns a gRPC server with the Copilot service registered.
+// Connections are served with TLS when tlsConfig is not nil.
+func NewGRPCServer(state *llm.ServerState, tlsConfig *tls.Config) *grpc.Server {
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	copilotpb.RegisterCopilotServer(server, NewServer(state))
+	return server
+}
+
+// Chat returns a complete chat completion
+func (s *Server) Chat(ctx context.Context, in *copilotpb.ChatRequest) (*copilotpb.ChatResponse, error) {
+	req, err := s.completionRequest(ctx, copilotpb.Copilot_Chat_FullMethodName, in)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.state.Service.Chat(req)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	return &copilotpb.ChatResponse{
+		Id:           completionID(),
+		Model:        in.Model,
+		Message:      &copilotpb.Message{Role: "assistant", Content: result.Content},
+		FinishReason: result.FinishReason,
+		Usage:        usage(result),
+	}, nil
+}
+
+// StreamChat streams a chat completion; the last chunk carries the finish
+// reason and usage
+func (s *Server) StreamChat(in *copilotpb.ChatRequest, stream copilotpb.Copilot_StreamChatServer) error {
+	req, err := s.completionRequest(stream.Context(), copilotpb.Copilot_StreamChat_FullMethodName, in)
+	if err != nil {
+		return err
+	}
+	id := completionID()
+	var sendErr error
+	result, err := s.state.Service.StreamChat(req, func(delta llm.ChatDelta) {
+		if sendErr == nil {
+			sendErr = stream.Send(&copilotpb.ChatChunk{Id: id, Model: in.Model, Content: delta.Content})
+		}
+	})
+	if sendErr != nil {
+		return sendErr
+	}
+	if err != nil {
+		return errorStatus(err)
+	}
+	return stream.Send(&copilotpb.ChatChunk{Id: id, Model: in.Model, FinishReason: result.FinishReason, Usage: usage(result)})
+}
+
+// ListModels lists the models the caller may use
+func (s *Server) ListModels(ctx context.Context, in *copilotpb.ListModelsRequest) (*copilotpb.ListModelsResponse, error) {
+	token, err := s.authenticate(ctx, copilotpb.Copilot_ListModels_FullMethodName)
+	if err != nil {
+		return nil, err
+	}
+	visible, err := s.state.Service.Models(token, countryCode(ctx))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to fetch models: %v", err)
+	}
+	out := &copilotpb.ListModelsResponse{}
+	for _, model := range visible {
+		out.Models = append(out.Models, &copilotpb.Model{Id: model.ID, Name: model.Name, Provider: string(model.Provider)})
+	}
+	return out, nil
+}
+
+// authenticate validates the authorization metadata or TLS client
+// certificate of a call
+func (s *Server) authenticate(ctx context.Context, method string) (*models.LLMToken, error) {
+	var conn *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			conn = &info.State
+		}
+	}
+	token, err := s.state.AuthenticateClient(metadataValue(ctx, "authorization"), method, conn)
+	if errors.Is(err, appauth.ErrScopeDenied) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return token, nil
+}
+
+// completionRequest authenticates a chat call and converts it to an
+// OpenAI chat completion request
+func (s *Server) completionRequest(ctx context.Context, method string, in *copilotpb.ChatRequest) (llm.CompletionRequest, error) {
+	token, err := s.authenticate(ctx, method)
+	if err != nil {
+		return llm.CompletionRequest{}, err
+	}
+	if in.Model == "" {
+		return llm.CompletionRequest{}, status.Error(codes.InvalidArgument, "model is required")
+	}
+	if len(in.Messages) == 0 {
+		return llm.CompletionRequest{}, status.Error(codes.InvalidArgument, "messages are required")
+	}
+
+	messages := make([]map[string]interface{}, len(in.Messages))
+	for i, m := range in.Messages {
+		messages[i] = map[string]interface{}{"role": m.Role, "content": m.Content}
+		if m.Name != "" {
+			messages[i]["name"] = m.Name
+		}
+	}
+	body := map[string]interface{}{"model": in.Model, "messages": messages}
+	if in.Temperature != nil {
+		body["temperature"] = *in.Temperature
+	}
+	if in.TopP != nil {
+		body["top_p"] = *in.TopP
+	}
+	if in.MaxTokens != nil {
+		body["max_tokens"] = *in.MaxTokens
+	}
+	if len(in.Stop) > 0 {
+		body["stop"] = in.Stop
+	}
+	providerRequest, err := json.Marshal(body)
+	if err != nil {
+		return llm.CompletionRequest{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return llm.CompletionRequest{
+		Context:         ctx,
+		Model:           in.Model,
+		ProviderRequest: string(providerRequest),
+		Token:           token,
+		CountryCode:     countryCode(ctx),
+		CurrentSpending: s.state.Service.CurrentSpending(token.UserID),
+		Endpoint:        method,
+	}, nil
+}
+
+// errorStatus converts a failed completion into a gRPC status whose code
+// matches the HTTP status the OpenAI-compatible API would respond with
+func errorStatus(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return status.Error(codes.Canceled, err.Error())
+	}
+	code := codes.Unknown
+	switch httpStatus, _, _ := llm.CompletionError(err); httpStatus {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = codes.InvalidArgument
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
+
+// metadataValue returns the first value of an incoming metadata key
+func metadataValue(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// countryCode reads the caller's country from the CF-IPCountry metadata set
+// by Cloudflare, like the HTTP API
+func countryCode(ctx context.Context) *string {
+	country := metadataValue(ctx, "cf-ipcountry")
+	if country == "" || country == "XX" {
+		return nil
+	}
+	return &country
+}
+
+// usage converts the token usage of a completion
+func usage(result *llm.ChatResult) *copilotpb.Usage {
+	return &copilotpb.Usage{
+		PromptTokens:     int32(result.PromptTokens),
+		CompletionTokens: int32(result.CompletionTokens),
+		TotalTokens:      int32(result.PromptTokens + result.CompletionTokens),
+	}
+}
+
+// completionID returns an OpenAI-style completion ID
+func completionID() string {
+	return fmt.Sprintf("chatcmpl-%d%06d", time.Now().Unix(), rand.Intn(1000000))
+}
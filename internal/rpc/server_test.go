@@ -0,0 +1,163 @@
+package rpc
+
+import (
+	"context"
+	"copilot-proxy/internal/llm"
+	"copilot-proxy/internal/rpc/copilotpb"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// upstreamRequests are the chat completion requests the fake Copilot API
+// received
+var upstreamRequests struct {
+	sync.Mutex
+	bodies []map[string]interface{}
+}
+
+// lastUpstreamRequest returns the last chat completion request sent upstream
+func lastUpstreamRequest() map[string]interface{} {
+	upstreamRequests.Lock()
+	defer upstreamRequests.Unlock()
+	if len(upstreamRequests.bodies) == 0 {
+		return nil
+	}
+	return upstreamRequests.bodies[len(upstreamRequests.bodies)-1]
+}
+
+// TestMain points the LLM service, whose configuration is loaded once per
+// process, at a fake Copilot API
+func TestMain(m *testing.M) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/models" {
+			fmt.Fprint(w, `{"data":[{"id":"test-model","name":"Test Model"}]}`)
+			return
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		upstreamRequests.Lock()
+		upstreamRequests.bodies = append(upstreamRequests.bodies, body)
+		upstreamRequests.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"lo\"},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":2,\"total_tokens\":5}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	os.Setenv("COPILOT_API_KEY", "test-key")
+	os.Setenv("COPILOT_API_URL", upstream.URL)
+	os.Setenv("DISABLE_AUTH", "true")
+	code := m.Run()
+	upstream.Close()
+	os.Exit(code)
+}
+
+// newTestClient serves the Copilot service in memory and returns a client
+// for it
+func newTestClient(t *testing.T) copilotpb.CopilotClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := NewGRPCServer(llm.NewLLMServerState("test-secret"), nil)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return copilotpb.NewCopilotClient(conn)
+}
+
+func TestServer(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	temperature := 0.5
+	request := &copilotpb.ChatRequest{
+		Model:       "test-model",
+		Messages:    []*copilotpb.Message{{Role: "user", Content: "hi"}},
+		Temperature: &temperature,
+	}
+
+	t.Run("Chat", func(t *testing.T) {
+		resp, err := client.Chat(ctx, request)
+		if err != nil {
+			t.Fatalf("Chat() error = %v", err)
+		}
+		if resp.Message.GetContent() != "Hello" || resp.FinishReason != "stop" || resp.Usage.GetTotalTokens() != 5 {
+			t.Errorf("Chat() = %v", resp)
+		}
+		upstream := lastUpstreamRequest()
+		if upstream["model"] != "test-model" || upstream["temperature"] != 0.5 {
+			t.Errorf("upstream request = %v", upstream)
+		}
+		if _, ok := upstream["top_p"]; ok {
+			t.Errorf("unset top_p was sent upstream: %v", upstream)
+		}
+	})
+
+	t.Run("StreamChat", func(t *testing.T) {
+		stream, err := client.StreamChat(ctx, request)
+		if err != nil {
+			t.Fatalf("StreamChat() error = %v", err)
+		}
+		var content strings.Builder
+		var last *copilotpb.ChatChunk
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Recv() error = %v", err)
+			}
+			content.WriteString(chunk.Content)
+			last = chunk
+		}
+		if content.String() != "Hello" || last.GetFinishReason() != "stop" || last.GetUsage().GetTotalTokens() != 5 {
+			t.Errorf("streamed %q, last chunk %v", content.String(), last)
+		}
+	})
+
+	t.Run("ListModels", func(t *testing.T) {
+		resp, err := client.ListModels(ctx, &copilotpb.ListModelsRequest{})
+		if err != nil {
+			t.Fatalf("ListModels() error = %v", err)
+		}
+		if len(resp.Models) != 1 || resp.Models[0].Id != "test-model" || resp.Models[0].Name != "Test Model" {
+			t.Errorf("ListModels() = %v", resp.Models)
+		}
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		_, err := client.Chat(ctx, &copilotpb.ChatRequest{Model: "test-model"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Chat() without messages error = %v, want InvalidArgument", err)
+		}
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		os.Setenv("DISABLE_AUTH", "false")
+		defer os.Setenv("DISABLE_AUTH", "true")
+		_, err := client.ListModels(ctx, &copilotpb.ListModelsRequest{})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("ListModels() without a key error = %v, want Unauthenticated", err)
+		}
+	})
+}
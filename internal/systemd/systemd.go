@@ -0,0 +1,153 @@
+// Package systemd integrates the proxy with systemd services.
+//
+// With socket activation systemd opens the listening sockets and passes them
+// to the service, which can then be started on the first connection and
+// restarted without refusing connections. The readiness notification
+// (sd_notify) lets systemd, and units ordered after the proxy, wait until
+// the listeners are up, and the watchdog restarts a proxy that hangs.
+//
+// The protocol is configured by systemd through:
+//   - LISTEN_PID, LISTEN_FDS, LISTEN_FDNAMES: the sockets passed from fd 3 on
+//     and their FileDescriptorName= names
+//   - NOTIFY_SOCKET: where state changes are sent (Type=notify)
+//   - WATCHDOG_USEC, WATCHDOG_PID: the watchdog interval (WatchdogSec=)
+//
+// Everything is a no-op when the proxy does not run under systemd.
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States sent with Notify
+const (
+	// Ready reports that startup is complete and the listeners are up
+	Ready = "READY=1"
+	// Reloading reports that the configuration is being reloaded; Ready ends it
+	Reloading = "RELOADING=1"
+	// Stopping reports that the service is shutting down
+	Stopping = "STOPPING=1"
+	// Watchdog keeps the watchdog from restarting the service
+	Watchdog = "WATCHDOG=1"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// Listener is a listening socket passed by socket activation
+type Listener struct {
+	net.Listener
+	// Name is the FileDescriptorName= of the socket, or the socket unit's
+	// name if it has none
+	Name string
+}
+
+// Listeners returns the sockets passed to this process by systemd socket
+// activation, or none if the process was not socket activated. The
+// environment variables are removed, so child processes do not take the
+// sockets for their own.
+func Listeners() ([]Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]Listener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// FileListener duplicates the descriptor, so the original is closed
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket activation: fd %d (%s) is not a listening socket: %w", fd, name, err)
+		}
+		listeners = append(listeners, Listener{Listener: listener, Name: name})
+	}
+	return listeners, nil
+}
+
+// Notify sends a state change such as Ready to systemd. It does nothing
+// when NOTIFY_SOCKET is unset, i.e. when not running as a Type=notify
+// service.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	// A leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		addr.Name = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	return nil
+}
+
+// WatchdogInterval returns the interval within which systemd expects a
+// Watchdog notification, or 0 if the watchdog is not enabled for this
+// process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// StartWatchdog notifies the watchdog at half its interval until ctx is
+// done. It reports whether the watchdog is enabled.
+func StartWatchdog(ctx context.Context) bool {
+	interval := WatchdogInterval()
+	if interval <= 0 {
+		return false
+	}
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := Notify(Watchdog); err != nil {
+					log.Printf("Warning: %v", err)
+				}
+			}
+		}
+	}()
+	return true
+}
@@ -0,0 +1,88 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify creates a notification socket and points NOTIFY_SOCKET at it
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unavailable: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func readState(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no notification received: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify(Ready); err != nil {
+		t.Errorf("Notify without NOTIFY_SOCKET: %v", err)
+	}
+
+	conn := listenNotify(t)
+	if err := Notify(Ready); err != nil {
+		t.Fatal(err)
+	}
+	if state := readState(t, conn); state != Ready {
+		t.Errorf("state = %q, want %q", state, Ready)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if WatchdogInterval() != 0 || StartWatchdog(context.Background()) {
+		t.Error("watchdog enabled without WATCHDOG_USEC")
+	}
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", "1")
+	if os.Getpid() != 1 && WatchdogInterval() != 0 {
+		t.Error("watchdog enabled for another process")
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := WatchdogInterval(); interval != 100*time.Millisecond {
+		t.Errorf("WatchdogInterval() = %v, want 100ms", interval)
+	}
+
+	conn := listenNotify(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !StartWatchdog(ctx) {
+		t.Fatal("watchdog not started")
+	}
+	if state := readState(t, conn); state != Watchdog {
+		t.Errorf("state = %q, want %q", state, Watchdog)
+	}
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := Listeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("Listeners() for another process = %v, %v", listeners, err)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Error("LISTEN_FDS was not removed")
+	}
+}
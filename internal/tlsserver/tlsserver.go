@@ -0,0 +1,300 @@
+// Package tlsserver lets the proxy terminate HTTPS itself.
+//
+// The certificate and key are read from PEM files and reloaded when either
+// file changes, so renewed certificates (e.g. from certbot) are picked up
+// without a restart. For local use a self-signed certificate can be generated
+// on first start.
+//
+// With a client CA the listener also authenticates clients by certificate
+// (mutual TLS). ClientIdentity names the client of a verified certificate,
+// which the proxy uses in place of an API key for rate limits, usage records
+// and the access log.
+//
+// The server is configured with:
+//   - TLS_CERT_FILE: PEM certificate (chain) file
+//   - TLS_KEY_FILE: PEM private key file
+//   - TLS_SELF_SIGNED: "true" or "1" to generate a self-signed certificate
+//     when the files do not exist (default location: copilot-proxy/tls in the
+//     user configuration directory)
+//   - TLS_CLIENT_CA_FILE: PEM file of the CA certificates client certificates
+//     must be issued by; setting it requires HTTPS
+//   - TLS_CLIENT_AUTH: "require" (default) to reject clients without a valid
+//     certificate or "optional" to let them authenticate with API keys
+package tlsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadCheckInterval limits how often the certificate files are checked for
+// changes during handshakes
+const reloadCheckInterval = 5 * time.Second
+
+// selfSignedValidity is how long a generated certificate is valid
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// Config controls HTTPS serving
+type Config struct {
+	// CertFile and KeyFile are the PEM certificate and private key
+	CertFile string
+	KeyFile  string
+	// SelfSigned generates a self-signed certificate when the files are missing
+	SelfSigned bool
+	// ClientCAFile holds the CA certificates client certificates are verified
+	// against; empty disables client authentication
+	ClientCAFile string
+	// ClientCertOptional accepts clients without a certificate; certificates
+	// that are presented must still be valid
+	ClientCertOptional bool
+}
+
+// ConfigFromEnv reads TLS_CERT_FILE, TLS_KEY_FILE, TLS_SELF_SIGNED,
+// TLS_CLIENT_CA_FILE and TLS_CLIENT_AUTH
+func ConfigFromEnv() (Config, error) {
+	selfSigned := os.Getenv("TLS_SELF_SIGNED")
+	config := Config{
+		CertFile:     os.Getenv("TLS_CERT_FILE"),
+		KeyFile:      os.Getenv("TLS_KEY_FILE"),
+		SelfSigned:   selfSigned == "true" || selfSigned == "1",
+		ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+	}
+	switch clientAuth := strings.ToLower(strings.TrimSpace(os.Getenv("TLS_CLIENT_AUTH"))); clientAuth {
+	case "", "require":
+	case "optional":
+		config.ClientCertOptional = true
+	default:
+		return config, fmt.Errorf("invalid TLS_CLIENT_AUTH %q: use require or optional", clientAuth)
+	}
+	return config, nil
+}
+
+// Enabled reports whether HTTPS is configured. A client CA alone counts, so
+// that NewTLSConfig reports the missing certificate instead of client
+// authentication being silently skipped.
+func (c Config) Enabled() bool {
+	return c.SelfSigned || c.CertFile != "" || c.KeyFile != "" || c.ClientCAFile != ""
+}
+
+// NewTLSConfig returns a server TLS configuration serving the configured
+// certificate, generating a self-signed one first if requested.
+func NewTLSConfig(c Config) (*tls.Config, error) {
+	if c.SelfSigned && (c.CertFile == "" || c.KeyFile == "") {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine certificate location: %w", err)
+		}
+		if c.CertFile == "" {
+			c.CertFile = filepath.Join(dir, "copilot-proxy", "tls", "cert.pem")
+		}
+		if c.KeyFile == "" {
+			c.KeyFile = filepath.Join(dir, "copilot-proxy", "tls", "key.pem")
+		}
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("both a TLS certificate and key file are required")
+	}
+
+	if c.SelfSigned {
+		_, certErr := os.Stat(c.CertFile)
+		_, keyErr := os.Stat(c.KeyFile)
+		if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+			if err := GenerateSelfSigned(c.CertFile, c.KeyFile, defaultHosts()); err != nil {
+				return nil, err
+			}
+			log.Printf("Generated a self-signed TLS certificate in %s", c.CertFile)
+		}
+	}
+
+	reloader := &certReloader{certFile: c.CertFile, keyFile: c.KeyFile}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if c.ClientCAFile != "" {
+		pemData, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if c.ClientCertOptional {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return tlsConfig, nil
+}
+
+// ClientIdentity returns the identity of the client of a connection that
+// presented a verified certificate: the certificate's common name or, if it
+// has none, its first DNS, email or URI subject alternative name. It returns
+// "" for connections without a verified client certificate.
+func ClientIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := state.VerifiedChains[0][0]
+	switch {
+	case leaf.Subject.CommonName != "":
+		return leaf.Subject.CommonName
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0]
+	case len(leaf.EmailAddresses) > 0:
+		return leaf.EmailAddresses[0]
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String()
+	}
+	return ""
+}
+
+// certReloader serves a certificate from files and reloads it when the files
+// change. A certificate that fails to load is logged and the previous one is
+// kept.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) >= reloadCheckInterval {
+		r.checked = time.Now()
+		if modTime, err := r.latestModTime(); err == nil && !modTime.Equal(r.modTime) {
+			if err := r.loadLocked(); err != nil {
+				log.Printf("Warning: failed to reload TLS certificate, keeping the current one: %v", err)
+			} else {
+				log.Printf("Reloaded TLS certificate from %s", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// load reads the certificate and key
+func (r *certReloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked()
+}
+
+func (r *certReloader) loadLocked() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert, r.modTime, r.checked = &cert, modTime, time.Now()
+	return nil
+}
+
+// latestModTime returns the later modification time of the two files
+func (r *certReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read TLS certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read TLS key: %w", err)
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// defaultHosts are the names a self-signed certificate is issued for
+func defaultHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+// GenerateSelfSigned writes a self-signed ECDSA P-256 certificate for hosts
+// (DNS names or IP addresses) and its private key to certFile and keyFile.
+func GenerateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate TLS key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"copilot-proxy"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode TLS key: %w", err)
+	}
+
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0o600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0o644)
+}
+
+// writePEM writes a single PEM block, creating the parent directory
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package tlsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewTLSConfigSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem"), SelfSigned: true}
+	tlsConfig, err := NewTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewTLSConfig() error = %v", err)
+	}
+	if info, err := os.Stat(cfg.KeyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("key file = %v, %v, want mode 0600", info, err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	pemData, _ := os.ReadFile(cfg.CertFile)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pemData)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("GET over TLS error = %v", err)
+	}
+	resp.Body.Close()
+
+	// The existing certificate is reused
+	before, _ := os.ReadFile(cfg.CertFile)
+	if _, err := NewTLSConfig(cfg); err != nil {
+		t.Fatalf("NewTLSConfig() again error = %v", err)
+	}
+	if after, _ := os.ReadFile(cfg.CertFile); string(after) != string(before) {
+		t.Error("NewTLSConfig() regenerated an existing certificate")
+	}
+}
+
+func TestNewTLSConfigRequiresFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewTLSConfig(Config{CertFile: filepath.Join(dir, "cert.pem")}); err == nil {
+		t.Error("NewTLSConfig() without a key succeeded")
+	}
+	if _, err := NewTLSConfig(Config{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}); err == nil {
+		t.Error("NewTLSConfig() with missing files succeeded")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := GenerateSelfSigned(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	first, _ := r.GetCertificate(nil)
+
+	// Replace the certificate and make the change visible
+	if err := GenerateSelfSigned(certFile, keyFile, []string{"example.test"}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	// Changes are only checked every reloadCheckInterval
+	if cert, _ := r.GetCertificate(nil); cert != first {
+		t.Error("GetCertificate() reloaded before the check interval passed")
+	}
+	r.checked = time.Time{}
+	second, _ := r.GetCertificate(nil)
+	if second == first {
+		t.Fatal("GetCertificate() did not reload the changed certificate")
+	}
+	leaf, _ := x509.ParseCertificate(second.Certificate[0])
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "example.test" {
+		t.Errorf("reloaded certificate names = %v", leaf.DNSNames)
+	}
+
+	// A broken file keeps the current certificate
+	os.WriteFile(certFile, []byte("not a certificate"), 0o644)
+	os.Chtimes(certFile, later.Add(time.Minute), later.Add(time.Minute))
+	r.checked = time.Time{}
+	if cert, _ := r.GetCertificate(nil); cert != second {
+		t.Error("GetCertificate() dropped the certificate after a failed reload")
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := GenerateSelfSigned(certFile, keyFile, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A CA issuing a client certificate
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o644)
+	caCert, _ := x509.ParseCertificate(caDER)
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientDER, _ := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"build-agent.internal"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, &clientKey.PublicKey, caKey)
+	clientCert := tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+
+	serverPEM, _ := os.ReadFile(certFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverPEM)
+	get := func(optional bool, certs ...tls.Certificate) (string, error) {
+		tlsConfig, err := NewTLSConfig(Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientCertOptional: optional})
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, ClientIdentity(r.TLS))
+		}), ErrorLog: log.New(io.Discard, "", 0)}
+		go server.Serve(listener)
+		defer server.Close()
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := client.Get("https://" + listener.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	// Without a common name, the first SAN identifies the client
+	if identity, err := get(false, clientCert); err != nil || identity != "build-agent.internal" {
+		t.Errorf("client certificate: identity = %q, %v", identity, err)
+	}
+	if _, err := get(false); err == nil {
+		t.Error("a client without a certificate was accepted")
+	}
+	if identity, err := get(true); err != nil || identity != "" {
+		t.Errorf("optional client certificate: identity = %q, %v", identity, err)
+	}
+
+	t.Setenv("TLS_CLIENT_AUTH", "sometimes")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("ConfigFromEnv() accepted an invalid TLS_CLIENT_AUTH")
+	}
+}
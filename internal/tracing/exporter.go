@@ -0,0 +1,253 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBatchSize is the number of spans sent in one export request
+	maxBatchSize = 256
+	// maxQueueSize bounds buffered spans; spans are dropped when it is full
+	maxQueueSize = 2048
+	// flushInterval is how often buffered spans are exported
+	flushInterval = 5 * time.Second
+)
+
+// Config configures the OTLP/HTTP span exporter
+type Config struct {
+	// Endpoint is the full URL of the OTLP traces endpoint
+	Endpoint string
+	// Headers are added to every export request
+	Headers map[string]string
+	// ServiceName is reported as the service.name resource attribute
+	ServiceName string
+}
+
+// ConfigFromEnv builds the exporter configuration from the standard
+// OTEL_* environment variables. The endpoint is empty when tracing export
+// is not configured.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Endpoint:    os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		Headers:     make(map[string]string),
+		ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+	}
+	if cfg.Endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			cfg.Endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	for _, entry := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) != "" {
+			cfg.Headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "copilot-proxy"
+	}
+	return cfg
+}
+
+// tracer batches finished spans and exports them
+type tracer struct {
+	cfg    Config
+	client *http.Client
+	queue  chan *Span
+	flush  chan chan struct{}
+	done   chan struct{}
+}
+
+var (
+	tracerMu sync.RWMutex
+	active   *tracer
+)
+
+func currentTracer() *tracer {
+	tracerMu.RLock()
+	defer tracerMu.RUnlock()
+	return active
+}
+
+// Init starts exporting spans according to cfg and returns a function that
+// flushes pending spans and stops the exporter. With an empty endpoint,
+// export stays disabled and the returned function is a no-op.
+func Init(cfg Config) func(ctx context.Context) error {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }
+	}
+	t := &tracer{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *Span, maxQueueSize),
+		flush:  make(chan chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+
+	tracerMu.Lock()
+	active = t
+	tracerMu.Unlock()
+
+	return func(ctx context.Context) error {
+		tracerMu.Lock()
+		if active == t {
+			active = nil
+		}
+		tracerMu.Unlock()
+
+		flushed := make(chan struct{})
+		select {
+		case t.flush <- flushed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		close(t.done)
+		return nil
+	}
+}
+
+// export queues a finished span without blocking the caller
+func (t *tracer) export(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		// Dropping spans is preferable to slowing down requests
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	send := func() {
+		if len(batch) > 0 {
+			if err := t.send(batch); err != nil {
+				log.Printf("Warning: failed to export %d spans: %v", len(batch), err)
+			}
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-t.flush:
+			// Drain whatever is queued before acknowledging
+			for drained := false; !drained; {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			send()
+			close(flushed)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// send posts a batch of spans to the collector as OTLP JSON
+func (t *tracer) send(spans []*Span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// encode converts spans into an OTLP ExportTraceServiceRequest
+func (t *tracer) encode(spans []*Span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.context.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.context.SpanID[:]),
+			"name":              s.name,
+			"kind":              int(s.kind),
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        encodeAttributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.errMessage != "" {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.errMessage}
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": encodeAttributes([]Attribute{String("service.name", t.cfg.ServiceName)}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "copilot-proxy"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+// encodeAttributes converts attributes to OTLP KeyValue objects
+func encodeAttributes(attrs []Attribute) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]interface{}
+		switch v := a.Value.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": a.Key, "value": value})
+	}
+	return out
+}
@@ -0,0 +1,209 @@
+// Package tracing provides lightweight OpenTelemetry-compatible tracing.
+//
+// Spans are exported in batches to an OTLP/HTTP collector using the JSON
+// encoding, and trace context is propagated with W3C traceparent headers.
+// Without a configured exporter spans are still created and propagated, so
+// incoming trace IDs reach the upstream, but nothing is exported.
+//
+// The exporter is configured with the standard OpenTelemetry variables:
+//   - OTEL_EXPORTER_OTLP_TRACES_ENDPOINT: full URL of the traces endpoint
+//   - OTEL_EXPORTER_OTLP_ENDPOINT: base URL; "/v1/traces" is appended
+//   - OTEL_EXPORTER_OTLP_HEADERS: comma-separated key=value request headers
+//   - OTEL_SERVICE_NAME: service.name resource attribute (default "copilot-proxy")
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKind describes the relationship of a span to its remote parent or child
+type SpanKind int
+
+// Span kinds as defined by OTLP
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Attribute is a key/value pair attached to a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String creates a string attribute
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int creates an integer attribute
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+// Bool creates a boolean attribute
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span IDs are non-zero
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats the span context as a W3C traceparent header value
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// Span is a single timed operation
+type Span struct {
+	mu         sync.Mutex
+	name       string
+	kind       SpanKind
+	context    SpanContext
+	parentID   [8]byte
+	start      time.Time
+	end        time.Time
+	attributes []Attribute
+	errMessage string
+	ended      bool
+	tracer     *tracer
+}
+
+// Context returns the span's identifiers
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attrs...)
+}
+
+// RecordError marks the span as failed with the error's message. A nil
+// error is ignored.
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMessage = err.Error()
+}
+
+// End completes the span and queues it for export. Calling End more than
+// once has no effect.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.tracer != nil && s.context.Sampled {
+		s.tracer.export(s)
+	}
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span, or nil if there is none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+type remoteKey struct{}
+
+// Start creates a span as a child of the span (or remote parent) in ctx and
+// returns a context carrying the new span.
+func Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	span := &Span{
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: attrs,
+		tracer:     currentTracer(),
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.context.TraceID = parent.context.TraceID
+		span.context.Sampled = parent.context.Sampled
+		span.parentID = parent.context.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		span.context.TraceID = remote.TraceID
+		span.context.Sampled = remote.Sampled
+		span.parentID = remote.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	rand.Read(span.context.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Extract returns a context carrying the remote parent described by the
+// traceparent header, or ctx unchanged if the header is missing or invalid.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := ParseTraceParent(header.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject writes the traceparent header for the current span in ctx
+func Inject(ctx context.Context, header http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		header.Set("traceparent", span.context.TraceParent())
+	}
+}
+
+// ParseTraceParent parses a W3C traceparent header value
+func ParseTraceParent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&0x01 == 1
+	return sc, sc.IsValid()
+}
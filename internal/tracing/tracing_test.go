@@ -0,0 +1,136 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		wantOK      bool
+		wantSampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"short span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01", false, false},
+		{"not hex", "00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceParent(tt.value)
+			if ok != tt.wantOK {
+				t.Fatalf("ParseTraceParent(%q) ok = %v, want %v", tt.value, ok, tt.wantOK)
+			}
+			if ok && sc.Sampled != tt.wantSampled {
+				t.Errorf("Sampled = %v, want %v", sc.Sampled, tt.wantSampled)
+			}
+			if ok && sc.TraceParent() != tt.value {
+				t.Errorf("TraceParent() = %q, want %q", sc.TraceParent(), tt.value)
+			}
+		})
+	}
+}
+
+func TestStartPropagatesTrace(t *testing.T) {
+	incoming := http.Header{}
+	incoming.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, parent := Start(Extract(context.Background(), incoming), "server", SpanKindServer)
+	_, child := Start(ctx, "client", SpanKindClient)
+
+	if got := parent.Context().TraceParent()[3:35]; got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("parent trace id = %s, want incoming trace id", got)
+	}
+	if parent.parentID != [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7} {
+		t.Errorf("parent span is not a child of the remote span")
+	}
+	if child.Context().TraceID != parent.Context().TraceID || child.parentID != parent.Context().SpanID {
+		t.Error("child span does not continue the parent span")
+	}
+
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	if sc, ok := ParseTraceParent(outgoing.Get("traceparent")); !ok || sc.SpanID != parent.Context().SpanID {
+		t.Errorf("Inject() traceparent = %q, want parent span", outgoing.Get("traceparent"))
+	}
+}
+
+func TestStartWithoutParentCreatesRoot(t *testing.T) {
+	_, span := Start(context.Background(), "root", SpanKindInternal)
+	if !span.Context().IsValid() || !span.Context().Sampled {
+		t.Errorf("root span context = %+v, want valid sampled context", span.Context())
+	}
+	if span.parentID != [8]byte{} {
+		t.Error("root span should not have a parent")
+	}
+}
+
+func TestExportToCollector(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("X-Api-Key") != "secret" {
+			t.Errorf("unexpected export request %s with headers %v", r.URL.Path, r.Header)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer collector.Close()
+
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL+"/")
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "X-Api-Key=secret")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_HEADERS")
+
+	shutdown := Init(ConfigFromEnv())
+	_, span := Start(context.Background(), "PerformCompletion", SpanKindInternal, String("llm.model", "gpt-4o"))
+	span.RecordError(errors.New("upstream failed"))
+	span.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("shutdown() error = %v", err)
+	}
+
+	var body map[string]interface{}
+	select {
+	case body = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("collector received no spans")
+	}
+	encoded, _ := json.Marshal(body)
+	for _, want := range []string{
+		`"name":"PerformCompletion"`,
+		`"stringValue":"copilot-proxy"`,
+		`"key":"llm.model"`,
+		`"message":"upstream failed"`,
+		`"traceId":"`,
+	} {
+		if !strings.Contains(string(encoded), want) {
+			t.Errorf("export body missing %s: %s", want, encoded)
+		}
+	}
+}
+
+func TestInitWithoutEndpointIsNoop(t *testing.T) {
+	shutdown := Init(Config{})
+	if currentTracer() != nil {
+		t.Error("expected no active tracer without an endpoint")
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown() error = %v", err)
+	}
+}
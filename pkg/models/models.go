@@ -9,6 +9,10 @@ type LanguageModelProvider string
 const (
 	// ProviderCopilot represents the GitHub Copilot Chat API provider
 	ProviderCopilot LanguageModelProvider = "copilot"
+	// ProviderOpenAI represents the OpenAI API, used for models Copilot does not offer
+	ProviderOpenAI LanguageModelProvider = "openai"
+	// ProviderAnthropic represents the Anthropic Messages API, used for Claude models
+	ProviderAnthropic LanguageModelProvider = "anthropic"
 )
 
 // LanguageModel contains metadata about the Copilot LLM including its capabilities and rate limits.
@@ -29,6 +33,8 @@ type LanguageModel struct {
 	MaxOutputTokensPerMinute int `json:"max_output_tokens_per_minute"`
 	// MaxTokensPerDay is the maximum total tokens allowed per day
 	MaxTokensPerDay int `json:"max_tokens_per_day"`
+	// ContextWindow is the maximum number of tokens of a request, if known
+	ContextWindow int `json:"context_window,omitempty"`
 	// Enabled indicates if the model is currently available for use
 	Enabled bool `json:"enabled"`
 }
@@ -90,4 +96,53 @@ type LLMToken struct {
 	MaxMonthlySpendInCents uint32 `json:"max_monthly_spend_in_cents"`
 	// CustomMonthlyAllowanceInCents is the custom monthly allowance in cents
 	CustomMonthlyAllowanceInCents *uint32 `json:"custom_monthly_allowance_in_cents,omitempty"`
+	// AllowedModels restricts the models the token may use; empty allows all
+	AllowedModels []string `json:"allowed_models,omitempty"`
+	// NoStreaming rejects streaming completion requests
+	NoStreaming bool `json:"no_streaming,omitempty"`
+	// KeyID is the ID of the stored API key the token was issued for; zero
+	// for other tokens
+	KeyID uint64 `json:"key_id,omitempty"`
+	// Tenant is the tenant the token's key belongs to, if any
+	Tenant string `json:"tenant,omitempty"`
+	// TenantModels restricts the models further to those of the tenant;
+	// empty allows all
+	TenantModels []string `json:"tenant_models,omitempty"`
+}
+
+// UsageEvent is a single completion request recorded for usage accounting.
+type UsageEvent struct {
+	// Time is when the request was recorded
+	Time time.Time `json:"timestamp"`
+	// Key identifies the API key (user) that made the request
+	Key string `json:"key"`
+	// Model is the model that served the request
+	Model string `json:"model"`
+	// InputTokens counts prompt tokens
+	InputTokens int `json:"input_tokens"`
+	// OutputTokens counts generated tokens
+	OutputTokens int `json:"output_tokens"`
+	// LatencyMs is how long the upstream took to respond, in milliseconds
+	LatencyMs int64 `json:"latency_ms"`
+	// EstimatedCostUSD is the cost of the request at the model prices in
+	// effect when it was made
+	EstimatedCostUSD float64 `json:"estimated_cost_usd"`
+}
+
+// UsageAggregate summarizes usage of one model by one API key over a time window.
+type UsageAggregate struct {
+	// Key identifies the API key (user) the usage belongs to
+	Key string `json:"key"`
+	// Model is the model the usage was recorded for
+	Model string `json:"model"`
+	// Requests counts completion requests
+	Requests int `json:"requests"`
+	// InputTokens counts prompt tokens
+	InputTokens int `json:"input_tokens"`
+	// OutputTokens counts generated tokens
+	OutputTokens int `json:"output_tokens"`
+	// TotalTokens is the sum of input and output tokens
+	TotalTokens int `json:"total_tokens"`
+	// EstimatedCostUSD is the cost of the tokens at the configured model prices
+	EstimatedCostUSD float64 `json:"estimated_cost_usd"`
 }
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxRequestBodyBytes is the request body limit without
+// MAX_REQUEST_BODY_BYTES: 32 MiB leaves room for base64 images in chat
+// completions.
+const DefaultMaxRequestBodyBytes int64 = 32 << 20
+
+// MaxRequestBodyBytes returns the request body limit from
+// MAX_REQUEST_BODY_BYTES, or DefaultMaxRequestBodyBytes if it is unset or
+// invalid.
+func MaxRequestBodyBytes() int64 {
+	limit, err := strconv.ParseInt(os.Getenv("MAX_REQUEST_BODY_BYTES"), 10, 64)
+	if err != nil || limit <= 0 {
+		return DefaultMaxRequestBodyBytes
+	}
+	return limit
+}
+
+// LimitRequestBody wraps a handler so that request bodies larger than limit
+// bytes cannot be read. Requests declaring a larger Content-Length are
+// rejected with an OpenAI-style 413 error up front; reading a larger
+// chunked body fails with an error IsRequestBodyTooLarge recognizes.
+func LimitRequestBody(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			WriteRequestBodyTooLarge(w, limit)
+			return
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IsRequestBodyTooLarge reports whether err is the error of reading a body
+// past the limit of LimitRequestBody
+func IsRequestBodyTooLarge(err error) bool {
+	// http.MaxBytesError is only available from Go 1.19
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// WriteRequestBodyTooLarge writes the OpenAI-style 413 error of a request
+// body over limit bytes
+func WriteRequestBodyTooLarge(w http.ResponseWriter, limit int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": fmt.Sprintf("request body exceeds the limit of %d bytes", limit),
+			"type":    "invalid_request_error",
+			"param":   nil,
+			"code":    "request_too_large",
+		},
+	})
+}
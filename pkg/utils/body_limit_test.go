@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitRequestBody(t *testing.T) {
+	handler := LimitRequestBody(10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if IsRequestBodyTooLarge(err) {
+			WriteRequestBodyTooLarge(w, 10)
+			return
+		}
+		w.Write(body)
+	}))
+
+	tests := []struct {
+		name    string
+		body    io.Reader
+		want    int
+		chunked bool
+	}{
+		{"within the limit", strings.NewReader("0123456789"), http.StatusOK, false},
+		{"declared too large", strings.NewReader("0123456789a"), http.StatusRequestEntityTooLarge, false},
+		{"chunked too large", io.MultiReader(strings.NewReader("01234"), strings.NewReader("56789a")), http.StatusRequestEntityTooLarge, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/chat/completions", tt.body)
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusRequestEntityTooLarge && !strings.Contains(w.Body.String(), `"code":"request_too_large"`) {
+				t.Errorf("body = %s, want an OpenAI-style error", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	clientIDsOnce    sync.Once
+	clientMachineID  string
+	clientSessionID  string
+	machineIDPathFor = MachineIDPath
+)
+
+// MachineIDPath returns where the generated VS Code machine ID is kept:
+// machine_id in copilot-proxy under the user configuration directory
+func MachineIDPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "copilot-proxy", "machine_id"), nil
+}
+
+// ClientIDs returns the Vscode-Machineid and Vscode-Sessionid sent to the
+// Copilot API, so the proxy looks like one consistent VS Code client:
+// VSCODE_MACHINE_ID and VSCODE_SESSION_ID when set, else a machine ID that
+// is generated once and kept in MachineIDPath and a session ID that is new
+// for every run. Both are generated the way VS Code does.
+func ClientIDs() (machineID, sessionID string) {
+	clientIDsOnce.Do(func() {
+		clientMachineID = loadMachineID()
+		clientSessionID = uuid.New().String() + fmt.Sprint(time.Now().UnixNano()/int64(time.Millisecond))
+	})
+	machineID, sessionID = clientMachineID, clientSessionID
+	if v := os.Getenv("VSCODE_MACHINE_ID"); v != "" {
+		machineID = v
+	}
+	if v := os.Getenv("VSCODE_SESSION_ID"); v != "" {
+		sessionID = v
+	}
+	return machineID, sessionID
+}
+
+// loadMachineID reads the persisted machine ID or generates and stores a new
+// one. A machine ID that cannot be stored is only used for this run.
+func loadMachineID() string {
+	path, err := machineIDPathFor()
+	if err == nil {
+		if data, err := os.ReadFile(path); err == nil {
+			if id := strings.TrimSpace(string(data)); isMachineID(id) {
+				return id
+			}
+		}
+	}
+
+	// Two random UUIDs without dashes make the 64 hex digits VS Code uses
+	id := strings.ReplaceAll(uuid.New().String()+uuid.New().String(), "-", "")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+		if err == nil {
+			err = os.WriteFile(path, []byte(id+"\n"), 0o600)
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: failed to store the machine ID, a new one is used on every run: %v", err)
+	}
+	return id
+}
+
+// isMachineID reports whether id looks like a VS Code machine ID, 64
+// lowercase hexadecimal digits
+func isMachineID(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil && strings.ToLower(id) == id
+}
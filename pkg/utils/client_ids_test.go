@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestClientIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "copilot-proxy", "machine_id")
+	run := func() (string, string) {
+		clientIDsOnce = sync.Once{}
+		machineIDPathFor = func() (string, error) { return path, nil }
+		return ClientIDs()
+	}
+	defer func() {
+		clientIDsOnce = sync.Once{}
+		machineIDPathFor = MachineIDPath
+	}()
+	t.Setenv("VSCODE_MACHINE_ID", "")
+	t.Setenv("VSCODE_SESSION_ID", "")
+
+	machineID, sessionID := run()
+	if !isMachineID(machineID) {
+		t.Fatalf("generated machine ID %q is not 64 hex digits", machineID)
+	}
+	if sessionID == "" {
+		t.Fatal("no session ID generated")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != machineID+"\n" {
+		t.Fatalf("stored machine ID = %q, %v", data, err)
+	}
+
+	// The next run keeps the machine ID and starts a new session
+	nextMachineID, nextSessionID := run()
+	if nextMachineID != machineID {
+		t.Errorf("machine ID changed across runs: %q, then %q", machineID, nextMachineID)
+	}
+	if nextSessionID == sessionID {
+		t.Errorf("session ID %q reused across runs", sessionID)
+	}
+
+	// A damaged file is replaced
+	if err := os.WriteFile(path, []byte("not-an-id\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := run(); !isMachineID(id) || id == machineID {
+		t.Errorf("machine ID after a damaged file = %q", id)
+	}
+
+	// Configured IDs take precedence
+	t.Setenv("VSCODE_MACHINE_ID", "configured-machine")
+	t.Setenv("VSCODE_SESSION_ID", "configured-session")
+	if machineID, sessionID := run(); machineID != "configured-machine" || sessionID != "configured-session" {
+		t.Errorf("ClientIDs() with environment = %q, %q", machineID, sessionID)
+	}
+}
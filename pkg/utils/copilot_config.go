@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -37,10 +36,10 @@ type TokenInfo struct {
 // GetCopilotToken retrieves the GitHub Copilot access token from the local config file.
 // This allows the application to use the same authentication as the official GitHub Copilot client.
 //
-// The function looks for a config file at the standard location for the current platform:
-// - Windows: %APPDATA%\GitHub Copilot\apps.json
-// - macOS: ~/.config/github-copilot/apps.json
-// - Linux: ~/.config/github-copilot/apps.json
+// The function looks for config files at the standard locations for the current platform
+// and returns the unexpired token that expires last, see discoverCopilotCredentials:
+// - Windows: %APPDATA%\GitHub Copilot\apps.json and %LOCALAPPDATA%\github-copilot
+// - macOS and Linux: ~/.config/github-copilot/apps.json (or $XDG_CONFIG_HOME/github-copilot)
 //
 // The token retrieved is in the format:
 // tid=<token-id>;exp=<expiration-timestamp>;sku=<subscription-type>;proxy-ep=<proxy-endpoint>;st=<status>;
@@ -56,64 +55,20 @@ type TokenInfo struct {
 //	}
 //	// Use token for API authentication
 func GetCopilotToken() (string, error) {
-	configPath, err := getCopilotConfigPath()
+	credentials, err := discoverCopilotCredentials()
 	if err != nil {
 		return "", err
 	}
-
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return "", err
-	}
-
-	var config CopilotConfig
-	if err := json.Unmarshal(data, &config); err != nil {
-		return "", err
-	}
-
-	// Find any valid token (typically there's only one)
-	for _, tokenInfo := range config.Tokens {
-		if tokenInfo.Token != "" {
-			return tokenInfo.Token, nil
-		}
+	if apiKey, ok := freshestAPIKey(credentials, time.Now()); ok {
+		return apiKey.APIKey, nil
 	}
-
 	return "", errors.New("no valid GitHub Copilot token found in config")
 }
 
-// getCopilotConfigPath returns the path to the GitHub Copilot config file based on the OS.
-// Internal helper function that determines the correct path for the current platform.
-func getCopilotConfigPath() (string, error) {
-	var configDir string
-
-	// Determine the config directory based on the operating system
-	switch runtime.GOOS {
-	case "windows":
-		appData := os.Getenv("APPDATA")
-		if appData == "" {
-			return "", errors.New("APPDATA environment variable not set")
-		}
-		configDir = filepath.Join(appData, "GitHub Copilot")
-	case "darwin":
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return "", err
-		}
-		configDir = filepath.Join(home, ".config", "github-copilot")
-	default: // Linux and other Unix-like systems
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return "", err
-		}
-		configDir = filepath.Join(home, ".config", "github-copilot")
-	}
-
-	return filepath.Join(configDir, "apps.json"), nil
-}
-
 // GetCopilotOAuthToken attempts to read a GitHub OAuth token from various sources.
-// It checks environment variables (COPILOT_OAUTH_TOKEN or OAUTH_TOKEN) and will
-// eventually try to read from the VS Code GitHub Copilot extension configuration.
+// It checks environment variables (COPILOT_OAUTH_TOKEN or OAUTH_TOKEN), then
+// the token saved by "coproxy login" (see SaveCopilotOAuthToken) and finally
+// the credentials of the VS Code, JetBrains or Vim GitHub Copilot plugins.
 //
 // Returns the OAuth token if found, or an empty string and error if not found.
 func GetCopilotOAuthToken() (string, error) {
@@ -134,10 +89,92 @@ func GetCopilotOAuthToken() (string, error) {
 		return oauthToken, nil
 	}
 
-	// TODO: Add logic to extract OAuth token from VS Code Copilot extension
-	// This would require reading the configuration files
+	// Then fall back to the token saved by "coproxy login"
+	if oauthToken, err := loadSavedOAuthToken(); err == nil && oauthToken != "" {
+		fmt.Printf("Found OAuth token saved by login: %s\n", maskToken(oauthToken))
+		return oauthToken, nil
+	}
+
+	// Finally reuse the sign-in of a GitHub Copilot editor plugin
+	if oauthToken, path, err := getPluginOAuthToken(); err == nil {
+		fmt.Printf("Found OAuth token of the GitHub Copilot plugin in %s: %s\n", path, maskToken(oauthToken))
+		return oauthToken, nil
+	}
+
+	return "", errors.New("no OAuth token found in environment variables or Copilot plugin configs; run \"coproxy login\" to sign in")
+}
 
-	return "", errors.New("no OAuth token found in environment variables")
+// savedOAuthToken is the file written by SaveCopilotOAuthToken
+type savedOAuthToken struct {
+	OAuthToken string    `json:"oauth_token"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// OAuthTokenPath returns where SaveCopilotOAuthToken stores the OAuth token
+// without a keychain: oauth_token.json in copilot-proxy under the user
+// configuration directory
+func OAuthTokenPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "copilot-proxy", "oauth_token.json"), nil
+}
+
+// SaveCopilotOAuthToken stores a GitHub OAuth token where GetCopilotOAuthToken
+// finds it: in the system keychain or, if none is available or TOKEN_STORE is
+// "file", in a file readable only by the current user. It returns where the
+// token was stored.
+func SaveCopilotOAuthToken(token string) (string, error) {
+	path, err := OAuthTokenPath()
+	if err != nil {
+		return "", err
+	}
+	keychainErr := keychainSet(oauthTokenAccount, token)
+	if keychainErr == nil {
+		// Do not leave an older plaintext copy behind
+		os.Remove(path)
+		return "the system keychain", nil
+	}
+	if tokenStore() == "keychain" {
+		return "", keychainErr
+	}
+
+	data, err := json.MarshalIndent(savedOAuthToken{OAuthToken: token, CreatedAt: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// loadSavedOAuthToken reads the token stored by SaveCopilotOAuthToken
+func loadSavedOAuthToken() (string, error) {
+	if token, err := keychainGet(oauthTokenAccount); err == nil {
+		return token, nil
+	}
+	if tokenStore() == "keychain" {
+		return "", errors.New("no OAuth token in the system keychain")
+	}
+	path, err := OAuthTokenPath()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var saved savedOAuthToken
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return saved.OAuthToken, nil
 }
 
 // maskToken masks most of a token for safe logging, showing only the first 4 and last 4 characters
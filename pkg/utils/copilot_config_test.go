@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zalando/go-keyring"
+)
+
+func TestGetCopilotOAuthTokenFromPlugins(t *testing.T) {
+	keyring.MockInit()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("TOKEN_STORE", "file")
+	t.Setenv("COPILOT_OAUTH_TOKEN", "")
+	t.Setenv("OAUTH_TOKEN", "")
+	t.Setenv("GITHUB_HOST", "")
+
+	if _, err := GetCopilotOAuthToken(); err == nil {
+		t.Fatal("GetCopilotOAuthToken() without any credentials succeeded")
+	}
+
+	// Older JetBrains plugins write hosts.json keyed by the bare host
+	dir := filepath.Join(home, ".config", "github-copilot")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	hosts := `{"octo.ghe.com": {"user": "octocat", "oauth_token": "ghu_enterprise"}, "github.com": {"user": "octocat", "oauth_token": "ghu_hosts"}}`
+	if err := os.WriteFile(filepath.Join(dir, "hosts.json"), []byte(hosts), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := GetCopilotOAuthToken(); err != nil || token != "ghu_hosts" {
+		t.Errorf("GetCopilotOAuthToken() from hosts.json = %q, %v", token, err)
+	}
+
+	t.Setenv("GITHUB_HOST", "octo.ghe.com")
+	if token, err := GetCopilotOAuthToken(); err != nil || token != "ghu_enterprise" {
+		t.Errorf("GetCopilotOAuthToken() for GITHUB_HOST = %q, %v", token, err)
+	}
+	t.Setenv("GITHUB_HOST", "")
+
+	// apps.json keyed by host and app ID takes precedence
+	apps := `{"github.com:Iv1.b507a08c87ecfe98": {"user": "octocat", "oauth_token": "ghu_apps", "githubAppId": "Iv1.b507a08c87ecfe98"}}`
+	if err := os.WriteFile(filepath.Join(dir, "apps.json"), []byte(apps), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := GetCopilotOAuthToken(); err != nil || token != "ghu_apps" {
+		t.Errorf("GetCopilotOAuthToken() from apps.json = %q, %v", token, err)
+	}
+
+	// Environment variables still win
+	t.Setenv("COPILOT_OAUTH_TOKEN", "gho_env")
+	if token, err := GetCopilotOAuthToken(); err != nil || token != "gho_env" {
+		t.Errorf("GetCopilotOAuthToken() with COPILOT_OAUTH_TOKEN = %q, %v", token, err)
+	}
+}
+
+func TestParseCopilotConfigLayouts(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name      string
+		data      string
+		wantHost  string
+		wantOAuth string
+		wantKey   string
+	}{
+		{"legacy tokens", fmt.Sprintf(`{"tokens": {"github": {"token": "tid=1;exp=%d;sku=free;", "provider_id": "github"}}}`, exp), "", "", fmt.Sprintf("tid=1;exp=%d;sku=free;", exp)},
+		{"hosts", `{"github.com": {"user": "octocat", "oauth_token": "ghu_hosts"}}`, "github.com", "ghu_hosts", ""},
+		{"apps", `{"github.com:Iv1.b507a08c87ecfe98": {"user": "octocat", "oauth_token": "ghu_apps"}}`, "github.com", "ghu_apps", ""},
+		{"versioned", `{"version": 2, "hosts": {"github.com": {"user": "octocat", "oauth_token": "ghu_v2"}}}`, "github.com", "ghu_v2", ""},
+		{"malformed", `[]`, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credentials := parseCopilotConfig([]byte(tt.data), "config.json", time.Now())
+			if tt.wantOAuth == "" && tt.wantKey == "" {
+				if len(credentials) != 0 {
+					t.Errorf("parseCopilotConfig() = %+v, want none", credentials)
+				}
+				return
+			}
+			if len(credentials) != 1 {
+				t.Fatalf("parseCopilotConfig() = %+v, want one credential", credentials)
+			}
+			c := credentials[0]
+			if c.Host != tt.wantHost || c.OAuthToken != tt.wantOAuth || c.APIKey != tt.wantKey {
+				t.Errorf("parseCopilotConfig() = %+v", c)
+			}
+			if tt.wantKey != "" && c.ExpiresAt.Unix() != exp {
+				t.Errorf("ExpiresAt = %v, want %d", c.ExpiresAt, exp)
+			}
+		})
+	}
+}
+
+func TestDiscoveryPicksFreshestToken(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GITHUB_HOST", "")
+	dir := filepath.Join(home, ".config", "github-copilot")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	expired := fmt.Sprintf("tid=old;exp=%d;sku=free;", now.Add(-time.Hour).Unix())
+	soon := fmt.Sprintf("tid=soon;exp=%d;sku=free;", now.Add(10*time.Minute).Unix())
+	later := fmt.Sprintf("tid=later;exp=%d;sku=free;", now.Add(time.Hour).Unix())
+	apps := fmt.Sprintf(`{"tokens": {"a": {"token": %q}, "b": {"token": %q}}, "github.com": {"oauth_token": "ghu_stale"}}`, expired, soon)
+	hosts := fmt.Sprintf(`{"version": 2, "hosts": {"github.com": {"oauth_token": "ghu_fresh", "token": %q}}}`, later)
+	write := func(name, data string, modTime time.Time) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("apps.json", apps, now.Add(-time.Hour))
+	write("hosts.json", hosts, now)
+
+	if token, err := GetCopilotToken(); err != nil || token != later {
+		t.Errorf("GetCopilotToken() = %q, %v, want %q", token, err, later)
+	}
+	if token, path, err := getPluginOAuthToken(); err != nil || token != "ghu_fresh" || filepath.Base(path) != "hosts.json" {
+		t.Errorf("getPluginOAuthToken() = %q, %q, %v", token, path, err)
+	}
+
+	write("apps.json", fmt.Sprintf(`{"tokens": {"a": {"token": %q}}}`, expired), now)
+	write("hosts.json", `{}`, now)
+	if token, err := GetCopilotToken(); err == nil {
+		t.Errorf("GetCopilotToken() with only expired tokens = %q", token)
+	}
+}
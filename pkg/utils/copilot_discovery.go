@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// copilotConfigFiles are the credential files written by GitHub Copilot
+// clients, in the order they are tried: apps.json, written by VS Code and
+// current JetBrains plugins, and hosts.json, written by older JetBrains and
+// Vim plugins as well as newer clients
+var copilotConfigFiles = []string{"apps.json", "hosts.json"}
+
+// copilotCredential is a token found in a GitHub Copilot client config file
+type copilotCredential struct {
+	// Path is the file the token was read from
+	Path string
+	// Host is the GitHub host the token belongs to; empty for entries of the
+	// legacy "tokens" layout
+	Host string
+	// OAuthToken is a GitHub OAuth token that can be exchanged for API keys
+	OAuthToken string
+	// APIKey is a Copilot API key and ExpiresAt its expiry
+	APIKey    string
+	ExpiresAt time.Time
+	// UpdatedAt is when the file was last written
+	UpdatedAt time.Time
+}
+
+// copilotConfigEntry is a per-host or per-provider entry of a config file.
+// Host entries are keyed by GitHub host, optionally followed by ":" and the
+// OAuth app ID, e.g. "github.com:Iv1.b507a08c87ecfe98".
+type copilotConfigEntry struct {
+	User       string `json:"user"`
+	OAuthToken string `json:"oauth_token"`
+	Token      string `json:"token"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+// copilotConfigDirs returns the directories where GitHub Copilot plugins keep
+// their credentials. VS Code uses "GitHub Copilot" under %APPDATA% on Windows;
+// the JetBrains plugin uses github-copilot under %LOCALAPPDATA% on Windows.
+// Elsewhere both use github-copilot under $XDG_CONFIG_HOME or ~/.config.
+func copilotConfigDirs() ([]string, error) {
+	if runtime.GOOS == "windows" {
+		var dirs []string
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			dirs = append(dirs, filepath.Join(appData, "GitHub Copilot"))
+		}
+		if localAppData := os.Getenv("LOCALAPPDATA"); localAppData != "" {
+			dirs = append(dirs, filepath.Join(localAppData, "github-copilot"))
+		}
+		if len(dirs) == 0 {
+			return nil, errors.New("APPDATA environment variable not set")
+		}
+		return dirs, nil
+	}
+
+	var dirs []string
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		dirs = append(dirs, filepath.Join(xdg, "github-copilot"))
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		if len(dirs) > 0 {
+			return dirs, nil
+		}
+		return nil, err
+	}
+	if dir := filepath.Join(home, ".config", "github-copilot"); len(dirs) == 0 || dirs[0] != dir {
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// copilotConfigPaths returns the credential files of the GitHub Copilot clients
+func copilotConfigPaths() ([]string, error) {
+	dirs, err := copilotConfigDirs()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, dir := range dirs {
+		for _, name := range copilotConfigFiles {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	return paths, nil
+}
+
+// discoverCopilotCredentials reads every token from the config files of the
+// GitHub Copilot clients. Unreadable and malformed files are skipped.
+func discoverCopilotCredentials() ([]copilotCredential, error) {
+	paths, err := copilotConfigPaths()
+	if err != nil {
+		return nil, err
+	}
+	var credentials []copilotCredential
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		credentials = append(credentials, parseCopilotConfig(data, path, info.ModTime())...)
+	}
+	return credentials, nil
+}
+
+// parseCopilotConfig extracts the tokens of a config file in any of the known
+// layouts:
+//   - legacy: {"tokens": {"<provider>": {"token": "tid=...", "expires_at": ...}}}
+//   - per host: {"github.com": {"user": "...", "oauth_token": "gho_..."}}
+//   - versioned: {"version": 2, "hosts": {"github.com": {...}}}, where the
+//     per-host entries are nested under "hosts" or "apps"
+func parseCopilotConfig(data []byte, path string, updatedAt time.Time) []copilotCredential {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil
+	}
+
+	var credentials []copilotCredential
+	add := func(host string, raw json.RawMessage) {
+		var entry copilotConfigEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return
+		}
+		if entry.OAuthToken != "" && host != "" {
+			credentials = append(credentials, copilotCredential{Path: path, Host: host, OAuthToken: entry.OAuthToken, UpdatedAt: updatedAt})
+		}
+		if entry.Token != "" {
+			credentials = append(credentials, copilotCredential{Path: path, Host: host, APIKey: entry.Token, ExpiresAt: copilotTokenExpiry(entry.Token, entry.ExpiresAt), UpdatedAt: updatedAt})
+		}
+	}
+	addAll := func(raw json.RawMessage, keyedByHost bool) {
+		var entries map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return
+		}
+		for key, entry := range entries {
+			host := ""
+			if keyedByHost {
+				host, _, _ = strings.Cut(key, ":")
+			}
+			add(host, entry)
+		}
+	}
+
+	if _, versioned := top["version"]; versioned {
+		for _, key := range []string{"hosts", "apps"} {
+			if raw, ok := top[key]; ok {
+				addAll(raw, true)
+			}
+		}
+		return credentials
+	}
+	if raw, ok := top["tokens"]; ok {
+		addAll(raw, false)
+		return credentials
+	}
+	for key, raw := range top {
+		host, _, _ := strings.Cut(key, ":")
+		add(host, raw)
+	}
+	return credentials
+}
+
+// copilotTokenExpiry returns when a Copilot API key expires: the exp field of
+// the key or, for keys without one, the expires_at of its config entry
+func copilotTokenExpiry(token string, expiresAt int64) time.Time {
+	if fields, err := ParseCopilotToken(token); err == nil {
+		if exp, err := strconv.ParseInt(fields["exp"], 10, 64); err == nil {
+			return time.Unix(exp, 0)
+		}
+	}
+	if expiresAt > 0 {
+		return time.Unix(expiresAt, 0)
+	}
+	return time.Time{}
+}
+
+// freshestAPIKey returns the unexpired API key that expires last. Keys
+// without a known expiry are only used if no key with one is found.
+func freshestAPIKey(credentials []copilotCredential, now time.Time) (copilotCredential, bool) {
+	var best copilotCredential
+	found := false
+	for _, c := range credentials {
+		if c.APIKey == "" || (!c.ExpiresAt.IsZero() && !c.ExpiresAt.After(now)) {
+			continue
+		}
+		if !found || c.ExpiresAt.After(best.ExpiresAt) ||
+			(c.ExpiresAt.Equal(best.ExpiresAt) && c.UpdatedAt.After(best.UpdatedAt)) {
+			best, found = c, true
+		}
+	}
+	return best, found
+}
+
+// freshestOAuthToken returns the OAuth token for host from the most recently
+// written config file
+func freshestOAuthToken(credentials []copilotCredential, host string) (copilotCredential, bool) {
+	var best copilotCredential
+	found := false
+	for _, c := range credentials {
+		if c.OAuthToken == "" || c.Host != host {
+			continue
+		}
+		if !found || c.UpdatedAt.After(best.UpdatedAt) {
+			best, found = c, true
+		}
+	}
+	return best, found
+}
+
+// getPluginOAuthToken returns the OAuth token a GitHub Copilot editor plugin
+// (VS Code, JetBrains IDEs, Vim) signed in with for the configured GitHub
+// host, and the file it was read from
+func getPluginOAuthToken() (string, string, error) {
+	credentials, err := discoverCopilotCredentials()
+	if err != nil {
+		return "", "", err
+	}
+	host := GitHubHost()
+	if c, ok := freshestOAuthToken(credentials, host); ok {
+		return c.OAuthToken, c.Path, nil
+	}
+	return "", "", fmt.Errorf("no GitHub Copilot plugin signed in to %s", host)
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// CopilotCredentials are the tokens the GitHub Copilot editor plugins
+// currently provide for the configured GitHub host
+type CopilotCredentials struct {
+	// APIKey is the unexpired Copilot API key that expires last and
+	// APIKeyPath the file it was read from
+	APIKey     string
+	APIKeyPath string
+	// OAuthToken is the most recently written OAuth token and
+	// OAuthTokenPath the file it was read from
+	OAuthToken     string
+	OAuthTokenPath string
+}
+
+// ReadCopilotCredentials returns the tokens found in the config files of the
+// GitHub Copilot plugins; fields are empty when no such token is found
+func ReadCopilotCredentials() (CopilotCredentials, error) {
+	credentials, err := discoverCopilotCredentials()
+	if err != nil {
+		return CopilotCredentials{}, err
+	}
+	var c CopilotCredentials
+	if apiKey, ok := freshestAPIKey(credentials, time.Now()); ok {
+		c.APIKey, c.APIKeyPath = apiKey.APIKey, apiKey.Path
+	}
+	if oauthToken, ok := freshestOAuthToken(credentials, GitHubHost()); ok {
+		c.OAuthToken, c.OAuthTokenPath = oauthToken.OAuthToken, oauthToken.Path
+	}
+	return c, nil
+}
+
+// copilotConfigState identifies a version of a config file; a missing file
+// has the zero state
+type copilotConfigState struct {
+	modTime time.Time
+	size    int64
+}
+
+// copilotConfigStates returns the state of every config file
+func copilotConfigStates(paths []string) map[string]copilotConfigState {
+	states := make(map[string]copilotConfigState, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			states[path] = copilotConfigState{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return states
+}
+
+// WatchCopilotConfig checks the config files of the GitHub Copilot plugins
+// every interval until ctx is canceled, and calls onChange when a plugin
+// wrote an API key or OAuth token other than the ones found when watching
+// started or last reported. The files are polled because editors replace
+// them rather than writing in place, and the directories may not exist yet.
+func WatchCopilotConfig(ctx context.Context, interval time.Duration, onChange func(CopilotCredentials)) error {
+	paths, err := copilotConfigPaths()
+	if err != nil {
+		return err
+	}
+	states := copilotConfigStates(paths)
+	last, _ := ReadCopilotCredentials()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current := copilotConfigStates(paths)
+			if sameCopilotConfigStates(states, current) {
+				continue
+			}
+			states = current
+			credentials, err := ReadCopilotCredentials()
+			if err != nil || (credentials.APIKey == last.APIKey && credentials.OAuthToken == last.OAuthToken) {
+				continue
+			}
+			last = credentials
+			onChange(credentials)
+		}
+	}()
+	return nil
+}
+
+// sameCopilotConfigStates reports whether no config file was created,
+// written or removed between two checks
+func sameCopilotConfigStates(a, b map[string]copilotConfigState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		if other, ok := b[path]; !ok || !other.modTime.Equal(state.modTime) || other.size != state.size {
+			return false
+		}
+	}
+	return true
+}
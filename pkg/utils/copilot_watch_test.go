@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWatchCopilotConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GITHUB_HOST", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan CopilotCredentials, 10)
+	if err := WatchCopilotConfig(ctx, 10*time.Millisecond, func(c CopilotCredentials) { changes <- c }); err != nil {
+		t.Fatal(err)
+	}
+	next := func() CopilotCredentials {
+		t.Helper()
+		select {
+		case c := <-changes:
+			return c
+		case <-time.After(2 * time.Second):
+			t.Fatal("no change reported")
+			return CopilotCredentials{}
+		}
+	}
+
+	// The plugin signs in after watching started; the directory is created
+	dir := filepath.Join(home, ".config", "github-copilot")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "apps.json")
+	if err := os.WriteFile(path, []byte(`{"github.com:Iv1.app": {"user": "octocat", "oauth_token": "ghu_first"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if c := next(); c.OAuthToken != "ghu_first" || c.OAuthTokenPath != path {
+		t.Errorf("first change = %+v", c)
+	}
+
+	// A refreshed token is reported, and so is an API key written next to it
+	exp := time.Now().Add(time.Hour).Unix()
+	config := `{"github.com:Iv1.app": {"user": "octocat", "oauth_token": "ghu_refreshed", "token": "tid=abc;exp=` + strconv.FormatInt(exp, 10) + `", "expires_at": ` + strconv.FormatInt(exp, 10) + `}}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if c := next(); c.OAuthToken != "ghu_refreshed" || c.APIKey != "tid=abc;exp="+strconv.FormatInt(exp, 10) {
+		t.Errorf("refresh = %+v", c)
+	}
+
+	// Writing the same tokens again is not a change
+	os.WriteFile(path, []byte(config+"\n"), 0o600)
+	select {
+	case c := <-changes:
+		t.Errorf("unchanged tokens reported: %+v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Nothing is reported once the context is canceled
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	os.Remove(path)
+	select {
+	case c := <-changes:
+		t.Errorf("change reported after cancel: %+v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
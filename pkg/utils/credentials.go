@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+)
+
+// credentialService names the entries in the system keychain
+const credentialService = "copilot-proxy"
+
+// Keychain accounts of the stored credentials
+const (
+	oauthTokenAccount    = "github-oauth-token"
+	copilotAPIKeyAccount = "copilot-api-key"
+)
+
+// ErrKeychainDisabled is returned when TOKEN_STORE disables the keychain
+var ErrKeychainDisabled = errors.New("keychain disabled by TOKEN_STORE")
+
+// tokenStore returns the credential store selected by TOKEN_STORE:
+// "keychain" (macOS Keychain, Windows Credential Manager or the Secret
+// Service via libsecret), "file" or "auto", the default, which uses the
+// keychain when it is available and falls back to files otherwise.
+func tokenStore() string {
+	switch store := strings.ToLower(os.Getenv("TOKEN_STORE")); store {
+	case "keychain", "file":
+		return store
+	default:
+		return "auto"
+	}
+}
+
+// keychainGet reads a credential from the system keychain
+func keychainGet(account string) (string, error) {
+	if tokenStore() == "file" {
+		return "", ErrKeychainDisabled
+	}
+	return keyring.Get(credentialService, account)
+}
+
+// keychainSet stores a credential in the system keychain
+func keychainSet(account, secret string) error {
+	if tokenStore() == "file" {
+		return ErrKeychainDisabled
+	}
+	if err := keyring.Set(credentialService, account, secret); err != nil {
+		return fmt.Errorf("failed to store credential in the system keychain: %w", err)
+	}
+	return nil
+}
+
+// SaveCopilotAPIKey caches a Copilot API key in the system keychain so later
+// runs can reuse it until it expires. Without a keychain nothing is cached;
+// an error is only returned if TOKEN_STORE requires the keychain.
+func SaveCopilotAPIKey(apiKey string) error {
+	err := keychainSet(copilotAPIKeyAccount, apiKey)
+	if err != nil && tokenStore() != "keychain" {
+		return nil
+	}
+	return err
+}
+
+// GetCachedCopilotAPIKey returns the Copilot API key cached by
+// SaveCopilotAPIKey if it has not expired yet
+func GetCachedCopilotAPIKey() (string, error) {
+	apiKey, err := keychainGet(copilotAPIKeyAccount)
+	if err != nil {
+		return "", err
+	}
+	if !ValidateCopilotToken(apiKey) {
+		return "", errors.New("cached Copilot API key has expired")
+	}
+	return apiKey, nil
+}
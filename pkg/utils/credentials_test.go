@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zalando/go-keyring"
+)
+
+func TestSaveCopilotOAuthToken(t *testing.T) {
+	keyring.MockInit()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("COPILOT_OAUTH_TOKEN", "")
+	t.Setenv("OAUTH_TOKEN", "")
+	path, _ := OAuthTokenPath()
+
+	t.Setenv("TOKEN_STORE", "file")
+	if where, err := SaveCopilotOAuthToken("gho_file"); err != nil || where != path {
+		t.Fatalf("SaveCopilotOAuthToken(file) = %q, %v", where, err)
+	}
+	if token, err := GetCopilotOAuthToken(); err != nil || token != "gho_file" {
+		t.Errorf("GetCopilotOAuthToken() = %q, %v", token, err)
+	}
+
+	// Moving to the keychain removes the plaintext copy
+	t.Setenv("TOKEN_STORE", "")
+	if where, err := SaveCopilotOAuthToken("gho_keychain"); err != nil || where != "the system keychain" {
+		t.Fatalf("SaveCopilotOAuthToken(keychain) = %q, %v", where, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("plaintext token file still exists: %v", err)
+	}
+	if token, err := GetCopilotOAuthToken(); err != nil || token != "gho_keychain" {
+		t.Errorf("GetCopilotOAuthToken() = %q, %v", token, err)
+	}
+}
+
+func TestCachedCopilotAPIKey(t *testing.T) {
+	keyring.MockInit()
+	t.Setenv("TOKEN_STORE", "")
+
+	valid := fmt.Sprintf("tid=abc;exp=%d;sku=free;", time.Now().Add(time.Hour).Unix())
+	if err := SaveCopilotAPIKey(valid); err != nil {
+		t.Fatalf("SaveCopilotAPIKey() error = %v", err)
+	}
+	if key, err := GetCachedCopilotAPIKey(); err != nil || key != valid {
+		t.Errorf("GetCachedCopilotAPIKey() = %q, %v", key, err)
+	}
+
+	expired := fmt.Sprintf("tid=abc;exp=%d;sku=free;", time.Now().Add(-time.Hour).Unix())
+	SaveCopilotAPIKey(expired)
+	if _, err := GetCachedCopilotAPIKey(); err == nil {
+		t.Error("GetCachedCopilotAPIKey() returned an expired key")
+	}
+
+	t.Setenv("TOKEN_STORE", "file")
+	if _, err := GetCachedCopilotAPIKey(); err != ErrKeychainDisabled {
+		t.Errorf("GetCachedCopilotAPIKey() with TOKEN_STORE=file error = %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultEditorVersion and DefaultEditorPluginVersion are known-good
+// versions sent to the Copilot API when no local VS Code installation or
+// Copilot Chat extension is found
+const (
+	DefaultEditorVersion       = "vscode/1.99.2"
+	DefaultEditorPluginVersion = "copilot-chat/0.26.3"
+)
+
+// copilotChatExtension is the ID of the Copilot Chat extension, the prefix
+// of its directories in the VS Code extensions directory
+const copilotChatExtension = "github.copilot-chat"
+
+var (
+	editorVersionsOnce    sync.Once
+	detectedEditor        string
+	detectedEditorPlugin  string
+	vscodeInstallPaths    = defaultVSCodeInstallPaths
+	vscodeExtensionsPaths = defaultVSCodeExtensionsPaths
+)
+
+// EditorVersions returns the Editor-Version and Editor-Plugin-Version sent to
+// the Copilot API: EDITOR_VERSION and EDITOR_PLUGIN_VERSION when set, else
+// the versions of the locally installed VS Code and Copilot Chat extension,
+// else DefaultEditorVersion and DefaultEditorPluginVersion. Detection runs
+// once and is skipped when DETECT_EDITOR_VERSIONS is false.
+func EditorVersions() (editor, plugin string) {
+	editorVersionsOnce.Do(func() {
+		detectedEditor, detectedEditorPlugin = DefaultEditorVersion, DefaultEditorPluginVersion
+		if detect, err := strconv.ParseBool(os.Getenv("DETECT_EDITOR_VERSIONS")); err == nil && !detect {
+			return
+		}
+		if version := detectVSCodeVersion(); version != "" {
+			detectedEditor = "vscode/" + version
+		}
+		if version := detectCopilotChatVersion(); version != "" {
+			detectedEditorPlugin = "copilot-chat/" + version
+		}
+	})
+	editor, plugin = detectedEditor, detectedEditorPlugin
+	if v := os.Getenv("EDITOR_VERSION"); v != "" {
+		editor = v
+	}
+	if v := os.Getenv("EDITOR_PLUGIN_VERSION"); v != "" {
+		plugin = v
+	}
+	return editor, plugin
+}
+
+// defaultVSCodeInstallPaths returns the application directories of the
+// usual VS Code installations of the platform
+func defaultVSCodeInstallPaths() []string {
+	switch runtime.GOOS {
+	case "windows":
+		var paths []string
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			paths = append(paths, filepath.Join(dir, "Programs", "Microsoft VS Code", "resources", "app"))
+		}
+		if dir := os.Getenv("ProgramFiles"); dir != "" {
+			paths = append(paths, filepath.Join(dir, "Microsoft VS Code", "resources", "app"))
+		}
+		return paths
+	case "darwin":
+		paths := []string{"/Applications/Visual Studio Code.app/Contents/Resources/app"}
+		if home, err := os.UserHomeDir(); err == nil {
+			paths = append(paths, filepath.Join(home, "Applications", "Visual Studio Code.app", "Contents", "Resources", "app"))
+		}
+		return paths
+	default:
+		return []string{
+			"/usr/share/code/resources/app",
+			"/usr/lib/code/resources/app",
+			"/opt/visual-studio-code/resources/app",
+			"/snap/code/current/usr/share/code/resources/app",
+			"/var/lib/flatpak/app/com.visualstudio.code/current/active/files/extra/vscode/resources/app",
+		}
+	}
+}
+
+// defaultVSCodeExtensionsPaths returns the directories VS Code and VS Code
+// Server install extensions into
+func defaultVSCodeExtensionsPaths() []string {
+	if dir := os.Getenv("VSCODE_EXTENSIONS"); dir != "" {
+		return []string{dir}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	return []string{
+		filepath.Join(home, ".vscode", "extensions"),
+		filepath.Join(home, ".vscode-server", "extensions"),
+	}
+}
+
+// packageVersion reads the version of the package.json in dir
+func packageVersion(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return ""
+	}
+	var pkg struct {
+		Version string `json:"version"`
+	}
+	if json.Unmarshal(data, &pkg) != nil || parseVersion(pkg.Version) == nil {
+		return ""
+	}
+	return pkg.Version
+}
+
+// detectVSCodeVersion returns the version of the first VS Code installation
+// found, or "" if there is none
+func detectVSCodeVersion() string {
+	for _, dir := range vscodeInstallPaths() {
+		if version := packageVersion(dir); version != "" {
+			return version
+		}
+	}
+	return ""
+}
+
+// detectCopilotChatVersion returns the newest installed version of the
+// Copilot Chat extension, or "" if it is not installed. Extension
+// directories are named <id>-<version>, optionally followed by a platform.
+func detectCopilotChatVersion() string {
+	var best string
+	for _, dir := range vscodeExtensionsPaths() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || !strings.HasPrefix(entry.Name(), copilotChatExtension+"-") {
+				continue
+			}
+			version := packageVersion(filepath.Join(dir, entry.Name()))
+			if version == "" {
+				version, _, _ = strings.Cut(strings.TrimPrefix(entry.Name(), copilotChatExtension+"-"), "-")
+			}
+			if parseVersion(version) != nil && (best == "" || compareVersions(version, best) > 0) {
+				best = version
+			}
+		}
+	}
+	return best
+}
+
+// parseVersion returns the numeric parts of a version such as 1.99.2, or nil
+// if it is not one
+func parseVersion(version string) []int {
+	fields := strings.Split(version, ".")
+	if len(fields) < 2 {
+		return nil
+	}
+	parts := make([]int, len(fields))
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil
+		}
+		parts[i] = n
+	}
+	return parts
+}
+
+// compareVersions compares two versions accepted by parseVersion
+func compareVersions(a, b string) int {
+	pa, pb := parseVersion(a), parseVersion(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
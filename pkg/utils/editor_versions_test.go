@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestEditorVersions(t *testing.T) {
+	dir := t.TempDir()
+	install := filepath.Join(dir, "code", "resources", "app")
+	extensions := filepath.Join(dir, "extensions")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restore := func() {
+		editorVersionsOnce = sync.Once{}
+		vscodeInstallPaths, vscodeExtensionsPaths = defaultVSCodeInstallPaths, defaultVSCodeExtensionsPaths
+	}
+	defer restore()
+	detect := func() (string, string) {
+		editorVersionsOnce = sync.Once{}
+		vscodeInstallPaths = func() []string { return []string{filepath.Join(dir, "missing"), install} }
+		vscodeExtensionsPaths = func() []string { return []string{extensions} }
+		return EditorVersions()
+	}
+	t.Setenv("EDITOR_VERSION", "")
+	t.Setenv("EDITOR_PLUGIN_VERSION", "")
+	t.Setenv("DETECT_EDITOR_VERSIONS", "")
+
+	// Nothing installed: the known-good versions
+	if editor, plugin := detect(); editor != DefaultEditorVersion || plugin != DefaultEditorPluginVersion {
+		t.Errorf("EditorVersions() without VS Code = %q, %q", editor, plugin)
+	}
+
+	write(filepath.Join(install, "package.json"), `{"name": "code-oss-dev", "version": "1.104.1"}`)
+	write(filepath.Join(extensions, "github.copilot-chat-0.9.0", "package.json"), `{"version": "0.9.0"}`)
+	write(filepath.Join(extensions, "github.copilot-chat-0.31.2", "package.json"), `{"version": "0.31.2"}`)
+	// A platform-specific build without a readable package.json
+	if err := os.MkdirAll(filepath.Join(extensions, "github.copilot-chat-0.31.10-linux-x64"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(extensions, "github.copilot-1.999.0", "package.json"), `{"version": "1.999.0"}`)
+	if editor, plugin := detect(); editor != "vscode/1.104.1" || plugin != "copilot-chat/0.31.10" {
+		t.Errorf("EditorVersions() = %q, %q, want the installed versions", editor, plugin)
+	}
+
+	// The environment overrides detection
+	t.Setenv("EDITOR_PLUGIN_VERSION", "copilot-chat/0.20.0")
+	if editor, plugin := detect(); editor != "vscode/1.104.1" || plugin != "copilot-chat/0.20.0" {
+		t.Errorf("EditorVersions() with EDITOR_PLUGIN_VERSION = %q, %q", editor, plugin)
+	}
+	t.Setenv("EDITOR_PLUGIN_VERSION", "")
+
+	t.Setenv("DETECT_EDITOR_VERSIONS", "false")
+	if editor, plugin := detect(); editor != DefaultEditorVersion || plugin != DefaultEditorPluginVersion {
+		t.Errorf("EditorVersions() with detection disabled = %q, %q", editor, plugin)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.99.2", "1.99.2", 0},
+		{"1.100.0", "1.99.2", 1},
+		{"0.26.3", "0.26.10", -1},
+		{"1.2", "1.2.0", 0},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"os"
+	"strings"
+)
+
+// GitHubHost returns the GitHub instance Copilot is licensed through, set with
+// GITHUB_HOST for GitHub Enterprise Server or GHE.com (default: github.com)
+func GitHubHost() string {
+	host := strings.TrimSpace(os.Getenv("GITHUB_HOST"))
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host = strings.TrimRight(host, "/")
+	if host == "" {
+		return "github.com"
+	}
+	return host
+}
+
+// GitHubWebURL returns the base URL of the GitHub web interface, which serves
+// the OAuth endpoints
+func GitHubWebURL() string {
+	return "https://" + GitHubHost()
+}
+
+// GitHubAPIURL returns the base URL of the GitHub REST API: GITHUB_API_URL if
+// set, otherwise https://api.github.com, https://api.<tenant>.ghe.com for
+// GHE.com or https://<host>/api/v3 for GitHub Enterprise Server
+func GitHubAPIURL() string {
+	if apiURL := strings.TrimSpace(os.Getenv("GITHUB_API_URL")); apiURL != "" {
+		return strings.TrimRight(apiURL, "/")
+	}
+	host := GitHubHost()
+	switch {
+	case host == "github.com":
+		return "https://api.github.com"
+	case strings.HasSuffix(host, ".ghe.com"):
+		return "https://api." + host
+	default:
+		return "https://" + host + "/api/v3"
+	}
+}
+
+// CopilotAPIURL returns the Copilot API base URL set with COPILOT_API_URL.
+// It is empty by default, in which case the proxy-ep endpoint of the Copilot
+// API key is used.
+func CopilotAPIURL() string {
+	return strings.TrimRight(strings.TrimSpace(os.Getenv("COPILOT_API_URL")), "/")
+}
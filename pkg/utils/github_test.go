@@ -0,0 +1,38 @@
+package utils
+
+import "testing"
+
+func TestGitHubAPIURL(t *testing.T) {
+	tests := []struct {
+		name, host, apiURL string
+		wantWeb, wantAPI   string
+	}{
+		{"github.com", "", "", "https://github.com", "https://api.github.com"},
+		{"GHE.com", "octocorp.ghe.com", "", "https://octocorp.ghe.com", "https://api.octocorp.ghe.com"},
+		{"GHE Server", "https://github.example.com/", "", "https://github.example.com", "https://github.example.com/api/v3"},
+		{"explicit API URL", "github.example.com", "https://gh-api.example.com/", "https://github.example.com", "https://gh-api.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GITHUB_HOST", tt.host)
+			t.Setenv("GITHUB_API_URL", tt.apiURL)
+			if got := GitHubWebURL(); got != tt.wantWeb {
+				t.Errorf("GitHubWebURL() = %q, want %q", got, tt.wantWeb)
+			}
+			if got := GitHubAPIURL(); got != tt.wantAPI {
+				t.Errorf("GitHubAPIURL() = %q, want %q", got, tt.wantAPI)
+			}
+		})
+	}
+}
+
+func TestGetProxyURL(t *testing.T) {
+	t.Setenv("COPILOT_API_URL", "")
+	if got := getProxyURL("tid=1;proxy-ep=proxy.enterprise.githubcopilot.com;", "/chat/completions"); got != "https://proxy.enterprise.githubcopilot.com/chat/completions" {
+		t.Errorf("getProxyURL(proxy-ep) = %q", got)
+	}
+	t.Setenv("COPILOT_API_URL", "https://copilot.example.com/")
+	if got := getProxyURL("tid=1;proxy-ep=proxy.enterprise.githubcopilot.com;", "/chat/completions"); got != "https://copilot.example.com/chat/completions" {
+		t.Errorf("getProxyURL(COPILOT_API_URL) = %q", got)
+	}
+}
@@ -0,0 +1,287 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp in the names of rotated log files
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// LogRotation configures when a log file is rotated and how many of the
+// rotated files are kept. Zero values disable the respective limit.
+type LogRotation struct {
+	// MaxSize is the size in bytes a log file may grow to
+	MaxSize int64
+	// Interval is how long a log file is written to
+	Interval time.Duration
+	// MaxBackups is how many rotated files are kept
+	MaxBackups int
+	// MaxAge is how long rotated files are kept
+	MaxAge time.Duration
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// LogRotationFromEnv reads LOG_MAX_SIZE (e.g. 100MB), LOG_ROTATE_INTERVAL,
+// LOG_MAX_BACKUPS, LOG_MAX_AGE and LOG_COMPRESS
+func LogRotationFromEnv() (LogRotation, error) {
+	var r LogRotation
+	var err error
+	if v := strings.TrimSpace(os.Getenv("LOG_MAX_SIZE")); v != "" {
+		if r.MaxSize, err = ParseByteSize(v); err != nil {
+			return r, fmt.Errorf("invalid LOG_MAX_SIZE %q", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("LOG_ROTATE_INTERVAL")); v != "" {
+		if r.Interval, err = time.ParseDuration(v); err != nil || r.Interval < 0 {
+			return r, fmt.Errorf("invalid LOG_ROTATE_INTERVAL %q", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("LOG_MAX_BACKUPS")); v != "" {
+		if r.MaxBackups, err = strconv.Atoi(v); err != nil || r.MaxBackups < 0 {
+			return r, fmt.Errorf("invalid LOG_MAX_BACKUPS %q", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("LOG_MAX_AGE")); v != "" {
+		if r.MaxAge, err = time.ParseDuration(v); err != nil || r.MaxAge < 0 {
+			return r, fmt.Errorf("invalid LOG_MAX_AGE %q", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("LOG_COMPRESS")); v != "" {
+		if r.Compress, err = strconv.ParseBool(v); err != nil {
+			return r, fmt.Errorf("invalid LOG_COMPRESS %q", v)
+		}
+	}
+	return r, nil
+}
+
+// ParseByteSize parses a size such as 512, 64KB, 100MB or 1GB. The units
+// are powers of 1024.
+func ParseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		bytes  int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// LogFile is a log file that rotates itself. When it would grow beyond the
+// maximum size or has been written to for the rotation interval, it is
+// renamed to name-<timestamp>.ext, next to the file, and a new file is
+// started. Rotated files are compressed and the ones beyond the retention
+// limits removed in the background. Reopen supports external rotation.
+type LogFile struct {
+	path     string
+	rotation LogRotation
+	// now is the clock, replaced in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time
+
+	// millMu serializes compressing and removing rotated files
+	millMu sync.Mutex
+	mills  sync.WaitGroup
+}
+
+// OpenLogFile opens path for appending with the given rotation
+func OpenLogFile(path string, rotation LogRotation) (*LogFile, error) {
+	l := &LogFile{path: path, rotation: rotation, now: time.Now}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write appends to the current file, rotating it first when due. If the
+// rotation fails, the error is noted in the file, which is written to for
+// another interval.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rotationDue(len(p)) {
+		if err := l.rotate(); err != nil {
+			l.started = l.now()
+			fmt.Fprintf(l.file, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotationDue reports whether the file must be rotated before n more bytes
+// are written. An empty file is never rotated.
+func (l *LogFile) rotationDue(n int) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.rotation.MaxSize > 0 && l.size+int64(n) > l.rotation.MaxSize {
+		return true
+	}
+	return l.rotation.Interval > 0 && l.now().Sub(l.started) >= l.rotation.Interval
+}
+
+// rotate renames the current file to a backup and starts a new one
+func (l *LogFile) rotate() error {
+	now := l.now()
+	ext := filepath.Ext(l.path)
+	backup := strings.TrimSuffix(l.path, ext) + "-" + now.UTC().Format(backupTimeFormat) + ext
+	if err := os.Rename(l.path, backup); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.mills.Add(1)
+	go func() {
+		defer l.mills.Done()
+		l.mill(now)
+	}()
+	return nil
+}
+
+// Reopen closes the file and opens path again, creating it if it was moved
+func (l *LogFile) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.open()
+}
+
+// open replaces the current file with path
+func (l *LogFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, l.size, l.started = file, size, l.now()
+	return nil
+}
+
+// Close closes the file and waits for rotated files to be compressed
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	err := l.file.Close()
+	l.mu.Unlock()
+	l.mills.Wait()
+	return err
+}
+
+// logBackup is a rotated log file
+type logBackup struct {
+	path string
+	time time.Time
+}
+
+// backups returns the rotated files of the log, newest first
+func (l *LogFile) backups() ([]logBackup, error) {
+	dir := filepath.Dir(l.path)
+	ext := filepath.Ext(l.path)
+	prefix := strings.TrimSuffix(filepath.Base(l.path), ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []logBackup
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, prefix)
+		stamp = strings.TrimSuffix(stamp, ".gz")
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		t, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, ext))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, logBackup{path: filepath.Join(dir, name), time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].time.After(backups[j].time) })
+	return backups, nil
+}
+
+// mill removes the rotated files beyond MaxBackups or older than MaxAge at
+// now and compresses the remaining ones if enabled. Failures are written to
+// the log file, since the log writes to it.
+func (l *LogFile) mill(now time.Time) {
+	l.millMu.Lock()
+	defer l.millMu.Unlock()
+	backups, err := l.backups()
+	if err != nil {
+		l.Write([]byte(fmt.Sprintf("failed to list rotated log files: %v\n", err)))
+		return
+	}
+	for i, backup := range backups {
+		expired := l.rotation.MaxAge > 0 && now.Sub(backup.time) > l.rotation.MaxAge
+		if (l.rotation.MaxBackups > 0 && i >= l.rotation.MaxBackups) || expired {
+			if err := os.Remove(backup.path); err != nil && !os.IsNotExist(err) {
+				l.Write([]byte(fmt.Sprintf("failed to remove rotated log file: %v\n", err)))
+			}
+			continue
+		}
+		if l.rotation.Compress && !strings.HasSuffix(backup.path, ".gz") {
+			if err := compressFile(backup.path); err != nil {
+				l.Write([]byte(fmt.Sprintf("failed to compress rotated log file: %v\n", err)))
+			}
+		}
+	}
+}
+
+// compressFile gzips path to path.gz and removes path
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	in.Close()
+	return os.Remove(path)
+}
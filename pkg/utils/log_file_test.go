@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]int64{"512": 512, "64KB": 64 << 10, "100mb": 100 << 20, "1G": 1 << 30, "10 MB": 10 << 20}
+	for input, want := range tests {
+		if got, err := ParseByteSize(input); err != nil || got != want {
+			t.Errorf("ParseByteSize(%q) = %d, %v, want %d", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"", "MB", "-1KB", "1TB"} {
+		if _, err := ParseByteSize(input); err == nil {
+			t.Errorf("ParseByteSize(%q) should fail", input)
+		}
+	}
+}
+
+func TestLogRotationFromEnv(t *testing.T) {
+	t.Setenv("LOG_MAX_SIZE", "10MB")
+	t.Setenv("LOG_ROTATE_INTERVAL", "24h")
+	t.Setenv("LOG_MAX_BACKUPS", "5")
+	t.Setenv("LOG_MAX_AGE", "168h")
+	t.Setenv("LOG_COMPRESS", "true")
+	r, err := LogRotationFromEnv()
+	want := LogRotation{MaxSize: 10 << 20, Interval: 24 * time.Hour, MaxBackups: 5, MaxAge: 168 * time.Hour, Compress: true}
+	if err != nil || r != want {
+		t.Errorf("LogRotationFromEnv() = %+v, %v, want %+v", r, err, want)
+	}
+
+	t.Setenv("LOG_MAX_BACKUPS", "some")
+	if _, err := LogRotationFromEnv(); err == nil {
+		t.Error("LogRotationFromEnv() with an invalid LOG_MAX_BACKUPS should fail")
+	}
+}
+
+// logFiles returns the names of the files in dir
+func logFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestLogFileRotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "coproxy.log")
+	os.WriteFile(path, []byte("old line\n"), 0o600)
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	l, err := OpenLogFile(path, LogRotation{MaxSize: 20, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("OpenLogFile() error = %v", err)
+	}
+	l.now = func() time.Time { return now }
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		l.Write([]byte("0123456789\n"))
+	}
+	l.Close()
+
+	// Each write after the first rotates the file; only two backups are kept
+	names := logFiles(t, dir)
+	want := []string{"coproxy-2026-01-02T03-04-08.000.log.gz", "coproxy-2026-01-02T03-04-09.000.log.gz", "coproxy.log"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "0123456789\n" {
+		t.Errorf("current file = %q", data)
+	}
+	file, _ := os.Open(filepath.Join(dir, want[1]))
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(gz); string(data) != "0123456789\n" {
+		t.Errorf("compressed backup = %q", data)
+	}
+}
+
+func TestLogFileRotatesByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "coproxy.log")
+	now := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	// An expired backup from an earlier run and one still kept
+	os.WriteFile(filepath.Join(dir, "coproxy-2025-12-01T00-00-00.000.log"), nil, 0o600)
+	os.WriteFile(filepath.Join(dir, "coproxy-2026-01-01T00-00-00.000.log"), nil, 0o600)
+	os.WriteFile(filepath.Join(dir, "other.log"), nil, 0o600)
+
+	l, err := OpenLogFile(path, LogRotation{Interval: time.Hour, MaxAge: 7 * 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("OpenLogFile() error = %v", err)
+	}
+	l.now = func() time.Time { return now }
+	l.started = now
+	l.Write([]byte("first\n"))
+	now = now.Add(30 * time.Minute)
+	l.Write([]byte("second\n"))
+	now = now.Add(30 * time.Minute)
+	l.Write([]byte("third\n"))
+	l.Close()
+
+	names := logFiles(t, dir)
+	want := []string{"coproxy-2026-01-01T00-00-00.000.log", "coproxy-2026-01-02T01-00-00.000.log", "coproxy.log", "other.log"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, want[1])); string(data) != "first\nsecond\n" {
+		t.Errorf("backup = %q", data)
+	}
+}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// UpstreamProxyURL returns the proxy set in UPSTREAM_PROXY, e.g.
+// "http://proxy.corp.example:3128". A URL without a scheme is taken as an
+// HTTP proxy.
+func UpstreamProxyURL() (*url.URL, error) {
+	value := strings.TrimSpace(os.Getenv("UPSTREAM_PROXY"))
+	if value == "" {
+		return nil, nil
+	}
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid UPSTREAM_PROXY %q", os.Getenv("UPSTREAM_PROXY"))
+	}
+	return proxyURL, nil
+}
+
+// ProxyFunc selects the proxy for upstream requests (token exchange, models,
+// completions): UPSTREAM_PROXY for every host not excluded by NO_PROXY or,
+// without it, HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment.
+func ProxyFunc() func(*http.Request) (*url.URL, error) {
+	proxyURL, err := UpstreamProxyURL()
+	if err != nil {
+		return func(*http.Request) (*url.URL, error) { return nil, err }
+	}
+	if proxyURL == nil {
+		return http.ProxyFromEnvironment
+	}
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(noProxy, req.URL) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+}
+
+// NewUpstreamTransport returns a copy of http.DefaultTransport that sends
+// requests through the proxy chosen by ProxyFunc
+func NewUpstreamTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = ProxyFunc()
+	return transport
+}
+
+// NewUpstreamClient returns an HTTP client for upstream requests that honors
+// the proxy settings
+func NewUpstreamClient() *http.Client {
+	return &http.Client{Transport: NewUpstreamTransport()}
+}
+
+// bypassProxy reports whether a NO_PROXY list excludes u. Entries are host
+// names, which also match their subdomains (a leading "." is optional), IP
+// addresses, CIDR ranges or "*", each optionally followed by a port.
+// Loopback addresses are never proxied.
+func bypassProxy(noProxy string, u *url.URL) bool {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		host := strings.ToLower(host)
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
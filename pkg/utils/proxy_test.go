@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestBypassProxy(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		target  string
+		want    bool
+	}{
+		{"", "https://api.githubcopilot.com/chat/completions", false},
+		{"", "http://localhost:8080/", true},
+		{"", "http://127.0.0.1:8080/", true},
+		{"*", "https://api.github.com/", true},
+		{"github.com", "https://api.github.com/", true},
+		{".github.com", "https://github.com/", true},
+		{"github.com", "https://notgithub.com/", false},
+		{"github.com:443", "https://api.github.com/", true},
+		{"github.com:8443", "https://api.github.com/", false},
+		{"10.0.0.0/8, 192.168.1.5", "http://10.1.2.3/", true},
+		{"10.0.0.0/8, 192.168.1.5", "http://192.168.1.5/", true},
+		{"10.0.0.0/8, 192.168.1.5", "http://192.168.1.6/", false},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.target)
+		if got := bypassProxy(tt.noProxy, u); got != tt.want {
+			t.Errorf("bypassProxy(%q, %s) = %v, want %v", tt.noProxy, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		io.WriteString(w, "via proxy")
+	}))
+	defer proxy.Close()
+
+	t.Setenv("UPSTREAM_PROXY", proxy.Listener.Addr().String())
+	t.Setenv("NO_PROXY", "internal.example")
+	client := NewUpstreamClient()
+
+	resp, err := client.Get("http://api.githubcopilot.test/models")
+	if err != nil {
+		t.Fatalf("GET through proxy error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "via proxy" || proxied != "http://api.githubcopilot.test/models" {
+		t.Errorf("proxy saw %q and returned %q", proxied, body)
+	}
+
+	proxyFunc := ProxyFunc()
+	req, _ := http.NewRequest("GET", "https://git.internal.example/api", nil)
+	if u, err := proxyFunc(req); err != nil || u != nil {
+		t.Errorf("ProxyFunc() for a NO_PROXY host = %v, %v", u, err)
+	}
+
+	t.Setenv("UPSTREAM_PROXY", "http://[bad")
+	if _, err := UpstreamProxyURL(); err == nil {
+		t.Error("UpstreamProxyURL() accepted an invalid URL")
+	}
+	if _, err := ProxyFunc()(req); err == nil {
+		t.Error("ProxyFunc() with an invalid UPSTREAM_PROXY did not fail")
+	}
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// secretPatterns match credentials by their format: GitHub tokens, Copilot
+// API keys, the proxy's own API keys, OpenAI and Anthropic keys, JWTs and
+// bearer credentials
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\b(gh[opusr]_[A-Za-z0-9]{20,}|github_pat_[A-Za-z0-9_]{20,})\b`),
+	regexp.MustCompile(`\btid=[^\s;"']+(;[^\s"']+)?`),
+	regexp.MustCompile(`\bcpk_[0-9a-f]{16,}`),
+	regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{16,}`),
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+	regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]{8,}`),
+}
+
+// minSecretLength is the shortest registered secret that is redacted;
+// shorter values would mask ordinary words
+const minSecretLength = 8
+
+var (
+	secretsMu sync.RWMutex
+	// secrets are the configured credentials registered with RegisterSecret,
+	// longest first so that a secret containing another is masked whole
+	secrets []string
+)
+
+// RegisterSecret makes RedactSecrets mask a configured credential, such as
+// an admin token or an API key, that has no recognizable format
+func RegisterSecret(secret string) {
+	secret = strings.TrimSpace(secret)
+	if len(secret) < minSecretLength {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// RedactSecrets masks every credential in text with MaskToken: the
+// registered secrets and anything formatted like a token or key
+func RedactSecrets(text string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		if strings.Contains(text, secret) {
+			text = strings.ReplaceAll(text, secret, MaskToken(secret))
+		}
+	}
+	secretsMu.RUnlock()
+	for _, pattern := range secretPatterns {
+		text = pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if fields := strings.Fields(match); len(fields) == 2 {
+				// Keep the "Bearer" scheme readable
+				return fields[0] + " " + MaskToken(fields[1])
+			}
+			return MaskToken(match)
+		})
+	}
+	return text
+}
+
+// RedactingWriter masks credentials in everything written through it. Use it
+// as the output of the log package so that no log line leaks a secret.
+type RedactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter returns a writer that redacts secrets before writing
+// to w. Each Write should be a complete line, as the log package does.
+func NewRedactingWriter(w io.Writer) *RedactingWriter {
+	return &RedactingWriter{w: w}
+}
+
+// Write redacts p and writes it, reporting the length of p on success
+func (r *RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, RedactSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
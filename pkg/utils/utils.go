@@ -57,8 +57,12 @@ func getProxyEndpoint(apiKey string) string {
 	return "api.githubcopilot.com"
 }
 
-// getProxyURL builds a full URL for the given path using the proxy endpoint in the API key
+// getProxyURL builds a full URL for the given path using COPILOT_API_URL or
+// the proxy endpoint in the API key
 func getProxyURL(apiKey, path string) string {
+	if base := CopilotAPIURL(); base != "" {
+		return base + path
+	}
 	host := getProxyEndpoint(apiKey)
 	if strings.HasPrefix(host, "http://") || strings.HasPrefix(host, "https://") {
 		return host + path
@@ -128,10 +132,8 @@ func CallCopilotAPI(apiKey string, payload map[string]interface{}) (map[string]i
 	}
 
 	// Get environment variables for headers or use defaults
-	editorVersion := GetEnvWithDefault("EDITOR_VERSION", "vscode/1.99.2")
-	editorPluginVersion := GetEnvWithDefault("EDITOR_PLUGIN_VERSION", "copilot-chat/0.26.3")
-	vscodeMachineID := os.Getenv("VSCODE_MACHINE_ID")
-	vscodeSessionID := os.Getenv("VSCODE_SESSION_ID")
+	editorVersion, editorPluginVersion := EditorVersions()
+	vscodeMachineID, vscodeSessionID := ClientIDs()
 
 	// Generate a unique request ID
 	requestID := fmt.Sprintf("%s-%s", time.Now().Format("20060102T150405.000Z"), uuid.New().String()[:8])
@@ -159,15 +161,10 @@ func CallCopilotAPI(apiKey string, payload map[string]interface{}) (map[string]i
 	req.Header.Set("X-Interaction-Type", "conversation-agent")
 	req.Header.Set("X-Request-ID", requestID)
 
-	// Optional VS Code specific headers if available
-	if vscodeMachineID != "" {
-		req.Header.Set("Vscode-Machineid", vscodeMachineID)
-	}
-	if vscodeSessionID != "" {
-		req.Header.Set("Vscode-Sessionid", vscodeSessionID)
-	}
+	req.Header.Set("Vscode-Machineid", vscodeMachineID)
+	req.Header.Set("Vscode-Sessionid", vscodeSessionID)
 
-	client := &http.Client{}
+	client := NewUpstreamClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -266,7 +263,7 @@ func CallAPIWithBody(url string, contentType string, apiKey string, payload inte
 		}
 	}
 
-	client := &http.Client{}
+	client := NewUpstreamClient()
 	return client.Do(req)
 }
 